@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// parsePeriodBound accepts an RFC3339 time or a date (2026-09-01, UTC
+// midnight). Empty yields the zero time.
+func parsePeriodBound(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// monthStart is the first instant of t's calendar month in UTC, the default
+// start of a billing period.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// writeAccounting prints an ExportAccounting result as CSV (one row per
+// user, with the period on every row) or as one JSON document.
+func writeAccounting(w io.Writer, format string, resp *jobpb.ExportAccountingResponse) error {
+	from, to := periodString(resp.GetFrom()), periodString(resp.GetTo())
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"period_start", "period_end", "user", "jobs", "cpu_seconds", "memory_byte_seconds"})
+		for _, u := range resp.GetUsers() {
+			_ = cw.Write([]string{
+				from, to,
+				u.GetUser(),
+				strconv.Itoa(int(u.GetJobs())),
+				strconv.FormatFloat(u.GetCpuSeconds(), 'f', 3, 64),
+				strconv.FormatFloat(u.GetMemoryByteSeconds(), 'f', 0, 64),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "json":
+		type user struct {
+			User              string  `json:"user"`
+			Jobs              int32   `json:"jobs"`
+			CPUSeconds        float64 `json:"cpu_seconds"`
+			MemoryByteSeconds float64 `json:"memory_byte_seconds"`
+		}
+		out := struct {
+			PeriodStart string `json:"period_start"`
+			PeriodEnd   string `json:"period_end"`
+			Users       []user `json:"users"`
+		}{PeriodStart: from, PeriodEnd: to, Users: []user{}}
+		for _, u := range resp.GetUsers() {
+			out.Users = append(out.Users, user{u.GetUser(), u.GetJobs(), u.GetCpuSeconds(), u.GetMemoryByteSeconds()})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+
+	default:
+		return fmt.Errorf("invalid -o %q (want csv or json)", format)
+	}
+}
+
+func periodString(ts *timestamppb.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+	return ts.AsTime().UTC().Format(time.RFC3339)
+}
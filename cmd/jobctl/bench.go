@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// benchResult is what one phase of -cmd bench measured.
+type benchResult struct {
+	calls   []time.Duration // Latency of each call that succeeded
+	errors  int
+	firstEr error
+	elapsed time.Duration
+}
+
+// runBench starts n copies of spec from parallel workers, then asks each
+// one's status once, and prints the latency of both calls, and for admins
+// the server's goroutines and heap once the jobs are started. The jobs are
+// left for GC, so repeated runs measure a server holding more and more.
+func runBench(root context.Context, c *client.Client, spec client.JobSpec, n, parallel int, timeout time.Duration) {
+	if n < 1 {
+		die("-n must be at least 1")
+	}
+	if parallel < 1 {
+		die("-parallel must be at least 1")
+	}
+
+	ids := make([]string, n)
+	start := benchPhase(n, parallel, func(i int) error {
+		ctx, cancel := commandContext(root, timeout, 10*time.Second)
+		defer cancel()
+		id, err := c.Start(ctx, spec)
+		ids[i] = id
+		return err
+	})
+	printBench("StartJob", start)
+	printServerLoad(root, c, timeout)
+
+	ids = slices.DeleteFunc(ids, func(id string) bool { return id == "" })
+	if len(ids) == 0 {
+		die("no job started")
+	}
+	status := benchPhase(len(ids), parallel, func(i int) error {
+		ctx, cancel := commandContext(root, timeout, 5*time.Second)
+		defer cancel()
+		_, err := c.Status(ctx, ids[i])
+		return err
+	})
+	printBench("GetStatus", status)
+}
+
+// benchPhase runs call(0) to call(n-1) from parallel workers and times
+// each.
+func benchPhase(n, parallel int, call func(i int) error) benchResult {
+	var (
+		next atomic.Int64
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		res  = benchResult{calls: make([]time.Duration, 0, n)}
+	)
+	began := time.Now()
+	for range min(parallel, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				t := time.Now()
+				err := call(i)
+				d := time.Since(t)
+
+				mu.Lock()
+				if err != nil {
+					res.errors++
+					if res.firstEr == nil {
+						res.firstEr = err
+					}
+				} else {
+					res.calls = append(res.calls, d)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(began)
+	slices.Sort(res.calls)
+	return res
+}
+
+func printBench(name string, r benchResult) {
+	fmt.Printf("%s calls=%d errors=%d rate=%.0f/s", name, len(r.calls)+r.errors, r.errors,
+		float64(len(r.calls))/r.elapsed.Seconds())
+	if len(r.calls) > 0 {
+		fmt.Printf(" p50=%s p90=%s p99=%s max=%s",
+			percentile(r.calls, 50), percentile(r.calls, 90), percentile(r.calls, 99), percentile(r.calls, 100))
+	}
+	fmt.Println()
+	if r.firstEr != nil {
+		fmt.Printf("  first error: %v\n", r.firstEr)
+	}
+}
+
+// runStreamBench reads output n times, parallel at once, and prints the
+// throughput: job id's stdout with StreamOutput, or without id the stdout
+// of every job selector matches with StreamJobsOutput. For admins it also
+// prints what the server allocated, and how often it collected garbage,
+// per GiB sent.
+func runStreamBench(root context.Context, c *client.Client, id string, selector map[string]string, n, parallel int, timeout time.Duration) {
+	if n < 1 {
+		die("-n must be at least 1")
+	}
+	if parallel < 1 {
+		die("-parallel must be at least 1")
+	}
+
+	name, read := "StreamOutput", func() (int64, error) {
+		r, err := c.Stream(root, id, false)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		return io.Copy(io.Discard, r)
+	}
+	if id == "" {
+		name, read = "StreamJobsOutput", func() (int64, error) {
+			ctx, cancel := context.WithCancel(root)
+			defer cancel()
+			s, err := c.StreamJobs(ctx, client.JobsOutputOptions{Selector: selector})
+			if err != nil {
+				return 0, err
+			}
+			var n int64
+			for {
+				msg, err := s.Recv()
+				if err == io.EOF {
+					return n, nil
+				}
+				if err != nil {
+					return n, err
+				}
+				n += int64(len(msg.GetChunk()))
+			}
+		}
+	}
+
+	before := serverDiagnostics(root, c, timeout)
+	var sent atomic.Int64
+	res := benchPhase(n, parallel, func(int) error {
+		k, err := read()
+		sent.Add(k)
+		return err
+	})
+	printBench(name, res)
+
+	total := float64(sent.Load())
+	fmt.Printf("streamed %s at %s/s\n", humanBytes(total), humanBytes(total/res.elapsed.Seconds()))
+	after := serverDiagnostics(root, c, timeout)
+	if before == nil || after == nil || total == 0 {
+		return
+	}
+	gib := total / (1 << 30)
+	fmt.Printf("server per GiB: allocated=%s gc_cycles=%.1f\n",
+		humanBytes(float64(after.GetTotalAllocBytes()-before.GetTotalAllocBytes())/gib),
+		float64(after.GetGcCycles()-before.GetGcCycles())/gib)
+}
+
+// serverDiagnostics asks for the server's diagnostics, or returns nil
+// when this user may not (-admin-cns).
+func serverDiagnostics(root context.Context, c *client.Client, timeout time.Duration) *jobpb.GetDiagnosticsResponse {
+	ctx, cancel := commandContext(root, timeout, 5*time.Second)
+	defer cancel()
+	d, err := c.AdminRPC().GetDiagnostics(ctx, &jobpb.GetDiagnosticsRequest{})
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// printServerLoad prints how many goroutines and how much heap the server
+// holds with the jobs just started, when this user may ask.
+func printServerLoad(root context.Context, c *client.Client, timeout time.Duration) {
+	d := serverDiagnostics(root, c, timeout)
+	if d == nil {
+		return
+	}
+	fmt.Printf("server jobs=%d running=%d goroutines=%d heap=%s\n",
+		d.GetTotalJobs(), d.GetRunningJobs(), d.GetGoroutines(), humanBytes(float64(d.GetHeapAllocBytes())))
+}
+
+// percentile of sorted, rounded to a readable precision.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	return sorted[max(i, 0)].Round(time.Microsecond)
+}
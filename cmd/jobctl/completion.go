@@ -0,0 +1,420 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// commands are the -cmd values, in the order help lists them.
+var commands = []struct {
+	name, desc string
+	admin      bool
+}{
+	{name: "start", desc: "start a job"},
+	{name: "validate", desc: "check a job as start would, without running it"},
+	{name: "create", desc: "create a job without starting it"},
+	{name: "launch", desc: "start a created job"},
+	{name: "status", desc: "show a job's status"},
+	{name: "stop", desc: "stop a job"},
+	{name: "delete", desc: "remove a finished job and its output"},
+	{name: "resize", desc: "resize the terminal of a job started with -tty"},
+	{name: "stream", desc: "stream a job's output"},
+	{name: "lines", desc: "count the lines of a job's output"},
+	{name: "logs", desc: "follow the output of several jobs at once"},
+	{name: "grep", desc: "search a job's output"},
+	{name: "ps", desc: "list a job's processes"},
+	{name: "download", desc: "download a job's whole stdout or stderr, checksummed"},
+	{name: "core", desc: "download the core a crashed job left"},
+	{name: "result", desc: "print the result data a job started with -result-fd wrote"},
+	{name: "list", desc: "list jobs"},
+	{name: "watch", desc: "show jobs' status as it changes"},
+	{name: "top", desc: "show running jobs' resource use live"},
+	{name: "quota", desc: "show a user's quota and usage"},
+	{name: "version", desc: "show jobctl's and the server's versions and API capabilities"},
+	{name: "start-group", desc: "start -n jobs as a group"},
+	{name: "apply", desc: "start the jobs in a -file manifest that aren't running or done already"},
+	{name: "get", desc: "show the jobs of a -file manifest"},
+	{name: "group-status", desc: "show a group's status"},
+	{name: "group-stop", desc: "stop a group's jobs"},
+	{name: "group-wait", desc: "wait for a group's jobs to finish"},
+	{name: "bench", desc: "start -n jobs and measure StartJob and GetStatus latency, or with -id or -label read output -n times"},
+	{name: "completion", desc: "print a completion script for bash, zsh or fish"},
+	{name: "docs", desc: "print the man page"},
+	{name: "log-level", desc: "set the server's log level", admin: true},
+	{name: "drain", desc: "stop the server accepting new jobs", admin: true},
+	{name: "resume", desc: "undo drain", admin: true},
+	{name: "gc", desc: "remove finished jobs' files now", admin: true},
+	{name: "settings", desc: "change the server's runtime settings", admin: true},
+	{name: "debug", desc: "show the server's diagnostics", admin: true},
+	{name: "accounting", desc: "export per-job resource accounting", admin: true},
+	{name: "exec", desc: "run a command inside a job", admin: true},
+}
+
+// completeIDsCmd is the hidden -cmd the completion scripts run to list job
+// ids, one "<id>\t<status> <exe>" per line.
+const completeIDsCmd = "complete-ids"
+
+// completionShells are the shells -cmd completion has scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// commandList is the commands as help shows them: start|...; admin: ...
+func commandList() string {
+	var user, admin []string
+	for _, c := range commands {
+		if c.admin {
+			admin = append(admin, c.name)
+		} else {
+			user = append(user, c.name)
+		}
+	}
+	return strings.Join(user, "|") + "; admin: " + strings.Join(admin, "|")
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return names
+}
+
+// connFlags are passed from the line being completed to the complete-ids
+// call, so it reaches the same server as the same user.
+var connFlags = []string{"addr", "balance", "certs", "token-file", "insecure", "timeout", "all-users", "owner"}
+
+// flagValues are the fixed values some flags take, offered as completions.
+func flagValues() map[string][]string {
+	return map[string][]string{
+		"cmd":          commandNames(),
+		"target":       {"stdout", "stderr"},
+		"balance":      {"pick_first", "round_robin"},
+		"o":            {"csv", "json"},
+		"sort":         strings.Split(topSortNames(), "|"),
+		"compress":     {"gzip"},
+		"level":        {"debug", "info", "warn", "error"},
+		"io":           {"low", "med", "high"},
+		"leftovers":    {"kill", "wait"},
+		"output-limit": {"discard", "kill"},
+	}
+}
+
+// fileFlags take a local path; certs takes a directory.
+var fileFlags = map[string]bool{"token-file": true, "script": true, "out": true, "certs": true, "file": true}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagsByKind splits fs's flags into those that take a value and those
+// that don't, sorted by name.
+func flagsByKind(fs *flag.FlagSet) (valued, bools []*flag.Flag) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if isBoolFlag(f) {
+			bools = append(bools, f)
+		} else {
+			valued = append(valued, f)
+		}
+	})
+	return valued, bools
+}
+
+// writeCompletion writes shell's completion script for fs. -cmd and -id
+// complete, the latter with ids fetched from ListJobs, as do the flags with
+// fixed values and paths. The word after -cmd completion or -cmd docs
+// completes too.
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	switch shell {
+	case "bash":
+		writeBash(w, fs)
+	case "zsh":
+		writeZsh(w, fs)
+	case "fish":
+		writeFish(w, fs)
+	default:
+		return fmt.Errorf("unknown shell %q (want %s)", shell, strings.Join(completionShells, ", "))
+	}
+	return nil
+}
+
+// sortedKeys returns m's keys in order, so the scripts are stable.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeBash(w io.Writer, fs *flag.FlagSet) {
+	valued, bools := flagsByKind(fs)
+	connValued, connBools := connFlagsOf(fs)
+
+	fmt.Fprintf(w, `# bash completion for jobctl. Load it with
+#   source <(jobctl -cmd completion bash)
+
+_jobctl_ids() {
+	local conn=() i w
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		w=${COMP_WORDS[i]}
+		case $w in
+		%s) conn+=("$w" "${COMP_WORDS[i+1]}"); ((i++)) ;;
+		%s) conn+=("$w") ;;
+		esac
+	done
+	"${COMP_WORDS[0]}" "${conn[@]}" -cmd %s 2>/dev/null | cut -f1
+}
+
+_jobctl() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	case $prev in
+	-cmd | --cmd) COMPREPLY=($(compgen -W "%s" -- "$cur")); return ;;
+	-id | --id) COMPREPLY=($(compgen -W "$(_jobctl_ids)" -- "$cur")); return ;;
+`, dashAlts(connValued...), dashAlts(connBools...), completeIDsCmd, strings.Join(commandNames(), " "))
+	values := flagValues()
+	for _, name := range sortedKeys(values) {
+		if name != "cmd" {
+			fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", dashAlts(name), strings.Join(values[name], " "))
+		}
+	}
+	fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", dashAlts("certs"))
+	for _, name := range sortedKeys(fileFlags) {
+		if name != "certs" {
+			fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", dashAlts(name))
+		}
+	}
+	fmt.Fprintf(w, `	%s) return ;;
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	local i
+	for ((i = 1; i < COMP_CWORD - 1; i++)); do
+		[[ ${COMP_WORDS[i]} == -cmd || ${COMP_WORDS[i]} == --cmd ]] || continue
+		case ${COMP_WORDS[i+1]} in
+		completion) COMPREPLY=($(compgen -W "%s" -- "$cur")) ;;
+		docs) COMPREPLY=($(compgen -W "man" -- "$cur")) ;;
+		esac
+	done
+}
+
+complete -o default -F _jobctl jobctl
+`, dashAlts(names(valued)...), "-"+strings.Join(names(append(valued, bools...)), " -"), strings.Join(completionShells, " "))
+}
+
+// dashAlts is a bash or zsh case pattern matching each flag in names, with
+// one dash or two.
+func dashAlts(names ...string) string {
+	if len(names) == 0 {
+		return "''"
+	}
+	alts := make([]string, 0, 2*len(names))
+	for _, n := range names {
+		alts = append(alts, "-"+n, "--"+n)
+	}
+	return strings.Join(alts, " | ")
+}
+
+func names(fl []*flag.Flag) []string {
+	names := make([]string, len(fl))
+	for i, f := range fl {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// connFlagsOf splits connFlags into those fs has that take a value and
+// those that don't.
+func connFlagsOf(fs *flag.FlagSet) (valued, bools []string) {
+	for _, name := range connFlags {
+		if f := fs.Lookup(name); f != nil && isBoolFlag(f) {
+			bools = append(bools, name)
+		} else if f != nil {
+			valued = append(valued, name)
+		}
+	}
+	return valued, bools
+}
+
+func writeZsh(w io.Writer, fs *flag.FlagSet) {
+	connValued, connBools := connFlagsOf(fs)
+
+	fmt.Fprintf(w, `#compdef jobctl
+# zsh completion for jobctl. Save it as _jobctl in a directory on $fpath,
+# or load it with
+#   source <(jobctl -cmd completion zsh)
+
+_jobctl_ids() {
+	local -a conn ids
+	local i w
+	for ((i = 2; i < CURRENT; i++)); do
+		w=${words[i]}
+		case $w in
+		%s) conn+=("$w" "${words[i+1]}"); ((i++)) ;;
+		%s) conn+=("$w") ;;
+		esac
+	done
+	ids=(${(f)"$("${words[1]}" "${conn[@]}" -cmd %s 2>/dev/null | tr '\t' :)"})
+	_describe 'job id' ids
+}
+
+_jobctl_args() {
+	local i
+	for ((i = 2; i < CURRENT - 1; i++)); do
+		[[ ${words[i]} == -cmd || ${words[i]} == --cmd ]] || continue
+		case ${words[i+1]} in
+		completion) _values shell %s ;;
+		docs) _values format man ;;
+		esac
+		return
+	done
+}
+
+_jobctl() {
+	local -a cmds=(
+`, dashAlts(connValued...), dashAlts(connBools...), completeIDsCmd, strings.Join(completionShells, " "))
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t\t%s\n", zshQuote(c.name+":"+c.desc))
+	}
+	fmt.Fprintf(w, "\t)\n\t_arguments \\\n")
+
+	values := flagValues()
+	fs.VisitAll(func(f *flag.Flag) {
+		spec := "-" + f.Name + "[" + zshEscape(shortUsage(f.Usage)) + "]"
+		if !isBoolFlag(f) {
+			name, _ := flag.UnquoteUsage(f)
+			if name == "" {
+				name = "value"
+			}
+			action := " "
+			switch {
+			case f.Name == "cmd":
+				action = "{_describe command cmds}"
+			case f.Name == "id":
+				action = "_jobctl_ids"
+			case f.Name == "certs":
+				action = "_files -/"
+			case fileFlags[f.Name]:
+				action = "_files"
+			case values[f.Name] != nil:
+				action = "(" + strings.Join(values[f.Name], " ") + ")"
+			}
+			spec += ":" + name + ":" + action
+		}
+		fmt.Fprintf(w, "\t\t%s \\\n", zshQuote(spec))
+	})
+	fmt.Fprintf(w, "\t\t'*:argument:_jobctl_args'\n}\n\nif [[ $zsh_eval_context[-1] == loadautofunc ]]; then\n\t_jobctl \"$@\"\nelse\n\tcompdef _jobctl jobctl\nfi\n")
+}
+
+// shortUsage is a flag's usage up to its first clause, for the one-line
+// descriptions zsh and fish show.
+func shortUsage(s string) string {
+	if i := strings.IndexAny(s, ";("); i > 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// zshEscape escapes what _arguments treats specially in a description.
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// zshQuote single-quotes s for zsh.
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeFish(w io.Writer, fs *flag.FlagSet) {
+	connValued, connBools := connFlagsOf(fs)
+
+	fmt.Fprintf(w, `# fish completion for jobctl. Save it as jobctl.fish in
+# ~/.config/fish/completions, or load it with
+#   jobctl -cmd completion fish | source
+
+function __jobctl_ids
+	set -l words (commandline -opc)
+	set -l conn
+	set -l i 2
+	while test $i -le (count $words)
+		switch (string replace -r '^--?' '' -- $words[$i])
+			case %s
+				set -a conn $words[$i] $words[(math $i + 1)]
+				set i (math $i + 1)
+			case %s
+				set -a conn $words[$i]
+		end
+		set i (math $i + 1)
+	end
+	$words[1] $conn -cmd %s 2>/dev/null
+end
+
+function __jobctl_commands
+%s
+end
+
+# __jobctl_cmd_is succeeds when the line so far has -cmd $argv[1].
+function __jobctl_cmd_is
+	set -l words (commandline -opc)
+	for i in (seq 2 (math (count $words) - 1))
+		if string match -qr -- '^--?cmd$' $words[$i]; and test "$words[(math $i + 1)]" = $argv[1]
+			return 0
+		end
+	end
+	return 1
+end
+
+complete -c jobctl -f
+`, fishAlts(connValued), fishAlts(connBools), completeIDsCmd, fishCommands())
+
+	values := flagValues()
+	fs.VisitAll(func(f *flag.Flag) {
+		line := fmt.Sprintf("complete -c jobctl -o %s -d %s", f.Name, fishQuote(shortUsage(f.Usage)))
+		switch {
+		case isBoolFlag(f):
+		case f.Name == "cmd":
+			line += " -x -a '(__jobctl_commands)'"
+		case f.Name == "id":
+			line += " -x -a '(__jobctl_ids)'"
+		case f.Name == "certs":
+			line += " -x -a '(__fish_complete_directories)'"
+		case fileFlags[f.Name]:
+			line += " -r -F"
+		case values[f.Name] != nil:
+			line += " -x -a " + fishQuote(strings.Join(values[f.Name], " "))
+		default:
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	})
+	fmt.Fprintf(w, "complete -c jobctl -n '__jobctl_cmd_is completion' -a %s\n", fishQuote(strings.Join(completionShells, " ")))
+	fmt.Fprintf(w, "complete -c jobctl -n '__jobctl_cmd_is docs' -a man\n")
+}
+
+// fishAlts is a fish case list matching each of names.
+func fishAlts(names []string) string {
+	if len(names) == 0 {
+		return "''"
+	}
+	return strings.Join(names, " ")
+}
+
+// fishCommands is the body of __jobctl_commands, which prints each command
+// with its description as fish completions take them.
+func fishCommands() string {
+	lines := make([]string, len(commands))
+	for i, c := range commands {
+		lines[i] = "\tprintf '%s\\t%s\\n' " + fishQuote(c.name) + " " + fishQuote(c.desc)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fishQuote single-quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeMan writes jobctl(1) in roff, from the command table and fs's flags,
+// so the page can't drift from -help.
+func writeMan(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprint(w, `.TH JOBCTL 1 "" "jobworker" "User Commands"
+.SH NAME
+jobctl \- start, watch and manage jobs on a jobworker server
+.SH SYNOPSIS
+.B jobctl
+[\fB\-addr\fR \fIhost:port\fR]
+[\fB\-certs\fR \fIdir\fR]
+\fB\-cmd\fR \fIcommand\fR
+[\fIflags\fR]
+[\fIargs\fR]
+.SH DESCRIPTION
+.B jobctl
+talks to a jobworker server over gRPC with mutual TLS.
+The client certificate in \fB\-certs\fR names the user; with \fB\-token\-file\fR
+a bearer token does instead.
+Each invocation runs one \fIcommand\fR, chosen with \fB\-cmd\fR.
+Flags only apply to the commands their description names.
+.SH COMMANDS
+`)
+	admin := false
+	for _, c := range commands {
+		if c.admin && !admin {
+			fmt.Fprint(w, ".SS Admin commands\nThese need an identity in the server's \\fB\\-admin\\-cns\\fR.\n")
+			admin = true
+		}
+		fmt.Fprintf(w, ".TP\n.B %s\n%s.\n", roffEscape(c.name), roffEscape(capitalize(c.desc)))
+	}
+
+	fmt.Fprint(w, ".SH OPTIONS\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, ".TP\n\\fB\\-%s\\fR", roffEscape(f.Name))
+		if name != "" {
+			fmt.Fprintf(w, " \\fI%s\\fR", roffEscape(name))
+		}
+		fmt.Fprintf(w, "\n%s", roffEscape(usage))
+		if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" && !strings.Contains(usage, "(default") {
+			fmt.Fprintf(w, " (default %s)", roffEscape(f.DefValue))
+		}
+		fmt.Fprintln(w)
+	})
+
+	fmt.Fprint(w, `.SH EXIT STATUS
+0 on success and 1 on any error.
+\fBstart \-wait\fR and \fBstart \-follow\fR exit as the job did, and
+\fBexec\fR as its command did: with its exit code, or 128+\fIn\fR when it
+was killed by signal \fIn\fR.
+\fBgroup\-wait\fR exits 1 unless every job in the group succeeded.
+.SH FILES
+.TP
+.I certs/ca.crt
+The CA the server's certificate must chain to.
+.TP
+.I certs/<name>/client.crt, certs/<name>/client.key
+The client certificate and key, in the one subdirectory holding them; the
+certificate's CN is the user.
+.SH EXAMPLES
+.nf
+jobctl \-cmd start \-exe ls \-args "\-lah /"
+jobctl \-cmd start \-exe ./build.sh \-follow
+jobctl \-cmd watch
+jobctl \-cmd stream \-id \fIjob\-id\fR
+source <(jobctl \-cmd completion bash)
+jobctl \-cmd docs man > /usr/local/share/man/man1/jobctl.1
+.fi
+`)
+}
+
+// roffEscape escapes s for running text: backslashes, and dashes so they
+// print as the minus signs flags need.
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s // not a request
+	}
+	return s
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
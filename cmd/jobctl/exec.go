@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"golang.org/x/sys/unix"
+)
+
+// runExec runs argv inside job id through Admin.ExecInJob, relaying stdin
+// and the command's output, and returns the exit status a shell would
+// report for it (128+n when killed by signal n).
+func runExec(ctx context.Context, admin jobpb.AdminClient, id string, argv []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := admin.ExecInJob(ctx)
+	if err != nil {
+		return 0, err
+	}
+	start := &jobpb.ExecStart{JobId: id}
+	if len(argv) > 0 {
+		start.Executable, start.Args = argv[0], argv[1:]
+	}
+	if err := stream.Send(&jobpb.ExecInJobRequest{Part: &jobpb.ExecInJobRequest_Start{Start: start}}); err != nil {
+		return 0, err
+	}
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				chunk := append([]byte(nil), buf[:n]...)
+				if stream.Send(&jobpb.ExecInJobRequest{Part: &jobpb.ExecInJobRequest_Stdin{Stdin: chunk}}) != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = stream.CloseSend()
+				return
+			}
+		}
+	}()
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return 0, errors.New("stream ended without an exit status")
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch part := resp.GetPart().(type) {
+		case *jobpb.ExecInJobResponse_Stdout:
+			stdout.Write(part.Stdout)
+		case *jobpb.ExecInJobResponse_Stderr:
+			stderr.Write(part.Stderr)
+		case *jobpb.ExecInJobResponse_Exit:
+			if sig := part.Exit.GetSignal(); sig != "" {
+				fmt.Fprintf(stderr, "killed by %s\n", sig)
+				return 128 + int(unix.SignalNum(sig)), nil
+			}
+			return int(part.Exit.GetExitCode()), nil
+		}
+	}
+}
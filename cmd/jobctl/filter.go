@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// filterNoteInterval is how often stream notes lines -include/-exclude
+// left out.
+const filterNoteInterval = 5 * time.Second
+
+// filterNotes tells stderr how many lines a filtered stream left out, at
+// most every filterNoteInterval and once more at the end.
+type filterNotes struct {
+	pending uint64
+	last    time.Time
+}
+
+func (n *filterNotes) add(lines uint64) {
+	n.pending += lines
+	if time.Since(n.last) >= filterNoteInterval {
+		n.flush()
+	}
+}
+
+func (n *filterNotes) flush() {
+	if n.pending == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[%d line(s) filtered out]\n", n.pending)
+	n.pending, n.last = 0, time.Now()
+}
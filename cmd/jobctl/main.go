@@ -2,147 +2,996 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/bucknercd/jobworker/internal/cluster"
+	"github.com/bucknercd/jobworker/internal/limits"
+	"github.com/bucknercd/jobworker/internal/manifest"
+	"github.com/bucknercd/jobworker/internal/version"
+	"github.com/bucknercd/jobworker/pkg/client"
 	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func main() {
 	var (
-		addr     = flag.String("addr", "127.0.0.1:50051", "jobworker server address")
+		addr     = flag.String("addr", "127.0.0.1:50051", "jobworker server address; several separated by commas, or dns:///host:port for every address host has, fail over to a healthy one")
+		balance  = flag.String("balance", client.PickFirst, "with several -addr: pick_first|round_robin (spread status, list and output calls)")
 		certsDir = flag.String("certs", "./certs", "certs directory")
-		cmd      = flag.String("cmd", "", "command: start|status|stop|stream")
-		jobID    = flag.String("id", "", "job id for status/stop/stream")
-		target   = flag.String("target", "stdout", "stream target: stdout|stderr")
+		tokenAt  = flag.String("token-file", "", "send the bearer token in this file (static or JWT) with every call, for servers with -auth-mode token or mtls+token; -certs then needs only ca.crt")
+		cmd      = flag.String("cmd", "", "command: "+commandList())
+		jobID    = flag.String("id", "", "job id for launch/status/stop/delete/stream/lines/grep/ps/core/download/exec, top for just that job, or bench to stream its output -n times")
+		allUsers = flag.Bool("all-users", false, "list/top/logs: every user's jobs (admin only)")
+		owner    = flag.String("owner", "", "list/top/logs/quota: this user instead of yourself (admin only); accounting: only this user")
+		nspace   = flag.String("namespace", "", "start/create: put the job in this namespace; list/watch/top: only this namespace's jobs. Other than your own (your cert's OU, or default): admin only")
+		target   = flag.String("target", "stdout", "stream/lines/logs/grep/download target: stdout|stderr")
+		groupID  = flag.String("group", "", "group id for group-status/group-stop/group-wait")
+		count    = flag.Int("n", 1, "start-group, bench: how many jobs; with start-group, \"{}\" in -args becomes each one's index, 0 to n-1")
+		parallel = flag.Int("parallel", 16, "bench: calls in flight at once")
+		follow   = flag.Bool("f", false, "logs: keep following the jobs, and new ones that match, until Ctrl-C")
+		ctxLines = flag.Int("C", 0, "grep: lines of context around each match")
+		ignCase  = flag.Bool("ignore-case", false, "grep, stream -include/-exclude: match case-insensitively")
+		maxMatch = flag.Int("max-matches", 0, "grep: stop after this many matches (0 = server default, 100)")
+		level    = flag.String("level", "", "log-level/settings: new server log level (debug|info|warn|error)")
+		maxJobs  = flag.Int("max-jobs", 0, "settings: new concurrent job cap (negative removes it)")
+		olderThn = flag.Duration("older-than", 0, "gc: remove jobs finished at least this long ago (0 = server -job-retention)")
+		from     = flag.String("from", "", "accounting: period start, a date (2026-09-01) or RFC3339 time (default: start of this month, UTC)")
+		to       = flag.String("to", "", "accounting: period end, exclusive (default: now)")
+		outFmt   = flag.String("o", "csv", "accounting: output format, csv or json")
+		outFile  = flag.String("out", "", "core, download: write the file here (default core.<id>, <id>.<target>; - for stdout)")
+		force    = flag.Bool("force", false, "delete: stop the job first if it is still running; apply: start every job anew, stopping running ones first")
+		specFile = flag.String("file", "", "apply, get: the job manifest, YAML or JSON (- for stdin)")
+		timings  = flag.Bool("timings", false, "status: also print how long each step of the job's start took")
 		insecure = flag.Bool("insecure", false, "skip TLS verification (dev only)")
+		showVer  = flag.Bool("version", false, "print jobctl's version and exit (-cmd version also asks the server)")
+		tailN    = flag.Uint64("tail", 0, "stream: start at the last this many lines instead of the beginning")
+		sinceLn  = flag.Uint64("since-line", 0, "stream: start at this line (1-based) instead of the beginning")
+		incl     = flag.String("include", "", "stream: only lines matching this regexp, filtered by the server; lines left out are counted on stderr")
+		excl     = flag.String("exclude", "", "stream: leave out lines matching this regexp, filtered by the server")
+		noRecon  = flag.Bool("no-reconnect", false, "stream: fail on a dropped connection instead of resuming")
+		compress = flag.String("compress", "", "stream: compress output in transit (gzip)")
+		sanitize = flag.Bool("sanitize", false, "stream/logs/grep/start -follow: strip ANSI escapes, control characters and bidi overrides from job output, for terminal safety")
+		interval = flag.Duration("interval", 2*time.Second, "top, watch: refresh interval")
+		sortBy   = flag.String("sort", "cpu", "top: sort by cpu|mem|read|write|pids|time|id (keys c m r w p t i switch it live)")
+		frames   = flag.Int("iterations", 0, "top, watch: exit after this many refreshes (0 = until q or Ctrl-C)")
+		timeout  = flag.Duration("timeout", 0, "per-command RPC timeout (0 = default: 10s start/validate/create/launch/stop, 30s delete, 5s status/list and each watch refresh, none for stream/lines/logs/top/grep/group-wait/exec/core/download)")
+		deadline = flag.String("deadline", "", "overall deadline for this invocation incl. retries, as a duration (2m) or RFC3339 time")
 		// start params
-		exe  = flag.String("exe", "", "executable for start (e.g. ls or /bin/ls)")
+		exe  = flag.String("exe", "", "executable for start (e.g. ls or /bin/ls); with -script, the interpreter")
+		scr  = flag.String("script", "", "start: upload this local script and run it with -exe (default sh)")
 		args = flag.String("args", "", "args for start, single string (e.g. \"-lah /\")")
 		cpu  = flag.String("cpu", "", "cpu limit (e.g. 500m, 2, max)")
-		mem  = flag.String("mem", "", "memory limit (e.g. 100M, max)")
-		ioCl = flag.String("io", "", "io class (low|med|high)")
+		mem  = flag.String("mem", "", "memory limit (e.g. 100M, 2Gi, max)")
+		swap = flag.String("swap", "", "swap limit (e.g. 512M, max; 0 disables swap)")
+		ioCl = flag.String("io", "", "io class preset (low|med|high): io.weight plus, below high, an io.max cap on the output disk")
+		left = flag.String("leftovers", "kill", "processes still running when the main process exits: kill, or wait for them")
+		mOut = flag.String("max-output", "", "stdout+stderr to keep, e.g. 100M (default: server's -default-max-output)")
+		oLim = flag.String("output-limit", "discard", "once -max-output is reached: discard the rest, or kill the job")
+		stal = flag.Duration("stall", 0, "report the job stalled (job.stalled event) after this long without output or CPU use, e.g. 10m (min 10s)")
+		sCPU = flag.Duration("stall-min-cpu", 0, "with -stall: CPU time per window that still counts as no progress, e.g. 50ms")
+		sStp = flag.Bool("stall-stop", false, "with -stall: stop the job once it stalls")
+		core = flag.Bool("capture-core", false, "keep the job's core if it crashes, for -cmd core")
+		cSiz = flag.String("core-size", "", "max core file size (RLIMIT_CORE), e.g. 0 or 512M; caps -capture-core")
+		pids = flag.String("pids", "", "max processes+threads (pids.max), e.g. 256 or max (default: server's)")
+		nofl = flag.String("nofile", "", "max open files per process (RLIMIT_NOFILE), e.g. 1024 or max (default: server's)")
+		nprc = flag.String("nproc", "", "max processes of the job's user, other jobs included (RLIMIT_NPROC), e.g. 512 or max")
+		fsiz = flag.String("fsize", "", "max size of any file the job writes (RLIMIT_FSIZE), e.g. 10G or max")
+		wait = flag.Bool("wait", false, "start: wait for the job to finish and exit as it did: its exit code, 128+n if killed by signal n, 1 if stopped or it never ran")
+		fout = flag.Bool("follow", false, "start: like -wait, printing the job's stdout and stderr to ours meanwhile; the job id and how it ended go to stderr")
+		ikey = flag.String("idempotency-key", "", "start/create: a key that makes retrying safe; a repeat within 24h gets the first call's job (e.g. a UUID per job)")
+		rLns = flag.Uint("result-lines", 0, "start: keep the job's last N stdout lines (at most 1000) as its result, shown by status")
+		rBeg = flag.String("result-begin", "", "start: keep as the job's result the stdout lines after the last line equal to this")
+		rFD  = flag.Bool("result-fd", false, "start: give the job file descriptor 3 for result data kept apart from its output, for -cmd result")
+		rEnd = flag.String("result-end", "", "start, with -result-begin: the line that ends the result (default: end of output)")
+		umsk = flag.String("umask", "", "start: the job's umask in octal, e.g. 027 (default: server's)")
+		ttyM = flag.Bool("tty", false, "start: run the job on a terminal, so it writes color and interactive output; its stderr goes to stdout. With -follow it follows our terminal's size")
+		tSiz = flag.String("tty-size", "", "start -tty, resize: the terminal's size as COLSxROWS, e.g. 120x40 (default 80x24, or ours with -follow)")
+		cpuS = flag.String("cpuset", "", "pin to these CPUs, e.g. 0-3,8 (cpuset.cpus)")
+		memS = flag.String("cpuset-mems", "", "pin to these NUMA memory nodes, e.g. 0 (cpuset.mems)")
+		ioMx = flag.String("io-max", "", "io.max caps, ';'-separated, each device=<dev|path>,rbps=50M,wbps=20M,riops=N,wiops=N (no device = output disk)")
+		gpus = flag.Int("gpus", 0, "number of exclusive GPUs for start")
+		img  = flag.String("image", "", "container image for start (oci:<dir>[:tag] or bundle:<dir> on the server)")
+		sEnv = flag.String("secret-env", "", "secret env for start, comma-separated ENV=secret-name (e.g. \"API_KEY=my-secret\")")
+		pEnv = flag.String("env", "", "start: environment variables, comma-separated NAME=value (e.g. \"MODE=full,DEBUG=1\"); not for credentials")
+		rTmo = flag.Duration("run-timeout", 0, "start: stop the job once it has run this long, e.g. 1h (whole seconds)")
+		rMax = flag.Uint("restarts", 0, "start: start the job again, as a new job, up to this many times when it exits non-zero or is killed by a signal")
+		rDly = flag.Duration("restart-delay", 0, "start, with -restarts: wait this long before each restart, e.g. 30s (at most 1h)")
+		nSel = flag.String("node-selector", "", "node labels required for start, comma-separated key=value (e.g. \"arch=arm64,gpu=true\")")
+		jLab = flag.String("label", "", "start: labels to give the job; logs, and bench without -exe: select jobs with all of them. Comma-separated key=value (e.g. \"team=ml,batch=42\")")
 	)
 	flag.Parse()
 
+	if *showVer {
+		fmt.Println(version.String("jobctl"))
+		return
+	}
 	if *cmd == "" {
-		die("missing -cmd (start|status|stop|stream)")
+		die("missing -cmd (%s)", commandList())
 	}
 
-	tlsCfg, err := buildClientTLSConfig(*certsDir, *addr, *insecure)
-	if err != nil {
-		die("tls config: %v", err)
+	// These need no server.
+	switch *cmd {
+	case "completion":
+		if flag.NArg() != 1 {
+			die("usage: jobctl -cmd completion %s", strings.Join(completionShells, "|"))
+		}
+		if err := writeCompletion(os.Stdout, flag.Arg(0), flag.CommandLine); err != nil {
+			die("completion: %v", err)
+		}
+		return
+	case "docs":
+		if flag.NArg() != 1 || flag.Arg(0) != "man" {
+			die("usage: jobctl -cmd docs man")
+		}
+		writeMan(os.Stdout, flag.CommandLine)
+		return
 	}
 
-	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	root := context.Background()
+	if *deadline != "" {
+		t, err := parseDeadline(*deadline)
+		if err != nil {
+			die("invalid -deadline: %v", err)
+		}
+		var cancel context.CancelFunc
+		root, cancel = context.WithDeadline(root, t)
+		defer cancel()
+	}
+
+	var token string
+	if *tokenAt != "" {
+		b, err := os.ReadFile(*tokenAt)
+		if err != nil {
+			die("-token-file: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	c, err := client.New(client.Config{
+		Addr:      *addr,
+		Balancing: *balance,
+		CertsDir:  *certsDir,
+		Insecure:  *insecure,
+		Token:     token,
+
+		NoStreamReconnect: *noRecon,
+		StreamCompression: *compress,
+	})
 	if err != nil {
-		die("dial %s: %v", *addr, err)
+		die("%v", err)
 	}
-	defer conn.Close()
+	defer c.Close()
 
-	client := jobpb.NewJobWorkerClient(conn)
+	var applied []manifest.Job // apply and get's manifest
+	if *cmd == "apply" || *cmd == "get" {
+		if *specFile == "" {
+			die("%s requires -file", *cmd)
+		}
+		if applied, err = manifest.Read(*specFile); err != nil {
+			die("%v", err)
+		}
+	}
+
+	if *cmd != completeIDsCmd && *cmd != "version" {
+		var extra []string
+		if *cmd == "apply" {
+			extra = manifest.Capabilities(applied)
+		}
+		if *pEnv != "" {
+			extra = append(extra, "job-env")
+		}
+		if *rTmo > 0 {
+			extra = append(extra, "job-timeouts")
+		}
+		if *rMax > 0 {
+			extra = append(extra, "job-restarts")
+		}
+		if *ttyM {
+			extra = append(extra, "tty")
+		}
+		if *nspace != "" {
+			extra = append(extra, "namespaces")
+		}
+		if *scr != "" {
+			extra = append(extra, "run-script")
+		}
+		if *ikey != "" {
+			extra = append(extra, "idempotency-keys")
+		}
+		if *rLns > 0 || *rBeg != "" {
+			extra = append(extra, "result-capture")
+		}
+		if *rFD {
+			extra = append(extra, "result-fd")
+		}
+		if *tailN > 0 || *sinceLn > 0 {
+			extra = append(extra, "output-index")
+		}
+		if *incl != "" || *excl != "" {
+			extra = append(extra, "stream-filter")
+		}
+		checkServer(root, c, *cmd, extra...)
+	}
 
 	switch *cmd {
-	case "start":
-		if *exe == "" {
-			die("start requires -exe")
+	case "version":
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		info, err := c.ServerInfo(ctx)
+		if err != nil {
+			die("GetServerInfo: %v", err)
 		}
-		// NOTE: args parsing is minimal; later swap to cobra and proper arg splitting.
-		req := &jobpb.StartJobRequest{
-			Executable: *exe,
-			Args:       splitArgs(*args),
-			Limits: &jobpb.ResourceLimits{
-				Cpu:       *cpu,
-				MemoryMax: *mem,
-				IoClass:   *ioCl,
-			},
+		printServerInfo(info)
+
+	case "start", "validate", "create", "start-group", "bench":
+		if *cmd == "bench" && (*jobID != "" || *jLab != "" && *exe == "" && *img == "") {
+			selector, err := cluster.ParseLabels(*jLab)
+			if err != nil {
+				die("invalid -label: %v", err)
+			}
+			runStreamBench(root, c, *jobID, selector, *count, *parallel, *timeout)
+			return
+		}
+		if *scr != "" {
+			if *cmd != "start" {
+				die("-script only works with start")
+			}
+			if *exe == "" {
+				*exe = "sh"
+			}
+		}
+		if *exe == "" && *img == "" {
+			die("%s requires -exe or -image", *cmd)
+		}
+		if *ikey != "" && (*cmd == "validate" || *cmd == "start-group" || *cmd == "bench") {
+			die("-idempotency-key only works with start and create")
+		}
+		if (*wait || *fout) && *cmd != "start" {
+			die("-wait and -follow only work with start")
+		}
+		var tty *jobpb.TerminalSize
+		if *ttyM {
+			tty = &jobpb.TerminalSize{}
+			if *tSiz != "" {
+				if tty, err = parseTTYSize(*tSiz); err != nil {
+					die("invalid -tty-size: %v", err)
+				}
+			} else if size, ok := terminalSize(os.Stdout); ok && *fout {
+				tty = size
+			}
+		} else if *tSiz != "" {
+			die("-tty-size needs -tty")
+		}
+		var resultCapture *jobpb.ResultCapture
+		if *rLns > 0 || *rBeg != "" || *rEnd != "" {
+			resultCapture = &jobpb.ResultCapture{LastLines: uint32(*rLns), BeginMarker: *rBeg, EndMarker: *rEnd}
+		}
+		secretEnv, err := parseSecretEnv(*sEnv)
+		if err != nil {
+			die("invalid -secret-env: %v", err)
+		}
+		plainEnv, err := parseEnv(*pEnv)
+		if err != nil {
+			die("invalid -env: %v", err)
+		}
+		if *rTmo < 0 || *rTmo%time.Second != 0 || *rDly < 0 || *rDly%time.Second != 0 {
+			die("-run-timeout and -restart-delay take whole seconds")
+		}
+		if *rDly > 0 && *rMax == 0 {
+			die("-restart-delay needs -restarts")
+		}
+		selector, err := cluster.ParseLabels(*nSel)
+		if err != nil {
+			die("invalid -node-selector: %v", err)
+		}
+		jobLabels, err := cluster.ParseLabels(*jLab)
+		if err != nil {
+			die("invalid -label: %v", err)
+		}
+		if *left != "kill" && *left != "wait" {
+			die("invalid -leftovers %q: want kill or wait", *left)
+		}
+		if *oLim != "discard" && *oLim != "kill" {
+			die("invalid -output-limit %q: want discard or kill", *oLim)
+		}
+		maxOutput, err := limits.ParseMemory(*mOut)
+		if err != nil {
+			die("invalid -max-output: %v", err)
+		}
+		ioMax, err := parseIOMax(*ioMx)
+		if err != nil {
+			die("invalid -io-max: %v", err)
+		}
+		// Same parser as the server, so typos fail before any RPC.
+		if _, err := limits.Parse(limits.Spec{CPU: *cpu, Memory: *mem, Swap: *swap, IOClass: *ioCl, CPUs: *cpuS, Mems: *memS, PIDs: *pids,
+			NoFile: *nofl, NProc: *nprc, Core: *cSiz, FSize: *fsiz}); err != nil {
+			die("invalid limits: %v", err)
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		// The deadline travels with the RPC, so the server won't launch a job
+		// after we've stopped waiting for its id.
+		ctx, cancel := commandContext(root, *timeout, 10*time.Second)
 		defer cancel()
 
-		resp, err := client.StartJob(ctx, req)
+		// NOTE: args parsing is minimal; later swap to cobra and proper arg splitting.
+		spec := client.JobSpec{
+			Executable:       *exe,
+			Args:             splitArgs(*args),
+			Image:            *img,
+			CPU:              *cpu,
+			Memory:           *mem,
+			Swap:             *swap,
+			IOClass:          *ioCl,
+			IOMax:            ioMax,
+			CPUSet:           *cpuS,
+			CPUSetMems:       *memS,
+			PIDsMax:          *pids,
+			WaitForLeftovers: *left == "wait",
+			GPUs:             *gpus,
+			SecretEnv:        secretEnv,
+			Env:              plainEnv,
+			NodeSelector:     selector,
+			Labels:           jobLabels,
+			Namespace:        *nspace,
+
+			MaxOutputBytes:    uint64(maxOutput.Bytes()),
+			KillOnOutputLimit: *oLim == "kill",
+
+			StallAfter:      *stal,
+			StallMinCPU:     *sCPU,
+			StopWhenStalled: *sStp,
+
+			CaptureCore:    *core,
+			Umask:          *umsk,
+			IdempotencyKey: *ikey,
+			TTY:            tty,
+			Result:         resultCapture,
+			ResultFD:       *rFD,
+
+			Timeout:      *rTmo,
+			MaxRestarts:  uint32(*rMax),
+			RestartDelay: *rDly,
+
+			NoFile:   *nofl,
+			NProc:    *nprc,
+			CoreSize: *cSiz,
+			FileSize: *fsiz,
+		}
+
+		if *cmd == "validate" {
+			r, err := c.Validate(ctx, spec)
+			if err != nil {
+				die("StartJob (validate_only): %v", err)
+			}
+			printResolved(r)
+			return
+		}
+
+		if *cmd == "start-group" {
+			if *count < 1 {
+				die("-n must be at least 1")
+			}
+			specs := make([]client.JobSpec, *count)
+			for i := range specs {
+				specs[i] = spec
+				specs[i].Args = splitArgs(strings.ReplaceAll(*args, "{}", strconv.Itoa(i)))
+			}
+			group, ids, err := c.StartGroup(ctx, specs)
+			if err != nil {
+				die("StartJobs: %v", err)
+			}
+			fmt.Printf("group_id=%s\n", group)
+			for _, id := range ids {
+				fmt.Println(id)
+			}
+			return
+		}
+
+		if *cmd == "bench" {
+			runBench(root, c, spec, *count, *parallel, *timeout)
+			return
+		}
+
+		if *cmd == "create" {
+			id, err := c.Create(ctx, spec)
+			if err != nil {
+				die("CreateJob: %v", err)
+			}
+			fmt.Println(id)
+			return
+		}
+
+		if *scr != "" {
+			f, err := os.Open(*scr)
+			if err != nil {
+				die("%v", err)
+			}
+			defer f.Close()
+			id, err := c.RunScript(ctx, spec, f)
+			if err != nil {
+				die("RunScript: %v", err)
+			}
+			startedJob(root, c, id, *wait, *fout, *sanitize, *ttyM)
+			return
+		}
+
+		id, err := c.Start(ctx, spec)
 		if err != nil {
 			die("StartJob: %v", err)
 		}
-		fmt.Println(resp.GetJobId())
+		startedJob(root, c, id, *wait, *fout, *sanitize, *ttyM)
+
+	case "apply", "get":
+		ctx, cancel := commandContext(root, *timeout, 30*time.Second)
+		defer cancel()
+
+		if *cmd == "get" {
+			getManifest(ctx, c, applied)
+			return
+		}
+		if !applyManifest(ctx, c, applied, *force) {
+			os.Exit(1)
+		}
+
+	case "group-status", "group-stop", "group-wait":
+		if *groupID == "" {
+			die("%s requires -group", *cmd)
+		}
+		var (
+			gs  *jobpb.GroupStatus
+			err error
+		)
+		switch *cmd {
+		case "group-status":
+			ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+			defer cancel()
+			gs, err = c.GroupStatus(ctx, *groupID)
+		case "group-stop":
+			ctx, cancel := commandContext(root, *timeout, 10*time.Second)
+			defer cancel()
+			gs, err = c.StopGroup(ctx, *groupID)
+		case "group-wait":
+			ctx, cancel := commandContext(root, *timeout, 0)
+			defer cancel()
+			gs, err = c.WaitGroup(ctx, *groupID)
+		}
+		if err != nil {
+			die("%s: %v", *cmd, err)
+		}
+		printGroup(gs)
+		if *cmd == "group-wait" && gs.GetSucceeded() != gs.GetTotal() {
+			os.Exit(1)
+		}
+
+	case "launch":
+		if *jobID == "" {
+			die("launch requires -id")
+		}
+		ctx, cancel := commandContext(root, *timeout, 10*time.Second)
+		defer cancel()
+
+		info, err := c.StartCreated(ctx, *jobID)
+		if err != nil {
+			die("StartCreatedJob: %v", err)
+		}
+		fmt.Printf("job_id=%s status=%s\n", info.ID, info.Status.String())
 
 	case "status":
 		if *jobID == "" {
 			die("status requires -id")
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
 		defer cancel()
 
-		resp, err := client.GetStatus(ctx, &jobpb.GetStatusRequest{JobId: *jobID})
+		info, err := c.Status(ctx, *jobID)
 		if err != nil {
 			die("GetStatus: %v", err)
 		}
-		fmt.Printf("job_id=%s status=%s exit_code=%d\n",
-			resp.GetJobId(),
-			resp.GetMetadata().GetStatus().String(),
-			resp.GetMetadata().GetExitCode(),
+		fmt.Printf("job_id=%s status=%s exit_code=%d reason=%q output_truncated=%t stalled=%t core_captured=%t",
+			info.ID,
+			info.Status.String(),
+			info.ExitCode,
+			info.Reason,
+			info.OutputTruncated,
+			info.Stalled,
+			info.CoreCaptured,
 		)
+		if info.Status == jobpb.JobStatus_JOB_STATUS_EXPIRED {
+			fmt.Printf(" final_status=%s expired_at=%s", info.FinalStatus, info.ExpiredAt.Format(time.RFC3339))
+		}
+		if info.Namespace != "" && info.Namespace != "default" {
+			fmt.Printf(" namespace=%s", info.Namespace)
+		}
+		if info.RestartCount > 0 {
+			fmt.Printf(" restart_count=%d restart_of=%s", info.RestartCount, info.RestartOf)
+		}
+		if info.RestartedAs != "" {
+			fmt.Printf(" restarted_as=%s", info.RestartedAs)
+		}
+		if info.ResultTruncated {
+			fmt.Printf(" result_truncated=true")
+		}
+		fmt.Println()
+		if info.Result != "" {
+			fmt.Print(info.Result)
+			if !strings.HasSuffix(info.Result, "\n") {
+				fmt.Println()
+			}
+		}
+		if *timings {
+			t := info.StartTimings
+			fmt.Printf("start_timings validate=%s queued=%s cgroup=%s filesystem=%s exec=%s first_output=%s\n",
+				t.Validate, t.Queued, t.Cgroup, t.Filesystem, t.Exec, t.FirstOutput)
+		}
 
 	case "stop":
 		if *jobID == "" {
 			die("stop requires -id")
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := commandContext(root, *timeout, 10*time.Second)
 		defer cancel()
 
-		resp, err := client.StopJob(ctx, &jobpb.StopJobRequest{JobId: *jobID})
+		info, err := c.Stop(ctx, *jobID)
 		if err != nil {
 			die("StopJob: %v", err)
 		}
-		fmt.Printf("status=%s exit_code=%d\n",
-			resp.GetMetadata().GetStatus().String(),
-			resp.GetMetadata().GetExitCode(),
+		fmt.Printf("status=%s exit_code=%d reason=%q already_stopped=%t\n",
+			info.Status.String(),
+			info.ExitCode,
+			info.Reason,
+			info.AlreadyStopped,
 		)
 
+	case "delete":
+		if *jobID == "" {
+			die("delete requires -id")
+		}
+		ctx, cancel := commandContext(root, *timeout, 30*time.Second) // -force waits out the stop
+		defer cancel()
+
+		freed, err := c.Delete(ctx, *jobID, *force)
+		if err != nil {
+			die("DeleteJob: %v", err)
+		}
+		fmt.Printf("job_id=%s deleted bytes_freed=%d\n", *jobID, freed)
+
+	case "resize":
+		if *jobID == "" || *tSiz == "" {
+			die("usage: jobctl -cmd resize -id <job> -tty-size COLSxROWS")
+		}
+		size, err := parseTTYSize(*tSiz)
+		if err != nil {
+			die("invalid -tty-size: %v", err)
+		}
+		ctx, cancel := commandContext(root, *timeout, 10*time.Second)
+		defer cancel()
+
+		if err := c.ResizeTerminal(ctx, *jobID, int(size.GetRows()), int(size.GetCols())); err != nil {
+			die("ResizeTerminal: %v", err)
+		}
+
 	case "stream":
 		if *jobID == "" {
 			die("stream requires -id")
 		}
 
-		var t jobpb.StreamTarget
+		var stderr bool
 		switch *target {
 		case "stdout":
-			t = jobpb.StreamTarget_STREAM_TARGET_STDOUT
 		case "stderr":
-			t = jobpb.StreamTarget_STREAM_TARGET_STDERR
+			stderr = true
 		default:
 			die("invalid -target (stdout|stderr)")
 		}
+		if *tailN > 0 && *sinceLn > 0 {
+			die("-tail and -since-line are exclusive")
+		}
 
-		ctx := context.Background()
-		stream, err := client.StreamOutput(ctx, &jobpb.StreamOutputRequest{
-			JobId:  *jobID,
-			Target: t,
-		})
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		notes := &filterNotes{}
+		defer notes.flush()
+		r, err := c.StreamFrom(ctx, *jobID, client.StreamOptions{Stderr: stderr, TailLines: *tailN, SinceLine: *sinceLn,
+			Include: *incl, Exclude: *excl, IgnoreCase: *ignCase, OnSuppressed: notes.add})
 		if err != nil {
 			die("StreamOutput: %v", err)
 		}
+		defer r.Close()
+
+		var out io.Writer = os.Stdout
+		if *sanitize {
+			sw := &sanitizeWriter{w: os.Stdout}
+			defer sw.Close()
+			out = sw
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			die("stream recv: %v", err)
+		}
 
+	case "lines":
+		if *jobID == "" {
+			die("lines requires -id")
+		}
+		if *target != "stdout" && *target != "stderr" {
+			die("invalid -target (stdout|stderr)")
+		}
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		resp, err := c.CountLines(ctx, *jobID, *target == "stderr")
+		if err != nil {
+			die("CountOutputLines: %v", err)
+		}
+		fmt.Printf("lines=%d bytes=%d\n", resp.GetLines(), resp.GetBytes())
+
+	case "logs":
+		if *target != "stdout" && *target != "stderr" {
+			die("invalid -target (stdout|stderr)")
+		}
+		selector, err := cluster.ParseLabels(*jLab)
+		if err != nil {
+			die("invalid -label: %v", err)
+		}
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		stream, err := c.StreamJobs(ctx, client.JobsOutputOptions{
+			ListOptions: client.ListOptions{AllUsers: *allUsers, Owner: *owner, Namespace: *nspace},
+			Selector:    selector,
+			Stderr:      *target == "stderr",
+			Follow:      *follow,
+		})
+		if err != nil {
+			die("StreamJobsOutput: %v", err)
+		}
+		sanitizers := make(map[string]*sanitizer) // by job
 		for {
 			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
 			if err != nil {
-				if err == io.EOF {
-					return
+				die("StreamJobsOutput: %v", err)
+			}
+			if *sanitize {
+				s := sanitizers[msg.GetJobId()]
+				if s == nil {
+					s = &sanitizer{}
+					sanitizers[msg.GetJobId()] = s
 				}
-				die("stream recv: %v", err)
+				msg.Chunk = s.clean(nil, msg.GetChunk())
+			}
+			printJobLines(os.Stdout, msg)
+		}
+
+	case "grep":
+		if *jobID == "" || flag.NArg() != 1 {
+			die("usage: jobctl -cmd grep -id <job> [-target stderr] [-C n] [-ignore-case] [-max-matches n] <regexp>")
+		}
+		if *target != "stdout" && *target != "stderr" {
+			die("invalid -target (stdout|stderr)")
+		}
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		resp, err := c.Search(ctx, *jobID, client.SearchOptions{
+			Pattern:    flag.Arg(0),
+			IgnoreCase: *ignCase,
+			Stderr:     *target == "stderr",
+			Context:    *ctxLines,
+			MaxMatches: *maxMatch,
+		})
+		if err != nil {
+			die("SearchOutput: %v", err)
+		}
+		if *sanitize {
+			for _, l := range resp.GetLines() {
+				var s sanitizer
+				l.Text = string(s.flush(s.clean(nil, []byte(l.GetText()))))
 			}
-			os.Stdout.Write(msg.GetChunk())
+		}
+		printMatches(os.Stdout, resp, *ctxLines > 0)
+		if resp.GetTruncated() {
+			fmt.Fprintf(os.Stderr, "stopped after %d matches; raise -max-matches for more\n", resp.GetMatches())
+		}
+		if resp.GetMatches() == 0 {
+			os.Exit(1)
+		}
+
+	case "ps":
+		if *jobID == "" {
+			die("ps requires -id")
+		}
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		procs, err := c.Processes(ctx, *jobID)
+		if err != nil {
+			die("GetJobProcesses: %v", err)
+		}
+		printProcesses(os.Stdout, procs)
+
+	case "result":
+		if *jobID == "" {
+			die("result requires -id")
+		}
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		resp, err := c.Result(ctx, *jobID)
+		if err != nil {
+			die("GetJobResult: %v", err)
+		}
+		os.Stdout.Write(resp.GetData())
+		if resp.GetTruncated() {
+			fmt.Fprintln(os.Stderr, "warning: the job wrote more than 1 MiB of result data; the rest was dropped")
+		}
+		if !resp.GetComplete() {
+			fmt.Fprintln(os.Stderr, "warning: the job is still running; this is its result data so far")
+		}
+
+	case "core":
+		if *jobID == "" {
+			die("core requires -id")
+		}
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		path := *outFile
+		if path == "" {
+			path = "core." + *jobID
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			die("core: %v", err)
+		}
+		n, err := c.DownloadCore(ctx, *jobID, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+			die("DownloadCore: %v", err)
+		}
+		fmt.Printf("wrote %d bytes to %s\n", n, path)
+
+	case "download":
+		if *jobID == "" {
+			die("download requires -id")
+		}
+		var stderr bool
+		switch *target {
+		case "stdout":
+		case "stderr":
+			stderr = true
+		default:
+			die("invalid -target (stdout|stderr)")
+		}
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		path := *outFile
+		if path == "" {
+			path = *jobID + "." + *target
+		}
+		var f *os.File
+		if path == "-" {
+			f = os.Stdout
+		} else if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			die("download: %v", err)
+		}
+		d, err := c.DownloadOutput(ctx, *jobID, stderr, f)
+		if path != "-" {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+			}
+		}
+		if err != nil {
+			die("DownloadOutput: %v", err)
+		}
+		note, out := "", os.Stdout
+		if !d.Complete {
+			note = " (job still running: output so far)"
+		}
+		if path == "-" {
+			out = os.Stderr
+		}
+		fmt.Fprintf(out, "wrote %d bytes to %s sha256=%x%s\n", d.Size, path, d.SHA256, note)
+
+	case "list":
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		jobs, err := c.List(ctx, client.ListOptions{AllUsers: *allUsers, Owner: *owner, Namespace: *nspace})
+		if err != nil {
+			die("ListJobs: %v", err)
+		}
+		for _, j := range jobs {
+			fmt.Printf("job_id=%s owner=%s status=%s exit_code=%d started=%s exe=%q",
+				j.GetJobId(),
+				j.GetOwner(),
+				j.GetMetadata().GetStatus(),
+				j.GetMetadata().GetExitCode(),
+				j.GetStartedAt().AsTime().Format(time.RFC3339),
+				j.GetExecutable(),
+			)
+			if len(j.GetLabels()) > 0 {
+				fmt.Printf(" labels=%s", cluster.FormatLabels(j.GetLabels()))
+			}
+			if ns := j.GetMetadata().GetNamespace(); ns != "" && ns != "default" {
+				fmt.Printf(" namespace=%s", ns)
+			}
+			fmt.Println()
+		}
+
+	case "watch":
+		if *interval <= 0 {
+			die("-interval must be positive")
+		}
+		err := runWatch(root, c, watchOptions{
+			list:       client.ListOptions{AllUsers: *allUsers, Owner: *owner, Namespace: *nspace},
+			interval:   *interval,
+			timeout:    *timeout,
+			iterations: *frames,
+		})
+		if err != nil {
+			die("watch: %v", err)
+		}
+
+	case completeIDsCmd:
+		ctx, cancel := commandContext(root, *timeout, 2*time.Second)
+		defer cancel()
+
+		jobs, err := c.List(ctx, client.ListOptions{AllUsers: *allUsers, Owner: *owner, Namespace: *nspace})
+		if err != nil {
+			die("ListJobs: %v", err)
+		}
+		for _, j := range jobs {
+			r := watchRowOf(j)
+			fmt.Printf("%s\t%s %s\n", r.id, r.status, r.exe)
+		}
+
+	case "top":
+		if *interval <= 0 {
+			die("-interval must be positive")
+		}
+		err := runTop(root, c, topOptions{
+			id:         *jobID,
+			list:       client.ListOptions{AllUsers: *allUsers, Owner: *owner, Namespace: *nspace},
+			interval:   *interval,
+			sortBy:     *sortBy,
+			iterations: *frames,
+		})
+		if err != nil {
+			die("top: %v", err)
+		}
+
+	case "quota":
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		q, err := c.Quota(ctx, *owner)
+		if err != nil {
+			die("GetQuota: %v", err)
+		}
+		lim, used := q.GetLimit(), q.GetUsed()
+		fmt.Printf("user=%s jobs=%d/%s cpu_millis=%d/%s memory_bytes=%d/%s\n",
+			q.GetUser(),
+			used.GetJobs(), quotaLimit(int64(lim.GetJobs())),
+			used.GetCpuMillis(), quotaLimit(lim.GetCpuMillis()),
+			used.GetMemoryBytes(), quotaLimit(lim.GetMemoryBytes()),
+		)
+
+	case "log-level":
+		if *level == "" {
+			die("log-level requires -level")
+		}
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		resp, err := c.AdminRPC().SetLogLevel(ctx, &jobpb.SetLogLevelRequest{Level: *level})
+		if err != nil {
+			die("SetLogLevel: %v", err)
+		}
+		fmt.Printf("log_level=%s previous=%s\n", resp.GetLevel(), resp.GetPrevious())
+
+	case "drain", "resume":
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		resp, err := c.AdminRPC().Drain(ctx, &jobpb.DrainRequest{Drain: *cmd == "drain"})
+		if err != nil {
+			die("Drain: %v", err)
+		}
+		fmt.Printf("draining=%t running_jobs=%d\n", resp.GetDraining(), resp.GetRunningJobs())
+
+	case "gc":
+		ctx, cancel := commandContext(root, *timeout, 30*time.Second)
+		defer cancel()
+
+		resp, err := c.AdminRPC().RunGC(ctx, &jobpb.RunGCRequest{OlderThanSeconds: int64(olderThn.Seconds())})
+		if err != nil {
+			die("RunGC: %v", err)
+		}
+		fmt.Printf("removed=%d remaining=%d\n", resp.GetRemoved(), resp.GetRemaining())
+
+	case "settings":
+		ctx, cancel := commandContext(root, *timeout, 5*time.Second)
+		defer cancel()
+
+		// With neither -level nor -max-jobs this just reports the settings.
+		s, err := c.AdminRPC().UpdateSettings(ctx, &jobpb.UpdateSettingsRequest{LogLevel: *level, MaxJobs: int32(*maxJobs)})
+		if err != nil {
+			die("UpdateSettings: %v", err)
+		}
+		fmt.Printf("log_level=%s max_jobs=%d draining=%t\n", s.GetLogLevel(), s.GetMaxJobs(), s.GetDraining())
+
+	case "exec":
+		if *jobID == "" {
+			die("usage: jobctl -cmd exec -id <job> [command [args...]]  (default sh)")
+		}
+		ctx, cancel := commandContext(root, *timeout, 0)
+		defer cancel()
+
+		code, err := runExec(ctx, c.AdminRPC(), *jobID, flag.Args(), os.Stdin, os.Stdout, os.Stderr)
+		if err != nil {
+			die("ExecInJob: %v", err)
+		}
+		os.Exit(code)
+
+	case "debug":
+		ctx, cancel := commandContext(root, *timeout, 10*time.Second)
+		defer cancel()
+
+		d, err := c.AdminRPC().GetDiagnostics(ctx, &jobpb.GetDiagnosticsRequest{})
+		if err != nil {
+			die("GetDiagnostics: %v", err)
+		}
+		printDiagnostics(d)
+
+	case "accounting":
+		if *outFmt != "csv" && *outFmt != "json" {
+			die("invalid -o %q (want csv or json)", *outFmt)
+		}
+		start, err := parsePeriodBound(*from)
+		if err != nil {
+			die("invalid -from: %v", err)
+		}
+		if start.IsZero() {
+			start = monthStart(time.Now())
+		}
+		end, err := parsePeriodBound(*to)
+		if err != nil {
+			die("invalid -to: %v", err)
+		}
+		req := &jobpb.ExportAccountingRequest{From: timestamppb.New(start), Owner: *owner}
+		if !end.IsZero() {
+			req.To = timestamppb.New(end)
+		}
+
+		ctx, cancel := commandContext(root, *timeout, 10*time.Second)
+		defer cancel()
+
+		resp, err := c.AdminRPC().ExportAccounting(ctx, req)
+		if err != nil {
+			die("ExportAccounting: %v", err)
+		}
+		if err := writeAccounting(os.Stdout, *outFmt, resp); err != nil {
+			die("%v", err)
 		}
 
 	default:
@@ -150,6 +999,49 @@ func main() {
 	}
 }
 
+// startedJob reports a job start has made, then with wait or follow waits
+// for the job and exits as it did.
+func startedJob(ctx context.Context, c *client.Client, id string, wait, follow, sanitize, tty bool) {
+	if !wait && !follow {
+		fmt.Println(id)
+		return
+	}
+	out := os.Stdout
+	if follow {
+		out = os.Stderr // stdout is the job's
+	}
+	fmt.Fprintln(out, id)
+	if follow && tty && isTerminal(os.Stdout) {
+		go forwardResizes(ctx, c, id)
+	}
+	code, info, err := waitForJob(ctx, c, id, follow, sanitize)
+	if err != nil {
+		die("%v", err)
+	}
+	fmt.Fprintf(out, "job_id=%s status=%s exit_code=%d reason=%q\n", info.ID, info.Status.String(), info.ExitCode, info.Reason)
+	os.Exit(code)
+}
+
+// commandContext bounds a command by -timeout, or def when that's unset
+// (def 0 = no limit), within the overall -deadline already on parent.
+func commandContext(parent context.Context, timeout, def time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		def = timeout
+	}
+	if def <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, def)
+}
+
+// parseDeadline accepts a duration from now or an absolute RFC3339 time.
+func parseDeadline(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
 func die(format string, args ...any) {
 	log.Printf(format, args...)
 	os.Exit(1)
@@ -181,74 +1073,220 @@ func splitArgs(s string) []string {
 	return out
 }
 
-func buildClientTLSConfig(certsDir, addr string, insecure bool) (*tls.Config, error) {
-	identityDir, err := discoverIdentityDir(certsDir)
-	if err != nil {
-		return nil, err
+// printResolved prints a validate_only result one key=value per line.
+func printResolved(r *jobpb.ResolvedJob) {
+	fmt.Printf("user=%s\n", r.GetUser())
+	fmt.Printf("run_as=%s\n", r.GetRunAs())
+	fmt.Printf("executable=%s\n", r.GetExecutable())
+	fmt.Printf("args=%q\n", r.GetArgs())
+	if r.GetImage() != "" {
+		fmt.Printf("image=%s\n", r.GetImage())
+	}
+	if r.GetWorkingDir() != "" {
+		fmt.Printf("working_dir=%s\n", r.GetWorkingDir())
+	}
+	fmt.Printf("cgroup_limits=%q\n", r.GetCgroupLimits())
+	fmt.Printf("rlimits=%q\n", r.GetRlimits())
+	if r.GetUmask() != "" {
+		fmt.Printf("umask=%s\n", r.GetUmask())
+	}
+	fmt.Printf("env=%s\n", strings.Join(r.GetEnvNames(), ","))
+	if r.GetGpus() > 0 {
+		fmt.Printf("gpus=%d\n", r.GetGpus())
 	}
+}
 
-	clientCertPath := filepath.Join(identityDir, "client.crt")
-	clientKeyPath := filepath.Join(identityDir, "client.key")
-	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("load client keypair (%s): %w", identityDir, err)
+// quotaLimit renders a quota limit, where 0 means unlimited.
+// printGroup prints a group's counts, then one line per member.
+func printGroup(gs *jobpb.GroupStatus) {
+	fmt.Printf("group_id=%s total=%d created=%d running=%d succeeded=%d failed=%d stopped=%d done=%t\n",
+		gs.GetGroupId(), gs.GetTotal(), gs.GetCreated(), gs.GetRunning(),
+		gs.GetSucceeded(), gs.GetFailed(), gs.GetStopped(), gs.GetDone())
+	for _, j := range gs.GetJobs() {
+		md := j.GetMetadata()
+		fmt.Printf("  job_id=%s status=%s exit_code=%d reason=%q\n", j.GetJobId(), md.GetStatus(), md.GetExitCode(), md.GetReason())
 	}
+}
 
-	caPath := filepath.Join(certsDir, "ca.crt")
-	caPEM, err := os.ReadFile(caPath)
-	if err != nil {
-		return nil, fmt.Errorf("read ca.crt: %w", err)
+// printJobLines prints a StreamJobsOutput chunk one line at a time, each
+// prefixed with "[job-id] " (and the node, in multi-node mode).
+func printJobLines(w io.Writer, msg *jobpb.JobOutputChunk) {
+	prefix := "[" + msg.GetJobId() + "] "
+	if msg.GetNode() != "" {
+		prefix = "[" + msg.GetNode() + "/" + msg.GetJobId() + "] "
 	}
-	roots := x509.NewCertPool()
-	if ok := roots.AppendCertsFromPEM(caPEM); !ok {
-		return nil, fmt.Errorf("append ca.crt: no certs found")
+	for _, line := range strings.SplitAfter(string(msg.GetChunk()), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		io.WriteString(w, prefix+line)
 	}
+}
 
-	host := addr
-	// addr might be "host:port"
-	if h, _, err := net.SplitHostPort(addr); err == nil {
-		host = h
+// printMatches prints SearchOutput results like grep -n: "12:text" for a
+// match, "11-text" for context and, with context, "--" between
+// non-adjacent groups.
+func printMatches(w io.Writer, resp *jobpb.SearchOutputResponse, context bool) {
+	var prev uint64
+	for _, l := range resp.GetLines() {
+		if context && prev != 0 && l.GetNumber() != prev+1 {
+			fmt.Fprintln(w, "--")
+		}
+		sep := "-"
+		if l.GetMatch() {
+			sep = ":"
+		}
+		fmt.Fprintf(w, "%d%s%s\n", l.GetNumber(), sep, l.GetText())
+		prev = l.GetNumber()
 	}
+}
 
-	tlsCfg := &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{clientCert},
-		RootCAs:      roots,
-		ServerName:   host,
+// printProcesses prints a job's processes as a tree, like ps f: each
+// process under its parent, children indented.
+func printProcesses(w io.Writer, procs []*jobpb.JobProcess) {
+	byPID := make(map[int32]bool, len(procs))
+	for _, p := range procs {
+		byPID[p.GetPid()] = true
+	}
+	children := make(map[int32][]*jobpb.JobProcess)
+	var roots []*jobpb.JobProcess
+	for _, p := range procs {
+		if byPID[p.GetPpid()] {
+			children[p.GetPpid()] = append(children[p.GetPpid()], p)
+		} else {
+			roots = append(roots, p)
+		}
 	}
 
-	if insecure {
-		tlsCfg.InsecureSkipVerify = true // dev-only
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tPPID\tSTAT\tTHR\tRSS\tTIME\tSTARTED\tCOMMAND")
+	var walk func(p *jobpb.JobProcess, depth int)
+	walk = func(p *jobpb.JobProcess, depth int) {
+		cmd := strings.Join(p.GetArgs(), " ")
+		if cmd == "" {
+			cmd = "[" + p.GetCommand() + "]"
+		}
+		if depth > 0 {
+			cmd = strings.Repeat("    ", depth-1) + " \\_ " + cmd
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			p.GetPid(), p.GetPpid(), p.GetState(), p.GetThreads(),
+			humanBytes(float64(p.GetRssBytes())),
+			(time.Duration(p.GetCpuUsec()) * time.Microsecond).Truncate(10*time.Millisecond),
+			p.GetStartedAt().AsTime().Local().Format(time.TimeOnly),
+			cmd)
+		for _, c := range children[p.GetPid()] {
+			walk(c, depth+1)
+		}
+	}
+	for _, p := range roots {
+		walk(p, 0)
 	}
-	return tlsCfg, nil
+	tw.Flush()
 }
 
-func discoverIdentityDir(certsDir string) (string, error) {
-	entries, err := os.ReadDir(certsDir)
-	if err != nil {
-		return "", err
+func quotaLimit(n int64) string {
+	if n == 0 {
+		return "unlimited"
 	}
+	return fmt.Sprint(n)
+}
 
-	var found string
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
+// printDiagnostics prints server totals, then one line per job.
+func printDiagnostics(d *jobpb.GetDiagnosticsResponse) {
+	st := d.GetSettings()
+	fmt.Printf("uptime=%s goroutines=%d heap_alloc=%d total_alloc=%d gc_cycles=%d jobs=%d running=%d streams=%d output_bytes=%d log_level=%s max_jobs=%d draining=%t\n",
+		time.Duration(d.GetUptimeSeconds())*time.Second,
+		d.GetGoroutines(),
+		d.GetHeapAllocBytes(),
+		d.GetTotalAllocBytes(),
+		d.GetGcCycles(),
+		d.GetTotalJobs(),
+		d.GetRunningJobs(),
+		d.GetActiveStreams(),
+		d.GetOutputBytes(),
+		st.GetLogLevel(),
+		st.GetMaxJobs(),
+		st.GetDraining(),
+	)
+	for _, v := range d.GetOutputVolumes() {
+		fmt.Printf("volume path=%s total_bytes=%d free_bytes=%d below_min_free=%t jobs=%d output_bytes=%d\n",
+			v.GetPath(), v.GetTotalBytes(), v.GetFreeBytes(), v.GetBelowMinFree(), v.GetJobs(), v.GetOutputBytes())
+	}
+	for _, j := range d.GetJobs() {
+		lastRead := "-"
+		if t := j.GetLastOutputReadUnix(); t != 0 {
+			lastRead = time.Unix(t, 0).Format(time.RFC3339)
 		}
-		d := filepath.Join(certsDir, e.Name())
-		if fileExists(filepath.Join(d, "client.crt")) && fileExists(filepath.Join(d, "client.key")) {
-			if found != "" {
-				return "", fmt.Errorf("multiple identities found under %s; specify one", certsDir)
-			}
-			found = d
+		fmt.Printf("job_id=%s status=%s exit_code=%d pid=%d pids=%d pids_max_hits=%d streams=%d stdout_bytes=%d stderr_bytes=%d output_reads=%d output_bytes_read=%d last_read=%s started=%s jobs_dir=%s cgroup=%s exe=%q\n",
+			j.GetJobId(),
+			j.GetStatus(),
+			j.GetExitCode(),
+			j.GetPid(),
+			j.GetPids(),
+			j.GetPidsMaxHits(),
+			j.GetStreams(),
+			j.GetStdoutBytes(),
+			j.GetStderrBytes(),
+			j.GetOutputReads(),
+			j.GetOutputBytesRead(),
+			lastRead,
+			time.Unix(j.GetStartedAtUnix(), 0).Format(time.RFC3339),
+			j.GetJobsDir(),
+			j.GetCgroupPath(),
+			j.GetExecutable(),
+		)
+	}
+}
+
+// parseIOMax parses -io-max: limits.ParseIOMax entries separated by ';'.
+func parseIOMax(s string) ([]*jobpb.IOLimit, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var out []*jobpb.IOLimit
+	for _, entry := range strings.Split(s, ";") {
+		m, err := limits.ParseIOMax(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, &jobpb.IOLimit{Device: m.Device, Rbps: m.RBps, Wbps: m.WBps, Riops: m.RIOPS, Wiops: m.WIOPS})
 	}
-	if found == "" {
-		return "", fmt.Errorf("no identity found under %s", certsDir)
+	return out, nil
+}
+
+// parseSecretEnv parses "ENV=secret,ENV2=secret2" into a map.
+func parseSecretEnv(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
 	}
-	return found, nil
+	out := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("expected ENV=secret-name, got %q", pair)
+		}
+		out[k] = v
+	}
+	return out, nil
 }
 
-func fileExists(p string) bool {
-	_, err := os.Stat(p)
-	return err == nil
+// parseEnv parses "NAME=value,NAME2=value2" into a map; a value may be
+// empty.
+func parseEnv(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected NAME=value, got %q", pair)
+		}
+		out[k] = v
+	}
+	return out, nil
 }
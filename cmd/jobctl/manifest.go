@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/bucknercd/jobworker/internal/manifest"
+	"github.com/bucknercd/jobworker/pkg/client"
+)
+
+// applyManifest starts the manifest's jobs that aren't there yet. A job
+// whose latest run (or restart) was started from the same definition is
+// left as it is, running or finished; one whose definition changed is
+// started anew once the old run has finished. With force, every job is
+// started anew, still-running ones stopped first. It reports each job on
+// stdout, and whether all were applied.
+func applyManifest(ctx context.Context, c *client.Client, jobs []manifest.Job, force bool) bool {
+	existing, err := c.List(ctx, client.ListOptions{})
+	if err != nil {
+		die("ListJobs: %v", err)
+	}
+
+	ok := true
+	for _, j := range jobs {
+		prev := manifest.Latest(existing, j.Name)
+		if prev != nil {
+			id, st := prev.GetJobId(), prev.GetMetadata().GetStatus()
+			switch {
+			case !force && j.Current(prev):
+				fmt.Printf("name=%s job_id=%s status=%s action=unchanged\n", j.Name, id, st)
+				continue
+			case manifest.Active(st) && !force:
+				fmt.Fprintf(os.Stderr, "%s: job %s, from an earlier definition, is still %s; stop it first or use -force\n", j.Name, id, st)
+				ok = false
+				continue
+			case manifest.Active(st):
+				if _, err := c.Stop(ctx, id); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: StopJob %s: %v\n", j.Name, id, err)
+					ok = false
+					continue
+				}
+			}
+		}
+		id, err := c.Start(ctx, j.Spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: StartJob: %v\n", j.Name, err)
+			ok = false
+			continue
+		}
+		action := "started"
+		if prev != nil {
+			action = "updated"
+		}
+		fmt.Printf("name=%s job_id=%s action=%s\n", j.Name, id, action)
+	}
+	return ok
+}
+
+// getManifest prints where each of the manifest's jobs stands: its latest
+// run, and whether that was started from the definition there now.
+func getManifest(ctx context.Context, c *client.Client, jobs []manifest.Job) {
+	existing, err := c.List(ctx, client.ListOptions{})
+	if err != nil {
+		die("ListJobs: %v", err)
+	}
+	for _, j := range jobs {
+		prev := manifest.Latest(existing, j.Name)
+		if prev == nil {
+			fmt.Printf("name=%s status=NOT_APPLIED\n", j.Name)
+			continue
+		}
+		md := prev.GetMetadata()
+		fmt.Printf("name=%s job_id=%s status=%s exit_code=%d restarts=%d current=%t",
+			j.Name, prev.GetJobId(), md.GetStatus(), md.GetExitCode(), md.GetRestartCount(),
+			j.Current(prev))
+		if md.GetReason() != "" {
+			fmt.Printf(" reason=%q", md.GetReason())
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// sanitizer strips what could take over a terminal from job output, for
+// -sanitize: ANSI escape sequences (CSI, OSC, DCS and the like), control
+// characters other than newline and tab (carriage returns included), and
+// bidi overrides. Invalid UTF-8 becomes U+FFFD. It keeps its state between
+// chunks, so a sequence or character split across two is still handled.
+type sanitizer struct {
+	state   int
+	partial []byte // an incomplete UTF-8 sequence ending the last chunk
+}
+
+const (
+	sanText   = iota
+	sanEscape // after ESC, until a final byte
+	sanCSI    // after ESC [, until a final byte
+	sanString // OSC, DCS, SOS, PM or APC, until BEL or ESC \
+)
+
+// clean appends p, sanitized, to dst.
+func (s *sanitizer) clean(dst, p []byte) []byte {
+	if len(s.partial) > 0 {
+		p = append(s.partial, p...)
+		s.partial = nil
+	}
+	for i := 0; i < len(p); {
+		b := p[i]
+		switch s.state {
+		case sanEscape:
+			i++
+			switch {
+			case b == '[':
+				s.state = sanCSI
+			case b == ']', b == 'P', b == 'X', b == '^', b == '_':
+				s.state = sanString
+			case b >= 0x20 && b <= 0x2f: // intermediate byte
+			default:
+				s.state = sanText
+			}
+			continue
+		case sanCSI:
+			if b >= 0x80 { // not part of a sequence: end it and keep b
+				s.state = sanText
+				continue
+			}
+			i++
+			if b >= 0x40 && b <= 0x7e {
+				s.state = sanText
+			}
+			continue
+		case sanString:
+			i++
+			switch b {
+			case 0x07:
+				s.state = sanText
+			case 0x1b: // ESC \ ends it; any other escape starts anew
+				s.state = sanEscape
+			}
+			continue
+		}
+
+		if b < utf8.RuneSelf {
+			i++
+			switch {
+			case b == 0x1b:
+				s.state = sanEscape
+			case b == '\n', b == '\t', b >= 0x20 && b < 0x7f:
+				dst = append(dst, b)
+			}
+			continue
+		}
+		r, n := utf8.DecodeRune(p[i:])
+		if r == utf8.RuneError && n <= 1 {
+			if !utf8.FullRune(p[i:]) {
+				s.partial = append([]byte(nil), p[i:]...)
+				break
+			}
+			dst = append(dst, string(utf8.RuneError)...)
+			i++
+			continue
+		}
+		if !hiddenRune(r) {
+			dst = append(dst, p[i:i+n]...)
+		}
+		i += n
+	}
+	return dst
+}
+
+// flush appends what clean held back, once no more output is coming.
+func (s *sanitizer) flush(dst []byte) []byte {
+	if len(s.partial) > 0 {
+		dst = append(dst, string(utf8.RuneError)...)
+		s.partial = nil
+	}
+	return dst
+}
+
+// hiddenRune reports C1 controls and the bidi formatting characters that
+// can make text display differently from what it is.
+func hiddenRune(r rune) bool {
+	switch {
+	case r >= 0x80 && r <= 0x9f,
+		r == 0x061c, r == 0x200e, r == 0x200f,
+		r >= 0x202a && r <= 0x202e,
+		r >= 0x2066 && r <= 0x2069:
+		return true
+	}
+	return false
+}
+
+// sanitizeWriter sanitizes what is written through it to w. Close writes
+// anything held back, without closing w.
+type sanitizeWriter struct {
+	w   io.Writer
+	s   sanitizer
+	buf []byte
+}
+
+func (w *sanitizeWriter) Write(p []byte) (int, error) {
+	w.buf = w.s.clean(w.buf[:0], p)
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *sanitizeWriter) Close() error {
+	_, err := w.w.Write(w.s.flush(nil))
+	return err
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// topSorts are the columns top can sort by, with the key that picks each
+// one interactively. Everything but id sorts largest first.
+var topSorts = []struct {
+	name string
+	key  byte
+}{
+	{"cpu", 'c'}, {"mem", 'm'}, {"read", 'r'}, {"write", 'w'}, {"pids", 'p'}, {"time", 't'}, {"id", 'i'},
+}
+
+// topRow is one job with rates computed against its previous sample.
+type topRow struct {
+	*jobpb.JobStats
+	cpuPct          float64 // of one CPU; -1 until there are two samples
+	readPS, writePS float64 // bytes/s
+	uptime          time.Duration
+}
+
+type topOptions struct {
+	id         string // watch just this job
+	list       client.ListOptions
+	interval   time.Duration
+	sortBy     string
+	iterations int // 0 = until interrupted
+}
+
+// topBatch is one sample off the watch, or the error that ended it.
+type topBatch struct {
+	jobs []*jobpb.JobStats
+	err  error
+}
+
+// runTop redraws a table of running jobs as the server pushes samples,
+// every interval, until ctx ends, q is pressed, the watched job finishes
+// or iterations frames have been shown. CPU% and IO rates are the change in
+// the cgroup counters since the previous sample.
+func runTop(ctx context.Context, c *client.Client, opts topOptions) error {
+	if !validTopSort(opts.sortBy) {
+		return fmt.Errorf("invalid -sort %q (want %s)", opts.sortBy, topSortNames())
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w, err := c.WatchStats(ctx, opts.id, opts.list, opts.interval)
+	if err != nil {
+		return err
+	}
+	batches := make(chan topBatch)
+	go func() {
+		for {
+			jobs, err := w.Recv()
+			select {
+			case batches <- topBatch{jobs, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	tty := isTerminal(os.Stdout)
+	keys := make(chan byte)
+	if tty {
+		if restore, err := cbreak(os.Stdin); err == nil {
+			defer restore()
+			go readKeys(os.Stdin, keys)
+		}
+	}
+
+	var (
+		prev []*jobpb.JobStats
+		rows []topRow // last frame, resorted on a key press
+	)
+	// The first sample has no rates yet. A terminal shows it straight away;
+	// piped output waits for the second so every frame is complete. Only
+	// frames with rates count toward iterations.
+	for frames := 0; opts.iterations == 0 || frames < opts.iterations; {
+		select {
+		case <-ctx.Done():
+			return nil
+		case k := <-keys:
+			if k == 'q' {
+				return nil
+			}
+			for _, s := range topSorts {
+				if s.key == k && rows != nil {
+					opts.sortBy = s.name
+					renderTop(os.Stdout, rows, opts.sortBy, tty)
+				}
+			}
+		case b := <-batches:
+			if errors.Is(b.err, io.EOF) {
+				return nil // the watched job is done
+			}
+			if b.err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return b.err
+			}
+			rows = topRows(b.jobs, prev)
+			if prev != nil || tty {
+				renderTop(os.Stdout, rows, opts.sortBy, tty)
+			}
+			if prev != nil {
+				frames++
+			}
+			prev = b.jobs
+		}
+	}
+	return nil
+}
+
+// topRows pairs each job in cur with its sample in prev, if any.
+func topRows(cur, prev []*jobpb.JobStats) []topRow {
+	before := make(map[string]*jobpb.JobStats, len(prev))
+	for _, s := range prev {
+		before[s.GetJobId()] = s
+	}
+	rows := make([]topRow, 0, len(cur))
+	for _, s := range cur {
+		r := topRow{JobStats: s, cpuPct: -1, readPS: -1, writePS: -1}
+		if t := s.GetRunningAt(); t != nil {
+			r.uptime = s.GetSampledAt().AsTime().Sub(t.AsTime())
+		}
+		if p, ok := before[s.GetJobId()]; ok {
+			dt := s.GetSampledAt().AsTime().Sub(p.GetSampledAt().AsTime()).Seconds()
+			if dt > 0 {
+				r.cpuPct = float64(s.GetCpuUsageUsec()-p.GetCpuUsageUsec()) / 1e6 / dt * 100
+				r.readPS = float64(s.GetIoReadBytes()-p.GetIoReadBytes()) / dt
+				r.writePS = float64(s.GetIoWriteBytes()-p.GetIoWriteBytes()) / dt
+			}
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+func sortTop(rows []topRow, by string) {
+	less := map[string]func(a, b topRow) bool{
+		"cpu":   func(a, b topRow) bool { return a.cpuPct > b.cpuPct },
+		"mem":   func(a, b topRow) bool { return a.GetMemoryBytes() > b.GetMemoryBytes() },
+		"read":  func(a, b topRow) bool { return a.readPS > b.readPS },
+		"write": func(a, b topRow) bool { return a.writePS > b.writePS },
+		"pids":  func(a, b topRow) bool { return a.GetPids() > b.GetPids() },
+		"time":  func(a, b topRow) bool { return a.uptime > b.uptime },
+		"id":    func(a, b topRow) bool { return a.GetJobId() < b.GetJobId() },
+	}[by]
+	sort.SliceStable(rows, func(i, j int) bool {
+		if less(rows[i], rows[j]) != less(rows[j], rows[i]) {
+			return less(rows[i], rows[j])
+		}
+		return rows[i].GetJobId() < rows[j].GetJobId()
+	})
+}
+
+func renderTop(w io.Writer, rows []topRow, by string, tty bool) {
+	sortTop(rows, by)
+	if tty {
+		fmt.Fprint(w, "\033[H\033[2J") // home, clear screen
+	}
+	fmt.Fprintf(w, "%s  %d running  sort=%s", time.Now().Format(time.TimeOnly), len(rows), by)
+	if tty {
+		var keys []string
+		for _, s := range topSorts {
+			keys = append(keys, fmt.Sprintf("%c=%s", s.key, s.name))
+		}
+		fmt.Fprintf(w, "  [%s q=quit]", strings.Join(keys, " "))
+	}
+	fmt.Fprintln(w)
+
+	multiNode := false
+	for _, r := range rows {
+		multiNode = multiNode || r.GetNode() != ""
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	cols := []string{"JOB_ID", "OWNER"}
+	if multiNode {
+		cols = append(cols, "NODE")
+	}
+	cols = append(cols, "CPU%", "MEM", "MEM%", "READ/s", "WRITE/s", "PIDS", "TIME", "EXE")
+	fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	for _, r := range rows {
+		f := []string{r.GetJobId(), r.GetOwner()}
+		if multiNode {
+			f = append(f, r.GetNode())
+		}
+		memPct := "-"
+		if m := r.GetMemoryMaxBytes(); m > 0 {
+			memPct = fmt.Sprintf("%.1f", float64(r.GetMemoryBytes())/float64(m)*100)
+		}
+		f = append(f,
+			rate(r.cpuPct, func(v float64) string { return fmt.Sprintf("%.1f", v) }),
+			humanBytes(float64(r.GetMemoryBytes())),
+			memPct,
+			rate(r.readPS, humanBytes),
+			rate(r.writePS, humanBytes),
+			fmt.Sprint(r.GetPids()),
+			r.uptime.Truncate(time.Second).String(),
+			r.GetExecutable(),
+		)
+		fmt.Fprintln(tw, strings.Join(f, "\t"))
+	}
+	tw.Flush()
+	if !tty {
+		fmt.Fprintln(w)
+	}
+}
+
+// rate formats v, or "-" before there are two samples.
+func rate(v float64, format func(float64) string) string {
+	if v < 0 {
+		return "-"
+	}
+	return format(v)
+}
+
+func humanBytes(n float64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", n, units[i])
+}
+
+func validTopSort(name string) bool {
+	for _, s := range topSorts {
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func topSortNames() string {
+	names := make([]string, len(topSorts))
+	for i, s := range topSorts {
+		names[i] = s.name
+	}
+	return strings.Join(names, "|")
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// cbreak turns off line buffering and echo on f so single keys arrive as
+// they're pressed, and returns a func that restores the old settings.
+func cbreak(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	t := *old
+	t.Lflag &^= unix.ICANON | unix.ECHO
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &t); err != nil {
+		return nil, err
+	}
+	return func() { _ = unix.IoctlSetTermios(fd, unix.TCSETS, old) }, nil
+}
+
+func readKeys(r io.Reader, keys chan<- byte) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			return
+		}
+		keys <- buf[0]
+	}
+}
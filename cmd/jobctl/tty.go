@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"golang.org/x/sys/unix"
+)
+
+// parseTTYSize parses -tty-size, COLSxROWS as in 120x40.
+func parseTTYSize(s string) (*jobpb.TerminalSize, error) {
+	var cols, rows uint32
+	if _, err := fmt.Sscanf(s, "%dx%d", &cols, &rows); err != nil || cols == 0 || rows == 0 {
+		return nil, fmt.Errorf("%q: want COLSxROWS, e.g. 120x40", s)
+	}
+	return &jobpb.TerminalSize{Rows: rows, Cols: cols}, nil
+}
+
+// terminalSize is f's window size, when f is a terminal.
+func terminalSize(f *os.File) (*jobpb.TerminalSize, bool) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Row == 0 || ws.Col == 0 {
+		return nil, false
+	}
+	return &jobpb.TerminalSize{Rows: uint32(ws.Row), Cols: uint32(ws.Col)}, true
+}
+
+// forwardResizes keeps job id's terminal the size of ours (stdout) until
+// ctx ends.
+func forwardResizes(ctx context.Context, c *client.Client, id string) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, unix.SIGWINCH)
+	defer signal.Stop(winch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-winch:
+		}
+		if size, ok := terminalSize(os.Stdout); ok {
+			_ = c.ResizeTerminal(ctx, id, int(size.GetRows()), int(size.GetCols())) // the job may have ended
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/version"
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// commandCapabilities are the server capabilities a command relies on,
+// beyond the basics every server has.
+var commandCapabilities = map[string][]string{
+	"create":       {"create-job"},
+	"launch":       {"create-job"},
+	"delete":       {"delete-job"},
+	"resize":       {"tty"},
+	"core":         {"download-core"},
+	"download":     {"download-output"},
+	"grep":         {"search-output"},
+	"lines":        {"output-index"},
+	"result":       {"result-fd"},
+	"logs":         {"stream-jobs-output"},
+	"top":          {"job-stats"},
+	"start-group":  {"job-groups"},
+	"group-status": {"job-groups"},
+	"group-stop":   {"job-groups"},
+	"group-wait":   {"job-groups"},
+}
+
+// checkServer warns on stderr when the server can't serve cmd as this
+// jobctl expects: its API is incompatible, or it lacks a capability in
+// need (cmd's, plus extra ones the flags ask for). It never fails the
+// command; a server it can't ask is left for the command itself to
+// report.
+func checkServer(root context.Context, c *client.Client, cmd string, extra ...string) {
+	ctx, cancel := context.WithTimeout(root, 2*time.Second)
+	defer cancel()
+
+	need := slices.Concat(commandCapabilities[cmd], extra)
+	info, err := c.ServerInfo(ctx)
+	if status.Code(err) == codes.Unimplemented {
+		if len(need) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: the server predates version checks and may not support %s\n", strings.Join(need, ", "))
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	if !info.GetCompatible() || !version.Compatible(info.GetApiVersion(), info.GetMinApiVersion()) {
+		fmt.Fprintf(os.Stderr, "warning: server %s speaks API v%d (needs clients of v%d or later); jobctl %s speaks v%d (needs servers of v%d or later)\n",
+			info.GetVersion(), info.GetApiVersion(), info.GetMinApiVersion(), version.Version, version.APIVersion, version.MinAPIVersion)
+	}
+	var missing []string
+	for _, c := range need {
+		if !version.HasCapability(info.GetCapabilities(), c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: server %s doesn't support %s; -cmd %s will likely fail\n", info.GetVersion(), strings.Join(missing, ", "), cmd)
+	}
+}
+
+// printServerInfo prints jobctl's version and the server's, for -cmd
+// version.
+func printServerInfo(info *jobpb.GetServerInfoResponse) {
+	fmt.Println(version.String("jobctl"))
+	fmt.Printf("server version=%s commit=%s built=%s go=%s api=v%d min_client_api=v%d compatible=%t",
+		info.GetVersion(), info.GetCommit(), info.GetBuildDate(), info.GetGoVersion(),
+		info.GetApiVersion(), info.GetMinApiVersion(),
+		info.GetCompatible() && version.Compatible(info.GetApiVersion(), info.GetMinApiVersion()))
+	if info.GetNode() != "" {
+		fmt.Printf(" node=%s", info.GetNode())
+	}
+	fmt.Println()
+	fmt.Printf("capabilities=%s\n", strings.Join(info.GetCapabilities(), ","))
+	if len(info.GetFeatures()) > 0 {
+		fmt.Printf("features=%s\n", strings.Join(info.GetFeatures(), ","))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"golang.org/x/sys/unix"
+)
+
+// waitForJob waits for job id to finish, with follow copying its stdout
+// and stderr to ours meanwhile (through a sanitizeWriter with sanitize),
+// and returns the exit status jobctl should end with: the job's exit code
+// as exec would report it (128+n when killed by signal n), or 1 when it
+// never ran or was stopped.
+func waitForJob(ctx context.Context, c *client.Client, id string, follow, sanitize bool) (int, *client.JobInfo, error) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	if follow {
+		for _, stderr := range []bool{false, true} {
+			r, err := c.Stream(ctx, id, stderr)
+			if err != nil {
+				return 0, nil, fmt.Errorf("StreamOutput: %w", err)
+			}
+			var w io.Writer = os.Stdout
+			if stderr {
+				w = os.Stderr
+			}
+			if sanitize {
+				sw := &sanitizeWriter{w: w}
+				defer sw.Close()
+				w = sw
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer r.Close()
+				if _, err := io.Copy(w, r); err != nil {
+					errs <- fmt.Errorf("stream recv: %w", err)
+				}
+			}()
+		}
+	}
+
+	info, err := c.Wait(ctx, id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("wait: %w", err)
+	}
+	// The streams end with the job; this only waits for their tails.
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return 0, nil, err
+	}
+
+	st := info.Status
+	if st == jobpb.JobStatus_JOB_STATUS_EXPIRED { // removed before we polled again
+		st = info.FinalStatus
+	}
+	if sig, ok := strings.CutPrefix(info.Reason, "killed by signal "); ok && st == jobpb.JobStatus_JOB_STATUS_EXITED {
+		if n := unix.SignalNum(strings.Fields(sig)[0]); n != 0 {
+			return 128 + int(n), info, nil
+		}
+	}
+	code := int(info.ExitCode)
+	if st != jobpb.JobStatus_JOB_STATUS_EXITED || code < 0 {
+		code = max(code, 1)
+	}
+	return code, info, nil
+}
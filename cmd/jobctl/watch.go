@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+type watchOptions struct {
+	list       client.ListOptions
+	interval   time.Duration
+	timeout    time.Duration // per ListJobs call
+	iterations int           // 0 = until interrupted
+}
+
+// watchRow is what watch shows of a job; a job is printed again when it
+// changes.
+type watchRow struct {
+	id, owner, node, status, exit, exe string
+	started                            time.Time
+}
+
+// runWatch polls ListJobs every interval and shows the jobs as a table,
+// like kubectl get -w. A terminal gets the whole table redrawn each time;
+// piped output gets it once, then a line per job that appears or changes
+// status.
+func runWatch(ctx context.Context, c *client.Client, opts watchOptions) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tty := isTerminal(os.Stdout)
+	keys := make(chan byte)
+	if tty {
+		if restore, err := cbreak(os.Stdin); err == nil {
+			defer restore()
+			go readKeys(os.Stdin, keys)
+		}
+	}
+
+	t := time.NewTicker(opts.interval)
+	defer t.Stop()
+	var (
+		table watchTable
+		seen  map[string]watchRow // nil until the first poll
+	)
+	for polls := 0; opts.iterations == 0 || polls < opts.iterations; polls++ {
+		if polls > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case k := <-keys:
+				if k == 'q' {
+					return nil
+				}
+				polls-- // not a poll
+				continue
+			case <-t.C:
+			}
+		}
+
+		pctx, cancel := commandContext(ctx, opts.timeout, 5*time.Second)
+		jobs, err := c.List(pctx, opts.list)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		rows := make([]watchRow, len(jobs))
+		for i, j := range jobs {
+			rows[i] = watchRowOf(j)
+		}
+
+		switch {
+		case tty:
+			table.render(os.Stdout, rows, true)
+		case seen == nil:
+			table.render(os.Stdout, rows, false)
+		default:
+			var changed []watchRow
+			for _, r := range rows {
+				if old, ok := seen[r.id]; !ok || old.status != r.status || old.exit != r.exit {
+					changed = append(changed, r)
+				}
+			}
+			// Oldest first, so the lines read in the order things happened.
+			for i, j := 0, len(changed)-1; i < j; i, j = i+1, j-1 {
+				changed[i], changed[j] = changed[j], changed[i]
+			}
+			table.write(os.Stdout, changed, hasNode(rows), false)
+		}
+		seen = make(map[string]watchRow, len(rows))
+		for _, r := range rows {
+			seen[r.id] = r
+		}
+	}
+	return nil
+}
+
+func watchRowOf(j *jobpb.JobSummary) watchRow {
+	md := j.GetMetadata()
+	r := watchRow{
+		id:     j.GetJobId(),
+		owner:  j.GetOwner(),
+		node:   md.GetNode(),
+		status: strings.TrimPrefix(md.GetStatus().String(), "JOB_STATUS_"),
+		exit:   "-",
+		exe:    j.GetExecutable(),
+	}
+	switch md.GetStatus() {
+	case jobpb.JobStatus_JOB_STATUS_EXITED, jobpb.JobStatus_JOB_STATUS_FAILED:
+		r.exit = fmt.Sprint(md.GetExitCode())
+	}
+	if t := j.GetStartedAt(); t != nil {
+		r.started = t.AsTime()
+	}
+	return r
+}
+
+// watchTable writes rows in columns that only ever widen, so lines printed
+// poll after poll stay under the header.
+type watchTable struct {
+	widths []int
+}
+
+// render writes a full table of rows, newest first as ListJobs returns
+// them.
+func (t *watchTable) render(w io.Writer, rows []watchRow, tty bool) {
+	if tty {
+		fmt.Fprint(w, "\033[H\033[2J") // home, clear screen
+		fmt.Fprintf(w, "%s  %d jobs  [q=quit]\n", time.Now().Format(time.TimeOnly), len(rows))
+	}
+	t.write(w, rows, hasNode(rows), true)
+}
+
+func (t *watchTable) write(w io.Writer, rows []watchRow, multiNode, header bool) {
+	var lines [][]string
+	if header {
+		cols := []string{"JOB_ID", "OWNER"}
+		if multiNode {
+			cols = append(cols, "NODE")
+		}
+		lines = append(lines, append(cols, "STATUS", "EXIT", "AGE", "EXE"))
+	}
+	now := time.Now()
+	for _, r := range rows {
+		f := []string{r.id, r.owner}
+		if multiNode {
+			f = append(f, r.node)
+		}
+		age := "-"
+		if !r.started.IsZero() {
+			age = shortAge(now.Sub(r.started))
+		}
+		lines = append(lines, append(f, r.status, r.exit, age, r.exe))
+	}
+	for _, l := range lines {
+		if len(t.widths) != len(l) {
+			t.widths = make([]int, len(l)) // NODE came or went
+		}
+		for i, f := range l {
+			t.widths[i] = max(t.widths[i], len(f))
+		}
+	}
+	for _, l := range lines {
+		for i, f := range l[:len(l)-1] {
+			fmt.Fprintf(w, "%-*s  ", t.widths[i], f)
+		}
+		fmt.Fprintln(w, l[len(l)-1])
+	}
+}
+
+func hasNode(rows []watchRow) bool {
+	for _, r := range rows {
+		if r.node != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// shortAge formats d the way kubectl does: 45s, 12m, 3h, 5d.
+func shortAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/bucknercd/jobworker/internal/logging"
+	"github.com/bucknercd/jobworker/internal/manager"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// adminServer implements the operator-only Admin service.
+type adminServer struct {
+	jobpb.UnimplementedAdminServer
+	logger *log.Logger
+	logs   *logging.Logs
+	mgr    *manager.Manager // nil in coordinator mode
+	admins map[string]bool
+}
+
+func NewAdminServer(logger *log.Logger, logs *logging.Logs, mgr *manager.Manager, adminCNs []string) jobpb.AdminServer {
+	return &adminServer{logger: logger, logs: logs, mgr: mgr, admins: stringSet(adminCNs)}
+}
+
+// authorize admits direct callers on the allowlist. Forwarded identities
+// are deliberately not honoured here.
+func (a *adminServer) authorize(ctx context.Context) (string, error) {
+	cn, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if !a.admins[cn] {
+		return "", status.Errorf(codes.PermissionDenied, "%s is not an admin", cn)
+	}
+	return cn, nil
+}
+
+// jobs authorizes the caller and returns the local job manager.
+func (a *adminServer) jobs(ctx context.Context) (string, *manager.Manager, error) {
+	cn, err := a.authorize(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if a.mgr == nil {
+		return "", nil, status.Error(codes.FailedPrecondition, "this server runs no jobs (coordinator mode); call the agent directly")
+	}
+	return cn, a.mgr, nil
+}
+
+func (a *adminServer) SetLogLevel(ctx context.Context, req *jobpb.SetLogLevelRequest) (*jobpb.SetLogLevelResponse, error) {
+	cn, err := a.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prev, lv, err := a.setLogLevel(cn, req.GetLevel())
+	if err != nil {
+		return nil, err
+	}
+	return &jobpb.SetLogLevelResponse{Previous: prev, Level: lv}, nil
+}
+
+func (a *adminServer) setLogLevel(cn, level string) (prev, now string, err error) {
+	lv, err := logging.ParseLevel(level)
+	if err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	prev, now = logging.LevelName(a.logs.Level()), logging.LevelName(lv)
+	a.logs.SetLevel(lv)
+	a.logger.Printf("admin %s set log level %s -> %s", cn, prev, now)
+	return prev, now, nil
+}
+
+func (a *adminServer) Drain(ctx context.Context, req *jobpb.DrainRequest) (*jobpb.DrainResponse, error) {
+	cn, mgr, err := a.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if prev := mgr.SetDraining(req.GetDrain()); prev != req.GetDrain() {
+		a.logger.Printf("admin %s set draining=%t", cn, req.GetDrain())
+	}
+	return &jobpb.DrainResponse{Draining: mgr.Draining(), RunningJobs: int32(mgr.Running())}, nil
+}
+
+func (a *adminServer) RunGC(ctx context.Context, req *jobpb.RunGCRequest) (*jobpb.RunGCResponse, error) {
+	cn, mgr, err := a.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Printf("admin %s triggered gc older_than=%ds", cn, req.GetOlderThanSeconds())
+	return mgr.RunGC(req)
+}
+
+func (a *adminServer) GetDiagnostics(ctx context.Context, _ *jobpb.GetDiagnosticsRequest) (*jobpb.GetDiagnosticsResponse, error) {
+	_, mgr, err := a.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := mgr.Diagnostics()
+	resp.Settings = a.settings()
+	return resp, nil
+}
+
+func (a *adminServer) UpdateSettings(ctx context.Context, req *jobpb.UpdateSettingsRequest) (*jobpb.RuntimeSettings, error) {
+	cn, err := a.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetMaxJobs() != 0 && a.mgr == nil {
+		return nil, status.Error(codes.FailedPrecondition, "max_jobs applies to agents; this server runs no jobs")
+	}
+
+	if req.GetLogLevel() != "" {
+		if _, _, err := a.setLogLevel(cn, req.GetLogLevel()); err != nil {
+			return nil, err
+		}
+	}
+	if n := req.GetMaxJobs(); n != 0 {
+		a.mgr.SetMaxJobs(int(n))
+		a.logger.Printf("admin %s set max_jobs=%d", cn, a.mgr.MaxJobs())
+	}
+	return a.settings(), nil
+}
+
+func (a *adminServer) ExportAccounting(ctx context.Context, req *jobpb.ExportAccountingRequest) (*jobpb.ExportAccountingResponse, error) {
+	cn, mgr, err := a.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Printf("admin %s exported accounting owner=%q", cn, req.GetOwner())
+	return mgr.ExportAccounting(req)
+}
+
+// ExecInJob is audited: who ran what in which job.
+func (a *adminServer) ExecInJob(stream jobpb.Admin_ExecInJobServer) error {
+	cn, mgr, err := a.jobs(stream.Context())
+	if err != nil {
+		return err
+	}
+	start, err := manager.ReadExecStart(stream)
+	if err != nil {
+		return err
+	}
+	a.logger.Printf("admin %s exec in job %s: exe=%q args=%v", cn, start.GetJobId(), start.GetExecutable(), start.GetArgs())
+	return mgr.ExecInJob(start, stream)
+}
+
+func (a *adminServer) settings() *jobpb.RuntimeSettings {
+	s := &jobpb.RuntimeSettings{LogLevel: logging.LevelName(a.logs.Level())}
+	if a.mgr != nil {
+		s.MaxJobs = int32(a.mgr.MaxJobs())
+		s.Draining = a.mgr.Draining()
+	}
+	return s
+}
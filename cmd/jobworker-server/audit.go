@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bucknercd/jobworker/internal/audit"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxAuditRequest bounds the request JSON kept in a record.
+const maxAuditRequest = 4 << 10
+
+// auditHook records every JobWorker and Admin call, allowed or not, once
+// it has finished.
+type auditHook struct {
+	log               *audit.Log
+	trustedForwarders map[string]bool
+}
+
+func newAuditHook(log *audit.Log, trustedForwarders []string) *auditHook {
+	return &auditHook{log: log, trustedForwarders: stringSet(trustedForwarders)}
+}
+
+// record audits a call to fullMethod with req and resp (either may be nil)
+// that ended with err.
+func (h *auditHook) record(ctx context.Context, fullMethod string, req, resp any, err error) {
+	if r, ok := h.newRecord(ctx, fullMethod, req, resp, err); ok {
+		h.log.Record(r)
+	}
+}
+
+// newRecord builds the record record writes, reporting false for calls
+// outside the audited services.
+func (h *auditHook) newRecord(ctx context.Context, fullMethod string, req, resp any, err error) (audit.Record, bool) {
+	service, verb := splitMethod(fullMethod)
+	if service != "JobWorker" && service != "Admin" {
+		return audit.Record{}, false
+	}
+	r := audit.Record{
+		Service: service,
+		Action:  verb,
+		Outcome: status.Code(err).String(),
+	}
+	if err != nil {
+		r.Error = status.Convert(err).Message()
+	}
+	r.Actor, _ = callerFromContext(ctx, h.trustedForwarders)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.Peer = p.Addr.String()
+	}
+	for _, m := range []any{req, resp} {
+		if v, ok := m.(interface{ GetJobId() string }); ok && r.JobID == "" {
+			r.JobID = v.GetJobId()
+		}
+		if v, ok := m.(interface{ GetGroupId() string }); ok && r.GroupID == "" {
+			r.GroupID = v.GetGroupId()
+		}
+	}
+	if m, ok := req.(proto.Message); ok {
+		if b, err := (protojson.MarshalOptions{UseProtoNames: true}).Marshal(m); err == nil && len(b) <= maxAuditRequest {
+			r.Request = b
+		}
+	}
+	return r, true
+}
+
+func (h *auditHook) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		h.record(ctx, info.FullMethod, req, resp, err)
+		return resp, err
+	}
+}
+
+// streamInterceptor records streams with their first message, and output
+// streams per job read (see outputStream).
+func (h *auditHook) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		switch info.FullMethod {
+		case jobpb.JobWorker_StreamOutput_FullMethodName, jobpb.JobWorker_StreamJobsOutput_FullMethodName,
+			jobpb.JobWorker_DownloadOutput_FullMethodName:
+			out := &outputStream{recordedStream: recordedStream{ServerStream: ss}, hook: h, method: info.FullMethod}
+			err := handler(srv, out)
+			out.end(err)
+			return err
+		}
+		rs := &recordedStream{ServerStream: ss}
+		err := handler(srv, rs)
+		h.record(ss.Context(), info.FullMethod, rs.received, rs.sent, err)
+		return err
+	}
+}
+
+// outputStream audits who read which job's output, since it may hold
+// secrets: a "begin" record when a job's first chunk goes out, and when
+// the stream ends an "end" record per job with the bytes sent. A stream
+// that sent nothing gets the usual single record.
+type outputStream struct {
+	recordedStream
+	hook   *auditHook
+	method string
+	jobs   []string         // in the order their output began
+	bytes  map[string]int64 // by job
+}
+
+func (s *outputStream) SendMsg(m any) error {
+	var id string
+	var n int
+	switch m := m.(type) {
+	case *jobpb.StreamOutputResponse:
+		if req, ok := s.received.(*jobpb.StreamOutputRequest); ok {
+			id, n = req.GetJobId(), len(m.GetChunk())
+		}
+	case *jobpb.DownloadOutputResponse:
+		if req, ok := s.received.(*jobpb.DownloadOutputRequest); ok {
+			id, n = req.GetJobId(), len(m.GetChunk())
+		}
+	case *jobpb.JobOutputChunk:
+		id, n = m.GetJobId(), len(m.GetChunk())
+	}
+	if id != "" {
+		if _, ok := s.bytes[id]; !ok {
+			if s.bytes == nil {
+				s.bytes = make(map[string]int64)
+			}
+			s.jobs = append(s.jobs, id)
+			r, _ := s.hook.newRecord(s.Context(), s.method, s.received, nil, nil)
+			r.JobID, r.Phase = id, audit.PhaseBegin
+			s.hook.log.Record(r)
+		}
+		s.bytes[id] += int64(n)
+	}
+	return s.recordedStream.SendMsg(m)
+}
+
+// end records how the stream ended for each job it read.
+func (s *outputStream) end(err error) {
+	if len(s.jobs) == 0 {
+		s.hook.record(s.Context(), s.method, s.received, s.sent, err)
+		return
+	}
+	for _, id := range s.jobs {
+		r, _ := s.hook.newRecord(s.Context(), s.method, s.received, nil, err)
+		r.JobID, r.Phase, r.Bytes = id, audit.PhaseEnd, s.bytes[id]
+		s.hook.log.Record(r)
+	}
+}
+
+// recordedStream keeps the first message each way: the request, and for
+// RunScript the response naming the job.
+type recordedStream struct {
+	grpc.ServerStream
+	received, sent any
+}
+
+func (s *recordedStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.received == nil {
+		s.received = m
+	}
+	return err
+}
+
+func (s *recordedStream) SendMsg(m any) error {
+	if s.sent == nil {
+		s.sent = m
+	}
+	return s.ServerStream.SendMsg(m)
+}
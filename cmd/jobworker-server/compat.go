@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/bucknercd/jobworker/internal/version"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// clientUnderstands reports whether the caller listed capability c in its
+// client capabilities. Clients from before the list existed send none.
+func clientUnderstands(ctx context.Context, c string) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(version.ClientCapabilitiesKey) {
+		if slices.Contains(strings.Split(v, ","), c) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusConversions are the JobStatus values added since the first v1
+// release: the client capability that asks for each, and what clients
+// without it get instead.
+var statusConversions = []struct {
+	capability string
+	status     jobpb.JobStatus
+	old        func(*jobpb.JobMetadata) jobpb.JobStatus
+}{
+	// The status the job had before GC removed it, or the client's wait
+	// loop would never see a terminal one.
+	{"expired-status", jobpb.JobStatus_JOB_STATUS_EXPIRED, (*jobpb.JobMetadata).GetFinalStatus},
+	// What StartJob reported before -fast-accept.
+	{"starting-status", jobpb.JobStatus_JOB_STATUS_STARTING, func(*jobpb.JobMetadata) jobpb.JobStatus {
+		return jobpb.JobStatus_JOB_STATUS_RUNNING
+	}},
+	// The process is still there until the stop has killed it.
+	{"stopping-status", jobpb.JobStatus_JOB_STATUS_STOPPING, func(*jobpb.JobMetadata) jobpb.JobStatus {
+		return jobpb.JobStatus_JOB_STATUS_RUNNING
+	}},
+	// Not running yet, and not finished: the one v1 status for that.
+	{"created-status", jobpb.JobStatus_JOB_STATUS_CREATED, func(*jobpb.JobMetadata) jobpb.JobStatus {
+		return jobpb.JobStatus_JOB_STATUS_UNSPECIFIED
+	}},
+}
+
+// compatInterceptor converts responses into what older clients expect, so
+// v1 can grow new enum values without breaking them (statusConversions).
+// Only gRPC callers need this; the HTTP gateway is built from this tree.
+func compatInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		return statusConverter(ctx)(resp), nil
+	}
+}
+
+// compatStreamInterceptor is compatInterceptor for streams: each message
+// a stream sends is converted the same way, so one that reports jobs
+// can't pass a newer status to an older client.
+func compatStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &compatStream{ServerStream: ss, convert: statusConverter(ss.Context())})
+	}
+}
+
+type compatStream struct {
+	grpc.ServerStream
+	convert func(any) any
+}
+
+func (s *compatStream) SendMsg(m any) error {
+	return s.ServerStream.SendMsg(s.convert(m))
+}
+
+// statusConverter returns what converts a response for the caller in ctx:
+// the identity if the caller understands every newer status.
+func statusConverter(ctx context.Context) func(any) any {
+	convert := map[jobpb.JobStatus]func(*jobpb.JobMetadata) jobpb.JobStatus{}
+	for _, c := range statusConversions {
+		if !clientUnderstands(ctx, c.capability) {
+			convert[c.status] = c.old
+		}
+	}
+	if len(convert) == 0 {
+		return func(resp any) any { return resp }
+	}
+	needed := func(md *jobpb.JobMetadata) bool { return convert[md.GetStatus()] != nil }
+	return func(resp any) any {
+		m, ok := resp.(proto.Message)
+		if !ok || !eachJobMetadata(m.ProtoReflect(), needed) {
+			return resp
+		}
+		// The response may share messages with the manager's own records.
+		m = proto.Clone(m)
+		eachJobMetadata(m.ProtoReflect(), func(md *jobpb.JobMetadata) bool {
+			if old := convert[md.GetStatus()]; old != nil {
+				md.Status = old(md)
+			}
+			return false
+		})
+		return m
+	}
+}
+
+// eachJobMetadata calls fn on every JobMetadata in m, however deeply
+// nested, until fn returns true. It reports whether one did.
+func eachJobMetadata(m protoreflect.Message, fn func(*jobpb.JobMetadata) bool) bool {
+	if md, ok := m.Interface().(*jobpb.JobMetadata); ok {
+		return fn(md)
+	}
+	found := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					found = eachJobMetadata(mv.Message(), fn)
+					return !found
+				})
+			}
+		case fd.Message() == nil:
+		case fd.IsList():
+			for i := 0; i < v.List().Len() && !found; i++ {
+				found = eachJobMetadata(v.List().Get(i).Message(), fn)
+			}
+		default:
+			found = eachJobMetadata(v.Message(), fn)
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/cluster"
+	"github.com/bucknercd/jobworker/internal/manager"
+	"github.com/bucknercd/jobworker/internal/version"
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// coordinator serves the client-facing JobWorker API in multi-node mode by
+// placing jobs on registered agents and proxying every call to the agent
+// that owns the job. It keeps no job state beyond a job -> node index, which
+// is rebuilt from agent ListJobs after a restart.
+type coordinator struct {
+	jobpb.UnimplementedJobWorkerServer
+	logger   *log.Logger
+	registry *cluster.Registry
+	certsDir string
+	admins   map[string]bool
+
+	mu      sync.Mutex
+	conns   map[string]*agentConn // node -> connection
+	jobNode map[string]string     // job id -> node
+
+	// idem sends a retried start to the job the first call placed, which
+	// may be on another agent than a second Pick would choose.
+	idem *manager.IdempotencyKeys
+
+	// rebuild is the job index rebuild in flight or last finished. Lookups
+	// of unknown ids share it instead of each listing every agent.
+	rebuild *indexRebuild
+}
+
+// indexRebuild is one ListJobs fan-out refilling jobNode.
+type indexRebuild struct {
+	done     chan struct{} // closed when it finishes
+	finished time.Time
+}
+
+const (
+	// indexRebuildInterval is how long a finished rebuild answers for
+	// unknown ids before another may run.
+	indexRebuildInterval = cluster.HeartbeatInterval
+	// indexRebuildTimeout bounds a rebuild, which outlives the call that
+	// started it.
+	indexRebuildTimeout = 30 * time.Second
+)
+
+type agentConn struct {
+	address string
+	conn    *grpc.ClientConn
+	rpc     jobpb.JobWorkerClient
+}
+
+func NewCoordinator(logger *log.Logger, registry *cluster.Registry, certsDir string, adminCNs []string) *coordinator {
+	return &coordinator{
+		logger:   logger,
+		registry: registry,
+		certsDir: certsDir,
+		admins:   stringSet(adminCNs),
+		conns:    make(map[string]*agentConn),
+		jobNode:  make(map[string]string),
+		idem:     manager.NewIdempotencyKeys(),
+	}
+}
+
+func (c *coordinator) StartJob(ctx context.Context, req *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
+	return c.place(ctx, "StartJob", req, nil, jobpb.JobWorkerClient.StartJob)
+}
+
+// CreateJob places the job now, so StartCreatedJob later goes to the same
+// agent; that agent's admission checks apply when it is started.
+func (c *coordinator) CreateJob(ctx context.Context, req *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
+	return c.place(ctx, "CreateJob", req, nil, jobpb.JobWorkerClient.CreateJob)
+}
+
+// RunScript takes the whole script before placing the job, then uploads it
+// to the chosen agent.
+func (c *coordinator) RunScript(stream jobpb.JobWorker_RunScriptServer) error {
+	req, script, err := manager.ReadScript(stream)
+	if err != nil {
+		return err
+	}
+	resp, err := c.place(stream.Context(), "RunScript", req, script,
+		func(rpc jobpb.JobWorkerClient, ctx context.Context, req *jobpb.StartJobRequest, _ ...grpc.CallOption) (*jobpb.StartJobResponse, error) {
+			return client.SendScript(ctx, rpc, req, bytes.NewReader(script))
+		})
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+func (c *coordinator) StartCreatedJob(ctx context.Context, req *jobpb.StartCreatedJobRequest) (*jobpb.StartCreatedJobResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.StartCreatedJob(fctx, req)
+}
+
+// place picks an agent for req and forwards it with call (StartJob or
+// CreateJob), recording which node owns the new job. script is RunScript's,
+// for matching idempotency keys.
+func (c *coordinator) place(ctx context.Context, method string, req *jobpb.StartJobRequest, script []byte,
+	call func(jobpb.JobWorkerClient, context.Context, *jobpb.StartJobRequest, ...grpc.CallOption) (*jobpb.StartJobResponse, error),
+) (*jobpb.StartJobResponse, error) {
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+
+	sc, err := callerNamespace(ctx, nil, c.admins)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if req.Namespace, err = sc.resolve(req.GetNamespace()); err != nil {
+		return nil, err
+	}
+
+	prior, done, err := c.idem.Begin(user, method, req, script)
+	if err != nil {
+		return nil, err
+	}
+	if prior != "" {
+		c.mu.Lock()
+		node := c.jobNode[prior]
+		c.mu.Unlock()
+		resp := &jobpb.StartJobResponse{JobId: prior, Node: node}
+		if rpc, fctx, err := c.forJob(ctx, prior); err == nil { // best effort, like the agent's own answer
+			if st, err := rpc.GetStatus(fctx, &jobpb.GetStatusRequest{JobId: prior}); err == nil {
+				resp.Metadata = st.GetMetadata()
+			}
+		}
+		return resp, nil
+	}
+	var placed string
+	defer func() { done(placed) }()
+
+	agent, err := c.registry.Pick(req.GetNodeSelector())
+	switch {
+	case errors.Is(err, cluster.ErrNoMatchingNode):
+		return nil, status.Errorf(codes.FailedPrecondition, "%v: %s", err, cluster.FormatLabels(req.GetNodeSelector()))
+	case err != nil:
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	rpc, err := c.agentClient(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Printf("%s user=%s exe=%q -> node %s", method, user, req.GetExecutable(), agent.Node)
+	resp, err := call(rpc, c.forwardUser(ctx, user), req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.GetJobId() != "" {
+		c.mu.Lock()
+		c.jobNode[resp.GetJobId()] = agent.Node
+		c.mu.Unlock()
+		placed = resp.GetJobId()
+	}
+
+	resp.Node = agent.Node
+	return resp, nil
+}
+
+func (c *coordinator) StopJob(ctx context.Context, req *jobpb.StopJobRequest) (*jobpb.StopJobResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.StopJob(fctx, req)
+}
+
+// DeleteJob forgets the job's node once the agent has deleted it.
+func (c *coordinator) DeleteJob(ctx context.Context, req *jobpb.DeleteJobRequest) (*jobpb.DeleteJobResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rpc.DeleteJob(fctx, req)
+	if err == nil {
+		c.mu.Lock()
+		delete(c.jobNode, req.GetJobId())
+		c.mu.Unlock()
+	}
+	return resp, err
+}
+
+func (c *coordinator) ResizeTerminal(ctx context.Context, req *jobpb.ResizeTerminalRequest) (*jobpb.ResizeTerminalResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.ResizeTerminal(fctx, req)
+}
+
+func (c *coordinator) GetStatus(ctx context.Context, req *jobpb.GetStatusRequest) (*jobpb.GetStatusResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.GetStatus(fctx, req)
+}
+
+// ListJobs fans out to every live agent and merges the results. Agents that
+// fail are skipped (and logged) so one bad node doesn't hide the rest. The
+// request is scoped here; agents trust the coordinator's scoping.
+func (c *coordinator) ListJobs(ctx context.Context, req *jobpb.ListJobsRequest) (*jobpb.ListJobsResponse, error) {
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	sc, err := callerNamespace(ctx, nil, c.admins)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	req, err = scopeListJobs(req, user, sc.ns, c.admins[user])
+	if err != nil {
+		return nil, err
+	}
+	return c.listAll(c.forwardUser(ctx, user), req), nil
+}
+
+func (c *coordinator) StreamOutput(req *jobpb.StreamOutputRequest, stream jobpb.JobWorker_StreamOutputServer) error {
+	rpc, fctx, err := c.forJob(stream.Context(), req.GetJobId())
+	if err != nil {
+		return err
+	}
+	up, err := rpc.StreamOutput(fctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := up.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// StreamJobsOutput merges every live agent's stream. Agents that fail or
+// register after the call began are left out; the stream ends when all the
+// agents' streams have.
+func (c *coordinator) StreamJobsOutput(req *jobpb.StreamJobsOutputRequest, stream jobpb.JobWorker_StreamJobsOutputServer) error {
+	ctx := stream.Context()
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if req, err = scopeJobsOutput(req, user, c.admins[user]); err != nil {
+		return err
+	}
+	fctx := c.forwardUser(ctx, user)
+
+	var mu sync.Mutex
+	c.eachAgent("StreamJobsOutput", func(a cluster.Agent, rpc jobpb.JobWorkerClient) error {
+		up, err := rpc.StreamJobsOutput(fctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			msg, err := up.Recv()
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			msg.Node = a.Node
+			mu.Lock()
+			err = stream.Send(msg)
+			mu.Unlock()
+			if err != nil {
+				return nil // the caller is gone
+			}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+func (c *coordinator) SearchOutput(ctx context.Context, req *jobpb.SearchOutputRequest) (*jobpb.SearchOutputResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.SearchOutput(fctx, req)
+}
+
+func (c *coordinator) CountOutputLines(ctx context.Context, req *jobpb.CountOutputLinesRequest) (*jobpb.CountOutputLinesResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.CountOutputLines(fctx, req)
+}
+
+func (c *coordinator) GetJobProcesses(ctx context.Context, req *jobpb.GetJobProcessesRequest) (*jobpb.GetJobProcessesResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.GetJobProcesses(fctx, req)
+}
+
+func (c *coordinator) GetJobResult(ctx context.Context, req *jobpb.GetJobResultRequest) (*jobpb.GetJobResultResponse, error) {
+	rpc, fctx, err := c.forJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return rpc.GetJobResult(fctx, req)
+}
+
+func (c *coordinator) DownloadCore(req *jobpb.DownloadCoreRequest, stream jobpb.JobWorker_DownloadCoreServer) error {
+	rpc, fctx, err := c.forJob(stream.Context(), req.GetJobId())
+	if err != nil {
+		return err
+	}
+	up, err := rpc.DownloadCore(fctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := up.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *coordinator) DownloadOutput(req *jobpb.DownloadOutputRequest, stream jobpb.JobWorker_DownloadOutputServer) error {
+	rpc, fctx, err := c.forJob(stream.Context(), req.GetJobId())
+	if err != nil {
+		return err
+	}
+	up, err := rpc.DownloadOutput(fctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := up.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// StartJobs places each member like StartJob, under a group id made here,
+// so a group may span nodes. A member that can't be started stops the ones
+// before it.
+func (c *coordinator) StartJobs(ctx context.Context, req *jobpb.StartJobsRequest) (*jobpb.StartJobsResponse, error) {
+	if err := manager.CheckStartJobs(req); err != nil {
+		return nil, err
+	}
+	resp := &jobpb.StartJobsResponse{GroupId: uuid.New().String()}
+	for i := range req.GetJobs() {
+		out, err := c.StartJob(ctx, manager.GroupMember(req, i, resp.GroupId))
+		if err != nil {
+			for _, id := range resp.JobIds {
+				if _, err := c.StopJob(ctx, &jobpb.StopJobRequest{JobId: id}); err != nil {
+					c.logger.Printf("group %s: stop job %s after failed start: %v", resp.GroupId, id, err)
+				}
+			}
+			return nil, manager.MemberError(i, err)
+		}
+		resp.JobIds = append(resp.JobIds, out.GetJobId())
+	}
+	return resp, nil
+}
+
+func (c *coordinator) GetGroupStatus(ctx context.Context, req *jobpb.GetGroupStatusRequest) (*jobpb.GroupStatus, error) {
+	return c.groupAll(ctx, "GetGroupStatus", req.GetGroupId(), func(rpc jobpb.JobWorkerClient, ctx context.Context) (*jobpb.GroupStatus, error) {
+		return rpc.GetGroupStatus(ctx, req)
+	})
+}
+
+func (c *coordinator) StopGroup(ctx context.Context, req *jobpb.StopGroupRequest) (*jobpb.GroupStatus, error) {
+	return c.groupAll(ctx, "StopGroup", req.GetGroupId(), func(rpc jobpb.JobWorkerClient, ctx context.Context) (*jobpb.GroupStatus, error) {
+		return rpc.StopGroup(ctx, req)
+	})
+}
+
+// WaitGroup waits on every node at once; the caller's deadline travels
+// with each call.
+func (c *coordinator) WaitGroup(ctx context.Context, req *jobpb.WaitGroupRequest) (*jobpb.GroupStatus, error) {
+	gs, err := c.groupAll(ctx, "WaitGroup", req.GetGroupId(), func(rpc jobpb.JobWorkerClient, ctx context.Context) (*jobpb.GroupStatus, error) {
+		return rpc.WaitGroup(ctx, req)
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return gs, err
+}
+
+// groupAll makes call on every live agent and merges the members they
+// report. Agents with no members answer NOT_FOUND; the group is only not
+// found if every agent says so.
+func (c *coordinator) groupAll(ctx context.Context, method, id string,
+	call func(jobpb.JobWorkerClient, context.Context) (*jobpb.GroupStatus, error),
+) (*jobpb.GroupStatus, error) {
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "group_id required")
+	}
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	fctx := c.forwardUser(ctx, user)
+
+	var (
+		mu    sync.Mutex
+		found bool
+		jobs  []*jobpb.JobSummary
+	)
+	c.eachAgent(method, func(a cluster.Agent, rpc jobpb.JobWorkerClient) error {
+		gs, err := call(rpc, fctx)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		found = true
+		jobs = append(jobs, gs.GetJobs()...)
+		return nil
+	})
+	if !found {
+		return nil, status.Error(codes.NotFound, "group not found")
+	}
+	return manager.GroupStatusOf(id, jobs), nil
+}
+
+func (c *coordinator) listAll(ctx context.Context, req *jobpb.ListJobsRequest) *jobpb.ListJobsResponse {
+	var (
+		mu  sync.Mutex
+		out = &jobpb.ListJobsResponse{}
+	)
+	c.eachAgent("ListJobs", func(a cluster.Agent, rpc jobpb.JobWorkerClient) error {
+		resp, err := rpc.ListJobs(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, j := range resp.GetJobs() {
+			if j.GetMetadata() != nil {
+				j.Metadata.Node = a.Node
+			}
+			c.jobNode[j.GetJobId()] = a.Node
+			out.Jobs = append(out.Jobs, j)
+		}
+		return nil
+	})
+
+	sort.Slice(out.Jobs, func(i, j int) bool {
+		return out.Jobs[i].GetStartedAt().AsTime().After(out.Jobs[j].GetStartedAt().AsTime())
+	})
+	return out
+}
+
+// GetStats fans out like ListJobs.
+func (c *coordinator) GetStats(ctx context.Context, req *jobpb.ListJobsRequest) (*jobpb.GetStatsResponse, error) {
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	sc, err := callerNamespace(ctx, nil, c.admins)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	req, err = scopeListJobs(req, user, sc.ns, c.admins[user])
+	if err != nil {
+		return nil, err
+	}
+	return c.statsAll(c.forwardUser(ctx, user), req), nil
+}
+
+// GetQuota fans out like GetStats. Each agent enforces its own quota
+// file, so usage and limits are summed over the agents; the user is
+// limited only if every agent that answered limits them.
+func (c *coordinator) GetQuota(ctx context.Context, req *jobpb.GetQuotaRequest) (*jobpb.GetQuotaResponse, error) {
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if req.GetUser() != "" && req.GetUser() != user && !c.admins[user] {
+		return nil, status.Errorf(codes.PermissionDenied, "%s may only see their own quota", user)
+	}
+	if req.GetUser() == "" {
+		req = &jobpb.GetQuotaRequest{User: user}
+	}
+	return c.quotaAll(c.forwardUser(ctx, user), req), nil
+}
+
+func (c *coordinator) quotaAll(ctx context.Context, req *jobpb.GetQuotaRequest) *jobpb.GetQuotaResponse {
+	var (
+		mu                sync.Mutex
+		answered, limited int
+		used, limit       = &jobpb.QuotaUsage{}, &jobpb.QuotaUsage{}
+	)
+	c.eachAgent("GetQuota", func(_ cluster.Agent, rpc jobpb.JobWorkerClient) error {
+		resp, err := rpc.GetQuota(ctx, req)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		answered++
+		addQuotaUsage(used, resp.GetUsed())
+		if resp.GetLimited() {
+			limited++
+			addQuotaUsage(limit, resp.GetLimit())
+		}
+		return nil
+	})
+
+	out := &jobpb.GetQuotaResponse{User: req.GetUser(), Used: used}
+	if answered > 0 && limited == answered {
+		out.Limited, out.Limit = true, limit
+	}
+	return out
+}
+
+func addQuotaUsage(to, u *jobpb.QuotaUsage) {
+	to.Jobs += u.GetJobs()
+	to.CpuMillis += u.GetCpuMillis()
+	to.MemoryBytes += u.GetMemoryBytes()
+}
+
+// WatchJobStats proxies a single job's stream from the agent that runs it.
+// Watching many jobs polls every agent's GetStats each interval instead,
+// so one slow or lost node only drops out of a sample rather than ending
+// the stream.
+func (c *coordinator) WatchJobStats(req *jobpb.WatchJobStatsRequest, stream jobpb.JobWorker_WatchJobStatsServer) error {
+	ctx := stream.Context()
+	if id := req.GetJobId(); id != "" {
+		rpc, fctx, err := c.forJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		node := c.jobNode[id]
+		c.mu.Unlock()
+		up, err := rpc.WatchJobStats(fctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			msg, err := up.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, j := range msg.GetJobs() {
+				j.Node = node
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	req, err = scopeWatchStats(req, user, c.admins[user])
+	if err != nil {
+		return err
+	}
+	list := &jobpb.ListJobsRequest{AllUsers: req.GetAllUsers(), Owner: req.GetOwner()}
+	fctx := c.forwardUser(ctx, user)
+
+	tick := time.NewTicker(manager.StatsInterval(req))
+	defer tick.Stop()
+	for {
+		if err := stream.Send(c.statsAll(fctx, list)); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+func (c *coordinator) statsAll(ctx context.Context, req *jobpb.ListJobsRequest) *jobpb.GetStatsResponse {
+	var (
+		mu  sync.Mutex
+		out = &jobpb.GetStatsResponse{}
+	)
+	c.eachAgent("GetStats", func(a cluster.Agent, rpc jobpb.JobWorkerClient) error {
+		resp, err := rpc.GetStats(ctx, req)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, j := range resp.GetJobs() {
+			j.Node = a.Node
+			out.Jobs = append(out.Jobs, j)
+		}
+		return nil
+	})
+
+	sort.Slice(out.Jobs, func(i, j int) bool {
+		return out.Jobs[i].GetRunningAt().AsTime().After(out.Jobs[j].GetRunningAt().AsTime())
+	})
+	return out
+}
+
+// eachAgent calls fn for every live agent concurrently and waits. Agents
+// that fail are logged under method and skipped, so one bad node doesn't
+// hide the rest.
+func (c *coordinator) eachAgent(method string, fn func(cluster.Agent, jobpb.JobWorkerClient) error) {
+	var wg sync.WaitGroup
+	for _, a := range c.registry.Live() {
+		wg.Add(1)
+		go func(a cluster.Agent) {
+			defer wg.Done()
+			rpc, err := c.agentClient(a)
+			if err == nil {
+				err = fn(a, rpc)
+			}
+			if err != nil {
+				c.logger.Printf("%s: node %s: %v", method, a.Node, err)
+			}
+		}(a)
+	}
+	wg.Wait()
+}
+
+// forJob resolves the agent owning id and returns a client for it plus a
+// context carrying the caller's identity.
+func (c *coordinator) forJob(ctx context.Context, id string) (jobpb.JobWorkerClient, context.Context, error) {
+	user, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	fctx := c.forwardUser(ctx, user)
+
+	c.mu.Lock()
+	node, ok := c.jobNode[id]
+	c.mu.Unlock()
+	if !ok {
+		// Unknown here (e.g. coordinator restarted): rebuild the index.
+		c.rebuildIndex(fctx)
+		c.mu.Lock()
+		node, ok = c.jobNode[id]
+		c.mu.Unlock()
+		if !ok {
+			return nil, nil, status.Error(codes.NotFound, "job not found")
+		}
+	}
+
+	agent, ok := c.registry.Get(node)
+	if !ok {
+		return nil, nil, status.Errorf(codes.Unavailable, "node %s is not reachable", node)
+	}
+	rpc, err := c.agentClient(agent)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rpc, fctx, nil
+}
+
+// rebuildIndex refills jobNode from every agent's jobs. Callers arriving
+// while a rebuild runs wait for it, and one that finished less than
+// indexRebuildInterval ago is taken as current, so a stream of unknown ids
+// costs at most one fan-out per interval.
+func (c *coordinator) rebuildIndex(ctx context.Context) {
+	c.mu.Lock()
+	r := c.rebuild
+	if r != nil && (r.finished.IsZero() || time.Since(r.finished) < indexRebuildInterval) {
+		c.mu.Unlock()
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+		}
+		return
+	}
+	r = &indexRebuild{done: make(chan struct{})}
+	c.rebuild = r
+	c.mu.Unlock()
+
+	// Others may be waiting on it, so it doesn't end with this caller.
+	lctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), indexRebuildTimeout)
+	defer cancel()
+	c.listAll(lctx, &jobpb.ListJobsRequest{AllUsers: true})
+
+	c.mu.Lock()
+	r.finished = time.Now()
+	c.mu.Unlock()
+	close(r.done)
+}
+
+// agentClient returns a cached connection to the agent, redialing if it
+// re-registered under a new address.
+func (c *coordinator) agentClient(a cluster.Agent) (jobpb.JobWorkerClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ac, ok := c.conns[a.Node]; ok {
+		if ac.address == a.Address {
+			return ac.rpc, nil
+		}
+		ac.conn.Close()
+		delete(c.conns, a.Node)
+	}
+
+	tlsCfg, err := client.TLSConfig(c.certsDir, a.Address, false)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "agent tls config: %v", err)
+	}
+	conn, err := grpc.NewClient(a.Address, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "dial node %s: %v", a.Node, err)
+	}
+	ac := &agentConn{address: a.Address, conn: conn, rpc: jobpb.NewJobWorkerClient(conn)}
+	c.conns[a.Node] = ac
+	return ac.rpc, nil
+}
+
+// GetServerInfo describes the coordinator itself; its agents may run
+// other builds.
+func (c *coordinator) GetServerInfo(ctx context.Context, req *jobpb.GetServerInfoRequest) (*jobpb.GetServerInfoResponse, error) {
+	return serverInfo("", req), nil
+}
+
+// forwardUser adds the caller's identity for the agent: user, and their
+// namespace unless they are an admin and so see every one. It also lists
+// this build's client capabilities: the agent's answers pass through the
+// coordinator's own compat conversion on the way back to the caller.
+func (c *coordinator) forwardUser(ctx context.Context, user string) context.Context {
+	kv := []string{forwardedUserKey, user, version.ClientCapabilitiesKey, strings.Join(version.ClientCapabilities, ",")}
+	if sc, err := callerNamespace(ctx, nil, c.admins); err == nil && !sc.all {
+		kv = append(kv, forwardedNamespaceKey, sc.ns)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// agentRegistrar implements the Coordinator service agents heartbeat into.
+type agentRegistrar struct {
+	jobpb.UnimplementedCoordinatorServer
+	logger   *log.Logger
+	registry *cluster.Registry
+	allowed  map[string]bool
+
+	mu     sync.Mutex
+	owners map[string]string // node -> CN that first registered it
+}
+
+func NewAgentRegistrar(logger *log.Logger, registry *cluster.Registry, allowedCNs []string) jobpb.CoordinatorServer {
+	return &agentRegistrar{logger: logger, registry: registry, allowed: stringSet(allowedCNs), owners: make(map[string]string)}
+}
+
+// claim binds node to cn, the first time it registers, for as long as the
+// coordinator runs, so another agent identity can't take over its name and
+// have its jobs proxied to an address of its choosing.
+func (r *agentRegistrar) claim(node, cn string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	owner, ok := r.owners[node]
+	if !ok {
+		r.owners[node] = cn
+		return nil
+	}
+	if owner != cn {
+		return status.Errorf(codes.PermissionDenied, "node %s is registered to agent %s, not %s", node, owner, cn)
+	}
+	return nil
+}
+
+func (r *agentRegistrar) RegisterAgent(ctx context.Context, req *jobpb.RegisterAgentRequest) (*jobpb.RegisterAgentResponse, error) {
+	// Agents are nodes, which always present certificates.
+	cn, err := certUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if !r.allowed[cn] {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not an allowed agent identity", cn)
+	}
+
+	a := req.GetAgent()
+	if a.GetNode() == "" || a.GetAddress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent node and address required")
+	}
+	if err := r.claim(a.GetNode(), cn); err != nil {
+		r.logger.Printf("agent %s refused: %v", cn, err)
+		return nil, err
+	}
+	if _, known := r.registry.Get(a.GetNode()); !known {
+		r.logger.Printf("agent %s registered: node=%s addr=%s max_jobs=%d labels=%s",
+			cn, a.GetNode(), a.GetAddress(), a.GetMaxJobs(), cluster.FormatLabels(a.GetLabels()))
+	}
+	r.registry.Register(cluster.Agent{
+		Node:        a.GetNode(),
+		Address:     a.GetAddress(),
+		MaxJobs:     int(a.GetMaxJobs()),
+		RunningJobs: int(a.GetRunningJobs()),
+		Labels:      a.GetLabels(),
+		Draining:    a.GetDraining(),
+	})
+	return &jobpb.RegisterAgentResponse{
+		HeartbeatIntervalSeconds: int32(cluster.HeartbeatInterval.Seconds()),
+	}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/bucknercd/jobworker/internal/cluster"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// certContext is an incoming call from a client certificate with CN cn.
+func certContext(cn string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+}
+
+func TestRegisterAgentBindsNode(t *testing.T) {
+	registry := cluster.NewRegistry()
+	r := NewAgentRegistrar(log.New(io.Discard, "", 0), registry, []string{"agent-a", "agent-b"})
+	register := func(cn, node, addr string) error {
+		_, err := r.RegisterAgent(certContext(cn), &jobpb.RegisterAgentRequest{
+			Agent: &jobpb.AgentInfo{Node: node, Address: addr},
+		})
+		return err
+	}
+
+	if err := register("agent-a", "node1", "10.0.0.1:50051"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("agent-a", "node1", "10.0.0.2:50051"); err != nil {
+		t.Fatalf("re-registration by the same agent: %v", err)
+	}
+	if err := register("agent-b", "node1", "10.6.6.6:50051"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("takeover by another agent = %v, want PermissionDenied", err)
+	}
+	if a, _ := registry.Get("node1"); a.Address != "10.0.0.2:50051" {
+		t.Errorf("node1 address = %s after refused takeover", a.Address)
+	}
+	if err := register("agent-b", "node2", "10.0.0.3:50051"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("intruder", "node3", "10.6.6.6:50051"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("unlisted agent = %v, want PermissionDenied", err)
+	}
+}
+
+// TestRebuildIndexLimited checks that unknown ids share one index rebuild
+// per interval.
+func TestRebuildIndexLimited(t *testing.T) {
+	c := NewCoordinator(log.New(io.Discard, "", 0), cluster.NewRegistry(), "", nil)
+	ctx := certContext("alice")
+
+	c.rebuildIndex(ctx)
+	first := c.rebuild
+	if first == nil || first.finished.IsZero() {
+		t.Fatal("no rebuild recorded")
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.forJob(ctx, "unknown"); status.Code(err) != codes.NotFound {
+			t.Fatalf("forJob = %v, want NotFound", err)
+		}
+	}
+	if c.rebuild != first {
+		t.Error("rebuilt again within the interval")
+	}
+
+	first.finished = first.finished.Add(-indexRebuildInterval)
+	c.rebuildIndex(ctx)
+	if c.rebuild == first {
+		t.Error("not rebuilt after the interval")
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the embedded single-page dashboard. It talks to the
+// gateway's /v1 API from the browser, so it inherits the same mTLS auth.
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // embedded path is fixed at build time
+	}
+	return http.FileServerFS(sub)
+}
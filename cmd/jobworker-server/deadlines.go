@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultDeadlineInterceptor gives unary calls that arrive without a
+// deadline a server-side one, so a stuck call can't hold resources forever.
+// Deadlines set by the client are left alone.
+func defaultDeadlineInterceptor(d time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if _, ok := ctx.Deadline(); ok || d <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// errStreamExpired is the cause recorded when a stream hits its limit.
+var errStreamExpired = errors.New("max stream duration reached")
+
+// maxStreamDurationInterceptor ends server streams after d. The client gets
+// ABORTED (which it treats as retryable) rather than a bare
+// DEADLINE_EXCEEDED, so a live reader knows to resume from its offset.
+func maxStreamDurationInterceptor(d time.Duration) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if d <= 0 {
+			return handler(srv, ss)
+		}
+		ctx, cancel := context.WithTimeoutCause(ss.Context(), d, errStreamExpired)
+		defer cancel()
+
+		err := handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+		if err != nil && ss.Context().Err() == nil && errors.Is(context.Cause(ctx), errStreamExpired) {
+			return status.Errorf(codes.Aborted, "%s: stream exceeded %s; reopen it to continue", info.FullMethod, d)
+		}
+		return err
+	}
+}
+
+// ctxServerStream overrides the context seen by a stream handler.
+type ctxServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *ctxServerStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/manager"
+)
+
+// newDebugServer serves net/http/pprof and expvar on addr, and the job
+// start histograms for Prometheus at /metrics. A loopback address is served
+// as plain HTTP for local `go tool pprof`; anything else requires mTLS and
+// one of adminCNs.
+func newDebugServer(logger *log.Logger, addr string, tlsCfg *tls.Config, mgr *manager.Manager, adminCNs []string) (*http.Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("-debug-listen %q: %w", addr, err)
+	}
+	loopback := host == "localhost"
+	if ip := net.ParseIP(host); ip != nil {
+		loopback = ip.IsLoopback()
+	}
+
+	if mgr != nil {
+		expvar.Publish("jobworker", expvar.Func(func() any {
+			return map[string]any{
+				"running_jobs": mgr.Running(),
+				"max_jobs":     mgr.MaxJobs(),
+				"draining":     mgr.Draining(),
+			}
+		}))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	if mgr != nil {
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			mgr.WriteMetrics(w)
+		})
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          logger,
+	}
+	if !loopback {
+		if len(adminCNs) == 0 {
+			return nil, fmt.Errorf("-debug-listen on non-loopback %s requires -admin-cns", addr)
+		}
+		srv.TLSConfig = tlsCfg
+		srv.Handler = requireCN(mux, stringSet(adminCNs))
+	}
+	return srv, nil
+}
+
+func requireCN(next http.Handler, allowed map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !allowed[r.TLS.PeerCertificates[0].Subject.CommonName] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug serves srv on lis, which the caller binds up front so that it
+// happens before -user drops privileges.
+func serveDebug(logger *log.Logger, srv *http.Server, lis net.Listener) {
+	var err error
+	if srv.TLSConfig != nil {
+		logger.Printf("debug endpoints (pprof, expvar) on https://%s/debug/ (admin mTLS)", srv.Addr)
+		err = srv.ServeTLS(lis, "", "")
+	} else {
+		logger.Printf("debug endpoints (pprof, expvar) on http://%s/debug/ (loopback only)", srv.Addr)
+		err = srv.Serve(lis)
+	}
+	if err != nil {
+		logger.Fatalf("debug listener: %v", err)
+	}
+}
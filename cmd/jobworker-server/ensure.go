@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/manager"
+	"github.com/bucknercd/jobworker/internal/manifest"
+	"github.com/bucknercd/jobworker/internal/validate"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+const (
+	// ensureInterval is how often the supervisor checks its jobs, and
+	// whether the -ensure-file changed.
+	ensureInterval = time.Second
+
+	// A job that ended is started again after ensureMinDelay, or, if it
+	// ran for less than ensureStableRun, after twice the last delay, up
+	// to ensureMaxDelay, so a crash loop doesn't spin.
+	ensureMinDelay  = time.Second
+	ensureMaxDelay  = time.Minute
+	ensureStableRun = 10 * time.Second
+)
+
+// supervisor keeps the jobs an -ensure-file declares running. It starts
+// each one that is missing, starts it again whenever it ends, for whatever
+// reason, replaces it when its definition changes, and stops the ones
+// taken out of the file. The file is read again when it changes; a version
+// that doesn't load is logged and the last good one kept.
+type supervisor struct {
+	logger *log.Logger
+	mgr    *manager.Manager
+	path   string
+	owner  string // the jobs' owner
+
+	jobs    []manifest.Job
+	modTime time.Time               // of the file jobs came from
+	size    int64                   // -1 while the file can't be read
+	retries map[string]*ensureRetry // by job name
+}
+
+// ensureRetry holds a job back after it ended or failed to start.
+type ensureRetry struct {
+	after string // the ID of the job that ended, or "" if none started
+	delay time.Duration
+	at    time.Time
+}
+
+// newSupervisor loads the -ensure-file at path, failing if it can't.
+func newSupervisor(logger *log.Logger, mgr *manager.Manager, path, owner string) (*supervisor, error) {
+	s := &supervisor{logger: logger, mgr: mgr, path: path, owner: owner, retries: make(map[string]*ensureRetry)}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// run reconciles every ensureInterval until ctx is done.
+func (s *supervisor) run(ctx context.Context) {
+	s.logger.Printf("ensure: keeping %d job(s) from %s running as %s", len(s.jobs), s.path, s.owner)
+	t := time.NewTicker(ensureInterval)
+	defer t.Stop()
+	for {
+		changed, err := s.reload()
+		if err != nil {
+			s.logger.Printf("ensure: %v; keeping the %d job(s) loaded before", err, len(s.jobs))
+		} else if changed {
+			s.logger.Printf("ensure: reloaded %s: %d job(s)", s.path, len(s.jobs))
+		}
+		s.reconcile(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// reload reads the file again if its size or modification time changed,
+// and reports whether it did.
+func (s *supervisor) reload() (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		if s.size < 0 { // reported already
+			return false, nil
+		}
+		s.size = -1
+		return false, err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return false, nil
+	}
+	s.modTime, s.size = fi.ModTime(), fi.Size() // a bad version is reported once
+	jobs, err := manifest.Read(s.path)
+	if err != nil {
+		return false, err
+	}
+	for _, j := range jobs {
+		if j.Spec.MaxRestarts > 0 {
+			return false, fmt.Errorf("%s: job %s: restart doesn't apply here; ensured jobs are always started again", s.path, j.Name)
+		}
+		if err := validate.Request(j.Spec.Request()); err != nil {
+			return false, fmt.Errorf("%s: job %s: %v", s.path, j.Name, status.Convert(err).Message())
+		}
+	}
+	s.jobs = jobs
+	return true, nil
+}
+
+// reconcile brings the owner's jobs in line with s.jobs.
+func (s *supervisor) reconcile(ctx context.Context) {
+	ctx = manager.WithUser(ctx, s.owner)
+	list, err := s.mgr.ListJobs(ctx, &jobpb.ListJobsRequest{Owner: s.owner})
+	if err != nil {
+		s.logger.Printf("ensure: list jobs: %v", err)
+		return
+	}
+	existing := list.GetJobs()
+
+	declared := make(map[string]bool, len(s.jobs))
+	for _, j := range s.jobs {
+		declared[j.Name] = true
+		prev := manifest.Latest(existing, j.Name)
+		switch {
+		case prev == nil:
+			s.start(ctx, j, "", false)
+		case manifest.Active(prev.GetMetadata().GetStatus()):
+			if !j.Current(prev) {
+				s.stop(ctx, prev, "its definition changed")
+			}
+		case !j.Current(prev):
+			delete(s.retries, j.Name)
+			if s.start(ctx, j, "", false) {
+				s.prune(ctx, existing, j.Name, prev.GetJobId())
+			}
+		default:
+			if s.start(ctx, j, prev.GetJobId(), ranShort(prev.GetMetadata())) {
+				s.prune(ctx, existing, j.Name, prev.GetJobId())
+			}
+		}
+	}
+	for name := range s.retries {
+		if !declared[name] {
+			delete(s.retries, name)
+		}
+	}
+	for _, j := range existing {
+		name, ok := j.GetLabels()[manifest.NameLabel]
+		if ok && !declared[name] && manifest.Active(j.GetMetadata().GetStatus()) {
+			s.stop(ctx, j, "it was taken out of "+s.path)
+		}
+	}
+}
+
+// start starts j in place of the job with ID after ("" if none), once
+// the delay its ending, or a failed start, calls for has passed. It
+// reports whether it started one.
+func (s *supervisor) start(ctx context.Context, j manifest.Job, after string, short bool) bool {
+	now := time.Now()
+	r := s.retries[j.Name]
+	if after != "" && (r == nil || r.after != after) {
+		delay := ensureMinDelay
+		if r != nil && short {
+			delay = min(2*r.delay, ensureMaxDelay)
+		}
+		r = &ensureRetry{after: after, delay: delay, at: now.Add(delay)}
+		s.retries[j.Name] = r
+		s.logger.Printf("ensure: %s: job %s ended; starting it again in %s", j.Name, after, delay)
+	}
+	if s.mgr.Draining() || r != nil && r.after == after && now.Before(r.at) {
+		return false
+	}
+
+	resp, err := s.mgr.StartJob(ctx, j.Spec.Request())
+	if err != nil {
+		delay := ensureMinDelay
+		if r != nil && r.after == after {
+			delay = min(2*r.delay, ensureMaxDelay)
+		}
+		s.retries[j.Name] = &ensureRetry{after: after, delay: delay, at: now.Add(delay)}
+		s.logger.Printf("ensure: %s: start: %v; retrying in %s", j.Name, err, delay)
+		return false
+	}
+	s.logger.Printf("ensure: %s: started job %s", j.Name, resp.GetJobId())
+	return true
+}
+
+// prune deletes the finished attempts at the job named name but keep, the
+// one just replaced, so a job that keeps ending leaves its last run to
+// look at rather than one per restart.
+func (s *supervisor) prune(ctx context.Context, existing []*jobpb.JobSummary, name, keep string) {
+	for _, j := range existing {
+		st := j.GetMetadata().GetStatus()
+		if j.GetLabels()[manifest.NameLabel] != name || j.GetJobId() == keep ||
+			manifest.Active(st) || st == jobpb.JobStatus_JOB_STATUS_EXPIRED {
+			continue
+		}
+		if _, err := s.mgr.DeleteJob(ctx, &jobpb.DeleteJobRequest{JobId: j.GetJobId()}); err != nil && status.Code(err) != codes.NotFound {
+			s.logger.Printf("ensure: %s: delete job %s: %v", name, j.GetJobId(), err)
+		}
+	}
+}
+
+// stop stops j, saying why.
+func (s *supervisor) stop(ctx context.Context, j *jobpb.JobSummary, why string) {
+	name := j.GetLabels()[manifest.NameLabel]
+	resp, err := s.mgr.StopJob(ctx, &jobpb.StopJobRequest{JobId: j.GetJobId()})
+	if err != nil {
+		s.logger.Printf("ensure: %s: stop job %s: %v", name, j.GetJobId(), err)
+		return
+	}
+	if resp.GetAlreadyStopped() { // still on its way down
+		return
+	}
+	s.logger.Printf("ensure: %s: stopped job %s: %s", name, j.GetJobId(), why)
+}
+
+// ranShort reports whether a finished job ran for less than
+// ensureStableRun, counting one that never launched.
+func ranShort(md *jobpb.JobMetadata) bool {
+	if md.GetRunningAt() == nil || md.GetFinishedAt() == nil {
+		return true
+	}
+	return md.GetFinishedAt().AsTime().Sub(md.GetRunningAt().AsTime()) < ensureStableRun
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"sort"
 
 	"github.com/bucknercd/jobworker/internal/manager"
 	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
@@ -14,34 +15,339 @@ type grpcServer struct {
 	jobpb.UnimplementedJobWorkerServer
 	logger *log.Logger
 	mgr    *manager.Manager
+
+	// trustedForwarders are CNs (coordinators) allowed to act on behalf of
+	// the user named in forwarded metadata.
+	trustedForwarders map[string]bool
+
+	// admins may list every user's jobs.
+	admins map[string]bool
 }
 
-func NewGRPCServer(logger *log.Logger, mgr *manager.Manager) jobpb.JobWorkerServer {
-	return &grpcServer{logger: logger, mgr: mgr}
+func NewGRPCServer(logger *log.Logger, mgr *manager.Manager, trustedForwarders, adminCNs []string) jobpb.JobWorkerServer {
+	return &grpcServer{logger: logger, mgr: mgr, trustedForwarders: stringSet(trustedForwarders), admins: stringSet(adminCNs)}
 }
 
 func (s *grpcServer) StartJob(ctx context.Context, req *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
-	user, err := mtlsUserFromContext(ctx)
+	user, err := callerFromContext(ctx, s.trustedForwarders)
 	if err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
 	}
 
 	// For now: log it. Next step: pass it to manager/joblib for authz/auditing.
-	s.logger.Printf("StartJob user=%s exe=%q args=%v", user, req.GetExecutable(), req.GetArgs())
+	if err := s.setNamespace(ctx, req); err != nil {
+		return nil, err
+	}
+	// Only secret_env variable names are logged, never the resolved values.
+	s.logger.Printf("StartJob user=%s ns=%s exe=%q args=%v secret_env=%v validate_only=%t", user, req.GetNamespace(), req.GetExecutable(), req.GetArgs(), secretEnvNames(req), req.GetValidateOnly())
+
+	resp, err := s.mgr.StartJob(manager.WithUser(ctx, user), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.GetResolved() != nil {
+		resp.Resolved.User = user
+	}
+	return resp, nil
+}
 
-	return s.mgr.StartJob(ctx, req)
+func (s *grpcServer) CreateJob(ctx context.Context, req *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
+	user, err := callerFromContext(ctx, s.trustedForwarders)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if err := s.setNamespace(ctx, req); err != nil {
+		return nil, err
+	}
+	s.logger.Printf("CreateJob user=%s ns=%s exe=%q args=%v secret_env=%v", user, req.GetNamespace(), req.GetExecutable(), req.GetArgs(), secretEnvNames(req))
+	return s.mgr.CreateJob(manager.WithUser(ctx, user), req)
+}
+
+func (s *grpcServer) RunScript(stream jobpb.JobWorker_RunScriptServer) error {
+	ctx := stream.Context()
+	user, err := callerFromContext(ctx, s.trustedForwarders)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	req, script, err := manager.ReadScript(stream)
+	if err != nil {
+		return err
+	}
+	if err := s.setNamespace(ctx, req); err != nil {
+		return err
+	}
+	s.logger.Printf("RunScript user=%s ns=%s interpreter=%q args=%v script_bytes=%d secret_env=%v", user, req.GetNamespace(), req.GetExecutable(), req.GetArgs(), len(script), secretEnvNames(req))
+	resp, err := s.mgr.RunScript(manager.WithUser(ctx, user), req, script)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+func (s *grpcServer) StartCreatedJob(ctx context.Context, req *jobpb.StartCreatedJobRequest) (*jobpb.StartCreatedJobResponse, error) {
+	return s.mgr.StartCreatedJob(ctx, req)
+}
+
+func (s *grpcServer) DeleteJob(ctx context.Context, req *jobpb.DeleteJobRequest) (*jobpb.DeleteJobResponse, error) {
+	return s.mgr.DeleteJob(ctx, req)
 }
 
 func (s *grpcServer) StopJob(ctx context.Context, req *jobpb.StopJobRequest) (*jobpb.StopJobResponse, error) {
 	return s.mgr.StopJob(ctx, req)
 }
 
+func (s *grpcServer) ResizeTerminal(ctx context.Context, req *jobpb.ResizeTerminalRequest) (*jobpb.ResizeTerminalResponse, error) {
+	return s.mgr.ResizeTerminal(ctx, req)
+}
+
 func (s *grpcServer) GetStatus(ctx context.Context, req *jobpb.GetStatusRequest) (*jobpb.GetStatusResponse, error) {
 	return s.mgr.GetStatus(ctx, req)
 }
 
+func (s *grpcServer) ListJobs(ctx context.Context, req *jobpb.ListJobsRequest) (*jobpb.ListJobsResponse, error) {
+	cn, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	// A coordinator has already scoped the request for its caller.
+	if !viaForwarder(ctx, s.trustedForwarders) {
+		sc, err := callerNamespace(ctx, s.trustedForwarders, s.admins)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+		}
+		if req, err = scopeListJobs(req, cn, sc.ns, s.admins[cn]); err != nil {
+			return nil, err
+		}
+	}
+	return s.mgr.ListJobs(ctx, req)
+}
+
+func (s *grpcServer) GetStats(ctx context.Context, req *jobpb.ListJobsRequest) (*jobpb.GetStatsResponse, error) {
+	cn, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if !viaForwarder(ctx, s.trustedForwarders) {
+		sc, err := callerNamespace(ctx, s.trustedForwarders, s.admins)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+		}
+		if req, err = scopeListJobs(req, cn, sc.ns, s.admins[cn]); err != nil {
+			return nil, err
+		}
+	}
+	return s.mgr.GetStats(ctx, req)
+}
+
+// WatchJobStats is GetStats on a timer. A single job is watched by id, like
+// GetStatus; otherwise the request is scoped as ListJobs would be.
+func (s *grpcServer) WatchJobStats(req *jobpb.WatchJobStatsRequest, stream jobpb.JobWorker_WatchJobStatsServer) error {
+	cn, err := mtlsUserFromContext(stream.Context())
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if req.GetJobId() == "" && !viaForwarder(stream.Context(), s.trustedForwarders) {
+		if req, err = scopeWatchStats(req, cn, s.admins[cn]); err != nil {
+			return err
+		}
+	}
+	return s.mgr.WatchJobStats(req, stream)
+}
+
+func (s *grpcServer) GetQuota(ctx context.Context, req *jobpb.GetQuotaRequest) (*jobpb.GetQuotaResponse, error) {
+	cn, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	user, err := callerFromContext(ctx, s.trustedForwarders)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	// A coordinator has already checked that the caller may ask.
+	if req.GetUser() != "" && req.GetUser() != user && !s.admins[cn] && !viaForwarder(ctx, s.trustedForwarders) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s may only see their own quota", user)
+	}
+	if req.GetUser() == "" {
+		req = &jobpb.GetQuotaRequest{User: user}
+	}
+	return s.mgr.GetQuota(ctx, req)
+}
+
+func (s *grpcServer) GetServerInfo(ctx context.Context, req *jobpb.GetServerInfoRequest) (*jobpb.GetServerInfoResponse, error) {
+	resp := serverInfo(s.mgr.NodeName(), req)
+	if !resp.GetCompatible() {
+		s.logger.Printf("GetServerInfo: client %s (api v%d) is incompatible with api v%d", req.GetClientVersion(), req.GetClientApiVersion(), resp.GetApiVersion())
+	}
+	return resp, nil
+}
+
+// scopeListJobs limits a ListJobs request to what user may see: their own
+// jobs in their namespace ns, unless an admin asks for all users, someone
+// else's, or another namespace's.
+func scopeListJobs(req *jobpb.ListJobsRequest, user, ns string, admin bool) (*jobpb.ListJobsRequest, error) {
+	owner := req.GetOwner()
+	if admin {
+		if !req.GetAllUsers() && owner == "" {
+			return &jobpb.ListJobsRequest{Owner: user, Namespace: req.GetNamespace()}, nil
+		}
+		return req, nil
+	}
+	if req.GetAllUsers() || (owner != "" && owner != user) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s may only list their own jobs", user)
+	}
+	if req.GetNamespace() != "" && req.GetNamespace() != ns {
+		return nil, status.Errorf(codes.PermissionDenied, "%s may only list jobs in namespace %s", user, ns)
+	}
+	return &jobpb.ListJobsRequest{Owner: user, Namespace: ns}, nil
+}
+
+// scopeWatchStats applies scopeListJobs to a WatchJobStats request.
+func scopeWatchStats(req *jobpb.WatchJobStatsRequest, user string, admin bool) (*jobpb.WatchJobStatsRequest, error) {
+	list, err := scopeListJobs(&jobpb.ListJobsRequest{AllUsers: req.GetAllUsers(), Owner: req.GetOwner()}, user, "", admin)
+	if err != nil {
+		return nil, err
+	}
+	return &jobpb.WatchJobStatsRequest{AllUsers: list.GetAllUsers(), Owner: list.GetOwner(), IntervalMs: req.GetIntervalMs()}, nil
+}
+
+// scopeJobsOutput applies scopeListJobs to a StreamJobsOutput request.
+func scopeJobsOutput(req *jobpb.StreamJobsOutputRequest, user string, admin bool) (*jobpb.StreamJobsOutputRequest, error) {
+	list, err := scopeListJobs(&jobpb.ListJobsRequest{AllUsers: req.GetAllUsers(), Owner: req.GetOwner()}, user, "", admin)
+	if err != nil {
+		return nil, err
+	}
+	return &jobpb.StreamJobsOutputRequest{
+		Selector: req.GetSelector(),
+		Target:   req.GetTarget(),
+		Follow:   req.GetFollow(),
+		AllUsers: list.GetAllUsers(),
+		Owner:    list.GetOwner(),
+	}, nil
+}
+
 func (s *grpcServer) StreamOutput(req *jobpb.StreamOutputRequest, stream jobpb.JobWorker_StreamOutputServer) error {
-	// Not implemented in manager yet; keep it explicit.
-	// If you already have it in joblib, we can wire next.
-	return jobpb.UnimplementedJobWorkerServer{}.StreamOutput(req, stream)
+	return s.mgr.StreamOutput(req, stream)
+}
+
+// StreamJobsOutput is scoped by owner as ListJobs is.
+func (s *grpcServer) StreamJobsOutput(req *jobpb.StreamJobsOutputRequest, stream jobpb.JobWorker_StreamJobsOutputServer) error {
+	cn, err := mtlsUserFromContext(stream.Context())
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if !viaForwarder(stream.Context(), s.trustedForwarders) {
+		if req, err = scopeJobsOutput(req, cn, s.admins[cn]); err != nil {
+			return err
+		}
+	}
+	return s.mgr.StreamJobsOutput(req, stream)
+}
+
+func (s *grpcServer) SearchOutput(ctx context.Context, req *jobpb.SearchOutputRequest) (*jobpb.SearchOutputResponse, error) {
+	return s.mgr.SearchOutput(ctx, req)
+}
+
+func (s *grpcServer) CountOutputLines(ctx context.Context, req *jobpb.CountOutputLinesRequest) (*jobpb.CountOutputLinesResponse, error) {
+	return s.mgr.CountOutputLines(ctx, req)
+}
+
+func (s *grpcServer) GetJobProcesses(ctx context.Context, req *jobpb.GetJobProcessesRequest) (*jobpb.GetJobProcessesResponse, error) {
+	return s.mgr.GetJobProcesses(ctx, req)
+}
+
+func (s *grpcServer) DownloadCore(req *jobpb.DownloadCoreRequest, stream jobpb.JobWorker_DownloadCoreServer) error {
+	return s.mgr.DownloadCore(req, stream)
+}
+
+func (s *grpcServer) DownloadOutput(req *jobpb.DownloadOutputRequest, stream jobpb.JobWorker_DownloadOutputServer) error {
+	return s.mgr.DownloadOutput(req, stream)
+}
+
+func (s *grpcServer) GetJobResult(ctx context.Context, req *jobpb.GetJobResultRequest) (*jobpb.GetJobResultResponse, error) {
+	return s.mgr.GetJobResult(ctx, req)
+}
+
+func (s *grpcServer) StartJobs(ctx context.Context, req *jobpb.StartJobsRequest) (*jobpb.StartJobsResponse, error) {
+	user, err := callerFromContext(ctx, s.trustedForwarders)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if err := s.setNamespace(ctx, req.GetJobs()...); err != nil {
+		return nil, err
+	}
+	s.logger.Printf("StartJobs user=%s jobs=%d", user, len(req.GetJobs()))
+	return s.mgr.StartJobs(manager.WithUser(ctx, user), req)
+}
+
+func (s *grpcServer) GetGroupStatus(ctx context.Context, req *jobpb.GetGroupStatusRequest) (*jobpb.GroupStatus, error) {
+	ctx, err := s.groupContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.mgr.GetGroupStatus(ctx, req)
+}
+
+func (s *grpcServer) StopGroup(ctx context.Context, req *jobpb.StopGroupRequest) (*jobpb.GroupStatus, error) {
+	ctx, err := s.groupContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.mgr.StopGroup(ctx, req)
+}
+
+func (s *grpcServer) WaitGroup(ctx context.Context, req *jobpb.WaitGroupRequest) (*jobpb.GroupStatus, error) {
+	ctx, err := s.groupContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.mgr.WaitGroup(ctx, req)
+}
+
+// groupContext adds the caller, and what they may reach, for the
+// manager's group calls: the namespace guard only checks calls naming a
+// job, so those check their members themselves.
+func (s *grpcServer) groupContext(ctx context.Context) (context.Context, error) {
+	user, err := callerFromContext(ctx, s.trustedForwarders)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	sc, err := callerNamespace(ctx, s.trustedForwarders, s.admins)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	return manager.WithScope(manager.WithUser(ctx, user), sc.ns, sc.all), nil
+}
+
+// setNamespace sets each request's namespace to the one its job goes in:
+// the caller's own unless they named another they may use.
+func (s *grpcServer) setNamespace(ctx context.Context, reqs ...*jobpb.StartJobRequest) error {
+	sc, err := callerNamespace(ctx, s.trustedForwarders, s.admins)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	for _, req := range reqs {
+		ns, err := sc.resolve(req.GetNamespace())
+		if err != nil {
+			return err
+		}
+		req.Namespace = ns
+	}
+	return nil
+}
+
+func secretEnvNames(req *jobpb.StartJobRequest) []string {
+	names := make([]string, 0, len(req.GetSecretEnv()))
+	for k := range req.GetSecretEnv() {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stringSet(xs []string) map[string]bool {
+	set := make(map[string]bool, len(xs))
+	for _, x := range xs {
+		set[x] = true
+	}
+	return set
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthPollInterval is how often Watch looks for a change.
+const healthPollInterval = time.Second
+
+// healthServer implements grpc.health.v1 for the server as a whole (the
+// empty service name): SERVING, or NOT_SERVING while draining, so clients
+// given several servers send new jobs to another.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	draining func() bool // nil: never
+}
+
+func (h *healthServer) current() healthpb.HealthCheckResponse_ServingStatus {
+	if h.draining != nil && h.draining() {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func (h *healthServer) Check(_ context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.GetService() != "" {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: h.current()}, nil
+}
+
+// Watch sends the status, then each change until the client goes away.
+func (h *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if req.GetService() != "" {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+	t := time.NewTicker(healthPollInterval)
+	defer t.Stop()
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if cur := h.current(); cur != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: cur}); err != nil {
+				return err
+			}
+			last = cur
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
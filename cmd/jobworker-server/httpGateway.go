@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bucknercd/jobworker/internal/manager"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const maxRequestBody = 1 << 20
+
+// httpGateway is a hand-written HTTP+JSON front end for the same
+// JobWorkerServer the gRPC listener serves. Requests are dispatched in
+// process with the client certificate attached as the gRPC peer, so the
+// mTLS identity checks and handler logic are shared exactly.
+//
+//	POST /v1/jobs                 StartJobRequest  -> StartJobResponse
+//	POST /v1/jobs/create          StartJobRequest  -> StartJobResponse (not launched)
+//	POST /v1/jobs/{id}/start                       -> StartCreatedJobResponse
+//	GET  /v1/jobs[?all_users=true&owner=<cn>&namespace=<ns>] -> ListJobsResponse
+//	GET  /v1/jobs/{id}                             -> GetStatusResponse
+//	POST /v1/jobs/{id}/stop                        -> StopJobResponse
+//	DELETE /v1/jobs/{id}[?force=true]              -> DeleteJobResponse
+//	GET  /v1/jobs/{id}/logs[?target=stderr]        -> raw output, streamed
+//	GET  /v1/quota[?user=<cn>]                     -> GetQuotaResponse
+//
+// The logs endpoint switches to server-sent events (one base64 "chunk"
+// event per output chunk, then "end") when the client sends
+// Accept: text/event-stream, and to a WebSocket (one binary message per
+// chunk, then a normal close) on an Upgrade request. With the dashboard enabled, the embedded UI is
+// served at /.
+type httpGateway struct {
+	logger *log.Logger
+	srv    jobpb.JobWorkerServer
+	// intercept runs each call through the interceptors gRPC calls get
+	// (policy, audit); nil when there are none.
+	intercept grpc.UnaryServerInterceptor
+	// origins are the pages, besides the gateway's own, that may call it
+	// from a browser, as Origin values ("https://ui.example:8443").
+	origins map[string]bool
+}
+
+func NewHTTPGateway(logger *log.Logger, srv jobpb.JobWorkerServer, intercept grpc.UnaryServerInterceptor, dashboard bool, origins []string) http.Handler {
+	g := &httpGateway{logger: logger, srv: srv, intercept: intercept, origins: stringSet(origins)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/jobs", g.startJob)
+	mux.HandleFunc("POST /v1/jobs/create", g.createJob)
+	mux.HandleFunc("POST /v1/jobs/{id}/start", g.startCreatedJob)
+	mux.HandleFunc("GET /v1/jobs", g.listJobs)
+	mux.HandleFunc("GET /v1/jobs/{id}", g.getStatus)
+	mux.HandleFunc("POST /v1/jobs/{id}/stop", g.stopJob)
+	mux.HandleFunc("DELETE /v1/jobs/{id}", g.deleteJob)
+	mux.HandleFunc("GET /v1/jobs/{id}/logs", g.streamOutput)
+	mux.HandleFunc("GET /v1/quota", g.getQuota)
+	if dashboard {
+		mux.Handle("GET /", dashboardHandler())
+	}
+	return g.sameOrigin(mux)
+}
+
+// sameOrigin refuses state-changing requests a browser sends for another
+// site. The gateway authenticates with the client certificate, which a
+// browser presents on any request to it, so otherwise any page its user
+// visits could start, stop or delete their jobs. Browsers say where a
+// request comes from in Sec-Fetch-Site, or in Origin; other clients, such
+// as curl, send neither. WebSocket upgrades are GETs, and are checked
+// before the upgrade (streamWebSocket).
+func (g *httpGateway) sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !g.fromAllowedOrigin(r) {
+				writeError(w, status.Error(codes.PermissionDenied, "cross-origin request refused"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fromAllowedOrigin reports whether r came from the gateway's own pages,
+// one of g.origins, or no page at all.
+func (g *httpGateway) fromAllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if g.origins[origin] {
+		return true
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (g *httpGateway) startJob(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.StartJobRequest{}
+	if err := decodeJSON(r, req); err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "decode request: %v", err))
+		return
+	}
+	resp, err := g.call(r, jobpb.JobWorker_StartJob_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.StartJob(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) createJob(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.StartJobRequest{}
+	if err := decodeJSON(r, req); err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "decode request: %v", err))
+		return
+	}
+	resp, err := g.call(r, jobpb.JobWorker_CreateJob_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.CreateJob(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) startCreatedJob(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.StartCreatedJobRequest{JobId: r.PathValue("id")}
+	resp, err := g.call(r, jobpb.JobWorker_StartCreatedJob_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.StartCreatedJob(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) listJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := &jobpb.ListJobsRequest{Owner: q.Get("owner"), Namespace: q.Get("namespace")}
+	if v := q.Get("all_users"); v != "" {
+		all, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "all_users: %v", err))
+			return
+		}
+		req.AllUsers = all
+	}
+	resp, err := g.call(r, jobpb.JobWorker_ListJobs_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.ListJobs(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) getQuota(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.GetQuotaRequest{User: r.URL.Query().Get("user")}
+	resp, err := g.call(r, jobpb.JobWorker_GetQuota_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.GetQuota(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) getStatus(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.GetStatusRequest{JobId: r.PathValue("id")}
+	resp, err := g.call(r, jobpb.JobWorker_GetStatus_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.GetStatus(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) stopJob(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.StopJobRequest{JobId: r.PathValue("id")}
+	resp, err := g.call(r, jobpb.JobWorker_StopJob_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.StopJob(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) deleteJob(w http.ResponseWriter, r *http.Request) {
+	req := &jobpb.DeleteJobRequest{JobId: r.PathValue("id")}
+	if v := r.URL.Query().Get("force"); v != "" {
+		force, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "force: %v", err))
+			return
+		}
+		req.Force = force
+	}
+	resp, err := g.call(r, jobpb.JobWorker_DeleteJob_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		return g.srv.DeleteJob(ctx, req)
+	})
+	g.reply(w, resp, err)
+}
+
+func (g *httpGateway) streamOutput(w http.ResponseWriter, r *http.Request) {
+	target := jobpb.StreamTarget_STREAM_TARGET_STDOUT
+	switch r.URL.Query().Get("target") {
+	case "", "stdout":
+	case "stderr":
+		target = jobpb.StreamTarget_STREAM_TARGET_STDERR
+	default:
+		writeError(w, status.Error(codes.InvalidArgument, "target must be stdout or stderr"))
+		return
+	}
+	req := &jobpb.StreamOutputRequest{JobId: r.PathValue("id"), Target: target}
+
+	if isWebSocketUpgrade(r) {
+		g.streamWebSocket(w, r, req)
+		return
+	}
+
+	hs := &httpOutputStream{
+		w:   w,
+		sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream"),
+	}
+	_, err := g.call(r, jobpb.JobWorker_StreamOutput_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		hs.ctx = ctx
+		return nil, g.srv.StreamOutput(req, hs)
+	})
+	if err != nil {
+		if !hs.started {
+			writeError(w, err)
+			return
+		}
+		// Headers are gone; all we can do is cut the body short.
+		g.logger.Printf("http logs %s: %v", r.PathValue("id"), err)
+		if hs.sse {
+			hs.event("error", status.Convert(err).Message())
+		}
+		return
+	}
+	if hs.sse {
+		hs.start()
+		hs.event("end", "")
+	}
+}
+
+func (g *httpGateway) streamWebSocket(w http.ResponseWriter, r *http.Request, req *jobpb.StreamOutputRequest) {
+	// The same-origin policy doesn't cover WebSockets: any page could
+	// read the output with its visitor's certificate.
+	if !g.fromAllowedOrigin(r) {
+		writeError(w, status.Error(codes.PermissionDenied, "cross-origin websocket refused"))
+		return
+	}
+	var ws *wsConn
+	_, err := g.call(r, jobpb.JobWorker_StreamOutput_FullMethodName, req, func(ctx context.Context, _ any) (any, error) {
+		// Resolve the job before upgrading so lookup errors are plain HTTP.
+		if _, err := g.srv.GetStatus(ctx, &jobpb.GetStatusRequest{JobId: req.GetJobId()}); err != nil {
+			return nil, err
+		}
+		var err error
+		if ws, err = upgradeWebSocket(w, r); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "websocket upgrade: %v", err)
+		}
+
+		// The hijacked connection outlives r.Context(); the read loop
+		// cancels when the client closes.
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		go ws.readLoop(cancel)
+		return nil, g.srv.StreamOutput(req, &wsOutputStream{ctx: ctx, ws: ws})
+	})
+	switch {
+	case ws == nil:
+		writeError(w, err)
+	case err != nil:
+		g.logger.Printf("websocket logs %s: %v", req.GetJobId(), err)
+		ws.close(wsCloseInternal, status.Convert(err).Message())
+	default:
+		ws.close(wsCloseNormal, "end of output")
+	}
+}
+
+// call runs handler as the gRPC call method would be run, through
+// g.intercept.
+func (g *httpGateway) call(r *http.Request, method string, req any, handler grpc.UnaryHandler) (any, error) {
+	ctx := grpcContext(r)
+	if g.intercept == nil {
+		return handler(ctx, req)
+	}
+	return g.intercept(ctx, req, &grpc.UnaryServerInfo{Server: g.srv, FullMethod: method}, handler)
+}
+
+func (g *httpGateway) reply(w http.ResponseWriter, resp any, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := protojson.Marshal(resp.(proto.Message))
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// grpcContext carries the HTTP request's verified client certificate and
+// address as a gRPC peer so mtlsUserFromContext works unchanged.
+func grpcContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if r.TLS != nil {
+		p := &peer.Peer{AuthInfo: credentials.TLSInfo{State: *r.TLS}}
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			p.Addr = addr
+		}
+		ctx = peer.NewContext(ctx, p)
+	}
+	return ctx
+}
+
+// decodeJSON reads the request body as m. The body must be declared
+// JSON: a cross-site form can only send text/plain, urlencoded or
+// multipart ones without the browser asking first.
+func decodeJSON(r *http.Request, m proto.Message) error {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return errors.New("content type must be application/json")
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(b, m)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code := httpStatusFromCode(st.Code())
+	if code == http.StatusNotFound && jobExpired(st) {
+		code = http.StatusGone
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"code":    st.Code().String(),
+		"message": st.Message(),
+	})
+}
+
+// jobExpired reports the NOT_FOUND of a job retention GC removed.
+func jobExpired(st *status.Status) bool {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetReason() == manager.ExpiredReason {
+			return true
+		}
+	}
+	return false
+}
+
+func httpStatusFromCode(c codes.Code) int {
+	switch c {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// httpOutputStream adapts an http.ResponseWriter to the server-streaming
+// interface StreamOutput writes to; each chunk is written and flushed.
+type httpOutputStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	sse     bool
+	started bool
+}
+
+var _ grpc.ServerStreamingServer[jobpb.StreamOutputResponse] = (*httpOutputStream)(nil)
+
+func (s *httpOutputStream) start() {
+	if s.started {
+		return
+	}
+	if s.sse {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		s.w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	s.w.Header().Set("X-Content-Type-Options", "nosniff")
+	s.started = true
+}
+
+// event writes one SSE event. Output chunks are binary-safe base64 since
+// they may split UTF-8 sequences at arbitrary offsets.
+func (s *httpOutputStream) event(name, data string) error {
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *httpOutputStream) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *httpOutputStream) Send(m *jobpb.StreamOutputResponse) error {
+	s.start()
+	if s.sse {
+		return s.event("chunk", base64.StdEncoding.EncodeToString(m.GetChunk()))
+	}
+	if _, err := s.w.Write(m.GetChunk()); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *httpOutputStream) Context() context.Context     { return s.ctx }
+func (s *httpOutputStream) SetHeader(metadata.MD) error  { return nil }
+func (s *httpOutputStream) SendHeader(metadata.MD) error { return nil }
+func (s *httpOutputStream) SetTrailer(metadata.MD)       {}
+func (s *httpOutputStream) SendMsg(m any) error {
+	return s.Send(m.(*jobpb.StreamOutputResponse))
+}
+func (s *httpOutputStream) RecvMsg(any) error { return io.EOF }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// countingServer counts the calls that reach it.
+type countingServer struct {
+	jobpb.UnimplementedJobWorkerServer
+	calls int
+}
+
+func (s *countingServer) StartJob(context.Context, *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
+	s.calls++
+	return &jobpb.StartJobResponse{JobId: "job1"}, nil
+}
+
+func (s *countingServer) StopJob(context.Context, *jobpb.StopJobRequest) (*jobpb.StopJobResponse, error) {
+	s.calls++
+	return &jobpb.StopJobResponse{}, nil
+}
+
+func TestGatewayRefusesCrossSite(t *testing.T) {
+	const body = `{"executable":"/bin/true"}`
+	for _, tc := range []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    int
+	}{
+		{"curl", "/v1/jobs", map[string]string{"Content-Type": "application/json"}, http.StatusOK},
+		{"dashboard", "/v1/jobs/00000000-0000-0000-0000-000000000001/stop",
+			map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "https://gw.example"}, http.StatusOK},
+		{"same origin, no fetch metadata", "/v1/jobs",
+			map[string]string{"Content-Type": "application/json", "Origin": "https://gw.example"}, http.StatusOK},
+		{"text/plain body", "/v1/jobs", map[string]string{"Content-Type": "text/plain"}, http.StatusBadRequest},
+		{"no content type", "/v1/jobs", nil, http.StatusBadRequest},
+		{"cross-site", "/v1/jobs",
+			map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same-site", "/v1/jobs/00000000-0000-0000-0000-000000000001/stop",
+			map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"foreign origin", "/v1/jobs/00000000-0000-0000-0000-000000000001/stop",
+			map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &countingServer{}
+			gw := NewHTTPGateway(log.New(io.Discard, "", 0), srv, nil, false, nil)
+			r := httptest.NewRequest(http.MethodPost, "https://gw.example"+tc.path, strings.NewReader(body))
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			gw.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+			if reached := srv.calls > 0; reached != (tc.want == http.StatusOK) {
+				t.Errorf("handler reached: %v", reached)
+			}
+		})
+	}
+}
+
+// TestGatewayWebSocketOrigin checks that a WebSocket upgrade from another
+// site is refused before the handshake, unless its origin is allowed.
+func TestGatewayWebSocketOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		origin  string
+		allowed []string
+		refused bool
+	}{
+		{"", nil, false},
+		{"https://gw.example", nil, false},
+		{"https://evil.example", nil, true},
+		{"https://ui.example", []string{"https://ui.example"}, false},
+		{"http://ui.example", []string{"https://ui.example"}, true},
+	} {
+		gw := NewHTTPGateway(log.New(io.Discard, "", 0), &countingServer{}, nil, false, tc.allowed)
+		r := httptest.NewRequest(http.MethodGet, "https://gw.example/v1/jobs/00000000-0000-0000-0000-000000000001/logs", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, r)
+		// countingServer has no GetStatus, so an accepted upgrade stops at
+		// the job lookup instead.
+		if refused := w.Code == http.StatusForbidden; refused != tc.refused {
+			t.Errorf("origin %q, allowed %q: status %d, want refused=%v", tc.origin, tc.allowed, w.Code, tc.refused)
+		}
+	}
+}
@@ -1,65 +1,774 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bucknercd/jobworker/internal/accounting"
+	"github.com/bucknercd/jobworker/internal/archive"
+	"github.com/bucknercd/jobworker/internal/audit"
+	"github.com/bucknercd/jobworker/internal/cgroups"
+	"github.com/bucknercd/jobworker/internal/cluster"
+	"github.com/bucknercd/jobworker/internal/events"
+	"github.com/bucknercd/jobworker/internal/gpu"
+	"github.com/bucknercd/jobworker/internal/limits"
+	"github.com/bucknercd/jobworker/internal/logcrypt"
+	"github.com/bucknercd/jobworker/internal/logging"
+	"github.com/bucknercd/jobworker/internal/logsink"
 	"github.com/bucknercd/jobworker/internal/manager"
+	"github.com/bucknercd/jobworker/internal/oci"
+	"github.com/bucknercd/jobworker/internal/policy"
+	"github.com/bucknercd/jobworker/internal/preflight"
+	"github.com/bucknercd/jobworker/internal/privs"
+	"github.com/bucknercd/jobworker/internal/quota"
+	"github.com/bucknercd/jobworker/internal/secrets"
+	"github.com/bucknercd/jobworker/internal/tokenauth"
+	"github.com/bucknercd/jobworker/internal/tracing"
+	"github.com/bucknercd/jobworker/internal/validate"
+	"github.com/bucknercd/jobworker/internal/version"
+	"github.com/bucknercd/jobworker/internal/volumes"
+	"github.com/bucknercd/jobworker/pkg/client"
+	"github.com/bucknercd/jobworker/pkg/joblib"
 	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // lets clients request compressed StreamOutput
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // ---- MAIN ----
 
 func main() {
+	joblib.RunShim() // jobs with mounts, a umask or a PID namespace start as a re-exec of this binary
+
 	var (
 		listenAddr = flag.String("listen", ":50051", "listen address")
+		httpAddr   = flag.String("http-listen", "", "also serve the HTTP+JSON gateway (same mTLS) on this address; empty disables")
+		dashboard  = flag.Bool("dashboard", false, "serve the web dashboard at / on the HTTP gateway (requires -http-listen)")
+		httpOrigin = flag.String("http-origins", "", "comma-separated origins (https://host[:port]) whose pages may call the HTTP gateway from a browser, besides its own")
 		certsDir   = flag.String("certs", "./certs", "certs directory")
+		tlsMin     = flag.String("tls-min-version", "1.3", "oldest TLS version the listeners accept: 1.3, or 1.2 for clients that can't do 1.3")
+		tlsCurves  = flag.String("tls-curves", "", "comma-separated key exchange curves in preference order, from x25519, p256, p384, p521 (default: Go's)")
+		tlsCiphers = flag.String("tls-ciphers", "", "with -tls-min-version 1.2: comma-separated TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (default: Go's secure set; insecure ones are refused)")
+		authMode   = flag.String("auth-mode", authMTLS, "how callers authenticate: mtls (client certificate), token (a bearer token, or else a client certificate; clients may connect without one), or mtls+token (both, naming the same user)")
+		authToks   = flag.String("auth-tokens", "", "with -auth-mode token or mtls+token: file of static bearer tokens, one \"<user> <token>\" line each (the token may be written sha256:<hex>)")
+		jwtKeys    = flag.String("jwt-keys", "", "with -auth-mode token or mtls+token: PEM file of an identity provider's public keys (PUBLIC KEY or CERTIFICATE blocks) whose JWTs are accepted as bearer tokens")
+		jwtIssuer  = flag.String("jwt-issuer", "", "with -jwt-keys: the iss JWTs must carry (required)")
+		jwtAud     = flag.String("jwt-audience", "", "with -jwt-keys: an aud JWTs must include; empty skips the check")
+		jwtClaim   = flag.String("jwt-user-claim", "sub", "with -jwt-keys: the claim naming the user")
+		auditSpool = flag.String("audit-spool", "", "directory where audit records wait until every -audit-export has them, surviving restarts and exporter outages")
+		policyURL  = flag.String("policy-url", "", "ask this Open Policy Agent rule (Data API URL, e.g. http://127.0.0.1:8181/v1/data/jobworker/allow) whether each JobWorker and Admin call is allowed; empty disables")
+		policyWait = flag.Duration("policy-timeout", 2*time.Second, "with -policy-url: how long to wait for OPA before failing the call with UNAVAILABLE")
 		logPath    = flag.String("log", "./jobworker-server.log", "server log file")
+		logLevel   = flag.String("log-level", "info", "server log level: debug, info, warn or error (changeable at runtime via Admin.SetLogLevel)")
+		logMaxMB   = flag.Int64("log-max-size", 100, "rotate the server log when it would exceed this many MiB (0 = never)")
+		logMaxAge  = flag.Duration("log-rotate-every", 0, "also rotate the server log once it is this old, e.g. 24h (0 = never)")
+		logKeep    = flag.Int("log-max-backups", 7, "rotated server logs to keep (0 = keep all)")
+		logGzip    = flag.Bool("log-compress", true, "gzip rotated server logs")
+		rpcTimeout = flag.Duration("rpc-timeout", time.Minute, "deadline applied to unary RPCs whose client sent none (0 = none)")
+		maxStream  = flag.Duration("max-stream-duration", 24*time.Hour, "end output streams after this long with ABORTED; clients resume from their offset (0 = unlimited)")
+		debugAddr  = flag.String("debug-listen", "", "serve pprof and expvar under /debug/, and job start histograms for Prometheus at /metrics, on this address; loopback is plain HTTP, other addresses need mTLS + -admin-cns")
+		adminCNs   = flag.String("admin-cns", "", "comma-separated mTLS CNs allowed to call the Admin service and list every user's jobs")
+		secretsAt  = flag.String("secrets", "", "secrets directory (one file per secret, a subdirectory per namespace) or NAME=VALUE file (NAME is ns/name for a namespace's); jobs only get their own namespace's secrets; empty disables secret_env")
+		eventsFile = flag.String("events-file", "", "append job lifecycle events as JSON lines to this file")
+		eventsHook = flag.String("events-webhook", "", "POST job lifecycle events as JSON to this URL")
+		eventsNATS = flag.String("events-nats", "", "publish job lifecycle events to NATS (nats://host:port/subject)")
+		otlpURL    = flag.String("otlp-endpoint", "", "export traces as OTLP/HTTP JSON to this URL (e.g. http://localhost:4318/v1/traces)")
+		otelName   = flag.String("otel-service-name", "jobworker-server", "service.name reported with exported traces")
+		outputKey  = flag.String("output-key", "", "key file for encrypting job output at rest (32 raw bytes or 64 hex chars); empty disables")
+
+		mode       = flag.String("mode", "standalone", "standalone, coordinator, or agent")
+		coordAddr  = flag.String("coordinator", "", "agent mode: coordinator address (host:port) to register with")
+		advertise  = flag.String("advertise", "", "agent mode: address the coordinator should dial this agent on (default -listen)")
+		nodeName   = flag.String("node", "", "agent mode: node name (default hostname)")
+		maxJobs    = flag.Int("max-jobs", 0, "max concurrently running jobs, also advertised to the coordinator in agent mode (0 = unlimited)")
+		fastAccept = flag.Bool("fast-accept", false, "StartJob returns once a job is validated and queued (status STARTING); launch workers then create its cgroup and files and exec it")
+		launchers  = flag.Int("launch-workers", 8, "with -fast-accept, how many jobs are launched at once")
+		quotaFile  = flag.String("quota-file", "", "per-user quotas, one \"<cn> jobs=N,cpu=C,memory=M\" line each (\"*\" for everyone else); empty disables")
+		ensureFile = flag.String("ensure-file", "", "keep the jobs declared in this manifest (the format jobctl apply takes) running: start them, start each again whenever it ends, replace one whose definition changes, stop one taken out; the file is re-read when it changes")
+		ensureUser = flag.String("ensure-owner", "supervisor", "with -ensure-file: the owner recorded on its jobs")
+		retention  = flag.Duration("job-retention", 0, "forget finished jobs and delete their output after this long, e.g. 72h (0 = keep until Admin.RunGC)")
+		archiveURL = flag.String("archive", "", "upload finished jobs' output and metadata to this S3 bucket and prefix, e.g. s3://my-bucket/jobworker, and serve reads of jobs retention GC removed from there; credentials come from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or the instance role; empty disables")
+		archiveEnd = flag.String("archive-endpoint", "https://s3.amazonaws.com", "with -archive: the S3-compatible endpoint, e.g. http://minio.internal:9000")
+		archiveReg = flag.String("archive-region", "", "with -archive: the bucket's region (default: ask the endpoint)")
+		compressAt = flag.Duration("compress-output-after", 0, "zstd-compress a finished job's stdout and stderr on disk this long after it ends, e.g. 1h; reads decompress them (0 = never; not with -output-key)")
+		acctFile   = flag.String("accounting-file", "", "record what each finished job consumed (cpu, memory over time) as JSON lines in this file, for Admin.ExportAccounting; empty disables")
+		acctEvery  = flag.Duration("accounting-interval", 10*time.Second, "how often running jobs' memory is sampled for accounting")
+		agentCNs   = flag.String("agent-cns", "", "coordinator mode: comma-separated mTLS CNs allowed to register as agents")
+		coordCNs   = flag.String("coordinator-cns", "", "agent mode: comma-separated mTLS CNs trusted to forward caller identity")
+		gpusFlag   = flag.Bool("gpus", false, "hand out this host's NVIDIA GPUs to jobs exclusively (gpu_count/gpu_uuids); unassigned GPUs are hidden from every job")
+		roHost     = flag.Bool("readonly-host", false, "run local jobs in their own mount namespace with every mount read-only except a per-job workspace (needs root; not with -user)")
+		pidNS      = flag.Bool("pid-namespace", false, "run local jobs in their own PID namespace under a small init that reaps orphans and forwards signals (needs root; not with -user)")
+		procTitle  = flag.Bool("process-title", false, "prefix local jobs' argv[0] with jobworker:<id> so host ps shows which job a process belongs to (programs that look at argv[0], like busybox, may break)")
+		privTmp    = flag.String("private-tmp", "", "give each local job its own tmpfs /tmp of at most this size, e.g. 256M, or max to cap it only by the job's memory limit; empty disables (needs root; not with -user)")
+		imagesDir  = flag.String("image-cache", "", "enable container image jobs, unpacking OCI layouts into this directory; empty disables")
+		chunkSize  = flag.Int("stream-chunk-size", 32*1024, "max bytes per StreamOutput message")
+		flushEvery = flag.Duration("stream-flush-interval", 100*time.Millisecond, "send buffered output after this long even if the chunk isn't full")
+		summaryN   = flag.Int("log-job-output", 0, "log the first/last N lines of each finished job's stdout/stderr at debug level (0 = never)")
+		pidsMax    = flag.String("default-pids-max", "4096", "pids.max for jobs that don't set pids_max, guarding against fork bombs (\"max\" = no limit)")
+		maxOutput  = flag.String("default-max-output", "max", "stdout+stderr kept for jobs that don't set max_output_bytes, e.g. 1G (\"max\" = no limit)")
+		maxCore    = flag.String("max-core-size", "1G", "largest core kept for a job started with capture_core (\"max\" = no limit)")
+		execPath   = flag.String("exec-path", strings.Join(manager.DefaultExecPath, ":"), "colon-separated directories searched for bare executable names (empty: executables must be paths)")
+		jobsDir    = flag.String("jobs-dir", joblib.DefaultJobsDir, "directory holding each job's output; several, comma-separated in order of preference, e.g. a fast disk then a large one (see -jobs-dir-placement)")
+		placement  = flag.String("jobs-dir-placement", "fill", "with several -jobs-dir: fill (the first with -jobs-dir-min-free left, then overflow to the next) or most-free")
+		minFree    = flag.String("jobs-dir-min-free", "5%", "with several -jobs-dir: free space to leave on a volume before placing output on the next, as a percentage or size (e.g. 5%, 20G; 0 = fill it)")
+		runAs      = flag.String("run-as", "", "uid:gid local jobs run as (default nobody:nogroup)")
+		userFlag   = flag.String("user", "", "started as root: after binding listeners and delegating the cgroup subtree, switch to this user keeping only the capabilities jobs need")
+		cgroupRoot = flag.String("cgroup-root", cgroups.DefaultRoots.Mount, "cgroup v2 mount point; job cgroups go in its jobs/ subdirectory")
+		cgDriver   = flag.String("cgroup-driver", "cgroupfs", "how job cgroups are made: cgroupfs (write -cgroup-root directly) or systemd (transient scopes over D-Bus)")
+		sdSlice    = flag.String("systemd-slice", cgroups.DefaultSystemdSlice, "systemd driver: slice holding the job scopes")
+		fakeCgroup = flag.Bool("fake-cgroups", false, "treat -cgroup-root as a plain directory standing in for cgroupfs (tests only: jobs are not confined)")
+		checkOnly  = flag.Bool("check", false, "run the preflight checks (privileges, cgroups, jobs dir, certs), print a report and exit: 0 if nothing failed")
+		showVer    = flag.Bool("version", false, "print the version and exit")
+		labelsFlag = flag.String("labels", "", "node labels matched by node_selector, comma-separated key=value (arch defaults to this build's GOARCH)")
 	)
+	var auditExports []string
+	flag.Func("audit-export", "deliver an audit record of every JobWorker and Admin call to URL: syslog: (local), syslog://host:514, syslog+tcp://, http(s)://..., or file:///path[?max-size=100M&max-age=24h&keep=N&compress=true]; repeatable, needs -audit-spool", func(s string) error {
+		auditExports = append(auditExports, s)
+		return nil
+	})
+	var outputSinks []string
+	flag.Func("output-sink", "also ship job output lines to URL[;k=v,...] (syslog://host:514, syslog+tcp://, syslog: for local, fluentd://host:24224/tag, http(s)://...), only for jobs with those labels if given; repeatable", func(s string) error {
+		outputSinks = append(outputSinks, s)
+		return nil
+	})
 	flag.Parse()
 
-	lf, err := os.OpenFile(*logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if *showVer {
+		fmt.Println(version.String("jobworker-server"))
+		return
+	}
+
+	var runAsCred *syscall.Credential
+	if *runAs != "" {
+		var err error
+		if runAsCred, err = parseRunAs(*runAs); err != nil {
+			log.Fatalf("-run-as: %v", err)
+		}
+	}
+	runsJobs := *mode != "coordinator"
+	var dropTo *user.User
+	if *userFlag != "" {
+		var err error
+		if dropTo, err = user.Lookup(*userFlag); err != nil {
+			log.Fatalf("-user: %v", err)
+		}
+	}
+	// The shim mounts as root before becoming the job's user; capabilities
+	// kept under -user don't survive its exec.
+	if (*roHost || *privTmp != "" || *pidNS) && runsJobs && (dropTo != nil || os.Geteuid() != 0) {
+		log.Fatalf("-readonly-host, -private-tmp and -pid-namespace need the server to run as root, without -user")
+	}
+	jobsDirs := splitList(*jobsDir)
+	if len(jobsDirs) == 0 && runsJobs {
+		log.Fatalf("-jobs-dir: no directory given")
+	}
+	// The job's /tmp would hide its own job dir.
+	if *privTmp != "" && runsJobs {
+		for _, dir := range jobsDirs {
+			if abs, err := filepath.Abs(dir); err == nil && (abs == "/tmp" || strings.HasPrefix(abs, "/tmp/")) {
+				log.Fatalf("-private-tmp needs -jobs-dir outside /tmp")
+			}
+		}
+	}
+	tlsPol, err := parseTLSPolicy(*tlsMin, *tlsCurves, *tlsCiphers)
 	if err != nil {
-		log.Fatalf("open log file: %v", err)
+		log.Fatal(err)
+	}
+	var tokens *tokenauth.Verifier
+	switch *authMode {
+	case authMTLS:
+		if *authToks != "" || *jwtKeys != "" {
+			log.Fatalf("-auth-tokens and -jwt-keys need -auth-mode token or mtls+token")
+		}
+	case authToken, authMTLSToken:
+		tokens, err = tokenauth.New(*authToks, tokenauth.JWTConfig{
+			KeysFile:  *jwtKeys,
+			Issuer:    *jwtIssuer,
+			Audience:  *jwtAud,
+			UserClaim: *jwtClaim,
+		})
+		if err != nil {
+			log.Fatalf("-auth-mode %s: %v", *authMode, err)
+		}
+	default:
+		log.Fatalf("unknown -auth-mode %q (mtls, token or mtls+token)", *authMode)
+	}
+	// Delegating the cgroup subtree only matters to the cgroupfs driver;
+	// systemd makes the scopes itself.
+	delegate := dropTo != nil && runsJobs && *cgDriver == "cgroupfs"
+	cgRoots := cgroups.Roots{Mount: *cgroupRoot, Fake: *fakeCgroup}
+	if delegate {
+		cgRoots = cgroups.Delegated(cgRoots)
+	}
+	cgroups.Configure(cgRoots)
+	check := preflight.Config{
+		CertsDir: *certsDir,
+		RunsJobs: runsJobs,
+		JobsDirs: jobsDirs,
+		Cgroups:  cgRoots,
+		RunAs:    runAsCred,
+	}
+	if *cgDriver == "systemd" {
+		check.SystemdSlice = *sdSlice
+	}
+	if *checkOnly {
+		results := preflight.Run(check)
+		_ = preflight.Write(os.Stdout, results)
+		if preflight.Failed(results) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	logger := log.New(lf, "", log.LstdFlags|log.Lmsgprefix)
-	logger.SetPrefix("[jobworker-server] ")
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("-log-level: %v", err)
+	}
+	logs, err := logging.Open(*logPath, level, logging.Rotation{
+		MaxSize:    *logMaxMB << 20,
+		MaxAge:     *logMaxAge,
+		MaxBackups: *logKeep,
+		Compress:   *logGzip,
+	})
+	if err != nil {
+		log.Fatalf("open log file: %v", err)
+	}
+	logger := logs.Std()
 
 	abs, _ := filepath.Abs(*logPath)
 	logger.Printf("logging to %s", abs)
 
-	tlsCfg, err := buildServerTLSConfig(*certsDir)
+	// Problems are logged, not fatal: -check is the strict form.
+	for _, r := range preflight.Run(check) {
+		if r.Level != preflight.OK {
+			logger.Printf("preflight: %s %s: %s", r.Level, r.Check, r.Detail)
+		}
+	}
+
+	var uid, gid int
+	if dropTo != nil {
+		uid, _ = strconv.Atoi(dropTo.Uid)
+		gid, _ = strconv.Atoi(dropTo.Gid)
+		if delegate {
+			if _, err := cgroups.Delegate(cgRoots, uid, gid); err != nil {
+				logger.Fatalf("-user: delegate cgroups: %v", err)
+			}
+			logger.Printf("delegated %s to %s", filepath.Dir(cgRoots.JobRoot()), dropTo.Username)
+		}
+		if runsJobs {
+			for _, dir := range jobsDirs {
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					logger.Fatalf("-user: %v", err)
+				}
+				if err := os.Chown(dir, uid, gid); err != nil {
+					logger.Fatalf("-user: %v", err)
+				}
+			}
+		}
+	}
+
+	tlsCfg, err := buildServerTLSConfig(*certsDir, tlsPol)
 	if err != nil {
 		logger.Fatalf("tls config: %v", err)
 	}
+	logger.Printf("tls policy: %s", tlsPol)
+	var tokAuth *tokenAuth
+	if tokens != nil {
+		if *authMode == authToken {
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		tokAuth = newTokenAuth(logger, *authMode, tokens, append(splitList(*agentCNs), splitList(*coordCNs)...))
+		logger.Printf("auth mode %s: %s", *authMode, tokens)
+	}
 
 	lis, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
 		logger.Fatalf("listen %s: %v", *listenAddr, err)
 	}
-	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsCfg)))
 
-	mgr := manager.NewManager(logger)
-	jobpb.RegisterJobWorkerServer(grpcServer, NewGRPCServer(logger, mgr))
+	opts := manager.Options{
+		StreamChunkSize:     *chunkSize,
+		StreamFlushInterval: *flushEvery,
+		OutputSummaryLines:  *summaryN,
+		DebugLogger:         logs.Debug(),
+		MaxJobs:             *maxJobs,
+		FastAccept:          *fastAccept,
+		LaunchWorkers:       *launchers,
+		Retention:           *retention,
+		CompressOutputAfter: *compressAt,
+		ExecPath:            filepath.SplitList(*execPath),
+		JobsDirs:            jobsDirs,
+	}
+	opts.Credential = runAsCred
+	if *fakeCgroup {
+		logger.Printf("WARNING: fake cgroups under %s; job limits are not enforced", *cgroupRoot)
+	}
+	switch *cgDriver {
+	case "cgroupfs":
+	case "systemd":
+		if *fakeCgroup {
+			logger.Fatalf("-fake-cgroups only applies to -cgroup-driver cgroupfs")
+		}
+		if opts.Cgroups, err = cgroups.Systemd(*sdSlice); err != nil {
+			logger.Fatalf("-cgroup-driver systemd: %v", err)
+		}
+		logger.Printf("job cgroups: systemd scopes in %s", *sdSlice)
+	default:
+		logger.Fatalf("unknown -cgroup-driver %q (cgroupfs or systemd)", *cgDriver)
+	}
+	if opts.DefaultPIDsMax, err = limits.ParsePIDs(*pidsMax); err != nil {
+		logger.Fatalf("-default-pids-max: %v", err)
+	}
+	maxOut, err := limits.ParseMemory(*maxOutput)
+	if err != nil {
+		logger.Fatalf("-default-max-output: %v", err)
+	}
+	opts.DefaultMaxOutputBytes = maxOut.Bytes()
+	maxCoreSize, err := limits.ParseMemory(*maxCore)
+	if err != nil {
+		logger.Fatalf("-max-core-size: %v", err)
+	}
+	opts.MaxCoreBytes = maxCoreSize.Bytes()
+	if opts.Placement, err = volumes.ParsePolicy(*placement); err != nil {
+		logger.Fatalf("-jobs-dir-placement: %v", err)
+	}
+	if opts.MinFree, err = volumes.ParseThreshold(*minFree); err != nil {
+		logger.Fatalf("-jobs-dir-min-free: %v", err)
+	}
+	if *otlpURL != "" {
+		opts.Tracer = tracing.NewOTLPTracer(logger, *otlpURL, *otelName)
+		logger.Printf("exporting traces to %s", *otlpURL)
+	}
+
+	var authz *policyHook
+	if *policyURL != "" {
+		opa, err := policy.New(*policyURL, *policyWait)
+		if err != nil {
+			logger.Fatalf("-policy-url: %v", err)
+		}
+		var forwarders []string
+		if *mode == "agent" {
+			forwarders = splitList(*coordCNs)
+		}
+		authz = newPolicyHook(logger, opa, forwarders, splitList(*adminCNs))
+		logger.Printf("authorizing calls with policy %s", opa)
+	}
+
+	var audits *auditHook
+	if len(auditExports) > 0 || *auditSpool != "" {
+		if len(auditExports) == 0 || *auditSpool == "" {
+			logger.Fatalf("-audit-export and -audit-spool go together")
+		}
+		alog, err := audit.Open(logger, *auditSpool, auditExports)
+		if err != nil {
+			logger.Fatalf("audit: %v", err)
+		}
+		if dropTo != nil {
+			if err := chownTree(*auditSpool, uid, gid); err != nil {
+				logger.Fatalf("-user: audit spool: %v", err)
+			}
+		}
+		var forwarders []string
+		if *mode == "agent" {
+			forwarders = splitList(*coordCNs)
+		}
+		audits = newAuditHook(alog, forwarders)
+		logger.Printf("auditing calls to %s (spool %s)", alog.Exporters(), *auditSpool)
+	}
+
+	unary := []grpc.UnaryServerInterceptor{
+		tracing.UnaryServerInterceptor(opts.Tracer),
+		defaultDeadlineInterceptor(*rpcTimeout),
+	}
+	stream := []grpc.StreamServerInterceptor{
+		tracing.StreamServerInterceptor(opts.Tracer),
+		maxStreamDurationInterceptor(*maxStream),
+	}
+	// Converts for older gRPC clients; the HTTP gateway skips it.
+	unary = append(unary, compatInterceptor())
+	stream = append(stream, compatStreamInterceptor())
+	if tokAuth != nil {
+		unary = append(unary, tokAuth.unaryInterceptor())
+		stream = append(stream, tokAuth.streamInterceptor())
+	}
+	// Audit outside the policy, so denials are recorded too.
+	var gatewayChain []grpc.UnaryServerInterceptor
+	if audits != nil {
+		gatewayChain = append(gatewayChain, audits.unaryInterceptor())
+		stream = append(stream, audits.streamInterceptor())
+	}
+	if authz != nil {
+		gatewayChain = append(gatewayChain, authz.unaryInterceptor())
+		stream = append(stream, authz.streamInterceptor())
+	}
+	var nsForwarders []string
+	if *mode == "agent" {
+		nsForwarders = splitList(*coordCNs)
+	}
+	nsGuard := newNamespaceGuard(nsForwarders, splitList(*adminCNs))
+	gatewayChain = append(gatewayChain, nsGuard.unaryInterceptor())
+	stream = append(stream, nsGuard.streamInterceptor())
+	// Innermost, so handlers only see requests that keep to the field
+	// rules in job.proto.
+	gatewayChain = append(gatewayChain, validate.UnaryServerInterceptor())
+	stream = append(stream, validate.StreamServerInterceptor())
+	unary = append(unary, gatewayChain...)
+	grpcServer := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsCfg)),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
+
+	if *outputKey != "" {
+		key, err := logcrypt.LoadKeyFile(*outputKey)
+		if err != nil {
+			logger.Fatalf("output key: %v", err)
+		}
+		opts.OutputKey = key
+		logger.Printf("job output encryption enabled")
+		if *compressAt > 0 {
+			logger.Printf("WARNING: -compress-output-after has no effect with -output-key; encrypted output isn't compressed")
+		}
+	}
+
+	if *secretsAt != "" {
+		store, err := secrets.Load(*secretsAt)
+		if err != nil {
+			logger.Fatalf("secrets: %v", err)
+		}
+		opts.Secrets = store
+		logger.Printf("loaded %d secrets from %s", store.Len(), *secretsAt)
+	}
+
+	if *quotaFile != "" {
+		table, err := quota.Load(*quotaFile)
+		if err != nil {
+			logger.Fatalf("quotas: %v", err)
+		}
+		opts.Quotas = table
+		logger.Printf("loaded quotas for %d user(s) from %s", len(table), *quotaFile)
+	}
+
+	if *archiveURL != "" && runsJobs {
+		store, err := archive.New(archive.Config{URL: *archiveURL, Endpoint: *archiveEnd, Region: *archiveReg})
+		if err != nil {
+			logger.Fatalf("-archive: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := store.Check(ctx); err != nil {
+			logger.Printf("WARNING: archive %s: %v; finished jobs are kept until it can be reached", store, err)
+		}
+		cancel()
+		opts.Archive = store
+		logger.Printf("archiving finished jobs to %s", store)
+	}
+
+	if *acctFile != "" && runsJobs {
+		ledger, err := accounting.Open(*acctFile)
+		if err != nil {
+			logger.Fatalf("accounting: %v", err)
+		}
+		opts.Accounting = ledger
+		opts.AccountingInterval = *acctEvery
+		logger.Printf("job accounting in %s (%d record(s))", *acctFile, ledger.Len())
+	}
+
+	sinks, err := buildEventSinks(*eventsFile, *eventsHook, *eventsNATS)
+	if err != nil {
+		logger.Fatalf("events: %v", err)
+	}
+	if len(sinks) > 0 {
+		opts.Events = events.NewBus(logger, sinks...)
+		logger.Printf("publishing job events to %d sink(s)", len(sinks))
+	}
+
+	if runsJobs {
+		for _, spec := range outputSinks {
+			r, err := logsink.Parse(logger, spec)
+			if err != nil {
+				logger.Fatalf("-output-sink: %v", err)
+			}
+			opts.OutputSinks = append(opts.OutputSinks, r)
+			logger.Printf("shipping job output to %s", r)
+		}
+	}
+
+	labels, err := cluster.ParseLabels(*labelsFlag)
+	if err != nil {
+		logger.Fatalf("-labels: %v", err)
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	if _, ok := labels["arch"]; !ok {
+		labels["arch"] = runtime.GOARCH
+	}
+
+	if *gpusFlag {
+		devs, err := gpu.Discover()
+		if err != nil {
+			logger.Fatalf("gpus: %v", err)
+		}
+		if len(devs) == 0 {
+			logger.Fatalf("-gpus: no NVIDIA GPUs found (is the driver loaded?)")
+		}
+		opts.GPUs = gpu.NewAllocator(devs)
+		if _, ok := labels["gpu"]; !ok {
+			labels["gpu"] = "true"
+		}
+		logger.Printf("managing %d GPU(s)", len(devs))
+	}
+	opts.Labels = labels
+	opts.ReadOnlyHost = *roHost
+	opts.ProcessTitle = *procTitle
+	opts.PIDNamespace = *pidNS
+	if *privTmp != "" {
+		size, err := limits.ParseMemory(*privTmp)
+		if err != nil {
+			logger.Fatalf("-private-tmp: %v", err)
+		}
+		opts.PrivateTmp, opts.PrivateTmpSize = true, size.Bytes()
+	}
+
+	if *imagesDir != "" {
+		store, err := oci.NewStore(*imagesDir)
+		if err != nil {
+			logger.Fatalf("image cache: %v", err)
+		}
+		opts.Images = store
+		logger.Printf("container image jobs enabled (cache %s)", *imagesDir)
+	}
+
+	var (
+		jobSrv jobpb.JobWorkerServer
+		mgr    *manager.Manager // nil in coordinator mode
+	)
+	switch *mode {
+	case "standalone":
+		mgr = manager.NewManager(logger, opts)
+		jobSrv = NewGRPCServer(logger, mgr, nil, splitList(*adminCNs))
+
+	case "coordinator":
+		if *agentCNs == "" {
+			logger.Fatalf("-mode coordinator requires -agent-cns")
+		}
+		registry := cluster.NewRegistry()
+		jobSrv = NewCoordinator(logger, registry, *certsDir, splitList(*adminCNs))
+		jobpb.RegisterCoordinatorServer(grpcServer, NewAgentRegistrar(logger, registry, splitList(*agentCNs)))
+		logger.Printf("coordinator mode: accepting agents %s", *agentCNs)
+
+	case "agent":
+		if *coordAddr == "" || *coordCNs == "" {
+			logger.Fatalf("-mode agent requires -coordinator and -coordinator-cns")
+		}
+		cfg := cluster.AgentConfig{Node: *nodeName, Address: *advertise, Labels: labels}
+		if cfg.Node == "" {
+			if cfg.Node, err = os.Hostname(); err != nil {
+				logger.Fatalf("hostname: %v", err)
+			}
+		}
+		if cfg.Address == "" {
+			cfg.Address = *listenAddr
+		}
+		opts.NodeName = cfg.Node
+		mgr = manager.NewManager(logger, opts)
+		jobSrv = NewGRPCServer(logger, mgr, splitList(*coordCNs), splitList(*adminCNs))
+
+		coordTLS, err := client.TLSConfig(*certsDir, *coordAddr, false)
+		if err != nil {
+			logger.Fatalf("coordinator tls config: %v", err)
+		}
+		conn, err := grpc.NewClient(*coordAddr, grpc.WithTransportCredentials(credentials.NewTLS(coordTLS)))
+		if err != nil {
+			logger.Fatalf("dial coordinator %s: %v", *coordAddr, err)
+		}
+		go cluster.RunAgent(context.Background(), logger, jobpb.NewCoordinatorClient(conn), cfg, mgr.Load)
+
+	default:
+		logger.Fatalf("unknown -mode %q", *mode)
+	}
+	nsGuard.mgr = mgr
+	var sup *supervisor
+	if *ensureFile != "" {
+		switch {
+		case mgr == nil:
+			logger.Fatalf("-ensure-file needs a mode that runs jobs (standalone or agent)")
+		case *ensureUser == "":
+			logger.Fatalf("-ensure-owner must not be empty")
+		}
+		if sup, err = newSupervisor(logger, mgr, *ensureFile, *ensureUser); err != nil {
+			logger.Fatalf("-ensure-file: %v", err)
+		}
+	}
+	jobpb.RegisterJobWorkerServer(grpcServer, jobSrv)
+	jobpb.RegisterAdminServer(grpcServer, NewAdminServer(logger, logs, mgr, splitList(*adminCNs)))
+	health := &healthServer{}
+	if mgr != nil {
+		health.draining = mgr.Draining
+	}
+	healthpb.RegisterHealthServer(grpcServer, health)
+
+	if *debugAddr != "" {
+		dbg, err := newDebugServer(logger, *debugAddr, tlsCfg, mgr, splitList(*adminCNs))
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		dbgLis, err := net.Listen("tcp", *debugAddr)
+		if err != nil {
+			logger.Fatalf("debug listen %s: %v", *debugAddr, err)
+		}
+		go serveDebug(logger, dbg, dbgLis)
+	}
+
+	if *dashboard && *httpAddr == "" {
+		logger.Fatalf("-dashboard requires -http-listen")
+	}
+	if *httpAddr != "" {
+		gateway := NewHTTPGateway(logger, jobSrv, chainUnary(gatewayChain), *dashboard, splitList(*httpOrigin))
+		if tokAuth != nil {
+			gateway = tokAuth.httpMiddleware(gateway)
+		}
+		httpSrv := &http.Server{
+			Addr:              *httpAddr,
+			Handler:           gateway,
+			TLSConfig:         tlsCfg,
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          logger,
+		}
+		httpLis, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			logger.Fatalf("http gateway listen %s: %v", *httpAddr, err)
+		}
+		go func() {
+			logger.Printf("http gateway listening on %s", *httpAddr)
+			if err := httpSrv.ServeTLS(httpLis, "", ""); err != nil {
+				logger.Fatalf("http gateway: %v", err)
+			}
+		}()
+	}
+
+	// Everything that needs root is done: listeners are bound, the cgroup
+	// subtree is delegated and the certs are loaded.
+	if dropTo != nil {
+		var keep privs.Set
+		if runsJobs {
+			keep = privs.Needs(*imagesDir != "", *gpusFlag)
+		}
+		if err := privs.Drop(uid, gid, keep); err != nil {
+			logger.Fatalf("-user %s: %v", dropTo.Username, err)
+		}
+		logger.Printf("running as %s (uid %d) with %s", dropTo.Username, uid, keep)
+	}
 
+	logger.Printf("%s", version.String("jobworker-server"))
+	if sup != nil {
+		go sup.run(context.Background())
+	}
 	logger.Printf("listening on %s", *listenAddr)
 	if err := grpcServer.Serve(lis); err != nil {
 		logger.Fatalf("serve: %v", err)
 	}
 }
 
+// chainUnary combines interceptors into one, the first outermost; nil if
+// there are none.
+func chainUnary(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			ic, inner := interceptors[i], next
+			next = func(ctx context.Context, req any) (any, error) { return ic(ctx, req, info, inner) }
+		}
+		return next(ctx, req)
+	}
+}
+
+// chownTree gives dir and everything in it to uid:gid.
+func chownTree(dir string, uid, gid int) error {
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chown(path, uid, gid)
+	})
+}
+
+// parseRunAs parses "uid:gid". Running as the server's own uid skips
+// setgroups, which an unprivileged server isn't allowed to call.
+func parseRunAs(s string) (*syscall.Credential, error) {
+	u, g, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("%q: want uid:gid", s)
+	}
+	uid, err := strconv.ParseUint(u, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("uid %q: %w", u, err)
+	}
+	gid, err := strconv.ParseUint(g, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("gid %q: %w", g, err)
+	}
+	return &syscall.Credential{
+		Uid:         uint32(uid),
+		Gid:         uint32(gid),
+		NoSetGroups: int(uid) == os.Getuid(),
+	}, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func buildEventSinks(file, webhook, natsURL string) ([]events.Sink, error) {
+	var sinks []events.Sink
+	if file != "" {
+		s, err := events.NewFileSink(file)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if webhook != "" {
+		sinks = append(sinks, events.NewWebhookSink(webhook))
+	}
+	if natsURL != "" {
+		s, err := events.NewNATSSink(natsURL)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
 // --- TLS helpers ---
 
-func buildServerTLSConfig(certsDir string) (*tls.Config, error) {
+func buildServerTLSConfig(certsDir string, policy tlsPolicy) (*tls.Config, error) {
 	// server cert/key
 	certPath := filepath.Join(certsDir, "server.crt")
 	keyPath := filepath.Join(certsDir, "server.key")
@@ -79,8 +788,7 @@ func buildServerTLSConfig(certsDir string) (*tls.Config, error) {
 		return nil, fmt.Errorf("append ca.crt: no certs found")
 	}
 
-	return &tls.Config{
-		MinVersion:   tls.VersionTLS13,
+	cfg := &tls.Config{
 		Certificates: []tls.Certificate{serverCert},
 
 		ClientCAs:  clientCAs,
@@ -88,5 +796,7 @@ func buildServerTLSConfig(certsDir string) (*tls.Config, error) {
 
 		// Good hygiene
 		PreferServerCipherSuites: true,
-	}, nil
+	}
+	policy.apply(cfg)
+	return cfg, nil
 }
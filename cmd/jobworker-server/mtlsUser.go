@@ -5,10 +5,26 @@ import (
 	"fmt"
 
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 )
 
+// forwardedUserKey carries the original caller's identity when a coordinator
+// proxies a request to an agent in multi-node mode.
+const forwardedUserKey = "x-jobworker-user"
+
+// mtlsUserFromContext returns the direct caller: the user their bearer
+// token names, when -auth-mode token let a token stand in for a
+// certificate, or else their certificate's CN.
 func mtlsUserFromContext(ctx context.Context) (string, error) {
+	if user, ok := ctx.Value(tokenUserKey{}).(string); ok {
+		return user, nil
+	}
+	return certUserFromContext(ctx)
+}
+
+// certUserFromContext returns the CN of the caller's client certificate.
+func certUserFromContext(ctx context.Context) (string, error) {
 	p, ok := peer.FromContext(ctx)
 	if !ok || p.AuthInfo == nil {
 		return "", fmt.Errorf("no peer auth info")
@@ -29,3 +45,34 @@ func mtlsUserFromContext(ctx context.Context) (string, error) {
 	}
 	return cn, nil
 }
+
+// callerFromContext returns the effective user for a request: the direct
+// caller, or, when they are a trusted forwarder (a coordinator) calling
+// with its certificate, the user it forwarded. Forwarded identities from
+// anyone else are ignored.
+func callerFromContext(ctx context.Context, trustedForwarders map[string]bool) (string, error) {
+	cn, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !viaForwarder(ctx, trustedForwarders) {
+		return cn, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(forwardedUserKey); len(v) == 1 && v[0] != "" {
+		return v[0], nil
+	}
+	return cn, nil
+}
+
+// viaForwarder reports whether the direct caller is a trusted forwarder (a
+// coordinator) calling with its certificate. A bearer token whose subject
+// happens to be a forwarder's CN doesn't count: token callers are plain
+// users.
+func viaForwarder(ctx context.Context, trustedForwarders map[string]bool) bool {
+	if _, byToken := ctx.Value(tokenUserKey{}).(string); byToken {
+		return false
+	}
+	cn, err := certUserFromContext(ctx)
+	return err == nil && trustedForwarders[cn]
+}
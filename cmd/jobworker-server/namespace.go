@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bucknercd/jobworker/internal/manager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// forwardedNamespaceKey carries the original caller's namespace next to
+// forwardedUserKey. A coordinator leaves it out for admins, whose calls
+// reach every namespace.
+const forwardedNamespaceKey = "x-jobworker-namespace"
+
+// namespaceScope is where a caller's jobs go and what they may see.
+type namespaceScope struct {
+	ns  string // where their jobs go unless they name another
+	all bool   // may name, and see jobs in, any namespace
+}
+
+// resolve picks the namespace for a job the caller starts: requested, or
+// their own when empty. Only callers with all may name another.
+func (sc namespaceScope) resolve(requested string) (string, error) {
+	if requested == "" || requested == sc.ns {
+		return sc.ns, nil
+	}
+	if !sc.all {
+		return "", status.Errorf(codes.PermissionDenied, "namespace %s: caller may only use namespace %s", requested, sc.ns)
+	}
+	return requested, manager.ValidateNamespace(requested)
+}
+
+// certNamespaceFromContext returns the namespace the caller's client
+// certificate puts them in: its first OU, or the default without one.
+func certNamespaceFromContext(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return "", fmt.Errorf("no peer auth info")
+	}
+	ti, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(ti.State.PeerCertificates) == 0 {
+		return "", fmt.Errorf("no peer certificates")
+	}
+	ous := ti.State.PeerCertificates[0].Subject.OrganizationalUnit
+	if len(ous) == 0 || ous[0] == "" {
+		return manager.DefaultNamespace, nil
+	}
+	if err := manager.ValidateNamespace(ous[0]); err != nil {
+		return "", fmt.Errorf("certificate OU %q is not a valid namespace", ous[0])
+	}
+	return ous[0], nil
+}
+
+// callerNamespace returns the caller's scope. Token callers are in the
+// default namespace. A trusted forwarder's calls are scoped to the
+// namespace it forwarded, or to none when it forwarded a user without
+// one (an admin). Admins see every namespace.
+func callerNamespace(ctx context.Context, trustedForwarders, admins map[string]bool) (namespaceScope, error) {
+	cn, err := mtlsUserFromContext(ctx)
+	if err != nil {
+		return namespaceScope{}, err
+	}
+	if _, byToken := ctx.Value(tokenUserKey{}).(string); byToken {
+		return namespaceScope{ns: manager.DefaultNamespace, all: admins[cn]}, nil
+	}
+	if trustedForwarders[cn] {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(forwardedUserKey); len(v) == 1 && v[0] != "" {
+			if ns := md.Get(forwardedNamespaceKey); len(ns) == 1 && ns[0] != "" {
+				return namespaceScope{ns: ns[0]}, nil
+			}
+			return namespaceScope{ns: manager.DefaultNamespace, all: true}, nil
+		}
+	}
+	ns, err := certNamespaceFromContext(ctx)
+	if err != nil {
+		return namespaceScope{}, err
+	}
+	return namespaceScope{ns: ns, all: admins[cn] || trustedForwarders[cn]}, nil
+}
+
+// namespaceGuard hides other users' jobs: a JobWorker call naming a job
+// outside the caller's namespace, or one someone else owns, gets
+// NOT_FOUND, as if it didn't exist. Admins and trusted forwarders calling
+// for themselves may name any job; a forwarded call is checked for the
+// user it was made for. mgr is set once the manager exists; nil
+// (coordinator mode) leaves the check to the agents.
+type namespaceGuard struct {
+	mgr               *manager.Manager
+	trustedForwarders map[string]bool
+	admins            map[string]bool
+}
+
+func newNamespaceGuard(trustedForwarders, adminCNs []string) *namespaceGuard {
+	return &namespaceGuard{trustedForwarders: stringSet(trustedForwarders), admins: stringSet(adminCNs)}
+}
+
+func (g *namespaceGuard) check(ctx context.Context, fullMethod string, req any) error {
+	r, ok := req.(interface{ GetJobId() string })
+	if g.mgr == nil || !ok || r.GetJobId() == "" {
+		return nil
+	}
+	if service, _ := splitMethod(fullMethod); service != "JobWorker" {
+		return nil
+	}
+	sc, err := callerNamespace(ctx, g.trustedForwarders, g.admins)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	owner, ns, ok := g.mgr.JobAccess(r.GetJobId())
+	if !ok || sc.all {
+		return nil
+	}
+	user, err := callerFromContext(ctx, g.trustedForwarders)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+	if ns != sc.ns || owner != user {
+		return status.Error(codes.NotFound, "job not found")
+	}
+	return nil
+}
+
+func (g *namespaceGuard) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := g.check(ctx, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// streamInterceptor checks streams on their first message, like the
+// policy hook.
+func (g *namespaceGuard) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &guardedStream{ServerStream: ss, guard: g, method: info.FullMethod})
+	}
+}
+
+type guardedStream struct {
+	grpc.ServerStream
+	guard   *namespaceGuard
+	method  string
+	checked bool
+}
+
+func (s *guardedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !s.checked {
+		s.checked = true
+		return s.guard.check(s.Context(), s.method, m)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/bucknercd/jobworker/internal/policy"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// policyHook puts every JobWorker and Admin call to -policy-url before
+// its handler runs. Calls between nodes (agent registration) are not
+// checked. The server's own checks (ownership, admin, quotas) still apply
+// after an allow.
+type policyHook struct {
+	logger            *log.Logger
+	opa               *policy.Client
+	trustedForwarders map[string]bool
+	admins            map[string]bool
+}
+
+func newPolicyHook(logger *log.Logger, opa *policy.Client, trustedForwarders, adminCNs []string) *policyHook {
+	return &policyHook{logger: logger, opa: opa, trustedForwarders: stringSet(trustedForwarders), admins: stringSet(adminCNs)}
+}
+
+// check asks the policy about a call to fullMethod with req. If OPA
+// can't be asked, the call fails UNAVAILABLE.
+func (h *policyHook) check(ctx context.Context, fullMethod string, req any) error {
+	service, verb := splitMethod(fullMethod)
+	if service != "JobWorker" && service != "Admin" {
+		return nil
+	}
+	user, err := callerFromContext(ctx, h.trustedForwarders)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+
+	sc, err := callerNamespace(ctx, h.trustedForwarders, h.admins)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "mTLS identity: %v", err)
+	}
+
+	in := policy.Input{Subject: user, Admin: h.admins[user], Namespace: sc.ns, Service: service, Verb: verb}
+	if m, ok := req.(proto.Message); ok {
+		in.Jobs = jobsOf(m)
+		if b, err := (protojson.MarshalOptions{UseProtoNames: true}).Marshal(m); err == nil {
+			in.Request = b
+		}
+	}
+	d, err := h.opa.Decide(ctx, in)
+	if err != nil {
+		h.logger.Printf("policy: %s %s: %v", user, verb, err)
+		return status.Error(codes.Unavailable, "policy check failed")
+	}
+	if !d.Allow {
+		msg := "denied by policy"
+		if d.Reason != "" {
+			msg += ": " + d.Reason
+		}
+		h.logger.Printf("policy: %s %s %s", user, verb, msg)
+		return status.Error(codes.PermissionDenied, msg)
+	}
+	return nil
+}
+
+// splitMethod splits "/jobworker.v1.JobWorker/StartJob" into "JobWorker"
+// and "StartJob".
+func splitMethod(fullMethod string) (service, verb string) {
+	service, verb, _ = strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		service = service[i+1:]
+	}
+	return service, verb
+}
+
+// jobsOf describes the jobs m would start, if any.
+func jobsOf(m proto.Message) []policy.Job {
+	switch r := m.(type) {
+	case *jobpb.StartJobRequest:
+		return []policy.Job{policy.JobOf(r)}
+	case *jobpb.RunScriptRequest:
+		if r.GetJob() != nil {
+			return []policy.Job{policy.JobOf(r.GetJob())}
+		}
+	case *jobpb.StartJobsRequest:
+		jobs := make([]policy.Job, len(r.GetJobs()))
+		for i, j := range r.GetJobs() {
+			jobs[i] = policy.JobOf(j)
+		}
+		return jobs
+	}
+	return nil
+}
+
+func (h *policyHook) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := h.check(ctx, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// streamInterceptor checks streams on their first message, which holds
+// the request (for RunScript, the job).
+func (h *policyHook) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &checkedStream{ServerStream: ss, hook: h, method: info.FullMethod})
+	}
+}
+
+type checkedStream struct {
+	grpc.ServerStream
+	hook    *policyHook
+	method  string
+	checked bool
+}
+
+func (s *checkedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !s.checked {
+		s.checked = true
+		return s.hook.check(s.Context(), s.method, m)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/bucknercd/jobworker/internal/version"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// serverInfo answers GetServerInfo for this binary, running as node.
+func serverInfo(node string, req *jobpb.GetServerInfoRequest) *jobpb.GetServerInfoResponse {
+	return &jobpb.GetServerInfoResponse{
+		Version:       version.Version,
+		Commit:        version.Commit,
+		BuildDate:     version.BuildDate,
+		GoVersion:     runtime.Version(),
+		ApiVersion:    version.APIVersion,
+		MinApiVersion: version.MinAPIVersion,
+		Capabilities:  version.Capabilities,
+		Features:      version.FeatureList(),
+		Node:          node,
+		// A client too old to say is assumed to be fine, as it was before.
+		Compatible: version.Compatible(req.GetClientApiVersion(), version.MinAPIVersion),
+	}
+}
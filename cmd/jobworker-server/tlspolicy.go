@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsPolicy is what the server's listeners accept, from -tls-min-version,
+// -tls-curves and -tls-ciphers. The zero value is the default: TLS 1.3
+// only, with Go's curve preferences.
+type tlsPolicy struct {
+	minVersion uint16
+	curves     []tls.CurveID
+	ciphers    []uint16 // TLS 1.2 only; nil => Go's secure defaults
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// parseTLSPolicy parses the TLS flags. Cipher suites Go considers insecure
+// are refused, as are cipher suites without TLS 1.2 to use them.
+func parseTLSPolicy(minVersion, curves, ciphers string) (tlsPolicy, error) {
+	p := tlsPolicy{minVersion: tls.VersionTLS13}
+	switch minVersion {
+	case "", "1.3":
+	case "1.2":
+		p.minVersion = tls.VersionTLS12
+	default:
+		return tlsPolicy{}, fmt.Errorf("-tls-min-version %q: want 1.2 or 1.3", minVersion)
+	}
+
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return tlsPolicy{}, fmt.Errorf("-tls-curves: unknown curve %q (want x25519, p256, p384 or p521)", name)
+		}
+		p.curves = append(p.curves, id)
+	}
+
+	names := splitList(ciphers)
+	if len(names) > 0 && p.minVersion != tls.VersionTLS12 {
+		return tlsPolicy{}, fmt.Errorf("-tls-ciphers only applies with -tls-min-version 1.2; TLS 1.3 suites aren't configurable")
+	}
+	for _, name := range names {
+		id, err := tls12Cipher(name)
+		if err != nil {
+			return tlsPolicy{}, fmt.Errorf("-tls-ciphers: %w", err)
+		}
+		p.ciphers = append(p.ciphers, id)
+	}
+	return p, nil
+}
+
+func tls12Cipher(name string) (uint16, error) {
+	for _, c := range tls.InsecureCipherSuites() {
+		if strings.EqualFold(c.Name, name) {
+			return 0, fmt.Errorf("%s is insecure", c.Name)
+		}
+	}
+	for _, c := range tls.CipherSuites() {
+		if !strings.EqualFold(c.Name, name) {
+			continue
+		}
+		for _, v := range c.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return c.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("%s is a TLS 1.3 suite, which can't be configured", c.Name)
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// apply sets the policy on cfg.
+func (p tlsPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.minVersion
+	cfg.CurvePreferences = p.curves
+	cfg.CipherSuites = p.ciphers
+}
+
+// String describes the policy for the startup log.
+func (p tlsPolicy) String() string {
+	s := "TLS 1.3+"
+	if p.minVersion == tls.VersionTLS12 {
+		s = "TLS 1.2+"
+	}
+	if len(p.curves) > 0 {
+		names := make([]string, len(p.curves))
+		for i, c := range p.curves {
+			names[i] = c.String()
+		}
+		s += ", curves " + strings.Join(names, ",")
+	}
+	if len(p.ciphers) > 0 {
+		names := make([]string, len(p.ciphers))
+		for i, c := range p.ciphers {
+			names[i] = tls.CipherSuiteName(c)
+		}
+		s += ", TLS 1.2 ciphers " + strings.Join(names, ",")
+	}
+	return s
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bucknercd/jobworker/internal/tokenauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Authentication modes, from -auth-mode.
+const (
+	authMTLS      = "mtls"       // a client certificate; tokens are ignored
+	authToken     = "token"      // a bearer token, or else a client certificate
+	authMTLSToken = "mtls+token" // both, naming the same user
+)
+
+// tokenUserKey holds the user a bearer token authenticated, when that is
+// who the caller is.
+type tokenUserKey struct{}
+
+// tokenAuth checks the bearer token in each call's authorization metadata
+// before any handler runs.
+type tokenAuth struct {
+	logger   *log.Logger
+	mode     string
+	verifier *tokenauth.Verifier
+	// servicePeers are the CNs of other nodes (agents, coordinators),
+	// which call with their certificates alone in mtls+token mode.
+	servicePeers map[string]bool
+}
+
+func newTokenAuth(logger *log.Logger, mode string, verifier *tokenauth.Verifier, servicePeers []string) *tokenAuth {
+	return &tokenAuth{logger: logger, mode: mode, verifier: verifier, servicePeers: stringSet(servicePeers)}
+}
+
+// authenticate returns ctx carrying the caller's token identity, if that
+// is who they are, or an Unauthenticated error.
+func (a *tokenAuth) authenticate(ctx context.Context) (context.Context, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	cn, certErr := certUserFromContext(ctx)
+
+	if a.mode == authMTLSToken {
+		if certErr != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "mTLS identity: %v", certErr)
+		}
+		if token == "" && a.servicePeers[cn] {
+			return ctx, nil
+		}
+	}
+	if token == "" {
+		if a.mode == authToken && certErr == nil {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "bearer token required")
+	}
+
+	user, err := a.verifier.Verify(token)
+	if err != nil {
+		a.logger.Printf("auth: rejected token: %v", err)
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	if a.mode == authMTLSToken {
+		if user != cn {
+			a.logger.Printf("auth: token for %s presented with certificate for %s", user, cn)
+			return nil, status.Error(codes.Unauthenticated, "bearer token and client certificate name different users")
+		}
+		return ctx, nil
+	}
+	return context.WithValue(ctx, tokenUserKey{}, user), nil
+}
+
+// bearerToken returns the token in the authorization metadata, or "" if
+// there is none.
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get("authorization")
+	switch len(v) {
+	case 0:
+		return "", nil
+	case 1:
+	default:
+		return "", errors.New("more than one authorization value")
+	}
+	scheme, token, ok := strings.Cut(v[0], " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("authorization: want Bearer <token>")
+	}
+	return strings.TrimSpace(token), nil
+}
+
+func (a *tokenAuth) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *tokenAuth) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authedStream is a server stream with the authenticated context.
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context { return s.ctx }
+
+// httpMiddleware applies the same checks to the HTTP gateway's API, with
+// the Authorization header as the metadata. The dashboard's static files
+// are left open; the API calls it makes are not.
+func (a *tokenAuth) httpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := grpcContext(r)
+		if h := r.Header.Values("Authorization"); len(h) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.MD{"authorization": h})
+		}
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,183 @@
+// Package accounting keeps a ledger of what finished jobs consumed, for
+// chargeback: CPU time, memory held over time, and job counts per user.
+package accounting
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record is what one job consumed between launch and its end.
+type Record struct {
+	JobID      string    `json:"job_id"`
+	Owner      string    `json:"owner"`
+	Node       string    `json:"node,omitempty"`
+	Executable string    `json:"executable"`
+	Status     string    `json:"status"`
+	RunningAt  time.Time `json:"running_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	CPUSeconds        float64 `json:"cpu_seconds"`
+	MemoryByteSeconds float64 `json:"memory_byte_seconds"` // memory.current integrated over the run
+	MemoryPeakBytes   uint64  `json:"memory_peak_bytes"`   // highest sample
+}
+
+// Usage totals the records of one user.
+type Usage struct {
+	User              string
+	Jobs              int
+	CPUSeconds        float64
+	MemoryByteSeconds float64
+}
+
+// Ledger holds job records, appending each to a JSON-lines file so they
+// outlive the jobs (and the server).
+type Ledger struct {
+	mu      sync.Mutex
+	f       *os.File
+	records []Record
+}
+
+// Open loads the ledger at path, creating it if needed. Records are
+// appended to it from then on.
+func Open(path string) (*Ledger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open accounting file: %w", err)
+	}
+	l := &Ledger{f: f}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("accounting file %s: line %d: %w", path, lineNo, err)
+		}
+		l.records = append(l.records, r)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read accounting file: %w", err)
+	}
+	return l, nil
+}
+
+// Len is the number of records in the ledger.
+func (l *Ledger) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.records)
+}
+
+// Add appends r to the ledger.
+func (l *Ledger) Add(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+	_, err = l.f.Write(b)
+	return err
+}
+
+// Records returns the records of jobs that finished in [from, to), limited
+// to owner when it is set. A job is billed to the period it finished in.
+func (l *Ledger) Records(from, to time.Time, owner string) []Record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []Record
+	for _, r := range l.records {
+		if r.FinishedAt.Before(from) || !r.FinishedAt.Before(to) {
+			continue
+		}
+		if owner != "" && r.Owner != owner {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Summarize totals records per user, ordered by user.
+func Summarize(records []Record) []Usage {
+	byUser := make(map[string]*Usage)
+	for _, r := range records {
+		u, ok := byUser[r.Owner]
+		if !ok {
+			u = &Usage{User: r.Owner}
+			byUser[r.Owner] = u
+		}
+		u.Jobs++
+		u.CPUSeconds += r.CPUSeconds
+		u.MemoryByteSeconds += r.MemoryByteSeconds
+	}
+	out := make([]Usage, 0, len(byUser))
+	for _, u := range byUser {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	return out
+}
+
+// Meter integrates a job's memory use over time from periodic samples.
+// The zero value is ready; it counts nothing until Start.
+type Meter struct {
+	mu          sync.Mutex
+	last        time.Time // time of the previous sample, or the start
+	lastBytes   uint64
+	sampled     bool
+	byteSeconds float64
+	peak        uint64
+}
+
+// Start marks when the job began running.
+func (m *Meter) Start(at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = at
+}
+
+// Observe adds a memory.current sample taken at at. Between samples usage
+// is taken to change linearly; before the first, to have been flat.
+func (m *Meter) Observe(at time.Time, bytes uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.IsZero() || at.Before(m.last) {
+		return
+	}
+	prev := m.lastBytes
+	if !m.sampled {
+		prev, m.sampled = bytes, true
+	}
+	m.byteSeconds += (float64(prev) + float64(bytes)) / 2 * at.Sub(m.last).Seconds()
+	m.last, m.lastBytes = at, bytes
+	m.peak = max(m.peak, bytes)
+}
+
+// Totals reports the integral so far and the highest sample.
+func (m *Meter) Totals() (byteSeconds float64, peak uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.byteSeconds, m.peak
+}
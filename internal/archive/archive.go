@@ -0,0 +1,163 @@
+// Package archive keeps finished jobs' output and metadata in an
+// S3-compatible bucket, so they can still be read after the server has
+// garbage-collected its own copy. Each job is a few objects under
+// <prefix><job id>/: stdout, stderr, result (for jobs with a result fd)
+// and metadata.json.
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Object names under a job's prefix.
+const (
+	Stdout   = "stdout"
+	Stderr   = "stderr"
+	Result   = "result"
+	Metadata = "metadata.json"
+)
+
+// partSize is the multipart upload part size for output of unknown length.
+// Each upload buffers one part; 10000 parts of it allow 160 GiB per
+// object.
+const partSize = 16 << 20
+
+// OutputName is the object holding a job's stdout or stderr.
+func OutputName(stderr bool) string {
+	if stderr {
+		return Stderr
+	}
+	return Stdout
+}
+
+// Config says where the archive is.
+type Config struct {
+	// URL is s3://bucket or s3://bucket/prefix.
+	URL string
+	// Endpoint is the S3 API, e.g. https://s3.amazonaws.com or
+	// http://minio.internal:9000; a bare host:port means https.
+	Endpoint string
+	// Region is the bucket's; empty asks the endpoint.
+	Region string
+}
+
+// Store is an archive bucket. Credentials come from the environment
+// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN) or else
+// the instance role: EC2 instance metadata, ECS task role, or EKS web
+// identity.
+type Store struct {
+	client *minio.Client
+	bucket string
+	prefix string // empty, or ends in "/"
+}
+
+// New parses cfg. It doesn't contact the endpoint; see Check.
+func New(cfg Config) (*Store, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("archive url must look like s3://bucket/prefix, got %q", cfg.URL)
+	}
+	host, secure := cfg.Endpoint, true
+	if strings.Contains(host, "://") {
+		e, err := url.Parse(host)
+		if err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" || strings.Trim(e.Path, "/") != "" {
+			return nil, fmt.Errorf("archive endpoint must look like https://host[:port], got %q", cfg.Endpoint)
+		}
+		host, secure = e.Host, e.Scheme == "https"
+	}
+	client, err := minio.New(host, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.IAM{},
+		}),
+		Secure: secure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("archive endpoint: %w", err)
+	}
+	s := &Store{client: client, bucket: u.Host}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		s.prefix = p + "/"
+	}
+	return s, nil
+}
+
+// String is the archive's URL, for logs.
+func (s *Store) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// Check reports whether the bucket exists and the credentials can reach
+// it.
+func (s *Store) Check(ctx context.Context) error {
+	ok, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", s.bucket)
+	}
+	return nil
+}
+
+func (s *Store) key(id, name string) string {
+	return s.prefix + id + "/" + name
+}
+
+// Put stores r as job id's object name, replacing any earlier one. size
+// is -1 when unknown.
+func (s *Store) Put(ctx context.Context, id, name string, r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream", PartSize: partSize}
+	if name == Metadata {
+		opts.ContentType = "application/json"
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, s.key(id, name), r, size, opts); err != nil {
+		return fmt.Errorf("put %s: %w", s.key(id, name), err)
+	}
+	return nil
+}
+
+// Open opens job id's object name for reading, failing with an error
+// wrapping os.ErrNotExist when there is none. Seeking fetches from the
+// new offset.
+func (s *Store) Open(ctx context.Context, id, name string) (io.ReadSeekCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(id, name), minio.GetObjectOptions{})
+	if err == nil {
+		_, err = obj.Stat() // GetObject is lazy; this asks
+		if err != nil {
+			obj.Close()
+		}
+	}
+	if err != nil {
+		return nil, s.objectError(id, name, err)
+	}
+	return obj, nil
+}
+
+// Remove deletes job id's objects; missing ones are no error.
+func (s *Store) Remove(ctx context.Context, id string) error {
+	var errs []error
+	for _, name := range []string{Metadata, Stdout, Stderr, Result} {
+		if err := s.client.RemoveObject(ctx, s.bucket, s.key(id, name), minio.RemoveObjectOptions{}); err != nil {
+			errs = append(errs, s.objectError(id, name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) objectError(id, name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%s: %w", s.key(id, name), os.ErrNotExist)
+	}
+	return fmt.Errorf("%s: %w", s.key(id, name), err)
+}
@@ -0,0 +1,167 @@
+// Package audit records who did what through the API (starting, stopping
+// and reading jobs, admin calls) and delivers the records to external
+// systems such as a SIEM. Each record is appended to a local spool before
+// anything is exported, and each exporter delivers from its own cursor in
+// the spool, in order and at least once: an exporter that is down, or a
+// server restart, delays records but doesn't lose them.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is one audited call.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`          // CN or token user; empty if unknown
+	Peer    string    `json:"peer,omitempty"` // remote address
+	Service string    `json:"service"`        // "JobWorker" or "Admin"
+	Action  string    `json:"action"`         // the RPC, e.g. "StopJob"
+	JobID   string    `json:"job_id,omitempty"`
+	GroupID string    `json:"group_id,omitempty"`
+	Outcome string    `json:"outcome"` // gRPC code name: "OK", "PermissionDenied", ...
+	Error   string    `json:"error,omitempty"`
+	// Request is the request (for streams, the first message) as JSON.
+	Request json.RawMessage `json:"request,omitempty"`
+	// Phase and Bytes are set on reads of job output: a PhaseBegin record
+	// when the job's output starts going out, and a PhaseEnd one with the
+	// bytes sent (omitted when none) when the stream ends.
+	Phase string `json:"phase,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+}
+
+// Record.Phase values.
+const (
+	PhaseBegin = "begin"
+	PhaseEnd   = "end"
+)
+
+// Exporter delivers records to an external system. Export gets them as
+// the JSON lines the spool holds; an error means none may have arrived,
+// and the batch is sent again.
+type Exporter interface {
+	Export(records []json.RawMessage) error
+	Close() error
+}
+
+// Log spools records and runs their delivery to each exporter.
+type Log struct {
+	logger *log.Logger
+	spool  *spool
+
+	mu         sync.Mutex // guards the deliveries' positions
+	deliveries []*delivery
+}
+
+// Open opens the spool in dir and starts delivering to the exporters
+// specs describe (see ParseExporter), picking up where each left off.
+func Open(logger *log.Logger, dir string, specs []string) (*Log, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no exporters")
+	}
+	sp, err := openSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{logger: logger, spool: sp}
+	keep := make(map[string]bool)
+	for _, spec := range specs {
+		exp, err := ParseExporter(spec)
+		if err != nil {
+			l.closeExporters()
+			sp.close()
+			return nil, fmt.Errorf("audit exporter %q: %w", spec, err)
+		}
+		d := newDelivery(l, spec, exp)
+		keep[d.cursorPath()] = true
+		l.deliveries = append(l.deliveries, d)
+	}
+	// Cursors of exporters no longer configured would pin the spool.
+	stale, _ := filepath.Glob(filepath.Join(dir, "cursor-*"))
+	for _, c := range stale {
+		if !keep[c] {
+			os.Remove(c)
+		}
+	}
+	for _, d := range l.deliveries {
+		go d.run()
+	}
+	l.cleanup()
+	return l, nil
+}
+
+// Record spools r for delivery. The record is on disk when Record returns;
+// the spool is fsynced every second.
+func (l *Log) Record(r Record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		l.logger.Printf("[audit] encode %s by %s: %v", r.Action, r.Actor, err)
+		return
+	}
+	if err := l.spool.append(b); err != nil {
+		l.logger.Printf("[audit] spool %s by %s: %v", r.Action, r.Actor, err)
+		return
+	}
+	for _, d := range l.deliveries {
+		d.wakeUp()
+	}
+}
+
+// Exporters names the exporters, for the startup log.
+func (l *Log) Exporters() string {
+	names := make([]string, len(l.deliveries))
+	for i, d := range l.deliveries {
+		names[i] = d.spec
+	}
+	return strings.Join(names, ", ")
+}
+
+// Close stops delivery, after the batches in flight, and syncs the spool.
+// Undelivered records go out after the next Open.
+func (l *Log) Close() error {
+	for _, d := range l.deliveries {
+		close(d.stop)
+	}
+	for _, d := range l.deliveries {
+		<-d.done
+	}
+	l.closeExporters()
+	return l.spool.close()
+}
+
+func (l *Log) closeExporters() {
+	for _, d := range l.deliveries {
+		d.exp.Close()
+	}
+}
+
+// cleanup removes the segments every exporter has delivered.
+func (l *Log) cleanup() {
+	l.mu.Lock()
+	oldest := l.spool.current()
+	for _, d := range l.deliveries {
+		oldest = min(oldest, d.pos.seq)
+	}
+	l.mu.Unlock()
+	l.spool.removeBefore(oldest)
+}
+
+// cursorName is the file holding an exporter's position, named for its
+// spec so a changed spec starts afresh.
+func cursorName(spec string) string {
+	sum := sha256.Sum256([]byte(spec))
+	return "cursor-" + hex.EncodeToString(sum[:8])
+}
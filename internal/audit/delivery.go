@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	maxBatch     = 256 // records per Export
+	idlePoll     = time.Second
+	retryBackoff = time.Second
+	maxBackoff   = time.Minute
+)
+
+// position is a place in the spool: a segment and a byte offset in it.
+type position struct {
+	seq uint64
+	off int64
+}
+
+// delivery feeds one exporter from the spool.
+type delivery struct {
+	log  *Log
+	spec string
+	exp  Exporter
+	pos  position // guarded by log.mu
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newDelivery(l *Log, spec string, exp Exporter) *delivery {
+	d := &delivery{
+		log:  l,
+		spec: spec,
+		exp:  exp,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	d.pos = d.loadCursor()
+	return d
+}
+
+func (d *delivery) cursorPath() string {
+	return filepath.Join(d.log.spool.dir, cursorName(d.spec))
+}
+
+// loadCursor returns the saved position, or the start of the oldest
+// segment for an exporter that has none.
+func (d *delivery) loadCursor() position {
+	var p position
+	b, err := os.ReadFile(d.cursorPath())
+	if err == nil {
+		// A cursor past the current segment belongs to a spool since wiped.
+		if _, err = fmt.Sscanf(string(b), "%d %d", &p.seq, &p.off); err == nil && p.seq <= d.log.spool.current() {
+			return p
+		}
+	}
+	return position{seq: d.log.spool.oldest()}
+}
+
+func (d *delivery) saveCursor(p position) error {
+	tmp := d.cursorPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", p.seq, p.off)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.cursorPath())
+}
+
+func (d *delivery) wakeUp() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *delivery) run() {
+	defer close(d.done)
+	backoff := retryBackoff
+	for {
+		d.log.mu.Lock()
+		pos := d.pos
+		d.log.mu.Unlock()
+
+		batch, next, err := d.read(pos)
+		if err == nil && len(batch) > 0 {
+			err = d.exp.Export(batch)
+		}
+		if err != nil {
+			d.log.logger.Printf("[audit] %s: %v (retrying in %s)", d.spec, err, backoff)
+			if !d.sleep(backoff) {
+				return
+			}
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = retryBackoff
+
+		if next != pos {
+			if err := d.saveCursor(next); err != nil {
+				d.log.logger.Printf("[audit] %s: save cursor: %v", d.spec, err)
+			}
+			d.log.mu.Lock()
+			d.pos = next
+			d.log.mu.Unlock()
+			if next.seq != pos.seq {
+				d.log.cleanup()
+			}
+			continue
+		}
+		select {
+		case <-d.wake:
+		case <-time.After(idlePoll):
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// sleep waits for t, returning false if delivery is stopped first.
+func (d *delivery) sleep(t time.Duration) bool {
+	select {
+	case <-time.After(t):
+		return true
+	case <-d.stop:
+		return false
+	}
+}
+
+// read returns up to maxBatch whole records from pos, and the position
+// after them. At the end of a finished segment it moves on to the next.
+func (d *delivery) read(pos position) ([]json.RawMessage, position, error) {
+	f, err := os.Open(d.log.spool.segmentPath(pos.seq))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, d.after(pos), nil
+	}
+	if err != nil {
+		return nil, pos, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.off, io.SeekStart); err != nil {
+		return nil, pos, err
+	}
+
+	var batch []json.RawMessage
+	r := bufio.NewReader(f)
+	for len(batch) < maxBatch {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break // a partial line is still being written
+		}
+		if err != nil {
+			return nil, pos, err
+		}
+		pos.off += int64(len(line))
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			batch = append(batch, json.RawMessage(line))
+		}
+	}
+	if len(batch) == 0 {
+		return nil, d.after(pos), nil
+	}
+	return batch, pos, nil
+}
+
+// after is where to go from pos when its segment has nothing more: the
+// next segment once pos's is no longer written, else pos.
+func (d *delivery) after(pos position) position {
+	if pos.seq >= d.log.spool.current() {
+		return pos
+	}
+	// Records may have landed after the read and before the segment was
+	// finished; they're read next time round.
+	if fi, err := os.Stat(d.log.spool.segmentPath(pos.seq)); err == nil && fi.Size() > pos.off {
+		return pos
+	}
+	segs, _ := d.log.spool.segments()
+	for _, seq := range segs {
+		if seq > pos.seq {
+			return position{seq: seq}
+		}
+	}
+	return position{seq: d.log.spool.current()}
+}
@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/limits"
+	"github.com/bucknercd/jobworker/internal/logging"
+)
+
+const httpTimeout = 10 * time.Second
+
+// ParseExporter opens the exporter spec describes:
+//
+//	syslog:                   the local syslog daemon
+//	syslog://host:514         syslog over UDP (syslog+tcp:// for TCP)
+//	https://siem/path         POST batches as a JSON array (http:// too)
+//	file:///var/log/audit.log JSON lines, rotated with ?max-size=100M,
+//	                          max-age=24h, keep=N and compress=true
+func ParseExporter(spec string) (Exporter, error) {
+	u, err := url.Parse(strings.TrimSpace(spec))
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "syslog", "syslog+udp", "syslog+tcp":
+		return newSyslogExporter(u)
+	case "http", "https":
+		return &httpExporter{url: u.String(), client: &http.Client{Timeout: httpTimeout}}, nil
+	case "file":
+		return newFileExporter(u)
+	}
+	return nil, fmt.Errorf("unknown scheme %q (want syslog, syslog+tcp, http, https or file)", u.Scheme)
+}
+
+// syslogExporter sends each record as one AUTHPRIV.NOTICE message tagged
+// "jobworker-audit".
+type syslogExporter struct {
+	network, addr string
+
+	mu sync.Mutex
+	w  *syslog.Writer
+}
+
+func newSyslogExporter(u *url.URL) (*syslogExporter, error) {
+	s := &syslogExporter{}
+	if u.Host != "" {
+		s.network = strings.TrimPrefix(strings.TrimPrefix(u.Scheme, "syslog"), "+")
+		if s.network == "" {
+			s.network = "udp"
+		}
+		s.addr = u.Host
+		if u.Port() == "" {
+			s.addr += ":514"
+		}
+	}
+	// Dial now so a bad address fails at startup; later failures redial.
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial connects to the syslog daemon. Caller holds s.mu, or s is new.
+func (s *syslogExporter) dial() error {
+	w, err := syslog.Dial(s.network, s.addr, syslog.LOG_NOTICE|syslog.LOG_AUTHPRIV, "jobworker-audit")
+	if err != nil {
+		return fmt.Errorf("syslog dial: %w", err)
+	}
+	s.w = w
+	return nil
+}
+
+func (s *syslogExporter) Export(records []json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		if err := s.w.Notice(string(r)); err != nil {
+			s.w.Close()
+			s.w = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogExporter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
+
+// httpExporter POSTs each batch as a JSON array; anything but a 2xx is a
+// failure and the batch is sent again.
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpExporter) Export(records []json.RawMessage) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpExporter) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// fileExporter appends records as JSON lines to a rotating file.
+type fileExporter struct {
+	f *logging.RotatingFile
+}
+
+func newFileExporter(u *url.URL) (*fileExporter, error) {
+	if u.Path == "" {
+		return nil, fmt.Errorf("file: needs a path, e.g. file:///var/log/jobworker-audit.log")
+	}
+	var rot logging.Rotation
+	q := u.Query()
+	for k := range q {
+		v := q.Get(k)
+		var err error
+		switch k {
+		case "max-size":
+			var m limits.Memory
+			m, err = limits.ParseMemory(v)
+			rot.MaxSize = m.Bytes()
+		case "max-age":
+			rot.MaxAge, err = time.ParseDuration(v)
+		case "keep":
+			rot.MaxBackups, err = strconv.Atoi(v)
+		case "compress":
+			rot.Compress, err = strconv.ParseBool(v)
+		default:
+			err = fmt.Errorf("unknown option (want max-size, max-age, keep or compress)")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s=%s: %w", k, v, err)
+		}
+	}
+	f, err := logging.OpenRotating(u.Path, rot)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{f: f}, nil
+}
+
+func (s *fileExporter) Export(records []json.RawMessage) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	_, err := s.f.Write(buf.Bytes())
+	return err
+}
+
+func (s *fileExporter) Close() error { return s.f.Close() }
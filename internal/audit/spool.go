@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSize    = 8 << 20 // start a new segment past this many bytes
+	spoolSyncEvery = time.Second
+)
+
+// spool is a directory of append-only JSON-lines segments, numbered in
+// order. Only the newest is written; a new one is started on every open.
+type spool struct {
+	dir string
+
+	mu    sync.Mutex
+	f     *os.File
+	seq   uint64
+	size  int64
+	dirty bool
+	done  chan struct{}
+}
+
+func openSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("audit spool: %w", err)
+	}
+	s := &spool{dir: dir, done: make(chan struct{})}
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	next := uint64(1)
+	if len(segs) > 0 {
+		next = segs[len(segs)-1] + 1
+	}
+	if err := s.create(next); err != nil {
+		return nil, err
+	}
+	go s.syncLoop()
+	return s, nil
+}
+
+func segmentName(seq uint64) string { return fmt.Sprintf("%016d.jsonl", seq) }
+
+func (s *spool) segmentPath(seq uint64) string { return filepath.Join(s.dir, segmentName(seq)) }
+
+// create starts segment seq. Caller holds s.mu, or s is new.
+func (s *spool) create(seq uint64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit spool: %w", err)
+	}
+	s.f, s.seq, s.size = f, seq, 0
+	return nil
+}
+
+// append writes line as one record, in a single write so readers never
+// see half of it as a whole line.
+func (s *spool) append(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if s.size >= segmentSize {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+		s.f.Close()
+		if err := s.create(s.seq + 1); err != nil {
+			s.f = nil
+			return err
+		}
+	}
+	n, err := s.f.Write(append(line, '\n'))
+	s.size += int64(n)
+	s.dirty = true
+	return err
+}
+
+// current is the segment being written.
+func (s *spool) current() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// segments lists the segment numbers in the spool, oldest first.
+func (s *spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("audit spool: %w", err)
+	}
+	var segs []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		if seq, err := strconv.ParseUint(name, 10, 64); err == nil {
+			segs = append(segs, seq)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// oldest is the first segment in the spool, or the current one.
+func (s *spool) oldest() uint64 {
+	if segs, err := s.segments(); err == nil && len(segs) > 0 {
+		return segs[0]
+	}
+	return s.current()
+}
+
+// removeBefore deletes the segments older than seq.
+func (s *spool) removeBefore(seq uint64) {
+	segs, _ := s.segments()
+	for _, old := range segs {
+		if old >= seq {
+			break
+		}
+		os.Remove(s.segmentPath(old))
+	}
+}
+
+func (s *spool) syncLoop() {
+	t := time.NewTicker(spoolSyncEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			if s.dirty && s.f != nil {
+				_ = s.f.Sync()
+				s.dirty = false
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *spool) close() error {
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// BlockDevice returns the "MAJ:MIN" io.max needs for dev: either already
+// in that form, a block device node, or any other path, meaning the disk
+// its filesystem lives on. Partitions are mapped to their whole disk, since
+// io.max only takes disks. A path that doesn't exist yet is resolved
+// through its nearest existing parent.
+func BlockDevice(dev string) (string, error) {
+	var maj, min uint32
+	if _, err := fmt.Sscanf(dev, "%d:%d", &maj, &min); err == nil && fmt.Sprintf("%d:%d", maj, min) == dev {
+		return dev, nil
+	}
+
+	path := dev
+	var st unix.Stat_t
+	for {
+		err := unix.Stat(path, &st)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return "", fmt.Errorf("stat %s: %w", path, err)
+		}
+		path = parent
+	}
+
+	devt := st.Dev
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		devt = st.Rdev
+	}
+	maj, min = unix.Major(devt), unix.Minor(devt)
+	if maj == 0 {
+		return "", fmt.Errorf("%s is not backed by a block device (%d:%d is virtual)", dev, maj, min)
+	}
+
+	return wholeDisk(maj, min)
+}
+
+// wholeDisk maps a partition to its disk via sysfs, where
+// /sys/dev/block/MAJ:MIN links into the disk's directory.
+func wholeDisk(maj, min uint32) (string, error) {
+	sys := fmt.Sprintf("/sys/dev/block/%d:%d", maj, min)
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err != nil {
+		return fmt.Sprintf("%d:%d", maj, min), nil
+	}
+	real, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		return "", fmt.Errorf("find disk of partition %d:%d: %w", maj, min, err)
+	}
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(real), "dev"))
+	if err != nil {
+		return "", fmt.Errorf("find disk of partition %d:%d: %w", maj, min, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
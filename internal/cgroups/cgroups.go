@@ -9,60 +9,106 @@ import (
 	"strings"
 	"syscall"
 	"time"
-)
 
-const (
-	jobCgroupRoot = "/sys/fs/cgroup/jobs"
+	cg "github.com/bucknercd/jobworker/pkg/cgroups"
 )
 
-type CgroupManager struct {
-	cgPath string
+// Roots says where the cgroup filesystem is and which directory under it
+// holds job cgroups.
+type Roots struct {
+	// Mount is the cgroup v2 mount point.
+	Mount string
+	// Jobs is the parent of every job cgroup. Empty means <Mount>/jobs.
+	Jobs string
+	// Fake treats Mount as an ordinary directory tree standing in for
+	// cgroupfs, for tests: limit files are created rather than required,
+	// and Create returns no FD, so processes are not actually confined.
+	Fake bool
 }
 
-type Snapshot struct {
-	Path string
+// DefaultRoots is the host's cgroup v2 hierarchy.
+var DefaultRoots = Roots{Mount: "/sys/fs/cgroup"}
 
-	PidsCurrent int
-	Procs       []int
+var roots = DefaultRoots
 
-	CPUMax    string
-	MemoryMax string
-	IOMax     string
+// Configure points the package at r. It must be called before any job
+// cgroup is created, typically once at startup.
+func Configure(r Roots) {
+	if r.Mount == "" {
+		r.Mount = DefaultRoots.Mount
+	}
+	roots = r
+}
 
-	MemoryCurrent uint64
+// JobRoot is the parent of every job cgroup.
+func (r Roots) JobRoot() string {
+	if r.Jobs != "" {
+		return r.Jobs
+	}
+	return filepath.Join(r.Mount, "jobs")
+}
 
-	CPUStat map[string]uint64
+type CgroupManager struct {
+	cgPath string
 }
 
 func NewCgroupManager(jobID string) *CgroupManager {
-	return &CgroupManager{cgPath: filepath.Join(jobCgroupRoot, jobID)}
+	return &CgroupManager{cgPath: filepath.Join(roots.JobRoot(), jobID)}
 }
 
+// Path is the job's cgroup directory (which may not exist yet).
+func (m *CgroupManager) Path() string { return m.cgPath }
+
 // Create ensures the parent cgroup delegates controllers, creates the job cgroup,
 // applies limits, and returns an FD opened on the job cgroup directory suitable
-// for SysProcAttr{UseCgroupFD: true, CgroupFD: fd}.
+// for SysProcAttr{UseCgroupFD: true, CgroupFD: fd}. With fake roots the FD
+// is -1: there is nothing the kernel could place a process into.
 func (m *CgroupManager) Create(jobID string, limits []string) (int, error) {
 	if jobID == "" {
 		return -1, fmt.Errorf("jobID required")
 	}
 
+	jobRoot := roots.JobRoot()
+
 	// Basic sanity: cgroup v2 expects this file to exist.
-	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+	if _, err := os.Stat(filepath.Join(roots.Mount, "cgroup.controllers")); err != nil {
 		return -1, fmt.Errorf("cgroup v2 not available: %w", err)
 	}
 
 	// Ensure root exists.
-	if err := os.MkdirAll(jobCgroupRoot, 0o755); err != nil {
-		return -1, fmt.Errorf("mkdir %s: %w", jobCgroupRoot, err)
+	if err := os.MkdirAll(jobRoot, 0o755); err != nil {
+		return -1, fmt.Errorf("mkdir %s: %w", jobRoot, err)
 	}
 
 	// Ensure controllers are delegated to children of /jobs.
 	// Without this, job cgroups won't have cpu.max/memory.max/io.max/etc.
-	if err := ensureDelegatedControllers(jobCgroupRoot, []string{"cpu", "memory", "io", "pids"}); err != nil {
+	if err := ensureDelegatedControllers(jobRoot, []string{"cpu", "cpuset", "memory", "io", "pids"}); err != nil {
 		// Treat this as a hard error: without controller delegation, per-job limits won't exist.
 		return -1, err
 	}
 
+	// A namespaced job's cgroup is a level further down, in its namespace's,
+	// which has to pass the controllers on in turn.
+	if rel, err := filepath.Rel(jobRoot, filepath.Dir(m.cgPath)); err == nil && rel != "." {
+		parent := jobRoot
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			parent = filepath.Join(parent, part)
+			if err := os.MkdirAll(parent, 0o755); err != nil {
+				return -1, fmt.Errorf("mkdir %s: %w", parent, err)
+			}
+			if roots.Fake {
+				if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); errors.Is(err, os.ErrNotExist) {
+					if err := seedFake(roots.Mount, parent); err != nil {
+						return -1, err
+					}
+				}
+			}
+			if err := ensureDelegatedControllers(parent, []string{"cpu", "cpuset", "memory", "io", "pids"}); err != nil {
+				return -1, err
+			}
+		}
+	}
+
 	// Create the job cgroup dir.
 	if err := os.MkdirAll(m.cgPath, 0o755); err != nil {
 		return -1, fmt.Errorf("mkdir %s: %w", m.cgPath, err)
@@ -74,6 +120,10 @@ func (m *CgroupManager) Create(jobID string, limits []string) (int, error) {
 		return -1, err
 	}
 
+	if roots.Fake {
+		return -1, nil
+	}
+
 	// Open FD on the job cgroup directory for UseCgroupFD.
 	fd, err := syscall.Open(m.cgPath, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
 	if err != nil {
@@ -200,7 +250,7 @@ func applyLimits(cgPath string, limits []string) error {
 		}
 
 		switch k {
-		case "cpu.max", "memory.max", "io.max":
+		case "cpu.max", "memory.max", "memory.swap.max", "io.max", "io.weight", "cpuset.cpus", "cpuset.mems", "pids.max":
 		default:
 			return fmt.Errorf("unsupported cgroup limit key %q", k)
 		}
@@ -208,12 +258,12 @@ func applyLimits(cgPath string, limits []string) error {
 		path := filepath.Join(cgPath, k)
 
 		// Make missing controller files an explicit, helpful error.
-		if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(path); err != nil && !roots.Fake {
 			if errors.Is(err, os.ErrNotExist) {
 				return fmt.Errorf(
 					"cgroup file %s does not exist (controller not delegated?). "+
 						"Ensure %s has controllers enabled in cgroup.subtree_control",
-					path, jobCgroupRoot,
+					path, roots.JobRoot(),
 				)
 			}
 			return fmt.Errorf("stat %s: %w", path, err)
@@ -234,8 +284,17 @@ func cgroupEmpty(procsPath string) (bool, error) {
 	return strings.TrimSpace(string(b)) == "", nil
 }
 
-func (m *CgroupManager) Snapshot() (*Snapshot, error) {
-	s := &Snapshot{Path: m.cgPath, CPUStat: map[string]uint64{}}
+// Procs lists the processes in the cgroup. A removed cgroup has none.
+func (m *CgroupManager) Procs() ([]int, error) {
+	procs, err := readProcs(filepath.Join(m.cgPath, "cgroup.procs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return procs, err
+}
+
+func (m *CgroupManager) Snapshot() (*cg.Snapshot, error) {
+	s := &cg.Snapshot{Path: m.cgPath, CPUStat: map[string]uint64{}, MemoryEvents: map[string]uint64{}}
 
 	// Membership
 	if v, err := readInt(filepath.Join(m.cgPath, "pids.current")); err == nil {
@@ -244,11 +303,15 @@ func (m *CgroupManager) Snapshot() (*Snapshot, error) {
 	if procs, err := readProcs(filepath.Join(m.cgPath, "cgroup.procs")); err == nil {
 		s.Procs = procs
 	}
+	if ev, err := readKeyVals(filepath.Join(m.cgPath, "pids.events")); err == nil {
+		s.PidsEvents = ev
+	}
 
 	// Limits (read back exactly what kernel sees)
 	s.CPUMax, _ = readTrim(filepath.Join(m.cgPath, "cpu.max"))
 	s.MemoryMax, _ = readTrim(filepath.Join(m.cgPath, "memory.max"))
 	s.IOMax, _ = readTrim(filepath.Join(m.cgPath, "io.max"))
+	s.PidsMax, _ = readTrim(filepath.Join(m.cgPath, "pids.max"))
 
 	// Usage
 	if v, err := readUint64(filepath.Join(m.cgPath, "memory.current")); err == nil {
@@ -257,6 +320,10 @@ func (m *CgroupManager) Snapshot() (*Snapshot, error) {
 	if st, err := readKeyVals(filepath.Join(m.cgPath, "cpu.stat")); err == nil {
 		s.CPUStat = st
 	}
+	if ev, err := readKeyVals(filepath.Join(m.cgPath, "memory.events")); err == nil {
+		s.MemoryEvents = ev
+	}
+	s.IOReadBytes, s.IOWriteBytes, _ = readIOStat(filepath.Join(m.cgPath, "io.stat"))
 
 	// If the cgroup doesn’t have controllers enabled, these files won’t exist.
 	// Snapshot should still succeed and return partial data.
@@ -311,6 +378,31 @@ func readProcs(p string) ([]int, error) {
 	return out, nil
 }
 
+// readIOStat sums rbytes and wbytes over io.stat's per-device lines
+// ("8:0 rbytes=1 wbytes=2 rios=3 ...").
+func readIOStat(p string) (read, write uint64, err error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		for _, f := range strings.Fields(line) {
+			k, v, _ := strings.Cut(f, "=")
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch k {
+			case "rbytes":
+				read += n
+			case "wbytes":
+				write += n
+			}
+		}
+	}
+	return read, write, nil
+}
+
 func readKeyVals(p string) (map[string]uint64, error) {
 	b, err := os.ReadFile(p)
 	if err != nil {
@@ -0,0 +1,100 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// delegateDir is the subtree a server that drops root owns.
+const delegateDir = "jobworker"
+
+// delegateFiles are what cgroup v2 delegation hands over besides the
+// directory itself (Documentation/admin-guide/cgroup-v2.rst, "Delegation").
+var delegateFiles = []string{"cgroup.procs", "cgroup.threads", "cgroup.subtree_control"}
+
+// Delegated is r laid out for a server that will give up root: job
+// cgroups go in <Mount>/jobworker/jobs, next to the server's own
+// <Mount>/jobworker/server.
+func Delegated(r Roots) Roots {
+	r.Jobs = filepath.Join(r.Mount, delegateDir, "jobs")
+	return r
+}
+
+// Delegate prepares Delegated(r) for uid:gid, as systemd's Delegate=yes
+// would: it enables the controllers down to the job root, moves this
+// process into the server cgroup, and hands all of the subtree to uid:gid.
+// The kernel only lets a process place another into a cgroup if it may
+// write cgroup.procs of both cgroups' common ancestor, so the server has
+// to live inside the subtree it owns. It must run as root, before
+// privileges are dropped; the caller then Configures the returned Roots.
+func Delegate(r Roots, uid, gid int) (Roots, error) {
+	r = Delegated(r)
+	base := filepath.Dir(r.Jobs)
+	server := filepath.Join(base, "server")
+	for _, dir := range []string{base, server, r.Jobs} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return r, fmt.Errorf("mkdir %s: %w", dir, err)
+		}
+	}
+
+	if r.Fake {
+		if err := seedFake(r.Mount, base, server, r.Jobs); err != nil {
+			return r, err
+		}
+	} else {
+		want := []string{"cpu", "cpuset", "memory", "io", "pids"}
+		for _, dir := range []string{r.Mount, base} {
+			if err := ensureDelegatedControllers(dir, want); err != nil {
+				return r, err
+			}
+		}
+		procs := filepath.Join(server, "cgroup.procs")
+		if err := os.WriteFile(procs, []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+			return r, fmt.Errorf("move server into %s: %w", server, err)
+		}
+		// Only now, with base free of processes, can the job root get
+		// controllers of its own.
+		if err := ensureDelegatedControllers(r.Jobs, want); err != nil {
+			return r, err
+		}
+	}
+
+	for _, dir := range []string{base, server, r.Jobs} {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return r, fmt.Errorf("chown %s: %w", dir, err)
+		}
+		for _, f := range delegateFiles {
+			p := filepath.Join(dir, f)
+			if err := os.Chown(p, uid, gid); err != nil {
+				return r, fmt.Errorf("chown %s: %w", p, err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// seedFake gives dirs the interface files cgroupfs would create, with the
+// controllers the fake mount offers.
+func seedFake(mount string, dirs ...string) error {
+	ctrl, err := os.ReadFile(filepath.Join(mount, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.controllers"), ctrl, 0o444); err != nil {
+			return err
+		}
+		for _, f := range delegateFiles {
+			p := filepath.Join(dir, f)
+			if _, err := os.Stat(p); err == nil {
+				continue
+			}
+			if err := os.WriteFile(p, nil, 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
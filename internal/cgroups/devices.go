@@ -0,0 +1,135 @@
+package cgroups
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// NvidiaMajor is the character-device major of /dev/nvidia*,
+// /dev/nvidiactl and /dev/nvidia-modeset.
+const NvidiaMajor = 195
+
+// Minors of the control nodes every CUDA process needs regardless of which
+// GPUs it was given.
+const (
+	nvidiaCtlMinor     = 255
+	nvidiaModesetMinor = 254
+)
+
+// bpf_cgroup_dev_ctx field offsets (include/uapi/linux/bpf.h).
+const (
+	devCtxMajorOff = 4
+	devCtxMinorOff = 8
+)
+
+// RestrictGPUs confines the cgroup behind cgroupFD to the given NVIDIA GPU
+// minors: /dev/nvidiaN for any other N is denied, every other device
+// (including nvidiactl/modeset/uvm) is left alone. cgroup v2 has no
+// devices.allow file, so this attaches a BPF_PROG_TYPE_CGROUP_DEVICE filter.
+// It must be called before the job's process is placed in the cgroup.
+func RestrictGPUs(cgroupFD int, allowMinors []uint32) error {
+	prog := gpuFilterProgram(allowMinors)
+
+	license := []byte("GPL\x00")
+	load := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(prog) / bpfInsnSize),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFD, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&load)), unsafe.Sizeof(load))
+	if errno != 0 {
+		return fmt.Errorf("load device filter: %w", errno)
+	}
+	// The cgroup keeps its own reference once attached.
+	defer unix.Close(int(progFD))
+
+	attach := bpfProgAttachAttr{
+		targetFD:    uint32(cgroupFD),
+		attachBPFFD: uint32(progFD),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI, // compose with any filter systemd put on a parent
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); errno != 0 {
+		return fmt.Errorf("attach device filter: %w", errno)
+	}
+	return nil
+}
+
+// gpuFilterProgram assembles:
+//
+//	if major != 195                        return 1
+//	if minor in {255, 254, allowMinors...} return 1
+//	return 0
+func gpuFilterProgram(allowMinors []uint32) []byte {
+	minors := append([]uint32{nvidiaCtlMinor, nvidiaModesetMinor}, allowMinors...)
+
+	var insns [][bpfInsnSize]byte
+	emit := func(op, regs uint8, off int16, imm int32) {
+		var in [bpfInsnSize]byte
+		in[0] = op
+		in[1] = regs
+		binary.LittleEndian.PutUint16(in[2:], uint16(off))
+		binary.LittleEndian.PutUint32(in[4:], uint32(imm))
+		insns = append(insns, in)
+	}
+	const (
+		ldxW   = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+		jeqImm = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jneImm = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+		movImm = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+		exit   = unix.BPF_JMP | unix.BPF_EXIT
+
+		r0, r1, r2, r3 uint8 = 0, 1, 2, 3
+	)
+
+	// Layout: 0 ldx major; 1 jne -> allow; 2 ldx minor; 3..3+n jeq -> allow;
+	// deny: mov r0,0; exit; allow: mov r0,1; exit.
+	n := len(minors)
+	allow := 3 + n + 2
+	emit(ldxW, src(r1)|r2, devCtxMajorOff, 0)
+	emit(jneImm, r2, int16(allow-2), NvidiaMajor)
+	emit(ldxW, src(r1)|r3, devCtxMinorOff, 0)
+	for i, m := range minors {
+		pc := 3 + i
+		emit(jeqImm, r3, int16(allow-(pc+1)), int32(m))
+	}
+	emit(movImm, r0, 0, 0)
+	emit(exit, 0, 0, 0)
+	emit(movImm, r0, 0, 1)
+	emit(exit, 0, 0, 0)
+
+	out := make([]byte, 0, len(insns)*bpfInsnSize)
+	for _, in := range insns {
+		out = append(out, in[:]...)
+	}
+	return out
+}
+
+// src encodes r as the source register (high nibble of the regs byte).
+func src(r uint8) uint8 { return r << 4 }
+
+const bpfInsnSize = 8
+
+// Prefixes of union bpf_attr; the kernel zero-extends shorter structs.
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfProgAttachAttr struct {
+	targetFD    uint32
+	attachBPFFD uint32
+	attachType  uint32
+	attachFlags uint32
+}
@@ -0,0 +1,12 @@
+package cgroups
+
+import cg "github.com/bucknercd/jobworker/pkg/cgroups"
+
+var (
+	_ cg.Manager  = (*CgroupManager)(nil)
+	_ cg.Attacher = (*systemdScope)(nil)
+)
+
+// V2 is the default Driver: a cgroup v2 directory under the configured
+// Roots.
+func V2(jobID string) cg.Manager { return NewCgroupManager(jobID) }
@@ -0,0 +1,264 @@
+package cgroups
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/dbus"
+	"github.com/bucknercd/jobworker/internal/limits"
+	cg "github.com/bucknercd/jobworker/pkg/cgroups"
+)
+
+// DefaultSystemdSlice holds the scopes made by the systemd driver.
+const DefaultSystemdSlice = "jobworker.slice"
+
+const (
+	systemdDest  = "org.freedesktop.systemd1"
+	systemdPath  = dbus.ObjectPath("/org/freedesktop/systemd1")
+	systemdIface = "org.freedesktop.systemd1.Manager"
+
+	systemdTimeout = 5 * time.Second
+)
+
+// Systemd returns a Driver that runs each job in a transient scope,
+// jobworker-<id>.scope under slice, created over D-Bus. systemd owns the
+// cgroup and applies the limits as unit properties, so nothing else writes
+// to a hierarchy it manages. It fails if systemd isn't reachable.
+//
+// A scope can only be made around a running process, so the job starts
+// in the server's cgroup and is moved within milliseconds; anything it
+// forks before then stays behind.
+func Systemd(slice string) (cg.Driver, error) {
+	if !strings.HasSuffix(slice, ".slice") || strings.Contains(slice, "/") {
+		return nil, fmt.Errorf("invalid slice %q (want e.g. %s)", slice, DefaultSystemdSlice)
+	}
+	conn, err := dbus.DialSystem(systemdTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to system bus: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Call(systemdDest, systemdPath, "org.freedesktop.DBus.Peer", "Ping", ""); err != nil {
+		return nil, fmt.Errorf("systemd not reachable over D-Bus: %w", err)
+	}
+	dir := slicePath(slice)
+	return func(jobID string) cg.Manager {
+		unit := "jobworker-" + strings.ReplaceAll(jobID, "/", "-") + ".scope" // scopes don't nest
+		return &systemdScope{
+			CgroupManager: &CgroupManager{cgPath: filepath.Join(dir, unit)},
+			slice:         slice,
+			unit:          unit,
+		}
+	}, nil
+}
+
+// slicePath is where systemd puts slice's cgroup: "a-b.slice" nests
+// inside "a.slice".
+func slicePath(slice string) string {
+	dir := roots.Mount
+	parts := strings.Split(strings.TrimSuffix(slice, ".slice"), "-")
+	for i := range parts {
+		dir = filepath.Join(dir, strings.Join(parts[:i+1], "-")+".slice")
+	}
+	return dir
+}
+
+// systemdScope reads its cgroup like any other; only creation and removal
+// go through systemd.
+type systemdScope struct {
+	*CgroupManager
+	slice string
+	unit  string
+	props []any // unit properties from the limits, set by Create
+
+	attached bool // StartTransientUnit was tried, so there may be a unit
+}
+
+func (s *systemdScope) Create(jobID string, limits []string) (int, error) {
+	props, err := systemdProperties(limits)
+	if err != nil {
+		return -1, err
+	}
+	s.props = props
+	return -1, nil
+}
+
+func (s *systemdScope) Attach(pid int) error {
+	props := append([]any{
+		prop("Description", "s", "jobworker job "+strings.TrimSuffix(strings.TrimPrefix(s.unit, "jobworker-"), ".scope")),
+		prop("Slice", "s", s.slice),
+		prop("PIDs", "au", []any{uint32(pid)}),
+		prop("CollectMode", "s", "inactive-or-failed"),
+	}, s.props...)
+
+	conn, err := dbus.DialSystem(systemdTimeout)
+	if err != nil {
+		return fmt.Errorf("connect to system bus: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(systemdTimeout))
+	s.attached = true
+	if _, err := conn.Call(systemdDest, systemdPath, systemdIface, "StartTransientUnit",
+		"ssa(sv)a(sa(sv))", s.unit, "fail", props, []any{}); err != nil {
+		if zombie(pid) {
+			return nil // already exited: nothing left to confine
+		}
+		return fmt.Errorf("start scope %s: %w", s.unit, err)
+	}
+
+	// The unit starts asynchronously; the job is confined once systemd has
+	// moved it.
+	deadline := time.Now().Add(systemdTimeout)
+	for {
+		procs, _ := s.Procs()
+		if slices.Contains(procs, pid) || zombie(pid) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("scope %s: pid %d not moved into %s after %s", s.unit, pid, s.Path(), systemdTimeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Delete kills the scope's processes and stops it. systemd collects the
+// unit and its cgroup; a scope that is already gone is fine.
+func (s *systemdScope) Delete(jobID string) error {
+	if !s.attached {
+		return nil
+	}
+	conn, err := dbus.DialSystem(systemdTimeout)
+	if err != nil {
+		return fmt.Errorf("connect to system bus: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(systemdTimeout))
+
+	for _, call := range []struct {
+		member, sig string
+		args        []any
+	}{
+		{"KillUnit", "ssi", []any{s.unit, "all", int32(syscall.SIGKILL)}},
+		{"StopUnit", "ss", []any{s.unit, "replace"}},
+	} {
+		_, err := conn.Call(systemdDest, systemdPath, systemdIface, call.member, call.sig, call.args...)
+		if err != nil && !dbus.IsError(err, "org.freedesktop.systemd1.NoSuchUnit") {
+			return fmt.Errorf("%s %s: %w", call.member, s.unit, err)
+		}
+	}
+	return nil
+}
+
+func prop(name, sig string, v any) []any {
+	return []any{name, dbus.Variant{Sig: sig, Value: v}}
+}
+
+// systemdProperties turns cgroup "file=value" writes into the unit
+// properties systemd applies them from.
+func systemdProperties(writes []string) ([]any, error) {
+	var props []any
+	ioProps := map[string][]any{} // property -> a(st) entries
+	for _, raw := range writes {
+		k, v, ok := strings.Cut(strings.TrimSpace(raw), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid limit format %q (expected key=value)", raw)
+		}
+		bad := func(err error) error { return fmt.Errorf("limit %q for systemd: %v", raw, err) }
+		switch k {
+		case "cpu.max":
+			quota, period, _ := strings.Cut(v, " ")
+			p, err := strconv.ParseUint(period, 10, 64)
+			if err != nil || p == 0 {
+				return nil, bad(fmt.Errorf("period %q", period))
+			}
+			perSec := uint64(math.MaxUint64)
+			if quota != "max" {
+				q, err := strconv.ParseUint(quota, 10, 64)
+				if err != nil {
+					return nil, bad(err)
+				}
+				perSec = q * 1_000_000 / p
+			}
+			props = append(props, prop("CPUQuotaPerSecUSec", "t", perSec), prop("CPUQuotaPeriodUSec", "t", p))
+		case "memory.max", "memory.swap.max", "pids.max":
+			n, err := maxOrUint(v)
+			if err != nil {
+				return nil, bad(err)
+			}
+			name := map[string]string{"memory.max": "MemoryMax", "memory.swap.max": "MemorySwapMax", "pids.max": "TasksMax"}[k]
+			props = append(props, prop(name, "t", n))
+		case "io.weight":
+			w, err := strconv.ParseUint(strings.TrimPrefix(v, "default "), 10, 64)
+			if err != nil {
+				return nil, bad(err)
+			}
+			props = append(props, prop("IOWeight", "t", w))
+		case "io.max":
+			dev, rates, _ := strings.Cut(v, " ")
+			for _, r := range strings.Fields(rates) {
+				key, val, _ := strings.Cut(r, "=")
+				n, err := strconv.ParseUint(val, 10, 64)
+				name, known := map[string]string{
+					"rbps": "IOReadBandwidthMax", "wbps": "IOWriteBandwidthMax",
+					"riops": "IOReadIOPSMax", "wiops": "IOWriteIOPSMax",
+				}[key]
+				if err != nil || !known {
+					return nil, bad(fmt.Errorf("rate %q", r))
+				}
+				ioProps[name] = append(ioProps[name], []any{"/dev/block/" + dev, n})
+			}
+		case "cpuset.cpus", "cpuset.mems":
+			set, err := limits.ParseCPUSet(v)
+			if err != nil {
+				return nil, bad(err)
+			}
+			name := map[string]string{"cpuset.cpus": "AllowedCPUs", "cpuset.mems": "AllowedMemoryNodes"}[k]
+			props = append(props, prop(name, "ay", cpuMask(set)))
+		default:
+			return nil, fmt.Errorf("unsupported cgroup limit key %q", k)
+		}
+	}
+	for _, name := range []string{"IOReadBandwidthMax", "IOWriteBandwidthMax", "IOReadIOPSMax", "IOWriteIOPSMax"} {
+		if len(ioProps[name]) > 0 {
+			props = append(props, prop(name, "a(st)", ioProps[name]))
+		}
+	}
+	return props, nil
+}
+
+func maxOrUint(v string) (uint64, error) {
+	if v == "max" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// cpuMask is set as systemd's byte-array bitmask: bit i%8 of byte i/8.
+func cpuMask(set limits.CPUSet) []byte {
+	if len(set) == 0 {
+		return nil
+	}
+	mask := make([]byte, set[len(set)-1]/8+1)
+	for _, id := range set {
+		mask[id/8] |= 1 << (id % 8)
+	}
+	return mask
+}
+
+// zombie reports whether pid has exited but not been reaped.
+func zombie(pid int) bool {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name, which may itself
+	// contain ") ".
+	i := strings.LastIndexByte(string(b), ')')
+	return i < 0 || i+2 >= len(b) || b[i+2] == 'Z'
+}
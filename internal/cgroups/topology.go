@@ -0,0 +1,40 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Topology reports the CPUs and memory nodes jobs may be pinned to, in
+// list format ("0-7"). It prefers what the jobs cgroup can actually hand
+// out, falling back to what the host has online.
+func Topology() (cpus, mems string, err error) {
+	if cpus, err = firstReadable(
+		filepath.Join(roots.JobRoot(), "cpuset.cpus.effective"),
+		filepath.Join(roots.Mount, "cpuset.cpus.effective"),
+		"/sys/devices/system/cpu/online",
+	); err != nil {
+		return "", "", err
+	}
+	// Hosts without NUMA have no node directory: node 0 is all there is.
+	if mems, err = firstReadable(
+		filepath.Join(roots.JobRoot(), "cpuset.mems.effective"),
+		filepath.Join(roots.Mount, "cpuset.mems.effective"),
+		"/sys/devices/system/node/online",
+	); err != nil {
+		mems, err = "0", nil
+	}
+	return cpus, mems, nil
+}
+
+func firstReadable(paths ...string) (string, error) {
+	var err error
+	for _, p := range paths {
+		var b []byte
+		if b, err = os.ReadFile(p); err == nil && strings.TrimSpace(string(b)) != "" {
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"time"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// AgentConfig describes how an agent advertises itself to the coordinator.
+type AgentConfig struct {
+	Node    string
+	Address string            // advertised host:port of this agent's JobWorker listener
+	Labels  map[string]string // e.g. arch=arm64, gpu=true
+}
+
+// Load is what an agent reports about itself on each heartbeat. It is read
+// fresh every time, so runtime changes (drain, a new job cap) propagate.
+type Load struct {
+	Running  int
+	MaxJobs  int // 0 = unlimited
+	Draining bool
+}
+
+// RunAgent registers with the coordinator and keeps re-registering at the
+// interval the coordinator asks for, reporting current load from load.
+// It returns when ctx is done.
+func RunAgent(ctx context.Context, logger *log.Logger, coord jobpb.CoordinatorClient, cfg AgentConfig, load func() Load) {
+	interval := HeartbeatInterval
+	registered := false
+	for {
+		l := load()
+		rctx, cancel := context.WithTimeout(ctx, interval)
+		resp, err := coord.RegisterAgent(rctx, &jobpb.RegisterAgentRequest{
+			Agent: &jobpb.AgentInfo{
+				Node:        cfg.Node,
+				Address:     cfg.Address,
+				MaxJobs:     int32(l.MaxJobs),
+				RunningJobs: int32(l.Running),
+				Labels:      cfg.Labels,
+				Draining:    l.Draining,
+			},
+		})
+		cancel()
+
+		switch {
+		case err != nil:
+			if registered {
+				logger.Printf("[agent] heartbeat to coordinator failed: %v", err)
+			} else {
+				logger.Printf("[agent] register with coordinator failed: %v", err)
+			}
+			registered = false
+		case !registered:
+			logger.Printf("[agent] registered as node %q (%s) labels=%s", cfg.Node, cfg.Address, FormatLabels(cfg.Labels))
+			registered = true
+		}
+		if err == nil && resp.GetHeartbeatIntervalSeconds() > 0 {
+			interval = time.Duration(resp.GetHeartbeatIntervalSeconds()) * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// HeartbeatInterval is how often agents are asked to re-register.
+	HeartbeatInterval = 5 * time.Second
+	// agentTTL is how long an agent stays schedulable without a heartbeat.
+	agentTTL = 3 * HeartbeatInterval
+)
+
+var (
+	ErrNoCapacity = errors.New("no live agent with free capacity")
+	// ErrNoMatchingNode means no live agent carries the requested labels,
+	// regardless of capacity.
+	ErrNoMatchingNode = errors.New("no live agent satisfies the node selector")
+)
+
+// Agent is the coordinator's view of one registered node.
+type Agent struct {
+	Node        string
+	Address     string
+	MaxJobs     int // 0 = unlimited
+	RunningJobs int
+	Labels      map[string]string
+	Draining    bool // takes no new jobs
+	LastSeen    time.Time
+}
+
+func (a Agent) free() int {
+	if a.Draining {
+		return 0
+	}
+	if a.MaxJobs <= 0 {
+		return int(^uint(0) >> 1)
+	}
+	return a.MaxJobs - a.RunningJobs
+}
+
+// Registry tracks live agents from their heartbeats.
+type Registry struct {
+	mu     sync.Mutex
+	agents map[string]*Agent
+	now    func() time.Time
+}
+
+func NewRegistry() *Registry {
+	return &Registry{agents: make(map[string]*Agent), now: time.Now}
+}
+
+// Register records (or refreshes) an agent.
+func (r *Registry) Register(a Agent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a.LastSeen = r.now()
+	r.agents[a.Node] = &a
+}
+
+// Get returns a live agent by node name.
+func (r *Registry) Get(node string) (Agent, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[node]
+	if !ok || r.expired(a) {
+		return Agent{}, false
+	}
+	return *a, true
+}
+
+// Live returns all agents that have heartbeated recently, sorted by name.
+func (r *Registry) Live() []Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Agent, 0, len(r.agents))
+	for name, a := range r.agents {
+		if r.expired(a) {
+			delete(r.agents, name)
+			continue
+		}
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Node < out[j].Node })
+	return out
+}
+
+// Pick chooses, among live agents whose labels satisfy selector, the one with
+// the most free capacity and optimistically counts the new job against it
+// until its next heartbeat. Ties go to the lexicographically smallest node
+// name so placement is deterministic.
+func (r *Registry) Pick(selector map[string]string) (Agent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var best *Agent
+	matched := false
+	for _, a := range r.agents {
+		if r.expired(a) || !Matches(a.Labels, selector) {
+			continue
+		}
+		matched = true
+		if a.free() <= 0 {
+			continue
+		}
+		if best == nil || a.free() > best.free() || (a.free() == best.free() && a.Node < best.Node) {
+			best = a
+		}
+	}
+	if !matched {
+		return Agent{}, ErrNoMatchingNode
+	}
+	if best == nil {
+		return Agent{}, ErrNoCapacity
+	}
+	best.RunningJobs++
+	return *best, nil
+}
+
+func (r *Registry) expired(a *Agent) bool {
+	return r.now().Sub(a.LastSeen) > agentTTL
+}
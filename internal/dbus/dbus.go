@@ -0,0 +1,623 @@
+// Package dbus is a minimal D-Bus client: EXTERNAL auth over a unix socket
+// and blocking method calls. It covers what the systemd cgroup driver
+// needs and nothing more; signals are read and dropped.
+package dbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SystemBus is the system bus socket unless DBUS_SYSTEM_BUS_ADDRESS says
+// otherwise.
+const SystemBus = "/run/dbus/system_bus_socket"
+
+// ObjectPath is a D-Bus object path ("o"), e.g. /org/freedesktop/systemd1.
+type ObjectPath string
+
+// Variant is a value with its signature ("v").
+type Variant struct {
+	Sig   string
+	Value any
+}
+
+// Error is an error reply.
+type Error struct {
+	Name    string // e.g. org.freedesktop.systemd1.NoSuchUnit
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// IsError reports whether err is an error reply named name.
+func IsError(err error, name string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Name == name
+}
+
+const (
+	msgMethodCall   = 1
+	msgMethodReturn = 2
+	msgError        = 3
+
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSignature   = 8
+
+	// maxMessage bounds what we'll read for one message (the spec's limit).
+	maxMessage = 128 << 20
+)
+
+// Conn is a connection to a bus. Calls are serialized.
+type Conn struct {
+	mu     sync.Mutex
+	c      net.Conn
+	r      *bufio.Reader
+	serial uint32
+}
+
+// DialSystem connects to the system bus and says Hello.
+func DialSystem(timeout time.Duration) (*Conn, error) {
+	path := SystemBus
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); addr != "" {
+		p, ok := strings.CutPrefix(addr, "unix:path=")
+		if !ok {
+			return nil, fmt.Errorf("unsupported bus address %q (only unix:path=)", addr)
+		}
+		path, _, _ = strings.Cut(p, ",")
+	}
+	return Dial(path, timeout)
+}
+
+// Dial connects to the bus listening on the unix socket at path.
+func Dial(path string, timeout time.Duration) (*Conn, error) {
+	c, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{c: c, r: bufio.NewReader(c)}
+	if timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := conn.auth(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("dbus auth: %w", err)
+	}
+	if _, err := conn.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("dbus hello: %w", err)
+	}
+	_ = c.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (c *Conn) Close() error { return c.c.Close() }
+
+// SetDeadline bounds the calls that follow.
+func (c *Conn) SetDeadline(t time.Time) error { return c.c.SetDeadline(t) }
+
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.c.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("rejected: %s", strings.TrimSpace(line))
+	}
+	_, err = c.c.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// Call invokes member and returns the reply body, whose values are decoded
+// as: y byte, b bool, u uint32, t uint64, i int32, x int64, s string,
+// o ObjectPath, g string, v Variant, a(...) []any, ay []byte, (...) []any.
+// args are encoded per sig using the same types.
+func (c *Conn) Call(dest string, path ObjectPath, iface, member, sig string, args ...any) ([]any, error) {
+	body := &encoder{}
+	rest := sig
+	for _, a := range args {
+		var t string
+		var err error
+		if t, rest, err = nextType(rest); err != nil {
+			return nil, err
+		}
+		if err := body.value(t, a); err != nil {
+			return nil, fmt.Errorf("%s arg %q: %w", member, t, err)
+		}
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("%s: %d args for signature %q", member, len(args), sig)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serial++
+	serial := c.serial
+
+	fields := []any{
+		[]any{byte(fieldPath), Variant{"o", path}},
+		[]any{byte(fieldMember), Variant{"s", member}},
+		[]any{byte(fieldDestination), Variant{"s", dest}},
+	}
+	if iface != "" {
+		fields = append(fields, []any{byte(fieldInterface), Variant{"s", iface}})
+	}
+	if sig != "" {
+		fields = append(fields, []any{byte(fieldSignature), Variant{"g", sig}})
+	}
+	hdr := &encoder{}
+	hdr.buf.Write([]byte{'l', msgMethodCall, 0, 1})
+	hdr.u32(uint32(len(body.buf.Bytes())))
+	hdr.u32(serial)
+	if err := hdr.value("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	hdr.align(8)
+	if _, err := c.c.Write(append(hdr.buf.Bytes(), body.buf.Bytes()...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if m.replySerial != serial || (m.typ != msgMethodReturn && m.typ != msgError) {
+			continue // signals, or replies to calls that timed out
+		}
+		vals, err := decodeBody(m)
+		if err != nil {
+			return nil, err
+		}
+		if m.typ == msgError {
+			e := &Error{Name: m.errorName}
+			if len(vals) > 0 {
+				e.Message, _ = vals[0].(string)
+			}
+			return nil, e
+		}
+		return vals, nil
+	}
+}
+
+type message struct {
+	order       binary.ByteOrder
+	typ         byte
+	replySerial uint32
+	errorName   string
+	sig         string
+	body        []byte
+}
+
+func (c *Conn) read() (*message, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(c.r, fixed[:]); err != nil {
+		return nil, err
+	}
+	m := &message{typ: fixed[1]}
+	switch fixed[0] {
+	case 'l':
+		m.order = binary.LittleEndian
+	case 'B':
+		m.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad endianness byte %q", fixed[0])
+	}
+	bodyLen := m.order.Uint32(fixed[4:])
+	fieldsLen := m.order.Uint32(fixed[12:])
+	hdrLen := 16 + int(fieldsLen)
+	padded := (hdrLen + 7) &^ 7
+	if uint64(padded)+uint64(bodyLen) > maxMessage {
+		return nil, fmt.Errorf("message too large")
+	}
+	rest := make([]byte, padded-16+int(bodyLen))
+	if _, err := io.ReadFull(c.r, rest); err != nil {
+		return nil, err
+	}
+	raw := append(fixed[:], rest...)
+	m.body = raw[padded:]
+
+	d := &decoder{buf: raw[:hdrLen], pos: 12, order: m.order}
+	v, err := d.value("a(yv)")
+	if err != nil {
+		return nil, fmt.Errorf("header fields: %w", err)
+	}
+	for _, f := range v.([]any) {
+		st := f.([]any)
+		val := st[1].(Variant).Value
+		switch st[0].(byte) {
+		case fieldReplySerial:
+			m.replySerial, _ = val.(uint32)
+		case fieldErrorName:
+			m.errorName, _ = val.(string)
+		case fieldSignature:
+			m.sig, _ = val.(string)
+		}
+	}
+	return m, nil
+}
+
+func decodeBody(m *message) ([]any, error) {
+	d := &decoder{buf: m.body, order: m.order}
+	var out []any
+	for rest := m.sig; rest != ""; {
+		var t string
+		var err error
+		if t, rest, err = nextType(rest); err != nil {
+			return nil, err
+		}
+		v, err := d.value(t)
+		if err != nil {
+			return nil, fmt.Errorf("reply %q: %w", m.sig, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// nextType splits the first complete type off sig.
+func nextType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errors.New("signature too short")
+	}
+	switch sig[0] {
+	case 'a':
+		t, rest, err := nextType(sig[1:])
+		return "a" + t, rest, err
+	case '(', '{':
+		closing := map[byte]byte{'(': ')', '{': '}'}[sig[0]]
+		depth := 0
+		for i := 0; i < len(sig); i++ {
+			switch sig[i] {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+			}
+			if depth == 0 {
+				if sig[i] != closing {
+					break
+				}
+				return sig[:i+1], sig[i+1:], nil
+			}
+		}
+		return "", "", fmt.Errorf("unbalanced signature %q", sig)
+	}
+	return sig[:1], sig[1:], nil
+}
+
+// alignment is the D-Bus alignment of a type's first byte.
+func alignment(t byte) int {
+	switch t {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 's', 'o', 'a', 'h':
+		return 4
+	}
+	return 8 // x t d ( {
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) align(n int) {
+	for e.buf.Len()%n != 0 {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) u32(v uint32) {
+	e.align(4)
+	_ = binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+func (e *encoder) str(s string) {
+	e.u32(uint32(len(s)))
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func (e *encoder) value(t string, v any) error {
+	bad := func() error { return fmt.Errorf("can't encode %T as %q", v, t) }
+	switch t[0] {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return bad()
+		}
+		e.buf.WriteByte(b)
+	case 'b':
+		b, ok := v.(bool)
+		if !ok {
+			return bad()
+		}
+		var u uint32
+		if b {
+			u = 1
+		}
+		e.u32(u)
+	case 'u':
+		u, ok := v.(uint32)
+		if !ok {
+			return bad()
+		}
+		e.u32(u)
+	case 'i':
+		i, ok := v.(int32)
+		if !ok {
+			return bad()
+		}
+		e.u32(uint32(i))
+	case 't', 'x':
+		var u uint64
+		switch n := v.(type) {
+		case uint64:
+			u = n
+		case int64:
+			u = uint64(n)
+		default:
+			return bad()
+		}
+		e.align(8)
+		_ = binary.Write(&e.buf, binary.LittleEndian, u)
+	case 's':
+		s, ok := v.(string)
+		if !ok {
+			return bad()
+		}
+		e.str(s)
+	case 'o':
+		p, ok := v.(ObjectPath)
+		if !ok {
+			return bad()
+		}
+		e.str(string(p))
+	case 'g':
+		s, ok := v.(string)
+		if !ok || len(s) > 255 {
+			return bad()
+		}
+		e.buf.WriteByte(byte(len(s)))
+		e.buf.WriteString(s)
+		e.buf.WriteByte(0)
+	case 'v':
+		vr, ok := v.(Variant)
+		if !ok {
+			return bad()
+		}
+		if err := e.value("g", vr.Sig); err != nil {
+			return err
+		}
+		return e.value(vr.Sig, vr.Value)
+	case 'a':
+		elem := t[1:]
+		e.u32(0)
+		lenAt := e.buf.Len() - 4
+		e.align(alignment(elem[0]))
+		start := e.buf.Len()
+		if b, ok := v.([]byte); ok && elem == "y" {
+			e.buf.Write(b)
+		} else {
+			items, ok := v.([]any)
+			if !ok {
+				return bad()
+			}
+			for _, it := range items {
+				if err := e.value(elem, it); err != nil {
+					return err
+				}
+			}
+		}
+		binary.LittleEndian.PutUint32(e.buf.Bytes()[lenAt:], uint32(e.buf.Len()-start))
+	case '(', '{':
+		fields, ok := v.([]any)
+		if !ok {
+			return bad()
+		}
+		e.align(8)
+		rest := t[1 : len(t)-1]
+		for _, f := range fields {
+			var ft string
+			var err error
+			if ft, rest, err = nextType(rest); err != nil {
+				return err
+			}
+			if err := e.value(ft, f); err != nil {
+				return err
+			}
+		}
+		if rest != "" {
+			return bad()
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", t)
+	}
+	return nil
+}
+
+type decoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errShort = errors.New("message truncated")
+
+func (d *decoder) align(n int) error {
+	d.pos = (d.pos + n - 1) &^ (n - 1)
+	if d.pos > len(d.buf) {
+		return errShort
+	}
+	return nil
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) u32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) str(lenBytes int) (string, error) {
+	var n int
+	if lenBytes == 1 {
+		b, err := d.take(1)
+		if err != nil {
+			return "", err
+		}
+		n = int(b[0])
+	} else {
+		u, err := d.u32()
+		if err != nil {
+			return "", err
+		}
+		n = int(u)
+	}
+	b, err := d.take(n + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
+
+func (d *decoder) value(t string) (any, error) {
+	switch t[0] {
+	case 'y':
+		b, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'n', 'q':
+		if err := d.align(2); err != nil {
+			return nil, err
+		}
+		b, err := d.take(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint16(b), nil
+	case 'b':
+		u, err := d.u32()
+		return u != 0, err
+	case 'u', 'h':
+		return d.u32()
+	case 'i':
+		u, err := d.u32()
+		return int32(u), err
+	case 't', 'x', 'd':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		if t[0] == 'x' {
+			return int64(d.order.Uint64(b)), nil
+		}
+		return d.order.Uint64(b), nil
+	case 's':
+		return d.str(4)
+	case 'o':
+		s, err := d.str(4)
+		return ObjectPath(s), err
+	case 'g':
+		return d.str(1)
+	case 'v':
+		sig, err := d.str(1)
+		if err != nil {
+			return nil, err
+		}
+		if sig == "" {
+			return nil, errors.New("empty variant signature")
+		}
+		v, err := d.value(sig)
+		return Variant{Sig: sig, Value: v}, err
+	case 'a':
+		n, err := d.u32()
+		if err != nil {
+			return nil, err
+		}
+		elem := t[1:]
+		if err := d.align(alignment(elem[0])); err != nil {
+			return nil, err
+		}
+		end := d.pos + int(n)
+		if end > len(d.buf) {
+			return nil, errShort
+		}
+		if elem == "y" {
+			b, _ := d.take(int(n))
+			return append([]byte(nil), b...), nil
+		}
+		items := []any{}
+		for d.pos < end {
+			v, err := d.value(elem)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case '(', '{':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		var fields []any
+		for rest := t[1 : len(t)-1]; rest != ""; {
+			var ft string
+			var err error
+			if ft, rest, err = nextType(rest); err != nil {
+				return nil, err
+			}
+			v, err := d.value(ft)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, v)
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q", t)
+}
@@ -0,0 +1,95 @@
+package events
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Event types emitted over a job's lifetime.
+const (
+	TypeJobStarted       = "job.started"
+	TypeJobStartFailed   = "job.start_failed"
+	TypeJobStopRequested = "job.stop_requested"
+	TypeJobFinished      = "job.finished"
+	TypeJobStalled       = "job.stalled"
+	TypeJobRestarted     = "job.restarted"
+)
+
+// Event is one job lifecycle transition, serialized as JSON by the sinks.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	JobID    string    `json:"job_id"`
+	Status   string    `json:"status,omitempty"`
+	ExitCode int32     `json:"exit_code"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// Sink delivers events to an external system. Publish may block on I/O;
+// callers that can't afford that should go through a Bus.
+type Sink interface {
+	Publish(Event) error
+	Close() error
+}
+
+const busBuffer = 1024
+
+// Bus fans events out to a set of sinks on a background goroutine so that
+// slow or unreachable sinks never stall job lifecycle handling. When the
+// buffer is full, events are dropped (and logged) rather than blocking.
+type Bus struct {
+	logger *log.Logger
+	sinks  []Sink
+	ch     chan Event
+	done   chan struct{}
+}
+
+func NewBus(logger *log.Logger, sinks ...Sink) *Bus {
+	b := &Bus{
+		logger: logger,
+		sinks:  sinks,
+		ch:     make(chan Event, busBuffer),
+		done:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Emit queues ev for delivery. A zero Time is filled in with time.Now().
+func (b *Bus) Emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	select {
+	case b.ch <- ev:
+	default:
+		b.logger.Printf("[events] buffer full, dropping %s for job %s", ev.Type, ev.JobID)
+	}
+}
+
+func (b *Bus) run() {
+	defer close(b.done)
+	for ev := range b.ch {
+		for _, s := range b.sinks {
+			if err := s.Publish(ev); err != nil {
+				b.logger.Printf("[events] %T publish %s for job %s: %v", s, ev.Type, ev.JobID, err)
+			}
+		}
+	}
+}
+
+// Close drains queued events and closes every sink. Emit must not be called
+// after Close.
+func (b *Bus) Close() error {
+	close(b.ch)
+	<-b.done
+
+	var errs []error
+	for _, s := range b.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+// NATSSink publishes events to a NATS subject using the core text protocol
+// (CONNECT/PUB/PING/PONG). It keeps one connection open and redials lazily
+// on the next publish after a failure. No JetStream, auth, or TLS support.
+type NATSSink struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewNATSSink parses a URL of the form nats://host:port/subject.
+func NewNATSSink(rawURL string) (*NATSSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse nats url: %w", err)
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("nats url must look like nats://host:port/subject, got %q", rawURL)
+	}
+	subject := strings.TrimPrefix(u.Path, "/")
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid nats subject %q", subject)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &NATSSink{addr: addr, subject: subject}, nil
+}
+
+func (s *NATSSink) Publish(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", s.subject, len(b), b)
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("nats publish: %w", err)
+	}
+	return nil
+}
+
+// dial connects and performs the handshake. Caller holds s.mu.
+func (s *NATSSink) dial() error {
+	conn, err := net.DialTimeout("tcp", s.addr, natsDialTimeout)
+	if err != nil {
+		return fmt.Errorf("nats dial %s: %w", s.addr, err)
+	}
+	r := bufio.NewReader(conn)
+
+	// Server speaks first with INFO {...}.
+	_ = conn.SetReadDeadline(time.Now().Add(natsDialTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats handshake with %s: unexpected greeting %q: %v", s.addr, strings.TrimSpace(line), err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"jobworker-server\"}\r\n")); err != nil {
+		conn.Close()
+		return fmt.Errorf("nats connect: %w", err)
+	}
+
+	s.conn = conn
+	go s.readLoop(conn, r)
+	return nil
+}
+
+// readLoop answers server PINGs so the connection isn't dropped as stale,
+// and tears the connection down on -ERR or read failure.
+func (s *NATSSink) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || strings.HasPrefix(line, "-ERR") {
+			break
+		}
+		if strings.HasPrefix(line, "PING") {
+			s.mu.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			s.mu.Unlock()
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
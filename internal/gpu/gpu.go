@@ -0,0 +1,202 @@
+// Package gpu discovers NVIDIA GPUs on the host and hands them out to jobs
+// exclusively: a device assigned to one job is not given to another until
+// that job releases it.
+package gpu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// procGPUs is where the NVIDIA kernel driver publishes one directory per GPU
+// (named by PCI bus id) with an "information" file.
+const procGPUs = "/proc/driver/nvidia/gpus"
+
+var (
+	// ErrUnavailable means the request is valid but not enough devices are
+	// free right now.
+	ErrUnavailable = errors.New("not enough free GPUs")
+	// ErrUnknownDevice means a requested UUID isn't on this host.
+	ErrUnknownDevice = errors.New("unknown GPU")
+)
+
+// Device is one GPU; Minor is N in /dev/nvidiaN.
+type Device struct {
+	UUID  string
+	Minor uint32
+}
+
+// Discover lists the host's NVIDIA GPUs ordered by device minor. A host
+// without the driver yields no devices and no error.
+func Discover() ([]Device, error) {
+	entries, err := os.ReadDir(procGPUs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var devs []Device
+	for _, e := range entries {
+		d, err := readInformation(filepath.Join(procGPUs, e.Name(), "information"))
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, d)
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Minor < devs[j].Minor })
+	return devs, nil
+}
+
+func readInformation(path string) (Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Device{}, err
+	}
+	defer f.Close()
+
+	var d Device
+	haveMinor := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "GPU UUID":
+			d.UUID = v
+		case "Device Minor":
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return Device{}, fmt.Errorf("%s: bad device minor %q", path, v)
+			}
+			d.Minor = uint32(n)
+			haveMinor = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return Device{}, err
+	}
+	if d.UUID == "" || !haveMinor {
+		return Device{}, fmt.Errorf("%s: missing GPU UUID or Device Minor", path)
+	}
+	return d, nil
+}
+
+// Allocator tracks which job holds which device.
+type Allocator struct {
+	mu      sync.Mutex
+	devices []Device
+	owner   map[string]string // uuid -> job id
+}
+
+func NewAllocator(devices []Device) *Allocator {
+	return &Allocator{devices: devices, owner: make(map[string]string)}
+}
+
+// Devices returns every device managed by the allocator.
+func (a *Allocator) Devices() []Device {
+	return append([]Device(nil), a.devices...)
+}
+
+// Acquire assigns devices to jobID: the named uuids if any are given,
+// otherwise the first count free devices.
+func (a *Allocator) Acquire(jobID string, count int, uuids []string) ([]Device, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	picked, err := a.pick(count, uuids)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range picked {
+		a.owner[d.UUID] = jobID
+	}
+	return picked, nil
+}
+
+// Check reports whether Acquire would currently succeed, without reserving.
+func (a *Allocator) Check(count int, uuids []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.pick(count, uuids)
+	return err
+}
+
+func (a *Allocator) pick(count int, uuids []string) ([]Device, error) {
+	var picked []Device
+	if len(uuids) > 0 {
+		byUUID := make(map[string]Device, len(a.devices))
+		for _, d := range a.devices {
+			byUUID[d.UUID] = d
+		}
+		for _, u := range uuids {
+			d, ok := byUUID[u]
+			if !ok {
+				return nil, fmt.Errorf("%w %q", ErrUnknownDevice, u)
+			}
+			if _, busy := a.owner[u]; busy {
+				return nil, fmt.Errorf("%w: %s is assigned to another job", ErrUnavailable, u)
+			}
+			picked = append(picked, d)
+		}
+		return picked, nil
+	}
+
+	for _, d := range a.devices {
+		if len(picked) == count {
+			break
+		}
+		if _, busy := a.owner[d.UUID]; !busy {
+			picked = append(picked, d)
+		}
+	}
+	if len(picked) < count {
+		return nil, fmt.Errorf("%w: want %d, %d free of %d", ErrUnavailable, count, len(picked), len(a.devices))
+	}
+	return picked, nil
+}
+
+// Release frees every device held by jobID.
+func (a *Allocator) Release(jobID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for u, owner := range a.owner {
+		if owner == jobID {
+			delete(a.owner, u)
+		}
+	}
+}
+
+// Env returns the variables that point CUDA and the NVIDIA container
+// tooling at exactly devs (by UUID, so numbering can't drift).
+func Env(devs []Device) []string {
+	ids := make([]string, len(devs))
+	for i, d := range devs {
+		ids[i] = d.UUID
+	}
+	v := strings.Join(ids, ",")
+	if v == "" {
+		v = "void"
+	}
+	return []string{"NVIDIA_VISIBLE_DEVICES=" + v, "CUDA_VISIBLE_DEVICES=" + strings.Join(ids, ",")}
+}
+
+// Minors returns the device minors of devs.
+func Minors(devs []Device) []uint32 {
+	out := make([]uint32, len(devs))
+	for i, d := range devs {
+		out[i] = d.Minor
+	}
+	return out
+}
@@ -0,0 +1,723 @@
+// Package limits parses the resource limits of a StartJobRequest (cpu,
+// memory, swap, io, cpuset, pids, and per-process rlimits) into typed
+// values and renders them as cgroup v2 writes and setrlimit values. The server and jobctl share it, so a
+// limit jobctl accepts is one the server accepts.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Unlimited is the spelling of "no limit" for cpu and memory; the empty
+// string means the same.
+const Unlimited = "max"
+
+// cpuPeriodUsec is the cpu.max period; quotas are scaled to it.
+const cpuPeriodUsec = 100000
+
+// minCPU is the smallest limit the kernel takes: a 1ms quota per period.
+// maxCPU keeps the quota in an int64.
+const (
+	minCPU CPU = 10
+	maxCPU CPU = math.MaxInt64 / (cpuPeriodUsec / 1000)
+)
+
+// CPU is a CPU limit in millicores (1000 = one core). Zero is unlimited.
+type CPU int64
+
+// ParseCPU accepts millicores ("250m"), cores with up to three decimals
+// ("2", "1.5"), or "max". The smallest limit is 10m.
+func ParseCPU(s string) (CPU, error) {
+	if s == "" || s == Unlimited {
+		return 0, nil
+	}
+	c, err := parseCPU(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpu %q: %v", s, err)
+	}
+	if c > maxCPU {
+		return 0, fmt.Errorf("invalid cpu %q: too large", s)
+	}
+	if c < minCPU {
+		return 0, fmt.Errorf("invalid cpu %q: below the minimum of %s", s, minCPU)
+	}
+	return c, nil
+}
+
+func parseCPU(s string) (CPU, error) {
+	const want = "want cores like 1.5, millicores like 250m, or max"
+	if m, ok := strings.CutSuffix(s, "m"); ok {
+		n, err := parseDigits(m)
+		if err != nil {
+			return 0, errors.New(want)
+		}
+		return CPU(n), nil
+	}
+
+	whole, frac, dot := strings.Cut(s, ".")
+	cores, err := parseDigits(whole)
+	if err != nil {
+		return 0, errors.New(want)
+	}
+	var millis int64
+	if dot {
+		if len(frac) > 3 {
+			return 0, errors.New("finer than 1m (0.001 cores)")
+		}
+		if millis, err = parseDigits(frac + strings.Repeat("0", 3-len(frac))); err != nil || frac == "" {
+			return 0, errors.New(want)
+		}
+	}
+	if cores > (math.MaxInt64-millis)/1000 {
+		return 0, errors.New("too large")
+	}
+	return CPU(cores*1000 + millis), nil
+}
+
+func (c CPU) Millis() int64 { return int64(c) }
+
+// String formats c so that ParseCPU gives it back: whole cores as "2",
+// anything else as millicores.
+func (c CPU) String() string {
+	switch {
+	case c == 0:
+		return Unlimited
+	case c%1000 == 0:
+		return strconv.FormatInt(int64(c)/1000, 10)
+	default:
+		return strconv.FormatInt(int64(c), 10) + "m"
+	}
+}
+
+// CgroupMax is the cpu.max value: a quota per 100ms period.
+func (c CPU) CgroupMax() string {
+	if c == 0 {
+		return Unlimited + " " + strconv.Itoa(cpuPeriodUsec)
+	}
+	return fmt.Sprintf("%d %d", int64(c)*cpuPeriodUsec/1000, cpuPeriodUsec)
+}
+
+// Memory is a memory limit in bytes. Zero is unlimited.
+type Memory int64
+
+// memoryUnits are binary multiples. "M" and "Mi" both mean 2^20: cgroup
+// limits are page-based, and jobctl has always read "100M" that way.
+var memoryUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"Ti", 1 << 40}, {"Gi", 1 << 30}, {"Mi", 1 << 20}, {"Ki", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+}
+
+// ParseMemory accepts a byte count with an optional K, M, G or T suffix,
+// with or without "i" and in either case ("512M", "2Gi", "64k"), or "max".
+func ParseMemory(s string) (Memory, error) {
+	if s == "" || s == Unlimited {
+		return 0, nil
+	}
+	num, mult := s, int64(1)
+	for _, u := range memoryUnits {
+		if len(s) > len(u.suffix) && strings.EqualFold(s[len(s)-len(u.suffix):], u.suffix) {
+			num, mult = s[:len(s)-len(u.suffix)], u.mult
+			break
+		}
+	}
+	n, err := parseDigits(num)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory %q: want bytes with an optional K, M, G or T suffix (e.g. 512M, 2Gi), or max", s)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("invalid memory %q: must be positive", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid memory %q: too large", s)
+	}
+	return Memory(n * mult), nil
+}
+
+func (m Memory) Bytes() int64 { return int64(m) }
+
+// String formats m with the largest suffix that divides it exactly, so
+// ParseMemory gives it back.
+func (m Memory) String() string {
+	if m == 0 {
+		return Unlimited
+	}
+	for _, u := range memoryUnits[4:] {
+		if int64(m)%u.mult == 0 {
+			return strconv.FormatInt(int64(m)/u.mult, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(m), 10)
+}
+
+// CgroupMax is the memory.max value.
+func (m Memory) CgroupMax() string {
+	if m == 0 {
+		return Unlimited
+	}
+	return strconv.FormatInt(int64(m), 10)
+}
+
+// Swap is a memory.swap.max limit in bytes. Zero leaves swap unlimited;
+// SwapDisabled keeps the job out of swap entirely.
+type Swap int64
+
+const SwapDisabled Swap = -1
+
+// ParseSwap accepts what ParseMemory does, plus "0" to disable swap.
+func ParseSwap(s string) (Swap, error) {
+	if s == "0" {
+		return SwapDisabled, nil
+	}
+	m, err := ParseMemory(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid swap %q: want 0, bytes with an optional K, M, G or T suffix, or max", s)
+	}
+	return Swap(m), nil
+}
+
+// String formats s so that ParseSwap gives it back.
+func (s Swap) String() string {
+	if s == SwapDisabled {
+		return "0"
+	}
+	return Memory(s).String()
+}
+
+// CgroupMax is the memory.swap.max value.
+func (s Swap) CgroupMax() string {
+	if s == SwapDisabled {
+		return "0"
+	}
+	return Memory(s).CgroupMax()
+}
+
+// IOClass is a coarse I/O priority: a preset io.weight and, below high,
+// an io.max cap on the disk holding job output.
+type IOClass int
+
+const (
+	IODefault IOClass = iota // no io_class: the kernel default weight
+	IOLow
+	IOMed
+	IOHigh
+)
+
+// ParseIOClass accepts "low", "med" (or "medium"), "high", or "".
+func ParseIOClass(s string) (IOClass, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return IODefault, nil
+	case "low":
+		return IOLow, nil
+	case "med", "medium":
+		return IOMed, nil
+	case "high":
+		return IOHigh, nil
+	}
+	return 0, fmt.Errorf("invalid io class %q: want low, med or high", s)
+}
+
+func (c IOClass) String() string {
+	switch c {
+	case IOLow:
+		return "low"
+	case IOMed:
+		return "med"
+	case IOHigh:
+		return "high"
+	}
+	return ""
+}
+
+// Weight is the io.weight for c (1-10000, kernel default 100), or 0 for
+// IODefault.
+func (c IOClass) Weight() int {
+	switch c {
+	case IOLow:
+		return 25
+	case IOMed:
+		return 100
+	case IOHigh:
+		return 400
+	}
+	return 0
+}
+
+// Spec holds the limit strings of a request, as ResourceLimits or jobctl
+// flags carry them. Empty fields are unset.
+type Spec struct {
+	CPU     string
+	Memory  string
+	Swap    string
+	IOClass string
+	// IOMax are explicit per-device caps; they override the io class
+	// preset where both set a rate on the same disk.
+	IOMax []IOMax
+	// CPUs and Mems pin the job (cpuset.cpus, cpuset.mems), in list
+	// format.
+	CPUs string
+	Mems string
+	// PIDs is the pids.max limit, a count or "max".
+	PIDs string
+	// NoFile and NProc are RLIMIT_NOFILE and RLIMIT_NPROC, counts or
+	// "max"; Core and FSize are RLIMIT_CORE and RLIMIT_FSIZE, sizes as
+	// ParseMemory takes them, "0", or "max".
+	NoFile string
+	NProc  string
+	Core   string
+	FSize  string
+}
+
+// Preset is the io.max cap for c on the output disk; empty for IODefault
+// and IOHigh.
+func (c IOClass) Preset() IOMax {
+	switch c {
+	case IOLow:
+		return IOMax{RBps: 10 << 20, WBps: 10 << 20, RIOPS: 500, WIOPS: 500}
+	case IOMed:
+		return IOMax{RBps: 50 << 20, WBps: 50 << 20, RIOPS: 2000, WIOPS: 2000}
+	}
+	return IOMax{}
+}
+
+// IOMax caps a job's I/O on one device. Device is "MAJ:MIN", a block
+// device, or a path on the disk meant; empty means the disk holding job
+// output. Zero rates are unlimited.
+type IOMax struct {
+	Device       string
+	RBps, WBps   uint64 // bytes per second
+	RIOPS, WIOPS uint64
+}
+
+func (m IOMax) empty() bool {
+	return m.RBps == 0 && m.WBps == 0 && m.RIOPS == 0 && m.WIOPS == 0
+}
+
+// over returns m with the rates set in o taking precedence.
+func (m IOMax) over(o IOMax) IOMax {
+	for _, f := range []struct{ dst, src *uint64 }{
+		{&m.RBps, &o.RBps}, {&m.WBps, &o.WBps}, {&m.RIOPS, &o.RIOPS}, {&m.WIOPS, &o.WIOPS},
+	} {
+		if *f.src != 0 {
+			*f.dst = *f.src
+		}
+	}
+	return m
+}
+
+// rates is the io.max line after the device, e.g. "rbps=1048576 wiops=100".
+func (m IOMax) rates() string {
+	var parts []string
+	for _, f := range []struct {
+		key string
+		v   uint64
+	}{{"rbps", m.RBps}, {"wbps", m.WBps}, {"riops", m.RIOPS}, {"wiops", m.WIOPS}} {
+		if f.v != 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", f.key, f.v))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// String formats m so that ParseIOMax gives it back.
+func (m IOMax) String() string {
+	var parts []string
+	if m.Device != "" {
+		parts = append(parts, "device="+m.Device)
+	}
+	for _, f := range []struct {
+		key string
+		v   uint64
+	}{{"rbps", m.RBps}, {"wbps", m.WBps}} {
+		if f.v != 0 {
+			parts = append(parts, f.key+"="+Memory(f.v).String())
+		}
+	}
+	for _, f := range []struct {
+		key string
+		v   uint64
+	}{{"riops", m.RIOPS}, {"wiops", m.WIOPS}} {
+		if f.v != 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", f.key, f.v))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseIOMax parses "device=/dev/sdb,rbps=50M,wbps=20M,riops=1000,wiops=500".
+// Byte rates take memory suffixes; device may be omitted. At least one
+// rate is required.
+func ParseIOMax(s string) (IOMax, error) {
+	var m IOMax
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || v == "" {
+			return IOMax{}, fmt.Errorf("invalid io.max %q: want key=value, got %q", s, pair)
+		}
+		var err error
+		switch k {
+		case "device":
+			m.Device = v
+		case "rbps", "wbps":
+			var b Memory
+			if b, err = ParseMemory(v); err == nil && b == 0 {
+				err = errors.New("use a rate, not max")
+			}
+			if k == "rbps" {
+				m.RBps = uint64(b)
+			} else {
+				m.WBps = uint64(b)
+			}
+		case "riops", "wiops":
+			var n int64
+			if n, err = parseDigits(v); err == nil && n == 0 {
+				err = errors.New("must be positive")
+			}
+			if k == "riops" {
+				m.RIOPS = uint64(n)
+			} else {
+				m.WIOPS = uint64(n)
+			}
+		default:
+			err = errors.New("unknown key (want device, rbps, wbps, riops or wiops)")
+		}
+		if err != nil {
+			return IOMax{}, fmt.Errorf("invalid io.max %q: %s: %v", s, k, err)
+		}
+	}
+	if err := m.validate(); err != nil {
+		return IOMax{}, fmt.Errorf("invalid io.max %q: %v", s, err)
+	}
+	return m, nil
+}
+
+func (m IOMax) validate() error {
+	if m.empty() {
+		return errors.New("set at least one of rbps, wbps, riops or wiops")
+	}
+	if m.Device != "" && strings.ContainsAny(m.Device, " \n") {
+		return fmt.Errorf("invalid device %q", m.Device)
+	}
+	return nil
+}
+
+// PIDs is a pids.max limit: how many processes and threads the job may
+// have at once. Zero is unset (the server default applies);
+// PIDsUnlimited lifts the limit.
+type PIDs int64
+
+const PIDsUnlimited PIDs = -1
+
+// ParsePIDs accepts a positive count or "max".
+func ParsePIDs(s string) (PIDs, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case Unlimited:
+		return PIDsUnlimited, nil
+	}
+	n, err := parseDigits(s)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid pids limit %q: want a positive count or max", s)
+	}
+	return PIDs(n), nil
+}
+
+// String formats p so that ParsePIDs gives it back.
+func (p PIDs) String() string {
+	switch p {
+	case 0:
+		return ""
+	case PIDsUnlimited:
+		return Unlimited
+	}
+	return strconv.FormatInt(int64(p), 10)
+}
+
+// Rlimit is a per-process limit (setrlimit(2)) on the job's main process,
+// which its children inherit. Zero is unset, leaving the server's own
+// limit; RlimitZero is a limit of 0 and RlimitUnlimited lifts the limit.
+type Rlimit int64
+
+const (
+	RlimitUnlimited Rlimit = -1
+	RlimitZero      Rlimit = -2
+)
+
+// ParseRlimitCount accepts a count, including 0, or "max".
+func ParseRlimitCount(s string) (Rlimit, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case Unlimited:
+		return RlimitUnlimited, nil
+	}
+	n, err := parseDigits(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q: want a count or max", s)
+	}
+	if n == 0 {
+		return RlimitZero, nil
+	}
+	return Rlimit(n), nil
+}
+
+// ParseRlimitSize accepts what ParseMemory does, plus "0".
+func ParseRlimitSize(s string) (Rlimit, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "0":
+		return RlimitZero, nil
+	case Unlimited:
+		return RlimitUnlimited, nil
+	}
+	m, err := ParseMemory(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: want 0, bytes with an optional K, M, G or T suffix, or max", s)
+	}
+	return Rlimit(m), nil
+}
+
+// Value is the setrlimit value of r, and whether r is set at all.
+func (r Rlimit) Value() (uint64, bool) {
+	switch r {
+	case 0:
+		return 0, false
+	case RlimitZero:
+		return 0, true
+	case RlimitUnlimited:
+		return math.MaxUint64, true // RLIM_INFINITY
+	}
+	return uint64(r), true
+}
+
+// Rlimits are the per-process limits of a job.
+type Rlimits struct {
+	NoFile Rlimit // open files
+	NProc  Rlimit // processes of the job's user, counting other jobs run as that user
+	Core   Rlimit // core file size, bytes
+	FSize  Rlimit // size of any file the job writes, bytes
+}
+
+// maxCPUSetID bounds ids in a cpu list, so "0-4000000000" can't allocate
+// a huge set.
+const maxCPUSetID = 1 << 16
+
+// CPUSet is a set of CPU or memory-node ids, sorted and without
+// duplicates. Nil means no pinning.
+type CPUSet []int
+
+// ParseCPUSet parses the kernel's list format: "0-3,8,10-11".
+func ParseCPUSet(s string) (CPUSet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		a, err := parseDigits(lo)
+		b := a
+		if err == nil && isRange {
+			b, err = parseDigits(hi)
+		}
+		if err != nil || b < a || b >= maxCPUSetID {
+			return nil, fmt.Errorf("invalid cpu list %q: bad entry %q (want e.g. 0-3,8)", s, part)
+		}
+		for i := a; i <= b; i++ {
+			seen[int(i)] = true
+		}
+	}
+	set := make(CPUSet, 0, len(seen))
+	for id := range seen {
+		set = append(set, id)
+	}
+	sort.Ints(set)
+	return set, nil
+}
+
+// String formats c in list format with ranges collapsed, so ParseCPUSet
+// gives it back.
+func (c CPUSet) String() string {
+	var parts []string
+	for i := 0; i < len(c); {
+		j := i
+		for j+1 < len(c) && c[j+1] == c[j]+1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.Itoa(c[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", c[i], c[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// Missing returns the ids in c that aren't in of.
+func (c CPUSet) Missing(of CPUSet) CPUSet {
+	have := make(map[int]bool, len(of))
+	for _, id := range of {
+		have[id] = true
+	}
+	var out CPUSet
+	for _, id := range c {
+		if !have[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// Limits is a parsed set of job limits.
+type Limits struct {
+	CPU    CPU
+	Memory Memory
+	Swap   Swap
+	IO     IOClass
+	IOMax  []IOMax
+	CPUs   CPUSet
+	Mems   CPUSet
+	PIDs   PIDs
+
+	Rlimits Rlimits
+}
+
+// Parse parses every limit in s.
+func Parse(s Spec) (Limits, error) {
+	var l Limits
+	var err error
+	if l.CPU, err = ParseCPU(s.CPU); err != nil {
+		return Limits{}, err
+	}
+	if l.Memory, err = ParseMemory(s.Memory); err != nil {
+		return Limits{}, err
+	}
+	if l.Swap, err = ParseSwap(s.Swap); err != nil {
+		return Limits{}, err
+	}
+	if l.IO, err = ParseIOClass(s.IOClass); err != nil {
+		return Limits{}, err
+	}
+	for _, m := range s.IOMax {
+		if err := m.validate(); err != nil {
+			return Limits{}, fmt.Errorf("invalid io.max for device %q: %v", m.Device, err)
+		}
+	}
+	l.IOMax = s.IOMax
+	if l.CPUs, err = ParseCPUSet(s.CPUs); err != nil {
+		return Limits{}, fmt.Errorf("cpuset cpus: %v", err)
+	}
+	if l.Mems, err = ParseCPUSet(s.Mems); err != nil {
+		return Limits{}, fmt.Errorf("cpuset mems: %v", err)
+	}
+	if l.PIDs, err = ParsePIDs(s.PIDs); err != nil {
+		return Limits{}, err
+	}
+	if l.Rlimits.NoFile, err = ParseRlimitCount(s.NoFile); err != nil {
+		return Limits{}, fmt.Errorf("nofile: %v", err)
+	}
+	if l.Rlimits.NProc, err = ParseRlimitCount(s.NProc); err != nil {
+		return Limits{}, fmt.Errorf("nproc: %v", err)
+	}
+	if l.Rlimits.Core, err = ParseRlimitSize(s.Core); err != nil {
+		return Limits{}, fmt.Errorf("core: %v", err)
+	}
+	if l.Rlimits.FSize, err = ParseRlimitSize(s.FSize); err != nil {
+		return Limits{}, fmt.Errorf("fsize: %v", err)
+	}
+	return l, nil
+}
+
+// Cgroup renders l as "file=value" writes for the job's cgroup, omitting
+// anything left unlimited. resolve turns an IOMax device (or "" for the
+// output disk) into "MAJ:MIN".
+func (l Limits) Cgroup(resolve func(device string) (string, error)) ([]string, error) {
+	var out []string
+	if l.CPU != 0 {
+		out = append(out, "cpu.max="+l.CPU.CgroupMax())
+	}
+	if l.Memory != 0 {
+		out = append(out, "memory.max="+l.Memory.CgroupMax())
+	}
+	if l.Swap != 0 {
+		out = append(out, "memory.swap.max="+l.Swap.CgroupMax())
+	}
+	if w := l.IO.Weight(); w != 0 {
+		out = append(out, fmt.Sprintf("io.weight=default %d", w))
+	}
+	if len(l.CPUs) > 0 {
+		out = append(out, "cpuset.cpus="+l.CPUs.String())
+	}
+	if len(l.Mems) > 0 {
+		out = append(out, "cpuset.mems="+l.Mems.String())
+	}
+	if l.PIDs != 0 {
+		out = append(out, "pids.max="+l.PIDs.String())
+	}
+
+	caps, err := l.ioCaps(resolve)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range caps {
+		out = append(out, "io.max="+m.Device+" "+m.rates())
+	}
+	return out, nil
+}
+
+// ioCaps resolves the preset and explicit io.max entries to disks and
+// merges them, explicit rates winning.
+func (l Limits) ioCaps(resolve func(string) (string, error)) ([]IOMax, error) {
+	var caps []IOMax
+	index := map[string]int{}     // disk -> position in caps
+	explicit := map[string]bool{} // disk already has an explicit entry
+	add := func(m IOMax, fromSpec bool) error {
+		dev, err := resolve(m.Device)
+		if err != nil {
+			return fmt.Errorf("io.max device %q: %v", m.Device, err)
+		}
+		m.Device = dev
+		i, seen := index[dev]
+		switch {
+		case !seen:
+			index[dev] = len(caps)
+			caps = append(caps, m)
+		case fromSpec && explicit[dev]:
+			return fmt.Errorf("io.max: disk %s listed more than once", dev)
+		default:
+			caps[i] = caps[i].over(m)
+		}
+		explicit[dev] = explicit[dev] || fromSpec
+		return nil
+	}
+	if p := l.IO.Preset(); !p.empty() {
+		if err := add(p, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range l.IOMax {
+		if err := add(m, true); err != nil {
+			return nil, err
+		}
+	}
+	return caps, nil
+}
+
+// parseDigits parses a non-empty run of ASCII digits; unlike ParseInt it
+// rejects signs.
+func parseDigits(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("not a number: %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
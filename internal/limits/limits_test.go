@@ -0,0 +1,310 @@
+package limits
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseCPU(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want CPU
+		err  string // a substring of the error; "" means none
+	}{
+		{in: "", want: 0},
+		{in: "max", want: 0},
+		{in: "250m", want: 250},
+		{in: "10m", want: 10},
+		{in: "2", want: 2000},
+		{in: "1.5", want: 1500},
+		{in: "0.25", want: 250},
+		{in: "0.001", err: "below the minimum"},
+		{in: "9m", err: "below the minimum"},
+		{in: "0", err: "below the minimum"},
+		{in: "1.0005", err: "finer than 1m"},
+		{in: "-1", err: "want cores"},
+		{in: "-250m", err: "want cores"},
+		{in: "+2", err: "want cores"},
+		{in: "1.", err: "want cores"},
+		{in: ".5", err: "want cores"},
+		{in: "2c", err: "want cores"},
+		{in: "250M", err: "want cores"},
+		{in: "lots", err: "want cores"},
+		{in: "9223372036854775807", err: "too large"},
+		{in: "9223372036854775807m", err: "too large"},
+		{in: "99999999999999999999", err: "want cores"},
+	} {
+		got, err := ParseCPU(tc.in)
+		check(t, "ParseCPU", tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParseCPU(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Memory
+		err  string
+	}{
+		{in: "", want: 0},
+		{in: "max", want: 0},
+		{in: "4096", want: 4096},
+		{in: "64k", want: 64 << 10},
+		{in: "64K", want: 64 << 10},
+		{in: "64Ki", want: 64 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "512mi", want: 512 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "2Gi", want: 2 << 30},
+		{in: "1T", want: 1 << 40},
+		{in: "1Ti", want: 1 << 40},
+		{in: "0", err: "must be positive"},
+		{in: "0M", err: "must be positive"},
+		{in: "-1", err: "want bytes"},
+		{in: "-512M", err: "want bytes"},
+		{in: "512MB", err: "want bytes"},
+		{in: "512P", err: "want bytes"},
+		{in: "1.5G", err: "want bytes"},
+		{in: "M", err: "want bytes"},
+		{in: "8388608T", err: "too large"},
+		{in: "9223372036854775808", err: "want bytes"},
+	} {
+		got, err := ParseMemory(tc.in)
+		check(t, "ParseMemory", tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParseMemory(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseSwap(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Swap
+		err  string
+	}{
+		{in: "", want: 0},
+		{in: "max", want: 0},
+		{in: "0", want: SwapDisabled},
+		{in: "1G", want: 1 << 30},
+		{in: "-1", err: "want 0"},
+		{in: "1X", err: "want 0"},
+	} {
+		got, err := ParseSwap(tc.in)
+		check(t, "ParseSwap", tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParseSwap(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParsePIDs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want PIDs
+		err  string
+	}{
+		{in: "", want: 0},
+		{in: "max", want: PIDsUnlimited},
+		{in: "64", want: 64},
+		{in: "0", err: "positive count"},
+		{in: "-5", err: "positive count"},
+		{in: "5k", err: "positive count"},
+		{in: "99999999999999999999", err: "positive count"},
+	} {
+		got, err := ParsePIDs(tc.in)
+		check(t, "ParsePIDs", tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParsePIDs(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseRlimit(t *testing.T) {
+	for _, tc := range []struct {
+		parse func(string) (Rlimit, error)
+		name  string
+		in    string
+		want  Rlimit
+		err   string
+	}{
+		{parse: ParseRlimitCount, name: "count", in: "", want: 0},
+		{parse: ParseRlimitCount, name: "count", in: "0", want: RlimitZero},
+		{parse: ParseRlimitCount, name: "count", in: "1024", want: 1024},
+		{parse: ParseRlimitCount, name: "count", in: "max", want: RlimitUnlimited},
+		{parse: ParseRlimitCount, name: "count", in: "-1", err: "want a count"},
+		{parse: ParseRlimitCount, name: "count", in: "1K", err: "want a count"},
+		{parse: ParseRlimitSize, name: "size", in: "0", want: RlimitZero},
+		{parse: ParseRlimitSize, name: "size", in: "10M", want: 10 << 20},
+		{parse: ParseRlimitSize, name: "size", in: "max", want: RlimitUnlimited},
+		{parse: ParseRlimitSize, name: "size", in: "-10M", err: "want 0"},
+		{parse: ParseRlimitSize, name: "size", in: "10Q", err: "want 0"},
+	} {
+		got, err := tc.parse(tc.in)
+		check(t, "ParseRlimit "+tc.name, tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParseRlimit %s(%q) = %d, want %d", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRlimitValue(t *testing.T) {
+	for _, tc := range []struct {
+		r   Rlimit
+		v   uint64
+		set bool
+	}{
+		{r: 0, v: 0, set: false},
+		{r: RlimitZero, v: 0, set: true},
+		{r: RlimitUnlimited, v: math.MaxUint64, set: true},
+		{r: 4096, v: 4096, set: true},
+	} {
+		if v, set := tc.r.Value(); v != tc.v || set != tc.set {
+			t.Errorf("Rlimit(%d).Value() = %d, %v; want %d, %v", tc.r, v, set, tc.v, tc.set)
+		}
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // String() of the result
+		err  string
+	}{
+		{in: "", want: ""},
+		{in: "3", want: "3"},
+		{in: "0-3,8,10-11", want: "0-3,8,10-11"},
+		{in: "8, 0-3 ,2", want: "0-3,8"},
+		{in: "1,2,3,5", want: "1-3,5"},
+		{in: "3-1", err: "bad entry"},
+		{in: "-1", err: "bad entry"},
+		{in: "0-", err: "bad entry"},
+		{in: "a", err: "bad entry"},
+		{in: "0-65536", err: "bad entry"},
+	} {
+		got, err := ParseCPUSet(tc.in)
+		check(t, "ParseCPUSet", tc.in, err, tc.err)
+		if err == nil && got.String() != tc.want {
+			t.Errorf("ParseCPUSet(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseIOMax(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want IOMax
+		err  string
+	}{
+		{in: "rbps=50M", want: IOMax{RBps: 50 << 20}},
+		{in: "device=/dev/sdb,rbps=50M,wbps=20M,riops=1000,wiops=500",
+			want: IOMax{Device: "/dev/sdb", RBps: 50 << 20, WBps: 20 << 20, RIOPS: 1000, WIOPS: 500}},
+		{in: "device=8:16", err: "at least one"},
+		{in: "rbps=max", err: "use a rate"},
+		{in: "riops=0", err: "must be positive"},
+		{in: "riops=-1", err: "riops"},
+		{in: "wbps=20X", err: "wbps"},
+		{in: "speed=1", err: "unknown key"},
+		{in: "rbps", err: "want key=value"},
+	} {
+		got, err := ParseIOMax(tc.in)
+		check(t, "ParseIOMax", tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParseIOMax(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseIOClass(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want IOClass
+		err  string
+	}{
+		{in: "", want: IODefault},
+		{in: "low", want: IOLow},
+		{in: "MED", want: IOMed},
+		{in: "medium", want: IOMed},
+		{in: "high", want: IOHigh},
+		{in: "urgent", err: "want low, med or high"},
+	} {
+		got, err := ParseIOClass(tc.in)
+		check(t, "ParseIOClass", tc.in, err, tc.err)
+		if err == nil && got != tc.want {
+			t.Errorf("ParseIOClass(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// TestStringRoundTrip checks that each limit's String is what its parser
+// gives back, and is canonical.
+func TestStringRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string // want is String of the parsed in
+		round    func(string) (string, error)
+	}{
+		{in: "250m", want: "250m", round: roundTrip(ParseCPU)},
+		{in: "2", want: "2", round: roundTrip(ParseCPU)},
+		{in: "1.5", want: "1500m", round: roundTrip(ParseCPU)},
+		{in: "2.000", want: "2", round: roundTrip(ParseCPU)},
+		{in: "max", want: "max", round: roundTrip(ParseCPU)},
+		{in: "512Mi", want: "512M", round: roundTrip(ParseMemory)},
+		{in: "1024K", want: "1M", round: roundTrip(ParseMemory)},
+		{in: "1536M", want: "1536M", round: roundTrip(ParseMemory)},
+		{in: "4097", want: "4097", round: roundTrip(ParseMemory)},
+		{in: "2t", want: "2T", round: roundTrip(ParseMemory)},
+		{in: "", want: "max", round: roundTrip(ParseMemory)},
+		{in: "0", want: "0", round: roundTrip(ParseSwap)},
+		{in: "1G", want: "1G", round: roundTrip(ParseSwap)},
+		{in: "max", want: "max", round: roundTrip(ParsePIDs)},
+		{in: "64", want: "64", round: roundTrip(ParsePIDs)},
+		{in: "medium", want: "med", round: roundTrip(ParseIOClass)},
+		{in: "1,2,3,5,7-9", want: "1-3,5,7-9", round: roundTrip(ParseCPUSet)},
+		{in: "riops=10,rbps=1048576,device=8:16", want: "device=8:16,rbps=1M,riops=10", round: roundTrip(ParseIOMax)},
+	} {
+		got, err := tc.round(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: String() = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// roundTrip returns a function that parses s and formats the result,
+// failing unless parsing that gives the same value back.
+func roundTrip[T fmt.Stringer](parse func(string) (T, error)) func(string) (string, error) {
+	return func(s string) (string, error) {
+		v, err := parse(s)
+		if err != nil {
+			return "", err
+		}
+		again, err := parse(v.String())
+		if err != nil {
+			return "", err
+		}
+		if again.String() != v.String() {
+			return "", fmt.Errorf("parsing %q gave %q back", v, again)
+		}
+		return v.String(), nil
+	}
+}
+
+// check fails t unless err is nil when want is "", or else contains want.
+func check(t *testing.T, fn, in string, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("%s(%q): unexpected error %v", fn, in, err)
+	case want != "" && err == nil:
+		t.Errorf("%s(%q): no error, want one containing %q", fn, in, want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Errorf("%s(%q): error %q, want one containing %q", fn, in, err, want)
+	}
+}
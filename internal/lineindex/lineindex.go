@@ -0,0 +1,277 @@
+// Package lineindex finds lines of an append-only file by number without
+// counting every newline before them. Next to the file it keeps a sidecar
+// of checkpoints, the number of newlines in each Interval-byte prefix, so a
+// query reads at most one interval plus whatever was appended since the
+// last checkpoint. The sidecar is built on the first query, extended as the
+// file grows, and reloaded by the next process to ask.
+package lineindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Interval is how many bytes of the file lie between checkpoints: 8 bytes
+// of index per MiB of output.
+const Interval = 1 << 20
+
+// magic starts every sidecar; a file without it is rebuilt.
+const magic = "jwlidx1\n"
+
+// SidecarPath is where the index of the file at path is kept.
+func SidecarPath(path string) string { return path + ".idx" }
+
+// Index is the line index of one append-only file. It is safe for
+// concurrent use.
+type Index struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	counts []uint64 // counts[k]: newlines in the first (k+1)*Interval bytes
+	noSave bool     // the sidecar can't be written; index in memory only
+}
+
+// New returns the index of the file at path. Nothing is read until the
+// first query.
+func New(path string) *Index {
+	return &Index{path: path}
+}
+
+// Lines reports how many lines the file holds, counting a last line
+// without a newline, and its size.
+func (x *Index) Lines(ctx context.Context) (lines, size uint64, err error) {
+	f, counts, size, err := x.open(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	start, seen := last(counts)
+	n, _, endsLine, err := scan(ctx, io.NewSectionReader(f, int64(start), int64(size-start)), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	lines = seen + n
+	if size > 0 && !endsLine {
+		lines++
+	}
+	return lines, size, nil
+}
+
+// Offset returns the byte offset where line n (1-based) starts, or the
+// file's size when it doesn't hold that line yet.
+func (x *Index) Offset(ctx context.Context, n uint64) (uint64, error) {
+	if n <= 1 {
+		return 0, nil
+	}
+	f, counts, size, err := x.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Start after the last checkpoint short of line n's newline.
+	want := n - 1
+	k := sort.Search(len(counts), func(i int) bool { return counts[i] >= want })
+	start, seen := last(counts[:k])
+	found, read, _, err := scan(ctx, io.NewSectionReader(f, int64(start), int64(size-start)), want-seen)
+	if err != nil {
+		return 0, err
+	}
+	if seen+found < want {
+		return size, nil
+	}
+	return start + read, nil
+}
+
+// TailOffset returns the byte offset where the last n lines of the file
+// start: 0 when it holds no more than n.
+func (x *Index) TailOffset(ctx context.Context, n uint64) (uint64, error) {
+	lines, size, err := x.Lines(ctx)
+	if err != nil || n >= lines {
+		return 0, err
+	}
+	if n == 0 {
+		return size, nil
+	}
+	return x.Offset(ctx, lines-n+1)
+}
+
+// open opens the file and brings the checkpoints up to its current size,
+// saving new ones to the sidecar. The checkpoints returned stay valid: the
+// file only grows.
+func (x *Index) open(ctx context.Context) (*os.File, []uint64, uint64, error) {
+	f, err := os.Open(x.path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	size := uint64(fi.Size())
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.loaded {
+		x.load(size)
+		x.loaded = true
+	}
+	have := len(x.counts)
+	for k := have; uint64(k+1)*Interval <= size; k++ {
+		_, seen := last(x.counts)
+		n, _, _, err := scan(ctx, io.NewSectionReader(f, int64(k)*Interval, Interval), 0)
+		if err != nil {
+			x.save(have) // keep what was counted before ctx ended
+			f.Close()
+			return nil, nil, 0, err
+		}
+		x.counts = append(x.counts, seen+n)
+	}
+	x.save(have)
+	return f, x.counts, size, nil
+}
+
+// load reads the sidecar, keeping the checkpoints that fit a file of size.
+// A sidecar that is damaged or from another file is started over.
+func (x *Index) load(size uint64) {
+	b, err := os.ReadFile(SidecarPath(x.path))
+	if err != nil || !bytes.HasPrefix(b, []byte(magic)) {
+		x.reset()
+		return
+	}
+	b = b[len(magic):]
+	n := min(uint64(len(b)/8), size/Interval)
+	var prev uint64
+	for i := range n {
+		c := binary.LittleEndian.Uint64(b[i*8:])
+		if c < prev || c-prev > Interval {
+			x.reset()
+			return
+		}
+		x.counts = append(x.counts, c)
+		prev = c
+	}
+	if uint64(len(b)) != n*8 { // a torn write, or checkpoints past the end
+		x.rewrite()
+	}
+}
+
+// save appends the checkpoints from counts[from] on to the sidecar.
+func (x *Index) save(from int) {
+	if x.noSave || from >= len(x.counts) {
+		return
+	}
+	b := make([]byte, 0, 8*(len(x.counts)-from))
+	for _, c := range x.counts[from:] {
+		b = binary.LittleEndian.AppendUint64(b, c)
+	}
+	f, err := os.OpenFile(SidecarPath(x.path), os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		x.noSave = true
+	}
+}
+
+func (x *Index) reset() {
+	x.counts = nil
+	x.rewrite()
+}
+
+// rewrite replaces the sidecar with the checkpoints held in memory.
+func (x *Index) rewrite() {
+	b := []byte(magic)
+	for _, c := range x.counts {
+		b = binary.LittleEndian.AppendUint64(b, c)
+	}
+	if err := os.WriteFile(SidecarPath(x.path), b, 0o600); err != nil {
+		x.noSave = true
+	}
+}
+
+// last returns where the checkpoints end and how many newlines lie before.
+func last(counts []uint64) (offset, newlines uint64) {
+	if len(counts) == 0 {
+		return 0, 0
+	}
+	return uint64(len(counts)) * Interval, counts[len(counts)-1]
+}
+
+// Count reads r to the end and reports how many lines it held, counting a
+// last line without a newline, and how many bytes. It is the unindexed
+// Lines, for output that can't be indexed.
+func Count(ctx context.Context, r io.Reader) (lines, size uint64, err error) {
+	n, size, endsLine, err := scan(ctx, r, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if size > 0 && !endsLine {
+		n++
+	}
+	return n, size, nil
+}
+
+// Find reads r up to the start of line n (1-based) and returns its byte
+// offset, or how many bytes r held when it ends first. It is the unindexed
+// Offset.
+func Find(ctx context.Context, r io.Reader, n uint64) (uint64, error) {
+	if n <= 1 {
+		return 0, nil
+	}
+	_, read, _, err := scan(ctx, r, n-1)
+	return read, err
+}
+
+const bufSize = 64 << 10
+
+var bufs = sync.Pool{New: func() any { return new([bufSize]byte) }}
+
+// scan counts the newlines in r, stopping just after the want'th when want
+// is above zero. It returns how many it counted, how many bytes it read,
+// and whether the last byte read was a newline.
+func scan(ctx context.Context, r io.Reader, want uint64) (newlines, read uint64, endsLine bool, err error) {
+	buf := bufs.Get().(*[bufSize]byte)
+	defer bufs.Put(buf)
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, false, err
+		}
+		n, err := r.Read(buf[:])
+		b := buf[:n]
+		if c := uint64(bytes.Count(b, []byte{'\n'})); want > 0 && newlines+c >= want {
+			for {
+				i := bytes.IndexByte(b, '\n')
+				read += uint64(i + 1)
+				b = b[i+1:]
+				if newlines++; newlines == want {
+					return newlines, read, true, nil
+				}
+			}
+		} else {
+			newlines += c
+		}
+		read += uint64(n)
+		if n > 0 {
+			endsLine = b[n-1] == '\n'
+		}
+		if errors.Is(err, io.EOF) {
+			return newlines, read, endsLine, nil
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+	}
+}
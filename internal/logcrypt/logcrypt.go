@@ -0,0 +1,213 @@
+package logcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// File layout:
+//
+//	header  = magic (8 bytes)
+//	record  = ciphertext length (uint32, big endian) | nonce (12 bytes) | ciphertext
+//
+// Each Write is sealed as one or more independent AES-256-GCM records of at
+// most maxRecordPlaintext bytes, so a reader can decrypt a file that is
+// still being appended to. The record index is bound in as additional data,
+// which makes dropped or reordered records fail authentication instead of
+// silently producing shuffled output.
+const (
+	KeySize = 32
+
+	maxRecordPlaintext = 64 * 1024
+	recordHeaderSize   = 4
+	nonceSize          = 12
+)
+
+var magic = []byte("JWENC\x00\x00\x01")
+
+var ErrBadKey = errors.New("logcrypt: key must be 32 bytes")
+
+// LoadKeyFile reads an AES-256 key from path. The file may hold either the
+// raw 32 bytes or 64 hex characters (surrounding whitespace is ignored).
+func LoadKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	if len(b) == KeySize {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	if len(s) == 2*KeySize {
+		key, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("decode hex key: %w", err)
+		}
+		return key, nil
+	}
+	return nil, ErrBadKey
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrBadKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(seq uint64) []byte {
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], seq)
+	return ad[:]
+}
+
+// Writer encrypts everything written to it into the chunked record format.
+type Writer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	seq  uint64
+}
+
+// NewWriter writes the file header to w and returns a Writer that seals
+// subsequent writes with key.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(magic); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	return &Writer{w: w, aead: aead}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxRecordPlaintext)
+		if err := w.writeRecord(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *Writer) writeRecord(plain []byte) error {
+	rec := make([]byte, recordHeaderSize+nonceSize, recordHeaderSize+nonceSize+len(plain)+w.aead.Overhead())
+	nonce := rec[recordHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+	rec = w.aead.Seal(rec, nonce, plain, additionalData(w.seq))
+	binary.BigEndian.PutUint32(rec[:recordHeaderSize], uint32(len(rec)-recordHeaderSize-nonceSize))
+
+	// One write per record keeps records whole for concurrent readers.
+	if _, err := w.w.Write(rec); err != nil {
+		return err
+	}
+	w.seq++
+	return nil
+}
+
+// Reader decrypts a stream produced by Writer. When the underlying reader
+// hits EOF in the middle of a record, Read returns io.EOF and keeps the
+// partial bytes, so callers tailing a growing file can simply retry.
+type Reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	seq    uint64
+	header bool
+	raw    []byte
+	plain  []byte
+}
+
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, aead: aead}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		ok, err := r.decodeRecord()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			continue
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// decodeRecord consumes the header and/or one full record from raw if
+// enough bytes are buffered.
+func (r *Reader) decodeRecord() (bool, error) {
+	if !r.header {
+		if len(r.raw) < len(magic) {
+			return false, nil
+		}
+		if string(r.raw[:len(magic)]) != string(magic) {
+			return false, errors.New("logcrypt: not an encrypted log")
+		}
+		r.raw = r.raw[len(magic):]
+		r.header = true
+	}
+	if len(r.raw) < recordHeaderSize+nonceSize {
+		return false, nil
+	}
+	// Writer never seals more than maxRecordPlaintext at once, so a longer
+	// record is corrupt, not one still being written: don't wait to buffer
+	// up to 4 GiB of it.
+	ctLen := int(binary.BigEndian.Uint32(r.raw[:recordHeaderSize]))
+	if ctLen < r.aead.Overhead() || ctLen > maxRecordPlaintext+r.aead.Overhead() {
+		return false, fmt.Errorf("logcrypt: record %d: bad length %d", r.seq, ctLen)
+	}
+	end := recordHeaderSize + nonceSize + ctLen
+	if len(r.raw) < end {
+		return false, nil
+	}
+	nonce := r.raw[recordHeaderSize : recordHeaderSize+nonceSize]
+	plain, err := r.aead.Open(nil, nonce, r.raw[recordHeaderSize+nonceSize:end], additionalData(r.seq))
+	if err != nil {
+		return false, fmt.Errorf("logcrypt: record %d: %w", r.seq, err)
+	}
+	r.raw = r.raw[end:]
+	r.seq++
+	r.plain = plain
+	return true, nil
+}
+
+func (r *Reader) fill() error {
+	buf := make([]byte, 32*1024)
+	n, err := r.r.Read(buf)
+	r.raw = append(r.raw, buf[:n]...)
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		return io.ErrNoProgress
+	}
+	return err
+}
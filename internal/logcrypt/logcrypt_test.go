@@ -0,0 +1,184 @@
+package logcrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, KeySize)
+
+// seal encrypts each of writes as it would be written to a log file.
+func seal(t *testing.T, writes ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range writes {
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func open(t *testing.T, file []byte) ([]byte, error) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(file), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return io.ReadAll(r)
+}
+
+// records splits a sealed file into its header and records.
+func records(t *testing.T, file []byte) (header []byte, recs [][]byte) {
+	t.Helper()
+	header, rest := file[:len(magic)], file[len(magic):]
+	for len(rest) > 0 {
+		n := recordHeaderSize + nonceSize + int(binary.BigEndian.Uint32(rest))
+		recs = append(recs, rest[:n])
+		rest = rest[n:]
+	}
+	return header, recs
+}
+
+func TestRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), maxRecordPlaintext/8) // two records
+	for _, tc := range []struct {
+		name   string
+		writes [][]byte
+	}{
+		{"empty", nil},
+		{"one write", [][]byte{[]byte("hello\n")}},
+		{"several writes", [][]byte{[]byte("a\n"), []byte("b"), []byte("c\n")}},
+		{"write over the record size", [][]byte{big, []byte("tail\n")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := open(t, seal(t, tc.writes...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Join(tc.writes, nil); !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	file := seal(t, []byte("secret"))
+	r, err := NewReader(bytes.NewReader(file), bytes.Repeat([]byte{8}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+	if _, err := NewReader(bytes.NewReader(file), testKey[:16]); !errors.Is(err, ErrBadKey) {
+		t.Errorf("short key: %v", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	file := seal(t, []byte("first\n"), []byte("second\n"), []byte("third\n"))
+	header, recs := records(t, file)
+	join := func(recs ...[]byte) []byte { return bytes.Join(append([][]byte{header}, recs...), nil) }
+	flip := func(i int) []byte {
+		f := bytes.Clone(file)
+		f[i] ^= 0x01
+		return f
+	}
+	lastByte := len(header) + len(recs[0]) - 1
+
+	for _, tc := range []struct {
+		name string
+		file []byte
+	}{
+		{"flipped magic", flip(0)},
+		{"flipped nonce", flip(len(header) + recordHeaderSize)},
+		{"flipped ciphertext", flip(len(header) + recordHeaderSize + nonceSize)},
+		{"flipped tag", flip(lastByte)},
+		{"reordered", join(recs[1], recs[0], recs[2])},
+		{"dropped", join(recs[0], recs[2])},
+		{"duplicated", join(recs[0], recs[0], recs[1])},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, err := open(t, tc.file); err == nil || errors.Is(err, io.EOF) {
+				t.Errorf("read %q, %v; want an error", got, err)
+			}
+		})
+	}
+}
+
+// TestBadLength checks that a record length no Writer could have written
+// fails at once rather than waiting for that much more of the file.
+func TestBadLength(t *testing.T) {
+	file := seal(t, []byte("hello\n"))
+	for _, n := range []uint32{0, 15, maxRecordPlaintext + 17, 1<<32 - 1} {
+		f := bytes.Clone(file)
+		binary.BigEndian.PutUint32(f[len(magic):], n)
+		_, err := open(t, f)
+		if err == nil || !strings.Contains(err.Error(), "bad length") {
+			t.Errorf("length %d: %v", n, err)
+		}
+	}
+}
+
+// TestTruncated checks that a file cut short, as one still being written
+// is, yields the whole records before the cut and then io.EOF, and that
+// reading on once the rest arrives picks up where it left off.
+func TestTruncated(t *testing.T) {
+	file := seal(t, []byte("first\n"), []byte("second\n"))
+	_, recs := records(t, file)
+	firstEnd := len(magic) + len(recs[0])
+
+	for _, cut := range []int{0, 3, len(magic), firstEnd - 1, firstEnd, firstEnd + recordHeaderSize + 2, len(file) - 1} {
+		src := &growing{data: file[:cut]}
+		r, err := NewReader(src, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		want := ""
+		if cut >= firstEnd {
+			want = "first\n"
+		}
+		if string(got) != want {
+			t.Errorf("cut at %d: read %q, want %q", cut, got, want)
+		}
+
+		src.data = file
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("cut at %d, then the rest: %v", cut, err)
+		}
+		if all := string(got) + string(rest); all != "first\nsecond\n" {
+			t.Errorf("cut at %d, then the rest: read %q", cut, all)
+		}
+	}
+}
+
+// growing is a file being appended to: reads past its end return io.EOF
+// until data grows.
+type growing struct {
+	data []byte
+	off  int
+}
+
+func (g *growing) Read(p []byte) (int, error) {
+	if g.off >= len(g.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, g.data[g.off:])
+	g.off += n
+	return n, nil
+}
@@ -1,17 +1,72 @@
+// Package logging sets up the server log: levelled, structured (logfmt)
+// records written to a rotating file, with a level that can be changed
+// while the server runs.
 package logging
 
 import (
+	"fmt"
 	"log"
-	"os"
+	"log/slog"
+	"strings"
 )
 
-var Logger *log.Logger
+// Logs is the server's log sink. Code that takes a *log.Logger keeps doing
+// so; Std and Debug hand out loggers that emit at a fixed level.
+type Logs struct {
+	level   *slog.LevelVar
+	handler slog.Handler
+	file    *RotatingFile
+}
 
-func Init(logFile string) error {
-	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+// Open starts logging to path at the given level.
+func Open(path string, level slog.Level, rot Rotation) (*Logs, error) {
+	f, err := OpenRotating(path, rot)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	Logger = log.New(f, "", log.LstdFlags|log.Lmsgprefix)
-	return nil
+	lv := new(slog.LevelVar)
+	lv.Set(level)
+	return &Logs{
+		level:   lv,
+		handler: slog.NewTextHandler(f, &slog.HandlerOptions{Level: lv}),
+		file:    f,
+	}, nil
 }
+
+// Std returns a logger whose lines are recorded at info level.
+func (l *Logs) Std() *log.Logger { return slog.NewLogLogger(l.handler, slog.LevelInfo) }
+
+// Debug returns a logger whose lines are dropped unless the level is debug.
+func (l *Logs) Debug() *log.Logger { return slog.NewLogLogger(l.handler, slog.LevelDebug) }
+
+// Slog returns a structured logger over the same sink.
+func (l *Logs) Slog() *slog.Logger { return slog.New(l.handler) }
+
+// Level reports the current level.
+func (l *Logs) Level() slog.Level { return l.level.Level() }
+
+// SetLevel changes the level for every logger handed out so far.
+func (l *Logs) SetLevel(level slog.Level) { l.level.Set(level) }
+
+func (l *Logs) Close() error { return l.file.Close() }
+
+// ParseLevel accepts debug, info, warn or error (any case).
+func ParseLevel(s string) (slog.Level, error) {
+	var lv slog.Level
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		lv = slog.LevelDebug
+	case "info", "":
+		lv = slog.LevelInfo
+	case "warn", "warning":
+		lv = slog.LevelWarn
+	case "error":
+		lv = slog.LevelError
+	default:
+		return 0, fmt.Errorf("unknown log level %q (want debug|info|warn|error)", s)
+	}
+	return lv, nil
+}
+
+// LevelName is the lower-case name ParseLevel accepts for lv.
+func LevelName(lv slog.Level) string { return strings.ToLower(lv.String()) }
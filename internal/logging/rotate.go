@@ -0,0 +1,181 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405"
+
+// Rotation controls when the log file is rotated and how many old files are
+// kept. Zero values disable the corresponding rule.
+type Rotation struct {
+	MaxSize    int64         // rotate once the file would exceed this many bytes
+	MaxAge     time.Duration // rotate once the file is this old
+	MaxBackups int           // keep at most this many rotated files
+	Compress   bool          // gzip rotated files
+}
+
+// RotatingFile is an append-only log file that renames itself to
+// <path>.<timestamp> when it grows too large or too old and starts afresh.
+type RotatingFile struct {
+	path string
+	rot  Rotation
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	wg     sync.WaitGroup // background compress/prune
+}
+
+func OpenRotating(path string, rot Rotation) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, rot: rot}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines.
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) due(next int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.rot.MaxSize > 0 && r.size+int64(next) > r.rot.MaxSize {
+		return true
+	}
+	return r.rot.MaxAge > 0 && time.Since(r.opened) >= r.rot.MaxAge
+}
+
+func (r *RotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().Format(backupTimeFormat)
+	if _, err := os.Stat(backup); err == nil {
+		backup += fmt.Sprintf(".%d", time.Now().UnixNano()) // rotated twice in a second
+	}
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		r.f = old // still valid; it now points at the backup
+		return err
+	}
+	old.Close()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if r.rot.Compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "compress %s: %v\n", backup, err)
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest backups beyond MaxBackups.
+func (r *RotatingFile) prune() {
+	if r.rot.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	// Timestamps sort lexically; a .gz twin of a name still being
+	// compressed is skipped so it isn't counted twice.
+	var names []string
+	for _, b := range backups {
+		if strings.HasSuffix(b, ".tmp") {
+			continue
+		}
+		if !strings.HasSuffix(b, ".gz") {
+			if _, err := os.Stat(b + ".gz"); err == nil {
+				continue
+			}
+		}
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	for len(names) > r.rot.MaxBackups {
+		os.Remove(names[0])
+		names = names[1:]
+	}
+}
+
+// Close flushes the file and waits for pending compression.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	err := r.f.Close()
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
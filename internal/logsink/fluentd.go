@@ -0,0 +1,135 @@
+package logsink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fluentdDialTimeout = 5 * time.Second
+
+// fluentdSink speaks the fluentd forward protocol in Forward mode: each
+// batch is one [tag, [[time, record], ...]] msgpack message over TCP. It
+// keeps one connection and redials on the next Send after a failure. No
+// acks, TLS or shared-key auth.
+type fluentdSink struct {
+	addr string
+	tag  string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newFluentdSink(u *url.URL) (*fluentdSink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("fluentd url must look like fluentd://host:port/tag")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "24224")
+	}
+	tag := strings.Trim(u.Path, "/")
+	if tag == "" {
+		tag = "jobworker"
+	}
+	return &fluentdSink{addr: addr, tag: tag}, nil
+}
+
+func (s *fluentdSink) Send(lines []Line) error {
+	var b []byte
+	b = mpArray(b, 2)
+	b = mpString(b, s.tag)
+	b = mpArray(b, len(lines))
+	for _, l := range lines {
+		b = mpArray(b, 2)
+		b = mpUint(b, uint64(l.Time.Unix()))
+		b = mpMap(b, 4)
+		b = mpString(mpString(b, "job_id"), l.JobID)
+		b = mpString(mpString(b, "owner"), l.Owner)
+		b = mpString(mpString(b, "stream"), l.Stream)
+		b = mpString(mpString(b, "log"), l.Text)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, fluentdDialTimeout)
+		if err != nil {
+			return fmt.Errorf("fluentd dial %s: %w", s.addr, err)
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(fluentdDialTimeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("fluentd write: %w", err)
+	}
+	return nil
+}
+
+func (s *fluentdSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Just enough msgpack for forward messages: arrays, string maps, strings
+// and unsigned integers.
+
+func mpArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func mpMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func mpString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func mpUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+	}
+}
@@ -0,0 +1,135 @@
+// Package logsink ships copies of job output lines to external log systems
+// (syslog, fluentd, HTTP). The job's files stay the source of truth for
+// streaming; shipping is best-effort and never holds a job up.
+package logsink
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/cluster"
+)
+
+const (
+	routeBuffer  = 256 // batches queued per route before dropping
+	maxBatchSize = 512 // lines per Send
+)
+
+// Line is one line of a job's output, without its newline.
+type Line struct {
+	Time   time.Time `json:"time"`
+	JobID  string    `json:"job_id"`
+	Owner  string    `json:"owner,omitempty"`
+	Stream string    `json:"stream"` // "stdout" or "stderr"
+	Text   string    `json:"line"`
+}
+
+// Sink delivers lines to an external system. Send may block on I/O.
+type Sink interface {
+	Send([]Line) error
+	Close() error
+}
+
+// Route sends the output of jobs whose labels match its selector to a sink.
+// Lines are delivered on a background goroutine; when the sink falls
+// behind, batches are dropped (and logged) rather than queued without
+// bound.
+type Route struct {
+	logger   *log.Logger
+	spec     string
+	selector map[string]string
+	sink     Sink
+	ch       chan []Line
+	done     chan struct{}
+}
+
+// Parse opens the route described by spec: "URL" or "URL;k=v,k2=v2" to
+// ship only jobs carrying those labels. URLs:
+//
+//	syslog://host:514        syslog over UDP (syslog+tcp:// for TCP)
+//	syslog:                  the local syslog daemon
+//	fluentd://host:24224/tag fluentd forward protocol; tag defaults to "jobworker"
+//	http(s)://host/path      POST batches as a JSON array
+func Parse(logger *log.Logger, spec string) (*Route, error) {
+	raw, sel, _ := strings.Cut(spec, ";")
+	selector, err := cluster.ParseLabels(sel)
+	if err != nil {
+		return nil, fmt.Errorf("output sink %q: labels: %w", spec, err)
+	}
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("output sink %q: %w", spec, err)
+	}
+
+	var sink Sink
+	switch u.Scheme {
+	case "syslog", "syslog+udp", "syslog+tcp":
+		sink, err = newSyslogSink(u)
+	case "fluentd":
+		sink, err = newFluentdSink(u)
+	case "http", "https":
+		sink = newHTTPSink(u.String())
+	default:
+		err = fmt.Errorf("unknown scheme %q (want syslog, syslog+tcp, fluentd, http or https)", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("output sink %q: %w", spec, err)
+	}
+
+	r := &Route{
+		logger:   logger,
+		spec:     u.Redacted(),
+		selector: selector,
+		sink:     sink,
+		ch:       make(chan []Line, routeBuffer),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// String describes the route for logs, without credentials.
+func (r *Route) String() string {
+	if len(r.selector) == 0 {
+		return r.spec
+	}
+	return r.spec + " for " + cluster.FormatLabels(r.selector)
+}
+
+// Matches reports whether a job with these labels is shipped on r.
+func (r *Route) Matches(labels map[string]string) bool {
+	return cluster.Matches(labels, r.selector)
+}
+
+// Ship queues lines for delivery without blocking.
+func (r *Route) Ship(lines []Line) {
+	for len(lines) > 0 {
+		n := min(len(lines), maxBatchSize)
+		select {
+		case r.ch <- lines[:n]:
+		default:
+			r.logger.Printf("[logsink] %s: falling behind, dropped %d line(s) of job %s", r.spec, n, lines[0].JobID)
+		}
+		lines = lines[n:]
+	}
+}
+
+func (r *Route) run() {
+	defer close(r.done)
+	for batch := range r.ch {
+		if err := r.sink.Send(batch); err != nil {
+			r.logger.Printf("[logsink] %s: %d line(s) of job %s: %v", r.spec, len(batch), batch[0].JobID, err)
+		}
+	}
+}
+
+// Close delivers what is queued and closes the sink. Ship must not be
+// called after Close.
+func (r *Route) Close() error {
+	close(r.ch)
+	<-r.done
+	return r.sink.Close()
+}
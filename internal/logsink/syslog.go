@@ -0,0 +1,83 @@
+package logsink
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// syslogSink writes one syslog message per line: INFO for stdout, ERR for
+// stderr, tagged "jobworker" and prefixed with the job id.
+type syslogSink struct {
+	network, addr string
+
+	mu sync.Mutex
+	w  *syslog.Writer
+}
+
+func newSyslogSink(u *url.URL) (*syslogSink, error) {
+	s := &syslogSink{}
+	if u.Host != "" {
+		s.network = strings.TrimPrefix(strings.TrimPrefix(u.Scheme, "syslog"), "+")
+		if s.network == "" {
+			s.network = "udp"
+		}
+		s.addr = u.Host
+		if u.Port() == "" {
+			s.addr += ":514"
+		}
+	}
+	// Dial now so a bad address fails at startup; later failures redial.
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial connects to the syslog daemon. Caller holds s.mu, or s is new.
+func (s *syslogSink) dial() error {
+	w, err := syslog.Dial(s.network, s.addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "jobworker")
+	if err != nil {
+		return fmt.Errorf("syslog dial: %w", err)
+	}
+	s.w = w
+	return nil
+}
+
+func (s *syslogSink) Send(lines []Line) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	for _, l := range lines {
+		msg := fmt.Sprintf("job=%s owner=%s %s", l.JobID, l.Owner, l.Text)
+		var err error
+		if l.Stream == "stderr" {
+			err = s.w.Err(msg)
+		} else {
+			err = s.w.Info(msg)
+		}
+		if err != nil {
+			s.w.Close()
+			s.w = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
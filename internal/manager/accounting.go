@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/bucknercd/jobworker/internal/accounting"
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// defaultAccountingInterval is how often running jobs' memory is sampled
+// for accounting when Options.AccountingInterval is unset.
+const defaultAccountingInterval = 10 * time.Second
+
+func (m *Manager) accountingLoop() {
+	t := time.NewTicker(m.opts.AccountingInterval)
+	defer t.Stop()
+	for now := range t.C {
+		for _, j := range m.activeJobs("", "") {
+			if stats, err := j.Stats(); err == nil {
+				j.meter.Observe(now, stats.MemoryCurrent)
+			}
+		}
+	}
+}
+
+// account adds a finished job to the ledger. Jobs that never launched used
+// nothing and are left out.
+func (m *Manager) account(j *managedJob, st joblib.State) {
+	if m.opts.Accounting == nil {
+		return
+	}
+	running, ok := st.Entered[joblib.StatusRunning]
+	if !ok {
+		return
+	}
+	finished := st.FinishedAt()
+	var cpu float64
+	if stats, err := j.Stats(); err == nil {
+		// Usage at exit; the cgroup is gone by now.
+		cpu = float64(stats.CPUUsageUsec) / 1e6
+		j.meter.Observe(finished, stats.MemoryCurrent)
+	}
+	byteSeconds, peak := j.meter.Totals()
+	err := m.opts.Accounting.Add(accounting.Record{
+		JobID:             j.ID(),
+		Owner:             j.owner,
+		Node:              m.opts.NodeName,
+		Executable:        j.executable,
+		Status:            st.Status.String(),
+		RunningAt:         running.UTC(),
+		FinishedAt:        finished.UTC(),
+		CPUSeconds:        cpu,
+		MemoryByteSeconds: byteSeconds,
+		MemoryPeakBytes:   peak,
+	})
+	if err != nil {
+		m.logger.Printf("job %s: accounting: %v", j.ID(), err)
+	}
+}
+
+// ExportAccounting totals the ledger per user for jobs that finished in
+// [from, to).
+func (m *Manager) ExportAccounting(req *jobpb.ExportAccountingRequest) (*jobpb.ExportAccountingResponse, error) {
+	if m.opts.Accounting == nil {
+		return nil, status.Error(codes.FailedPrecondition, "accounting is disabled on this server; start it with -accounting-file")
+	}
+	var from time.Time
+	if req.GetFrom() != nil {
+		from = req.GetFrom().AsTime()
+	}
+	to := time.Now()
+	if req.GetTo() != nil {
+		to = req.GetTo().AsTime()
+	}
+	if !from.Before(to) {
+		return nil, status.Errorf(codes.InvalidArgument, "empty period: from %s is not before to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	resp := &jobpb.ExportAccountingResponse{To: timestamppb.New(to)}
+	if !from.IsZero() {
+		resp.From = timestamppb.New(from)
+	}
+	for _, u := range accounting.Summarize(m.opts.Accounting.Records(from, to, req.GetOwner())) {
+		resp.Users = append(resp.Users, &jobpb.UserAccounting{
+			User:              u.User,
+			Jobs:              int32(u.Jobs),
+			CpuSeconds:        u.CPUSeconds,
+			MemoryByteSeconds: u.MemoryByteSeconds,
+		})
+	}
+	return resp, nil
+}
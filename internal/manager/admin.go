@@ -0,0 +1,280 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/cluster"
+	"github.com/bucknercd/jobworker/internal/limits"
+	"github.com/bucknercd/jobworker/internal/quota"
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gcInterval is how often finished jobs are checked against Options.Retention.
+const gcInterval = time.Minute
+
+// SetDraining turns draining on or off and returns the previous state.
+// While draining, StartJob fails with Unavailable; running jobs continue.
+func (m *Manager) SetDraining(on bool) bool {
+	return m.draining.Swap(on)
+}
+
+func (m *Manager) Draining() bool { return m.draining.Load() }
+
+// NodeName is the name this server reports jobs under in multi-node mode.
+func (m *Manager) NodeName() string { return m.opts.NodeName }
+
+// SetMaxJobs caps concurrently running jobs; n <= 0 removes the cap.
+func (m *Manager) SetMaxJobs(n int) {
+	m.maxJobs.Store(int32(max(n, 0)))
+}
+
+func (m *Manager) MaxJobs() int { return int(m.maxJobs.Load()) }
+
+// Load is what an agent reports to its coordinator.
+func (m *Manager) Load() cluster.Load {
+	return cluster.Load{Running: m.Running(), MaxJobs: m.MaxJobs(), Draining: m.Draining()}
+}
+
+// admit reserves a slot, and usage against owner's and namespace ns's
+// quotas, for a job about to start; the caller must call release once the
+// job is in m.jobs (or failed to get there).
+func (m *Manager) admit(owner, ns string, usage quota.Usage) (release func(), err error) {
+	if m.Draining() {
+		return nil, status.Error(codes.Unavailable, "node is draining; not accepting jobs")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit := m.MaxJobs(); limit > 0 {
+		if n := m.running + m.starting; n >= limit {
+			return nil, status.Errorf(codes.ResourceExhausted, "job limit reached (%d of %d running)", n, limit)
+		}
+	}
+	if limit, ok := m.opts.Quotas.For(owner); ok {
+		if what := limit.Exceeded(m.usageLocked(owner), usage); what != "" {
+			return nil, status.Errorf(codes.ResourceExhausted, "quota exceeded for %s: %s", owner, what)
+		}
+	}
+	if limit, ok := m.opts.Quotas.ForNamespace(ns); ok {
+		if what := limit.Exceeded(m.namespaceUsageLocked(ns), usage); what != "" {
+			return nil, status.Errorf(codes.ResourceExhausted, "quota exceeded for namespace %s: %s", ns, what)
+		}
+	}
+	m.starting++
+	m.pending[owner] = m.pending[owner].Add(usage)
+	m.pendingNS[ns] = m.pendingNS[ns].Add(usage)
+	return func() {
+		m.mu.Lock()
+		m.starting--
+		m.pending[owner] = m.pending[owner].Sub(usage)
+		if m.pending[owner] == (quota.Usage{}) {
+			delete(m.pending, owner)
+		}
+		m.pendingNS[ns] = m.pendingNS[ns].Sub(usage)
+		if m.pendingNS[ns] == (quota.Usage{}) {
+			delete(m.pendingNS, ns)
+		}
+		m.mu.Unlock()
+	}, nil
+}
+
+// GC forgets jobs that finished more than olderThan ago and deletes their
+// output. It returns how many were removed and how many remain.
+func (m *Manager) GC(olderThan time.Duration) (removed, remaining int) {
+	ctx := context.Background()
+	if m.opts.Archive != nil {
+		m.archiveFinished(ctx)
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	var unarchived int
+	victims := m.jobs.removeIf(func(j *managedJob) bool {
+		fin := j.State().FinishedAt()
+		if fin.IsZero() || fin.After(cutoff) {
+			return false
+		}
+		if m.opts.Archive != nil && !j.archived.Load() {
+			unarchived++
+			return false
+		}
+		return true
+	})
+	remaining = m.jobs.len()
+
+	now := time.Now()
+	for _, j := range victims {
+		s := m.summary(j)
+		m.expired.add(j.ID(), s.Metadata, now)
+		if m.opts.Archive != nil {
+			if err := m.archiveSummary(ctx, s); err != nil {
+				m.logger.Printf("job %s: gc: archive expired summary: %v", j.ID(), err)
+			}
+		}
+		m.idem.Forget(j.ID())
+		if err := j.Remove(); err != nil {
+			m.logger.Printf("job %s: gc: %v", j.ID(), err)
+		}
+	}
+	if len(victims) > 0 {
+		m.logger.Printf("gc: removed %d finished job(s), %d remain", len(victims), remaining)
+	}
+	if unarchived > 0 {
+		m.logger.Printf("gc: kept %d expired job(s) until they are archived", unarchived)
+	}
+	return len(victims), remaining
+}
+
+// RunGC is the Admin entry point for GC; zero means the configured retention.
+func (m *Manager) RunGC(req *jobpb.RunGCRequest) (*jobpb.RunGCResponse, error) {
+	olderThan := time.Duration(req.GetOlderThanSeconds()) * time.Second
+	if olderThan == 0 {
+		olderThan = m.opts.Retention
+	}
+	if olderThan <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "no job retention configured; set older_than_seconds")
+	}
+	removed, remaining := m.GC(olderThan)
+	return &jobpb.RunGCResponse{Removed: int32(removed), Remaining: int32(remaining)}, nil
+}
+
+func (m *Manager) gcLoop() {
+	t := time.NewTicker(gcInterval)
+	defer t.Stop()
+	for range t.C {
+		m.GC(m.opts.Retention)
+	}
+}
+
+// Diagnostics snapshots the process and every tracked job. The job table is
+// copied first; per-job detail (file sizes, PIDs) is gathered after, so a
+// slow disk can't stall StartJob.
+func (m *Manager) Diagnostics() *jobpb.GetDiagnosticsResponse {
+	entries := m.jobs.filter(nil)
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	resp := &jobpb.GetDiagnosticsResponse{
+		Goroutines:      int32(runtime.NumGoroutine()),
+		HeapAllocBytes:  ms.HeapAlloc,
+		TotalAllocBytes: ms.TotalAlloc,
+		GcCycles:        ms.NumGC,
+		UptimeSeconds:   int64(time.Since(m.created).Seconds()),
+		TotalJobs:       int32(len(entries)),
+		Jobs:            make([]*jobpb.JobDiagnostics, 0, len(entries)),
+	}
+
+	for _, j := range entries {
+		st := j.State()
+		desc := j.Describe()
+		d := &jobpb.JobDiagnostics{
+			JobId:         j.ID(),
+			Status:        mapStatus(st.Status, j.launching != nil),
+			ExitCode:      st.ExitCode,
+			Executable:    j.executable,
+			Image:         j.image,
+			StartedAtUnix: j.startedAt.Unix(),
+			Pid:           int32(desc.PID),
+			CgroupPath:    desc.CgroupPath,
+			Streams:       j.streams.Load(),
+			StdoutBytes:   outputSize(j, false),
+			StderrBytes:   outputSize(j, true),
+			JobsDir:       j.jobsDir,
+
+			OutputReads:        j.reads.count.Load(),
+			OutputBytesRead:    j.reads.bytes.Load(),
+			LastOutputReadUnix: j.reads.last.Load(),
+		}
+		if stats, err := j.Stats(); err == nil {
+			d.Pids = int32(stats.PIDs)
+			d.PidsMaxHits = stats.PIDsMaxHits
+		}
+		if fin := st.FinishedAt(); !fin.IsZero() {
+			d.FinishedAtUnix = fin.Unix()
+		} else {
+			resp.RunningJobs++
+		}
+		resp.ActiveStreams += d.Streams
+		resp.OutputBytes += max(d.StdoutBytes, 0) + max(d.StderrBytes, 0)
+		resp.Jobs = append(resp.Jobs, d)
+	}
+	sort.Slice(resp.Jobs, func(i, k int) bool { return resp.Jobs[i].StartedAtUnix < resp.Jobs[k].StartedAtUnix })
+	if m.opts.Backend == nil {
+		resp.OutputVolumes = m.outputVolumes(resp.Jobs)
+	}
+	return resp
+}
+
+// outputSize is the on-disk size of a job's output, compressed or not, or
+// -1 if unknown.
+func outputSize(j *managedJob, stderr bool) int64 {
+	path, ok := j.OutputPath(stderr)
+	if !ok {
+		return -1
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fi, err = os.Stat(path + joblib.CompressedSuffix)
+	}
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// requestUsage is what a job with limits l counts against owner's quota.
+// Under a cpu or memory quota, the job must set that limit: an unlimited
+// job can't be accounted for.
+func (m *Manager) requestUsage(owner string, l *jobpb.ResourceLimits) (quota.Usage, error) {
+	parsed, err := limits.Parse(limitSpec(l))
+	if err != nil {
+		return quota.Usage{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cpu, mem := parsed.CPU.Millis(), parsed.Memory.Bytes()
+	if limit, ok := m.opts.Quotas.For(owner); ok {
+		if limit.CPUMillis > 0 && cpu == 0 {
+			return quota.Usage{}, status.Errorf(codes.InvalidArgument, "%s has a cpu quota; set limits.cpu", owner)
+		}
+		if limit.MemoryBytes > 0 && mem == 0 {
+			return quota.Usage{}, status.Errorf(codes.InvalidArgument, "%s has a memory quota; set limits.memory_max", owner)
+		}
+	}
+	return quota.Usage{Jobs: 1, CPUMillis: cpu, MemoryBytes: mem}, nil
+}
+
+// usageLocked sums owner's unfinished and admitted jobs. m.mu must be held.
+func (m *Manager) usageLocked(owner string) quota.Usage {
+	return m.pending[owner].Add(m.active[owner])
+}
+
+// namespaceUsageLocked sums ns's unfinished and admitted jobs, whoever owns
+// them. m.mu must be held.
+func (m *Manager) namespaceUsageLocked(ns string) quota.Usage {
+	return m.pendingNS[ns].Add(m.activeNS[ns])
+}
+
+// GetQuota reports req.user's quota and current usage. Whether the caller
+// may ask about that user is decided by the gRPC layer.
+func (m *Manager) GetQuota(ctx context.Context, req *jobpb.GetQuotaRequest) (*jobpb.GetQuotaResponse, error) {
+	m.mu.RLock()
+	used := m.usageLocked(req.GetUser())
+	m.mu.RUnlock()
+
+	resp := &jobpb.GetQuotaResponse{User: req.GetUser(), Used: quotaUsagePB(used)}
+	if limit, ok := m.opts.Quotas.For(req.GetUser()); ok {
+		resp.Limited = true
+		resp.Limit = quotaUsagePB(limit)
+	}
+	return resp, nil
+}
+
+func quotaUsagePB(u quota.Usage) *jobpb.QuotaUsage {
+	return &jobpb.QuotaUsage{Jobs: int32(u.Jobs), CpuMillis: u.CPUMillis, MemoryBytes: u.MemoryBytes}
+}
@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// TestAdmitTally checks that admission counts jobs in as they launch and
+// out as they end, without scanning the index: the job limit and each
+// owner's usage follow the jobs.
+func TestAdmitTally(t *testing.T) {
+	m, f := newFakeManager(t)
+	m.SetMaxJobs(2)
+	alice := WithUser(context.Background(), "alice")
+	bob := WithUser(context.Background(), "bob")
+	start := func(ctx context.Context) (string, error) {
+		resp, err := m.StartJob(ctx, &jobpb.StartJobRequest{Executable: "/bin/true"})
+		return resp.GetJobId(), err
+	}
+	used := func(user string) int32 {
+		resp, err := m.GetQuota(context.Background(), &jobpb.GetQuotaRequest{User: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetUsed().GetJobs()
+	}
+
+	first, err := start(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := start(bob); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Running(); n != 2 {
+		t.Fatalf("Running() = %d, want 2", n)
+	}
+	if a, b := used("alice"), used("bob"); a != 1 || b != 1 {
+		t.Fatalf("jobs used: alice %d, bob %d; want 1 each", a, b)
+	}
+	if _, err := start(alice); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("third job: %v, want RESOURCE_EXHAUSTED", err)
+	}
+
+	f.get(first).exit(0)
+	deadline := time.Now().Add(time.Second)
+	for m.Running() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Running() = %d after a job exited, want 1", m.Running())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if a := used("alice"); a != 0 {
+		t.Fatalf("alice uses %d jobs after hers exited, want 0", a)
+	}
+	if _, err := start(alice); err != nil {
+		t.Fatalf("job after one exited: %v", err)
+	}
+
+	// A created job counts once started, and not at all if stopped first.
+	created, err := m.CreateJob(bob, &jobpb.StartJobRequest{Executable: "/bin/true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.StopJob(bob, &jobpb.StopJobRequest{JobId: created.GetJobId()}); err != nil {
+		t.Fatal(err)
+	}
+	if n, b := m.Running(), used("bob"); n != 2 || b != 1 {
+		t.Fatalf("after stopping a created job: Running() = %d, bob uses %d; want 2 and 1", n, b)
+	}
+}
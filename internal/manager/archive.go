@@ -0,0 +1,276 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/bucknercd/jobworker/internal/archive"
+	"github.com/bucknercd/jobworker/internal/logcrypt"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// With Options.Archive, each finished job's stdout, stderr, result data
+// and summary (JobSummary as JSON) are uploaded within archiveInterval of
+// it ending, the summary last, so its presence means the rest is all
+// there. GC leaves a job until it is archived, and rewrites its summary as
+// EXPIRED when removing it. A job the server no longer has is then looked
+// up in the archive, and reads of it (GetStatus, StreamOutput,
+// DownloadOutput, CountOutputLines, GetJobResult) are served from there.
+// Encrypted output is archived encrypted, with the same key.
+
+// archiveInterval is the longest a finished job waits to be archived, and
+// between retries of one that failed.
+const archiveInterval = time.Minute
+
+// archiveLookupTimeout bounds looking a job up in the archive where the
+// caller has no deadline of its own.
+const archiveLookupTimeout = 10 * time.Second
+
+// maxArchivedSummary bounds the metadata object read back.
+const maxArchivedSummary = 1 << 20
+
+func (m *Manager) archiveLoop() {
+	t := time.NewTicker(archiveInterval)
+	defer t.Stop()
+	for range t.C {
+		m.archiveFinished(context.Background())
+	}
+}
+
+// archiveFinished uploads, one job at a time, the finished jobs not yet
+// archived. A job that fails is tried again on the next pass.
+func (m *Manager) archiveFinished(ctx context.Context) {
+	m.archiving.Lock()
+	defer m.archiving.Unlock()
+	jobs := m.jobs.filter(func(j *managedJob) bool {
+		return !j.State().FinishedAt().IsZero() && !j.archived.Load()
+	})
+
+	var n, failed int
+	var firstErr error
+	for _, j := range jobs {
+		if err := m.archiveJob(ctx, j); err != nil {
+			if failed++; firstErr == nil {
+				firstErr = fmt.Errorf("job %s: %w", j.ID(), err)
+			}
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		m.logger.Printf("archive: archived %d job(s) to %s", n, m.opts.Archive)
+	}
+	if failed > 0 {
+		m.logger.Printf("archive: %d job(s) not archived, retrying in %s: %v", failed, archiveInterval, firstErr)
+	}
+}
+
+// archiveJob uploads j's output and result data, then its summary.
+func (m *Manager) archiveJob(ctx context.Context, j *managedJob) error {
+	j.archiveMu.Lock()
+	defer j.archiveMu.Unlock()
+	if m.jobs.get(j.ID()) != j { // deleted meanwhile
+		return nil
+	}
+	for _, stderr := range []bool{false, true} {
+		if err := m.archiveObject(ctx, j, archive.OutputName(stderr), j.output(stderr)); err != nil {
+			return err
+		}
+	}
+	if err := m.archiveObject(ctx, j, archive.Result, j.OpenResultData); err != nil {
+		return err
+	}
+	if err := m.archiveSummary(ctx, m.summary(j)); err != nil {
+		return err
+	}
+	j.archived.Store(true)
+	return nil
+}
+
+// archiveObject uploads what open reads of j as the object name,
+// encrypting it again with OutputKey when that is set. What the job
+// doesn't have isn't uploaded.
+func (m *Manager) archiveObject(ctx context.Context, j *managedJob, name string, open openOutput) error {
+	rc, err := open()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	size := int64(-1) // compressed output's is unknown; so is ciphertext's
+	if f, ok := rc.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	}
+	if m.opts.OutputKey != nil {
+		pr, pw := io.Pipe()
+		copied := make(chan struct{})
+		go func() {
+			defer close(copied)
+			w, err := logcrypt.NewWriter(pw, m.opts.OutputKey)
+			if err == nil {
+				_, err = io.Copy(w, rc)
+			}
+			pw.CloseWithError(err)
+		}()
+		defer func() {
+			pr.Close() // stops the copy if the upload failed
+			<-copied
+		}()
+		r = pr
+	}
+	return m.opts.Archive.Put(ctx, j.ID(), name, r, size)
+}
+
+func (m *Manager) archiveSummary(ctx context.Context, s *jobpb.JobSummary) error {
+	b, err := protojson.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return m.opts.Archive.Put(ctx, s.GetJobId(), archive.Metadata, bytes.NewReader(b), int64(len(b)))
+}
+
+// expiredMetadata is the last metadata of job id, which the server no
+// longer has: remembered from GC, or else read from the archive and
+// remembered from then on. Nil means neither knows it.
+func (m *Manager) expiredMetadata(ctx context.Context, id string) *jobpb.JobMetadata {
+	if md := m.expired.get(id); md != nil || m.opts.Archive == nil || id == "" {
+		return md
+	}
+	rc, err := m.opts.Archive.Open(ctx, id, archive.Metadata)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			m.logger.Printf("job %s: archive: %v", id, err)
+		}
+		return nil
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxArchivedSummary))
+	if err != nil {
+		m.logger.Printf("job %s: archive: read summary: %v", id, err)
+		return nil
+	}
+	s := &jobpb.JobSummary{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, s); err != nil || s.GetMetadata() == nil {
+		m.logger.Printf("job %s: archive: bad summary: %v", id, err)
+		return nil
+	}
+	// A job archived by an earlier run of the server, or whose EXPIRED
+	// summary failed to upload, has no expiry time.
+	m.expired.add(id, s.GetMetadata(), time.Time{})
+	return m.expired.get(id)
+}
+
+// isArchived reports whether job id, which the server no longer has, can
+// be read from the archive.
+func (m *Manager) isArchived(ctx context.Context, id string) bool {
+	return m.opts.Archive != nil && m.expiredMetadata(ctx, id) != nil
+}
+
+// archivedOutput opens an archived job's stdout or stderr, decrypting it
+// with OutputKey when that is set.
+func (m *Manager) archivedOutput(ctx context.Context, id string, stderr bool) openOutput {
+	return m.archivedObject(ctx, id, archive.OutputName(stderr))
+}
+
+// archivedObject opens an archived job's object name, as archivedOutput.
+func (m *Manager) archivedObject(ctx context.Context, id, name string) openOutput {
+	return func() (io.ReadCloser, error) {
+		obj, err := m.opts.Archive.Open(ctx, id, name)
+		if err != nil || m.opts.OutputKey == nil {
+			return obj, err
+		}
+		r, err := logcrypt.NewReader(obj, m.opts.OutputKey)
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, obj}, nil
+	}
+}
+
+// streamArchived is StreamOutput for a job read from the archive. It has
+// finished, so its output is sent once through to the end.
+func (m *Manager) streamArchived(req *jobpb.StreamOutputRequest, stream jobpb.JobWorker_StreamOutputServer) error {
+	ctx := stream.Context()
+	filter, err := newLineFilter(req)
+	if err != nil {
+		return err
+	}
+	open := m.archivedOutput(ctx, req.GetJobId(), req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR)
+	start, err := m.streamStart(ctx, req, nil, open)
+	if err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return outputError(err)
+	}
+	defer rc.Close()
+	if sk, ok := rc.(io.Seeker); ok {
+		_, err = sk.Seek(int64(start), io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, rc, int64(start))
+	}
+	if errors.Is(err, io.EOF) { // start is past the end
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "seek output: %v", err)
+	}
+
+	pooled := m.chunkBuf()
+	defer m.putChunkBuf(pooled)
+	buf := (*pooled)[:cap(*pooled)]
+	if filter != nil {
+		finished := make(chan struct{})
+		close(finished)
+		return m.sendFiltered(ctx, stream, rc, start, 0, filter, buf, finished, nil, 0, nil)
+	}
+	msg := &jobpb.StreamOutputResponse{Offset: start}
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 {
+			msg.Chunk = buf[:n]
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+			msg.Offset += uint64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "read output: %v", err)
+		}
+	}
+}
+
+// deleteArchived removes job id from the archive, waiting out an upload
+// of j in progress; j is nil for a job the server no longer has.
+func (m *Manager) deleteArchived(ctx context.Context, id string, j *managedJob) error {
+	if j != nil {
+		j.archiveMu.Lock()
+		defer j.archiveMu.Unlock()
+	}
+	return m.opts.Archive.Remove(ctx, id)
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whole-file reads (DownloadOutput, DownloadCore) can't hand the file to
+// the socket with sendfile or splice: every byte is framed by gRPC and
+// encrypted by TLS in user space on the way out. What they can cut is the
+// per-chunk cost. They read and send bulkChunkSize pieces from buffers
+// reused across calls, and tell the kernel to read ahead.
+
+// bulkChunkSize is the most a whole-file read sends in one message. Well
+// under the 4 MiB a gRPC client accepts by default.
+const bulkChunkSize = 1 << 20
+
+var bulkBufs = sync.Pool{New: func() any { return new([bulkChunkSize]byte) }}
+
+// getBulkBuf borrows a bulkChunkSize buffer; putBulkBuf returns it.
+func getBulkBuf() *[bulkChunkSize]byte { return bulkBufs.Get().(*[bulkChunkSize]byte) }
+
+func putBulkBuf(b *[bulkChunkSize]byte) { bulkBufs.Put(b) }
+
+// readSequential tells the kernel r, if it is a file, will be read from
+// start to end, so it reads further ahead of us.
+func readSequential(r io.Reader) {
+	if f, ok := r.(*os.File); ok {
+		unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+	}
+}
+
+// chunkBuf borrows an empty buffer of StreamChunkSize capacity for an
+// output stream; putChunkBuf returns it.
+func (m *Manager) chunkBuf() *[]byte {
+	if b, ok := m.chunkBufs.Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, 0, m.opts.StreamChunkSize)
+	return &b
+}
+
+func (m *Manager) putChunkBuf(b *[]byte) {
+	*b = (*b)[:0]
+	m.chunkBufs.Put(b)
+}
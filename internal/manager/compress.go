@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// compressInterval is the longest finished jobs wait between checks
+// against Options.CompressOutputAfter.
+const compressInterval = time.Minute
+
+func (m *Manager) compressLoop() {
+	t := time.NewTicker(min(m.opts.CompressOutputAfter, compressInterval))
+	defer t.Stop()
+	for range t.C {
+		m.compressFinished(m.opts.CompressOutputAfter)
+	}
+}
+
+// compressFinished compresses, one job at a time, the output of jobs that
+// finished more than after ago. Each job is tried once.
+func (m *Manager) compressFinished(after time.Duration) {
+	cutoff := time.Now().Add(-after)
+	jobs := m.jobs.filter(func(j *managedJob) bool {
+		fin := j.State().FinishedAt()
+		return !fin.IsZero() && !fin.After(cutoff) && !j.compressed.Load()
+	})
+
+	var n int
+	var before, saved int64
+	for _, j := range jobs {
+		j.compressed.Store(true)
+		in, out, err := j.CompressOutput()
+		switch {
+		case errors.Is(err, errors.ErrUnsupported), errors.Is(err, os.ErrNotExist):
+			// Encrypted, not kept on this host, or removed meanwhile.
+			continue
+		case err != nil:
+			m.logger.Printf("job %s: compress output: %v", j.ID(), err)
+		}
+		j.dropLineIndexes()
+		if in > out {
+			n++
+			before += in
+			saved += in - out
+		}
+	}
+	if n > 0 {
+		m.logger.Printf("compress: compressed the output of %d job(s), %d of %d bytes saved", n, saved, before)
+	}
+}
@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// DownloadCore streams the core a crashed job left, in bulkChunkSize
+// pieces.
+func (m *Manager) DownloadCore(req *jobpb.DownloadCoreRequest, stream jobpb.JobWorker_DownloadCoreServer) error {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		return m.notFound(req.GetJobId())
+	}
+	f, err := job.OpenCore()
+	if errors.Is(err, os.ErrNotExist) {
+		return status.Error(codes.NotFound, "job has no core dump")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "open core: %v", err)
+	}
+	defer f.Close()
+	readSequential(f)
+	fi, err := f.Stat()
+	if err != nil {
+		return status.Errorf(codes.Internal, "open core: %v", err)
+	}
+
+	resp := &jobpb.DownloadCoreResponse{Size: uint64(fi.Size())}
+	pooled := getBulkBuf()
+	defer putBulkBuf(pooled)
+	buf := pooled[:]
+	for {
+		n, err := f.Read(buf)
+		if n > 0 || resp.Size > 0 {
+			resp.Chunk = buf[:n]
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &jobpb.DownloadCoreResponse{}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "read core: %v", err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// DeleteJob forgets a job and deletes its output now, as GC would once
+// the job is past retention. A job that hasn't finished is refused unless
+// req.force, which stops it and waits for it to end first. Its archived
+// copy is deleted too, and a job only in the archive can be deleted from
+// there.
+func (m *Manager) DeleteJob(ctx context.Context, req *jobpb.DeleteJobRequest) (*jobpb.DeleteJobResponse, error) {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		if !m.isArchived(ctx, req.GetJobId()) {
+			return nil, m.notFound(req.GetJobId())
+		}
+		md := m.expiredMetadata(ctx, req.GetJobId())
+		if err := m.deleteArchived(ctx, req.GetJobId(), nil); err != nil {
+			m.logger.Printf("job %s: delete: %v", req.GetJobId(), err)
+			return nil, status.Errorf(codes.Internal, "remove archived job: %v", err)
+		}
+		m.expired.forget(req.GetJobId())
+		m.logger.Printf("job %s deleted from the archive by %s", req.GetJobId(), userFrom(ctx))
+		return &jobpb.DeleteJobResponse{Metadata: md}, nil
+	}
+
+	select {
+	case <-job.Done():
+	default:
+		if !req.GetForce() {
+			return nil, status.Error(codes.FailedPrecondition, "job has not finished; stop it first, or set force")
+		}
+		if _, err := job.Stop(); err != nil {
+			return nil, status.Errorf(codes.Internal, "stop job: %v", err)
+		}
+		select {
+		case <-job.Done():
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	if !m.jobs.remove(job) { // a concurrent DeleteJob or GC got it
+		return nil, m.notFound(job.ID())
+	}
+
+	resp := &jobpb.DeleteJobResponse{Metadata: m.metadata(job)}
+	for _, stderr := range []bool{false, true} {
+		resp.BytesFreed += uint64(max(outputSize(job, stderr), 0))
+	}
+	m.idem.Forget(job.ID())
+	if err := job.Remove(); err != nil {
+		m.logger.Printf("job %s: delete: %v", job.ID(), err)
+		return nil, status.Errorf(codes.Internal, "remove job output: %v", err)
+	}
+	if m.opts.Archive != nil {
+		if err := m.deleteArchived(ctx, job.ID(), job); err != nil {
+			m.logger.Printf("job %s: delete: %v", job.ID(), err)
+			return nil, status.Errorf(codes.Internal, "remove archived job: %v", err)
+		}
+	}
+	m.logger.Printf("job %s deleted by %s", job.ID(), userFrom(ctx))
+	return resp, nil
+}
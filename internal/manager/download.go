@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// DownloadOutput streams a job's stored stdout or stderr from the start to
+// its current end, in bulkChunkSize pieces, then its size and SHA-256.
+// Unlike StreamOutput it doesn't follow a running job; complete says
+// whether the job had already finished. A job retention GC removed is
+// read from the archive.
+func (m *Manager) DownloadOutput(req *jobpb.DownloadOutputRequest, stream jobpb.JobWorker_DownloadOutputServer) error {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		if !m.isArchived(stream.Context(), req.GetJobId()) {
+			return m.notFound(req.GetJobId())
+		}
+		stderr := req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR
+		rc, err := m.archivedOutput(stream.Context(), req.GetJobId(), stderr)()
+		if err != nil {
+			return outputError(err)
+		}
+		defer rc.Close()
+		return sendDownload(rc, stream, true, nil)
+	}
+
+	var complete bool
+	select {
+	case <-job.Done(): // before opening, so nothing is written after
+		complete = true
+	default:
+	}
+	stderr := req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR
+	rc, err := job.OpenOutput(stderr)
+	if err != nil {
+		return outputError(err)
+	}
+	defer rc.Close()
+	readSequential(rc)
+
+	job.streams.Add(1)
+	defer job.streams.Add(-1)
+	job.reads.count.Add(1)
+	return sendDownload(rc, stream, complete, &job.reads)
+}
+
+// sendDownload sends rc to its end, then its size and SHA-256, counting
+// what is sent in reads when that isn't nil.
+func sendDownload(rc io.Reader, stream jobpb.JobWorker_DownloadOutputServer, complete bool, reads *outputReads) error {
+	sum := sha256.New()
+	var size uint64
+	pooled := getBulkBuf()
+	defer putBulkBuf(pooled)
+	buf := pooled[:]
+	msg := &jobpb.DownloadOutputResponse{}
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			size += uint64(n)
+			msg.Chunk = buf[:n]
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+			if reads != nil {
+				reads.sent(n)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "read output: %v", err)
+		}
+	}
+	return stream.Send(&jobpb.DownloadOutputResponse{Sha256: sum.Sum(nil), Size: size, Complete: complete})
+}
+
+// outputError maps an error opening job output to its status.
+func outputError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return status.Error(codes.FailedPrecondition, "job output not available")
+	}
+	return status.Errorf(codes.Internal, "open output: %v", err)
+}
@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// defaultExecCommand is what ExecInJob runs when start names nothing.
+const defaultExecCommand = "sh"
+
+// ReadExecStart receives the first ExecInJob message, which must say what
+// to run.
+func ReadExecStart(stream jobpb.Admin_ExecInJobServer) (*jobpb.ExecStart, error) {
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil, status.Error(codes.InvalidArgument, "empty ExecInJob stream")
+	}
+	if err != nil {
+		return nil, err
+	}
+	start := first.GetStart()
+	if start == nil {
+		return nil, status.Error(codes.InvalidArgument, "the first ExecInJob message must carry start")
+	}
+	if start.GetJobId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "job_id required")
+	}
+	return start, nil
+}
+
+// ExecInJob runs start's command inside a running job (see joblib.ExecIn),
+// relaying stdin from the stream and stdout/stderr back to it, and ends
+// with the command's exit.
+func (m *Manager) ExecInJob(start *jobpb.ExecStart, stream jobpb.Admin_ExecInJobServer) error {
+	job := m.getJob(start.GetJobId())
+	if job == nil {
+		return m.notFound(start.GetJobId())
+	}
+	if st := job.Status(); st != joblib.StatusRunning {
+		return status.Errorf(codes.FailedPrecondition, "job is %s, not running", st)
+	}
+
+	var mu sync.Mutex
+	send := func(resp *jobpb.ExecInJobResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return stream.Send(resp)
+	}
+
+	stdin, feed := io.Pipe()
+	defer stdin.Close()
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				feed.Close()
+				return
+			}
+			if err != nil {
+				feed.CloseWithError(err)
+				return
+			}
+			if msg.GetStart() != nil {
+				feed.CloseWithError(errors.New("start sent twice"))
+				return
+			}
+			if _, err := feed.Write(msg.GetStdin()); err != nil {
+				return
+			}
+		}
+	}()
+
+	exit, err := job.ExecIn(stream.Context(), joblib.ExecSpec{
+		Command: cmp.Or(start.GetExecutable(), defaultExecCommand),
+		Args:    start.GetArgs(),
+		Env:     start.GetEnv(),
+		Stdin:   stdin,
+		Stdout: sendWriter(func(b []byte) error {
+			return send(&jobpb.ExecInJobResponse{Part: &jobpb.ExecInJobResponse_Stdout{Stdout: b}})
+		}),
+		Stderr: sendWriter(func(b []byte) error {
+			return send(&jobpb.ExecInJobResponse{Part: &jobpb.ExecInJobResponse_Stderr{Stderr: b}})
+		}),
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, errors.ErrUnsupported):
+		return status.Error(codes.Unimplemented, "this server's backend can't exec into jobs")
+	case errors.Is(err, exec.ErrNotFound):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case stream.Context().Err() != nil:
+		return status.FromContextError(stream.Context().Err()).Err()
+	case job.Status() != joblib.StatusRunning:
+		return status.Errorf(codes.FailedPrecondition, "exec: %v", err)
+	default:
+		return status.Errorf(codes.Internal, "exec: %v", err)
+	}
+
+	done := &jobpb.ExecExit{ExitCode: int32(exit.Code)}
+	if exit.Signaled {
+		done.ExitCode, done.Signal = -1, unix.SignalName(exit.Signal)
+	}
+	return send(&jobpb.ExecInJobResponse{Part: &jobpb.ExecInJobResponse_Exit{Exit: done}})
+}
+
+// sendWriter sends each write as one message. exec copies output in
+// chunks of at most 32KiB, well under the gRPC message limit.
+type sendWriter func([]byte) error
+
+func (w sendWriter) Write(p []byte) (int, error) {
+	if err := w(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,89 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+)
+
+// DefaultExecPath is where bare executable names are looked up unless
+// Options.ExecPath says otherwise.
+var DefaultExecPath = []string{"/usr/bin", "/bin"}
+
+// resolveExecutable finds name the way the job will see it: bare names are
+// searched for in dirs only (never the server's own PATH), and names with
+// a slash are taken as given. The result must be a regular file that cred
+// may execute. Errors are InvalidArgument and say what was wrong.
+func resolveExecutable(name string, dirs []string, cred *syscall.Credential) (string, error) {
+	if strings.Contains(name, "/") {
+		if err := checkExecutable(name, cred); err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "executable %q: %v", name, err)
+		}
+		return name, nil
+	}
+
+	var rejected []string
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		err := checkExecutable(path, cred)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsNotExist(err) {
+			rejected = append(rejected, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+	if len(rejected) > 0 {
+		return "", status.Errorf(codes.InvalidArgument, "executable %q not usable: %s", name, strings.Join(rejected, "; "))
+	}
+	return "", status.Errorf(codes.InvalidArgument, "executable %q not found in %s", name, strings.Join(dirs, ":"))
+}
+
+// checkExecutable reports why cred can't exec path, going by the file's
+// mode bits. Supplementary groups aren't considered.
+func checkExecutable(path string, cred *syscall.Credential) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("stat: %w", err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+
+	uid, gid := uint32(joblib.NobodyID), uint32(joblib.NobodyID)
+	if cred != nil {
+		uid, gid = cred.Uid, cred.Gid
+	}
+	perm := fi.Mode().Perm()
+	var ok bool
+	st, _ := fi.Sys().(*syscall.Stat_t)
+	switch {
+	case uid == 0:
+		ok = perm&0o111 != 0
+	case st == nil:
+		ok = perm&0o001 != 0
+	case st.Uid == uid:
+		ok = perm&0o100 != 0
+	case st.Gid == gid:
+		ok = perm&0o010 != 0
+	default:
+		ok = perm&0o001 != 0
+	}
+	if !ok {
+		return fmt.Errorf("not executable by uid %d gid %d (mode %s)", uid, gid, perm)
+	}
+	return nil
+}
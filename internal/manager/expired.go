@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// maxExpiredJobs bounds how many removed jobs expiredJobs remembers; the
+// oldest are forgotten first, and then look like they never existed.
+const maxExpiredJobs = 10000
+
+// ExpiredReason is the ErrorInfo reason on the NOT_FOUND a call naming an
+// expired job gets.
+const ExpiredReason = "JOB_EXPIRED"
+
+// expiredJobs remembers the last metadata of jobs retention GC removed,
+// so a call naming one can say it expired rather than that it never
+// existed. Like the job table it is lost on restart; jobs in the archive
+// are looked up there again (see expiredMetadata).
+type expiredJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*jobpb.JobMetadata
+	order []string // oldest first
+}
+
+// add remembers md, the last metadata of job id, as expired at at. A
+// zero at means unknown.
+func (e *expiredJobs) add(id string, md *jobpb.JobMetadata, at time.Time) {
+	if md.GetStatus() != jobpb.JobStatus_JOB_STATUS_EXPIRED {
+		md.FinalStatus, md.Status = md.Status, jobpb.JobStatus_JOB_STATUS_EXPIRED
+		md.CgroupPath = ""
+	}
+	if !at.IsZero() {
+		md.ExpiredAt = timestamppb.New(at)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.jobs == nil {
+		e.jobs = make(map[string]*jobpb.JobMetadata)
+	}
+	if _, ok := e.jobs[id]; !ok {
+		e.order = append(e.order, id)
+	}
+	e.jobs[id] = md
+	if len(e.order) > maxExpiredJobs {
+		delete(e.jobs, e.order[0])
+		e.order = e.order[1:]
+	}
+}
+
+func (e *expiredJobs) get(id string) *jobpb.JobMetadata {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.jobs[id]
+}
+
+func (e *expiredJobs) forget(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.jobs[id]; ok {
+		delete(e.jobs, id)
+		e.order = slices.DeleteFunc(e.order, func(o string) bool { return o == id })
+	}
+}
+
+// notFound is the error for a call naming a job the manager doesn't have:
+// NOT_FOUND either way, with an ErrorInfo (reason JOB_EXPIRED, the job's
+// owner and when it was removed) when retention GC removed it.
+func (m *Manager) notFound(id string) error {
+	md := m.expired.get(id)
+	if md == nil {
+		return status.Error(codes.NotFound, "job not found")
+	}
+	msg := "job expired: removed by retention GC"
+	info := map[string]string{"job_id": id, "owner": md.GetUser()}
+	if md.GetExpiredAt() != nil { // unknown for some archived jobs
+		at := md.GetExpiredAt().AsTime().Format(time.RFC3339)
+		msg += " at " + at
+		info["expired_at"] = at
+	}
+	st, err := status.New(codes.NotFound, msg).
+		WithDetails(&errdetails.ErrorInfo{
+			Reason:   ExpiredReason,
+			Domain:   "jobworker",
+			Metadata: info,
+		})
+	if err != nil {
+		return status.Error(codes.NotFound, "job expired")
+	}
+	return st.Err()
+}
+
+// expiredStatus is GetStatus for an expired job: its last metadata, as
+// EXPIRED.
+func (m *Manager) expiredStatus(ctx context.Context, id string) *jobpb.GetStatusResponse {
+	md := m.expiredMetadata(ctx, id)
+	if md == nil {
+		return nil
+	}
+	return &jobpb.GetStatusResponse{JobId: id, Metadata: proto.Clone(md).(*jobpb.JobMetadata)}
+}
@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+)
+
+// fakeBackend runs no process: it "exits" when exit is called or Stop
+// kills it, whichever comes first.
+type fakeBackend struct {
+	output []byte // what OutputReader reads, for stdout and stderr alike
+	exited chan struct{}
+	once   sync.Once
+	result joblib.Exit
+	stops  atomic.Int32 // Stop calls that found the process running
+}
+
+func (b *fakeBackend) exit(code int) {
+	b.once.Do(func() {
+		b.result = joblib.Exit{Code: code}
+		close(b.exited)
+	})
+}
+
+func (b *fakeBackend) Start() error { return nil }
+
+func (b *fakeBackend) Wait() (joblib.Exit, error) {
+	<-b.exited
+	return b.result, nil
+}
+
+func (b *fakeBackend) Stop() error {
+	b.once.Do(func() {
+		b.stops.Add(1)
+		b.result = joblib.Exit{Signaled: true, Signal: syscall.SIGKILL}
+		close(b.exited)
+	})
+	return nil
+}
+
+func (b *fakeBackend) Signal(syscall.Signal) error { return nil }
+func (b *fakeBackend) Stats() (joblib.Stats, error) {
+	return joblib.Stats{}, nil
+}
+func (b *fakeBackend) OutputReader(bool) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.output)), nil
+}
+
+// fakeBackends hands out a fakeBackend per job, by job ID.
+type fakeBackends struct {
+	mu     sync.Mutex
+	jobs   map[string]*fakeBackend
+	output []byte // given to each new backend
+}
+
+func (f *fakeBackends) factory(opts joblib.Options) (joblib.Backend, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := &fakeBackend{output: f.output, exited: make(chan struct{})}
+	f.jobs[opts.ID] = b
+	return b, nil
+}
+
+func (f *fakeBackends) get(id string) *fakeBackend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.jobs[id]
+}
+
+func newFakeManager(tb testing.TB) (*Manager, *fakeBackends) {
+	tb.Helper()
+	f := &fakeBackends{jobs: make(map[string]*fakeBackend)}
+	m := NewManager(log.New(io.Discard, "", 0), Options{
+		Backend:  f.factory,
+		JobsDirs: []string{tb.TempDir()},
+	})
+	return m, f
+}
@@ -0,0 +1,220 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+const (
+	// maxFilterLine is how much of a line a stream filter matches; the
+	// rest of a longer line goes where its start did.
+	maxFilterLine = 64 * 1024
+
+	// filterReportInterval is the longest a filtered stream that is
+	// dropping lines goes without saying how many.
+	filterReportInterval = 5 * time.Second
+)
+
+// lineFilter passes on the lines of a job's output that a
+// StreamOutputRequest's include and exclude select, and counts the rest.
+type lineFilter struct {
+	include, exclude *regexp.Regexp
+
+	fed     uint64 // output offset of the next byte written
+	line    []byte // the current line so far, while undecided
+	decided bool   // the current line outgrew maxFilterLine...
+	keep    bool   // ...and whether it is sent
+
+	out        []byte // kept bytes not yet sent
+	outOffset  uint64 // offset of out's first byte
+	suppressed uint64 // lines dropped since the last message
+}
+
+// newLineFilter compiles req's filter; nil means it has none.
+func newLineFilter(req *jobpb.StreamOutputRequest) (*lineFilter, error) {
+	if req.GetInclude() == "" && req.GetExclude() == "" {
+		return nil, nil
+	}
+	f := &lineFilter{}
+	for _, p := range []struct {
+		name, expr string
+		re         **regexp.Regexp
+	}{
+		{"include", req.GetInclude(), &f.include},
+		{"exclude", req.GetExclude(), &f.exclude},
+	} {
+		if p.expr == "" {
+			continue
+		}
+		expr := p.expr
+		if req.GetIgnoreCase() {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s pattern: %v", p.name, err)
+		}
+		*p.re = re
+	}
+	return f, nil
+}
+
+// write feeds f the output following what it was fed before.
+func (f *lineFilter) write(p []byte) {
+	for len(p) > 0 {
+		seg, end := p, false
+		if nl := bytes.IndexByte(p, '\n'); nl >= 0 {
+			seg, end = p[:nl+1], true
+		}
+		p = p[len(seg):]
+		f.fed += uint64(len(seg))
+
+		if f.decided { // the rest of a long line
+			if f.keep {
+				f.emit(seg)
+			}
+			f.decided = !end
+			continue
+		}
+		f.line = append(f.line, seg...)
+		if end || len(f.line) > maxFilterLine {
+			f.decide()
+			f.decided = !end
+		}
+	}
+}
+
+// flush decides a last line that has no newline.
+func (f *lineFilter) flush() {
+	if len(f.line) > 0 && !f.decided {
+		f.decide()
+	}
+}
+
+// decide sends or drops the line so far, matching it on its start.
+func (f *lineFilter) decide() {
+	text := bytes.TrimSuffix(f.line, []byte("\n"))
+	text = text[:min(len(text), maxFilterLine)]
+	f.keep = (f.include == nil || f.include.Match(text)) && (f.exclude == nil || !f.exclude.Match(text))
+	if f.keep {
+		f.emit(f.line)
+	} else {
+		f.suppressed++
+	}
+	f.line = f.line[:0]
+}
+
+func (f *lineFilter) emit(b []byte) {
+	if len(f.out) == 0 {
+		f.outOffset = f.fed - uint64(len(b))
+	}
+	f.out = append(f.out, b...)
+}
+
+// resume is where a stream picks up again: past every line f has sent or
+// dropped.
+func (f *lineFilter) resume() uint64 {
+	if f.decided {
+		return f.fed
+	}
+	return f.fed - uint64(len(f.line))
+}
+
+// sendFiltered is StreamOutput with a filter: it reads rc, the output
+// from offset start once skip bytes are skipped, and sends the lines f
+// keeps in chunks of up to cap(buf). Until done is closed it follows rc,
+// waking on grew or after idle. reads, if not nil, counts what is sent.
+func (m *Manager) sendFiltered(ctx context.Context, stream jobpb.JobWorker_StreamOutputServer, rc io.Reader, start, skip uint64, f *lineFilter,
+	buf []byte, done, grew <-chan struct{}, idle time.Duration, reads *outputReads) error {
+	f.fed = start
+	flush := m.opts.StreamFlushInterval
+	var pendingSince time.Time // when out got its oldest unsent byte
+	lastReport := time.Now()
+	send := func() error {
+		if len(f.out) == 0 && f.suppressed == 0 {
+			return nil
+		}
+		msg := &jobpb.StreamOutputResponse{
+			Chunk:           f.out,
+			Offset:          f.outOffset,
+			SuppressedLines: f.suppressed,
+			NextOffset:      f.resume(),
+		}
+		if len(f.out) == 0 {
+			msg.Offset = msg.NextOffset
+		}
+		err := stream.Send(msg)
+		if reads != nil {
+			reads.sent(len(f.out))
+		}
+		f.out, f.suppressed, lastReport = f.out[:0], 0, time.Now()
+		return err
+	}
+
+	finished := false
+	for {
+		n, err := rc.Read(buf[:cap(buf)])
+		if n > 0 {
+			p := buf[:n]
+			if skip > 0 {
+				k := min(skip, uint64(n))
+				skip -= k
+				p = p[k:]
+			}
+			had := len(f.out)
+			f.write(p)
+			if had == 0 && len(f.out) > 0 {
+				pendingSince = time.Now()
+			}
+			// Reading back a long run of dropped lines still reports them.
+			if len(f.out) >= cap(buf) || f.suppressed > 0 && time.Since(lastReport) >= filterReportInterval {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return status.Errorf(codes.Internal, "read output: %v", err)
+		}
+		if finished {
+			f.flush()
+			return send()
+		}
+
+		// Caught up: send kept lines once they have waited out the flush
+		// interval, and a count of dropped ones every filterReportInterval.
+		wait := idle
+		if len(f.out) > 0 || f.suppressed > 0 {
+			left := filterReportInterval - time.Since(lastReport)
+			if len(f.out) > 0 {
+				left = min(left, flush-time.Since(pendingSince))
+			}
+			if left <= 0 {
+				if err := send(); err != nil {
+					return err
+				}
+				continue
+			}
+			wait = min(wait, left)
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-done:
+			finished = true
+		case <-grew:
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bucknercd/jobworker/pkg/cgroups"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// footprint is what running jobs cost the server: goroutines and live
+// heap, measured after a GC.
+type footprint struct {
+	goroutines int
+	heap       uint64
+}
+
+func measure() footprint {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return footprint{goroutines: runtime.NumGoroutine(), heap: ms.HeapAlloc}
+}
+
+// startSleepers starts n real sleep jobs, unconfined and as the test's
+// user, and returns their IDs.
+func startSleepers(tb testing.TB, m *Manager, n int) []string {
+	tb.Helper()
+	ctx := WithUser(context.Background(), "bench")
+	ids := make([]string, n)
+	for i := range ids {
+		resp, err := m.StartJob(ctx, &jobpb.StartJobRequest{Executable: "sleep", Args: []string{"300"}})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		ids[i] = resp.GetJobId()
+	}
+	return ids
+}
+
+func stopAll(tb testing.TB, m *Manager, ids []string) {
+	tb.Helper()
+	ctx := WithUser(context.Background(), "bench")
+	for _, id := range ids {
+		if _, err := m.StopJob(ctx, &jobpb.StopJobRequest{JobId: id}); err != nil {
+			tb.Errorf("stop %s: %v", id, err)
+		}
+	}
+}
+
+func newExecManager(tb testing.TB, dir string) *Manager {
+	return NewManager(log.New(io.Discard, "", 0), Options{
+		JobsDirs: []string{dir},
+		Cgroups:  cgroups.Noop,
+		Credential: &syscall.Credential{
+			Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), NoSetGroups: true,
+		},
+	})
+}
+
+// waitRunning waits for the launch goroutines of just-started jobs to
+// finish, so they aren't counted.
+func waitRunning(tb testing.TB, m *Manager, n int) {
+	tb.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for m.Running() < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d of %d jobs running", m.Running(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRunningJobsHoldNoGoroutines checks that a running job holds no
+// goroutine of its own: exits are reaped by one shared epoll loop.
+func TestRunningJobsHoldNoGoroutines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts real processes")
+	}
+	m := newExecManager(t, t.TempDir())
+	const n = 200
+	before := measure()
+	ids := startSleepers(t, m, n)
+	defer stopAll(t, m, ids)
+	waitRunning(t, m, n)
+	after := measure()
+
+	// The reaper's loop, and little else, comes with the first job.
+	if grown := after.goroutines - before.goroutines; grown > 5 {
+		t.Errorf("%d running jobs added %d goroutines", n, grown)
+	}
+}
+
+// BenchmarkRunningJobs reports what each running job costs the server,
+// as goroutines/job and heap-B/job. Each op starts 500 sleep jobs, then
+// stops them.
+func BenchmarkRunningJobs(b *testing.B) {
+	const n = 500
+	m := newExecManager(b, b.TempDir())
+	var goroutines, heap float64
+	for i := 0; i < b.N; i++ {
+		before := measure()
+		ids := startSleepers(b, m, n)
+		waitRunning(b, m, n)
+		after := measure()
+		goroutines += float64(after.goroutines-before.goroutines) / n
+		heap += (float64(after.heap) - float64(before.heap)) / n
+		b.StopTimer()
+		stopAll(b, m, ids)
+		b.StartTimer()
+	}
+	b.ReportMetric(goroutines/float64(b.N), "goroutines/job")
+	b.ReportMetric(heap/float64(b.N), "heap-B/job")
+}
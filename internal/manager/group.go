@@ -0,0 +1,183 @@
+package manager
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// maxGroupSize caps the jobs in one StartJobs call.
+const maxGroupSize = 1000
+
+// CheckStartJobs rejects StartJobs requests that can't be started as a
+// group, before anything is started.
+func CheckStartJobs(req *jobpb.StartJobsRequest) error {
+	switch n := len(req.GetJobs()); {
+	case n == 0:
+		return status.Error(codes.InvalidArgument, "jobs required")
+	case n > maxGroupSize:
+		return status.Errorf(codes.InvalidArgument, "%d jobs exceeds the group limit of %d", n, maxGroupSize)
+	}
+	for i, r := range req.GetJobs() {
+		if r.GetValidateOnly() {
+			return status.Errorf(codes.InvalidArgument, "jobs[%d]: validate_only is not supported by StartJobs", i)
+		}
+	}
+	return nil
+}
+
+// GroupMember returns a copy of the i'th job of req as a member of group.
+func GroupMember(req *jobpb.StartJobsRequest, i int, group string) *jobpb.StartJobRequest {
+	r := proto.Clone(req.GetJobs()[i]).(*jobpb.StartJobRequest)
+	r.GroupId = group
+	return r
+}
+
+// MemberError wraps the error that stopped a StartJobs at job i, keeping
+// its code.
+func MemberError(i int, err error) error {
+	st := status.Convert(err)
+	return status.Errorf(st.Code(), "jobs[%d]: %s", i, st.Message())
+}
+
+// StartJobs starts req's jobs in order as one new group. If one fails, the
+// ones already started are stopped and the error is returned.
+func (m *Manager) StartJobs(ctx context.Context, req *jobpb.StartJobsRequest) (*jobpb.StartJobsResponse, error) {
+	if err := CheckStartJobs(req); err != nil {
+		return nil, err
+	}
+	resp := &jobpb.StartJobsResponse{GroupId: uuid.New().String()}
+	for i := range req.GetJobs() {
+		out, err := m.start(ctx, GroupMember(req, i, resp.GroupId), nil)
+		if err != nil {
+			for _, id := range resp.JobIds {
+				if j := m.getJob(id); j != nil {
+					if _, err := j.Stop(); err != nil {
+						m.logger.Printf("group %s: stop job %s after failed start: %v", resp.GroupId, id, err)
+					}
+				}
+			}
+			return nil, MemberError(i, err)
+		}
+		resp.JobIds = append(resp.JobIds, out.GetJobId())
+	}
+	return resp, nil
+}
+
+// GetGroupStatus reports the group's members and their outcomes.
+func (m *Manager) GetGroupStatus(ctx context.Context, req *jobpb.GetGroupStatusRequest) (*jobpb.GroupStatus, error) {
+	members, err := m.groupMembers(ctx, req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+	return m.groupStatus(req.GetGroupId(), members), nil
+}
+
+// StopGroup stops every member not yet terminal, and reports the group as
+// StopJob reports a job: stopping, not necessarily stopped.
+func (m *Manager) StopGroup(ctx context.Context, req *jobpb.StopGroupRequest) (*jobpb.GroupStatus, error) {
+	members, err := m.groupMembers(ctx, req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range members {
+		if _, err := j.Stop(); err != nil {
+			return nil, status.Errorf(codes.Internal, "stop job %s: %v", j.ID(), err)
+		}
+	}
+	return m.groupStatus(req.GetGroupId(), members), nil
+}
+
+// WaitGroup blocks until every member is terminal or ctx is done.
+func (m *Manager) WaitGroup(ctx context.Context, req *jobpb.WaitGroupRequest) (*jobpb.GroupStatus, error) {
+	members, err := m.groupMembers(ctx, req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range members {
+		if j.Status() == joblib.StatusUnknown && !j.queued() {
+			return nil, status.Errorf(codes.FailedPrecondition, "job %s was created but never started", j.ID())
+		}
+		select {
+		case <-j.Done():
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	return m.groupStatus(req.GetGroupId(), members), nil
+}
+
+// groupMembers returns the members of group id the caller in ctx may
+// reach (see WithScope). A group with none is NOT_FOUND, as if it didn't
+// exist.
+func (m *Manager) groupMembers(ctx context.Context, id string) ([]*managedJob, error) {
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "group_id required")
+	}
+	members := m.jobs.filter(func(j *managedJob) bool { return j.group == id && reaches(ctx, j) })
+	if len(members) == 0 {
+		return nil, status.Error(codes.NotFound, "group not found")
+	}
+	return members, nil
+}
+
+// checkJoin rejects a job for owner in namespace ns that names group id
+// when someone else's jobs, or jobs in another namespace, are in it.
+func (m *Manager) checkJoin(id, owner, ns string) error {
+	if id == "" {
+		return nil
+	}
+	others := m.jobs.filter(func(j *managedJob) bool {
+		return j.group == id && (j.owner != owner || j.namespace != ns)
+	})
+	if len(others) > 0 {
+		return status.Errorf(codes.PermissionDenied, "group %s belongs to another user", id)
+	}
+	return nil
+}
+
+func (m *Manager) groupStatus(id string, members []*managedJob) *jobpb.GroupStatus {
+	jobs := make([]*jobpb.JobSummary, len(members))
+	for i, j := range members {
+		jobs[i] = m.summary(j)
+	}
+	return GroupStatusOf(id, jobs)
+}
+
+// GroupStatusOf counts a group's members by outcome. The coordinator uses
+// it to merge what each node reports.
+func GroupStatusOf(id string, jobs []*jobpb.JobSummary) *jobpb.GroupStatus {
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].GetStartedAt().AsTime().Before(jobs[b].GetStartedAt().AsTime())
+	})
+	gs := &jobpb.GroupStatus{GroupId: id, Total: int32(len(jobs)), Jobs: jobs, Done: true}
+	for _, j := range jobs {
+		md := j.GetMetadata()
+		switch md.GetStatus() {
+		case jobpb.JobStatus_JOB_STATUS_CREATED:
+			gs.Created++
+			gs.Done = false
+		case jobpb.JobStatus_JOB_STATUS_STARTING, jobpb.JobStatus_JOB_STATUS_RUNNING, jobpb.JobStatus_JOB_STATUS_STOPPING:
+			gs.Running++
+			gs.Done = false
+		case jobpb.JobStatus_JOB_STATUS_EXITED:
+			if md.GetExitCode() == 0 {
+				gs.Succeeded++
+			} else {
+				gs.Failed++
+			}
+		case jobpb.JobStatus_JOB_STATUS_FAILED:
+			gs.Failed++
+		case jobpb.JobStatus_JOB_STATUS_STOPPED:
+			gs.Stopped++
+		}
+	}
+	return gs
+}
@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// TestGroupAccess checks that group calls reach only the caller's own
+// members, and that a job can't join someone else's group.
+func TestGroupAccess(t *testing.T) {
+	m, _ := newFakeManager(t)
+	alice := WithScope(WithUser(context.Background(), "alice"), DefaultNamespace, false)
+	bob := WithScope(WithUser(context.Background(), "bob"), DefaultNamespace, false)
+	aliceInTeamA := WithScope(WithUser(context.Background(), "alice"), "team-a", false)
+	admin := WithScope(WithUser(context.Background(), "carol"), DefaultNamespace, true)
+
+	resp, err := m.StartJobs(alice, &jobpb.StartJobsRequest{Jobs: []*jobpb.StartJobRequest{
+		{Executable: "/bin/true"}, {Executable: "/bin/true"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := resp.GetGroupId()
+
+	for name, ctx := range map[string]context.Context{"owner": alice, "admin": admin} {
+		gs, err := m.GetGroupStatus(ctx, &jobpb.GetGroupStatusRequest{GroupId: group})
+		if err != nil {
+			t.Fatalf("%s: GetGroupStatus: %v", name, err)
+		}
+		if n := len(gs.GetJobs()); n != 2 {
+			t.Errorf("%s: %d members, want 2", name, n)
+		}
+	}
+	for name, ctx := range map[string]context.Context{"other user": bob, "other namespace": aliceInTeamA, "no scope": context.Background()} {
+		if _, err := m.GetGroupStatus(ctx, &jobpb.GetGroupStatusRequest{GroupId: group}); status.Code(err) != codes.NotFound {
+			t.Errorf("%s: GetGroupStatus: %v, want NOT_FOUND", name, err)
+		}
+		if _, err := m.StopGroup(ctx, &jobpb.StopGroupRequest{GroupId: group}); status.Code(err) != codes.NotFound {
+			t.Errorf("%s: StopGroup: %v, want NOT_FOUND", name, err)
+		}
+		if _, err := m.WaitGroup(ctx, &jobpb.WaitGroupRequest{GroupId: group}); status.Code(err) != codes.NotFound {
+			t.Errorf("%s: WaitGroup: %v, want NOT_FOUND", name, err)
+		}
+	}
+
+	join := &jobpb.StartJobRequest{Executable: "/bin/true", GroupId: group}
+	if _, err := m.StartJob(bob, join); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("bob joining alice's group: %v, want PERMISSION_DENIED", err)
+	}
+	if _, err := m.CreateJob(bob, join); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("bob creating a job in alice's group: %v, want PERMISSION_DENIED", err)
+	}
+	if _, err := m.StartJob(alice, join); err != nil {
+		t.Errorf("alice joining her own group: %v", err)
+	}
+}
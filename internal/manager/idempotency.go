@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// idempotencyTTL is how long a StartJobRequest.idempotency_key is
+// remembered after the job it started.
+const idempotencyTTL = 24 * time.Hour
+
+// IdempotencyKeys remembers which job each owner's idempotency key
+// started, so a retried start gets that job back. The manager and the
+// coordinator each keep one; keys don't survive a restart.
+type IdempotencyKeys struct {
+	mu   sync.Mutex
+	keys map[idemKey]*idemEntry
+	now  func() time.Time
+}
+
+type idemKey struct{ owner, key string }
+
+type idemEntry struct {
+	sum     [sha256.Size]byte // of the request, to catch a key reused for another
+	jobID   string            // empty while the first call is in progress
+	expires time.Time
+}
+
+func NewIdempotencyKeys() *IdempotencyKeys {
+	return &IdempotencyKeys{keys: make(map[idemKey]*idemEntry), now: time.Now}
+}
+
+// Begin claims req's idempotency key for owner's call to method. If an
+// earlier call with the same key started a job, Begin returns its id and
+// the caller should answer with that. Otherwise the caller starts the job
+// and calls done with its id, or with "" if it failed, which frees the key
+// for a retry. Without a key Begin does nothing.
+func (k *IdempotencyKeys) Begin(owner, method string, req *jobpb.StartJobRequest, script []byte) (jobID string, done func(jobID string), err error) {
+	key := req.GetIdempotencyKey()
+	if key == "" || req.GetValidateOnly() {
+		return "", func(string) {}, nil
+	}
+	sum := requestSum(method, req, script)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	for ik, e := range k.keys {
+		if e.jobID != "" && now.After(e.expires) {
+			delete(k.keys, ik)
+		}
+	}
+	ik := idemKey{owner, key}
+	if e, ok := k.keys[ik]; ok {
+		switch {
+		case e.sum != sum:
+			return "", nil, status.Error(codes.AlreadyExists, "idempotency key was already used for a different request")
+		case e.jobID == "":
+			return "", nil, status.Error(codes.Aborted, "a call with this idempotency key is still in progress")
+		}
+		return e.jobID, nil, nil
+	}
+
+	e := &idemEntry{sum: sum}
+	k.keys[ik] = e
+	return "", func(jobID string) {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if jobID == "" {
+			delete(k.keys, ik)
+			return
+		}
+		e.jobID, e.expires = jobID, k.now().Add(idempotencyTTL)
+	}, nil
+}
+
+// Forget drops the key that started jobID, once the job itself is gone.
+func (k *IdempotencyKeys) Forget(jobID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for ik, e := range k.keys {
+		if e.jobID == jobID {
+			delete(k.keys, ik)
+		}
+	}
+}
+
+// requestSum fingerprints what a start asks for, key aside.
+func requestSum(method string, req *jobpb.StartJobRequest, script []byte) [sha256.Size]byte {
+	req = proto.Clone(req).(*jobpb.StartJobRequest)
+	req.IdempotencyKey = ""
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	h := sha256.New()
+	h.Write([]byte(method + "\x00"))
+	h.Write(b)
+	h.Write(script)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// jobShards is how many pieces the job index is split into. Lookups by id
+// (every GetStatus, stream and stop) only lock the shard the id hashes to,
+// so they don't queue behind each other, StartJob or a full scan.
+const jobShards = 64
+
+// jobIndex maps job ids to jobs. Scans lock one shard at a time, so they
+// see a consistent view of each shard but not of the whole index; callers
+// that need the index to hold still (admission) serialize on m.mu instead.
+type jobIndex struct {
+	seed   maphash.Seed
+	shards [jobShards]jobShard
+}
+
+type jobShard struct {
+	mu   sync.RWMutex
+	jobs map[string]*managedJob
+}
+
+func newJobIndex() *jobIndex {
+	x := &jobIndex{seed: maphash.MakeSeed()}
+	for i := range x.shards {
+		x.shards[i].jobs = make(map[string]*managedJob)
+	}
+	return x
+}
+
+func (x *jobIndex) shard(id string) *jobShard {
+	return &x.shards[maphash.String(x.seed, id)%jobShards]
+}
+
+func (x *jobIndex) get(id string) *managedJob {
+	s := x.shard(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.jobs[id]
+}
+
+func (x *jobIndex) add(j *managedJob) {
+	s := x.shard(j.ID())
+	s.mu.Lock()
+	s.jobs[j.ID()] = j
+	s.mu.Unlock()
+}
+
+// remove drops j, and reports whether it was still there: false means a
+// concurrent DeleteJob or GC got it first.
+func (x *jobIndex) remove(j *managedJob) bool {
+	s := x.shard(j.ID())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs[j.ID()] != j {
+		return false
+	}
+	delete(s.jobs, j.ID())
+	return true
+}
+
+// removeIf drops and returns every job match selects.
+func (x *jobIndex) removeIf(match func(*managedJob) bool) []*managedJob {
+	var out []*managedJob
+	for i := range x.shards {
+		s := &x.shards[i]
+		s.mu.Lock()
+		for id, j := range s.jobs {
+			if match(j) {
+				out = append(out, j)
+				delete(s.jobs, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return out
+}
+
+// filter returns every job match selects; a nil match selects all.
+func (x *jobIndex) filter(match func(*managedJob) bool) []*managedJob {
+	var out []*managedJob
+	for i := range x.shards {
+		s := &x.shards[i]
+		s.mu.RLock()
+		for _, j := range s.jobs {
+			if match == nil || match(j) {
+				out = append(out, j)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return out
+}
+
+func (x *jobIndex) len() int {
+	n := 0
+	for i := range x.shards {
+		s := &x.shards[i]
+		s.mu.RLock()
+		n += len(s.jobs)
+		s.mu.RUnlock()
+	}
+	return n
+}
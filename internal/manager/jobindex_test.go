@@ -0,0 +1,156 @@
+package manager
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+)
+
+// mutexIndex is the job index as it was before sharding: one map behind
+// one RWMutex. The benchmarks compare jobIndex against it.
+type mutexIndex struct {
+	mu   sync.RWMutex
+	jobs map[string]*managedJob
+}
+
+func (x *mutexIndex) get(id string) *managedJob {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.jobs[id]
+}
+
+func (x *mutexIndex) add(j *managedJob) {
+	x.mu.Lock()
+	x.jobs[j.ID()] = j
+	x.mu.Unlock()
+}
+
+func (x *mutexIndex) filter(match func(*managedJob) bool) []*managedJob {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var out []*managedJob
+	for _, j := range x.jobs {
+		if match == nil || match(j) {
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+type index interface {
+	get(id string) *managedJob
+	add(j *managedJob)
+	filter(match func(*managedJob) bool) []*managedJob
+}
+
+var indexes = []struct {
+	name string
+	make func() index
+}{
+	{"sharded", func() index { return newJobIndex() }},
+	{"mutex", func() index { return &mutexIndex{jobs: make(map[string]*managedJob)} }},
+}
+
+// benchJobs makes n jobs that never run, owned by one of 10 users.
+func benchJobs(b *testing.B, n int) []*managedJob {
+	b.Helper()
+	out := make([]*managedJob, n)
+	for i := range out {
+		job, err := joblib.New(joblib.Options{
+			ID:      "job-" + strconv.Itoa(i),
+			Command: "/bin/true",
+			Backend: func(joblib.Options) (joblib.Backend, error) { return &fakeBackend{exited: make(chan struct{})}, nil },
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		out[i] = &managedJob{Job: job, owner: "user" + strconv.Itoa(i%10)}
+	}
+	return out
+}
+
+// BenchmarkJobIndexGet looks jobs up by ID from every P at once, as
+// concurrent GetStatus calls do, while one goroutine keeps adding jobs,
+// as StartJob does.
+func BenchmarkJobIndexGet(b *testing.B) {
+	jobs := benchJobs(b, 10000)
+	extra := benchJobs(b, 1000)
+	for _, ix := range indexes {
+		b.Run(ix.name, func(b *testing.B) {
+			x := ix.make()
+			for _, j := range jobs {
+				x.add(j)
+			}
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+						x.add(extra[i%len(extra)])
+					}
+				}
+			}()
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(7919))
+				for pb.Next() {
+					if x.get(jobs[i%len(jobs)].ID()) == nil {
+						b.Error("job not found")
+					}
+					i++
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkJobIndexAdd adds jobs from every P at once.
+func BenchmarkJobIndexAdd(b *testing.B) {
+	jobs := benchJobs(b, 10000)
+	for _, ix := range indexes {
+		b.Run(ix.name, func(b *testing.B) {
+			x := ix.make()
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(7919))
+				for pb.Next() {
+					x.add(jobs[i%len(jobs)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkJobIndexFilter selects one user's jobs, as ListJobs does.
+func BenchmarkJobIndexFilter(b *testing.B) {
+	jobs := benchJobs(b, 10000)
+	for _, ix := range indexes {
+		b.Run(ix.name, func(b *testing.B) {
+			x := ix.make()
+			for _, j := range jobs {
+				x.add(j)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if got := x.filter(func(j *managedJob) bool { return j.owner == "user3" }); len(got) != len(jobs)/10 {
+					b.Fatalf("%d jobs, want %d", len(got), len(jobs)/10)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+)
+
+// With Options.FastAccept, StartJob stops short of launching: making the
+// job's cgroup, directories and output files and exec'ing it all block on
+// the filesystem, and under a burst of submissions they are what the
+// callers wait on. Instead the job is queued, StartJob returns it as
+// STARTING, and a fixed pool of launch workers works through the queue.
+
+const (
+	// defaultLaunchWorkers is how many jobs are launched at once when
+	// Options.LaunchWorkers is unset.
+	defaultLaunchWorkers = 8
+
+	// launchBacklog is how many queued jobs each launch worker may have
+	// waiting before StartJob blocks for room.
+	launchBacklog = 64
+)
+
+// launch is a job waiting for a launch worker, and the release of the
+// admission it holds until it is launched.
+type launch struct {
+	job     *managedJob
+	release func()
+	at      time.Time // when it was queued
+}
+
+func (m *Manager) startLaunchWorkers() {
+	n := m.opts.LaunchWorkers
+	if n <= 0 {
+		n = defaultLaunchWorkers
+	}
+	m.launches = make(chan launch, n*launchBacklog)
+	for range n {
+		go func() {
+			for l := range m.launches {
+				m.launch(l)
+			}
+		}()
+	}
+}
+
+// enqueue hands job, created to be queued, to the launch workers; they
+// release its admission. If ctx ends first, job is stopped and forgotten,
+// as its caller never learns its id.
+func (m *Manager) enqueue(ctx context.Context, job *managedJob, release func()) error {
+	select {
+	case m.launches <- launch{job, release, time.Now()}:
+		return nil
+	case <-ctx.Done():
+		job.StopWithReason("start abandoned by caller")
+		m.jobs.remove(job)
+		close(job.launching)
+		release()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// launch starts a queued job. One that fails to start stays listed as
+// FAILED, as after StartCreatedJob; one stopped while it waited is already
+// STOPPED and isn't started.
+func (m *Manager) launch(l launch) {
+	defer l.release()
+	defer close(l.job.launching)
+	queued := time.Since(l.at)
+	l.job.times.queued.Store(int64(queued))
+	m.observe("queued", queued)
+	l.job.Start()
+}
+
+// awaitLaunch waits until a fast-accepted job has left the launch queue,
+// so its output files exist. Other jobs return at once.
+func (m *Manager) awaitLaunch(ctx context.Context, j *managedJob) error {
+	if j.launching == nil {
+		return nil
+	}
+	select {
+	case <-j.launching:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// queued reports whether j was fast-accepted and is still waiting to be
+// launched.
+func (j *managedJob) queued() bool {
+	return j.launching != nil && j.Status() == joblib.StatusUnknown
+}
@@ -0,0 +1,179 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/lineindex"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// Line-based reads (StreamOutput's tail_lines and since_line,
+// CountOutputLines) find their lines with a lineindex kept next to each
+// output file, so the newlines of a multi-GB log are counted once, not on
+// every query. Encrypted output and output kept on another host aren't
+// indexed, nor is archived output; they are counted from the start each
+// time.
+
+// outputIndexes are a job's line indexes, made on first use.
+type outputIndexes struct {
+	mu sync.Mutex
+	ix [2]*lineindex.Index // stdout, stderr
+}
+
+// lineIndex returns the index of j's stdout or stderr, or nil when that
+// output isn't indexed.
+func (m *Manager) lineIndex(j *managedJob, stderr bool) *lineindex.Index {
+	path, ok := j.OutputPath(stderr)
+	if !ok || m.opts.OutputKey != nil {
+		return nil
+	}
+	i := 0
+	if stderr {
+		i = 1
+	}
+	j.indexes.mu.Lock()
+	defer j.indexes.mu.Unlock()
+	if j.indexes.ix[i] == nil {
+		j.indexes.ix[i] = lineindex.New(path)
+	}
+	return j.indexes.ix[i]
+}
+
+// streamStart is the byte offset req asks StreamOutput to start at in the
+// output open opens, using ix when it isn't nil.
+func (m *Manager) streamStart(ctx context.Context, req *jobpb.StreamOutputRequest, ix *lineindex.Index, open openOutput) (uint64, error) {
+	set := 0
+	for _, v := range []uint64{req.GetOffset(), req.GetTailLines(), req.GetSinceLine()} {
+		if v > 0 {
+			set++
+		}
+	}
+	if set > 1 {
+		return 0, status.Error(codes.InvalidArgument, "set at most one of offset, tail_lines and since_line")
+	}
+	tail, since := req.GetTailLines(), req.GetSinceLine()
+	if tail == 0 && since == 0 {
+		return req.GetOffset(), nil
+	}
+
+	var (
+		off uint64
+		err error
+	)
+	if ix != nil {
+		if tail > 0 {
+			off, err = ix.TailOffset(ctx, tail)
+		} else {
+			off, err = ix.Offset(ctx, since)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return off, lineError(err)
+		}
+		// Compressed since the index was made; read it instead.
+	}
+	if tail > 0 {
+		var lines uint64
+		if lines, _, err = countLines(ctx, open); err == nil && tail < lines {
+			off, err = findLine(ctx, open, lines-tail+1)
+		}
+	} else {
+		off, err = findLine(ctx, open, since)
+	}
+	return off, lineError(err)
+}
+
+// CountOutputLines counts the lines of a job's stored output.
+func (m *Manager) CountOutputLines(ctx context.Context, req *jobpb.CountOutputLinesRequest) (*jobpb.CountOutputLinesResponse, error) {
+	stderr := req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		if !m.isArchived(ctx, req.GetJobId()) {
+			return nil, m.notFound(req.GetJobId())
+		}
+		lines, size, err := countLines(ctx, m.archivedOutput(ctx, req.GetJobId(), stderr))
+		if err != nil {
+			return nil, lineError(err)
+		}
+		return &jobpb.CountOutputLinesResponse{Lines: lines, Bytes: size}, nil
+	}
+	if err := m.awaitLaunch(ctx, job); err != nil {
+		return nil, err
+	}
+	var lines, size uint64
+	err := os.ErrNotExist
+	if ix := m.lineIndex(job, stderr); ix != nil {
+		lines, size, err = ix.Lines(ctx)
+	}
+	if errors.Is(err, os.ErrNotExist) { // unindexed, or compressed
+		lines, size, err = countLines(ctx, job.output(stderr))
+	}
+	if err != nil {
+		return nil, lineError(err)
+	}
+	return &jobpb.CountOutputLinesResponse{Lines: lines, Bytes: size}, nil
+}
+
+// dropLineIndexes removes the indexes of j's output files that are gone,
+// compressed or removed.
+func (j *managedJob) dropLineIndexes() {
+	j.indexes.mu.Lock()
+	defer j.indexes.mu.Unlock()
+	for i, stderr := range []bool{false, true} {
+		path, ok := j.OutputPath(stderr)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			os.Remove(lineindex.SidecarPath(path))
+			j.indexes.ix[i] = nil
+		}
+	}
+}
+
+// openOutput opens a job's stdout or stderr from the start.
+type openOutput func() (io.ReadCloser, error)
+
+// output opens j's stdout or stderr.
+func (j *managedJob) output(stderr bool) openOutput {
+	return func() (io.ReadCloser, error) { return j.OpenOutput(stderr) }
+}
+
+// countLines and findLine read unindexed output from the start.
+func countLines(ctx context.Context, open openOutput) (lines, size uint64, err error) {
+	rc, err := open()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rc.Close()
+	return lineindex.Count(ctx, rc)
+}
+
+func findLine(ctx context.Context, open openOutput, n uint64) (uint64, error) {
+	rc, err := open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return lineindex.Find(ctx, rc, n)
+}
+
+// lineError maps an error finding lines in output to its status; nil stays
+// nil.
+func lineError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return status.Error(codes.FailedPrecondition, "job output not available")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Errorf(codes.Internal, "read output: %v", err)
+}
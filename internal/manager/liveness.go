@@ -0,0 +1,191 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/events"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+const (
+	// minStallWindow keeps the liveness check from firing on jobs that are
+	// merely between two writes.
+	minStallWindow = 10 * time.Second
+
+	// maxLivenessInterval bounds how late a stall is noticed.
+	maxLivenessInterval = 30 * time.Second
+)
+
+// checkLiveness validates a StartJobRequest's liveness policy.
+func checkLiveness(p *jobpb.LivenessPolicy) error {
+	if p == nil {
+		return nil
+	}
+	if window := time.Duration(p.GetStallSeconds()) * time.Second; window < minStallWindow {
+		return status.Errorf(codes.InvalidArgument, "liveness.stall_seconds must be at least %d", int(minStallWindow.Seconds()))
+	}
+	return nil
+}
+
+// progress is what a job has produced so far, as the liveness check sees it.
+type progress struct {
+	at       time.Time
+	output   int64  // bytes in its output files
+	cpuUsec  uint64 // cgroup CPU usage
+	measured bool   // cpuUsec could be read
+}
+
+// sampleProgress measures j's output and CPU use now.
+func sampleProgress(j *managedJob, now time.Time) progress {
+	p := progress{at: now}
+	for _, stderr := range []bool{false, true} {
+		if path, ok := j.OutputPath(stderr); ok {
+			if fi, err := os.Stat(path); err == nil {
+				p.output += fi.Size()
+			}
+		}
+	}
+	if stats, err := j.Stats(); err == nil {
+		p.cpuUsec, p.measured = stats.CPUUsageUsec, true
+	}
+	return p
+}
+
+// livenessTick is how often the shared sampler looks for jobs due a
+// sample, and so the most a sample can be late by.
+const livenessTick = time.Second
+
+// livenessWorkers bounds how many jobs are sampled at once.
+const livenessWorkers = 8
+
+// livenessWatches are the jobs with a LivenessPolicy. One goroutine
+// samples them all, each at its own interval, rather than one per job.
+type livenessWatches struct {
+	once    sync.Once
+	mu      sync.Mutex
+	watches map[*managedJob]*livenessWatch
+}
+
+// livenessWatch is one job's policy and what the sampler last saw of it.
+type livenessWatch struct {
+	j        *managedJob
+	policy   *jobpb.LivenessPolicy
+	window   time.Duration
+	interval time.Duration
+	last     progress // zero until the job is launched
+	next     time.Time
+}
+
+// watchLiveness adds j to the sampler, starting the sampler with the
+// first job.
+func (m *Manager) watchLiveness(j *managedJob, policy *jobpb.LivenessPolicy) {
+	ws := &m.liveness
+	ws.once.Do(func() {
+		ws.watches = make(map[*managedJob]*livenessWatch)
+		go m.livenessLoop()
+	})
+	window := time.Duration(policy.GetStallSeconds()) * time.Second
+	ws.mu.Lock()
+	ws.watches[j] = &livenessWatch{j: j, policy: policy, window: window, interval: min(window/10, maxLivenessInterval)}
+	ws.mu.Unlock()
+}
+
+// due returns the watches whose sample is due at now, dropping those of
+// jobs that are done. A job not launched yet is skipped.
+func (ws *livenessWatches) due(now time.Time) []*livenessWatch {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	var out []*livenessWatch
+	for j, w := range ws.watches {
+		select {
+		case <-j.Done():
+			delete(ws.watches, j)
+			continue
+		case <-j.launched:
+		default:
+			continue
+		}
+		if !now.Before(w.next) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+func (ws *livenessWatches) drop(j *managedJob) {
+	ws.mu.Lock()
+	delete(ws.watches, j)
+	ws.mu.Unlock()
+}
+
+// livenessLoop samples every due watch each livenessTick, livenessWorkers
+// at a time, until the process exits.
+func (m *Manager) livenessLoop() {
+	t := time.NewTicker(livenessTick)
+	defer t.Stop()
+	for now := range t.C {
+		due := m.liveness.due(now)
+		sem := make(chan struct{}, livenessWorkers)
+		var wg sync.WaitGroup
+		for _, w := range due {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				m.sampleLiveness(w, now)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// sampleLiveness checks one running job's progress. Each time the job
+// goes a whole window without progress it is marked stalled and a
+// job.stalled event is emitted; with policy.stop it is then stopped.
+// Progress clears the mark. Backends that keep output elsewhere are judged
+// on CPU alone.
+func (m *Manager) sampleLiveness(w *livenessWatch, now time.Time) {
+	j, policy := w.j, w.policy
+	w.next = now.Add(w.interval)
+	cur := sampleProgress(j, now)
+	if w.last.at.IsZero() {
+		w.last = cur // first sample since launch
+		return
+	}
+	if cur.output != w.last.output || (cur.measured && w.last.measured && cur.cpuUsec-w.last.cpuUsec > policy.GetMinCpuUsec()) {
+		w.last = cur
+		j.stalled.Store(false)
+		return
+	}
+	if now.Sub(w.last.at) < w.window || j.stalled.Load() {
+		return
+	}
+	j.stalled.Store(true)
+	msg := stallMessage(policy)
+	m.logger.Printf("job %s: stalled: %s", j.ID(), msg)
+	m.emit(events.Event{Time: now.UTC(), Type: events.TypeJobStalled, JobID: j.ID(), Status: j.Status().String(), ExitCode: j.ExitCode(), Message: msg})
+	j.span.AddEvent("job.stalled")
+	if policy.GetStop() {
+		m.liveness.drop(j)
+		// Stop waits for the job to be reaped; don't hold a worker for it.
+		go func() {
+			if _, err := j.StopWithReason("stopped: stalled, " + msg); err != nil {
+				m.logger.Printf("job %s: stop stalled job: %v", j.ID(), err)
+			}
+		}()
+	}
+}
+
+func stallMessage(policy *jobpb.LivenessPolicy) string {
+	window := time.Duration(policy.GetStallSeconds()) * time.Second
+	if policy.GetMinCpuUsec() == 0 {
+		return fmt.Sprintf("no output or CPU use for %s", window)
+	}
+	return fmt.Sprintf("no output and at most %s of CPU for %s", time.Duration(policy.GetMinCpuUsec())*time.Microsecond, window)
+}
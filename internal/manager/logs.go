@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/cluster"
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// jobsScanInterval is how often a following StreamJobsOutput looks for new
+// jobs matching its selector.
+const jobsScanInterval = time.Second
+
+// StreamJobsOutput sends the output of every launched job matching
+// req.selector (and req.owner, already scoped by the caller), tagged with
+// the job id. See StreamJobsOutputRequest for follow semantics.
+func (m *Manager) StreamJobsOutput(req *jobpb.StreamJobsOutputRequest, stream jobpb.JobWorker_StreamJobsOutputServer) error {
+	stderr := req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR
+	// Send has encoded msg by the time it returns, so msg, and the chunk
+	// buffer it points at, can be reused for the next one.
+	var mu sync.Mutex
+	msg := &jobpb.JobOutputChunk{Node: m.opts.NodeName}
+	send := func(id string, b []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		msg.JobId, msg.Chunk = id, b
+		return stream.Send(msg)
+	}
+
+	if !req.GetFollow() {
+		for _, j := range m.labeledJobs(req) {
+			if err := m.sendLines(stream.Context(), j, stderr, false, send); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		errc = make(chan error, 1)
+		seen = make(map[string]bool)
+	)
+	tick := time.NewTicker(jobsScanInterval)
+	defer tick.Stop()
+	for ctx.Err() == nil {
+		for _, j := range m.labeledJobs(req) {
+			if seen[j.ID()] {
+				continue
+			}
+			seen[j.ID()] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := m.sendLines(ctx, j, stderr, true, send); err != nil {
+					select {
+					case errc <- err:
+					default:
+					}
+					cancel()
+				}
+			}()
+		}
+		select {
+		case <-ctx.Done():
+		case <-tick.C:
+		}
+	}
+	wg.Wait()
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return status.FromContextError(stream.Context().Err()).Err()
+	}
+}
+
+// labeledJobs returns the launched jobs req selects, oldest first.
+func (m *Manager) labeledJobs(req *jobpb.StreamJobsOutputRequest) []*managedJob {
+	jobs := m.jobs.filter(func(j *managedJob) bool {
+		return (req.GetOwner() == "" || j.owner == req.GetOwner()) &&
+			cluster.Matches(j.labels, req.GetSelector()) &&
+			j.Status() != joblib.StatusUnknown
+	})
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].startedAt.Before(jobs[b].startedAt) })
+	return jobs
+}
+
+// sendLines sends one job's output in chunks that end on line boundaries,
+// stopping at the end of the file, or with follow once the job is done and
+// drained. A job whose output is gone (garbage-collected) sends nothing.
+// The chunk passed to send is reused once send returns.
+func (m *Manager) sendLines(ctx context.Context, job *managedJob, stderr, follow bool, send func(string, []byte) error) error {
+	rc, err := job.OpenOutput(stderr)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return status.Errorf(codes.Internal, "job %s: open output: %v", job.ID(), err)
+	}
+	defer rc.Close()
+
+	job.streams.Add(1)
+	defer job.streams.Add(-1)
+	job.reads.count.Add(1)
+
+	idle := streamPollInterval
+	var grew <-chan struct{}
+	if path, ok := job.OutputPath(stderr); ok && follow && m.notifier != nil {
+		if w, err := m.notifier.Watch(path); err == nil {
+			defer w.Close()
+			grew, idle = w.C, streamWatchedPoll
+		}
+	}
+
+	pooled := m.chunkBuf()
+	defer m.putChunkBuf(pooled)
+	buf := *pooled
+	// flush sends buf up to its last newline (all of it when full or
+	// final) and keeps the rest for the next read.
+	flush := func(final bool) error {
+		n := len(buf)
+		if !final && n < cap(buf) {
+			n = bytes.LastIndexByte(buf, '\n') + 1
+		}
+		if n == 0 {
+			return nil
+		}
+		if err := send(job.ID(), buf[:n]); err != nil {
+			return err
+		}
+		job.reads.sent(n)
+		buf = buf[:copy(buf, buf[n:])]
+		return nil
+	}
+
+	done := false
+	for {
+		n, err := rc.Read(buf[len(buf):cap(buf)])
+		if n > 0 {
+			buf = buf[:len(buf)+n]
+			if err := flush(false); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return status.Errorf(codes.Internal, "job %s: read output: %v", job.ID(), err)
+		}
+		if done || !follow {
+			return flush(true)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-job.Done():
+			// Writers are closed; one more pass drains whatever is left.
+			done = true
+		case <-grew:
+		case <-time.After(idle):
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/logsink"
+)
+
+// maxShippedLine caps one shipped line; longer runs without a newline are
+// sent in pieces of this size.
+const maxShippedLine = 16 * 1024
+
+// validateLabels rejects job labels that couldn't be written back as
+// "k=v,k2=v2" (what jobctl and -output-sink selectors use).
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, "=,") || strings.Contains(v, ",") {
+			return status.Errorf(codes.InvalidArgument, "invalid label %q=%q", k, v)
+		}
+	}
+	return nil
+}
+
+// outputRoutes returns the output sinks that take jobs with these labels.
+func (m *Manager) outputRoutes(labels map[string]string) []*logsink.Route {
+	var routes []*logsink.Route
+	for _, r := range m.opts.OutputSinks {
+		if r.Matches(labels) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// shipOutput copies the job's stdout and stderr, line by line, to routes
+// from launch until the job is done and its output drained. Jobs that never
+// launch ship nothing.
+func (m *Manager) shipOutput(mj *managedJob, routes []*logsink.Route) {
+	select {
+	case <-mj.launched:
+	case <-mj.Done():
+		return
+	}
+	done := make(chan struct{})
+	for _, stream := range []string{"stdout", "stderr"} {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := m.shipStream(mj, stream == "stderr", routes); err != nil {
+				m.logger.Printf("job %s: ship %s: %v", mj.ID(), stream, err)
+			}
+		}()
+	}
+	<-done
+	<-done
+}
+
+// shipStream follows one output file the way StreamOutput does, polling,
+// and hands complete lines to routes. A trailing partial line is sent once
+// the job is done.
+func (m *Manager) shipStream(mj *managedJob, stderr bool, routes []*logsink.Route) error {
+	rc, err := mj.OpenOutput(stderr)
+	if err != nil {
+		return fmt.Errorf("open output: %w", err)
+	}
+	defer rc.Close()
+
+	stream := "stdout"
+	if stderr {
+		stream = "stderr"
+	}
+	line := func(text []byte) logsink.Line {
+		return logsink.Line{Time: time.Now().UTC(), JobID: mj.ID(), Owner: mj.owner, Stream: stream, Text: string(text)}
+	}
+
+	buf := make([]byte, 32*1024)
+	var partial []byte
+	done := false
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			var lines []logsink.Line
+			partial = append(partial, buf[:n]...)
+			for {
+				i := bytes.IndexByte(partial, '\n')
+				if i < 0 {
+					if len(partial) < maxShippedLine {
+						break
+					}
+					i = maxShippedLine
+					lines = append(lines, line(partial[:i]))
+					partial = partial[i:]
+					continue
+				}
+				lines = append(lines, line(partial[:i]))
+				partial = partial[i+1:]
+			}
+			partial = append([]byte(nil), partial...)
+			ship(routes, lines)
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read output: %w", err)
+		}
+		if done {
+			if len(partial) > 0 {
+				ship(routes, []logsink.Line{line(partial)})
+			}
+			return nil
+		}
+		select {
+		case <-mj.Done():
+			// Writers are closed; one more pass drains whatever is left.
+			done = true
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+func ship(routes []*logsink.Route, lines []logsink.Line) {
+	if len(lines) == 0 {
+		return
+	}
+	for _, r := range routes {
+		r.Ship(lines)
+	}
+}
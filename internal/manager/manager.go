@@ -2,127 +2,1510 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
-	"github.com/bucknercd/jobworker/internal/joblib"
+	"github.com/bucknercd/jobworker/internal/accounting"
+	"github.com/bucknercd/jobworker/internal/archive"
+	cgv2 "github.com/bucknercd/jobworker/internal/cgroups"
+	"github.com/bucknercd/jobworker/internal/cluster"
+	"github.com/bucknercd/jobworker/internal/events"
+	"github.com/bucknercd/jobworker/internal/gpu"
+	"github.com/bucknercd/jobworker/internal/limits"
+	"github.com/bucknercd/jobworker/internal/logsink"
+	"github.com/bucknercd/jobworker/internal/metrics"
+	"github.com/bucknercd/jobworker/internal/oci"
+	"github.com/bucknercd/jobworker/internal/quota"
+	"github.com/bucknercd/jobworker/internal/secrets"
+	"github.com/bucknercd/jobworker/internal/tail"
+	"github.com/bucknercd/jobworker/internal/tracing"
+	"github.com/bucknercd/jobworker/internal/volumes"
+	"github.com/bucknercd/jobworker/pkg/cgroups"
+	"github.com/bucknercd/jobworker/pkg/joblib"
 	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
 )
 
+const (
+	defaultStreamChunkSize     = 32 * 1024
+	defaultStreamFlushInterval = 100 * time.Millisecond
+	streamPollInterval         = 100 * time.Millisecond
+
+	// streamWatchedPoll backs up inotify in case a wake-up is ever lost.
+	streamWatchedPoll = 5 * time.Second
+)
+
+// Options holds server-level settings applied to every job.
+type Options struct {
+	// OutputKey, when set, encrypts job stdout/stderr at rest (AES-256-GCM).
+	OutputKey []byte
+
+	// Secrets resolves StartJobRequest.secret_env references. Nil means the
+	// server has no secrets and such requests are rejected.
+	Secrets secrets.Provider
+
+	// Events, when set, receives job lifecycle events.
+	Events *events.Bus
+
+	// Tracer, when set, records one span per job from start to terminal state.
+	Tracer *tracing.Tracer
+
+	// NodeName identifies this server in multi-node mode; it is reported in
+	// every JobMetadata. Empty when standalone.
+	NodeName string
+
+	// Labels describe this node (e.g. arch=arm64); StartJob rejects requests
+	// whose node_selector they don't satisfy.
+	Labels map[string]string
+
+	// GPUs, when set, hands out this node's GPUs exclusively per job and
+	// hides unassigned ones. Nil means GPU requests are rejected.
+	GPUs *gpu.Allocator
+
+	// Images, when set, lets StartJobRequest.image run jobs inside container
+	// root filesystems. Nil means image requests are rejected.
+	Images *oci.Store
+
+	// Backend builds each job's execution backend. Nil means local exec.
+	Backend joblib.BackendFactory
+
+	// DefaultPIDsMax is pids.max for jobs that don't set pids_max, so a
+	// fork bomb can't exhaust the host's process table. Zero means none.
+	DefaultPIDsMax limits.PIDs
+
+	// DefaultMaxOutputBytes caps the output kept for jobs that don't set
+	// max_output_bytes. Zero means unlimited.
+	DefaultMaxOutputBytes int64
+
+	// MaxCoreBytes is RLIMIT_CORE for jobs started with capture_core. Zero
+	// means unlimited.
+	MaxCoreBytes int64
+
+	// JobsDirs are where job output is kept, in order of preference; each
+	// job's goes in the one Placement picks (see volumes.Set). Empty means
+	// joblib.DefaultJobsDir.
+	JobsDirs  []string
+	Placement volumes.Policy
+	MinFree   volumes.Threshold // Placement's free space to leave on a volume
+
+	// Credential is who local exec jobs run as. Nil means nobody:nogroup.
+	Credential *syscall.Credential
+
+	// ReadOnlyHost confines local exec jobs to a writable workspace, with
+	// the rest of the host read-only (joblib.Isolation.ReadOnlyHost).
+	ReadOnlyHost bool
+
+	// PrivateTmp gives local exec jobs their own tmpfs /tmp, capped at
+	// PrivateTmpSize bytes when that is positive.
+	PrivateTmp     bool
+	PrivateTmpSize int64
+
+	// PIDNamespace runs local exec jobs in their own PID namespace, under
+	// a small init (joblib.Isolation.PIDNamespace).
+	PIDNamespace bool
+
+	// ProcessTitle prefixes local exec jobs' argv[0] with "jobworker:<id>"
+	// so host ps output shows which job each process belongs to.
+	ProcessTitle bool
+
+	// Cgroups makes local exec jobs' cgroups. Nil means cgv2.V2.
+	Cgroups cgroups.Driver
+
+	// ExecPath is the directories searched for bare executable names with
+	// the local exec backend. Nil means DefaultExecPath.
+	ExecPath []string
+
+	// StreamChunkSize caps the bytes in one StreamOutput message (default
+	// 32KiB). StreamFlushInterval is how long output may sit buffered short
+	// of a full chunk before it is sent anyway (default 100ms). Small values
+	// favour latency, large ones fewer, bigger messages.
+	StreamChunkSize     int
+	StreamFlushInterval time.Duration
+
+	// OutputSummaryLines, when positive, logs the first and last that many
+	// lines of each finished job's output to DebugLogger.
+	OutputSummaryLines int
+
+	// DebugLogger receives debug-level detail. Nil means the main logger.
+	DebugLogger *log.Logger
+
+	// MaxJobs caps concurrently running jobs (0 = unlimited); it can be
+	// changed later with SetMaxJobs.
+	MaxJobs int
+
+	// FastAccept makes StartJob return a job as STARTING once it is planned,
+	// admitted and registered, and leaves the launch (cgroup, directories,
+	// output files, exec) to LaunchWorkers goroutines (default 8). A job
+	// that then fails to launch stays listed as FAILED.
+	FastAccept    bool
+	LaunchWorkers int
+
+	// Retention is how long finished jobs (and their output) are kept before
+	// being garbage-collected. Zero keeps them until an explicit GC.
+	Retention time.Duration
+
+	// CompressOutputAfter is how long after a job finishes its output is
+	// compressed on disk (zstd); reads decompress it transparently. Zero
+	// never compresses, and neither does OutputKey: ciphertext doesn't
+	// shrink.
+	CompressOutputAfter time.Duration
+
+	// Archive, when set, receives the output and metadata of every
+	// finished job; retention GC only removes jobs once archived, and
+	// reads of a removed job are served from it. Nil means no archive.
+	Archive *archive.Store
+
+	// Quotas caps each owner's unfinished jobs and the sums of their cpu
+	// and memory limits. Nil means no quotas.
+	Quotas quota.Table
+
+	// Accounting, when set, receives a record of what each job consumed
+	// once it ends. AccountingInterval is how often running jobs' memory is
+	// sampled for it (default 10s).
+	Accounting         *accounting.Ledger
+	AccountingInterval time.Duration
+
+	// OutputSinks get a copy of the output lines of every job whose labels
+	// they match. The job's own files remain what StreamOutput reads.
+	OutputSinks []*logsink.Route
+}
+
+// managedJob is the manager's view of a job: the joblib job plus the
+// server-side bookkeeping that joblib doesn't need to know about.
+type managedJob struct {
+	*joblib.Job
+	span *tracing.Span
+
+	owner      string      // caller's mTLS CN, from WithUser
+	namespace  string      // from the request, or DefaultNamespace
+	usage      quota.Usage // counted against the owner's quota until done
+	executable string
+	args       []string
+	image      string
+	labels     map[string]string
+	group      string
+	startedAt  time.Time
+	gpus       []gpu.Device
+	limits     []string // cgroup writes, as planned
+	jobsDir    string   // the JobsDirs entry holding its output
+	rlimits    []string
+	streams    atomic.Int32 // open StreamOutput calls
+	reads      outputReads
+	meter      *accounting.Meter
+	launched   chan struct{} // closed when the job starts running
+	launching  chan struct{} // FastAccept: closed once out of the launch queue; nil otherwise
+	stalled    atomic.Bool   // see watchLiveness
+	times      startTimes
+	indexes    outputIndexes
+	compressed atomic.Bool // CompressOutputAfter has been applied
+	archiveMu  sync.Mutex  // held while uploading to, or deleting from, the archive
+	archived   atomic.Bool // its output and metadata are in Options.Archive
+
+	timeout time.Duration              // StartJobRequest.timeout_seconds; 0 = none
+	timer   atomic.Pointer[time.Timer] // stops the job at its timeout; see startTimeout
+
+	// With a RestartPolicy, the request (and RunScript's script) is kept to
+	// start the next attempt from; see restartLater.
+	restart      *jobpb.RestartPolicy
+	spec         *jobpb.StartJobRequest
+	script       []byte
+	restartCount uint32 // attempts before this one
+	restartOf    string // the attempt this one restarted
+	restartedAs  atomic.Pointer[string]
+}
+
+// outputReads counts reads of a job's output over its life, for
+// diagnostics.
+type outputReads struct {
+	count atomic.Int32
+	bytes atomic.Int64
+	last  atomic.Int64 // unix seconds of the latest chunk sent
+}
+
+func (r *outputReads) sent(n int) {
+	r.bytes.Add(int64(n))
+	r.last.Store(time.Now().Unix())
+}
+
 type Manager struct {
+	// jobs is sharded so lookups by id don't contend with each other or
+	// with StartJob. mu guards only admission: starting, pending and the
+	// active tallies.
+	jobs *jobIndex
 	mu   sync.RWMutex
-	jobs map[string]*joblib.Job
 
 	logger *log.Logger
+	opts   Options
+
+	created  time.Time
+	draining atomic.Bool
+	maxJobs  atomic.Int32 // 0 = unlimited
+	starting int          // admitted but not yet in jobs; guarded by mu
+
+	// pending is quota usage admitted but not yet in jobs, per owner;
+	// guarded by mu.
+	pending   map[string]quota.Usage
+	pendingNS map[string]quota.Usage // the same, per namespace
+
+	// running counts launched jobs that haven't finished, and active and
+	// activeNS sum their usage per owner and per namespace, kept up to
+	// date by onTransition so admission needn't scan jobs; guarded by mu.
+	running  int
+	active   map[string]quota.Usage
+	activeNS map[string]quota.Usage
+
+	idem     *IdempotencyKeys
+	expired  expiredJobs // removed by GC, for notFound
+	liveness livenessWatches
+
+	chunkBufs sync.Pool   // StreamChunkSize read buffers; see chunkBuf
+	launches  chan launch // FastAccept's launch queue; nil without it
+
+	startSeconds *metrics.HistogramVec // see WriteMetrics
+
+	archiving sync.Mutex // one archive pass at a time; see archiveFinished
+
+	volumes     volumes.Set // from JobsDirs
+	volumesFull atomic.Bool // the last pick found no volume above MinFree
+
+	// notifier wakes output streams when job output grows; nil if inotify
+	// isn't available, in which case streams poll.
+	notifier *tail.Notifier
 }
 
-func NewManager(logger *log.Logger) *Manager {
-	return &Manager{
-		jobs:   make(map[string]*joblib.Job),
-		logger: logger,
+func NewManager(logger *log.Logger, opts Options) *Manager {
+	if opts.StreamChunkSize <= 0 {
+		opts.StreamChunkSize = defaultStreamChunkSize
+	}
+	if opts.StreamFlushInterval <= 0 {
+		opts.StreamFlushInterval = defaultStreamFlushInterval
+	}
+	if opts.ExecPath == nil {
+		opts.ExecPath = DefaultExecPath
+	}
+	if opts.AccountingInterval <= 0 {
+		opts.AccountingInterval = defaultAccountingInterval
+	}
+	notifier, err := tail.NewNotifier()
+	if err != nil {
+		logger.Printf("output streams will poll: %v", err)
+	}
+	m := &Manager{
+		jobs:      newJobIndex(),
+		pending:   make(map[string]quota.Usage),
+		pendingNS: make(map[string]quota.Usage),
+		active:    make(map[string]quota.Usage),
+		activeNS:  make(map[string]quota.Usage),
+		idem:      NewIdempotencyKeys(),
+		logger:    logger,
+		opts:      opts,
+		notifier:  notifier,
+		created:   time.Now(),
+
+		startSeconds: newStartSeconds(),
+		volumes:      volumes.Set{Dirs: opts.JobsDirs, Policy: opts.Placement, MinFree: opts.MinFree},
+	}
+	if len(m.volumes.Dirs) == 0 {
+		m.volumes.Dirs = []string{joblib.DefaultJobsDir}
+	}
+	m.SetMaxJobs(opts.MaxJobs)
+	if opts.FastAccept {
+		m.startLaunchWorkers()
+	}
+	if opts.Retention > 0 {
+		go m.gcLoop()
+	}
+	if opts.CompressOutputAfter > 0 && opts.OutputKey == nil {
+		go m.compressLoop()
+	}
+	if opts.Archive != nil {
+		go m.archiveLoop()
 	}
+	if opts.Accounting != nil {
+		go m.accountingLoop()
+	}
+	return m
 }
 
 // StartJob: creates job, starts it, stores in map, and returns job id.
+// With validate_only it stops after planning and returns the resolved spec.
 // NOTE: This currently uses UUID as job id. You can swap to your base36 sortable id later.
 func (m *Manager) StartJob(ctx context.Context, req *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
-	if req.GetExecutable() == "" {
-		return nil, status.Error(codes.InvalidArgument, "executable required")
+	if req.GetValidateOnly() {
+		p, err := m.plan("", req, false)
+		if err != nil {
+			return nil, err
+		}
+		return &jobpb.StartJobResponse{Node: m.opts.NodeName, Resolved: p.resolved(req)}, nil
 	}
+	return m.start(ctx, req, nil)
+}
 
-	id := uuid.New().String()
+// start admits, creates and launches a job, or with FastAccept queues it
+// to be launched; script is for RunScript. A retry with the same
+// idempotency key gets the first call's job.
+func (m *Manager) start(ctx context.Context, req *jobpb.StartJobRequest, script []byte) (*jobpb.StartJobResponse, error) {
+	owner := userFrom(ctx)
+	method := "StartJob"
+	if script != nil {
+		method = "RunScript"
+	}
+	prior, done, err := m.idem.Begin(owner, method, req, script)
+	if err != nil {
+		return nil, err
+	}
+	if prior != "" {
+		resp := &jobpb.StartJobResponse{JobId: prior, Node: m.opts.NodeName}
+		if job := m.getJob(prior); job != nil {
+			resp.Metadata = m.metadata(job)
+		}
+		return resp, nil
+	}
+	var started string
+	defer func() { done(started) }()
 
-	limits := translateLimits(req.GetLimits()) // TODO: upgrade later
+	job, err := m.run(ctx, req, owner, script, nil)
+	if err != nil {
+		return nil, err
+	}
+	started = job.ID()
+	return &jobpb.StartJobResponse{JobId: job.ID(), Node: m.opts.NodeName, Metadata: m.metadata(job)}, nil
+}
 
-	job, err := joblib.NewJob(id, req.GetExecutable(), req.GetArgs(), limits, m.logger)
+// run admits and creates a job for owner, then launches it, or with
+// FastAccept queues it to be launched. prev is the attempt a restart
+// follows, nil otherwise.
+func (m *Manager) run(ctx context.Context, req *jobpb.StartJobRequest, owner string, script []byte, prev *managedJob) (*managedJob, error) {
+	usage, err := m.requestUsage(owner, req.GetLimits())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "create job: %v", err)
+		return nil, err
+	}
+	release, err := m.admit(owner, namespaceOf(req), usage)
+	if err != nil {
+		return nil, err
+	}
+	queue := m.launches != nil
+	job, err := m.create(ctx, req, owner, usage, script, queue, prev)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if queue {
+		if err := m.enqueue(ctx, job, release); err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+	defer release()
+	if err := job.Start(); err != nil {
+		// The caller never learns this id, so don't keep it around.
+		m.jobs.remove(job)
+		return nil, status.Errorf(codes.Internal, "start job: %v", err)
+	}
+	return job, nil
+}
+
+// CreateJob plans req and registers the job without launching it; it
+// reports CREATED until StartCreatedJob. Planning reserves what the job
+// needs (GPUs, the unpacked image), so a created job holds those until it
+// is started and finishes, or is stopped.
+func (m *Manager) CreateJob(ctx context.Context, req *jobpb.StartJobRequest) (*jobpb.StartJobResponse, error) {
+	if req.GetValidateOnly() {
+		return nil, status.Error(codes.InvalidArgument, "validate_only is not supported by CreateJob; use StartJob")
+	}
+	if m.Draining() {
+		return nil, status.Error(codes.Unavailable, "node is draining; not accepting jobs")
+	}
+	owner := userFrom(ctx)
+	prior, done, err := m.idem.Begin(owner, "CreateJob", req, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prior != "" {
+		resp := &jobpb.StartJobResponse{JobId: prior, Node: m.opts.NodeName}
+		if job := m.getJob(prior); job != nil {
+			resp.Metadata = m.metadata(job)
+		}
+		return resp, nil
+	}
+	var created string
+	defer func() { done(created) }()
+
+	usage, err := m.requestUsage(owner, req.GetLimits())
+	if err != nil {
+		return nil, err
+	}
+	job, err := m.create(ctx, req, owner, usage, nil, false, nil)
+	if err != nil {
+		return nil, err
 	}
+	created = job.ID()
+	return &jobpb.StartJobResponse{JobId: job.ID(), Node: m.opts.NodeName, Metadata: m.metadata(job)}, nil
+}
+
+// StartCreatedJob launches a job made by CreateJob. Admission (draining,
+// -max-jobs, quotas) is checked now, not at creation. A job that fails to
+// launch stays listed as FAILED.
+func (m *Manager) StartCreatedJob(ctx context.Context, req *jobpb.StartCreatedJobRequest) (*jobpb.StartCreatedJobResponse, error) {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		return nil, m.notFound(req.GetJobId())
+	}
+	if st := job.Status(); st != joblib.StatusUnknown {
+		return nil, status.Errorf(codes.FailedPrecondition, "job is %s; only created jobs can be started", st)
+	}
+	if job.queued() {
+		return nil, status.Error(codes.FailedPrecondition, "job is already queued to start; only created jobs can be started")
+	}
+
+	release, err := m.admit(job.owner, job.namespace, job.usage)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	if err := job.Start(); err != nil {
+		if job.Status() != joblib.StatusFailed {
+			// Lost a race with another start or a stop.
+			return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+		}
 		return nil, status.Errorf(codes.Internal, "start job: %v", err)
 	}
+	return &jobpb.StartCreatedJobResponse{Metadata: m.metadata(job)}, nil
+}
+
+// create plans req and registers the resulting job, not yet started, along
+// with a reaper that releases its resources once it is done. A non-nil
+// script is written to the job's directory and becomes its first argument.
+// A job made to queue reports STARTING until enqueue's worker launches it.
+// prev, if set, is the attempt this job restarts.
+func (m *Manager) create(ctx context.Context, req *jobpb.StartJobRequest, owner string, usage quota.Usage, script []byte, queue bool, prev *managedJob) (*managedJob, error) {
+	if err := m.checkJoin(req.GetGroupId(), owner, namespaceOf(req)); err != nil {
+		return nil, err
+	}
+	id := uuid.New().String()
+
+	_, span := m.opts.Tracer.Start(ctx, "job", tracing.KindInternal)
+	span.SetAttr("job.id", id)
+	span.SetAttr("job.executable", req.GetExecutable())
+	if req.GetImage() != "" {
+		span.SetAttr("job.image", req.GetImage())
+	}
+
+	planning := time.Now()
+	p, err := m.plan(id, req, true)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+	validate := time.Since(planning)
+	m.observe("validate", validate)
+	ns := namespaceOf(req)
+	p.opts.Partition = partition(ns)
+	span.SetAttr("job.namespace", ns)
+
+	// Planning can be slow (unpacking an image); don't register a job whose
+	// caller has already given up and will never learn its id.
+	if err := ctx.Err(); err != nil {
+		m.releaseGPUs(id)
+		err = status.FromContextError(err).Err()
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+
+	if script != nil {
+		jobsDir := p.opts.JobsDir
+		if jobsDir == "" {
+			jobsDir = joblib.DefaultJobsDir
+		}
+		path, err := writeScript(filepath.Join(jobsDir, p.opts.Partition, id), script, p.opts.Isolation.Credential)
+		if err != nil {
+			m.releaseGPUs(id)
+			span.SetError(err)
+			span.End()
+			return nil, status.Errorf(codes.Internal, "create job: %v", err)
+		}
+		p.opts.Args = append([]string{path}, p.opts.Args...)
+	}
+
+	mj := &managedJob{
+		span:       span,
+		owner:      owner,
+		namespace:  ns,
+		usage:      usage,
+		executable: req.GetExecutable(),
+		args:       req.GetArgs(),
+		image:      req.GetImage(),
+		labels:     req.GetLabels(),
+		group:      req.GetGroupId(),
+		startedAt:  time.Now(),
+		gpus:       p.gpus,
+		limits:     p.opts.Limits,
+		jobsDir:    p.opts.JobsDir,
+		rlimits:    p.rlimits(),
+		meter:      &accounting.Meter{},
+		launched:   make(chan struct{}),
+		timeout:    time.Duration(req.GetTimeoutSeconds()) * time.Second,
+		restart:    req.GetRestart(),
+	}
+	mj.times.validate = validate
+	if mj.restart != nil {
+		mj.spec, mj.script = req, script
+	}
+	if prev != nil {
+		mj.restartCount, mj.restartOf = prev.restartCount+1, prev.ID()
+	}
+	if queue {
+		mj.launching = make(chan struct{})
+	}
+	p.opts.OnTransition = m.onTransition(mj)
+	job, err := joblib.New(p.opts)
+	if err != nil {
+		m.releaseGPUs(id)
+		span.SetError(err)
+		span.End()
+		return nil, status.Errorf(codes.Internal, "create job: %v", err)
+	}
+	mj.Job = job
+	m.jobs.add(mj)
+
+	if routes := m.outputRoutes(mj.labels); len(routes) > 0 {
+		go m.shipOutput(mj, routes)
+	}
+	if policy := req.GetLiveness(); policy != nil {
+		m.watchLiveness(mj, policy)
+	}
+
+	return mj, nil
+}
+
+// finished releases what a job held once it is done, and closes its
+// accounting and span. The job stays in the map until retention GC.
+func (m *Manager) finished(mj *managedJob) {
+	st := mj.State()
+	mj.stopTiming()
+	mj.stopTimeout()
+	m.releaseGPUs(mj.ID())
+	m.logger.Printf("job %s done status=%s exit=%d reason=%q", mj.ID(), st.Status, st.ExitCode, st.Reason)
+	m.account(mj, st)
+	mj.span.SetAttr("job.status", st.Status.String())
+	mj.span.SetAttr("job.exit_code", st.ExitCode)
+	mj.span.End()
+	if mj.restartDue(st) {
+		m.restartLater(mj)
+	}
+}
+
+// tally counts mj in or out of the active tallies as t launches or ends
+// it. Jobs that end without launching (a CREATED job stopped) never
+// counted.
+func (m *Manager) tally(mj *managedJob, t joblib.Transition) {
+	var add bool
+	switch {
+	case t.From == joblib.StatusUnknown && t.To == joblib.StatusStarted:
+		add = true
+	case t.From != joblib.StatusUnknown && t.To.Terminal():
+	default:
+		return
+	}
 
 	m.mu.Lock()
-	m.jobs[id] = job
-	m.mu.Unlock()
+	defer m.mu.Unlock()
+	if add {
+		m.running++
+		m.active[mj.owner] = m.active[mj.owner].Add(mj.usage)
+		m.activeNS[mj.namespace] = m.activeNS[mj.namespace].Add(mj.usage)
+		return
+	}
+	m.running--
+	if m.active[mj.owner] = m.active[mj.owner].Sub(mj.usage); m.active[mj.owner] == (quota.Usage{}) {
+		delete(m.active, mj.owner)
+	}
+	if m.activeNS[mj.namespace] = m.activeNS[mj.namespace].Sub(mj.usage); m.activeNS[mj.namespace] == (quota.Usage{}) {
+		delete(m.activeNS, mj.namespace)
+	}
+}
 
-	// Reap in background; keep job in map for now (you can add TTL cleanup later).
-	go func() {
-		<-job.Done()
-		m.logger.Printf("job %s done status=%s exit=%d", id, job.Status(), job.ExitCode())
-	}()
+// onTransition turns a job's status changes into lifecycle events and span
+// events, starts the job's meter and marks it launched when it starts
+// running, and calls finished once it is done. It runs on the goroutine
+// making the change, so a job waiting to start or run holds none of its
+// own.
+func (m *Manager) onTransition(mj *managedJob) func(joblib.Transition) {
+	span := mj.span
+	return func(t joblib.Transition) {
+		m.tally(mj, t)
+		ev := events.Event{Time: t.At.UTC(), JobID: t.JobID, Status: t.To.String(), ExitCode: t.ExitCode}
+		switch {
+		case t.To == joblib.StatusRunning:
+			mj.meter.Start(t.At)
+			close(mj.launched)
+			m.startTimeout(mj)
+			m.launchTimed(mj, t.At)
+			ev.Type = events.TypeJobStarted
+			span.AddEvent("job.started", "job.status", t.To.String())
+		case t.To == joblib.StatusStopping:
+			ev.Type = events.TypeJobStopRequested
+			span.AddEvent("job.stop_requested")
+		case t.To == joblib.StatusFailed && t.From != joblib.StatusRunning:
+			// Launch failed, possibly after a stop was requested.
+			ev.Type = events.TypeJobStartFailed
+			if t.Err != nil {
+				ev.Message = t.Err.Error()
+				span.SetError(t.Err)
+			}
+		case t.To.Terminal():
+			ev.Type = events.TypeJobFinished
+			ev.Message = t.Reason
+			span.AddEvent("job.finished", "job.status", t.To.String(), "job.exit_code", t.ExitCode)
+		default:
+			return
+		}
+		m.emit(ev)
+		if t.To.Terminal() {
+			m.finished(mj)
+		}
+	}
+}
 
-	return &jobpb.StartJobResponse{JobId: id}, nil
+// jobPlan is a StartJobRequest resolved against this server: everything
+// needed to launch it, with nothing launched yet.
+type jobPlan struct {
+	opts joblib.Options
+	gpus []gpu.Device
+}
+
+// plan validates and resolves req. With reserve, GPUs are assigned to id
+// (and released again if a later step fails); otherwise availability is
+// only checked, which is what validate_only wants. The caps and syntax
+// job.proto's field rules set were checked before, by internal/validate.
+func (m *Manager) plan(id string, req *jobpb.StartJobRequest, reserve bool) (p *jobPlan, err error) {
+	if req.GetExecutable() == "" && req.GetImage() == "" {
+		return nil, status.Error(codes.InvalidArgument, "executable required")
+	}
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, err
+	}
+	if ns := req.GetNamespace(); ns != "" {
+		if err := ValidateNamespace(ns); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkLiveness(req.GetLiveness()); err != nil {
+		return nil, err
+	}
+	if err := checkRestart(req); err != nil {
+		return nil, err
+	}
+	if !cluster.Matches(m.opts.Labels, req.GetNodeSelector()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "node labels [%s] do not satisfy node_selector [%s]",
+			cluster.FormatLabels(m.opts.Labels), cluster.FormatLabels(req.GetNodeSelector()))
+	}
+
+	jobsDir := m.pickJobsDir()
+	cgroupLimits, rlimits, err := translateLimits(req.GetLimits(), m.opts.DefaultPIDsMax, jobsDir)
+	if err != nil {
+		return nil, err
+	}
+	coreLimit, err := m.coreLimit(req, rlimits.Core)
+	if err != nil {
+		return nil, err
+	}
+	if coreLimit > 0 {
+		rlimits.Core = 0 // CoreLimit sets it
+	}
+
+	env, err := plainEnv(req)
+	if err != nil {
+		return nil, err
+	}
+	secretEnv, err := m.resolveSecretEnv(req.GetSecretEnv(), namespaceOf(req))
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, secretEnv...)
+
+	devs, isolation, err := m.assignGPUs(id, req.GetLimits(), reserve)
+	if err != nil {
+		return nil, err
+	}
+	isolation.Credential = m.opts.Credential
+	isolation.ReadOnlyHost = m.opts.ReadOnlyHost
+	isolation.PrivateTmp, isolation.PrivateTmpSize = m.opts.PrivateTmp, m.opts.PrivateTmpSize
+	isolation.PIDNamespace = m.opts.PIDNamespace
+	if reserve {
+		defer func() {
+			if err != nil {
+				m.releaseGPUs(id)
+			}
+		}()
+	}
+	if m.opts.GPUs != nil {
+		env = append(env, gpu.Env(devs)...)
+	}
+
+	command, args, dir := req.GetExecutable(), req.GetArgs(), ""
+	if ref := req.GetImage(); ref != "" {
+		img, argv, err := m.resolveImage(ref, command, args)
+		if err != nil {
+			return nil, err
+		}
+		command, args, dir = argv[0], argv[1:], img.WorkingDir
+		env = append(append([]string{}, img.Env...), env...)
+		isolation.Chroot = img.RootFS
+	} else if m.opts.Backend == nil {
+		// Local exec: fail here, before any cgroup exists, rather than at
+		// fork time. Other backends resolve the executable wherever they
+		// run it.
+		if command, err = resolveExecutable(command, m.opts.ExecPath, isolation.Credential); err != nil {
+			return nil, err
+		}
+	}
+
+	outputLimit, err := m.outputLimit(req)
+	if err != nil {
+		return nil, err
+	}
+	umask, setUmask, err := parseUmask(req)
+	if err != nil {
+		return nil, err
+	}
+	tty, err := ttySize(req.GetTty())
+	if err != nil {
+		return nil, err
+	}
+	result, err := resultCapture(req.GetResult())
+	if err != nil {
+		return nil, err
+	}
+	var title string
+	if m.opts.ProcessTitle {
+		title = "jobworker:" + id
+	}
+
+	return &jobPlan{
+		opts: joblib.Options{
+			ID:        id,
+			Command:   command,
+			Args:      args,
+			JobsDir:   jobsDir,
+			Limits:    cgroupLimits,
+			Env:       env,
+			Dir:       dir,
+			OutputKey: m.opts.OutputKey,
+			Isolation: isolation,
+			Leftovers: leftoverPolicy(req.GetLeftoverPolicy()),
+			Logger:    m.logger,
+			Backend:   m.opts.Backend,
+			Cgroups:   m.opts.Cgroups,
+
+			OutputLimit: outputLimit,
+			Rlimits:     jobRlimits(rlimits),
+			CoreLimit:   coreLimit,
+
+			Umask:        umask,
+			SetUmask:     setUmask,
+			ProcessTitle: title,
+			TTY:          tty,
+			Result:       result,
+			ResultFD:     req.GetResultFd(),
+
+			OutputSummaryLines: m.opts.OutputSummaryLines,
+			DebugLogger:        m.opts.DebugLogger,
+		},
+		gpus: devs,
+	}, nil
+}
+
+// resolved describes the plan for validate_only callers. Only env names are
+// exposed; values may be secrets.
+func (p *jobPlan) resolved(req *jobpb.StartJobRequest) *jobpb.ResolvedJob {
+	runAs := fmt.Sprintf("%d:%d", joblib.NobodyID, joblib.NobodyID)
+	if c := p.opts.Isolation.Credential; c != nil {
+		runAs = fmt.Sprintf("%d:%d", c.Uid, c.Gid)
+	}
+	names := make([]string, 0, len(p.opts.Env))
+	for _, kv := range p.opts.Env {
+		k, _, _ := strings.Cut(kv, "=")
+		names = append(names, k)
+	}
+	dir := p.opts.Dir
+	if dir == "" && p.opts.Isolation.Chroot != "" {
+		dir = "/"
+	}
+	var umask string
+	if p.opts.SetUmask {
+		umask = fmt.Sprintf("%04o", p.opts.Umask)
+	}
+	gpus := len(req.GetLimits().GetGpuUuids())
+	if gpus == 0 {
+		gpus = int(req.GetLimits().GetGpuCount())
+	}
+	return &jobpb.ResolvedJob{
+		RunAs:        runAs,
+		Executable:   p.opts.Command,
+		Args:         p.opts.Args,
+		WorkingDir:   dir,
+		Image:        req.GetImage(),
+		CgroupLimits: p.opts.Limits,
+		Rlimits:      p.rlimits(),
+		Umask:        umask,
+		EnvNames:     names,
+		Gpus:         uint32(gpus),
+	}
+}
+
+// rlimits lists the per-process limits the job gets, e.g.
+// "RLIMIT_NOFILE=1024".
+func (p *jobPlan) rlimits() []string {
+	var out []string
+	for _, r := range p.opts.Rlimits {
+		out = append(out, r.String())
+	}
+	if p.opts.CoreLimit > 0 {
+		out = append(out, joblib.Rlimit{Resource: unix.RLIMIT_CORE, Max: uint64(p.opts.CoreLimit)}.String())
+	}
+	return out
 }
 
 func (m *Manager) StopJob(ctx context.Context, req *jobpb.StopJobRequest) (*jobpb.StopJobResponse, error) {
 	job := m.getJob(req.GetJobId())
 	if job == nil {
-		return nil, status.Error(codes.NotFound, "job not found")
+		return nil, m.notFound(req.GetJobId())
 	}
 
-	if err := job.Stop(); err != nil {
+	already, err := job.Stop()
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "stop job: %v", err)
 	}
 
 	return &jobpb.StopJobResponse{
-		Metadata: &jobpb.JobMetadata{
-			User:     "", // filled by server auth layer later
-			Status:   mapStatus(job.Status()),
-			ExitCode: job.ExitCode(),
-		},
+		Metadata:       m.metadata(job),
+		AlreadyStopped: already,
 	}, nil
 }
 
 func (m *Manager) GetStatus(ctx context.Context, req *jobpb.GetStatusRequest) (*jobpb.GetStatusResponse, error) {
 	job := m.getJob(req.GetJobId())
 	if job == nil {
-		return nil, status.Error(codes.NotFound, "job not found")
+		if resp := m.expiredStatus(ctx, req.GetJobId()); resp != nil {
+			return resp, nil
+		}
+		return nil, m.notFound(req.GetJobId())
 	}
 
 	return &jobpb.GetStatusResponse{
-		JobId: req.GetJobId(),
-		Metadata: &jobpb.JobMetadata{
-			User:     "", // filled by server auth layer later
-			Status:   mapStatus(job.Status()),
-			ExitCode: job.ExitCode(),
-		},
+		JobId:    req.GetJobId(),
+		Metadata: m.metadata(job),
 	}, nil
 }
 
-func (m *Manager) getJob(id string) *joblib.Job {
+// ListJobs returns known jobs, newest first, limited to req.owner and
+// req.namespace when set.
+// Deciding who may see whose jobs is left to the caller (the gRPC layer).
+func (m *Manager) ListJobs(ctx context.Context, req *jobpb.ListJobsRequest) (*jobpb.ListJobsResponse, error) {
+	jobs := m.jobs.filter(func(j *managedJob) bool {
+		return (req.GetOwner() == "" || j.owner == req.GetOwner()) && (req.GetNamespace() == "" || j.namespace == req.GetNamespace())
+	})
+
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].startedAt.After(jobs[b].startedAt) })
+
+	resp := &jobpb.ListJobsResponse{Jobs: make([]*jobpb.JobSummary, 0, len(jobs))}
+	for _, j := range jobs {
+		resp.Jobs = append(resp.Jobs, m.summary(j))
+	}
+	return resp, nil
+}
+
+func (m *Manager) summary(j *managedJob) *jobpb.JobSummary {
+	return &jobpb.JobSummary{
+		JobId:      j.ID(),
+		Metadata:   m.metadata(j),
+		Executable: j.executable,
+		Args:       j.args,
+		StartedAt:  timestamppb.New(j.startedAt),
+		Image:      j.image,
+		Owner:      j.owner,
+		Labels:     j.labels,
+		GroupId:    j.group,
+	}
+}
+
+// StreamOutput sends the selected output from the beginning, or from the
+// offset or line req asks for, and keeps following it until the job is done and fully drained, or the client goes away.
+// A job still STARTING is waited for; one retention GC removed is read
+// from the archive. With include or exclude, only the lines they select
+// are sent (see sendFiltered).
+func (m *Manager) StreamOutput(req *jobpb.StreamOutputRequest, stream jobpb.JobWorker_StreamOutputServer) error {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		if m.isArchived(stream.Context(), req.GetJobId()) {
+			return m.streamArchived(req, stream)
+		}
+		return m.notFound(req.GetJobId())
+	}
+	if err := m.awaitLaunch(stream.Context(), job); err != nil {
+		return err
+	}
+
+	filter, err := newLineFilter(req)
+	if err != nil {
+		return err
+	}
+	stderr := req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR
+	rc, err := job.OpenOutput(stderr)
+	if err != nil {
+		return outputError(err)
+	}
+	defer rc.Close()
+
+	// The output may not have reached start yet; a file is seeked, other
+	// output read up to it.
+	start, err := m.streamStart(stream.Context(), req, m.lineIndex(job, stderr), job.output(stderr))
+	if err != nil {
+		return err
+	}
+	skip := start
+	if sk, ok := rc.(io.Seeker); ok && skip > 0 {
+		if _, err := sk.Seek(int64(skip), io.SeekStart); err != nil {
+			return status.Errorf(codes.Internal, "seek output: %v", err)
+		}
+		skip = 0
+	}
+
+	job.streams.Add(1)
+	defer job.streams.Add(-1)
+	job.reads.count.Add(1)
+
+	// Sleep until the file grows when we can watch it; poll otherwise. A
+	// finished job's output won't grow, and may be compressed away.
+	idle := min(streamPollInterval, m.opts.StreamFlushInterval)
+	var grew <-chan struct{}
+	if path, ok := job.OutputPath(stderr); ok && m.notifier != nil && job.State().FinishedAt().IsZero() {
+		w, err := m.notifier.Watch(path)
+		if err != nil {
+			m.logger.Printf("job %s: watch output, falling back to polling: %v", job.ID(), err)
+		} else {
+			defer w.Close()
+			grew, idle = w.C, streamWatchedPoll
+		}
+	}
+
+	ctx := stream.Context()
+	flush := m.opts.StreamFlushInterval
+	pooled := m.chunkBuf()
+	defer m.putChunkBuf(pooled)
+	buf := *pooled
+	if filter != nil {
+		return m.sendFiltered(ctx, stream, rc, start, skip, filter, buf, job.Done(), grew, idle, &job.reads)
+	}
+	var pendingSince time.Time           // when buf got its oldest unsent byte
+	msg := &jobpb.StreamOutputResponse{} // reused: Send encodes it before returning
+	msg.Offset = start                   // of the next chunk
+	send := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		msg.Chunk = buf
+		err := stream.Send(msg)
+		job.reads.sent(len(buf))
+		msg.Offset += uint64(len(buf))
+		buf = buf[:0]
+		return err
+	}
+
+	done := false
+	for {
+		n, err := rc.Read(buf[len(buf):cap(buf)])
+		if n > 0 {
+			fresh := buf[len(buf) : len(buf)+n]
+			if skip > 0 { // buf stays empty until the offset is reached
+				k := min(skip, uint64(n))
+				skip -= k
+				n = copy(fresh, fresh[k:])
+			}
+			if n > 0 && len(buf) == 0 {
+				pendingSince = time.Now()
+			}
+			buf = buf[:len(buf)+n]
+			if len(buf) == cap(buf) {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return status.Errorf(codes.Internal, "read output: %v", err)
+		}
+		if done {
+			return send()
+		}
+
+		// Caught up with the writer: send a partial chunk once it has waited
+		// out the flush interval, otherwise wait for more output.
+		wait := idle
+		if len(buf) > 0 {
+			left := flush - time.Since(pendingSince)
+			if left <= 0 {
+				if err := send(); err != nil {
+					return err
+				}
+				continue
+			}
+			wait = min(wait, left)
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-job.Done():
+			// Writers are closed; one more pass drains whatever is left.
+			done = true
+		case <-grew:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *Manager) emit(ev events.Event) {
+	if m.opts.Events != nil {
+		m.opts.Events.Emit(ev)
+	}
+}
+
+func (m *Manager) getJob(id string) *managedJob {
 	if id == "" {
 		return nil
 	}
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.jobs[id]
+	return m.jobs.get(id)
 }
 
-func translateLimits(l *jobpb.ResourceLimits) []string {
-	if l == nil {
-		return nil
+// resolveSecretEnv turns ENV_NAME -> secret name references into KEY=VALUE
+// entries, with the secrets a job in namespace ns may use. Errors only ever
+// mention names, never values.
+func (m *Manager) resolveSecretEnv(refs map[string]string, ns string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if m.opts.Secrets == nil {
+		return nil, status.Error(codes.FailedPrecondition, "secret_env requested but server has no secrets configured")
 	}
 
-	// Minimal translation for now:
-	// You probably want to parse cpu/mem strings into cpu.max/memory.max eventually.
-	// For now, return empty and rely on defaults (or hardcode defaults inside joblib/cgroups).
+	names := make([]string, 0, len(refs))
+	for k := range refs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	env := make([]string, 0, len(names))
+	for _, k := range names {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid secret_env variable name %q", k)
+		}
+		v, err := m.opts.Secrets.Lookup(ns, refs[k])
+		if err != nil {
+			if errors.Is(err, secrets.ErrNotFound) {
+				return nil, status.Errorf(codes.InvalidArgument, "unknown secret %q", refs[k])
+			}
+			if errors.Is(err, secrets.ErrDenied) {
+				return nil, status.Errorf(codes.PermissionDenied, "secret %q is not available in namespace %s", refs[k], ns)
+			}
+			return nil, status.Errorf(codes.Internal, "resolve secret %q: %v", refs[k], err)
+		}
+		env = append(env, k+"="+v)
+	}
+	return env, nil
+}
+
+// plainEnv returns req's env as KEY=VALUE, sorted by name. A name also in
+// secret_env is rejected rather than letting either one win.
+func plainEnv(req *jobpb.StartJobRequest) ([]string, error) {
+	vars := req.GetEnv()
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	env := make([]string, 0, len(names))
+	for _, k := range names {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid env variable name %q", k)
+		}
+		if strings.ContainsRune(vars[k], 0) {
+			return nil, status.Errorf(codes.InvalidArgument, "env %s: value contains a NUL byte", k)
+		}
+		if _, ok := req.GetSecretEnv()[k]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is in both env and secret_env", k)
+		}
+		env = append(env, k+"="+vars[k])
+	}
+	return env, nil
+}
+
+// resolveImage prepares ref and returns the argv to run in it: exe/args if
+// given (like `docker run --entrypoint`), else the image entrypoint with args
+// or the image cmd. argv[0] is resolved against the image's PATH.
+func (m *Manager) resolveImage(ref, exe string, args []string) (*oci.Image, []string, error) {
+	if m.opts.Images == nil {
+		return nil, nil, status.Error(codes.FailedPrecondition, "image requested but this server has image jobs disabled")
+	}
+
+	img, err := m.opts.Images.Resolve(ref)
+	switch {
+	case errors.Is(err, oci.ErrNotFound), errors.Is(err, oci.ErrInvalidRef):
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, nil, status.Errorf(codes.Internal, "prepare image: %v", err)
+	}
+
+	var argv []string
+	switch {
+	case exe != "":
+		argv = append([]string{exe}, args...)
+	case len(args) > 0:
+		argv = append(append([]string{}, img.Entrypoint...), args...)
+	default:
+		argv = append(append([]string{}, img.Entrypoint...), img.Cmd...)
+	}
+	if len(argv) == 0 {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "image %s has no entrypoint or cmd; executable required", ref)
+	}
+
+	p, err := img.LookPath(argv[0])
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	argv[0] = p
+	return img, argv, nil
+}
+
+// assignGPUs reserves the GPUs requested in l for job id, or with !reserve
+// only checks they are available. When the node manages GPUs, every job
+// gets a device filter, so jobs that asked for none can't reach any.
+func (m *Manager) assignGPUs(id string, l *jobpb.ResourceLimits, reserve bool) ([]gpu.Device, joblib.Isolation, error) {
+	count, uuids := int(l.GetGpuCount()), l.GetGpuUuids()
+	if m.opts.GPUs == nil {
+		if count > 0 || len(uuids) > 0 {
+			return nil, joblib.Isolation{}, status.Error(codes.FailedPrecondition, "GPUs requested but this node has none configured")
+		}
+		return nil, joblib.Isolation{}, nil
+	}
+
+	var (
+		devs []gpu.Device
+		err  error
+	)
+	if reserve {
+		devs, err = m.opts.GPUs.Acquire(id, count, uuids)
+	} else {
+		err = m.opts.GPUs.Check(count, uuids)
+	}
+	switch {
+	case errors.Is(err, gpu.ErrUnknownDevice):
+		return nil, joblib.Isolation{}, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, gpu.ErrUnavailable):
+		return nil, joblib.Isolation{}, status.Error(codes.ResourceExhausted, err.Error())
+	case err != nil:
+		return nil, joblib.Isolation{}, status.Errorf(codes.Internal, "assign GPUs: %v", err)
+	}
+	return devs, joblib.Isolation{RestrictGPUs: true, GPUMinors: gpu.Minors(devs)}, nil
+}
+
+func (m *Manager) releaseGPUs(id string) {
+	if m.opts.GPUs != nil {
+		m.opts.GPUs.Release(id)
+	}
+}
+
+func limitSpec(l *jobpb.ResourceLimits) limits.Spec {
+	s := limits.Spec{
+		CPU:     l.GetCpu(),
+		Memory:  l.GetMemoryMax(),
+		Swap:    l.GetMemorySwapMax(),
+		IOClass: l.GetIoClass(),
+		CPUs:    l.GetCpusetCpus(),
+		Mems:    l.GetCpusetMems(),
+		PIDs:    l.GetPidsMax(),
+		NoFile:  l.GetNofile(),
+		NProc:   l.GetNproc(),
+		Core:    l.GetCore(),
+		FSize:   l.GetFsize(),
+	}
+	for _, io := range l.GetIoMax() {
+		s.IOMax = append(s.IOMax, limits.IOMax{
+			Device: io.GetDevice(),
+			RBps:   io.GetRbps(), WBps: io.GetWbps(),
+			RIOPS: io.GetRiops(), WIOPS: io.GetWiops(),
+		})
+	}
+	return s
+}
+
+func leftoverPolicy(p jobpb.LeftoverPolicy) joblib.LeftoverPolicy {
+	if p == jobpb.LeftoverPolicy_LEFTOVER_POLICY_WAIT {
+		return joblib.LeftoverWait
+	}
+	return joblib.LeftoverKill
+}
+
+// outputLimit applies the server default to req's max_output_bytes.
+func (m *Manager) outputLimit(req *jobpb.StartJobRequest) (joblib.OutputLimit, error) {
+	n := req.GetMaxOutputBytes()
+	if n > math.MaxInt64 {
+		return joblib.OutputLimit{}, status.Errorf(codes.InvalidArgument, "max_output_bytes %d is too large", n)
+	}
+	limit := joblib.OutputLimit{
+		MaxBytes: int64(n),
+		Kill:     req.GetOutputLimitAction() == jobpb.OutputLimitAction_OUTPUT_LIMIT_ACTION_KILL,
+	}
+	if limit.MaxBytes == 0 {
+		limit.MaxBytes = m.opts.DefaultMaxOutputBytes
+	}
+	return limit, nil
+}
+
+// parseUmask reads req's octal umask; ok is false when it has none.
+func parseUmask(req *jobpb.StartJobRequest) (mask uint32, ok bool, err error) {
+	s := req.GetUmask()
+	if s == "" {
+		return 0, false, nil
+	}
+	if req.GetImage() != "" {
+		return 0, false, status.Error(codes.InvalidArgument, "umask is not supported with image")
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, false, status.Errorf(codes.InvalidArgument, "umask %q: want octal 000 to 777", s)
+	}
+	return uint32(n), true, nil
+}
+
+// resultCapture checks a job's result capture; nil means none.
+func resultCapture(r *jobpb.ResultCapture) (*joblib.ResultCapture, error) {
+	c := &joblib.ResultCapture{
+		LastLines: int(r.GetLastLines()),
+		Begin:     r.GetBeginMarker(),
+		End:       r.GetEndMarker(),
+	}
+	switch {
+	case c.LastLines > 0 && c.Begin != "":
+		return nil, status.Error(codes.InvalidArgument, "result: last_lines and begin_marker are exclusive")
+	case c.End != "" && c.Begin == "":
+		return nil, status.Error(codes.InvalidArgument, "result: end_marker needs begin_marker")
+	case c.LastLines > joblib.MaxResultLines:
+		return nil, status.Errorf(codes.InvalidArgument, "result: last_lines %d is over the limit of %d", c.LastLines, joblib.MaxResultLines)
+	case strings.ContainsAny(c.Begin+c.End, "\r\n"):
+		return nil, status.Error(codes.InvalidArgument, "result: markers must be a single line")
+	case c.LastLines == 0 && c.Begin == "":
+		return nil, nil
+	}
+	return c, nil
+}
+
+// coreLimit is the RLIMIT_CORE under which req's core is captured, the
+// server's -max-core-size lowered by limits.core; zero means no capture.
+func (m *Manager) coreLimit(req *jobpb.StartJobRequest, core limits.Rlimit) (int64, error) {
+	if !req.GetCaptureCore() {
+		return 0, nil
+	}
+	// The core is found by the crashed process's pid, which the server
+	// never learns behind a PID namespace's init.
+	if m.opts.PIDNamespace && req.GetImage() == "" {
+		return 0, status.Error(codes.FailedPrecondition, "capture_core is not supported on this server (-pid-namespace)")
+	}
+	limit := int64(math.MaxInt64)
+	if m.opts.MaxCoreBytes > 0 {
+		limit = m.opts.MaxCoreBytes
+	}
+	switch core {
+	case limits.RlimitZero:
+		return 0, status.Error(codes.InvalidArgument, "capture_core needs a core limit above 0")
+	case 0, limits.RlimitUnlimited:
+		return limit, nil
+	default:
+		return min(limit, int64(core)), nil
+	}
+}
+
+// jobRlimits lists the set limits in r for joblib.
+func jobRlimits(r limits.Rlimits) []joblib.Rlimit {
+	var out []joblib.Rlimit
+	for _, l := range []struct {
+		resource int
+		limit    limits.Rlimit
+	}{
+		{unix.RLIMIT_NOFILE, r.NoFile},
+		{unix.RLIMIT_NPROC, r.NProc},
+		{unix.RLIMIT_CORE, r.Core},
+		{unix.RLIMIT_FSIZE, r.FSize},
+	} {
+		if v, ok := l.limit.Value(); ok {
+			out = append(out, joblib.Rlimit{Resource: l.resource, Max: v})
+		}
+	}
+	return out
+}
+
+// checkTopology rejects cpuset pinning to CPUs or memory nodes this host
+// can't give the job. Other nodes may have them, hence FailedPrecondition.
+func checkTopology(l limits.Limits) error {
+	if len(l.CPUs) == 0 && len(l.Mems) == 0 {
+		return nil
+	}
+	cpus, mems, err := cgv2.Topology()
+	if err != nil {
+		return status.Errorf(codes.Internal, "read cpu topology: %v", err)
+	}
+	for _, c := range []struct {
+		what string
+		want limits.CPUSet
+		have string
+	}{{"cpus", l.CPUs, cpus}, {"memory nodes", l.Mems, mems}} {
+		have, err := limits.ParseCPUSet(c.have)
+		if err != nil {
+			return status.Errorf(codes.Internal, "read cpu topology: %v", err)
+		}
+		if missing := c.want.Missing(have); len(missing) > 0 {
+			return status.Errorf(codes.FailedPrecondition, "cpuset %s %s not available on this node (have %s)", c.what, missing, have)
+		}
+	}
 	return nil
 }
 
-// mapStatus maps internal joblib.Status -> proto JobStatus
-func mapStatus(s joblib.Status) jobpb.JobStatus {
+// translateLimits turns the request's limits into cgroup writes. io.max
+// devices are resolved on this host; no device means the disk holding job
+// output (jobsDir, or joblib.DefaultJobsDir). Without pids_max, defaultPIDs
+// applies. The rlimits are returned as parsed.
+func translateLimits(l *jobpb.ResourceLimits, defaultPIDs limits.PIDs, jobsDir string) ([]string, limits.Rlimits, error) {
+	parsed, err := limits.Parse(limitSpec(l))
+	if err != nil {
+		return nil, limits.Rlimits{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if parsed.PIDs == 0 {
+		parsed.PIDs = defaultPIDs
+	}
+	if err := checkTopology(parsed); err != nil {
+		return nil, limits.Rlimits{}, err
+	}
+	writes, err := parsed.Cgroup(func(dev string) (string, error) {
+		if dev == "" {
+			dev = jobsDir
+		}
+		if dev == "" {
+			dev = joblib.DefaultJobsDir
+		}
+		return cgv2.BlockDevice(dev)
+	})
+	if err != nil {
+		return nil, limits.Rlimits{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return writes, parsed.Rlimits, nil
+}
+
+func (m *Manager) metadata(j *managedJob) *jobpb.JobMetadata {
+	st := j.State()
+	md := &jobpb.JobMetadata{
+		User:      j.owner,
+		Namespace: j.namespace,
+		Status:    mapStatus(st.Status, j.launching != nil),
+		ExitCode:  st.ExitCode,
+		Reason:    st.Reason,
+		Node:      m.opts.NodeName,
+		Gpus:      gpuUUIDs(j.gpus),
+
+		OutputTruncated: j.OutputTruncated(),
+		Stalled:         j.stalled.Load() && st.Status == joblib.StatusRunning,
+		CoreCaptured:    j.CoreCaptured(),
+
+		CreatedAt:    timestamppb.New(j.startedAt),
+		CgroupLimits: j.limits,
+		Rlimits:      j.rlimits,
+		CgroupPath:   j.Describe().CgroupPath,
+		StartTimings: j.startTimings(),
+	}
+	if r := j.Result(); r != nil {
+		md.Result = strings.ToValidUTF8(string(r.Text), "\uFFFD")
+		md.ResultTruncated = r.Truncated
+	}
+	md.ResultDataTruncated = j.ResultDataTruncated()
+	md.RestartCount, md.RestartOf = j.restartCount, j.restartOf
+	if next := j.restartedAs.Load(); next != nil {
+		md.RestartedAs = *next
+	}
+	if t, ok := st.Entered[joblib.StatusRunning]; ok {
+		md.RunningAt = timestamppb.New(t)
+	}
+	if t := st.FinishedAt(); !t.IsZero() {
+		md.FinishedAt = timestamppb.New(t)
+	}
+	return md
+}
+
+func gpuUUIDs(devs []gpu.Device) []string {
+	if len(devs) == 0 {
+		return nil
+	}
+	out := make([]string, len(devs))
+	for i, d := range devs {
+		out[i] = d.UUID
+	}
+	return out
+}
+
+// Running reports how many launched jobs have not yet reached a terminal
+// state.
+func (m *Manager) Running() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.running
+}
+
+// active reports whether the job has been launched and isn't done yet.
+// Jobs waiting in CREATED don't count against limits or quotas.
+func (j *managedJob) active() bool {
+	st := j.Status()
+	return st != joblib.StatusUnknown && !st.Terminal()
+}
+
+// mapStatus maps internal joblib.Status -> proto JobStatus; queued says the
+// job was fast-accepted, so it is waiting to launch rather than created.
+func mapStatus(s joblib.Status, queued bool) jobpb.JobStatus {
 	switch s {
+	case joblib.StatusUnknown:
+		// Only jobs made by CreateJob or queued by FastAccept are ever
+		// seen before Start.
+		if queued {
+			return jobpb.JobStatus_JOB_STATUS_STARTING
+		}
+		return jobpb.JobStatus_JOB_STATUS_CREATED
+	case joblib.StatusStarted:
+		return jobpb.JobStatus_JOB_STATUS_STARTING
 	case joblib.StatusRunning:
 		return jobpb.JobStatus_JOB_STATUS_RUNNING
 	case joblib.StatusExited:
 		return jobpb.JobStatus_JOB_STATUS_EXITED
+	case joblib.StatusStopping:
+		return jobpb.JobStatus_JOB_STATUS_STOPPING
 	case joblib.StatusStopped:
 		return jobpb.JobStatus_JOB_STATUS_STOPPED
 	case joblib.StatusFailed:
@@ -132,8 +1515,15 @@ func mapStatus(s joblib.Status) jobpb.JobStatus {
 	}
 }
 
-func (m *Manager) DebugDump() string {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return fmt.Sprintf("jobs=%d", len(m.jobs))
+type userKey struct{}
+
+// WithUser attaches the authenticated caller to ctx. StartJob records it as
+// the job's owner, reported in metadata and used by ListJobs filters.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
 }
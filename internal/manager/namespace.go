@@ -0,0 +1,88 @@
+package manager
+
+import (
+	"context"
+	"regexp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// DefaultNamespace holds the jobs of callers without one of their own. Its
+// jobs keep the flat layout: <jobs-dir>/<id> and jobs/<id> in the cgroup
+// tree.
+const DefaultNamespace = "default"
+
+// namespacePartition prefixes a namespace's directory under the jobs dir
+// and the cgroup job root, so it can't be mistaken for a job id.
+const namespacePartition = "ns-"
+
+var namespaceRE = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// ValidateNamespace rejects names that can't be used as a directory and
+// cgroup name: lower-case letters, digits, '.', '_' and '-', at most 63.
+func ValidateNamespace(ns string) error {
+	if !namespaceRE.MatchString(ns) {
+		return status.Errorf(codes.InvalidArgument, "invalid namespace %q (want lower-case letters, digits, '.', '_' or '-', at most 63)", ns)
+	}
+	return nil
+}
+
+// partition is where ns's jobs live under the jobs dir and cgroup job root.
+func partition(ns string) string {
+	if ns == "" || ns == DefaultNamespace {
+		return ""
+	}
+	return namespacePartition + ns
+}
+
+// namespaceOf is the namespace req's job goes in. The gRPC layer has
+// already decided the caller may use it, and plan has validated it.
+func namespaceOf(req *jobpb.StartJobRequest) string {
+	if ns := req.GetNamespace(); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
+
+// JobAccess reports the owner and namespace of job id, and whether it is
+// known (running, finished, expired, or in the archive).
+func (m *Manager) JobAccess(id string) (owner, namespace string, ok bool) {
+	if j := m.getJob(id); j != nil {
+		return j.owner, j.namespace, true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), archiveLookupTimeout)
+	defer cancel()
+	if md := m.expiredMetadata(ctx, id); md != nil {
+		return md.GetUser(), md.GetNamespace(), true
+	}
+	return "", "", false
+}
+
+type scopeKey struct{}
+
+// groupScope is what a group call may reach, from WithScope.
+type groupScope struct {
+	namespace string
+	all       bool
+}
+
+// WithScope attaches the caller's namespace to ctx, and whether they may
+// reach every user's jobs in every namespace (admins, and trusted
+// forwarders calling for themselves). Calls naming a group check it, with
+// the user from WithUser; without it they reach only that user's jobs in
+// the default namespace.
+func WithScope(ctx context.Context, namespace string, all bool) context.Context {
+	return context.WithValue(ctx, scopeKey{}, groupScope{namespace: namespace, all: all})
+}
+
+// reaches reports whether the caller in ctx may reach j.
+func reaches(ctx context.Context, j *managedJob) bool {
+	sc, ok := ctx.Value(scopeKey{}).(groupScope)
+	if !ok {
+		sc.namespace = DefaultNamespace
+	}
+	return sc.all || j.owner == userFrom(ctx) && j.namespace == sc.namespace
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// GetJobProcesses lists what a live job is running, so operators can see
+// what a misbehaving job actually spawned.
+func (m *Manager) GetJobProcesses(ctx context.Context, req *jobpb.GetJobProcessesRequest) (*jobpb.GetJobProcessesResponse, error) {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		return nil, m.notFound(req.GetJobId())
+	}
+	if st := job.Status(); st != joblib.StatusRunning && st != joblib.StatusStopping {
+		return nil, status.Errorf(codes.FailedPrecondition, "job is %s, not running", st)
+	}
+	procs, err := job.Processes()
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		return nil, status.Error(codes.Unimplemented, "this server's backend can't list job processes")
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "list processes: %v", err)
+	}
+	sort.Slice(procs, func(a, b int) bool { return procs[a].PID < procs[b].PID })
+	resp := &jobpb.GetJobProcessesResponse{Processes: make([]*jobpb.JobProcess, len(procs))}
+	for i, p := range procs {
+		resp.Processes[i] = &jobpb.JobProcess{
+			Pid:       int32(p.PID),
+			Ppid:      int32(p.PPID),
+			Command:   p.Command,
+			Args:      p.Args,
+			State:     p.State,
+			Threads:   int32(p.Threads),
+			RssBytes:  p.RSSBytes,
+			CpuUsec:   p.CPUUsec,
+			StartedAt: timestamppb.New(p.StartedAt),
+		}
+	}
+	return resp, nil
+}
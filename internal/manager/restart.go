@@ -0,0 +1,73 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/events"
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+const (
+	// maxRestarts bounds how many times one job is started again.
+	maxRestarts = 100
+
+	// maxRestartDelay bounds how long a restart may wait.
+	maxRestartDelay = time.Hour
+)
+
+// checkRestart validates a StartJobRequest's restart policy.
+func checkRestart(req *jobpb.StartJobRequest) error {
+	p := req.GetRestart()
+	switch {
+	case p == nil:
+		return nil
+	case p.GetMaxRestarts() == 0 || p.GetMaxRestarts() > maxRestarts:
+		return status.Errorf(codes.InvalidArgument, "restart.max_restarts must be 1 to %d", maxRestarts)
+	case time.Duration(p.GetDelaySeconds())*time.Second > maxRestartDelay:
+		return status.Errorf(codes.InvalidArgument, "restart.delay_seconds must be at most %d", int(maxRestartDelay.Seconds()))
+	case req.GetGroupId() != "":
+		// A group's status and wait count its members; attempts coming and
+		// going would make a failed group look finished, or the reverse.
+		return status.Error(codes.InvalidArgument, "restart is not supported for group members")
+	}
+	return nil
+}
+
+// restartDue reports whether mj, done as st, is to be started again: it
+// exited non-zero, or was killed by a signal, and has restarts left.
+// Stopped jobs ended as asked, and ones that failed to launch would only
+// fail again.
+func (mj *managedJob) restartDue(st joblib.State) bool {
+	return mj.restart != nil && st.Status == joblib.StatusExited && st.ExitCode != 0 &&
+		mj.restartCount < mj.restart.GetMaxRestarts()
+}
+
+// restartLater starts mj's next attempt once its policy's delay has
+// passed, unless mj has been deleted meanwhile. An attempt that can't be
+// started (the node is draining or full, or the owner is over quota) ends
+// the chain, and says why in the server log.
+func (m *Manager) restartLater(mj *managedJob) {
+	delay := time.Duration(mj.restart.GetDelaySeconds()) * time.Second
+	time.AfterFunc(delay, func() {
+		if m.getJob(mj.ID()) != mj {
+			return
+		}
+		ctx := WithUser(context.Background(), mj.owner)
+		next, err := m.run(ctx, mj.spec, mj.owner, mj.script, mj)
+		if err != nil {
+			m.logger.Printf("job %s: not restarted: %v", mj.ID(), err)
+			return
+		}
+		id := next.ID()
+		mj.restartedAs.Store(&id)
+		msg := fmt.Sprintf("restart %d of %d, after job %s", next.restartCount, mj.restart.GetMaxRestarts(), mj.ID())
+		m.logger.Printf("job %s: %s", id, msg)
+		m.emit(events.Event{Time: time.Now().UTC(), Type: events.TypeJobRestarted, JobID: id, Status: next.Status().String(), Message: msg})
+	})
+}
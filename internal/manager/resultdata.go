@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/archive"
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// GetJobResult returns the result data a job started with result_fd has
+// written to joblib.ResultFD. A job retention GC removed is read from the
+// archive.
+func (m *Manager) GetJobResult(ctx context.Context, req *jobpb.GetJobResultRequest) (*jobpb.GetJobResultResponse, error) {
+	id := req.GetJobId()
+	job := m.getJob(id)
+	if job == nil {
+		if !m.isArchived(ctx, id) {
+			return nil, m.notFound(id)
+		}
+		data, err := readResultData(m.archivedObject(ctx, id, archive.Result))
+		if err != nil {
+			return nil, err
+		}
+		md := m.expiredMetadata(ctx, id)
+		return &jobpb.GetJobResultResponse{Data: data, Truncated: md.GetResultDataTruncated(), Complete: true}, nil
+	}
+	if err := m.awaitLaunch(ctx, job); err != nil {
+		return nil, err
+	}
+
+	var complete bool
+	select {
+	case <-job.Done(): // before reading, so nothing is written after
+		complete = true
+	default:
+	}
+	data, err := readResultData(job.OpenResultData)
+	if err != nil {
+		return nil, err
+	}
+	return &jobpb.GetJobResultResponse{Data: data, Truncated: job.ResultDataTruncated(), Complete: complete}, nil
+}
+
+// readResultData reads the result data open opens, at most
+// joblib.MaxResultData of it.
+func readResultData(open openOutput) ([]byte, error) {
+	rc, err := open()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Error(codes.FailedPrecondition, "job was not started with result_fd")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "open result data: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, joblib.MaxResultData))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "read result data: %v", err)
+	}
+	return data, nil
+}
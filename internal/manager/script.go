@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// MaxScriptSize caps a RunScript body.
+const MaxScriptSize = 1 << 20
+
+// scriptFilename is the uploaded script, next to the job's output.
+const scriptFilename = "script"
+
+// ReadScript receives a RunScript stream: the job first, then the script
+// body until the client closes its side. Malformed streams are
+// InvalidArgument.
+func ReadScript(stream jobpb.JobWorker_RunScriptServer) (*jobpb.StartJobRequest, []byte, error) {
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, status.Error(codes.InvalidArgument, "empty RunScript stream")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	req := first.GetJob()
+	if req == nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "the first RunScript message must carry the job")
+	}
+
+	var script []byte
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if msg.GetJob() != nil {
+			return nil, nil, status.Error(codes.InvalidArgument, "RunScript carries one job; the rest is the script")
+		}
+		if len(script)+len(msg.GetChunk()) > MaxScriptSize {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "script exceeds %d bytes", MaxScriptSize)
+		}
+		script = append(script, msg.GetChunk()...)
+	}
+	if len(script) == 0 {
+		return nil, nil, status.Error(codes.InvalidArgument, "empty script")
+	}
+	return req, script, nil
+}
+
+// RunScript is StartJob for a script the caller uploaded: req.executable
+// is the interpreter, which runs <jobs-dir>/<id>/script followed by
+// req.args. Scripts need the local exec backend and the host filesystem,
+// so images aren't supported.
+func (m *Manager) RunScript(ctx context.Context, req *jobpb.StartJobRequest, script []byte) (*jobpb.StartJobResponse, error) {
+	switch {
+	case req.GetExecutable() == "":
+		return nil, status.Error(codes.InvalidArgument, "executable (the interpreter) required")
+	case req.GetImage() != "":
+		return nil, status.Error(codes.InvalidArgument, "RunScript doesn't support images")
+	case req.GetValidateOnly():
+		return nil, status.Error(codes.InvalidArgument, "validate_only is not supported by RunScript; use StartJob")
+	case m.opts.Backend != nil:
+		return nil, status.Error(codes.FailedPrecondition, "RunScript needs the local exec backend")
+	case len(script) == 0:
+		return nil, status.Error(codes.InvalidArgument, "empty script")
+	}
+	return m.start(ctx, req, script)
+}
+
+// writeScript puts script in dir, readable only by the user the job runs
+// as and writable by no one, and returns its path.
+func writeScript(dir string, script []byte, cred *syscall.Credential) (string, error) {
+	uid, gid := joblib.NobodyID, joblib.NobodyID
+	if cred != nil {
+		uid, gid = int(cred.Uid), int(cred.Gid)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, scriptFilename)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(script)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chown(path, uid, gid)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("write %s: %w", path, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,153 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+const (
+	defaultSearchMatches = 100
+	maxSearchMatches     = 1000
+	maxSearchContext     = 100
+
+	// maxSearchLine is how much of each line is matched and returned; the
+	// rest is skipped.
+	maxSearchLine = 64 * 1024
+)
+
+// SearchOutput greps a job's stored output for req.pattern, returning each
+// match with up to context_lines of context on either side, until
+// max_matches. It reads the file once, front to back, holding only the
+// context window in memory, so multi-GB output costs time but not memory.
+func (m *Manager) SearchOutput(ctx context.Context, req *jobpb.SearchOutputRequest) (*jobpb.SearchOutputResponse, error) {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		return nil, m.notFound(req.GetJobId())
+	}
+	if req.GetPattern() == "" {
+		return nil, status.Error(codes.InvalidArgument, "pattern required")
+	}
+	pattern := req.GetPattern()
+	if req.GetIgnoreCase() {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid pattern: %v", err)
+	}
+	if req.GetContextLines() > maxSearchContext {
+		return nil, status.Errorf(codes.InvalidArgument, "context_lines %d exceeds %d", req.GetContextLines(), maxSearchContext)
+	}
+	limit := int(req.GetMaxMatches())
+	if limit == 0 {
+		limit = defaultSearchMatches
+	}
+	if limit > maxSearchMatches {
+		return nil, status.Errorf(codes.InvalidArgument, "max_matches %d exceeds %d", limit, maxSearchMatches)
+	}
+
+	rc, err := job.OpenOutput(req.GetTarget() == jobpb.StreamTarget_STREAM_TARGET_STDERR)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, status.Error(codes.FailedPrecondition, "job output not available")
+		}
+		return nil, status.Errorf(codes.Internal, "open output: %v", err)
+	}
+	defer rc.Close()
+
+	s := &searcher{re: re, context: int(req.GetContextLines()), limit: limit}
+	if err := s.run(ctx, bufio.NewReaderSize(rc, maxSearchLine)); err != nil {
+		return nil, err
+	}
+	return &jobpb.SearchOutputResponse{Lines: s.out, Matches: uint32(s.matches), Truncated: s.truncated}, nil
+}
+
+// searcher is one pass of SearchOutput over a file.
+type searcher struct {
+	re      *regexp.Regexp
+	context int
+	limit   int
+
+	before    []*jobpb.OutputLine // up to context lines not yet emitted
+	after     int                 // context lines still owed to the last match
+	out       []*jobpb.OutputLine
+	matches   int
+	truncated bool
+}
+
+func (s *searcher) run(ctx context.Context, r *bufio.Reader) error {
+	var number, offset uint64
+	for {
+		if number%4096 == 0 {
+			if err := ctx.Err(); err != nil {
+				return status.FromContextError(err).Err()
+			}
+		}
+		text, n, err := readLine(r)
+		if n == 0 {
+			if err != nil && !errors.Is(err, io.EOF) {
+				return status.Errorf(codes.Internal, "read output: %v", err)
+			}
+			return nil
+		}
+		number++
+		line := &jobpb.OutputLine{Number: number, Offset: offset}
+		offset += uint64(n)
+		keep := func() *jobpb.OutputLine {
+			line.Text = strings.ToValidUTF8(string(text), "\uFFFD")
+			return line
+		}
+
+		switch {
+		case s.matches < s.limit && s.re.Match(text):
+			line.Match = true
+			s.out = append(append(s.out, s.before...), keep())
+			s.before = s.before[:0]
+			s.after = s.context
+			s.matches++
+		case s.after > 0:
+			s.out = append(s.out, keep())
+			s.after--
+		case s.matches == s.limit:
+			// Whatever comes next is past the limit.
+			s.truncated = true
+			return nil
+		case s.context > 0:
+			if len(s.before) == s.context {
+				s.before = append(s.before[:0], s.before[1:]...)
+			}
+			s.before = append(s.before, keep())
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return status.Errorf(codes.Internal, "read output: %v", err)
+		}
+	}
+}
+
+// readLine returns the next line without its newline, cut to maxSearchLine
+// bytes, and n, how many bytes of the file it spanned. n is zero only at
+// the end of the file or on error.
+func readLine(r *bufio.Reader) (text []byte, n int, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += len(chunk)
+		if len(text) < maxSearchLine {
+			text = append(text, chunk[:min(len(chunk), maxSearchLine-len(text))]...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		return bytes.TrimSuffix(text, []byte("\n")), n, err
+	}
+}
@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/internal/secrets"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// TestSecretEnvNamespace checks that a job only gets its own namespace's
+// secrets: another's is PERMISSION_DENIED, not its value.
+func TestSecretEnvNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets")
+	if err := os.WriteFile(path, []byte("team-a/db-pass=a-pass\nteam-b/db-pass=b-pass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := secrets.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeBackends{jobs: make(map[string]*fakeBackend)}
+	m := NewManager(log.New(io.Discard, "", 0), Options{
+		Backend:  f.factory,
+		JobsDirs: []string{t.TempDir()},
+		Secrets:  store,
+	})
+	ctx := WithUser(context.Background(), "alice")
+
+	for _, tc := range []struct {
+		ref  string
+		code codes.Code
+	}{
+		{"db-pass", codes.OK},
+		{"team-a/db-pass", codes.OK},
+		{"team-b/db-pass", codes.PermissionDenied},
+		{"nope", codes.InvalidArgument},
+	} {
+		_, err := m.StartJob(ctx, &jobpb.StartJobRequest{
+			Executable: "/bin/true",
+			Namespace:  "team-a",
+			SecretEnv:  map[string]string{"DB_PASS": tc.ref},
+		})
+		if status.Code(err) != tc.code {
+			t.Errorf("secret %q: %v, want %s", tc.ref, err, tc.code)
+		}
+	}
+}
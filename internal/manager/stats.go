@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+const (
+	defaultStatsInterval = time.Second
+	minStatsInterval     = 100 * time.Millisecond
+)
+
+// GetStats samples the cgroup of each running job that req selects (by
+// owner and namespace, as in ListJobs), newest first. Jobs whose backend can't report
+// usage are left out.
+func (m *Manager) GetStats(ctx context.Context, req *jobpb.ListJobsRequest) (*jobpb.GetStatsResponse, error) {
+	return &jobpb.GetStatsResponse{Jobs: m.sampleStats(m.activeJobs(req.GetOwner(), req.GetNamespace()))}, nil
+}
+
+// WatchJobStats sends a GetStats-style sample now and every interval until
+// the caller goes away, or, for one job, until it is done. The caller has
+// already scoped req.owner.
+func (m *Manager) WatchJobStats(req *jobpb.WatchJobStatsRequest, stream jobpb.JobWorker_WatchJobStatsServer) error {
+	var (
+		one  *managedJob
+		done <-chan struct{}
+	)
+	if id := req.GetJobId(); id != "" {
+		if one = m.getJob(id); one == nil {
+			return m.notFound(id)
+		}
+		done = one.Done()
+	}
+
+	tick := time.NewTicker(StatsInterval(req))
+	defer tick.Stop()
+	for {
+		var jobs []*managedJob
+		switch {
+		case one == nil:
+			jobs = m.activeJobs(req.GetOwner(), "")
+		case one.active():
+			jobs = []*managedJob{one}
+		}
+		if err := stream.Send(&jobpb.GetStatsResponse{Jobs: m.sampleStats(jobs)}); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-done:
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// StatsInterval is how often a WatchJobStats stream samples: interval_ms,
+// at least 100ms, or every second if unset.
+func StatsInterval(req *jobpb.WatchJobStatsRequest) time.Duration {
+	if ms := req.GetIntervalMs(); ms > 0 {
+		return max(time.Duration(ms)*time.Millisecond, minStatsInterval)
+	}
+	return defaultStatsInterval
+}
+
+// activeJobs returns owner's running jobs in namespace ns, newest first;
+// an empty owner or ns matches any.
+func (m *Manager) activeJobs(owner, ns string) []*managedJob {
+	jobs := m.jobs.filter(func(j *managedJob) bool {
+		return j.active() && (owner == "" || j.owner == owner) && (ns == "" || j.namespace == ns)
+	})
+
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].startedAt.After(jobs[b].startedAt) })
+	return jobs
+}
+
+func (m *Manager) sampleStats(jobs []*managedJob) []*jobpb.JobStats {
+	out := make([]*jobpb.JobStats, 0, len(jobs))
+	for _, j := range jobs {
+		stats, err := j.Stats()
+		if err != nil {
+			continue
+		}
+		js := &jobpb.JobStats{
+			JobId:            j.ID(),
+			Owner:            j.owner,
+			Executable:       j.executable,
+			Node:             m.opts.NodeName,
+			SampledAt:        timestamppb.Now(),
+			CpuUsageUsec:     stats.CPUUsageUsec,
+			CpuThrottledUsec: stats.CPUThrottledUsec,
+			MemoryBytes:      stats.MemoryCurrent,
+			MemoryMaxBytes:   stats.MemoryMax,
+			IoReadBytes:      stats.IOReadBytes,
+			IoWriteBytes:     stats.IOWriteBytes,
+			Pids:             int32(stats.PIDs),
+		}
+		if t, ok := j.State().Entered[joblib.StatusRunning]; ok {
+			js.RunningAt = timestamppb.New(t)
+		}
+		out = append(out, js)
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// TestStopJobRacesExit runs concurrent StopJobs against the job exiting
+// on its own. Every StopJob answers with the job finished, at most one
+// says it stopped it, and the backend is killed at most once.
+func TestStopJobRacesExit(t *testing.T) {
+	m, f := newFakeManager(t)
+	ctx := WithUser(context.Background(), "alice")
+
+	for i := 0; i < 100; i++ {
+		resp, err := m.StartJob(ctx, &jobpb.StartJobRequest{Executable: "/bin/true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := resp.GetJobId()
+		b := f.get(id)
+
+		var stoppedIt atomic.Int32
+		var wg sync.WaitGroup
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			b.exit(0)
+		}()
+		for k := 0; k < 3; k++ {
+			go func() {
+				defer wg.Done()
+				resp, err := m.StopJob(ctx, &jobpb.StopJobRequest{JobId: id})
+				if err != nil {
+					t.Errorf("StopJob: %v", err)
+					return
+				}
+				if !resp.GetAlreadyStopped() {
+					stoppedIt.Add(1)
+				}
+				switch st := resp.GetMetadata().GetStatus(); st {
+				case jobpb.JobStatus_JOB_STATUS_EXITED, jobpb.JobStatus_JOB_STATUS_STOPPED:
+				default:
+					t.Errorf("StopJob answered with the job %s", st)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := stoppedIt.Load(); n > 1 {
+			t.Fatalf("%d StopJobs said they stopped the job", n)
+		}
+		if n := b.stops.Load(); n > 1 {
+			t.Fatalf("backend stopped %d times", n)
+		}
+	}
+}
+
+// TestStopJobAfterExit checks StopJob on a finished job: already_stopped,
+// and nothing signalled.
+func TestStopJobAfterExit(t *testing.T) {
+	m, f := newFakeManager(t)
+	ctx := WithUser(context.Background(), "alice")
+
+	resp, err := m.StartJob(ctx, &jobpb.StartJobRequest{Executable: "/bin/true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.GetJobId()
+	b := f.get(id)
+	b.exit(0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		st, err := m.GetStatus(ctx, &jobpb.GetStatusRequest{JobId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.GetMetadata().GetStatus() == jobpb.JobStatus_JOB_STATUS_EXITED {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", st.GetMetadata().GetStatus())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stop, err := m.StopJob(ctx, &jobpb.StopJobRequest{JobId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stop.GetAlreadyStopped() {
+		t.Error("already_stopped not set")
+	}
+	if n := b.stops.Load(); n != 0 {
+		t.Errorf("backend stopped %d times, want 0", n)
+	}
+}
@@ -0,0 +1,30 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+)
+
+// startTimeout arms mj's timeout, if it has one, as it starts running.
+func (m *Manager) startTimeout(mj *managedJob) {
+	if mj.timeout <= 0 {
+		return
+	}
+	mj.timer.Store(time.AfterFunc(mj.timeout, func() {
+		reason := fmt.Sprintf("stopped: timed out after %s", mj.timeout)
+		done, err := mj.StopWithReason(reason)
+		switch {
+		case err != nil:
+			m.logger.Printf("job %s: stop timed-out job: %v", mj.ID(), err)
+		case !done:
+			m.logger.Printf("job %s: %s", mj.ID(), reason)
+		}
+	}))
+}
+
+// stopTimeout disarms mj's timeout once it is done.
+func (mj *managedJob) stopTimeout() {
+	if t := mj.timer.Swap(nil); t != nil {
+		t.Stop()
+	}
+}
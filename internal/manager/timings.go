@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/metrics"
+	"github.com/bucknercd/jobworker/internal/tail"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// Each job's start is timed step by step, so a slow start on a loaded host
+// can be pinned on planning, the launch queue, the cgroup, the filesystem,
+// exec, or the program itself being slow to write. The manager times the
+// steps around the launch; the backend times the launch (joblib.StartTimings).
+
+// startPhases label the jobworker_job_start_seconds histograms, one per
+// StartTimings field.
+var startPhases = []string{"validate", "queued", "cgroup", "filesystem", "exec", "first_output"}
+
+func newStartSeconds() *metrics.HistogramVec {
+	return metrics.NewHistogramVec("jobworker_job_start_seconds",
+		"How long each step of starting a job took.", "phase", startPhases, metrics.DefaultBuckets)
+}
+
+// startTimes is what the manager times of one job's start.
+type startTimes struct {
+	validate    time.Duration // set by create
+	queued      atomic.Int64  // ns in the launch queue; set by launch
+	firstOutput atomic.Int64  // ns from running to the first output; set once
+	watches     []*tail.Watch // for the first output; see watchFirstOutput
+}
+
+// observe records d as one job's phase in the histograms.
+func (m *Manager) observe(phase string, d time.Duration) {
+	m.startSeconds.With(phase).Observe(d)
+}
+
+// launchTimed records the backend's timings of mj's launch once it is
+// running, and starts waiting for its first output.
+func (m *Manager) launchTimed(mj *managedJob, running time.Time) {
+	t := mj.StartTimings()
+	m.observe("cgroup", t.Cgroup)
+	m.observe("filesystem", t.Filesystem)
+	m.observe("exec", t.Exec)
+	m.watchFirstOutput(mj, running)
+}
+
+// watchFirstOutput records how long after running mj first wrote to stdout
+// or stderr. Output written before the watches are in place counts as
+// written now. It isn't timed without inotify, or with output encryption,
+// whose files start with a header.
+func (m *Manager) watchFirstOutput(mj *managedJob, running time.Time) {
+	if m.notifier == nil || m.opts.OutputKey != nil {
+		return
+	}
+	wrote := func() {
+		d := max(time.Since(running), time.Microsecond)
+		if mj.times.firstOutput.CompareAndSwap(0, int64(d)) {
+			m.observe("first_output", d)
+		}
+	}
+	for _, stderr := range []bool{false, true} {
+		path, ok := mj.OutputPath(stderr)
+		if !ok {
+			continue
+		}
+		w, err := m.notifier.Once(path, wrote)
+		if err != nil {
+			continue
+		}
+		mj.times.watches = append(mj.times.watches, w)
+		if outputSize(mj, stderr) > 0 {
+			wrote()
+		}
+	}
+}
+
+// stopTiming drops the first-output watches of a job that is done.
+func (j *managedJob) stopTiming() {
+	for _, w := range j.times.watches {
+		w.Close()
+	}
+	j.times.watches = nil
+}
+
+// startTimings reports j's timings as far as its start has got.
+func (j *managedJob) startTimings() *jobpb.StartTimings {
+	b := j.StartTimings()
+	return &jobpb.StartTimings{
+		ValidateUsec:    usec(j.times.validate),
+		QueuedUsec:      usec(time.Duration(j.times.queued.Load())),
+		CgroupUsec:      usec(b.Cgroup),
+		FilesystemUsec:  usec(b.Filesystem),
+		ExecUsec:        usec(b.Exec),
+		FirstOutputUsec: usec(time.Duration(j.times.firstOutput.Load())),
+	}
+}
+
+func usec(d time.Duration) uint64 {
+	return uint64(max(d.Microseconds(), 0))
+}
+
+// WriteMetrics writes the start histograms in the Prometheus text format.
+func (m *Manager) WriteMetrics(w io.Writer) error {
+	_, err := m.startSeconds.WriteTo(w)
+	return err
+}
@@ -0,0 +1,45 @@
+package manager
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bucknercd/jobworker/pkg/joblib"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// ttySize converts StartJobRequest.tty; nil for none.
+func ttySize(t *jobpb.TerminalSize) (*joblib.TTYSize, error) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.GetRows() > 0xffff || t.GetCols() > 0xffff {
+		return nil, status.Errorf(codes.InvalidArgument, "terminal size %dx%d is too large", t.GetCols(), t.GetRows())
+	}
+	return &joblib.TTYSize{Rows: uint16(t.GetRows()), Cols: uint16(t.GetCols())}, nil
+}
+
+// ResizeTerminal sets the window size of a running job started with tty.
+func (m *Manager) ResizeTerminal(ctx context.Context, req *jobpb.ResizeTerminalRequest) (*jobpb.ResizeTerminalResponse, error) {
+	job := m.getJob(req.GetJobId())
+	if job == nil {
+		return nil, m.notFound(req.GetJobId())
+	}
+	size, err := ttySize(req.GetSize())
+	if err != nil {
+		return nil, err
+	}
+	if size == nil {
+		return nil, status.Error(codes.InvalidArgument, "size required")
+	}
+	switch err := job.Resize(*size); {
+	case errors.Is(err, joblib.ErrNoTTY):
+		return nil, status.Error(codes.FailedPrecondition, "job has no terminal")
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "resize terminal: %v", err)
+	}
+	return &jobpb.ResizeTerminalResponse{}, nil
+}
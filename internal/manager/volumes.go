@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"github.com/bucknercd/jobworker/internal/volumes"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// pickJobsDir chooses the JobsDirs entry for a new job's output, and logs
+// when every volume has dropped below MinFree, and when one has room
+// again.
+func (m *Manager) pickJobsDir() string {
+	dir, full := m.volumes.Pick()
+	if m.volumesFull.Swap(full) != full {
+		if full {
+			m.logger.Printf("every jobs dir is below %s free; placing output on %s, the one with the most", m.volumes.MinFree, dir)
+		} else {
+			m.logger.Printf("jobs dirs have room again; placing output on %s", dir)
+		}
+	}
+	return dir
+}
+
+// outputVolumes reports each JobsDirs entry's volume, and the jobs in d
+// placed there.
+func (m *Manager) outputVolumes(d []*jobpb.JobDiagnostics) []*jobpb.OutputVolume {
+	out := make([]*jobpb.OutputVolume, len(m.volumes.Dirs))
+	byDir := make(map[string]*jobpb.OutputVolume, len(out))
+	for i, dir := range m.volumes.Dirs {
+		v := &jobpb.OutputVolume{Path: dir}
+		if u, err := volumes.Stat(dir); err == nil {
+			v.TotalBytes, v.FreeBytes = u.Total, u.Free
+			v.BelowMinFree = !m.volumes.MinFree.Met(u)
+		}
+		out[i], byDir[dir] = v, v
+	}
+	for _, j := range d {
+		if v := byDir[j.GetJobsDir()]; v != nil {
+			v.Jobs++
+			v.OutputBytes += max(j.GetStdoutBytes(), 0) + max(j.GetStderrBytes(), 0)
+		}
+	}
+	return out
+}
@@ -0,0 +1,283 @@
+// Package manifest reads job manifests: YAML (or JSON) files declaring
+// named jobs, which jobctl apply starts and jobworker-server -ensure-file
+// keeps running. Each job is turned into a client.JobSpec labelled with
+// its name and a hash of its definition, so the jobs started from it can
+// be found again and told apart from ones started from an older version.
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/bucknercd/jobworker/internal/limits"
+	"github.com/bucknercd/jobworker/pkg/client"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// Labels every job started from a manifest carries.
+const (
+	NameLabel = "jobctl/name" // the manifest job's name
+	SpecLabel = "jobctl/spec" // a hash of what the manifest asked for
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Job is a manifest job made ready to start.
+type Job struct {
+	Name string
+	Spec client.JobSpec
+	Hash string // Spec's SpecLabel value
+}
+
+// jobDef is one job in a manifest. Fields follow jobctl's start flags;
+// limits take the same values.
+type jobDef struct {
+	Name         string            `yaml:"name"`
+	Command      string            `yaml:"command"`
+	Args         []string          `yaml:"args"`
+	Image        string            `yaml:"image"`
+	Env          map[string]string `yaml:"env"`
+	SecretEnv    map[string]string `yaml:"secret_env"`
+	Labels       map[string]string `yaml:"labels"`
+	NodeSelector map[string]string `yaml:"node_selector"`
+	Namespace    string            `yaml:"namespace"`
+	Limits       limitsDef         `yaml:"limits"`
+	MaxOutput    string            `yaml:"max_output"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	Restart      *restartDef       `yaml:"restart"`
+}
+
+type limitsDef struct {
+	CPU        string `yaml:"cpu"`
+	Memory     string `yaml:"memory"`
+	Swap       string `yaml:"swap"`
+	IO         string `yaml:"io"`
+	CPUSet     string `yaml:"cpuset"`
+	CPUSetMems string `yaml:"cpuset_mems"`
+	PIDs       string `yaml:"pids"`
+	NoFile     string `yaml:"nofile"`
+	NProc      string `yaml:"nproc"`
+	FSize      string `yaml:"fsize"`
+	GPUs       int    `yaml:"gpus"`
+}
+
+type restartDef struct {
+	Max   uint32        `yaml:"max"`
+	Delay time.Duration `yaml:"delay"`
+}
+
+// doc is one YAML document of a manifest: a job, or a list of them under
+// jobs.
+type doc struct {
+	Jobs   []jobDef `yaml:"jobs"`
+	jobDef `yaml:",inline"`
+}
+
+// Read reads the manifest at path, - meaning stdin.
+func Read(path string) ([]Job, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return jobs, nil
+}
+
+// Parse parses a manifest: YAML documents, or JSON, each a job or a list
+// of them under jobs. Unknown fields and repeated names are errors, so
+// typos don't go unnoticed.
+func Parse(data []byte) ([]Job, error) {
+	var defs []jobDef
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	for {
+		var d doc
+		err := dec.Decode(&d)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d.Jobs == nil {
+			defs = append(defs, d.jobDef)
+			continue
+		}
+		if d.Name != "" || d.Command != "" || d.Image != "" {
+			return nil, errors.New("a document holds either one job or a jobs list, not both")
+		}
+		defs = append(defs, d.Jobs...)
+	}
+	if len(defs) == 0 {
+		return nil, errors.New("no jobs")
+	}
+
+	seen := make(map[string]bool, len(defs))
+	out := make([]Job, 0, len(defs))
+	for i, def := range defs {
+		j, err := def.job()
+		if err != nil {
+			if def.Name == "" {
+				return nil, fmt.Errorf("jobs[%d]: %v", i, err)
+			}
+			return nil, fmt.Errorf("job %s: %v", def.Name, err)
+		}
+		if seen[j.Name] {
+			return nil, fmt.Errorf("job %s appears more than once", j.Name)
+		}
+		seen[j.Name] = true
+		out = append(out, j)
+	}
+	return out, nil
+}
+
+// job checks d as jobctl start would and turns it into a JobSpec labelled
+// with d's name and the hash of the rest.
+func (d jobDef) job() (Job, error) {
+	switch {
+	case !validName.MatchString(d.Name):
+		return Job{}, fmt.Errorf("name %q: want 1 to 128 letters, digits, '.', '_' or '-', not starting with a symbol", d.Name)
+	case d.Command == "" && d.Image == "":
+		return Job{}, errors.New("command or image required")
+	case d.Timeout < 0 || d.Timeout%time.Second != 0:
+		return Job{}, fmt.Errorf("timeout %s: want whole seconds", d.Timeout)
+	case d.Restart != nil && (d.Restart.Max == 0 || d.Restart.Delay < 0 || d.Restart.Delay%time.Second != 0):
+		return Job{}, errors.New("restart: max must be at least 1, and delay whole seconds")
+	}
+	for k := range d.Labels {
+		if strings.HasPrefix(k, "jobctl/") {
+			return Job{}, fmt.Errorf("label %s: jobctl/ labels are set from the manifest", k)
+		}
+	}
+	l := d.Limits
+	if _, err := limits.Parse(limits.Spec{CPU: l.CPU, Memory: l.Memory, Swap: l.Swap, IOClass: l.IO, CPUs: l.CPUSet, Mems: l.CPUSetMems, PIDs: l.PIDs,
+		NoFile: l.NoFile, NProc: l.NProc, FSize: l.FSize}); err != nil {
+		return Job{}, fmt.Errorf("invalid limits: %v", err)
+	}
+	maxOutput, err := limits.ParseMemory(d.MaxOutput)
+	if err != nil {
+		return Job{}, fmt.Errorf("invalid max_output: %v", err)
+	}
+
+	labels := make(map[string]string, len(d.Labels)+2)
+	for k, v := range d.Labels {
+		labels[k] = v
+	}
+	labels[NameLabel] = d.Name
+	spec := client.JobSpec{
+		Executable:     d.Command,
+		Args:           d.Args,
+		Image:          d.Image,
+		Env:            d.Env,
+		SecretEnv:      d.SecretEnv,
+		Labels:         labels,
+		NodeSelector:   d.NodeSelector,
+		Namespace:      d.Namespace,
+		CPU:            l.CPU,
+		Memory:         l.Memory,
+		Swap:           l.Swap,
+		IOClass:        l.IO,
+		CPUSet:         l.CPUSet,
+		CPUSetMems:     l.CPUSetMems,
+		PIDsMax:        l.PIDs,
+		NoFile:         l.NoFile,
+		NProc:          l.NProc,
+		FileSize:       l.FSize,
+		GPUs:           l.GPUs,
+		MaxOutputBytes: uint64(maxOutput.Bytes()),
+		Timeout:        d.Timeout,
+	}
+	if r := d.Restart; r != nil {
+		spec.MaxRestarts, spec.RestartDelay = r.Max, r.Delay
+	}
+	hash, err := specHash(spec)
+	if err != nil {
+		return Job{}, err
+	}
+	labels[SpecLabel] = hash
+	return Job{Name: d.Name, Spec: spec, Hash: hash}, nil
+}
+
+// specHash identifies what spec asks the server for, so a job started from
+// it can be told from one started from another definition.
+func specHash(spec client.JobSpec) (string, error) {
+	b, err := json.Marshal(spec) // map keys sorted, so stable
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6]), nil
+}
+
+// Latest returns the newest of jobs (newest first, as ListJobs returns
+// them) started for the manifest job name, or nil.
+func Latest(jobs []*jobpb.JobSummary, name string) *jobpb.JobSummary {
+	for _, j := range jobs {
+		if j.GetLabels()[NameLabel] == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// Current reports whether summary j was started from job's definition as
+// it is now.
+func (job Job) Current(j *jobpb.JobSummary) bool {
+	return j.GetLabels()[SpecLabel] == job.Hash
+}
+
+// Capabilities are the server capabilities jobs need beyond those of a
+// plain StartJob.
+func Capabilities(jobs []Job) []string {
+	var caps []string
+	need := func(c string) {
+		if !slices.Contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	for _, j := range jobs {
+		if len(j.Spec.Env) > 0 {
+			need("job-env")
+		}
+		if j.Spec.MaxRestarts > 0 {
+			need("job-restarts")
+		}
+		if j.Spec.Timeout > 0 {
+			need("job-timeouts")
+		}
+	}
+	return caps
+}
+
+// Active reports whether a job in status st has yet to finish.
+func Active(st jobpb.JobStatus) bool {
+	switch st {
+	case jobpb.JobStatus_JOB_STATUS_EXITED, jobpb.JobStatus_JOB_STATUS_STOPPED,
+		jobpb.JobStatus_JOB_STATUS_FAILED, jobpb.JobStatus_JOB_STATUS_EXPIRED:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Package metrics keeps latency histograms and writes them in the
+// Prometheus text exposition format, without pulling in a client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are upper bounds in seconds, from half a millisecond to
+// a minute: wide enough for a cgroup mkdir and for a slow first write.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram counts durations into cumulative buckets. It is safe for
+// concurrent use; Observe doesn't lock.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, plus +Inf last
+	sum    atomic.Uint64   // nanoseconds
+}
+
+// NewHistogram returns a histogram with the given upper bounds in
+// seconds, which must be sorted.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// Observe records one duration.
+func (h *Histogram) Observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && s > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(uint64(max(d, 0)))
+}
+
+// HistogramVec is a family of histograms told apart by one label.
+type HistogramVec struct {
+	Name, Help, Label string
+
+	values []string
+	hists  []*Histogram
+}
+
+// NewHistogramVec returns a family with one histogram per label value,
+// all with bounds.
+func NewHistogramVec(name, help, label string, values []string, bounds []float64) *HistogramVec {
+	v := &HistogramVec{Name: name, Help: help, Label: label, values: values}
+	for range values {
+		v.hists = append(v.hists, NewHistogram(bounds))
+	}
+	return v
+}
+
+// With returns the histogram for value, or nil for one it wasn't made with.
+func (v *HistogramVec) With(value string) *Histogram {
+	for i, x := range v.values {
+		if x == value {
+			return v.hists[i]
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the family in the Prometheus text format.
+func (v *HistogramVec) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s histogram\n", v.Name, v.Help, v.Name)
+	for i, h := range v.hists {
+		label := fmt.Sprintf("%s=%q", v.Label, v.values[i])
+		var total uint64
+		for b := range h.counts {
+			total += h.counts[b].Load()
+			le := "+Inf"
+			if b < len(h.bounds) {
+				le = strconv.FormatFloat(h.bounds[b], 'g', -1, 64)
+			}
+			fmt.Fprintf(cw, "%s_bucket{%s,le=%q} %d\n", v.Name, label, le, total)
+		}
+		fmt.Fprintf(cw, "%s_sum{%s} %g\n", v.Name, label, time.Duration(h.sum.Load()).Seconds())
+		fmt.Fprintf(cw, "%s_count{%s} %d\n", v.Name, label, total)
+	}
+	return cw.n, cw.err
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
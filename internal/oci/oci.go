@@ -0,0 +1,282 @@
+// Package oci prepares root filesystems for container-image jobs. It reads
+// images that are already on disk, either as an OCI image layout (e.g.
+// produced by `skopeo copy docker://alpine:3 oci:/srv/images/alpine:3`) or as
+// an unpacked OCI runtime bundle, and caches unpacked layouts by manifest
+// digest. It does not talk to registries.
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	mediaTypeIndex        = "application/vnd.oci.image.index.v1+json"
+	dockerManifestList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	annotationRefName     = "org.opencontainers.image.ref.name"
+	defaultPath           = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	layoutPrefix          = "oci:"
+	bundlePrefix          = "bundle:"
+	unpackedRootfsDirName = "rootfs"
+)
+
+var (
+	// ErrNotFound means the reference doesn't name an image on this host.
+	ErrNotFound = errors.New("image not found")
+	// ErrInvalidRef means the reference isn't in a supported form.
+	ErrInvalidRef = errors.New("unsupported image reference")
+)
+
+// Image is a ready-to-run root filesystem plus the process defaults from
+// the image config.
+type Image struct {
+	Ref        string
+	RootFS     string
+	Env        []string
+	WorkingDir string
+	Entrypoint []string
+	Cmd        []string
+}
+
+// Store resolves image references and caches unpacked layouts under Root.
+type Store struct {
+	Root string
+
+	mu sync.Mutex // serialises unpacking
+}
+
+func NewStore(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{Root: root}, nil
+}
+
+// Resolve returns a runnable image for ref:
+//
+//	oci:<layout-dir>[:<tag>]  OCI image layout, unpacked into the cache
+//	bundle:<dir>              OCI runtime bundle (config.json + rootfs), used in place
+func (s *Store) Resolve(ref string) (*Image, error) {
+	switch {
+	case strings.HasPrefix(ref, layoutPrefix):
+		dir, tag := splitLayoutRef(strings.TrimPrefix(ref, layoutPrefix))
+		img, err := s.fromLayout(dir, tag)
+		if err != nil {
+			return nil, err
+		}
+		img.Ref = ref
+		return img, nil
+	case strings.HasPrefix(ref, bundlePrefix):
+		img, err := fromBundle(strings.TrimPrefix(ref, bundlePrefix))
+		if err != nil {
+			return nil, err
+		}
+		img.Ref = ref
+		return img, nil
+	default:
+		return nil, fmt.Errorf("%w %q (want oci:<dir>[:tag] or bundle:<dir>)", ErrInvalidRef, ref)
+	}
+}
+
+// LookPath finds file the way a shell inside the image would, returning the
+// path as seen from inside the rootfs.
+func (img *Image) LookPath(file string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	p := defaultPath
+	for _, kv := range img.Env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			p = v
+		}
+	}
+	for _, dir := range filepath.SplitList(p) {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		inImage := path.Join(dir, file)
+		// Symlinks (e.g. /bin -> usr/bin) resolve against the rootfs, not the host.
+		if fi, err := statInRoot(img.RootFS, inImage); err == nil && fi.Mode().IsRegular() && fi.Mode()&0o111 != 0 {
+			return inImage, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found in image PATH %s", file, p)
+}
+
+func splitLayoutRef(s string) (dir, tag string) {
+	// The tag is whatever follows the last ':' after the final path element.
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+type imageConfig struct {
+	Config struct {
+		Env        []string `json:"Env"`
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+		WorkingDir string   `json:"WorkingDir"`
+	} `json:"config"`
+}
+
+func (s *Store) fromLayout(dir, tag string) (*Image, error) {
+	var idx index
+	if err := readJSON(filepath.Join(dir, "index.json"), &idx); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: no OCI layout at %s", ErrNotFound, dir)
+		}
+		return nil, err
+	}
+
+	desc, err := pickManifest(idx.Manifests, tag)
+	if err != nil {
+		return nil, err
+	}
+	// Multi-platform images point at a nested index first.
+	for desc.MediaType == mediaTypeIndex || desc.MediaType == dockerManifestList {
+		var nested index
+		if err := readBlob(dir, desc.Digest, &nested); err != nil {
+			return nil, err
+		}
+		if desc, err = pickPlatform(nested.Manifests); err != nil {
+			return nil, err
+		}
+	}
+
+	var m manifest
+	if err := readBlob(dir, desc.Digest, &m); err != nil {
+		return nil, err
+	}
+	var cfg imageConfig
+	if err := readBlob(dir, m.Config.Digest, &cfg); err != nil {
+		return nil, err
+	}
+
+	rootfs, err := s.unpack(dir, desc.Digest, m.Layers)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		RootFS:     rootfs,
+		Env:        cfg.Config.Env,
+		WorkingDir: cfg.Config.WorkingDir,
+		Entrypoint: cfg.Config.Entrypoint,
+		Cmd:        cfg.Config.Cmd,
+	}, nil
+}
+
+func pickManifest(ds []descriptor, tag string) (descriptor, error) {
+	if tag == "" {
+		if len(ds) == 1 {
+			return ds[0], nil
+		}
+		return descriptor{}, fmt.Errorf("layout holds %d images; specify oci:<dir>:<tag>", len(ds))
+	}
+	for _, d := range ds {
+		if d.Annotations[annotationRefName] == tag {
+			return d, nil
+		}
+	}
+	return descriptor{}, fmt.Errorf("%w: no tag %q in layout", ErrNotFound, tag)
+}
+
+func pickPlatform(ds []descriptor) (descriptor, error) {
+	for _, d := range ds {
+		if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+			return d, nil
+		}
+	}
+	return descriptor{}, fmt.Errorf("%w: no linux/%s variant", ErrNotFound, runtime.GOARCH)
+}
+
+// bundleConfig is the subset of an OCI runtime config.json we honour.
+type bundleConfig struct {
+	Process struct {
+		Args []string `json:"args"`
+		Env  []string `json:"env"`
+		Cwd  string   `json:"cwd"`
+	} `json:"process"`
+	Root struct {
+		Path string `json:"path"`
+	} `json:"root"`
+}
+
+func fromBundle(dir string) (*Image, error) {
+	var cfg bundleConfig
+	if err := readJSON(filepath.Join(dir, "config.json"), &cfg); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: no bundle config.json in %s", ErrNotFound, dir)
+		}
+		return nil, err
+	}
+	root := cfg.Root.Path
+	if root == "" {
+		root = unpackedRootfsDirName
+	}
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(dir, root)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%w: bundle rootfs %s missing", ErrNotFound, root)
+	}
+	return &Image{
+		RootFS:     root,
+		Env:        cfg.Process.Env,
+		WorkingDir: cfg.Process.Cwd,
+		Cmd:        cfg.Process.Args,
+	}, nil
+}
+
+func readBlob(layout, digest string, v any) error {
+	p, err := blobPath(layout, digest)
+	if err != nil {
+		return err
+	}
+	return readJSON(p, v)
+}
+
+func blobPath(layout, digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, "/\\.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(layout, "blobs", alg, hex), nil
+}
+
+func readJSON(p string, v any) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parse %s: %w", p, err)
+	}
+	return nil
+}
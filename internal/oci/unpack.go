@@ -0,0 +1,260 @@
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	maxSymlinkHops = 40
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// unpack extracts layers into the cache keyed by manifestDigest and returns
+// the rootfs path. A finished unpack is reused; a half-finished one (crash)
+// is discarded because only complete trees are renamed into place.
+func (s *Store) unpack(layout, manifestDigest string, layers []descriptor) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dest := filepath.Join(s.Root, strings.Replace(manifestDigest, ":", "-", 1))
+	rootfs := filepath.Join(dest, unpackedRootfsDirName)
+	if _, err := os.Stat(rootfs); err == nil {
+		return rootfs, nil
+	}
+
+	tmp, err := os.MkdirTemp(s.Root, ".unpack-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	tmpRoot := filepath.Join(tmp, unpackedRootfsDirName)
+	if err := os.Mkdir(tmpRoot, 0o755); err != nil {
+		return "", err
+	}
+	for _, l := range layers {
+		if err := applyLayer(layout, l, tmpRoot); err != nil {
+			return "", fmt.Errorf("layer %s: %w", l.Digest, err)
+		}
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", err
+	}
+	return rootfs, nil
+}
+
+func applyLayer(layout string, l descriptor, root string) error {
+	p, err := blobPath(layout, l.Digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		return errors.New("zstd-compressed layers are not supported; re-copy the image with gzip layers")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyEntry(root, hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func applyEntry(root string, hdr *tar.Header, r io.Reader) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	base := path.Base(name)
+
+	parent, err := resolveInRoot(root, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+
+	switch {
+	case base == whiteoutOpaque:
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(parent, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		return os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+
+	target := filepath.Join(parent, base)
+	// No setuid/setgid in job images: jobs run unprivileged and shouldn't
+	// be able to regain privileges through the image.
+	mode := fs.FileMode(hdr.Mode) & (fs.ModePerm | fs.ModeSticky)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		if err := os.Mkdir(target, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	case tar.TypeReg:
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		// Symlinks are stored verbatim; they're resolved against the rootfs
+		// (never the host) by resolveInRoot and, at run time, by the chroot.
+		return lchown(target, hdr, os.Symlink(hdr.Linkname, target))
+	case tar.TypeLink:
+		// Resolve the link's directory only: a hardlink to a symlink links
+		// the symlink itself.
+		ln := path.Clean("/" + hdr.Linkname)
+		srcDir, err := resolveInRoot(root, path.Dir(ln))
+		if err != nil {
+			return err
+		}
+		src := filepath.Join(srcDir, path.Base(ln))
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		return os.Link(src, target)
+	default:
+		// Device nodes, fifos, etc. are skipped: unprivileged jobs can't use
+		// them and the chroot has no /dev of its own.
+		return nil
+	}
+
+	if err := lchown(target, hdr, nil); err != nil {
+		return err
+	}
+	return os.Chmod(target, mode)
+}
+
+func lchown(target string, hdr *tar.Header, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	return nil
+}
+
+// resolveInRoot maps the in-image path p to a host path under root,
+// following symlinks as if root were "/" so that no link (absolute or
+// "../"-laden) can point outside it. Missing components are allowed.
+func resolveInRoot(root, p string) (string, error) {
+	var (
+		resolved = "/"
+		rest     = strings.Split(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+		hops     = 0
+	)
+	for len(rest) > 0 {
+		comp := rest[0]
+		rest = rest[1:]
+		if comp == "" || comp == "." {
+			continue
+		}
+		if comp == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, comp)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many symlinks resolving %s", p)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(link, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+func statInRoot(root, p string) (fs.FileInfo, error) {
+	hp, err := resolveInRoot(root, p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(hp)
+}
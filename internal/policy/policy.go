@@ -0,0 +1,164 @@
+// Package policy asks an Open Policy Agent whether a call is allowed. The
+// Rego policy is loaded into OPA (as a bundle or files) and queried over
+// its Data API, so the server needs no Rego engine of its own:
+//
+//	opa run --server --bundle ./jobworker-policy
+//	jobworker-server -policy-url http://127.0.0.1:8181/v1/data/jobworker/allow
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/limits"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// maxResponse bounds what is read of OPA's reply.
+const maxResponse = 1 << 20
+
+// Input is the document a policy sees as input.
+type Input struct {
+	Subject   string `json:"subject"`   // the caller: CN or token user
+	Admin     bool   `json:"admin"`     // whether the subject is in -admin-cns
+	Namespace string `json:"namespace"` // the subject's own (cert OU, or "default")
+	Service   string `json:"service"`   // "JobWorker" or "Admin"
+	Verb      string `json:"verb"`      // the RPC, e.g. "StartJob"
+	// Jobs describes the jobs a call would start: one for StartJob,
+	// CreateJob and RunScript, one per member for StartJobs.
+	Jobs []Job `json:"jobs,omitempty"`
+	// Request is the request message as JSON, with proto field names.
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// Job is what a start request asks for, with limits in plain numbers so
+// policies can compare them. Zero limits mean none were asked for.
+type Job struct {
+	Executable   string            `json:"executable"`
+	Args         []string          `json:"args"`
+	Image        string            `json:"image,omitempty"`
+	Namespace    string            `json:"namespace,omitempty"` // as requested; empty for the subject's own
+	Labels       map[string]string `json:"labels,omitempty"`
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	SecretNames  []string          `json:"secret_names,omitempty"`
+	CPUMillis    int64             `json:"cpu_millis"`
+	MemoryBytes  int64             `json:"memory_bytes"`
+	GPUs         int               `json:"gpus"`
+}
+
+// JobOf describes req. Limits that don't parse are left zero; the server
+// rejects them later anyway.
+func JobOf(req *jobpb.StartJobRequest) Job {
+	j := Job{
+		Executable:   req.GetExecutable(),
+		Args:         append([]string{}, req.GetArgs()...),
+		Image:        req.GetImage(),
+		Namespace:    req.GetNamespace(),
+		Labels:       req.GetLabels(),
+		NodeSelector: req.GetNodeSelector(),
+	}
+	for _, name := range req.GetSecretEnv() {
+		j.SecretNames = append(j.SecretNames, name)
+	}
+	sort.Strings(j.SecretNames)
+	l := req.GetLimits()
+	if c, err := limits.ParseCPU(l.GetCpu()); err == nil {
+		j.CPUMillis = c.Millis()
+	}
+	if m, err := limits.ParseMemory(l.GetMemoryMax()); err == nil {
+		j.MemoryBytes = m.Bytes()
+	}
+	j.GPUs = int(l.GetGpuCount())
+	if n := len(l.GetGpuUuids()); n > 0 {
+		j.GPUs = n
+	}
+	return j
+}
+
+// Decision is a policy's answer.
+type Decision struct {
+	Allow  bool
+	Reason string // from the policy, if it gave one
+}
+
+// Client queries one OPA rule.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// New returns a client for the rule at ruleURL, an OPA Data API URL such
+// as http://127.0.0.1:8181/v1/data/jobworker/allow.
+func New(ruleURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(ruleURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%s: want an http(s) OPA Data API URL", ruleURL)
+	}
+	return &Client{url: ruleURL, http: &http.Client{Timeout: timeout}}, nil
+}
+
+// Decide evaluates the rule with in. The rule may be a boolean, or an
+// object with a boolean "allow" and a string "reason". An undefined rule
+// denies.
+func (c *Client) Decide(ctx context.Context, in Input) (Decision, error) {
+	body, err := json.Marshal(map[string]Input{"input": in})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return Decision{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("opa: unexpected status %s", resp.Status)
+	}
+	return parseResult(b)
+}
+
+func parseResult(b []byte) (Decision, error) {
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return Decision{}, fmt.Errorf("opa: %w", err)
+	}
+	if len(out.Result) == 0 {
+		return Decision{Reason: "policy rule is undefined"}, nil
+	}
+	var allow bool
+	if err := json.Unmarshal(out.Result, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var obj struct {
+		Allow  *bool  `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(out.Result, &obj); err != nil || obj.Allow == nil {
+		return Decision{}, errors.New("opa: result is neither a boolean nor {allow, reason}")
+	}
+	return Decision{Allow: *obj.Allow, Reason: obj.Reason}, nil
+}
+
+// String is the rule URL, for the startup log.
+func (c *Client) String() string { return c.url }
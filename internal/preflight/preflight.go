@@ -0,0 +1,278 @@
+// Package preflight checks that the host can run jobs before the server
+// takes any: privileges, cgroups, the job output directory and TLS
+// certificates. The server logs the results at startup; -check prints
+// them and exits.
+package preflight
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bucknercd/jobworker/internal/cgroups"
+	"github.com/bucknercd/jobworker/internal/privs"
+)
+
+// DefaultCertWarning is how close to expiry a certificate gets a warning.
+const DefaultCertWarning = 30 * 24 * time.Hour
+
+// Level is how bad a result is.
+type Level int
+
+const (
+	OK Level = iota
+	Warn
+	Fail
+)
+
+func (l Level) String() string {
+	switch l {
+	case OK:
+		return "OK"
+	case Warn:
+		return "WARN"
+	}
+	return "FAIL"
+}
+
+// Result is one check's outcome.
+type Result struct {
+	Check  string
+	Level  Level
+	Detail string
+}
+
+// Config is what the server is about to run with.
+type Config struct {
+	CertsDir string
+
+	// RunsJobs is false for a coordinator, which only checks its certs.
+	RunsJobs bool
+	JobsDirs []string
+	Cgroups  cgroups.Roots
+	// SystemdSlice, when set, means the systemd cgroup driver.
+	SystemdSlice string
+	// RunAs is who jobs run as; nil means nobody.
+	RunAs *syscall.Credential
+
+	// CertWarning defaults to DefaultCertWarning.
+	CertWarning time.Duration
+}
+
+// controllers are the ones job limits need.
+var controllers = []string{"cpu", "cpuset", "memory", "io", "pids"}
+
+// Run performs every check that applies to cfg. It changes nothing on
+// the host beyond a probe file in the jobs directory.
+func Run(cfg Config) []Result {
+	if cfg.CertWarning == 0 {
+		cfg.CertWarning = DefaultCertWarning
+	}
+	var out []Result
+	if cfg.RunsJobs {
+		out = append(out, privileges(cfg))
+		if cfg.SystemdSlice != "" {
+			out = append(out, systemd(cfg.SystemdSlice))
+		} else {
+			out = append(out, cgroupFS(cfg.Cgroups)...)
+		}
+		for _, dir := range cfg.JobsDirs {
+			out = append(out, jobsDir(dir))
+		}
+	}
+	return append(out, certs(cfg.CertsDir, cfg.CertWarning, time.Now())...)
+}
+
+// Failed reports whether any result is a failure.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Level == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints results as an aligned table.
+func Write(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Level, r.Check, r.Detail)
+	}
+	return tw.Flush()
+}
+
+func privileges(cfg Config) Result {
+	r := Result{Check: "privileges"}
+	if os.Geteuid() == 0 {
+		r.Detail = "running as root"
+		return r
+	}
+	self := cfg.RunAs != nil && int(cfg.RunAs.Uid) == os.Getuid() && int(cfg.RunAs.Gid) == os.Getgid()
+	if self {
+		r.Detail = fmt.Sprintf("uid %d; jobs run as this user, so no capabilities are needed", os.Getuid())
+		return r
+	}
+	eff, err := privs.Current()
+	if err != nil {
+		return Result{"privileges", Fail, fmt.Sprintf("not root and can't read capabilities: %v", err)}
+	}
+	need := privs.Needs(false, false)
+	if missing := need &^ eff; missing != 0 {
+		return Result{"privileges", Fail, fmt.Sprintf("uid %d lacks %s, needed to run jobs as another user", os.Getuid(), missing)}
+	}
+	r.Detail = fmt.Sprintf("uid %d with %s", os.Getuid(), eff)
+	return r
+}
+
+func cgroupFS(r cgroups.Roots) []Result {
+	mount := Result{Check: "cgroup v2"}
+	var st unix.Statfs_t
+	switch err := unix.Statfs(r.Mount, &st); {
+	case err != nil:
+		return []Result{{"cgroup v2", Fail, fmt.Sprintf("%s: %v", r.Mount, err)}}
+	case r.Fake:
+		mount.Level, mount.Detail = Warn, fmt.Sprintf("%s is a fake cgroupfs; limits are not enforced", r.Mount)
+	case st.Type != unix.CGROUP2_SUPER_MAGIC:
+		return []Result{{"cgroup v2", Fail, fmt.Sprintf("%s is not a cgroup v2 mount (cgroup v1 or hybrid host?)", r.Mount)}}
+	default:
+		mount.Detail = r.Mount + " is cgroup v2"
+	}
+	out := []Result{mount}
+
+	ctrl := Result{Check: "controllers"}
+	b, err := os.ReadFile(filepath.Join(r.Mount, "cgroup.controllers"))
+	if err != nil {
+		return append(out, Result{"controllers", Fail, err.Error()})
+	}
+	have := map[string]bool{}
+	for _, c := range strings.Fields(string(b)) {
+		have[c] = true
+	}
+	var missing []string
+	for _, c := range controllers {
+		if !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		ctrl.Level, ctrl.Detail = Fail, fmt.Sprintf("%s lacks %s; limits using them will fail", r.Mount, strings.Join(missing, ", "))
+	} else {
+		ctrl.Detail = strings.Join(controllers, " ") + " available"
+	}
+	out = append(out, ctrl)
+
+	return append(out, writable("cgroup root", r.JobRoot(), false))
+}
+
+func systemd(slice string) Result {
+	if _, err := cgroups.Systemd(slice); err != nil {
+		return Result{"systemd", Fail, err.Error()}
+	}
+	return Result{"systemd", OK, "reachable over D-Bus; scopes go in " + slice}
+}
+
+func jobsDir(dir string) Result {
+	return writable("jobs dir", dir, true)
+}
+
+// writable checks that dir, or the nearest existing parent it would be
+// created under, can be written. With probe, an existing dir is tested by
+// creating a file in it.
+func writable(check, dir string, probe bool) Result {
+	path := dir
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return Result{check, Fail, fmt.Sprintf("%s: no existing parent", dir)}
+		}
+		path = parent
+	}
+	if path != dir {
+		if err := unix.Access(path, unix.W_OK); err != nil {
+			return Result{check, Fail, fmt.Sprintf("%s doesn't exist and %s isn't writable: %v", dir, path, err)}
+		}
+		return Result{check, OK, fmt.Sprintf("%s will be created in %s", dir, path)}
+	}
+	if probe {
+		f, err := os.CreateTemp(dir, ".preflight-*")
+		if err != nil {
+			return Result{check, Fail, fmt.Sprintf("%s isn't writable: %v", dir, err)}
+		}
+		f.Close()
+		os.Remove(f.Name())
+	} else if err := unix.Access(dir, unix.W_OK); err != nil {
+		return Result{check, Fail, fmt.Sprintf("%s isn't writable: %v", dir, err)}
+	}
+	return Result{check, OK, dir + " is writable"}
+}
+
+func certs(dir string, warn time.Duration, now time.Time) []Result {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		return []Result{{"server cert", Fail, err.Error()}}
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return []Result{{"server cert", Fail, err.Error()}}
+	}
+
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return []Result{expiry("server cert", leaf, warn, now), {"ca cert", Fail, err.Error()}}
+	}
+	pool := x509.NewCertPool()
+	var cas []*x509.Certificate
+	for rest := caPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			cas = append(cas, c)
+			pool.AddCert(c)
+		}
+	}
+	if len(cas) == 0 {
+		return []Result{expiry("server cert", leaf, warn, now), {"ca cert", Fail, "ca.crt holds no certificates"}}
+	}
+
+	out := []Result{expiry("server cert", leaf, warn, now)}
+	// With the dates wrong, Verify would only say so again.
+	if out[0].Level != Fail {
+		opts := x509.VerifyOptions{Roots: pool, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		if _, err := leaf.Verify(opts); err != nil {
+			out = append(out, Result{"server cert", Fail, "not valid under ca.crt: " + err.Error()})
+		}
+	}
+	for _, ca := range cas {
+		out = append(out, expiry("ca cert", ca, warn, now))
+	}
+	return out
+}
+
+func expiry(check string, c *x509.Certificate, warn time.Duration, now time.Time) Result {
+	name := c.Subject.CommonName
+	switch left := c.NotAfter.Sub(now); {
+	case now.Before(c.NotBefore):
+		return Result{check, Fail, fmt.Sprintf("%s not valid until %s", name, c.NotBefore.Format(time.RFC3339))}
+	case left <= 0:
+		return Result{check, Fail, fmt.Sprintf("%s expired %s", name, c.NotAfter.Format(time.RFC3339))}
+	case left < warn:
+		return Result{check, Warn, fmt.Sprintf("%s expires in %d days (%s)", name, int(left.Hours()/24), c.NotAfter.Format(time.RFC3339))}
+	}
+	return Result{check, OK, fmt.Sprintf("%s valid until %s", name, c.NotAfter.Format(time.RFC3339))}
+}
@@ -0,0 +1,215 @@
+// Package privs drops a server started as root to an unprivileged user
+// that keeps only the capabilities it needs, the way cap_set_proc(3)
+// would after setuid. Capabilities are per thread, so every change is made
+// on all of the runtime's threads at once; that needs a CGO_ENABLED=0
+// build.
+package privs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cap is a Linux capability number.
+type Cap uint
+
+const (
+	Chown       Cap = unix.CAP_CHOWN
+	Kill        Cap = unix.CAP_KILL
+	SetGID      Cap = unix.CAP_SETGID
+	SetUID      Cap = unix.CAP_SETUID
+	SysChroot   Cap = unix.CAP_SYS_CHROOT
+	SysAdmin    Cap = unix.CAP_SYS_ADMIN
+	SysResource Cap = unix.CAP_SYS_RESOURCE
+)
+
+var capNames = map[Cap]string{
+	Chown:       "CAP_CHOWN",
+	Kill:        "CAP_KILL",
+	SetGID:      "CAP_SETGID",
+	SetUID:      "CAP_SETUID",
+	SysChroot:   "CAP_SYS_CHROOT",
+	SysAdmin:    "CAP_SYS_ADMIN",
+	SysResource: "CAP_SYS_RESOURCE",
+}
+
+func (c Cap) String() string {
+	if n, ok := capNames[c]; ok {
+		return n
+	}
+	return "CAP_" + strconv.Itoa(int(c))
+}
+
+// Set is a capability bitmask as in /proc/<pid>/status.
+type Set uint64
+
+// SetOf builds a Set.
+func SetOf(caps ...Cap) Set {
+	var s Set
+	for _, c := range caps {
+		s |= 1 << c
+	}
+	return s
+}
+
+func (s Set) String() string {
+	var names []string
+	for c := Cap(0); c < 64; c++ {
+		if s&(1<<c) != 0 {
+			names = append(names, c.String())
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Needs is the capability set a job-running server keeps: switching jobs
+// to their own user, signalling them, handing them uploaded scripts and
+// setting their rlimits, plus chroot for image jobs and SYS_ADMIN for the GPU device filter
+// (loading and attaching BPF).
+func Needs(images, gpus bool) Set {
+	s := SetOf(SetUID, SetGID, Kill, Chown, SysResource)
+	if images {
+		s |= SetOf(SysChroot)
+	}
+	if gpus {
+		s |= SetOf(SysAdmin)
+	}
+	return s
+}
+
+// ErrCgo is returned when the binary links the cgo runtime, which can't
+// change the credentials of threads it didn't start.
+var ErrCgo = errors.New("changing capabilities on every thread needs a CGO_ENABLED=0 build")
+
+// Drop switches every thread to uid:gid with no supplementary groups and
+// keeps exactly keep as permitted and effective capabilities. Nothing is
+// inheritable or ambient, so jobs don't get them. It must be called as
+// root and can't be undone.
+func Drop(uid, gid int, keep Set) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("dropping privileges requires root (euid %d)", os.Geteuid())
+	}
+	// Without KEEPCAPS, setuid away from root clears every capability.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("PR_SET_KEEPCAPS: %w", err)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setresgid(gid, gid, gid); err != nil {
+		return fmt.Errorf("setresgid %d: %w", gid, err)
+	}
+	if err := syscall.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("setresuid %d: %w", uid, err)
+	}
+	if err := capset(keep); err != nil {
+		return err
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0); err != nil {
+		return fmt.Errorf("clear PR_SET_KEEPCAPS: %w", err)
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	return Verify(uid, keep)
+}
+
+// capset sets permitted and effective to keep, inheritable to nothing.
+func capset(keep Set) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for i := range data {
+		data[i].Permitted = uint32(keep >> (32 * i))
+		data[i].Effective = data[i].Permitted
+	}
+	err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	runtime.KeepAlive(&hdr)
+	runtime.KeepAlive(&data)
+	if err != nil {
+		return fmt.Errorf("capset %s: %w", keep, err)
+	}
+	return nil
+}
+
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		return ErrCgo
+	}
+	return errno
+}
+
+// Verify checks that every thread runs as uid with exactly want effective.
+func Verify(uid int, want Set) error {
+	tasks, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil || len(tasks) == 0 {
+		return fmt.Errorf("list threads: %v", err)
+	}
+	for _, t := range tasks {
+		st, err := readStatus(t)
+		if err != nil {
+			continue // thread exited
+		}
+		if st.uid != uid || st.eff != want || st.prm != want {
+			return fmt.Errorf("thread %s: uid %d, effective %s, permitted %s; want uid %d with %s",
+				filepath.Base(filepath.Dir(t)), st.uid, st.eff, st.prm, uid, want)
+		}
+	}
+	return nil
+}
+
+// Current reports this thread's effective capabilities.
+func Current() (Set, error) {
+	st, err := readStatus("/proc/thread-self/status")
+	return st.eff, err
+}
+
+type status struct {
+	uid      int
+	eff, prm Set
+}
+
+func readStatus(path string) (status, error) {
+	var st status
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return st, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		k, v, _ := strings.Cut(line, ":")
+		v = strings.TrimSpace(v)
+		switch k {
+		case "Uid":
+			// real, effective, saved, fs: effective is what matters.
+			if f := strings.Fields(v); len(f) > 1 {
+				st.uid, _ = strconv.Atoi(f[1])
+			}
+		case "CapEff", "CapPrm":
+			n, err := strconv.ParseUint(v, 16, 64)
+			if err != nil {
+				return st, fmt.Errorf("%s %s: %w", path, k, err)
+			}
+			if k == "CapEff" {
+				st.eff = Set(n)
+			} else {
+				st.prm = Set(n)
+			}
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,143 @@
+// Package quota caps what each user (mTLS CN), and each namespace as a
+// whole, may run at once: a number of jobs and the sums of their CPU and
+// memory limits.
+package quota
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bucknercd/jobworker/internal/limits"
+)
+
+// Default is the table key that applies to users without their own line.
+const Default = "*"
+
+// NamespacePrefix marks a table key that caps a namespace rather than a
+// user: "ns:<name>", or "ns:*" for namespaces without their own line.
+const NamespacePrefix = "ns:"
+
+// Usage is a set of resources: what a job asks for, what a user is running,
+// or (as a limit) what a user may run. In a limit, zero fields are unlimited.
+type Usage struct {
+	Jobs        int
+	CPUMillis   int64
+	MemoryBytes int64
+}
+
+func (u Usage) Add(v Usage) Usage {
+	return Usage{Jobs: u.Jobs + v.Jobs, CPUMillis: u.CPUMillis + v.CPUMillis, MemoryBytes: u.MemoryBytes + v.MemoryBytes}
+}
+
+func (u Usage) Sub(v Usage) Usage {
+	return Usage{Jobs: u.Jobs - v.Jobs, CPUMillis: u.CPUMillis - v.CPUMillis, MemoryBytes: u.MemoryBytes - v.MemoryBytes}
+}
+
+// Exceeded names the first resource for which used+req goes over limit, or
+// returns "" if it fits.
+func (limit Usage) Exceeded(used, req Usage) string {
+	total := used.Add(req)
+	switch {
+	case limit.Jobs > 0 && total.Jobs > limit.Jobs:
+		return fmt.Sprintf("jobs (%d of %d in use)", used.Jobs, limit.Jobs)
+	case limit.CPUMillis > 0 && total.CPUMillis > limit.CPUMillis:
+		return fmt.Sprintf("cpu (%dm of %dm in use, %dm requested)", used.CPUMillis, limit.CPUMillis, req.CPUMillis)
+	case limit.MemoryBytes > 0 && total.MemoryBytes > limit.MemoryBytes:
+		return fmt.Sprintf("memory (%d of %d bytes in use, %d requested)", used.MemoryBytes, limit.MemoryBytes, req.MemoryBytes)
+	}
+	return ""
+}
+
+// Table maps users to their limits.
+type Table map[string]Usage
+
+// For returns user's limits, falling back to the Default entry. ok is false
+// when neither exists, i.e. the user is unlimited.
+func (t Table) For(user string) (limit Usage, ok bool) {
+	if limit, ok = t[user]; ok {
+		return limit, true
+	}
+	limit, ok = t[Default]
+	return limit, ok
+}
+
+// ForNamespace is For for namespace ns, from its "ns:<name>" entry or the
+// "ns:*" one. User entries, including Default, don't apply.
+func (t Table) ForNamespace(ns string) (limit Usage, ok bool) {
+	if limit, ok = t[NamespacePrefix+ns]; ok {
+		return limit, true
+	}
+	limit, ok = t[NamespacePrefix+Default]
+	return limit, ok
+}
+
+// Load reads a quota file: one "<user> jobs=N,cpu=C,memory=M" line per
+// user, "*" for everyone else, "ns:<name>" and "ns:*" for namespaces,
+// ignoring blanks and # comments. Omitted keys are unlimited.
+func Load(path string) (Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open quota file: %w", err)
+	}
+	defer f.Close()
+
+	t := make(Table)
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("quota file %s: line %d: expected <user> jobs=N,cpu=C,memory=M", path, lineNo)
+		}
+		user := fields[0]
+		limit, err := parseSpec(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("quota file %s: line %d: %w", path, lineNo, err)
+		}
+		t[user] = limit
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseSpec(s string) (Usage, error) {
+	var u Usage
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return u, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		var err error
+		switch k {
+		case "jobs":
+			u.Jobs, err = strconv.Atoi(v)
+			if err == nil && u.Jobs < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "cpu":
+			var c limits.CPU
+			c, err = limits.ParseCPU(v)
+			u.CPUMillis = c.Millis()
+		case "memory":
+			var m limits.Memory
+			m, err = limits.ParseMemory(v)
+			u.MemoryBytes = m.Bytes()
+		default:
+			err = fmt.Errorf("unknown key (want jobs, cpu or memory)")
+		}
+		if err != nil {
+			return u, fmt.Errorf("%s=%s: %w", k, v, err)
+		}
+	}
+	return u, nil
+}
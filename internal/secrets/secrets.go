@@ -0,0 +1,161 @@
+package secrets
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNotFound = errors.New("secret not found")
+	// ErrDenied is a secret that exists, but only for other namespaces.
+	ErrDenied = errors.New("secret belongs to another namespace")
+)
+
+// DefaultNamespace is where secrets without a namespace of their own
+// belong: the jobs of callers without one (manager.DefaultNamespace).
+const DefaultNamespace = "default"
+
+// Provider resolves a secret name, as a job in namespace sees it, to its
+// value. Values must never be logged or returned over the API; only names
+// travel through requests.
+type Provider interface {
+	Lookup(namespace, name string) (string, error)
+}
+
+// Store is an in-memory Provider loaded from local files.
+type Store struct {
+	values map[string]map[string]string // by namespace, then name
+}
+
+// Load builds a Store from path. A directory is read as one secret per file
+// (file name = secret name, contents = value, one trailing newline trimmed),
+// with a subdirectory per namespace; a regular file is read as NAME=VALUE
+// lines, ignoring blanks and # comments, where NAME is ns/name for a
+// namespace's secret. Secrets outside a namespace are the default
+// namespace's.
+func Load(path string) (*Store, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat secrets: %w", err)
+	}
+
+	s := &Store{values: make(map[string]map[string]string)}
+	if fi.IsDir() {
+		err = s.loadDir(path, DefaultNamespace, true)
+	} else {
+		err = s.loadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadDir reads dir's secrets into namespace ns, and, at the top, each
+// subdirectory's into the namespace it names.
+func (s *Store) loadDir(dir, ns string, top bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read secrets dir: %w", err)
+	}
+	for _, e := range entries {
+		// Skip dotfiles (e.g. the ..data links of projected volumes).
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			if top {
+				if err := s.loadDir(path, e.Name(), false); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read secret %s: %w", e.Name(), err)
+		}
+		v := strings.TrimSuffix(string(b), "\n")
+		s.set(ns, e.Name(), strings.TrimSuffix(v, "\r"))
+	}
+	return nil
+}
+
+func (s *Store) set(ns, name, value string) {
+	if s.values[ns] == nil {
+		s.values[ns] = make(map[string]string)
+	}
+	s.values[ns][name] = value
+}
+
+func (s *Store) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open secrets file: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		ns, name := splitName(k)
+		if !ok || name == "" || ns == "" {
+			// Don't echo the line: it may contain a secret value.
+			return fmt.Errorf("secrets file %s: line %d: expected NAME=VALUE or NAMESPACE/NAME=VALUE", path, lineNo)
+		}
+		s.set(ns, name, v)
+	}
+	return sc.Err()
+}
+
+// splitName splits ns/name, or a bare name in the default namespace.
+func splitName(ref string) (ns, name string) {
+	if ns, name, ok := strings.Cut(ref, "/"); ok {
+		return ns, name
+	}
+	return DefaultNamespace, ref
+}
+
+// Lookup returns secret name for a job in namespace: name in namespace,
+// or ns/name when ns is that namespace. A secret only other namespaces
+// have is ErrDenied, so the caller learns why without getting its value.
+func (s *Store) Lookup(namespace, name string) (string, error) {
+	ns, bare := name, name
+	if strings.Contains(name, "/") {
+		ns, bare = splitName(name)
+	} else {
+		ns = namespace
+	}
+	if ns == namespace {
+		if v, ok := s.values[ns][bare]; ok {
+			return v, nil
+		}
+	}
+	for other, vals := range s.values {
+		if _, ok := vals[bare]; ok && other != namespace {
+			return "", fmt.Errorf("%w: %s", ErrDenied, name)
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// Len reports how many secrets are loaded (safe to log).
+func (s *Store) Len() int {
+	n := 0
+	for _, vals := range s.values {
+		n += len(vals)
+	}
+	return n
+}
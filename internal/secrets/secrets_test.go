@@ -0,0 +1,86 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkLookups(t *testing.T, s *Store) {
+	t.Helper()
+	for _, tc := range []struct {
+		ns, name string
+		want     string
+		err      error
+	}{
+		{"default", "api-key", "shared", nil},
+		{"default", "default/api-key", "shared", nil},
+		{"team-a", "db-pass", "a-pass", nil},
+		{"team-a", "team-a/db-pass", "a-pass", nil},
+		{"team-b", "db-pass", "b-pass", nil},
+		// Another namespace's secret, named either way.
+		{"team-a", "team-b/db-pass", "", ErrDenied},
+		{"team-a", "api-key", "", ErrDenied},
+		{"default", "db-pass", "", ErrDenied},
+		{"team-a", "missing", "", ErrNotFound},
+		{"team-a", "team-b/missing", "", ErrNotFound},
+	} {
+		v, err := s.Lookup(tc.ns, tc.name)
+		if !errors.Is(err, tc.err) || v != tc.want {
+			t.Errorf("Lookup(%q, %q) = %q, %v; want %q, %v", tc.ns, tc.name, v, err, tc.want, tc.err)
+		}
+	}
+	if n := s.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets")
+	data := "# comment\napi-key=shared\nteam-a/db-pass=a-pass\n\nteam-b/db-pass=b-pass\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLookups(t, s)
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, v := range map[string]string{
+		"api-key":          "shared\n",
+		"team-a/db-pass":   "a-pass\r\n",
+		"team-b/db-pass":   "b-pass",
+		"team-b/..data/x":  "ignored",
+		"team-a/nested/ns": "ignored",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(v), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLookups(t, s)
+}
+
+func TestLoadFileBadLine(t *testing.T) {
+	for _, line := range []string{"no-equals", "=value", "/name=value", "team-a/=value"} {
+		path := filepath.Join(t.TempDir(), "secrets")
+		if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("%q loaded", line)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package tail wakes readers that follow growing files. Every watch shares a
+// single inotify instance, so many idle output streams cost one file
+// descriptor and no polling.
+package tail
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_DELETE_SELF
+
+// Notifier multiplexes file watches over one inotify instance.
+type Notifier struct {
+	fd int
+	f  *os.File // fd wrapped for reads; File.Fd would make it blocking
+
+	mu   sync.Mutex
+	subs map[int32]map[*Watch]struct{} // watch descriptor -> subscribers
+}
+
+// Watch delivers a wake-up on C whenever its file may have grown. Wake-ups
+// coalesce: C holds at most one pending signal.
+type Watch struct {
+	C <-chan struct{}
+
+	c    chan struct{}
+	once func() // set for Once watches, which have no C
+	n    *Notifier
+	wd   int32
+}
+
+// NewNotifier starts an inotify instance and the goroutine reading it.
+func NewNotifier() (*Notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking, so reads go through the runtime poller and Close
+	// interrupts them.
+	n := &Notifier{fd: fd, f: os.NewFile(uintptr(fd), "inotify"), subs: make(map[int32]map[*Watch]struct{})}
+	go n.run()
+	return n, nil
+}
+
+// Watch subscribes to changes of path, which must exist.
+func (n *Notifier) Watch(path string) (*Watch, error) {
+	c := make(chan struct{}, 1)
+	return n.add(path, &Watch{C: c, c: c})
+}
+
+// Once calls fn the first time path, which must exist, is written to, and
+// then drops the watch; closing the watch first cancels it. fn runs on the
+// notifier's goroutine and must not block or call back into n.
+func (n *Notifier) Once(path string, fn func()) (*Watch, error) {
+	return n.add(path, &Watch{once: fn})
+}
+
+func (n *Notifier) add(path string, w *Watch) (*Watch, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The same inode always maps to the same descriptor, so concurrent
+	// readers of one file share it.
+	wd, err := unix.InotifyAddWatch(n.fd, path, watchMask)
+	if err != nil {
+		return nil, &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	w.n, w.wd = n, int32(wd)
+	if n.subs[w.wd] == nil {
+		n.subs[w.wd] = make(map[*Watch]struct{})
+	}
+	n.subs[w.wd][w] = struct{}{}
+	return w, nil
+}
+
+// Close unsubscribes; the kernel watch goes away with its last subscriber.
+func (w *Watch) Close() {
+	n := w.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropLocked(w)
+}
+
+func (n *Notifier) dropLocked(w *Watch) {
+	subs := n.subs[w.wd]
+	if _, ok := subs[w]; !ok {
+		return // already dropped with its kernel watch
+	}
+	delete(subs, w)
+	if len(subs) == 0 {
+		delete(n.subs, w.wd)
+		unix.InotifyRmWatch(n.fd, uint32(w.wd))
+	}
+}
+
+// Close stops the notifier. Outstanding watches stop firing.
+func (n *Notifier) Close() error {
+	return n.f.Close()
+}
+
+func (n *Notifier) run() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		k, err := n.f.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				n.wakeAll() // let readers fall back to reading until EOF
+			}
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= k; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			switch {
+			case ev.Mask&unix.IN_Q_OVERFLOW != 0:
+				n.wakeAll()
+			case ev.Mask&unix.IN_IGNORED != 0:
+				// File deleted or watch removed; wake any stragglers once.
+				n.wake(ev.Wd, false, true)
+			default:
+				n.wake(ev.Wd, ev.Mask&unix.IN_MODIFY != 0, false)
+			}
+		}
+	}
+}
+
+// wake signals wd's watches, and with written fires its Once watches.
+func (n *Notifier) wake(wd int32, written, forget bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for w := range n.subs[wd] {
+		switch {
+		case w.once == nil:
+			w.signal()
+		case written:
+			w.once()
+			n.dropLocked(w)
+		}
+	}
+	if forget {
+		delete(n.subs, wd)
+	}
+}
+
+func (n *Notifier) wakeAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, subs := range n.subs {
+		for w := range subs {
+			if w.once == nil {
+				w.signal()
+			}
+		}
+	}
+}
+
+func (w *Watch) signal() {
+	select {
+	case w.c <- struct{}{}:
+	default:
+	}
+}
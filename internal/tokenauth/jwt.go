@@ -0,0 +1,235 @@
+package tokenauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far exp and nbf may be off before a JWT is refused.
+const clockSkew = time.Minute
+
+// jwtKey is one of the issuer's public keys, with the "kid" PEM header it
+// was given, if any.
+type jwtKey struct {
+	kid string
+	pub crypto.PublicKey
+}
+
+type jwtVerifier struct {
+	cfg  JWTConfig
+	keys []jwtKey
+}
+
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("JWT keys need an issuer")
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	keys, err := loadKeys(cfg.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtVerifier{cfg: cfg, keys: keys}, nil
+}
+
+// loadKeys reads PUBLIC KEY and CERTIFICATE blocks from a PEM file. A
+// "kid" header on a block ties it to JWTs with that key ID.
+func loadKeys(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read JWT keys: %w", err)
+	}
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var pub crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWT keys %s: %w", path, err)
+		}
+		switch pub.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("JWT keys %s: unsupported key type %T", path, pub)
+		}
+		keys = append(keys, jwtKey{kid: block.Headers["kid"], pub: pub})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWT keys %s: no PUBLIC KEY or CERTIFICATE blocks", path)
+	}
+	return keys, nil
+}
+
+func (j *jwtVerifier) String() string {
+	s := fmt.Sprintf("JWTs from %s (%d keys, user claim %q", j.cfg.Issuer, len(j.keys), j.cfg.UserClaim)
+	if j.cfg.Audience != "" {
+		s += ", audience " + j.cfg.Audience
+	}
+	return s + ")"
+}
+
+// verify checks a compact JWS: its signature by one of the keys, then
+// iss, aud, exp and nbf. exp is required.
+func (j *jwtVerifier) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("%w: header: %v", ErrInvalid, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: signature: %v", ErrInvalid, err)
+	}
+	if !j.checkSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig) {
+		return "", fmt.Errorf("%w: bad signature or unsupported alg %q", ErrInvalid, header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("%w: claims: %v", ErrInvalid, err)
+	}
+	if iss, _ := claims["iss"].(string); iss != j.cfg.Issuer {
+		return "", fmt.Errorf("%w: issuer %q", ErrInvalid, iss)
+	}
+	if j.cfg.Audience != "" && !hasAudience(claims["aud"], j.cfg.Audience) {
+		return "", fmt.Errorf("%w: not for audience %s", ErrInvalid, j.cfg.Audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", fmt.Errorf("%w: no exp", ErrInvalid)
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return "", fmt.Errorf("%w: expired", ErrInvalid)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return "", fmt.Errorf("%w: not valid yet", ErrInvalid)
+	}
+	user, _ := claims[j.cfg.UserClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("%w: no %s claim", ErrInvalid, j.cfg.UserClaim)
+	}
+	return user, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(aud any, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []any:
+		for _, v := range a {
+			if s, _ := v.(string); s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkSignature tries the keys whose kid matches (all of them when the
+// token or the keys carry none). Only asymmetric algorithms are accepted:
+// "none" and the HMAC family would let anyone holding the verification
+// key mint tokens.
+func (j *jwtVerifier) checkSignature(alg, kid, signed string, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return false
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+
+	for _, k := range j.keys {
+		if kid != "" && k.kid != "" && k.kid != kid {
+			continue
+		}
+		switch pub := k.pub.(type) {
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				if rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+					return true
+				}
+			case "PS":
+				if rsa.VerifyPSS(pub, hash, digest, sig, nil) == nil {
+					return true
+				}
+			}
+		case *ecdsa.PublicKey:
+			if alg[:2] == "ES" && ecdsaCurve(alg) == pub.Curve && len(sig) == 2*((pub.Curve.Params().BitSize+7)/8) {
+				r := new(big.Int).SetBytes(sig[:len(sig)/2])
+				s := new(big.Int).SetBytes(sig[len(sig)/2:])
+				if ecdsa.Verify(pub, digest, r, s) {
+					return true
+				}
+			}
+		case ed25519.PublicKey:
+			if alg == "EdDSA" && ed25519.Verify(pub, []byte(signed), sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ecdsaCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
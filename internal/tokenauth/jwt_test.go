@@ -0,0 +1,266 @@
+package tokenauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1_700_000_000, 0)
+
+type testKeys struct {
+	ec  *ecdsa.PrivateKey
+	rsa *rsa.PrivateKey
+	ed  ed25519.PrivateKey
+	pem []byte
+}
+
+// newTestKeys makes one key of each supported type; the EC key's PEM
+// block carries kid "ec1".
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	k := &testKeys{}
+	var err error
+	if k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if _, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	for _, pub := range []struct {
+		key crypto.PublicKey
+		kid string
+	}{{k.ec.Public(), "ec1"}, {k.rsa.Public(), ""}, {k.ed.Public(), ""}} {
+		der, err := x509.MarshalPKIXPublicKey(pub.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+		if pub.kid != "" {
+			block.Headers = map[string]string{"kid": pub.kid}
+		}
+		k.pem = append(k.pem, pem.EncodeToMemory(block)...)
+	}
+	return k
+}
+
+func (k *testKeys) verifier(t *testing.T, audience string) *jwtVerifier {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	if err := os.WriteFile(path, k.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := newJWTVerifier(JWTConfig{KeysFile: path, Issuer: "https://idp.example", Audience: audience})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// sign returns a compact JWS of claims. sig, when set, replaces the
+// signature over the header and claims.
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any, sig func(signed string) []byte) string {
+	t.Helper()
+	header := map[string]string{"alg": alg}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := segment(t, header) + "." + segment(t, claims)
+	if sig == nil {
+		sig = func(signed string) []byte { return k.signature(t, alg, signed) }
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig(signed))
+}
+
+func (k *testKeys) signature(t *testing.T, alg, signed string) []byte {
+	t.Helper()
+	digest := sha256.Sum256([]byte(signed))
+	var (
+		sig []byte
+		err error
+	)
+	switch alg {
+	case "ES256":
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:]); err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], nil)
+	case "EdDSA":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	case "HS256":
+		// Keyed with the public keys, as a verifier confused about alg
+		// would check it.
+		m := hmac.New(sha256.New, k.pem)
+		m.Write([]byte(signed))
+		sig = m.Sum(nil)
+	case "none":
+	default:
+		t.Fatalf("can't sign %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func segment(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// claims are valid for the verifier at now; set overrides them, and a nil
+// value drops the claim.
+func claims(set map[string]any) map[string]any {
+	c := map[string]any{
+		"iss": "https://idp.example",
+		"sub": "alice",
+		"aud": "jobworker",
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range set {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func TestJWTVerify(t *testing.T) {
+	k := newTestKeys(t)
+	v := k.verifier(t, "jobworker")
+
+	for _, tc := range []struct {
+		name  string
+		token func() string
+		ok    bool
+	}{
+		{"ES256", func() string { return k.sign(t, "ES256", "ec1", claims(nil), nil) }, true},
+		{"ES256 without kid", func() string { return k.sign(t, "ES256", "", claims(nil), nil) }, true},
+		{"RS256", func() string { return k.sign(t, "RS256", "", claims(nil), nil) }, true},
+		{"PS256", func() string { return k.sign(t, "PS256", "", claims(nil), nil) }, true},
+		{"EdDSA", func() string { return k.sign(t, "EdDSA", "", claims(nil), nil) }, true},
+
+		// Algorithms that aren't asymmetric signatures.
+		{"alg none", func() string { return k.sign(t, "none", "", claims(nil), nil) }, false},
+		{"alg none, lowercase", func() string {
+			return k.sign(t, "None", "", claims(nil), func(string) []byte { return nil })
+		}, false},
+		{"HS256 keyed with the public keys", func() string { return k.sign(t, "HS256", "", claims(nil), nil) }, false},
+
+		// Key selection.
+		{"kid of no key", func() string { return k.sign(t, "ES256", "ec2", claims(nil), nil) }, false},
+		{"RS256 claiming the EC key's kid", func() string { return k.sign(t, "RS256", "ec1", claims(nil), nil) }, true},
+		{"ES384 on a P-256 key", func() string {
+			return k.sign(t, "ES384", "", claims(nil), func(s string) []byte { return k.signature(t, "ES256", s) })
+		}, false},
+
+		// ECDSA signatures are fixed-size r||s, not ASN.1.
+		{"ES256 DER signature", func() string {
+			return k.sign(t, "ES256", "", claims(nil), func(s string) []byte {
+				digest := sha256.Sum256([]byte(s))
+				sig, err := ecdsa.SignASN1(rand.Reader, k.ec, digest[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sig
+			})
+		}, false},
+		{"ES256 signature one byte short", func() string {
+			return k.sign(t, "ES256", "", claims(nil), func(s string) []byte { return k.signature(t, "ES256", s)[1:] })
+		}, false},
+		{"ES256 signature padded", func() string {
+			return k.sign(t, "ES256", "", claims(nil), func(s string) []byte { return append([]byte{0}, k.signature(t, "ES256", s)...) })
+		}, false},
+		{"tampered claims", func() string {
+			tok := k.sign(t, "ES256", "", claims(nil), nil)
+			parts := strings.Split(tok, ".")
+			parts[1] = segment(t, claims(map[string]any{"sub": "root"}))
+			return strings.Join(parts, ".")
+		}, false},
+
+		// Issuer and audience.
+		{"wrong issuer", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"iss": "https://evil.example"}), nil)
+		}, false},
+		{"no issuer", func() string { return k.sign(t, "ES256", "", claims(map[string]any{"iss": nil}), nil) }, false},
+		{"wrong audience", func() string { return k.sign(t, "ES256", "", claims(map[string]any{"aud": "other"}), nil) }, false},
+		{"no audience", func() string { return k.sign(t, "ES256", "", claims(map[string]any{"aud": nil}), nil) }, false},
+		{"audience list", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"aud": []string{"other", "jobworker"}}), nil)
+		}, true},
+		{"audience list without ours", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"aud": []string{"other"}}), nil)
+		}, false},
+
+		// exp and nbf, allowing clockSkew either way.
+		{"no exp", func() string { return k.sign(t, "ES256", "", claims(map[string]any{"exp": nil}), nil) }, false},
+		{"expired within skew", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"exp": now.Add(-clockSkew / 2).Unix()}), nil)
+		}, true},
+		{"expired beyond skew", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"exp": now.Add(-2 * clockSkew).Unix()}), nil)
+		}, false},
+		{"nbf within skew", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"nbf": now.Add(clockSkew / 2).Unix()}), nil)
+		}, true},
+		{"nbf beyond skew", func() string {
+			return k.sign(t, "ES256", "", claims(map[string]any{"nbf": now.Add(2 * clockSkew).Unix()}), nil)
+		}, false},
+
+		{"no user claim", func() string { return k.sign(t, "ES256", "", claims(map[string]any{"sub": nil}), nil) }, false},
+		{"malformed header", func() string { return "e30x.e30.AA" }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			user, err := v.verify(tc.token(), now)
+			switch {
+			case tc.ok && (err != nil || user != "alice"):
+				t.Errorf("verify = %q, %v; want alice", user, err)
+			case !tc.ok && err == nil:
+				t.Errorf("verify accepted it as %q", user)
+			case !tc.ok && !errors.Is(err, ErrInvalid):
+				t.Errorf("verify error %v isn't ErrInvalid", err)
+			}
+		})
+	}
+}
+
+// TestJWTNoAudience checks that an empty Audience skips the aud check.
+func TestJWTNoAudience(t *testing.T) {
+	k := newTestKeys(t)
+	v := k.verifier(t, "")
+	tok := k.sign(t, "ES256", "", claims(map[string]any{"aud": nil}), nil)
+	if user, err := v.verify(tok, now); err != nil || user != "alice" {
+		t.Errorf("verify = %q, %v; want alice", user, err)
+	}
+}
@@ -0,0 +1,130 @@
+// Package tokenauth checks the bearer tokens callers may send instead of,
+// or as well as, a client certificate: static tokens listed in a file, and
+// JWTs signed by an identity provider whose public keys are configured.
+package tokenauth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is returned for every token that doesn't check out. The
+// wrapped detail is for the server log, not the caller.
+var ErrInvalid = errors.New("invalid token")
+
+// JWTConfig says which JWTs are accepted. KeysFile holds the issuer's
+// public keys as PEM; empty disables JWTs.
+type JWTConfig struct {
+	KeysFile string
+	Issuer   string // required "iss"
+	Audience string // "aud" must contain it; empty skips the check
+	// UserClaim names the claim holding the caller's identity; empty
+	// means "sub".
+	UserClaim string
+}
+
+// Verifier maps bearer tokens to users.
+type Verifier struct {
+	static map[[sha256.Size]byte]string
+	jwt    *jwtVerifier
+}
+
+// New loads the static tokens file, if any, and the JWT keys, if any. At
+// least one must be given.
+func New(tokensFile string, jc JWTConfig) (*Verifier, error) {
+	if tokensFile == "" && jc.KeysFile == "" {
+		return nil, errors.New("no tokens file or JWT keys")
+	}
+	v := &Verifier{}
+	if tokensFile != "" {
+		static, err := loadTokens(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		v.static = static
+	}
+	if jc.KeysFile != "" {
+		jv, err := newJWTVerifier(jc)
+		if err != nil {
+			return nil, err
+		}
+		v.jwt = jv
+	}
+	return v, nil
+}
+
+// Verify returns the user token belongs to.
+func (v *Verifier) Verify(token string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalid)
+	}
+	if user, ok := v.static[sha256.Sum256([]byte(token))]; ok {
+		return user, nil
+	}
+	if v.jwt != nil && strings.Count(token, ".") == 2 {
+		return v.jwt.verify(token, time.Now())
+	}
+	return "", fmt.Errorf("%w: unknown token", ErrInvalid)
+}
+
+// String describes what is accepted, for the startup log.
+func (v *Verifier) String() string {
+	var parts []string
+	if v.static != nil {
+		parts = append(parts, fmt.Sprintf("%d static tokens", len(v.static)))
+	}
+	if v.jwt != nil {
+		parts = append(parts, v.jwt.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// loadTokens reads a tokens file: one "<user> <token>" line per token,
+// ignoring blanks and # comments. A token written "sha256:<hex>" is the
+// hash of the real one, so the file needn't hold it. Only hashes are kept.
+func loadTokens(path string) (map[[sha256.Size]byte]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open tokens file: %w", err)
+	}
+	defer f.Close()
+
+	tokens := make(map[[sha256.Size]byte]string)
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("tokens file %s: line %d: expected <user> <token>", path, lineNo)
+		}
+		var sum [sha256.Size]byte
+		if h, ok := strings.CutPrefix(fields[1], "sha256:"); ok {
+			b, err := hex.DecodeString(h)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("tokens file %s: line %d: sha256: wants 64 hex digits", path, lineNo)
+			}
+			copy(sum[:], b)
+		} else {
+			sum = sha256.Sum256([]byte(fields[1]))
+		}
+		if prev, dup := tokens[sum]; dup {
+			return nil, fmt.Errorf("tokens file %s: line %d: token already belongs to %s", path, lineNo, prev)
+		}
+		tokens[sum] = fields[0]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
@@ -0,0 +1,75 @@
+package tokenauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticTokens(t *testing.T) {
+	hashed := sha256.Sum256([]byte("bob-secret"))
+	hashedHex := hex.EncodeToString(hashed[:])
+	path := filepath.Join(t.TempDir(), "tokens")
+	file := "# users\nalice alice-secret\n\nbob sha256:" + hashedHex + "\n"
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(path, JWTConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		token, user string
+	}{
+		{"alice-secret", "alice"},
+		{"bob-secret", "bob"},
+		{"sha256:" + hashedHex, ""}, // the hash isn't the token
+		{hashedHex, ""},
+		{"alice-secret ", ""},
+		{"", ""},
+	} {
+		user, err := v.Verify(tc.token)
+		if tc.user == "" {
+			if err == nil || !errors.Is(err, ErrInvalid) {
+				t.Errorf("Verify(%q) = %q, %v; want ErrInvalid", tc.token, user, err)
+			}
+			continue
+		}
+		if err != nil || user != tc.user {
+			t.Errorf("Verify(%q) = %q, %v; want %s", tc.token, user, err, tc.user)
+		}
+	}
+}
+
+func TestStaticTokensFile(t *testing.T) {
+	for _, tc := range []struct {
+		name, file string
+	}{
+		{"one field", "alice\n"},
+		{"three fields", "alice a b\n"},
+		{"short hash", "alice sha256:abcd\n"},
+		{"bad hex", "alice sha256:" + strings.Repeat("zz", 32) + "\n"},
+		{"duplicate", "alice same\nbob same\n"},
+		{"duplicate by hash", "alice same\nbob sha256:" + hex.EncodeToString(sha256Of("same")) + "\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			if err := os.WriteFile(path, []byte(tc.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := New(path, JWTConfig{}); err == nil {
+				t.Error("New accepted it")
+			}
+		})
+	}
+}
+
+func sha256Of(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor wraps each unary RPC in a server span, continuing
+// the caller's trace when a traceparent header is present.
+func UnaryServerInterceptor(t *Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, span := t.Start(incomingParent(ctx), info.FullMethod, KindServer)
+		defer span.End()
+
+		resp, err := handler(ctx, req)
+		recordStatus(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// UnaryServerInterceptor; the span covers the whole stream.
+func StreamServerInterceptor(t *Tracer) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := t.Start(incomingParent(ss.Context()), info.FullMethod, KindServer)
+		defer span.End()
+
+		err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+		recordStatus(span, err)
+		return err
+	}
+}
+
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context { return s.ctx }
+
+func incomingParent(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	if v := md.Get("traceparent"); len(v) > 0 {
+		return ContextWithRemoteParent(ctx, v[0])
+	}
+	return ctx
+}
+
+func recordStatus(span *Span, err error) {
+	st := status.Convert(err)
+	span.SetAttr("rpc.system", "grpc")
+	span.SetAttr("rpc.grpc.status_code", int(st.Code()))
+	if err != nil {
+		span.SetError(err)
+	}
+}
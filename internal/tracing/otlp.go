@@ -0,0 +1,248 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	exportInterval  = 5 * time.Second
+	exportBatchSize = 512
+	exportQueueSize = 4096
+	exportTimeout   = 10 * time.Second
+)
+
+// NewOTLPTracer returns a Tracer that batches finished spans and POSTs them
+// as OTLP/HTTP JSON to endpoint (e.g. http://collector:4318/v1/traces).
+func NewOTLPTracer(logger *log.Logger, endpoint, serviceName string) *Tracer {
+	e := &exporter{
+		logger:      logger,
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, exportQueueSize),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return &Tracer{exp: e}
+}
+
+// Shutdown flushes pending spans and stops the exporter.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.exp.closeOnce.Do(func() { close(t.exp.queue) })
+	<-t.exp.done
+}
+
+type exporter struct {
+	logger      *log.Logger
+	endpoint    string
+	serviceName string
+	client      *http.Client
+
+	queue     chan *Span
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (e *exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.logger.Printf("[tracing] export queue full, dropping span %q", s.name)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.flush(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *exporter) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		e.logger.Printf("[tracing] encode %d spans: %v", len(batch), err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.logger.Printf("[tracing] export %d spans: %v", len(batch), err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		e.logger.Printf("[tracing] export %d spans: collector returned %s", len(batch), resp.Status)
+	}
+}
+
+// ---- OTLP JSON encoding (opentelemetry/proto/collector/trace/v1) ----
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+func (e *exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           s.traceID.String(),
+			SpanID:            s.spanID.String(),
+			Name:              s.name,
+			Kind:              int(s.kind),
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        encodeAttrs(s.attrs),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.parent != (SpanID{}) {
+			out.ParentSpanID = s.parent.String()
+		}
+		if s.failed {
+			out.Status = otlpStatus{Code: otlpStatusError, Message: s.errMessage}
+		}
+		for _, ev := range s.events {
+			out.Events = append(out.Events, otlpEvent{
+				TimeUnixNano: unixNano(ev.time),
+				Name:         ev.name,
+				Attributes:   encodeAttrs(ev.attrs),
+			})
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttrs(map[string]any{"service.name": e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/bucknercd/jobworker"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeAttrs(attrs map[string]any) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var av otlpAnyValue
+		switch x := v.(type) {
+		case string:
+			av.StringValue = &x
+		case bool:
+			av.BoolValue = &x
+		case int:
+			s := strconv.Itoa(x)
+			av.IntValue = &s
+		case int32:
+			s := strconv.FormatInt(int64(x), 10)
+			av.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			av.IntValue = &s
+		case float64:
+			av.DoubleValue = &x
+		default:
+			s := fmt.Sprint(x)
+			av.StringValue = &s
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: av})
+	}
+	return out
+}
@@ -0,0 +1,171 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SpanKind mirrors the OTLP span kind values.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Tracer creates spans and hands finished ones to the exporter. A nil
+// *Tracer is valid and produces nil spans, whose methods are all no-ops, so
+// call sites never need to check whether tracing is enabled.
+type Tracer struct {
+	exp *exporter
+}
+
+type spanCtxKey struct{}
+
+type spanEvent struct {
+	name  string
+	time  time.Time
+	attrs map[string]any
+}
+
+// Span is a single timed operation. It is safe for concurrent use.
+type Span struct {
+	tracer  *Tracer
+	traceID TraceID
+	spanID  SpanID
+	parent  SpanID
+	name    string
+	kind    SpanKind
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attrs      map[string]any
+	events     []spanEvent
+	errMessage string
+	failed     bool
+	ended      bool
+}
+
+// Start begins a span as a child of whatever span (or remote parent) ctx
+// carries, and returns a context carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]any),
+	}
+	if p, ok := ctx.Value(spanCtxKey{}).(spanRef); ok {
+		s.traceID = p.traceID
+		s.parent = p.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanCtxKey{}, spanRef{traceID: s.traceID, spanID: s.spanID}), s
+}
+
+// spanRef is what travels in a context: enough to parent a new span.
+type spanRef struct {
+	traceID TraceID
+	spanID  SpanID
+}
+
+// ContextWithRemoteParent returns ctx carrying a parent parsed from a W3C
+// traceparent header ("00-<trace id>-<span id>-<flags>"). Invalid headers
+// are ignored.
+func ContextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	var ref spanRef
+	var version, flags string
+	var tid, sid string
+	if n, _ := fmt.Sscanf(traceparent, "%2s-%32s-%16s-%2s", &version, &tid, &sid, &flags); n != 4 || version != "00" {
+		return ctx
+	}
+	tb, err1 := hex.DecodeString(tid)
+	sb, err2 := hex.DecodeString(sid)
+	if err1 != nil || err2 != nil || len(tb) != 16 || len(sb) != 8 {
+		return ctx
+	}
+	copy(ref.traceID[:], tb)
+	copy(ref.spanID[:], sb)
+	if ref.traceID == (TraceID{}) || ref.spanID == (SpanID{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, spanCtxKey{}, ref)
+}
+
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.traceID
+}
+
+// SetAttr records a string, bool, integer, or float attribute.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// AddEvent records a point-in-time event; attrs are key/value pairs.
+func (s *Span) AddEvent(name string, attrs ...any) {
+	if s == nil {
+		return
+	}
+	ev := spanEvent{name: name, time: time.Now(), attrs: make(map[string]any)}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if k, ok := attrs[i].(string); ok {
+			ev.attrs[k] = attrs[i+1]
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errMessage = err.Error()
+}
+
+// End finishes the span and queues it for export. Later calls are no-ops.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.exp.enqueue(s)
+}
@@ -0,0 +1,177 @@
+// Package validate checks requests against the FieldRules their fields
+// are annotated with in job.proto, so the constraints on what a call may
+// carry live next to the fields and are enforced the same way for every
+// RPC, before any handler runs.
+package validate
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/bucknercd/jobworker/internal/limits"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// validID is how the server writes job and group IDs.
+var validID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// formats are the syntaxes FieldRules.format names.
+var formats = map[string]func(string) error{
+	"cpu":          func(s string) error { _, err := limits.ParseCPU(s); return err },
+	"memory":       func(s string) error { _, err := limits.ParseMemory(s); return err },
+	"swap":         func(s string) error { _, err := limits.ParseSwap(s); return err },
+	"io_class":     func(s string) error { _, err := limits.ParseIOClass(s); return err },
+	"cpuset":       func(s string) error { _, err := limits.ParseCPUSet(s); return err },
+	"pids":         func(s string) error { _, err := limits.ParsePIDs(s); return err },
+	"rlimit_count": func(s string) error { _, err := limits.ParseRlimitCount(s); return err },
+	"rlimit_size":  func(s string) error { _, err := limits.ParseRlimitSize(s); return err },
+}
+
+// Request checks msg and every message in it. It returns nil, or an
+// INVALID_ARGUMENT error that names the first field at fault and carries
+// a BadRequest detail listing them all.
+func Request(msg proto.Message) error {
+	var v violations
+	v.message(msg.ProtoReflect(), "")
+	if len(v) == 0 {
+		return nil
+	}
+	text := v[0].GetField() + ": " + v[0].GetDescription()
+	if len(v) > 1 {
+		text += fmt.Sprintf(" (and %d more)", len(v)-1)
+	}
+	st, err := status.New(codes.InvalidArgument, text).WithDetails(&errdetails.BadRequest{FieldViolations: v})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, text)
+	}
+	return st.Err()
+}
+
+type violations []*errdetails.BadRequest_FieldViolation
+
+func (v *violations) add(field, format string, args ...any) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)})
+}
+
+// message checks m's fields, path naming m in the request ("" for the
+// request itself).
+func (v *violations) message(m protoreflect.Message, path string) {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		name := string(fd.Name())
+		if path != "" {
+			name = path + "." + name
+		}
+		if r := rulesFor(fd); r != nil {
+			v.field(m, fd, name, r)
+		}
+		if !m.Has(fd) {
+			continue
+		}
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				m.Get(fd).Map().Range(func(k protoreflect.MapKey, val protoreflect.Value) bool {
+					v.message(val.Message(), fmt.Sprintf("%s[%q]", name, k.String()))
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				l := m.Get(fd).List()
+				for j := 0; j < l.Len(); j++ {
+					v.message(l.Get(j).Message(), fmt.Sprintf("%s[%d]", name, j))
+				}
+			}
+		case fd.Message() != nil:
+			v.message(m.Get(fd).Message(), name)
+		}
+	}
+}
+
+// field checks one field of m against its rules r.
+func (v *violations) field(m protoreflect.Message, fd protoreflect.FieldDescriptor, name string, r *jobpb.FieldRules) {
+	if !m.Has(fd) {
+		if r.GetRequired() {
+			v.add(name, "required")
+		}
+		return
+	}
+	val := m.Get(fd)
+	switch {
+	case fd.IsMap():
+		mp := val.Map()
+		if lim := int(r.GetMaxItems()); lim > 0 && mp.Len() > lim {
+			v.add(name, "%d entries, over the limit of %d", mp.Len(), lim)
+		}
+		total := 0
+		mp.Range(func(k protoreflect.MapKey, e protoreflect.Value) bool {
+			n := len(k.String()) + len(e.String())
+			if lim := int(r.GetMaxItemLen()); lim > 0 && n > lim {
+				v.add(fmt.Sprintf("%s[%.32q]", name, k.String()), "%d bytes with its key, over the limit of %d", n, lim)
+			}
+			total += n
+			return true
+		})
+		if lim := int(r.GetMaxTotalLen()); lim > 0 && total > lim {
+			v.add(name, "%d bytes in all, over the limit of %d", total, lim)
+		}
+	case fd.IsList():
+		l := val.List()
+		if lim := int(r.GetMaxItems()); lim > 0 && l.Len() > lim {
+			v.add(name, "%d entries, over the limit of %d", l.Len(), lim)
+		}
+		total := 0
+		for i := 0; i < l.Len(); i++ {
+			n := len(l.Get(i).String())
+			if lim := int(r.GetMaxItemLen()); lim > 0 && n > lim {
+				v.add(fmt.Sprintf("%s[%d]", name, i), "%d bytes, over the limit of %d", n, lim)
+			}
+			total += n
+		}
+		if lim := int(r.GetMaxTotalLen()); lim > 0 && total > lim {
+			v.add(name, "%d bytes in all, over the limit of %d", total, lim)
+		}
+	case fd.Kind() == protoreflect.StringKind:
+		s := val.String()
+		if lim := int(r.GetMaxLen()); lim > 0 && len(s) > lim {
+			v.add(name, "%d bytes, over the limit of %d", len(s), lim)
+			return
+		}
+		if r.GetId() && !validID.MatchString(s) {
+			v.add(name, "%.64q is not an ID the server issued", s)
+		}
+		if f := r.GetFormat(); f != "" {
+			parse, ok := formats[f]
+			if !ok {
+				v.add(name, "unknown format %q in the field's rules", f)
+			} else if err := parse(s); err != nil {
+				v.add(name, "%v", err)
+			}
+		}
+	}
+}
+
+// rules caches each field's FieldRules, nil for none, by full name.
+var rules sync.Map
+
+func rulesFor(fd protoreflect.FieldDescriptor) *jobpb.FieldRules {
+	if r, ok := rules.Load(fd.FullName()); ok {
+		return r.(*jobpb.FieldRules)
+	}
+	var r *jobpb.FieldRules
+	if opts, ok := fd.Options().(*descriptorpb.FieldOptions); ok && proto.HasExtension(opts, jobpb.E_Rules) {
+		r = proto.GetExtension(opts, jobpb.E_Rules).(*jobpb.FieldRules)
+	}
+	rules.Store(fd.FullName(), r)
+	return r
+}
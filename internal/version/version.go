@@ -0,0 +1,139 @@
+// Package version describes the running binary: its release, the commit
+// and time it was built from, and the API it speaks. Release builds set
+// the variables with -ldflags (see the Makefile):
+//
+//	go build -ldflags "-X github.com/bucknercd/jobworker/internal/version.Version=v1.4.0" ./cmd/jobctl
+//
+// Without them, Commit and BuildDate fall back to the revision and commit
+// time the Go toolchain stamped from the VCS, and Version is "dev".
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// Set with -ldflags "-X".
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+	// Features lists optional parts compiled in, comma-separated, e.g.
+	// "systemd,gpu". Empty means none were named at build time.
+	Features = ""
+)
+
+// APIVersion is the version of the JobWorker API this binary speaks. It
+// goes up when a change means an older peer would misbehave, not for
+// additions; those are announced as Capabilities.
+const APIVersion = 1
+
+// MinAPIVersion is the oldest peer API version this binary still works
+// with.
+const MinAPIVersion = 1
+
+// Capabilities are the optional parts of the API a server built from this
+// tree supports. A client checks for the one a call needs before relying
+// on it; an older server simply doesn't list it.
+var Capabilities = []string{
+	"create-job",
+	"delete-job",
+	"download-core",
+	"download-output",
+	"expired-status",
+	"idempotency-keys",
+	"job-env",
+	"job-groups",
+	"job-restarts",
+	"job-stats",
+	"job-timeouts",
+	"namespaces",
+	"output-index",
+	"result-capture",
+	"result-fd",
+	"run-script",
+	"search-output",
+	"starting-status",
+	"stream-filter",
+	"stream-jobs-output",
+	"tty",
+}
+
+// ClientCapabilitiesKey is the metadata key a client lists, comma-separated,
+// the ClientCapabilities it has. The server converts responses for clients
+// without one (see cmd/jobworker-server/compat.go).
+const ClientCapabilitiesKey = "x-jobworker-client-caps"
+
+// ClientCapabilities are the response values a client built from this tree
+// understands beyond those of the first v1 release.
+var ClientCapabilities = []string{
+	"created-status",
+	"expired-status",
+	"starting-status",
+	"stopping-status",
+}
+
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && Commit == "":
+			Commit = s.Value
+		case s.Key == "vcs.time" && BuildDate == "":
+			BuildDate = s.Value
+		}
+	}
+}
+
+// FeatureList is Features split into names.
+func FeatureList() []string {
+	var out []string
+	for _, f := range strings.Split(Features, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// Compatible reports whether a peer speaking apiVersion, and working with
+// nothing older than minAPIVersion, can talk to this binary. A zero
+// apiVersion (a peer too old to say) is taken as compatible.
+func Compatible(apiVersion, minAPIVersion uint32) bool {
+	if apiVersion == 0 {
+		return true
+	}
+	return apiVersion >= MinAPIVersion && APIVersion >= minAPIVersion
+}
+
+// HasCapability reports whether caps, as a server announced them, holds c.
+func HasCapability(caps []string, c string) bool {
+	return slices.Contains(caps, c)
+}
+
+// String is what -version prints: name's release, commit, build date, Go
+// version and API version.
+func String(name string) string {
+	commit := Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	built := BuildDate
+	if built == "" {
+		built = "unknown"
+	}
+	s := fmt.Sprintf("%s %s (commit %s, built %s, %s, api v%d)", name, Version, commit, built, runtime.Version(), APIVersion)
+	if f := FeatureList(); len(f) > 0 {
+		s += " features=" + strings.Join(f, ",")
+	}
+	return s
+}
@@ -0,0 +1,134 @@
+// Package volumes places job output on one of several directories,
+// usually on different filesystems: a fast local disk first and a larger
+// one to overflow to, so a busy host doesn't fill its root filesystem with
+// job logs.
+package volumes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bucknercd/jobworker/internal/limits"
+)
+
+// Policy is how Set.Pick chooses among its directories.
+type Policy string
+
+const (
+	// Fill takes the first directory whose volume has MinFree left, so
+	// the later ones only take the overflow.
+	Fill Policy = "fill"
+	// MostFree takes the directory whose volume has the most free space.
+	MostFree Policy = "most-free"
+)
+
+// ParsePolicy accepts "fill" and "most-free"; empty means Fill.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return Fill, nil
+	case Fill, MostFree:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid placement %q: want fill or most-free", s)
+}
+
+// Threshold is the free space Fill leaves on a volume before moving to
+// the next: a byte count, or a percentage of the volume's size.
+type Threshold struct {
+	Bytes   uint64
+	Percent float64
+}
+
+// ParseThreshold accepts a percentage ("5%"), a size with an optional K,
+// M, G or T suffix ("20G"), or "0" for none.
+func ParseThreshold(s string) (Threshold, error) {
+	if s == "" || s == "0" {
+		return Threshold{}, nil
+	}
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(pct, 64)
+		if err != nil || p < 0 || p >= 100 {
+			return Threshold{}, fmt.Errorf("invalid free space %q: want a percentage below 100", s)
+		}
+		return Threshold{Percent: p}, nil
+	}
+	m, err := limits.ParseMemory(s)
+	if err != nil || m == 0 {
+		return Threshold{}, fmt.Errorf("invalid free space %q: want a percentage (5%%) or a size (20G)", s)
+	}
+	return Threshold{Bytes: uint64(m.Bytes())}, nil
+}
+
+// Met reports whether u has at least t free.
+func (t Threshold) Met(u Usage) bool {
+	return u.Free >= t.Bytes && float64(u.Free) >= float64(u.Total)*t.Percent/100
+}
+
+func (t Threshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatUint(t.Bytes, 10) + " bytes"
+}
+
+// Usage is the size of a volume and what is left of it to unprivileged
+// writers, in bytes.
+type Usage struct {
+	Total, Free uint64
+}
+
+// Stat reports the usage of the volume holding dir, or the volume it would
+// be created on if it doesn't exist yet.
+func Stat(dir string) (Usage, error) {
+	path := dir
+	for {
+		var st unix.Statfs_t
+		err := unix.Statfs(path, &st)
+		if err == nil {
+			return Usage{Total: st.Blocks * uint64(st.Bsize), Free: st.Bavail * uint64(st.Bsize)}, nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return Usage{}, fmt.Errorf("statfs %s: %w", dir, err)
+		}
+		path = parent
+	}
+}
+
+// Set is the directories job output may go in, in order of preference.
+type Set struct {
+	Dirs    []string
+	Policy  Policy
+	MinFree Threshold
+}
+
+// Pick returns the directory for a new job's output. When no volume has
+// MinFree left, or none can be asked, it falls back to the one with the
+// most free space, or the first, and reports full.
+func (s Set) Pick() (dir string, full bool) {
+	if len(s.Dirs) == 1 {
+		return s.Dirs[0], false
+	}
+	best, bestFree, bestOK := s.Dirs[0], uint64(0), false
+	for _, d := range s.Dirs {
+		u, err := Stat(d)
+		if err != nil {
+			continue
+		}
+		if s.Policy == Fill && s.MinFree.Met(u) {
+			return d, false
+		}
+		if u.Free > bestFree {
+			best, bestFree = d, u.Free
+			bestOK = s.MinFree.Met(u)
+		}
+	}
+	return best, !bestOK
+}
@@ -0,0 +1,75 @@
+// Package cgroups defines how joblib's exec backend places a job in a
+// cgroup: a Driver makes each job's Manager. The cgroup v2 and systemd
+// implementations the server uses are internal to this module; programs
+// embedding joblib can supply their own, or Noop.
+package cgroups
+
+// Manager is one job's cgroup as the exec backend uses it. Implementations
+// can own the hierarchy directly, delegate to a different owner of it, or
+// stand in for it in tests.
+type Manager interface {
+	// Path is the cgroup's location, for display.
+	Path() string
+	// Create makes the cgroup, applies limits ("file=value" writes) and
+	// returns a directory FD for SysProcAttr.CgroupFD, or -1 when
+	// processes shouldn't (or can't) be placed into it by FD.
+	Create(jobID string, limits []string) (int, error)
+	// Delete kills whatever is left in the cgroup and removes it.
+	Delete(jobID string) error
+	// Procs lists the processes in the cgroup.
+	Procs() ([]int, error)
+	// Snapshot reads membership, limits and usage.
+	Snapshot() (*Snapshot, error)
+}
+
+// Driver makes the Manager for a job. jobID may be a path, e.g.
+// "ns-team/<id>", for a job in a subtree of its own.
+type Driver func(jobID string) Manager
+
+// Attacher is implemented by Managers that take the job's process once it
+// exists instead of by FD at fork (Create returns -1 for them). The exec
+// backend calls Attach right after the process starts.
+type Attacher interface {
+	Attach(pid int) error
+}
+
+// Snapshot is a cgroup's membership, limits and usage, as read from its
+// interface files.
+type Snapshot struct {
+	Path string
+
+	PidsCurrent int
+	Procs       []int
+	PidsEvents  map[string]uint64 // pids.events; "max" counts forks refused at pids.max
+
+	CPUMax    string
+	MemoryMax string
+	IOMax     string
+	PidsMax   string
+
+	MemoryCurrent uint64
+
+	CPUStat      map[string]uint64
+	MemoryEvents map[string]uint64 // memory.events, e.g. "oom_kill"
+
+	// IOReadBytes and IOWriteBytes sum io.stat over all devices.
+	IOReadBytes  uint64
+	IOWriteBytes uint64
+}
+
+var (
+	_ Manager  = (*Recorder)(nil)
+	_ Attacher = (*Recorder)(nil)
+)
+
+// Noop is a Driver whose cgroups do nothing and report nothing: jobs run
+// unconfined.
+func Noop(jobID string) Manager { return noop{} }
+
+type noop struct{}
+
+func (noop) Path() string                                      { return "" }
+func (noop) Create(jobID string, limits []string) (int, error) { return -1, nil }
+func (noop) Delete(jobID string) error                         { return nil }
+func (noop) Procs() ([]int, error)                             { return nil, nil }
+func (noop) Snapshot() (*Snapshot, error)                      { return &Snapshot{}, nil }
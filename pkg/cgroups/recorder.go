@@ -0,0 +1,85 @@
+package cgroups
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Recorder is a Manager for tests: it touches nothing, logs every call,
+// and answers from its exported fields. Set those before handing it out;
+// it is safe for concurrent use after that.
+type Recorder struct {
+	// CreateErr and DeleteErr, when set, are returned by Create and Delete.
+	CreateErr error
+	DeleteErr error
+	// LimitErrs fail Create the way a failed limit write would, by limit
+	// file (e.g. "memory.max"): it deletes the cgroup again, as
+	// the cgroup v2 driver does, and returns the error.
+	LimitErrs map[string]error
+	// AttachErr, when set, is returned by Attach.
+	AttachErr error
+	// Pids and Snap are what Procs and Snapshot report.
+	Pids []int
+	Snap Snapshot
+
+	mu    sync.Mutex
+	calls []string
+}
+
+// Driver returns a Driver handing out r for every job.
+func (r *Recorder) Driver() Driver { return func(string) Manager { return r } }
+
+// Calls returns the calls made so far, e.g. "create job1 memory.max=1024"
+// or "delete job1".
+func (r *Recorder) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+func (r *Recorder) record(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (r *Recorder) Path() string { return r.Snap.Path }
+
+func (r *Recorder) Create(jobID string, limits []string) (int, error) {
+	r.record("create %s %s", jobID, strings.Join(limits, " "))
+	if r.CreateErr != nil {
+		return -1, r.CreateErr
+	}
+	for _, l := range limits {
+		file, _, _ := strings.Cut(l, "=")
+		if err := r.LimitErrs[file]; err != nil {
+			_ = r.Delete(jobID)
+			return -1, fmt.Errorf("write %s: %w", file, err)
+		}
+	}
+	return -1, nil
+}
+
+// Attach makes Recorder an Attacher, so the exec backend places the job's
+// process by pid, as with a systemd scope.
+func (r *Recorder) Attach(pid int) error {
+	r.record("attach")
+	return r.AttachErr
+}
+
+func (r *Recorder) Delete(jobID string) error {
+	r.record("delete %s", jobID)
+	return r.DeleteErr
+}
+
+func (r *Recorder) Procs() ([]int, error) {
+	r.record("procs")
+	return append([]int(nil), r.Pids...), nil
+}
+
+func (r *Recorder) Snapshot() (*Snapshot, error) {
+	r.record("snapshot")
+	s := r.Snap
+	return &s, nil
+}
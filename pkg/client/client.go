@@ -0,0 +1,1279 @@
+// Package client is a Go API for jobworker-server, for programs that want to
+// control jobs without shelling out to jobctl.
+//
+//	c, err := client.New(client.Config{Addr: "127.0.0.1:50051", CertsDir: "./certs"})
+//	id, err := c.Start(ctx, client.JobSpec{Executable: "ls", Args: []string{"-lah", "/"}})
+//	r, err := c.Stream(ctx, id, false)
+//	io.Copy(os.Stdout, r)
+//	info, err := c.Wait(ctx, id)
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/version"
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers "gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMaxRetries   = 3
+	defaultBaseBackoff  = 200 * time.Millisecond
+	defaultMaxBackoff   = 5 * time.Second
+	defaultPollInterval = 500 * time.Millisecond
+
+	scriptChunkSize = 32 * 1024
+)
+
+// Config describes how to reach and authenticate to a server.
+type Config struct {
+	// Addr is the server, host:port, or several separated by commas;
+	// dns:///host:port stands for every address host resolves to. Calls
+	// go to a healthy one per Balancing, and retried calls fail over.
+	Addr string
+	// Balancing is PickFirst (the default) or RoundRobin.
+	Balancing string
+
+	// CertsDir is used to build the mTLS config when TLS is nil.
+	CertsDir string
+	Insecure bool
+	TLS      *tls.Config
+
+	// MaxRetries bounds retries of idempotent calls (Status, List, Stop,
+	// opening a stream, and starts with an IdempotencyKey) on transient
+	// errors. Zero means the default (3); negative disables retries.
+	MaxRetries int
+	// BaseBackoff is the first retry delay; it doubles up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// AttemptTimeout bounds each attempt of a retried call, so one stuck on
+	// a dead connection fails with DeadlineExceeded and is retried while
+	// the caller's ctx has time left. Zero means attempts only end with
+	// ctx. It doesn't apply to streams once open.
+	AttemptTimeout time.Duration
+
+	// PollInterval is how often Wait checks job status.
+	PollInterval time.Duration
+
+	// NoStreamReconnect makes Stream readers return the first transient error
+	// instead of reopening the stream at the byte offset they had reached.
+	NoStreamReconnect bool
+
+	// Token is sent as a bearer token with every call, for servers with
+	// -auth-mode token or mtls+token. With token, CertsDir needs only
+	// ca.crt when it holds no client identity.
+	Token string
+
+	// StreamCompression asks the server to compress StreamOutput responses
+	// with the named codec; "gzip" is the only one built in. Worth it when
+	// tailing verbose text logs over slow links. Empty means uncompressed.
+	StreamCompression string
+}
+
+// JobSpec is what to run and under which limits.
+type JobSpec struct {
+	Executable string
+	Args       []string
+	Image      string // "oci:<dir>[:tag]" or "bundle:<dir>" on the server; optional
+	CPU        string // e.g. "500m", "2", "max"
+	Memory     string // e.g. "100M", "max"
+	Swap       string // memory.swap.max, e.g. "512M"; "0" disables swap
+	IOClass    string // "low" | "med" | "high"
+	IOMax      []*jobpb.IOLimit
+	CPUSet     string // pin to CPUs, e.g. "0-3,8"
+	CPUSetMems string // pin to NUMA memory nodes, e.g. "0"
+	PIDsMax    string // pids.max, e.g. "256" or "max"; empty = server default
+	GPUs       int    // number of exclusive GPUs
+	GPUUUIDs   []string
+	SecretEnv  map[string]string
+	Env        map[string]string // plain variables, NAME -> value; not for credentials
+
+	// Per-process limits (setrlimit), e.g. "1024", "10G", "0" or "max";
+	// empty = the server's own. NProc counts every process of the job's
+	// user.
+	NoFile   string
+	NProc    string
+	CoreSize string
+	FileSize string
+
+	// WaitForLeftovers keeps the job RUNNING until processes it left
+	// behind have exited, instead of killing them when the main process
+	// exits.
+	WaitForLeftovers bool
+
+	// MaxOutputBytes caps the stdout and stderr kept for the job (0 = the
+	// server's default). Past it the rest is discarded, or with
+	// KillOnOutputLimit the job is killed.
+	MaxOutputBytes    uint64
+	KillOnOutputLimit bool
+
+	// StallAfter, when set, marks the job stalled (and emits job.stalled)
+	// once it goes this long without output or more than StallMinCPU of CPU
+	// use; StopWhenStalled stops it then. At least 10s.
+	StallAfter      time.Duration
+	StallMinCPU     time.Duration
+	StopWhenStalled bool
+
+	// CaptureCore keeps the job's core if it crashes, for DownloadCore.
+	CaptureCore bool
+
+	// Umask is the job's file mode creation mask in octal, e.g. "027".
+	// Empty means the server's.
+	Umask string
+
+	// TTY runs the job on a terminal of this size (zero fields: 80x24), so
+	// it writes color and interactive output; it is all captured as
+	// stdout. Nil means pipes. See ResizeTerminal.
+	TTY *jobpb.TerminalSize
+
+	// Result keeps part of the job's stdout, its last lines or a block
+	// between marker lines, as JobInfo.Result once it ends. Nil keeps none.
+	Result *jobpb.ResultCapture
+
+	// ResultFD gives the job a pipe on file descriptor 3, for result data
+	// kept apart from its output; see Client.Result.
+	ResultFD bool
+
+	// Timeout stops the job once it has run this long (whole seconds); 0
+	// means no limit.
+	Timeout time.Duration
+
+	// MaxRestarts, when set, starts the job again as a new job, up to that
+	// many times, each RestartDelay after the last attempt exits non-zero
+	// or is killed by a signal. JobInfo.RestartedAs names the next attempt.
+	MaxRestarts  uint32
+	RestartDelay time.Duration
+
+	// NodeSelector restricts placement to nodes with these labels
+	// (multi-node mode), e.g. {"arch": "arm64"}.
+	NodeSelector map[string]string
+
+	// Labels tag the job, e.g. {"team": "ml"}; servers route output to
+	// external log sinks by them.
+	Labels map[string]string
+
+	// Namespace puts the job in a namespace other than the caller's own
+	// (their certificate's OU, or "default"). Only admins may.
+	Namespace string
+
+	// IdempotencyKey makes Start, Create and RunScript safe to retry: the
+	// server answers a repeat with the job the first call started. With
+	// it, they are retried like Status; without, never. Use a fresh key,
+	// such as a UUID, per job.
+	IdempotencyKey string
+}
+
+// JobInfo is a point-in-time view of a job.
+type JobInfo struct {
+	ID        string
+	User      string
+	Namespace string
+	Status    jobpb.JobStatus
+	ExitCode  int32
+	// Reason says why a finished job ended, when it didn't exit 0.
+	Reason string
+	// OutputTruncated is set once the job's output reached its limit.
+	OutputTruncated bool
+	// Stalled is set while a running job is stalled under its StallAfter.
+	Stalled bool
+	// CoreCaptured is set when the job crashed and left a core.
+	CoreCaptured bool
+	// Result is what JobSpec.Result kept of the finished job's stdout;
+	// ResultTruncated says it was cut to 64 KiB.
+	Result          string
+	ResultTruncated bool
+
+	// For a job with JobSpec.MaxRestarts: how many attempts came before
+	// it, the one it restarted, and the one that restarted it.
+	RestartCount uint32
+	RestartOf    string
+	RestartedAs  string
+
+	// CreatedAt is when the server created the job. RunningAt and
+	// FinishedAt are when the process was launched and when the job reached
+	// its terminal status; zero if it hasn't (yet).
+	CreatedAt  time.Time
+	RunningAt  time.Time
+	FinishedAt time.Time
+
+	// CgroupLimits and Rlimits are the limits the job got, once the server
+	// applied its defaults and ceilings: cgroup v2 "file=value" writes and
+	// e.g. "RLIMIT_NOFILE=1024". CgroupPath is its cgroup on the node.
+	CgroupLimits []string
+	Rlimits      []string
+	CgroupPath   string
+
+	// ExpiredAt is when retention GC removed the job, for Status EXPIRED;
+	// FinalStatus is then the status it had.
+	ExpiredAt   time.Time
+	FinalStatus jobpb.JobStatus
+
+	// AlreadyStopped is set by Stop when the job had finished before the
+	// call, so nothing was signalled.
+	AlreadyStopped bool
+
+	// StartTimings is how long each step of starting the job took.
+	StartTimings StartTimings
+}
+
+// StartTimings breaks down a job's start; see jobpb.StartTimings. A step
+// the job hasn't finished, or that didn't apply to it, is zero.
+type StartTimings struct {
+	Validate    time.Duration // Planning: executable lookup, secrets, GPUs, image
+	Queued      time.Duration // Waiting for a launch worker (-fast-accept)
+	Cgroup      time.Duration
+	Filesystem  time.Duration
+	Exec        time.Duration
+	FirstOutput time.Duration // From running until the first byte of output
+}
+
+// Done reports whether the job has reached a terminal status.
+func (i *JobInfo) Done() bool {
+	switch i.Status {
+	case jobpb.JobStatus_JOB_STATUS_EXITED,
+		jobpb.JobStatus_JOB_STATUS_STOPPED,
+		jobpb.JobStatus_JOB_STATUS_FAILED,
+		jobpb.JobStatus_JOB_STATUS_EXPIRED:
+		return true
+	}
+	return false
+}
+
+type Client struct {
+	cfg   Config
+	conns *pool
+	rpc   jobpb.JobWorkerClient
+}
+
+// New creates a client. No connection is made until the first call.
+func New(cfg Config) (*Client, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("client: Addr required")
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = defaultBaseBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	switch cfg.Balancing {
+	case "":
+		cfg.Balancing = PickFirst
+	case PickFirst, RoundRobin:
+	default:
+		return nil, fmt.Errorf("client: unknown Balancing %q", cfg.Balancing)
+	}
+	targets, err := poolTargets(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	if cfg.StreamCompression != "" && encoding.GetCompressor(cfg.StreamCompression) == nil {
+		return nil, fmt.Errorf("client: unsupported StreamCompression %q", cfg.StreamCompression)
+	}
+
+	tlsCfg := cfg.TLS
+	if tlsCfg == nil {
+		tlsCfg, err = TLSConfig(cfg.CertsDir, targets[0].addr, cfg.Insecure)
+		if errors.Is(err, errNoIdentity) && cfg.Token != "" {
+			tlsCfg, err = serverOnlyTLSConfig(cfg.CertsDir, targets[0].addr, cfg.Insecure)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tls config: %w", err)
+		}
+	}
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(sendCapabilities),
+		grpc.WithChainStreamInterceptor(sendStreamCapabilities),
+	}
+	if cfg.Token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(bearerToken(cfg.Token)))
+	}
+	conns, err := newPool(cfg, targets, tlsCfg, cfg.TLS != nil && cfg.TLS.ServerName != "", dialOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cfg: cfg, conns: conns, rpc: jobpb.NewJobWorkerClient(conns)}, nil
+}
+
+// bearerToken sends a token in each call's authorization metadata, over
+// TLS only.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (bearerToken) RequireTransportSecurity() bool { return true }
+
+// sendCapabilities tells the server which newer response values this client
+// understands, so it doesn't convert them into older ones.
+func sendCapabilities(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withCapabilities(ctx), method, req, reply, cc, opts...)
+}
+
+func sendStreamCapabilities(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withCapabilities(ctx), desc, cc, method, opts...)
+}
+
+func withCapabilities(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, version.ClientCapabilitiesKey, strings.Join(version.ClientCapabilities, ","))
+}
+
+func (c *Client) Close() error {
+	return c.conns.Close()
+}
+
+// RPC exposes the raw generated client for calls not wrapped here.
+func (c *Client) RPC() jobpb.JobWorkerClient {
+	return c.rpc
+}
+
+// AdminRPC exposes the operator-only Admin service. Calls fail with
+// PermissionDenied unless this client's CN is on the server's -admin-cns.
+func (c *Client) AdminRPC() jobpb.AdminClient {
+	return jobpb.NewAdminClient(c.conns)
+}
+
+// Start launches a job and returns its id. It is retried only with
+// spec.IdempotencyKey set: a lost response could otherwise start the job
+// twice.
+func (c *Client) Start(ctx context.Context, spec JobSpec) (string, error) {
+	info, err := c.StartInfo(ctx, spec)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// StartInfo is Start returning the job as the server created it: its owner,
+// creation time, and the limits and cgroup it actually got.
+func (c *Client) StartInfo(ctx context.Context, spec JobSpec) (*JobInfo, error) {
+	req := spec.Request()
+	var resp *jobpb.StartJobResponse
+	err := c.retryIf(ctx, req.IdempotencyKey != "", func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.StartJob(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infoFromMetadata(resp.GetJobId(), resp.GetMetadata()), nil
+}
+
+// Create registers a job without launching it and returns its id; see
+// StartCreated. Retried like Start.
+func (c *Client) Create(ctx context.Context, spec JobSpec) (string, error) {
+	req := spec.Request()
+	var resp *jobpb.StartJobResponse
+	err := c.retryIf(ctx, req.IdempotencyKey != "", func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.CreateJob(ctx, req)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.GetJobId(), nil
+}
+
+// RunScript uploads script and runs it with spec.Executable as the
+// interpreter (e.g. "bash", "python3"), passing spec.Args after it. The
+// script needn't exist on the server. Retried like Start; script is then
+// read into memory first, so it can be sent again.
+func (c *Client) RunScript(ctx context.Context, spec JobSpec, script io.Reader) (string, error) {
+	req := spec.Request()
+	if req.IdempotencyKey == "" {
+		resp, err := SendScript(ctx, c.rpc, req, script)
+		if err != nil {
+			return "", err
+		}
+		return resp.GetJobId(), nil
+	}
+
+	b, err := io.ReadAll(script)
+	if err != nil {
+		return "", fmt.Errorf("read script: %w", err)
+	}
+	var resp *jobpb.StartJobResponse
+	err = c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = SendScript(ctx, c.rpc, req, bytes.NewReader(b))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.GetJobId(), nil
+}
+
+// SendScript makes a RunScript call on rpc: req, then script in chunks.
+func SendScript(ctx context.Context, rpc jobpb.JobWorkerClient, req *jobpb.StartJobRequest, script io.Reader) (*jobpb.StartJobResponse, error) {
+	// Failing to read script abandons the call, so the server never runs
+	// part of it.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := rpc.RunScript(ctx)
+	if err != nil {
+		return nil, err
+	}
+	send := func(msg *jobpb.RunScriptRequest) error {
+		err := stream.Send(msg)
+		if errors.Is(err, io.EOF) {
+			// The server ended the call; CloseAndRecv says why.
+			_, err = stream.CloseAndRecv()
+		}
+		return err
+	}
+
+	if err := send(&jobpb.RunScriptRequest{Part: &jobpb.RunScriptRequest_Job{Job: req}}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, scriptChunkSize)
+	for {
+		n, err := script.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			if err := send(&jobpb.RunScriptRequest{Part: &jobpb.RunScriptRequest_Chunk{Chunk: chunk}}); err != nil {
+				return nil, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read script: %w", err)
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// StartCreated launches a job made by Create. Not retried: a second call
+// fails with FailedPrecondition once the first has started it.
+func (c *Client) StartCreated(ctx context.Context, id string) (*JobInfo, error) {
+	resp, err := c.rpc.StartCreatedJob(ctx, &jobpb.StartCreatedJobRequest{JobId: id})
+	if err != nil {
+		return nil, err
+	}
+	return infoFromMetadata(id, resp.GetMetadata()), nil
+}
+
+// Validate runs the server's StartJob validation for spec and returns what it
+// resolves to, without launching anything. Safe to retry.
+func (c *Client) Validate(ctx context.Context, spec JobSpec) (*jobpb.ResolvedJob, error) {
+	req := spec.Request()
+	req.ValidateOnly = true
+
+	var resp *jobpb.StartJobResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.StartJob(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetResolved(), nil
+}
+
+// Request returns the StartJobRequest spec stands for, as Start sends it.
+func (spec JobSpec) Request() *jobpb.StartJobRequest {
+	req := &jobpb.StartJobRequest{
+		Executable: spec.Executable,
+		Args:       spec.Args,
+		Image:      spec.Image,
+		Limits: &jobpb.ResourceLimits{
+			Cpu:           spec.CPU,
+			MemoryMax:     spec.Memory,
+			MemorySwapMax: spec.Swap,
+			IoMax:         spec.IOMax,
+			CpusetCpus:    spec.CPUSet,
+			CpusetMems:    spec.CPUSetMems,
+			PidsMax:       spec.PIDsMax,
+			IoClass:       spec.IOClass,
+			GpuCount:      uint32(spec.GPUs),
+			GpuUuids:      spec.GPUUUIDs,
+			Nofile:        spec.NoFile,
+			Nproc:         spec.NProc,
+			Core:          spec.CoreSize,
+			Fsize:         spec.FileSize,
+		},
+		SecretEnv:    spec.SecretEnv,
+		Env:          spec.Env,
+		NodeSelector: spec.NodeSelector,
+		Labels:       spec.Labels,
+		Namespace:    spec.Namespace,
+
+		MaxOutputBytes: spec.MaxOutputBytes,
+		CaptureCore:    spec.CaptureCore,
+		Umask:          spec.Umask,
+		IdempotencyKey: spec.IdempotencyKey,
+		Tty:            spec.TTY,
+		Result:         spec.Result,
+		ResultFd:       spec.ResultFD,
+		TimeoutSeconds: uint32(spec.Timeout / time.Second),
+	}
+	if spec.WaitForLeftovers {
+		req.LeftoverPolicy = jobpb.LeftoverPolicy_LEFTOVER_POLICY_WAIT
+	}
+	if spec.KillOnOutputLimit {
+		req.OutputLimitAction = jobpb.OutputLimitAction_OUTPUT_LIMIT_ACTION_KILL
+	}
+	if spec.StallAfter > 0 {
+		req.Liveness = &jobpb.LivenessPolicy{
+			StallSeconds: uint32(spec.StallAfter / time.Second),
+			MinCpuUsec:   uint64(spec.StallMinCPU / time.Microsecond),
+			Stop:         spec.StopWhenStalled,
+		}
+	}
+	if spec.MaxRestarts > 0 {
+		req.Restart = &jobpb.RestartPolicy{
+			MaxRestarts:  spec.MaxRestarts,
+			DelaySeconds: uint32(spec.RestartDelay / time.Second),
+		}
+	}
+	return req
+}
+
+func (c *Client) Status(ctx context.Context, id string) (*JobInfo, error) {
+	var resp *jobpb.GetStatusResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetStatus(ctx, &jobpb.GetStatusRequest{JobId: id})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infoFromMetadata(resp.GetJobId(), resp.GetMetadata()), nil
+}
+
+func (c *Client) Stop(ctx context.Context, id string) (*JobInfo, error) {
+	var resp *jobpb.StopJobResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.StopJob(ctx, &jobpb.StopJobRequest{JobId: id})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := infoFromMetadata(id, resp.GetMetadata())
+	info.AlreadyStopped = resp.GetAlreadyStopped()
+	return info, nil
+}
+
+// Delete removes a finished job and its output from the server and returns
+// how many bytes of output that freed. A job that hasn't finished fails
+// with FailedPrecondition, unless force, which stops it first. Not retried:
+// a repeat of a delete that went through would be NotFound.
+func (c *Client) Delete(ctx context.Context, id string, force bool) (int64, error) {
+	resp, err := c.rpc.DeleteJob(ctx, &jobpb.DeleteJobRequest{JobId: id, Force: force})
+	if err != nil {
+		return 0, err
+	}
+	return int64(resp.GetBytesFreed()), nil
+}
+
+// ResizeTerminal sets the window size of a running job started with
+// JobSpec.TTY.
+func (c *Client) ResizeTerminal(ctx context.Context, id string, rows, cols int) error {
+	return c.retry(ctx, func(ctx context.Context) error {
+		_, err := c.rpc.ResizeTerminal(ctx, &jobpb.ResizeTerminalRequest{
+			JobId: id,
+			Size:  &jobpb.TerminalSize{Rows: uint32(rows), Cols: uint32(cols)},
+		})
+		return err
+	})
+}
+
+// ListOptions selects whose jobs List returns. The zero value means the
+// caller's own; AllUsers and other owners need an admin identity.
+type ListOptions struct {
+	AllUsers bool
+	Owner    string
+	// Namespace limits the list to one namespace; any but the caller's
+	// own needs an admin.
+	Namespace string
+}
+
+// List returns jobs newest first.
+func (c *Client) List(ctx context.Context, opts ListOptions) ([]*jobpb.JobSummary, error) {
+	var resp *jobpb.ListJobsResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.ListJobs(ctx, &jobpb.ListJobsRequest{AllUsers: opts.AllUsers, Owner: opts.Owner, Namespace: opts.Namespace})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetJobs(), nil
+}
+
+// Stats samples the resource usage of running jobs, chosen like List.
+// Counters are cumulative; compare two samples for rates.
+func (c *Client) Stats(ctx context.Context, opts ListOptions) ([]*jobpb.JobStats, error) {
+	var resp *jobpb.GetStatsResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetStats(ctx, &jobpb.ListJobsRequest{AllUsers: opts.AllUsers, Owner: opts.Owner, Namespace: opts.Namespace})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetJobs(), nil
+}
+
+// WatchStats is Stats pushed by the server every interval (zero leaves it
+// to the server) instead of polled. A non-empty id watches that job alone,
+// and the watch ends with io.EOF once it finishes; otherwise opts chooses
+// the jobs. Cancel ctx to stop. A watch broken by a transient error is
+// reopened like Stream.
+func (c *Client) WatchStats(ctx context.Context, id string, opts ListOptions, interval time.Duration) (*StatsWatch, error) {
+	w := &StatsWatch{c: c, ctx: ctx, req: &jobpb.WatchJobStatsRequest{
+		JobId:      id,
+		AllUsers:   opts.AllUsers,
+		Owner:      opts.Owner,
+		IntervalMs: uint32(interval.Milliseconds()),
+	}}
+	if err := c.reopen(ctx, w.open); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// StatsWatch is an open WatchStats.
+type StatsWatch struct {
+	c      *Client
+	ctx    context.Context
+	req    *jobpb.WatchJobStatsRequest
+	stream jobpb.JobWorker_WatchJobStatsClient
+}
+
+func (w *StatsWatch) open() error {
+	stream, err := w.c.rpc.WatchJobStats(w.ctx, w.req)
+	if err != nil {
+		return err
+	}
+	w.stream = stream
+	return nil
+}
+
+// Recv blocks for the next sample.
+func (w *StatsWatch) Recv() ([]*jobpb.JobStats, error) {
+	for {
+		msg, err := w.stream.Recv()
+		if err == nil {
+			return msg.GetJobs(), nil
+		}
+		if errors.Is(err, io.EOF) || w.c.cfg.NoStreamReconnect || !retryable(err) {
+			return nil, err
+		}
+		if err := w.c.reopen(w.ctx, w.open); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Quota reports a user's quota and usage on the server; empty user means
+// the caller.
+func (c *Client) Quota(ctx context.Context, user string) (*jobpb.GetQuotaResponse, error) {
+	var resp *jobpb.GetQuotaResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetQuota(ctx, &jobpb.GetQuotaRequest{User: user})
+		return err
+	})
+	return resp, err
+}
+
+// ServerInfo asks the server which build it is, its API version and
+// capabilities, telling it this client's. Servers too old to answer
+// return codes.Unimplemented.
+func (c *Client) ServerInfo(ctx context.Context) (*jobpb.GetServerInfoResponse, error) {
+	var resp *jobpb.GetServerInfoResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetServerInfo(ctx, &jobpb.GetServerInfoRequest{ClientVersion: version.Version, ClientApiVersion: version.APIVersion})
+		return err
+	})
+	return resp, err
+}
+
+// StartGroup starts every spec as one group, or none of them, and returns
+// the group id and the job ids in spec order.
+func (c *Client) StartGroup(ctx context.Context, specs []JobSpec) (string, []string, error) {
+	req := &jobpb.StartJobsRequest{}
+	for _, spec := range specs {
+		req.Jobs = append(req.Jobs, spec.Request())
+	}
+	var resp *jobpb.StartJobsResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.StartJobs(ctx, req)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.GetGroupId(), resp.GetJobIds(), nil
+}
+
+// GroupStatus reports a group's members and how many ended which way.
+func (c *Client) GroupStatus(ctx context.Context, id string) (*jobpb.GroupStatus, error) {
+	var resp *jobpb.GroupStatus
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetGroupStatus(ctx, &jobpb.GetGroupStatusRequest{GroupId: id})
+		return err
+	})
+	return resp, err
+}
+
+// StopGroup stops every member of the group that hasn't finished.
+func (c *Client) StopGroup(ctx context.Context, id string) (*jobpb.GroupStatus, error) {
+	var resp *jobpb.GroupStatus
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.StopGroup(ctx, &jobpb.StopGroupRequest{GroupId: id})
+		return err
+	})
+	return resp, err
+}
+
+// WaitGroup blocks until every member of the group is terminal or ctx is
+// done.
+func (c *Client) WaitGroup(ctx context.Context, id string) (*jobpb.GroupStatus, error) {
+	for {
+		var resp *jobpb.GroupStatus
+		err := c.retry(ctx, func(ctx context.Context) error {
+			var err error
+			resp, err = c.rpc.WaitGroup(ctx, &jobpb.WaitGroupRequest{GroupId: id})
+			return err
+		})
+		// The server's default deadline (-rpc-timeout) can end a wait the
+		// caller hasn't given up on.
+		if status.Code(err) == codes.DeadlineExceeded && ctx.Err() == nil {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// JobsOutputOptions selects the jobs for StreamJobs: those carrying every
+// label in Selector (all, if empty), owned as ListOptions says.
+type JobsOutputOptions struct {
+	ListOptions
+	Selector map[string]string
+	Stderr   bool
+	Follow   bool // keep following, and pick up jobs started later
+}
+
+// StreamJobs streams the output of many jobs at once, each message holding
+// whole lines of one job. Without Follow it ends after what is on disk now;
+// with Follow it runs until ctx is cancelled. Unlike Stream it is not
+// reopened after a transient error, since that would replay every job.
+func (c *Client) StreamJobs(ctx context.Context, opts JobsOutputOptions) (jobpb.JobWorker_StreamJobsOutputClient, error) {
+	req := &jobpb.StreamJobsOutputRequest{
+		Selector: opts.Selector,
+		Follow:   opts.Follow,
+		AllUsers: opts.AllUsers,
+		Owner:    opts.Owner,
+	}
+	if opts.Stderr {
+		req.Target = jobpb.StreamTarget_STREAM_TARGET_STDERR
+	}
+	var stream jobpb.JobWorker_StreamJobsOutputClient
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		stream, err = c.rpc.StreamJobsOutput(ctx, req)
+		return err
+	})
+	return stream, err
+}
+
+// SearchOptions is a SearchOutput query; see Search.
+type SearchOptions struct {
+	Pattern    string // RE2 regular expression
+	IgnoreCase bool
+	Stderr     bool
+	Context    int // lines before and after each match
+	MaxMatches int // 0 = server default (100)
+}
+
+// Search greps the job's stored output on the server, returning matching
+// lines and their context without downloading the output.
+func (c *Client) Search(ctx context.Context, id string, opts SearchOptions) (*jobpb.SearchOutputResponse, error) {
+	req := &jobpb.SearchOutputRequest{
+		JobId:        id,
+		Pattern:      opts.Pattern,
+		IgnoreCase:   opts.IgnoreCase,
+		ContextLines: uint32(opts.Context),
+		MaxMatches:   uint32(opts.MaxMatches),
+	}
+	if opts.Stderr {
+		req.Target = jobpb.StreamTarget_STREAM_TARGET_STDERR
+	}
+	var resp *jobpb.SearchOutputResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.SearchOutput(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// CountLines counts the lines of the job's stored stdout (or stderr), and
+// reports its size.
+func (c *Client) CountLines(ctx context.Context, id string, stderr bool) (*jobpb.CountOutputLinesResponse, error) {
+	req := &jobpb.CountOutputLinesRequest{JobId: id}
+	if stderr {
+		req.Target = jobpb.StreamTarget_STREAM_TARGET_STDERR
+	}
+	var resp *jobpb.CountOutputLinesResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.CountOutputLines(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// Result returns the result data a job started with JobSpec.ResultFD has
+// written to file descriptor 3; complete says it had finished, so that is
+// all of it.
+func (c *Client) Result(ctx context.Context, id string) (*jobpb.GetJobResultResponse, error) {
+	var resp *jobpb.GetJobResultResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetJobResult(ctx, &jobpb.GetJobResultRequest{JobId: id})
+		return err
+	})
+	return resp, err
+}
+
+// Processes lists a running job's processes, by pid.
+func (c *Client) Processes(ctx context.Context, id string) ([]*jobpb.JobProcess, error) {
+	var resp *jobpb.GetJobProcessesResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.rpc.GetJobProcesses(ctx, &jobpb.GetJobProcessesRequest{JobId: id})
+		return err
+	})
+	return resp.GetProcesses(), err
+}
+
+// DownloadCore writes the core a crashed job left to w and returns how many
+// bytes it wrote. It fails with NotFound when the job has none.
+func (c *Client) DownloadCore(ctx context.Context, id string, w io.Writer) (int64, error) {
+	var stream jobpb.JobWorker_DownloadCoreClient
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		stream, err = c.rpc.DownloadCore(ctx, &jobpb.DownloadCoreRequest{JobId: id})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n, size int64
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if msg.GetSize() > 0 {
+			size = int64(msg.GetSize())
+		}
+		m, err := w.Write(msg.GetChunk())
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	if n != size {
+		return n, fmt.Errorf("core cut short: got %d of %d bytes", n, size)
+	}
+	return n, nil
+}
+
+// OutputDownload is what DownloadOutput wrote.
+type OutputDownload struct {
+	Size   int64
+	SHA256 []byte
+	// Complete is set when the job had finished, so this is all its output;
+	// otherwise it is the output so far.
+	Complete bool
+}
+
+// DownloadOutput writes a job's stored stdout (or stderr) to w, from the
+// start to where it ends now, and checks it against the server's SHA-256.
+// A download that is cut short or doesn't match fails, after w got the
+// part that arrived.
+func (c *Client) DownloadOutput(ctx context.Context, id string, stderr bool, w io.Writer) (*OutputDownload, error) {
+	target := jobpb.StreamTarget_STREAM_TARGET_STDOUT
+	if stderr {
+		target = jobpb.StreamTarget_STREAM_TARGET_STDERR
+	}
+	var stream jobpb.JobWorker_DownloadOutputClient
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		stream, err = c.rpc.DownloadOutput(ctx, &jobpb.DownloadOutputRequest{JobId: id, Target: target})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	var n int64
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("output cut short after %d bytes", n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg.GetSha256() != nil {
+			d := &OutputDownload{Size: n, SHA256: sum.Sum(nil), Complete: msg.GetComplete()}
+			if uint64(n) != msg.GetSize() || !bytes.Equal(d.SHA256, msg.GetSha256()) {
+				return nil, fmt.Errorf("output corrupted: got %d bytes with sha256 %x, server sent %d with %x",
+					n, d.SHA256, msg.GetSize(), msg.GetSha256())
+			}
+			return d, nil
+		}
+		sum.Write(msg.GetChunk())
+		m, err := w.Write(msg.GetChunk())
+		n += int64(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// expiredReason is the server's ErrorInfo reason for an expired job.
+const expiredReason = "JOB_EXPIRED"
+
+// IsExpired reports whether err is a server's NOT_FOUND for a job that
+// existed but was removed by retention GC, as opposed to an id it never
+// had. Status reports such a job as EXPIRED instead of failing.
+func IsExpired(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.NotFound {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetReason() == expiredReason {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait polls until the job reaches a terminal status or ctx is done.
+func (c *Client) Wait(ctx context.Context, id string) (*JobInfo, error) {
+	t := time.NewTicker(c.cfg.PollInterval)
+	defer t.Stop()
+	for {
+		info, err := c.Status(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if info.Done() {
+			return info, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Stream returns the job's stdout (or stderr) from the beginning as a byte
+// stream that follows the job until it finishes. Close the reader to stop
+// early. Unless NoStreamReconnect is set, a stream broken by a transient error
+// (server restart, network blip) is reopened where it left off, backing off
+// between attempts. Only output arriving resets the backoff: after
+// MaxRetries reconnects in a row bring none, Read gives up and returns the
+// last transient error, e.g. UNAVAILABLE.
+func (c *Client) Stream(ctx context.Context, id string, stderr bool) (io.ReadCloser, error) {
+	return c.StreamFrom(ctx, id, StreamOptions{Stderr: stderr})
+}
+
+// StreamOptions pick the output StreamFrom reads and where it starts. Set
+// at most one of TailLines and SinceLine.
+type StreamOptions struct {
+	Stderr    bool
+	TailLines uint64 // start at the last this many lines written so far
+	SinceLine uint64 // start at this line (1-based)
+
+	// Include and Exclude, RE2 regular expressions, have the server send
+	// only the lines matching Include and not Exclude. OnSuppressed, if
+	// set, is told how many lines were filtered out, as the server reports
+	// them: with each chunk, and every 5s while nothing matches.
+	Include, Exclude string
+	IgnoreCase       bool
+	OnSuppressed     func(lines uint64)
+}
+
+// StreamFrom is Stream starting at a line instead of the beginning; on
+// multi-GB output the server finds the line without reading up to it.
+func (c *Client) StreamFrom(ctx context.Context, id string, opts StreamOptions) (io.ReadCloser, error) {
+	target := jobpb.StreamTarget_STREAM_TARGET_STDOUT
+	if opts.Stderr {
+		target = jobpb.StreamTarget_STREAM_TARGET_STDERR
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &streamReader{c: c, ctx: ctx, cancel: cancel, id: id, target: target, tail: opts.TailLines, since: opts.SinceLine,
+		include: opts.Include, exclude: opts.Exclude, ignoreCase: opts.IgnoreCase, onSuppressed: opts.OnSuppressed}
+	if err := c.reopen(ctx, r.open); err != nil {
+		cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+type streamReader struct {
+	c      *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	id     string
+	target jobpb.StreamTarget
+
+	tail  uint64 // TailLines, until the first chunk tells where it started
+	since uint64 // SinceLine, likewise
+
+	include, exclude string
+	ignoreCase       bool
+	onSuppressed     func(uint64)
+
+	stream jobpb.JobWorker_StreamOutputClient
+	offset uint64 // bytes received so far
+	buf    []byte
+
+	// A reopened stream only shows it works by delivering a message, so
+	// reconnects back off, and count towards MaxRetries, until one does.
+	backoff  time.Duration
+	failures int
+}
+
+func (r *streamReader) open() error {
+	var opts []grpc.CallOption
+	if name := r.c.cfg.StreamCompression; name != "" {
+		// The server answers in the codec the request was sent with.
+		opts = append(opts, grpc.UseCompressor(name))
+	}
+	stream, err := r.c.rpc.StreamOutput(r.ctx, &jobpb.StreamOutputRequest{
+		JobId:     r.id,
+		Target:    r.target,
+		Offset:    r.offset,
+		TailLines: r.tail,
+		SinceLine: r.since,
+
+		Include:    r.include,
+		Exclude:    r.exclude,
+		IgnoreCase: r.ignoreCase,
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	r.stream = stream
+	return nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, err // clean end of stream
+			}
+			if err := r.reconnect(err); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		r.buf = msg.GetChunk()
+		r.backoff, r.failures = 0, 0
+		if n := msg.GetSuppressedLines(); n > 0 && r.onSuppressed != nil {
+			r.onSuppressed(n)
+		}
+		if next := msg.GetNextOffset(); next > 0 {
+			// A filtered chunk skips what was dropped; resume past that too.
+			r.offset, r.tail, r.since = next, 0, 0
+			continue
+		}
+		if r.tail > 0 || r.since > 0 {
+			// Resume from where the lines turned out to start.
+			r.offset, r.tail, r.since = msg.GetOffset(), 0, 0
+		}
+		r.offset += uint64(len(r.buf))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// reconnect reopens the stream at r.offset after a transient failure. It
+// returns the last error instead if that isn't worth retrying, ctx ended
+// first, or MaxRetries reconnects in a row brought no message.
+func (r *streamReader) reconnect(err error) error {
+	if r.c.cfg.NoStreamReconnect {
+		return err
+	}
+	for retryable(err) && r.failures < r.c.cfg.MaxRetries {
+		if r.backoff == 0 {
+			r.backoff = r.c.cfg.BaseBackoff
+		}
+		select {
+		case <-r.ctx.Done():
+			return err
+		case <-time.After(r.backoff):
+		}
+		r.backoff = min(r.backoff*2, r.c.cfg.MaxBackoff)
+		r.failures++
+		if err = r.open(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// retry runs fn, retrying transient failures with exponential backoff.
+// Each attempt gets ctx bounded by AttemptTimeout; one that runs out is
+// retried if ctx itself hasn't. A DEADLINE_EXCEEDED from anywhere else,
+// ctx or the server's own timeout, would end the next attempt too.
+func (c *Client) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := c.cfg.BaseBackoff
+	for attempt := 0; ; attempt++ {
+		expired, err := c.attempt(ctx, fn)
+		timedOut := expired && status.Code(err) == codes.DeadlineExceeded && ctx.Err() == nil
+		if err == nil || attempt >= c.cfg.MaxRetries || !(retryable(err) || timedOut) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, c.cfg.MaxBackoff)
+	}
+}
+
+// retryIf is retry when ok, and otherwise a single attempt.
+func (c *Client) retryIf(ctx context.Context, ok bool, fn func(ctx context.Context) error) error {
+	if !ok {
+		_, err := c.attempt(ctx, fn)
+		return err
+	}
+	return c.retry(ctx, fn)
+}
+
+// attempt runs fn once, bounded by AttemptTimeout. expired reports
+// whether that bound ran out.
+func (c *Client) attempt(ctx context.Context, fn func(ctx context.Context) error) (expired bool, err error) {
+	if c.cfg.AttemptTimeout <= 0 {
+		return false, fn(ctx)
+	}
+	actx, cancel := context.WithTimeout(ctx, c.cfg.AttemptTimeout)
+	defer cancel()
+	err = fn(actx)
+	return actx.Err() == context.DeadlineExceeded && ctx.Err() == nil, err
+}
+
+// reopen retries open, which opens a stream on its own long-lived
+// context, so AttemptTimeout doesn't bound it.
+func (c *Client) reopen(ctx context.Context, open func() error) error {
+	return c.retry(ctx, func(context.Context) error { return open() })
+}
+
+// retryable reports whether err is transient. RESOURCE_EXHAUSTED isn't:
+// a quota or job limit stays hit until jobs end, and retrying it only
+// adds load.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+func infoFromMetadata(id string, md *jobpb.JobMetadata) *JobInfo {
+	info := &JobInfo{
+		ID:        id,
+		User:      md.GetUser(),
+		Namespace: md.GetNamespace(),
+		Status:    md.GetStatus(),
+		ExitCode:  md.GetExitCode(),
+		Reason:    md.GetReason(),
+
+		OutputTruncated: md.GetOutputTruncated(),
+		Stalled:         md.GetStalled(),
+		CoreCaptured:    md.GetCoreCaptured(),
+		Result:          md.GetResult(),
+		ResultTruncated: md.GetResultTruncated(),
+		RestartCount:    md.GetRestartCount(),
+		RestartOf:       md.GetRestartOf(),
+		RestartedAs:     md.GetRestartedAs(),
+
+		CgroupLimits: md.GetCgroupLimits(),
+		Rlimits:      md.GetRlimits(),
+		CgroupPath:   md.GetCgroupPath(),
+		FinalStatus:  md.GetFinalStatus(),
+	}
+	if t := md.GetStartTimings(); t != nil {
+		info.StartTimings = StartTimings{
+			Validate:    time.Duration(t.GetValidateUsec()) * time.Microsecond,
+			Queued:      time.Duration(t.GetQueuedUsec()) * time.Microsecond,
+			Cgroup:      time.Duration(t.GetCgroupUsec()) * time.Microsecond,
+			Filesystem:  time.Duration(t.GetFilesystemUsec()) * time.Microsecond,
+			Exec:        time.Duration(t.GetExecUsec()) * time.Microsecond,
+			FirstOutput: time.Duration(t.GetFirstOutputUsec()) * time.Microsecond,
+		}
+	}
+	if md.GetCreatedAt() != nil {
+		info.CreatedAt = md.GetCreatedAt().AsTime()
+	}
+	if md.GetRunningAt() != nil {
+		info.RunningAt = md.GetRunningAt().AsTime()
+	}
+	if md.GetExpiredAt() != nil {
+		info.ExpiredAt = md.GetExpiredAt().AsTime()
+	}
+	if md.GetFinishedAt() != nil {
+		info.FinishedAt = md.GetFinishedAt().AsTime()
+	}
+	return info
+}
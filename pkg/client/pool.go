@@ -0,0 +1,284 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Balancing policies for Config.Balancing.
+const (
+	// PickFirst sends every call to the first healthy server.
+	PickFirst = "pick_first"
+	// RoundRobin spreads read calls (status, listing, output) across the
+	// healthy servers; the rest still go to the first.
+	RoundRobin = "round_robin"
+)
+
+// readMethods are the calls RoundRobin spreads. Everything else changes
+// something, and stays on one server.
+var readMethods = map[string]bool{
+	jobpb.JobWorker_GetStatus_FullMethodName:        true,
+	jobpb.JobWorker_ListJobs_FullMethodName:         true,
+	jobpb.JobWorker_GetStats_FullMethodName:         true,
+	jobpb.JobWorker_WatchJobStats_FullMethodName:    true,
+	jobpb.JobWorker_StreamOutput_FullMethodName:     true,
+	jobpb.JobWorker_StreamJobsOutput_FullMethodName: true,
+	jobpb.JobWorker_SearchOutput_FullMethodName:     true,
+	jobpb.JobWorker_CountOutputLines_FullMethodName: true,
+	jobpb.JobWorker_GetJobProcesses_FullMethodName:  true,
+	jobpb.JobWorker_DownloadCore_FullMethodName:     true,
+	jobpb.JobWorker_DownloadOutput_FullMethodName:   true,
+	jobpb.JobWorker_GetJobResult_FullMethodName:     true,
+	jobpb.JobWorker_GetGroupStatus_FullMethodName:   true,
+	jobpb.JobWorker_WaitGroup_FullMethodName:        true,
+	jobpb.JobWorker_GetQuota_FullMethodName:         true,
+	jobpb.JobWorker_GetServerInfo_FullMethodName:    true,
+}
+
+// A member's health, from its grpc.health.v1 Watch and failed calls.
+const (
+	healthUnknown    int32 = iota // not heard from yet; used like serving
+	healthServing                 // takes any call
+	healthNotServing              // draining: reads only
+	healthDown                    // unreachable
+)
+
+// pool holds a connection per server in Config.Addr and implements
+// grpc.ClientConnInterface, sending each call to a server picked by
+// health and the balancing policy. With several servers each is watched
+// over grpc.health.v1; a call that fails with Unavailable marks its server
+// down until the watch sees it back. Retried calls then fail over.
+type pool struct {
+	members    []*member
+	roundRobin bool
+	next       atomic.Uint32
+	stop       context.CancelFunc
+}
+
+type member struct {
+	addr   string
+	conn   *grpc.ClientConn
+	health atomic.Int32
+}
+
+// poolTarget is a server to dial and the name its certificate is checked
+// against.
+type poolTarget struct {
+	addr, serverName string
+}
+
+// poolTargets parses Config.Addr: host:port entries separated by commas,
+// where dns:///host:port stands for every address host resolves to, looked
+// up now.
+func poolTargets(addrs string) ([]poolTarget, error) {
+	var targets []poolTarget
+	for _, a := range strings.Split(addrs, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		name, ok := strings.CutPrefix(a, "dns:///")
+		if !ok {
+			host, _, err := net.SplitHostPort(a)
+			if err != nil {
+				host = a
+			}
+			targets = append(targets, poolTarget{a, host})
+			continue
+		}
+		host, port, err := net.SplitHostPort(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a, err)
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a, err)
+		}
+		for _, ip := range ips {
+			targets = append(targets, poolTarget{net.JoinHostPort(ip, port), host})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no server address in %q", addrs)
+	}
+	return targets, nil
+}
+
+// newPool dials every target. tlsCfg's ServerName is set per target
+// unless keepServerName.
+func newPool(cfg Config, targets []poolTarget, tlsCfg *tls.Config, keepServerName bool, opts []grpc.DialOption) (*pool, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	p := &pool{roundRobin: cfg.Balancing == RoundRobin, stop: stop}
+	for _, t := range targets {
+		mc := tlsCfg.Clone()
+		if !keepServerName {
+			mc.ServerName = t.serverName
+		}
+		conn, err := grpc.NewClient(t.addr, append([]grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(mc))}, opts...)...)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("dial %s: %w", t.addr, err)
+		}
+		p.members = append(p.members, &member{addr: t.addr, conn: conn})
+	}
+	if len(p.members) > 1 {
+		for _, m := range p.members {
+			go m.watch(ctx, cfg.BaseBackoff, cfg.MaxBackoff)
+		}
+	}
+	return p, nil
+}
+
+func (p *pool) Close() error {
+	p.stop()
+	var first error
+	for _, m := range p.members {
+		if err := m.conn.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// pick chooses the server for method: for changes, the first serving
+// one; for reads, the first reachable one, or with RoundRobin the next.
+// When none qualifies it falls back to any that's up, then the first. A
+// server is only picked once connected, so a call that can't be retried
+// isn't lost on one that's down.
+func (p *pool) pick(ctx context.Context, method string) *member {
+	if len(p.members) == 1 {
+		return p.members[0]
+	}
+	read := readMethods[method]
+	var cands []*member
+	for _, m := range p.members {
+		switch h := m.health.Load(); {
+		case h == healthUnknown, h == healthServing, read && h == healthNotServing:
+			cands = append(cands, m)
+		}
+	}
+	if len(cands) == 0 {
+		for _, m := range p.members {
+			if m.health.Load() != healthDown {
+				cands = append(cands, m)
+			}
+		}
+	}
+	if len(cands) == 0 {
+		cands = p.members
+	}
+	start := 0
+	if read && p.roundRobin {
+		start = int(p.next.Add(1)-1) % len(cands)
+	}
+	for i := range cands {
+		m := cands[(start+i)%len(cands)]
+		if m.connected(ctx) && (read || m.serving(ctx)) {
+			return m
+		}
+	}
+	return cands[start]
+}
+
+// serving checks m's health if its watch hasn't reported yet, so a
+// short-lived client's first change doesn't go to a draining server.
+func (m *member) serving(ctx context.Context) bool {
+	if m.health.Load() == healthUnknown {
+		resp, err := healthpb.NewHealthClient(m.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		switch {
+		case err == nil && resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+			m.health.CompareAndSwap(healthUnknown, healthNotServing)
+		case err == nil, status.Code(err) == codes.Unimplemented:
+			m.health.CompareAndSwap(healthUnknown, healthServing)
+		}
+	}
+	return m.health.Load() != healthNotServing && m.health.Load() != healthDown
+}
+
+// connected reports whether m has a connection, making one if it's idle.
+// A failed one marks m down.
+func (m *member) connected(ctx context.Context) bool {
+	for {
+		switch st := m.conn.GetState(); st {
+		case connectivity.Ready:
+			return true
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			m.health.Store(healthDown)
+			return false
+		default:
+			m.conn.Connect()
+			if !m.conn.WaitForStateChange(ctx, st) {
+				return false
+			}
+		}
+	}
+}
+
+func (p *pool) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	m := p.pick(ctx, method)
+	err := m.conn.Invoke(ctx, method, args, reply, opts...)
+	m.failed(err)
+	return err
+}
+
+func (p *pool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	m := p.pick(ctx, method)
+	s, err := m.conn.NewStream(ctx, desc, method, opts...)
+	m.failed(err)
+	return s, err
+}
+
+// failed marks m down after a call couldn't reach it.
+func (m *member) failed(err error) {
+	if status.Code(err) == codes.Unavailable {
+		m.health.Store(healthDown)
+	}
+}
+
+// watch follows m's health until ctx ends, reconnecting with backoff.
+// Servers without the health service count as serving while reachable.
+func (m *member) watch(ctx context.Context, base, max time.Duration) {
+	hc := healthpb.NewHealthClient(m.conn)
+	backoff := base
+	for ctx.Err() == nil {
+		stream, err := hc.Watch(ctx, &healthpb.HealthCheckRequest{})
+		for err == nil {
+			var resp *healthpb.HealthCheckResponse
+			if resp, err = stream.Recv(); err == nil {
+				backoff = base
+				if resp.GetStatus() == healthpb.HealthCheckResponse_SERVING {
+					m.health.Store(healthServing)
+				} else {
+					m.health.Store(healthNotServing)
+				}
+			}
+		}
+		switch {
+		case ctx.Err() != nil:
+			return
+		case status.Code(err) == codes.Unimplemented:
+			m.health.Store(healthServing)
+		default:
+			m.health.Store(healthDown)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, max)
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryCodes(t *testing.T) {
+	c := &Client{cfg: Config{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+	for _, tc := range []struct {
+		code     codes.Code
+		attempts int
+	}{
+		{codes.Unavailable, 4},
+		{codes.Aborted, 4},
+		{codes.ResourceExhausted, 1},
+		{codes.DeadlineExceeded, 1}, // the server's deadline, not the attempt's
+		{codes.NotFound, 1},
+	} {
+		n := 0
+		err := c.retry(context.Background(), func(context.Context) error {
+			n++
+			return status.Error(tc.code, "x")
+		})
+		if status.Code(err) != tc.code || n != tc.attempts {
+			t.Errorf("%s: %d attempts, error %v; want %d attempts", tc.code, n, err, tc.attempts)
+		}
+	}
+}
+
+// TestRetryAttemptTimeout retries an attempt that runs out of
+// AttemptTimeout, but not one whose caller's deadline ran out.
+func TestRetryAttemptTimeout(t *testing.T) {
+	c := &Client{cfg: Config{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, AttemptTimeout: 10 * time.Millisecond}}
+	block := func(n *int) func(context.Context) error {
+		return func(ctx context.Context) error {
+			*n++
+			<-ctx.Done()
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	var n int
+	if err := c.retry(context.Background(), block(&n)); status.Code(err) != codes.DeadlineExceeded || n != 3 {
+		t.Errorf("attempt timeouts: %d attempts, error %v; want 3", n, err)
+	}
+
+	n = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := c.retry(ctx, block(&n)); status.Code(err) != codes.DeadlineExceeded || n != 1 {
+		t.Errorf("caller's deadline: %d attempts, error %v; want 1", n, err)
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	jobpb "github.com/bucknercd/jobworker/proto/gen/jobpb"
+)
+
+// flakyOutput opens output streams that each deliver chunks messages,
+// then fail UNAVAILABLE.
+type flakyOutput struct {
+	jobpb.JobWorkerClient
+	chunks int
+	opens  int
+}
+
+func (f *flakyOutput) StreamOutput(ctx context.Context, req *jobpb.StreamOutputRequest, _ ...grpc.CallOption) (jobpb.JobWorker_StreamOutputClient, error) {
+	f.opens++
+	return &flakyStream{left: f.chunks, offset: req.GetOffset()}, nil
+}
+
+type flakyStream struct {
+	grpc.ClientStream
+	left   int
+	offset uint64
+}
+
+func (s *flakyStream) Recv() (*jobpb.StreamOutputResponse, error) {
+	if s.left == 0 {
+		return nil, status.Error(codes.Unavailable, "connection reset")
+	}
+	s.left--
+	msg := &jobpb.StreamOutputResponse{Chunk: []byte("x"), Offset: s.offset}
+	s.offset++
+	return msg, nil
+}
+
+func newFlakyClient(rpc jobpb.JobWorkerClient) *Client {
+	return &Client{rpc: rpc, cfg: Config{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+}
+
+// TestStreamReconnectGivesUp checks that streams which open but never
+// deliver are reopened MaxRetries times, not forever.
+func TestStreamReconnectGivesUp(t *testing.T) {
+	rpc := &flakyOutput{}
+	r, err := newFlakyClient(rpc).StreamFrom(context.Background(), "job1", StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); status.Code(err) != codes.Unavailable {
+		t.Fatalf("read: %v, want UNAVAILABLE", err)
+	}
+	if rpc.opens != 4 {
+		t.Errorf("stream opened %d times, want 4", rpc.opens)
+	}
+}
+
+// TestStreamReconnectResets checks that a reconnect which delivers output
+// starts the count over.
+func TestStreamReconnectResets(t *testing.T) {
+	rpc := &flakyOutput{chunks: 1}
+	r, err := newFlakyClient(rpc).StreamFrom(context.Background(), "job1", StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("byte %d: %v", i, err)
+		}
+	}
+}
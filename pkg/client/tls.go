@@ -0,0 +1,98 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// TLSConfig builds the mTLS client config used by jobctl: ca.crt from
+// certsDir, and the single identity directory under certsDir holding
+// client.crt/client.key.
+func TLSConfig(certsDir, addr string, insecure bool) (*tls.Config, error) {
+	identityDir, err := discoverIdentityDir(certsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCertPath := filepath.Join(identityDir, "client.crt")
+	clientKeyPath := filepath.Join(identityDir, "client.key")
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load client keypair (%s): %w", identityDir, err)
+	}
+
+	tlsCfg, err := serverOnlyTLSConfig(certsDir, addr, insecure)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.Certificates = []tls.Certificate{clientCert}
+	return tlsCfg, nil
+}
+
+// serverOnlyTLSConfig verifies the server against ca.crt from certsDir
+// but presents no client certificate, for bearer token auth.
+func serverOnlyTLSConfig(certsDir, addr string, insecure bool) (*tls.Config, error) {
+	caPath := filepath.Join(certsDir, "ca.crt")
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("read ca.crt: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(caPEM); !ok {
+		return nil, fmt.Errorf("append ca.crt: no certs found")
+	}
+
+	host := addr
+	// addr might be "host:port"
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		RootCAs:    roots,
+		ServerName: host,
+	}
+
+	if insecure {
+		tlsCfg.InsecureSkipVerify = true // dev-only
+	}
+	return tlsCfg, nil
+}
+
+var errNoIdentity = errors.New("no identity found")
+
+func discoverIdentityDir(certsDir string) (string, error) {
+	entries, err := os.ReadDir(certsDir)
+	if err != nil {
+		return "", err
+	}
+
+	var found string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		d := filepath.Join(certsDir, e.Name())
+		if fileExists(filepath.Join(d, "client.crt")) && fileExists(filepath.Join(d, "client.key")) {
+			if found != "" {
+				return "", fmt.Errorf("multiple identities found under %s; specify one", certsDir)
+			}
+			found = d
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("%w under %s", errNoIdentity, certsDir)
+	}
+	return found, nil
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
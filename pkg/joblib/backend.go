@@ -0,0 +1,147 @@
+package joblib
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// Backend runs and confines the process behind a Job. The Job owns the
+// lifecycle (status, exit code, Done); a backend only has to launch, wait,
+// kill and report on one process tree, so new execution environments
+// (microVMs, remote hosts, ...) plug in without touching callers.
+type Backend interface {
+	// Start launches the process and returns without waiting for it. On
+	// error the backend has already released anything it set up. Failures
+	// while confining the job (before it runs) should wrap ErrSetup.
+	Start() error
+
+	// Wait blocks until the process has exited and the backend has released
+	// its resources (output flushed, cgroup removed). Called once, only
+	// after a successful Start.
+	Wait() (Exit, error)
+
+	// Stop kills the whole process tree. It may be called before Start, more
+	// than once, and concurrently with Wait.
+	Stop() error
+
+	// Signal delivers sig to the whole process tree.
+	Signal(sig syscall.Signal) error
+
+	// Stats reports current resource usage. Fields a backend can't measure
+	// are left zero.
+	Stats() (Stats, error)
+
+	// OutputReader opens the persisted stdout (or stderr) from the
+	// beginning, returning io.EOF at the current end.
+	OutputReader(stderr bool) (io.ReadCloser, error)
+}
+
+// LocalOutput is implemented by backends that persist output to files on
+// this host, so readers can watch the files for growth instead of polling.
+type LocalOutput interface {
+	OutputPath(stderr bool) string
+}
+
+// OutputCompressor is implemented by backends that can compress a
+// finished job's output files, which OutputReader then decompresses, so
+// readers get the same bytes as before. With LocalOutput, compressed
+// output lives at OutputPath plus CompressedSuffix.
+type OutputCompressor interface {
+	// CompressOutput compresses stdout and stderr, and reports their size
+	// on disk before and after. Output already compressed is left alone.
+	CompressOutput() (before, after int64, err error)
+}
+
+// CompressedSuffix is added to the name of an output file once it is
+// compressed (zstd).
+const CompressedSuffix = ".zst"
+
+// Remover is implemented by backends that keep per-job state, such as output
+// files, after the job ends. Remove deletes it.
+type Remover interface {
+	Remove() error
+}
+
+// Describer is implemented by backends that can say where a job runs on
+// the host, for diagnostics.
+type Describer interface {
+	Describe() Description
+}
+
+// Description locates a job's process. Zero fields are unknown.
+type Description struct {
+	PID        int
+	CgroupPath string
+}
+
+// StartTimer is implemented by backends that time the steps of Start, for
+// finding out why starts are slow.
+type StartTimer interface {
+	StartTimings() StartTimings
+}
+
+// StartTimings is how long each step of a backend's Start took. A step
+// Start didn't finish is zero, and so is every step until Start returns.
+type StartTimings struct {
+	Cgroup     time.Duration // Creating the cgroup, applying limits and device filters
+	Filesystem time.Duration // The job's directory, workspace and output files
+	Exec       time.Duration // From fork until the process runs in its cgroup
+}
+
+// BackendFactory builds the backend for a job from its options.
+type BackendFactory func(Options) (Backend, error)
+
+// Exit describes how a backend's process ended.
+type Exit struct {
+	Code      int            // Process exit code; meaningful when !Signaled
+	Signaled  bool           // Killed by a signal
+	Signal    syscall.Signal // Which signal, when Signaled
+	OOMKilled bool           // The kernel OOM killer fired in the job's cgroup
+
+	// OutputLimitKilled is set when the backend killed the job for reaching
+	// its OutputLimit.
+	OutputLimitKilled bool
+
+	// CoreDumped is set when the signal left a core; Core is where the
+	// backend kept it, if it did (see Options.CoreLimit).
+	CoreDumped bool
+	Core       string
+
+	// Leftovers is how many processes were still in the job's cgroup when
+	// the main process exited; LeftoversWaited is set if Wait waited for
+	// them rather than killing them.
+	Leftovers       int
+	LeftoversWaited bool
+
+	// Usage is the job's resource usage just before the backend released
+	// it, for backends that can still measure it then; nil otherwise.
+	Usage *Stats
+}
+
+// Stats is a point-in-time view of a job's resource usage.
+type Stats struct {
+	PIDs             int
+	PIDsMaxHits      uint64 // forks refused because pids.max was reached
+	MemoryCurrent    uint64 // bytes
+	MemoryMax        uint64 // bytes; 0 = unlimited
+	CPUUsageUsec     uint64
+	CPUThrottledUsec uint64
+	IOReadBytes      uint64 // all devices, since the job started
+	IOWriteBytes     uint64
+}
+
+// ErrSetup marks Start failures in isolation setup (cgroups, device filters,
+// sandboxes) as opposed to failing to launch the process itself.
+var ErrSetup = errors.New("job setup failed")
+
+// setupError reads as its own message but matches ErrSetup.
+type setupError struct {
+	msg string
+	err error
+}
+
+func (e *setupError) Error() string        { return e.msg + ": " + e.err.Error() }
+func (e *setupError) Unwrap() error        { return e.err }
+func (e *setupError) Is(target error) bool { return target == ErrSetup }
@@ -0,0 +1,128 @@
+package joblib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A finished job's output is only ever read again, often years of verbose
+// logs nobody looks at, so the exec backend can compress it in place: the
+// file is written compressed next to the original, renamed over, and the
+// original removed. A reader that opened the original keeps reading it.
+
+// compressWindow is the zstd window compressed output is written with. The
+// default 8 MiB would cost every reader's decoder that much; log lines
+// repeat over far shorter spans.
+const compressWindow = 1 << 20
+
+// CompressOutput implements OutputCompressor. Encrypted output isn't
+// compressed: ciphertext doesn't shrink.
+func (b *execBackend) CompressOutput() (before, after int64, err error) {
+	if b.outputKey != nil {
+		return 0, 0, errors.ErrUnsupported
+	}
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+	if b.removed {
+		return 0, 0, os.ErrNotExist
+	}
+	for _, path := range []string{b.stdoutPath, b.stderrPath} {
+		in, out, err := compressFile(path)
+		if err != nil {
+			return before, after, err
+		}
+		before += in
+		after += out
+	}
+	return before, after, nil
+}
+
+// compressFile compresses the file at path to path+CompressedSuffix,
+// unless it is missing (already compressed), empty, or wouldn't shrink.
+func compressFile(path string) (before, after int64, err error) {
+	src, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if before = fi.Size(); before == 0 {
+		return 0, 0, nil
+	}
+
+	tmp := path + CompressedSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp) // a no-op once renamed
+	enc, err := zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(compressWindow))
+	if err != nil {
+		dst.Close()
+		return 0, 0, err
+	}
+	if _, err := io.Copy(enc, src); err != nil {
+		enc.Close()
+		dst.Close()
+		return 0, 0, fmt.Errorf("compress %s: %w", path, err)
+	}
+	err = enc.Close()
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("compress %s: %w", path, err)
+	}
+
+	zfi, err := os.Stat(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	if zfi.Size() >= before {
+		return before, before, nil
+	}
+	if err := os.Rename(tmp, path+CompressedSuffix); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Remove(path); err != nil {
+		return 0, 0, err
+	}
+	return before, zfi.Size(), nil
+}
+
+// openCompressed opens output compressed by CompressOutput, decompressing.
+func openCompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path + CompressedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(compressWindow))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &compressedReader{Decoder: dec, f: f}, nil
+}
+
+type compressedReader struct {
+	*zstd.Decoder
+	f *os.File
+}
+
+func (r *compressedReader) Close() error {
+	r.Decoder.Close()
+	return r.f.Close()
+}
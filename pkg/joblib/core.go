@@ -0,0 +1,229 @@
+package joblib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	coreFilename = "core"
+
+	// coredumpctlTimeout bounds how long Wait waits for systemd-coredump to
+	// store a core before giving up on it.
+	coredumpctlTimeout = 30 * time.Second
+)
+
+// setCoreLimit raises RLIMIT_CORE of the job's main process, which its
+// children inherit, so a crash leaves a core.
+func (b *execBackend) setCoreLimit(pid int) {
+	lim := &unix.Rlimit{Cur: uint64(b.coreLimit), Max: uint64(b.coreLimit)}
+	if err := unix.Prlimit(pid, unix.RLIMIT_CORE, lim, nil); err != nil {
+		b.log.Printf("job %s: set RLIMIT_CORE: %v; a crash will not leave a core", b.id, err)
+	}
+}
+
+// captureCore moves the core the job's main process dumped into the job
+// dir and returns its path there. Where the kernel put it depends on
+// kernel.core_pattern: a file pattern is resolved the way the kernel did,
+// in the job's root and working directory; cores piped to systemd-coredump
+// are fetched back with coredumpctl. Other pipe handlers keep the core to
+// themselves. The job's owner can download the core, and the working
+// directory is theirs to pick, so a file is only taken if its name has the
+// job's pid and the job's uid owns it.
+func (b *execBackend) captureCore(pid int) (string, error) {
+	pattern, err := readTrimmed("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(b.jobsDir, coreFilename)
+
+	if handler, ok := strings.CutPrefix(pattern, "|"); ok {
+		if !strings.Contains(handler, "systemd-coredump") {
+			return "", fmt.Errorf("kernel.core_pattern pipes cores to %s", strings.Fields(handler)[0])
+		}
+		if err := b.coredumpctlDump(pid, dst); err != nil {
+			return "", err
+		}
+		return dst, nil
+	}
+
+	// Without the pid in its name, any process's core would match.
+	usesPID, _ := readTrimmed("/proc/sys/kernel/core_uses_pid")
+	if !strings.Contains(pattern, "%p") && !strings.Contains(pattern, "%P") && usesPID != "1" {
+		return "", fmt.Errorf("kernel.core_pattern %q has no %%p and core_uses_pid is off, so the job's core can't be told from others'", pattern)
+	}
+	glob := corePatternGlob(pattern, pid, usesPID == "1")
+	root := b.isolation.Chroot
+	if root == "" {
+		root = "/"
+	}
+	if !filepath.IsAbs(glob) {
+		// Without Dir the job ran in the server's working directory, even
+		// when chrooted.
+		dir := filepath.Join(root, b.cmd.Dir)
+		if b.cmd.Dir == "" {
+			if dir, err = os.Getwd(); err != nil {
+				return "", err
+			}
+		}
+		glob = filepath.Join(dir, glob)
+	} else {
+		glob = filepath.Join(root, glob)
+	}
+
+	uid := int(b.isolation.Credential.Uid)
+	src, err := newestSince(glob, b.startedAt, uid)
+	if err != nil {
+		return "", err
+	}
+	if err := takeCore(root, src, dst, uid); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// corePatternGlob turns a kernel.core_pattern into a glob for the file it
+// names for pid. Specifiers other than the pid match anything.
+func corePatternGlob(pattern string, pid int, usesPID bool) string {
+	var g strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i+1 == len(pattern) {
+			if strings.IndexByte(`*?[\`, c) >= 0 {
+				g.WriteByte('\\')
+			}
+			g.WriteByte(c)
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case '%':
+			g.WriteByte('%')
+		case 'p', 'P':
+			g.WriteString(strconv.Itoa(pid))
+		default:
+			g.WriteByte('*')
+		}
+	}
+	// The kernel appends .pid itself when asked to and the pattern has none.
+	if usesPID && !strings.Contains(pattern, "%p") {
+		g.WriteString("." + strconv.Itoa(pid))
+	}
+	return g.String()
+}
+
+// newestSince returns the newest regular file matching glob that uid owns
+// and that was written at or after since.
+func newestSince(glob string, since time.Time, uid int) (string, error) {
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return "", err
+	}
+	var newest string
+	var newestAt time.Time
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err != nil || !fi.Mode().IsRegular() || fi.ModTime().Before(since) || !ownedBy(fi, uid) {
+			continue
+		}
+		if newest == "" || fi.ModTime().After(newestAt) {
+			newest, newestAt = m, fi.ModTime()
+		}
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no core file matching %s owned by uid %d", glob, uid)
+	}
+	return newest, nil
+}
+
+func ownedBy(fi os.FileInfo, uid int) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == uid
+}
+
+// takeCore copies the core at src, under root, to dst and removes it. It
+// is opened without following symlinks, from root down, and checked again
+// once open, so a file swapped in after newestSince picked it isn't taken.
+func takeCore(root, src, dst string, uid int) error {
+	rel, err := filepath.Rel(root, src)
+	if err != nil {
+		return err
+	}
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", root, err)
+	}
+	defer unix.Close(rootFd)
+	fd, err := unix.Openat2(rootFd, rel, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return fmt.Errorf("open core %s: %w", src, err)
+	}
+	in := os.NewFile(uintptr(fd), src)
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || !ownedBy(fi, uid) {
+		return fmt.Errorf("core %s changed before it could be taken", src)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// coredumpctlDump fetches pid's core from the journal. systemd-coredump
+// stores it asynchronously, so a missing entry is retried for a while.
+func (b *execBackend) coredumpctlDump(pid int, dst string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), coredumpctlTimeout)
+	defer cancel()
+	since := "@" + strconv.FormatInt(b.startedAt.Unix(), 10)
+	for {
+		out, err := exec.CommandContext(ctx, "coredumpctl", "dump", "--since="+since, "--output="+dst, strconv.Itoa(pid)).CombinedOutput()
+		if err == nil {
+			return os.Chmod(dst, 0600)
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("cores go to systemd-coredump but coredumpctl is not installed")
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("coredumpctl dump %d: %v: %s", pid, err, strings.TrimSpace(string(out)))
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func readTrimmed(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,87 @@
+package joblib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCorePatternGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		usesPID bool
+		want    string
+	}{
+		{"core", false, "core"},
+		{"core", true, "core.42"},
+		{"core.%p", true, "core.42"},
+		{"/var/crash/%e.%P.%t", false, "/var/crash/*.42.*"},
+		{"core[%%]*", false, `core\[%]\*`},
+	} {
+		if got := corePatternGlob(tc.pattern, 42, tc.usesPID); got != tc.want {
+			t.Errorf("corePatternGlob(%q, usesPID=%v) = %q, want %q", tc.pattern, tc.usesPID, got, tc.want)
+		}
+	}
+}
+
+// writeCore writes a core file owned by uid.
+func writeCore(t *testing.T, path string, uid int) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("core of "+filepath.Base(path)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(path, uid, uid); err != nil {
+		t.Skipf("chown: %v", err)
+	}
+}
+
+// TestNewestSinceOwner checks that only the job's uid's cores are taken.
+func TestNewestSinceOwner(t *testing.T) {
+	dir := t.TempDir()
+	since := time.Now().Add(-time.Second)
+	writeCore(t, filepath.Join(dir, "core.1"), 1001)
+	writeCore(t, filepath.Join(dir, "core.2"), 0) // newer, someone else's
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "core.2"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := newestSince(filepath.Join(dir, "core.*"), since, 1001)
+	if err != nil || got != filepath.Join(dir, "core.1") {
+		t.Errorf("newestSince = %q, %v; want core.1", got, err)
+	}
+	if got, err := newestSince(filepath.Join(dir, "core.*"), since, 1002); err == nil {
+		t.Errorf("newestSince for a uid with no core = %q", got)
+	}
+}
+
+func TestTakeCore(t *testing.T) {
+	root := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "core")
+	src := filepath.Join(root, "core.1")
+	writeCore(t, src, 1001)
+
+	if err := takeCore(root, src, dst, 1002); err == nil {
+		t.Error("took another uid's core")
+	}
+	if err := takeCore(root, src, dst, 1001); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(dst); err != nil || string(b) != "core of core.1" {
+		t.Errorf("dst = %q, %v", b, err)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("src left behind: %v", err)
+	}
+
+	// A symlink swapped in for the core isn't followed.
+	secret := filepath.Join(t.TempDir(), "secret")
+	writeCore(t, secret, 1001)
+	if err := os.Symlink(secret, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := takeCore(root, src, dst, 1001); err == nil {
+		t.Error("followed a symlink")
+	}
+}
@@ -0,0 +1,71 @@
+package joblib
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	defaultLang = "C.UTF-8"
+)
+
+// jobEnv is the job's whole environment: env on top of a minimal default
+// PATH, HOME, USER and LANG. Nothing is inherited from the server, whose
+// environment may hold credentials. Defaults env already sets are left
+// out.
+func (b *execBackend) jobEnv(env []string) []string {
+	set := make(map[string]bool, len(env))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		set[k] = true
+	}
+
+	// Chrooted jobs can't see the workspace, and their users come from the
+	// image's /etc/passwd.
+	root, home := b.isolation.Chroot, "/"
+	if root == "" {
+		root, home = "/", b.workspace()
+	}
+	uid := b.isolation.Credential.Uid
+	defaults := [][2]string{
+		{"PATH", defaultPath},
+		{"HOME", home},
+		{"USER", lookupUser(root, uid)},
+		{"LANG", defaultLang},
+	}
+
+	var injected []string
+	for _, d := range defaults {
+		if !set[d[0]] {
+			injected = append(injected, d[0]+"="+d[1])
+		}
+	}
+	if len(injected) > 0 {
+		b.log.Printf("job %s: default env: %s", b.id, strings.Join(injected, " "))
+	}
+	return append(injected, env...)
+}
+
+// lookupUser returns the name of uid in root's /etc/passwd, or the uid
+// itself when it has none.
+func lookupUser(root string, uid uint32) string {
+	want := strconv.FormatUint(uint64(uid), 10)
+	f, err := os.Open(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return want
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(sc.Text(), ":")
+		if len(fields) > 2 && fields[2] == want && fields[0] != "" {
+			return fields[0]
+		}
+	}
+	return want
+}
@@ -0,0 +1,667 @@
+package joblib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	cgv2 "github.com/bucknercd/jobworker/internal/cgroups"
+	"github.com/bucknercd/jobworker/internal/logcrypt"
+	"github.com/bucknercd/jobworker/pkg/cgroups"
+)
+
+// leftoverPollInterval is how often LeftoverWait checks whether the
+// cgroup has emptied.
+const leftoverPollInterval = 200 * time.Millisecond
+
+// execBackend runs the job as a local child process in its own cgroup v2
+// with dropped privileges, its own process group, and disk-backed output.
+// It is the default backend.
+type execBackend struct {
+	id        string
+	cmd       *exec.Cmd
+	limits    []string
+	log       *log.Logger
+	isolation Isolation
+
+	leftovers  LeftoverPolicy
+	cgroups    cgroups.Driver
+	cgManager  cgroups.Manager // set by Start
+	cgroupByFD bool            // set by Start: processes join the cgroup via CgroupFD
+	cgroupKey  string          // what cgroups is asked for: <Partition>/<ID>
+	cgroupPath string
+	pid        atomic.Int64                 // set once started; read by Describe
+	timings    atomic.Pointer[StartTimings] // set once Start returns
+	jobsDir    string
+	stdoutPath string
+	stderrPath string
+	stdoutFile *os.File
+	stderrFile *os.File
+	outputMu   sync.Mutex // serializes CompressOutput and Remove
+	removed    bool
+	outputKey  []byte         // non-nil => stdout/stderr are encrypted at rest
+	limiter    *outputLimiter // non-nil => output is capped
+	rlimits    []Rlimit
+	coreLimit  int64     // >0 => RLIMIT_CORE, and crashes' cores are kept
+	startedAt  time.Time // set by Start; older core files aren't the job's
+	umask      *uint32   // nil => the server's
+	title      string    // argv[0] prefix
+	initStatus *os.File  // non-nil => the job runs under an init, which reports here
+	tty        *TTYSize  // non-nil => the job runs on a terminal...
+	pty        *pty      // ...set up by prepareJobFilesystem
+
+	resultPath      string        // non-empty => the job has a ResultFD...
+	resultW         *os.File      // ...whose write end this is, until Start passes it on
+	resultDone      chan struct{} // closed once the result data is all copied
+	resultTruncated atomic.Bool
+}
+
+// NewExecBackend is the BackendFactory for local processes. Options are
+// expected to have had defaults applied by New.
+func NewExecBackend(opts Options) (Backend, error) {
+	b := &execBackend{
+		id:        opts.ID,
+		log:       opts.Logger,
+		cmd:       exec.Command(opts.Command, opts.Args...),
+		limits:    opts.Limits,
+		isolation: opts.Isolation,
+		outputKey: opts.OutputKey,
+		leftovers: opts.Leftovers,
+		cgroups:   opts.Cgroups,
+		cgroupKey: path.Join(opts.Partition, opts.ID),
+		jobsDir:   filepath.Join(opts.JobsDir, opts.Partition, opts.ID),
+		rlimits:   opts.Rlimits,
+		coreLimit: opts.CoreLimit,
+		title:     opts.ProcessTitle,
+		tty:       opts.TTY,
+	}
+	if opts.SetUmask {
+		b.umask = &opts.Umask
+	}
+	if opts.OutputLimit.MaxBytes > 0 {
+		b.limiter = &outputLimiter{limit: opts.OutputLimit, kill: b.killForOutput}
+	}
+	b.cmd.Env = b.jobEnv(opts.Env)
+	b.setTitle(b.cmd)
+	b.cmd.Dir = opts.Dir
+	b.cgroupPath = opts.Cgroups(b.cgroupKey).Path()
+
+	b.stdoutPath = filepath.Join(b.jobsDir, stdoutFilename)
+	b.stderrPath = filepath.Join(b.jobsDir, stderrFilename)
+	if opts.ResultFD {
+		b.resultPath = filepath.Join(b.jobsDir, resultFilename)
+	}
+	return b, nil
+}
+
+// Start creates the cgroup and starts the process inside it.
+func (b *execBackend) Start() error {
+	var timings StartTimings
+	defer func() { b.timings.Store(&timings) }()
+	step := time.Now()
+	lap := func(d *time.Duration) {
+		now := time.Now()
+		*d, step = now.Sub(step), now
+	}
+
+	b.cgManager = b.cgroups(b.cgroupKey)
+
+	cgroupFD, err := b.cgManager.Create(b.id, b.limits)
+	if err != nil {
+		b.cleanup()
+		return &setupError{"failed to create cgroup", err}
+	}
+	if cgroupFD >= 0 {
+		defer syscall.Close(cgroupFD)
+	}
+	b.cgroupByFD = cgroupFD >= 0
+
+	if b.isolation.RestrictGPUs {
+		if cgroupFD < 0 {
+			b.cleanup()
+			return &setupError{"failed to restrict GPU devices", errors.New("the cgroup driver gives no cgroup FD to attach a device filter to")}
+		}
+		if err := cgv2.RestrictGPUs(cgroupFD, b.isolation.GPUMinors); err != nil {
+			b.cleanup()
+			return &setupError{"failed to restrict GPU devices", err}
+		}
+	}
+
+	lap(&timings.Cgroup)
+
+	if err := b.prepareJobFilesystem(); err != nil {
+		b.cleanup()
+		return fmt.Errorf("failed to prepare filesystem: %w", err)
+	}
+	lap(&timings.Filesystem)
+
+	b.cmd.SysProcAttr = &syscall.SysProcAttr{
+		UseCgroupFD: cgroupFD >= 0, // no FD with fake cgroups (tests)
+		CgroupFD:    cgroupFD,      // directory FD for cgroup
+		Chroot:      b.isolation.Chroot,
+
+		// Drop privileges (nobody:nogroup unless configured otherwise)
+		Credential: b.isolation.Credential,
+		Pdeathsig:  syscall.SIGKILL, // kill child if parent dies
+		Setpgid:    true,            // set process group ID to its own PID
+	}
+	if b.pty != nil {
+		// A session of its own, which is a process group of its own too,
+		// with the terminal (its stdin) as the controlling one.
+		b.cmd.SysProcAttr.Setpgid = false
+		b.cmd.SysProcAttr.Setsid = true
+		b.cmd.SysProcAttr.Setctty = true
+		b.cmd.SysProcAttr.Ctty = 0
+	}
+	var initStart *os.File // the job's init starts it on a byte from here
+	if b.usesShim() {
+		asInit := b.isolation.PIDNamespace
+		b.wrapShim(b.cmd, asInit)
+		if asInit {
+			if initStart, err = b.initPipes(); err != nil {
+				b.cleanup()
+				return &setupError{"failed to create the init's pipes", err}
+			}
+		}
+	}
+	if b.resultW != nil {
+		// ResultFD when it's the first; an init passes it on as that.
+		b.cmd.ExtraFiles = append(b.cmd.ExtraFiles, b.resultW)
+	}
+
+	b.startedAt = time.Now().Truncate(time.Second)
+	err = b.cmd.Start()
+	for _, f := range b.cmd.ExtraFiles {
+		f.Close() // the child's ends
+	}
+	if b.pty != nil {
+		b.cmd.Stdin.(*os.File).Close() // the job's side of the terminal
+		if err == nil {
+			go b.pty.copy()
+		}
+	}
+	if err != nil {
+		if initStart != nil {
+			initStart.Close()
+		}
+		b.cleanup()
+		return fmt.Errorf("failed to start target: %w", err)
+	}
+	if initStart != nil {
+		defer initStart.Close() // before the byte, on failure: the init gives up
+	}
+
+	pid := -1
+	if b.cmd.Process != nil {
+		pid = b.cmd.Process.Pid
+		b.pid.Store(int64(pid))
+	}
+
+	if a, ok := b.cgManager.(cgroups.Attacher); ok && cgroupFD < 0 {
+		if err := a.Attach(pid); err != nil {
+			b.killUnattached()
+			return &setupError{"failed to place job in its cgroup", err}
+		}
+	}
+	if err := b.setRlimits(pid); err != nil {
+		b.killUnattached()
+		return &setupError{"failed to set the job's rlimits", err}
+	}
+	if b.coreLimit > 0 {
+		b.setCoreLimit(pid)
+	}
+	if initStart != nil {
+		if _, err := initStart.Write([]byte{1}); err != nil {
+			b.killUnattached()
+			return &setupError{"failed to start the job under its init", err}
+		}
+	}
+	lap(&timings.Exec)
+
+	if snap, err := b.cgManager.Snapshot(); err != nil {
+		b.log.Printf("[cgroup] job=%s snapshot failed: %v", b.id, err)
+	} else {
+		b.log.Printf(
+			"[cgroup] job=%s pid=%d path=%s pids.current=%d procs=%v cpu.max=%q mem.max=%q io.max=%q mem.current=%dB cpu.usage_usec=%d throttled=%d throttled_usec=%d",
+			b.id,
+			pid,
+			snap.Path,
+			snap.PidsCurrent,
+			firstNInts(snap.Procs, 4),
+			snap.CPUMax,
+			snap.MemoryMax,
+			snap.IOMax,
+			snap.MemoryCurrent,
+			snap.CPUStat["usage_usec"],
+			snap.CPUStat["nr_throttled"],
+			snap.CPUStat["throttled_usec"],
+		)
+	}
+
+	b.log.Printf("job %s: started: %s", b.id, b.cmd.String())
+	return nil
+}
+
+// ExitFD is a pidfd for the main process, readable once it has exited.
+func (b *execBackend) ExitFD() (int, error) {
+	pid := int(b.pid.Load())
+	if pid <= 0 {
+		return -1, errors.New("no process")
+	}
+	return unix.PidfdOpen(pid, 0)
+}
+
+func (b *execBackend) Wait() (Exit, error) {
+	waitErr := b.cmd.Wait()
+	defer b.waitResult() // after cleanup has killed any leftovers holding it
+	defer b.cleanup()
+
+	exit, err := b.exitStatus(waitErr)
+	exit.Leftovers, exit.LeftoversWaited = b.handleLeftovers()
+	if b.pty != nil {
+		b.pty.drain()
+	}
+	if b.initStatus != nil {
+		// The init exits like the job as far as it can; its report is
+		// exact, and it alone saw the leftovers, which died with it.
+		rep := readInitReport(b.initStatus)
+		if rep.exited {
+			exit, err = b.exitOf(rep.status), nil
+			exit.Leftovers, exit.LeftoversWaited = rep.leftovers, rep.waited
+		}
+	}
+	exit.OutputLimitKilled = exit.Signaled && b.limiter != nil && b.limiter.limit.Kill && b.OutputTruncated()
+	if exit.CoreDumped && b.coreLimit > 0 {
+		if path, cerr := b.captureCore(int(b.pid.Load())); cerr != nil {
+			b.log.Printf("job %s: dumped core but it could not be kept: %v", b.id, cerr)
+		} else {
+			b.log.Printf("job %s: core kept at %s", b.id, path)
+			exit.Core = path
+		}
+	}
+	if stats, serr := b.Stats(); serr == nil {
+		exit.Usage = &stats
+	}
+	return exit, err
+}
+
+func (b *execBackend) exitStatus(waitErr error) (Exit, error) {
+	if waitErr == nil {
+		if b.cmd.ProcessState == nil {
+			return Exit{}, errors.New("exited cleanly but ProcessState was nil")
+		}
+		return Exit{Code: b.cmd.ProcessState.ExitCode()}, nil
+	}
+
+	exitErr, ok := waitErr.(*exec.ExitError)
+	if !ok || exitErr.ProcessState == nil {
+		return Exit{}, waitErr
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return b.exitOf(ws), nil
+	}
+	return Exit{Code: exitErr.ProcessState.ExitCode()}, nil
+}
+
+// exitOf turns the main process's wait status into an Exit.
+func (b *execBackend) exitOf(ws syscall.WaitStatus) Exit {
+	if ws.Signaled() {
+		b.log.Printf("job %s was terminated by signal: %s", b.id, ws.Signal())
+		return Exit{Signaled: true, Signal: ws.Signal(), OOMKilled: b.oomKilled(), CoreDumped: ws.CoreDump()}
+	}
+	return Exit{Code: ws.ExitStatus()}
+}
+
+// handleLeftovers deals with processes still in the cgroup once the main
+// process has been reaped. With LeftoverWait it blocks until they're gone
+// (Stop ends that early by emptying the cgroup); otherwise cleanup kills
+// them. It reports how many there were.
+func (b *execBackend) handleLeftovers() (n int, waited bool) {
+	if b.cgManager == nil {
+		return 0, false
+	}
+	procs, err := b.cgManager.Procs()
+	if err != nil || len(procs) == 0 {
+		return 0, false
+	}
+	if b.leftovers != LeftoverWait {
+		return len(procs), false
+	}
+	b.log.Printf("job %s: main process exited; waiting for %d leftover process(es) %v", b.id, len(procs), firstNInts(procs, 4))
+	for {
+		time.Sleep(leftoverPollInterval)
+		if rest, err := b.cgManager.Procs(); err != nil || len(rest) == 0 {
+			return len(procs), true
+		}
+	}
+}
+
+func (b *execBackend) Stop() error {
+	var errs []error
+
+	// Attempt to kill the process or its process group
+	if b.cmd != nil && b.cmd.Process != nil {
+		pgid, errPgid := syscall.Getpgid(b.cmd.Process.Pid)
+		if errPgid == nil {
+			// ESRCH: the group exited between the lookup and the kill.
+			if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+				b.log.Printf("failed to kill process group for job %s: %v", b.id, err)
+				errs = append(errs, fmt.Errorf("kill pgid: %w", err))
+			}
+		} else {
+			// Already reaped by a concurrent Wait: nothing left to kill.
+			if err := b.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				b.log.Printf("failed to kill process for job %s: %v", b.id, err)
+				errs = append(errs, fmt.Errorf("kill process: %w", err))
+			}
+		}
+	}
+
+	// Attempt to clean up cgroup
+	if b.cgManager != nil {
+		if err := b.cgManager.Delete(b.id); err != nil {
+			b.log.Printf("failed to cleanup cgroup for job %s: %v", b.id, err)
+			errs = append(errs, fmt.Errorf("cleanup cgroup: %w", err))
+		} else {
+			b.log.Printf("Deleted cgroup for job %s", b.id)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *execBackend) Signal(sig syscall.Signal) error {
+	if b.cmd == nil || b.cmd.Process == nil {
+		return errors.New("process not started")
+	}
+	pgid, err := syscall.Getpgid(b.cmd.Process.Pid)
+	if err != nil {
+		return b.cmd.Process.Signal(sig)
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+func (b *execBackend) Stats() (Stats, error) {
+	if b.cgManager == nil {
+		return Stats{}, errors.New("job not started")
+	}
+	snap, err := b.cgManager.Snapshot()
+	if err != nil {
+		return Stats{}, err
+	}
+	memMax, _ := strconv.ParseUint(snap.MemoryMax, 10, 64) // "max" -> 0
+	return Stats{
+		PIDs:             snap.PidsCurrent,
+		PIDsMaxHits:      snap.PidsEvents["max"],
+		MemoryCurrent:    snap.MemoryCurrent,
+		MemoryMax:        memMax,
+		CPUUsageUsec:     snap.CPUStat["usage_usec"],
+		CPUThrottledUsec: snap.CPUStat["throttled_usec"],
+		IOReadBytes:      snap.IOReadBytes,
+		IOWriteBytes:     snap.IOWriteBytes,
+	}, nil
+}
+
+// OutputReader opens persisted output; encrypted and compressed output is
+// decrypted or decompressed transparently.
+func (b *execBackend) OutputReader(stderr bool) (io.ReadCloser, error) {
+	path := b.stdoutPath
+	if stderr {
+		path = b.stderrPath
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if rc, zerr := openCompressed(path); zerr == nil {
+			return rc, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.outputKey == nil {
+		return f, nil
+	}
+
+	r, err := logcrypt.NewReader(f, b.outputKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &outputReader{Reader: r, f: f}, nil
+}
+
+// OutputPath implements LocalOutput. With encryption on, the file holds
+// ciphertext; it still grows as output is written.
+func (b *execBackend) OutputPath(stderr bool) string {
+	if stderr {
+		return b.stderrPath
+	}
+	return b.stdoutPath
+}
+
+// OutputTruncated implements OutputTruncater.
+func (b *execBackend) OutputTruncated() bool {
+	return b.limiter != nil && b.limiter.truncated.Load()
+}
+
+// killForOutput kills the job once it has reached its output limit.
+func (b *execBackend) killForOutput() {
+	b.log.Printf("job %s: output limit of %d bytes reached; killing it", b.id, b.limiter.limit.MaxBytes)
+	if err := b.Signal(syscall.SIGKILL); err != nil {
+		b.log.Printf("job %s: kill after output limit: %v", b.id, err)
+	}
+}
+
+// Processes implements ProcessLister: the processes in the job's cgroup, or
+// in its process group when the cgroup driver can't tell (fake or no-op
+// cgroups).
+func (b *execBackend) Processes() ([]Process, error) {
+	pid := int(b.pid.Load())
+	if pid == 0 || b.cgManager == nil {
+		return nil, errors.New("job not started")
+	}
+	pids, err := b.cgManager.Procs()
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		if pids, err = processGroup(pid); err != nil {
+			return nil, err
+		}
+	}
+	return readProcesses(pids)
+}
+
+// Describe implements Describer.
+// Resize implements Resizer.
+func (b *execBackend) Resize(size TTYSize) error {
+	if b.pty == nil {
+		return ErrNoTTY
+	}
+	return b.pty.resize(size)
+}
+
+func (b *execBackend) Describe() Description {
+	return Description{PID: int(b.pid.Load()), CgroupPath: b.cgroupPath}
+}
+
+// StartTimings implements StartTimer.
+func (b *execBackend) StartTimings() StartTimings {
+	if t := b.timings.Load(); t != nil {
+		return *t
+	}
+	return StartTimings{}
+}
+
+// Remove implements Remover: it deletes the job's output directory.
+func (b *execBackend) Remove() error {
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+	b.removed = true
+	b.releasePrivateTmp() // in case the server died with it mounted
+	return os.RemoveAll(b.jobsDir)
+}
+
+// killUnattached kills and reaps a process that couldn't be confined as
+// asked (placed in its cgroup, given its rlimits), then cleans up.
+func (b *execBackend) killUnattached() {
+	if pgid, err := syscall.Getpgid(b.cmd.Process.Pid); err == nil {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	} else {
+		_ = b.cmd.Process.Kill()
+	}
+	_ = b.cmd.Wait()
+	b.cleanup()
+}
+
+// oomKilled reports whether the OOM killer fired in the job's cgroup. It
+// must run before cleanup removes the cgroup.
+func (b *execBackend) oomKilled() bool {
+	if b.cgManager == nil {
+		return false
+	}
+	snap, err := b.cgManager.Snapshot()
+	return err == nil && snap.MemoryEvents["oom_kill"] > 0
+}
+
+// cleanup closes output files and removes the cgroup (best effort).
+func (b *execBackend) cleanup() {
+	if err := b.closeLogFiles(); err != nil {
+		b.log.Printf("job %s: error closing log files: %v", b.id, err)
+	}
+	if b.cgManager != nil {
+		if err := b.cgManager.Delete(b.id); err != nil {
+			b.log.Printf("job %s: failed to cleanup cgroup: %v", b.id, err)
+		}
+	}
+	b.releasePrivateTmp()
+	if b.resultW != nil {
+		b.resultW.Close() // already, unless Start failed before passing it on
+	}
+	if b.initStatus != nil {
+		b.initStatus.Close()
+	}
+	if b.pty != nil {
+		b.pty.close()
+	}
+}
+
+func (b *execBackend) prepareJobFilesystem() error {
+	if err := os.MkdirAll(b.jobsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create job dir %s: %w", b.jobsDir, err)
+	}
+	if b.isolation.Chroot == "" {
+		if err := b.prepareWorkspace(); err != nil {
+			return err
+		}
+	}
+	if b.usesShim() {
+		if err := b.prepareShim(); err != nil {
+			return err
+		}
+	}
+
+	stdoutFile, err := os.OpenFile(b.stdoutPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open stdout file: %w", err)
+	}
+	b.stdoutFile = stdoutFile
+
+	stderrFile, err := os.OpenFile(b.stderrPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open stderr file: %w", err)
+	}
+	b.stderrFile = stderrFile
+
+	if b.resultPath != "" {
+		if err := b.prepareResultFD(); err != nil {
+			return err
+		}
+	}
+
+	b.cmd.Stdout = b.stdoutFile
+	b.cmd.Stderr = b.stderrFile
+	b.cmd.Stdin = nil
+
+	// With encryption on, the child writes to a pipe and exec copies through
+	// the encrypting writer; cmd.Wait() waits for that copy to finish.
+	if b.outputKey != nil {
+		stdoutW, err := logcrypt.NewWriter(b.stdoutFile, b.outputKey)
+		if err != nil {
+			return fmt.Errorf("failed to set up stdout encryption: %w", err)
+		}
+		stderrW, err := logcrypt.NewWriter(b.stderrFile, b.outputKey)
+		if err != nil {
+			return fmt.Errorf("failed to set up stderr encryption: %w", err)
+		}
+		b.cmd.Stdout = stdoutW
+		b.cmd.Stderr = stderrW
+	}
+
+	// Likewise with an output limit, which counts plaintext bytes.
+	if b.limiter != nil {
+		b.cmd.Stdout = b.limiter.writer(b.cmd.Stdout)
+		b.cmd.Stderr = b.limiter.writer(b.cmd.Stderr)
+	}
+
+	// On a terminal, the job's stdin, stdout and stderr are all its side
+	// of it, and Start copies the other side to where stdout would go.
+	if b.tty != nil {
+		p, tty, err := openPTY(*b.tty, b.cmd.Stdout, b.isolation.Credential)
+		if err != nil {
+			return fmt.Errorf("failed to open a terminal: %w", err)
+		}
+		b.pty = p
+		b.cmd.Stdin, b.cmd.Stdout, b.cmd.Stderr = tty, tty, tty
+	}
+
+	return nil
+}
+
+func (b *execBackend) closeLogFiles() error {
+	var errs []error
+
+	if b.stdoutFile != nil {
+		if err := b.stdoutFile.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			b.log.Printf("job %s: error closing stdout file: %v", b.id, err)
+			errs = append(errs, fmt.Errorf("closing stdout: %w", err))
+		}
+	}
+
+	if b.stderrFile != nil {
+		if err := b.stderrFile.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			b.log.Printf("job %s: error closing stderr file: %v", b.id, err)
+			errs = append(errs, fmt.Errorf("closing stderr: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// outputReader pairs a decrypting reader with the file it reads from.
+type outputReader struct {
+	*logcrypt.Reader
+	f *os.File
+}
+
+func (r *outputReader) Close() error { return r.f.Close() }
+
+func firstNInts(xs []int, n int) []int {
+	if len(xs) <= n {
+		return xs
+	}
+	return xs[:n]
+}
@@ -0,0 +1,223 @@
+package joblib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bucknercd/jobworker/pkg/cgroups"
+)
+
+// execWaitDelay is how long ExecIn waits for output after the command
+// exits, in case something it started still holds stdout or stderr.
+const execWaitDelay = time.Second
+
+// execPath is where bare command names are looked up inside the job's root.
+var execPath = []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin"}
+
+// ExecSpec is a command to run beside a job's processes.
+type ExecSpec struct {
+	Command string   // absolute, or a bare name looked up in the job's /usr/bin, /bin, ...
+	Args    []string // not including the command
+	Env     []string // KEY=VALUE on top of a minimal PATH; the job's own env is not inherited
+
+	Stdin          io.Reader // nil means none
+	Stdout, Stderr io.Writer
+}
+
+// Execer is implemented by backends that can run extra commands with a
+// running job's confinement, for debugging it in place.
+type Execer interface {
+	// ExecIn runs spec to completion; cancelling ctx kills it.
+	ExecIn(ctx context.Context, spec ExecSpec) (Exit, error)
+}
+
+// ExecIn implements Execer: the command joins the job's cgroup and its
+// mount and PID namespaces, is chrooted where the job is, and runs as the
+// job's user in its working directory, in its own process group, with the
+// job's umask and process title.
+func (b *execBackend) ExecIn(ctx context.Context, spec ExecSpec) (Exit, error) {
+	if b.pid.Load() == 0 || b.cgManager == nil {
+		return Exit{}, errors.New("job not started")
+	}
+	path, err := b.lookInRoot(spec.Command)
+	if err != nil {
+		return Exit{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, path, spec.Args...)
+	cmd.Env = append([]string{"PATH=" + strings.Join(execPath, ":")}, spec.Env...)
+	b.setTitle(cmd)
+	cmd.Dir = b.cmd.Dir
+	cmd.Stdout, cmd.Stderr = spec.Stdout, spec.Stderr
+	if b.isolation.ReadOnlyHost && !b.isolation.PrivateTmp {
+		cmd.Env = append(cmd.Env, "TMPDIR="+b.workspace())
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Chroot:     b.isolation.Chroot,
+		Credential: b.isolation.Credential,
+		Pdeathsig:  syscall.SIGKILL,
+		Setpgid:    true,
+	}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = execWaitDelay
+
+	// Join the cgroup from birth, as the job did. Systemd scopes are joined
+	// by pid after Start instead; fake cgroups can't be joined.
+	if b.cgroupByFD {
+		fd, err := syscall.Open(b.cgManager.Path(), syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return Exit{}, &setupError{"failed to open the job's cgroup", err}
+		}
+		defer syscall.Close(fd)
+		cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, fd
+	}
+
+	// Copied here rather than by exec, so Wait doesn't wait on a client
+	// that never closes stdin.
+	var stdin io.WriteCloser
+	if spec.Stdin != nil {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return Exit{}, err
+		}
+	}
+	// enterJob taints the thread it runs on, so the command is started, and
+	// waited for, by a goroutine of its own that the thread exits with.
+	started, exited := make(chan error, 1), make(chan error, 1)
+	go func() {
+		pidNS, err := b.enterJob()
+		if err != nil {
+			started <- &setupError{"failed to enter the job's namespaces", err}
+			return
+		}
+		if pidNS {
+			// Its parent is outside the namespace, so Go would take it
+			// for gone and kill the child. The job's init dies with the
+			// server and takes the namespace with it instead.
+			cmd.SysProcAttr.Pdeathsig = 0
+		}
+		if err := cmd.Start(); err != nil {
+			started <- fmt.Errorf("failed to start %s: %w", spec.Command, err)
+			return
+		}
+		started <- nil
+		exited <- cmd.Wait()
+	}()
+	if err := <-started; err != nil {
+		return Exit{}, err
+	}
+	if a, ok := b.cgManager.(cgroups.Attacher); ok && !b.cgroupByFD {
+		if err := a.Attach(cmd.Process.Pid); err != nil {
+			_ = cmd.Cancel()
+			<-exited
+			return Exit{}, &setupError{"failed to place the command in the job's cgroup", err}
+		}
+	}
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(stdin, spec.Stdin)
+			stdin.Close()
+		}()
+	}
+
+	err = <-exited
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil, errors.As(err, &exitErr), errors.Is(err, exec.ErrWaitDelay):
+		return exitOf(cmd.ProcessState), nil
+	default:
+		return Exit{}, err
+	}
+}
+
+// enterJob moves the calling thread into the job's mount and PID
+// namespaces, those of its first process (the shim's init, when it has
+// one), where they differ from the server's, and gives it the job's umask,
+// so the command it then forks starts in them: the job's mounts are its
+// mounts, and its /proc shows the job's processes. There's no leaving
+// them again, so once it has anything to change it locks the goroutine to
+// the thread for good and the thread exits with it, after the command:
+// Pdeathsig fires when the forking thread does. It reports whether it
+// joined a PID namespace.
+func (b *execBackend) enterJob() (bool, error) {
+	pid := int(b.pid.Load())
+	var flags int
+	for _, ns := range []struct {
+		name string
+		flag int
+	}{{"mnt", unix.CLONE_NEWNS}, {"pid", unix.CLONE_NEWPID}} {
+		theirs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name))
+		if err != nil {
+			return false, err
+		}
+		ours, err := os.Readlink("/proc/thread-self/ns/" + ns.name)
+		if err != nil {
+			return false, err
+		}
+		if theirs != ours {
+			flags |= ns.flag
+		}
+	}
+	if flags == 0 && b.umask == nil {
+		return false, nil
+	}
+
+	runtime.LockOSThread()
+	// The umask, and joining a mount namespace, need the thread's own
+	// root, cwd and umask, not the ones it shares with the server.
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		return false, fmt.Errorf("unshare fs: %w", err)
+	}
+	if b.umask != nil {
+		unix.Umask(int(*b.umask))
+	}
+	if flags == 0 {
+		return false, nil
+	}
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return false, fmt.Errorf("pidfd_open %d: %w", pid, err)
+	}
+	defer unix.Close(pidfd)
+	if err := unix.Setns(pidfd, flags); err != nil {
+		return false, fmt.Errorf("setns: %w", err)
+	}
+	return flags&unix.CLONE_NEWPID != 0, nil
+}
+
+// lookInRoot resolves name the way the job's PATH would, inside its root.
+func (b *execBackend) lookInRoot(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			return "", fmt.Errorf("%s: command must be absolute or a bare name", name)
+		}
+		return name, nil
+	}
+	root := b.isolation.Chroot
+	if root == "" {
+		root = "/"
+	}
+	for _, dir := range execPath {
+		if fi, err := os.Stat(filepath.Join(root, dir, name)); err == nil && !fi.IsDir() {
+			return filepath.Join(dir, name), nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w (looked in the job's %s)", name, exec.ErrNotFound, strings.Join(execPath, ":"))
+}
+
+func exitOf(ps *os.ProcessState) Exit {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return Exit{Signaled: true, Signal: ws.Signal()}
+	}
+	return Exit{Code: ps.ExitCode()}
+}
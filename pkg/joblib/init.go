@@ -0,0 +1,187 @@
+package joblib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A job's init talks to the server over two pipes, passed as these fds.
+// It writes "exit <wait status>" to the first when the job's main process
+// ends, then "leftovers <n> <waited>". The server writes a byte to the
+// second once the init is confined and may start the job. A job's
+// ResultFD comes to the init as the third, and it passes it on.
+const (
+	initStatusFD = 3
+	initStartFD  = 4
+	initResultFD = 5
+)
+
+// forwardedSignals are passed on to the job's process group. SIGKILL and
+// SIGSTOP can't be caught: SIGKILL ends the whole namespace, and SIGSTOP
+// stops only the init.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGCONT, syscall.SIGTSTP,
+	syscall.SIGWINCH, syscall.SIGALRM,
+}
+
+// runInit is the shim as PID 1 of the job's PID namespace. The job would
+// otherwise be init there, which ignores signals it has no handler for
+// and inherits every orphan. Instead this starts the job as its child,
+// forwards signals to it, reaps orphans and reports how the job ended
+// over initStatusFD. With waitLeftovers it stays until every other
+// process has gone; otherwise its exit kills them.
+func runInit(c shimConfig, path string, argv []string) error {
+	syscall.CloseOnExec(initStatusFD)
+	syscall.CloseOnExec(initStartFD)
+	report := os.NewFile(initStatusFD, "status")
+	start := os.NewFile(initStartFD, "start")
+
+	// The server places the init in its cgroup and sets its rlimits after
+	// starting it; the job must inherit them.
+	var ok [1]byte
+	if n, _ := io.ReadFull(start, ok[:]); n == 0 {
+		return errors.New("server exited during setup")
+	}
+	start.Close()
+
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs, append(forwardedSignals, syscall.SIGCHLD)...)
+
+	cmd := exec.Command(path)
+	cmd.Args = argv
+	cmd.Env = os.Environ()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if c.resultFD {
+		syscall.CloseOnExec(initResultFD)
+		cmd.ExtraFiles = []*os.File{os.NewFile(initResultFD, "result")}
+	}
+	// Its own group, so the server's signals to the init's group reach it
+	// once, through us. On a terminal, that group is the foreground one.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		cmd.SysProcAttr.Foreground, cmd.SysProcAttr.Ctty = true, 0
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	for _, f := range cmd.ExtraFiles {
+		f.Close() // the job's now; its data ends when the job's processes do
+	}
+	job := cmd.Process.Pid
+
+	var (
+		jobWS    syscall.WaitStatus
+		jobDone  bool
+		reported bool
+	)
+	for sig := range sigs {
+		if sig != syscall.SIGCHLD {
+			_ = syscall.Kill(-job, sig.(syscall.Signal))
+			continue
+		}
+		for {
+			var ws syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+			if errors.Is(err, syscall.ECHILD) && reported {
+				exitLike(jobWS) // the last leftover is gone
+			}
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid == job {
+				jobWS, jobDone = ws, true
+				fmt.Fprintf(report, "exit %d\n", uint32(ws))
+			}
+		}
+		if jobDone && !reported {
+			n := countProcs() - 1 // not counting us
+			wait := c.waitLeftovers && n > 0
+			fmt.Fprintf(report, "leftovers %d %t\n", n, wait)
+			if !wait {
+				exitLike(jobWS) // the kernel kills the rest
+			}
+			reported = true
+		}
+	}
+	return nil
+}
+
+// exitLike exits the way ws says the job did, as far as an init can: a
+// signal becomes 128+n.
+func exitLike(ws syscall.WaitStatus) {
+	if ws.Signaled() {
+		os.Exit(128 + int(ws.Signal()))
+	}
+	os.Exit(ws.ExitStatus())
+}
+
+// countProcs counts the processes in the namespace, from its own /proc.
+func countProcs() int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// initReport is what a job's init said about it.
+type initReport struct {
+	exited    bool
+	status    syscall.WaitStatus
+	leftovers int
+	waited    bool
+}
+
+// readInitReport reads what the init wrote before exiting.
+func readInitReport(r io.Reader) initReport {
+	var rep initReport
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		switch {
+		case len(f) == 2 && f[0] == "exit":
+			if ws, err := strconv.ParseUint(f[1], 10, 32); err == nil {
+				rep.exited, rep.status = true, syscall.WaitStatus(ws)
+			}
+		case len(f) == 3 && f[0] == "leftovers":
+			rep.leftovers, _ = strconv.Atoi(f[1])
+			rep.waited = f[2] == "true"
+		}
+	}
+	return rep
+}
+
+// initPipes sets up the init's pipes as b.cmd's extra files and returns
+// the server's end of the start pipe.
+func (b *execBackend) initPipes() (*os.File, error) {
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	startR, startW, err := os.Pipe()
+	if err != nil {
+		statusR.Close()
+		statusW.Close()
+		return nil, err
+	}
+	b.cmd.ExtraFiles = []*os.File{statusW, startR} // initStatusFD, initStartFD
+	b.initStatus = statusR
+	return startW, nil
+}
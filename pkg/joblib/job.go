@@ -0,0 +1,621 @@
+// Package joblib runs a single supervised process: its own cgroup v2 with
+// resource limits, dropped privileges, its own process group, and
+// disk-backed stdout/stderr. It has no dependency on the gRPC layer, so other
+// daemons can embed it directly:
+//
+//	job, err := joblib.New(joblib.Options{
+//		ID:      "build-42",
+//		Command: "/usr/bin/make",
+//		Args:    []string{"-j4"},
+//		JobsDir: "/srv/jobs",
+//		Limits:  []string{"cpu.max=200000 100000", "memory.max=1073741824"},
+//		Logger:  logger,
+//	})
+//	if err := job.Start(); err != nil { ... }
+//	<-job.Done()
+//
+// A Job owns the lifecycle; the process itself is run by a Backend. The
+// default is the local exec backend described above; other execution
+// environments implement Backend and are selected with Options.Backend.
+// Likewise the exec backend's cgroup comes from Options.Cgroups.
+package joblib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	cgv2 "github.com/bucknercd/jobworker/internal/cgroups"
+	"github.com/bucknercd/jobworker/pkg/cgroups"
+)
+
+type Status int32
+
+const (
+	StatusUnknown  Status = iota // Initial state, before job is started
+	StatusStarted                // Job has been started
+	StatusRunning                // Job is currently running
+	StatusExited                 // Job has exited cleanly (any exit code)
+	StatusStopped                // Job has been stopped
+	StatusFailed                 // Job has failed (e.g. cgroup setup failure, process start failure, etc.)
+	StatusStopping               // Stop was requested; the process hasn't been reaped yet
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusStarted:
+		return "started"
+	case StatusRunning:
+		return "running"
+	case StatusExited:
+		return "exited"
+	case StatusStopped:
+		return "stopped"
+	case StatusFailed:
+		return "failed"
+	case StatusStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	exitCodeUnknown        = -10 // when the exit code is not known
+	exitCodeFailedToStart  = -11 // when the job fails to start
+	exitCodeFailedCgroup   = -12 // when the cgroup setup fails
+	exitCodeKilledBySignal = -13 // when the job is killed by a signal
+)
+
+const (
+	// DefaultJobsDir is where per-job output directories are created when
+	// Options.JobsDir is empty.
+	DefaultJobsDir = "/var/lib/jobs"
+	// DefaultChrootDir is the jail built by scripts/chroot.sh; pass it as
+	// Isolation.Chroot to opt in.
+	DefaultChrootDir = "/opt/jobroot"
+
+	// NobodyID is the uid and gid jobs run as unless Isolation.Credential
+	// says otherwise.
+	NobodyID = 65534
+
+	stdoutFilename = "stdout.log"
+	stderrFilename = "stderr.log"
+)
+
+// Options configures a Job. Only ID and Command are required.
+type Options struct {
+	ID      string
+	Command string
+	Args    []string
+
+	// JobsDir is the parent of the per-job output directory
+	// (<JobsDir>/<ID>/stdout.log). Defaults to DefaultJobsDir.
+	JobsDir string
+
+	// Partition, when set, puts the job's output directory and its cgroup
+	// one level down, in a directory of that name: <JobsDir>/<Partition>/<ID>
+	// and <Partition>/<ID> under the cgroup job root. The manager uses it
+	// to keep tenants' jobs apart.
+	Partition string
+
+	// Limits are cgroup v2 "file=value" writes, e.g. "memory.max=104857600".
+	Limits []string
+
+	// Env is the job's environment, KEY=VALUE. The server's is not
+	// inherited; the exec backend adds PATH, HOME, USER and LANG defaults
+	// for whichever of them Env leaves unset.
+	Env []string
+
+	// Dir is the working directory, relative to Isolation.Chroot when set.
+	Dir string
+
+	// Umask, when SetUmask is true, is the job's file mode creation mask
+	// instead of the server's. Needs RunShim; ignored with Isolation.Chroot.
+	Umask    uint32
+	SetUmask bool
+
+	// ProcessTitle, if set, is put in front of the job's argv[0], e.g.
+	// "jobworker:<id> sleep 60", so ps on the host shows which job a process
+	// belongs to. Programs that look at argv[0] see it too.
+	ProcessTitle string
+
+	// OutputKey, when set, encrypts stdout/stderr at rest (AES-256-GCM).
+	OutputKey []byte
+
+	Isolation Isolation
+
+	// Logger receives job lifecycle logs. Defaults to discarding them.
+	Logger *log.Logger
+
+	// DebugLogger receives verbose diagnostics. Defaults to Logger.
+	DebugLogger *log.Logger
+
+	// OutputSummaryLines, when positive, logs the first and last that many
+	// lines of stdout and stderr to DebugLogger once the job ends (lines
+	// truncated). Off by default: output can be large or sensitive.
+	OutputSummaryLines int
+
+	// Backend builds the execution backend. Defaults to NewExecBackend
+	// (local process in a cgroup).
+	Backend BackendFactory
+
+	// Cgroups makes each job's cgroup for the exec backend. Defaults to
+	// a cgroup v2 directory per job.
+	Cgroups cgroups.Driver
+
+	// Leftovers says what to do with processes still in the job's cgroup
+	// when the main process exits. Backends without a cgroup ignore it.
+	Leftovers LeftoverPolicy
+
+	// OutputLimit caps the output kept on disk. Backends that can't enforce
+	// it ignore it.
+	OutputLimit OutputLimit
+
+	// Rlimits are set on the job's main process once it has started.
+	// Backends without a local process ignore them.
+	Rlimits []Rlimit
+
+	// TTY, when set, runs the job on a pseudo-terminal of this size: its
+	// stdin, stdout and stderr, and its controlling terminal. What it
+	// writes is captured as stdout; stderr stays empty. Backends that
+	// can't ignore it.
+	TTY *TTYSize
+
+	// CoreLimit, when positive, is the job's RLIMIT_CORE, and the core of a
+	// crash of its main process is kept with its output (see Job.OpenCore);
+	// it overrides an RLIMIT_CORE in Rlimits. Backends that can't keep
+	// cores ignore it.
+	CoreLimit int64
+
+	// Result, if set, says what of stdout is kept as the job's result (see
+	// Job.Result). It is read once the job ends, before it is reported
+	// done.
+	Result *ResultCapture
+
+	// ResultFD gives the job a pipe on ResultFD, whose data is kept apart
+	// from its output (see Job.OpenResultData). Backends that can't ignore
+	// it.
+	ResultFD bool
+
+	// OnTransition, if set, is called after every status change, in order.
+	// It runs synchronously on the goroutine that made the change, so it
+	// must not block for long or call Start or Stop.
+	OnTransition func(Transition)
+}
+
+// LeftoverPolicy is what happens to a job's leftover processes.
+type LeftoverPolicy int
+
+const (
+	// LeftoverKill kills them as soon as the main process exits.
+	LeftoverKill LeftoverPolicy = iota
+	// LeftoverWait keeps the job running until they have exited too.
+	LeftoverWait
+)
+
+// Isolation controls how the job process is confined beyond its cgroup.
+type Isolation struct {
+	// Credential the job runs as. Nil means nobody:nogroup (NobodyID).
+	Credential *syscall.Credential
+	// Chroot, if set, jails the job into this directory.
+	Chroot string
+	// ReadOnlyHost runs the job in its own mount namespace where every
+	// mount is read-only except a per-job workspace, its working directory
+	// and TMPDIR. Needs root and RunShim; ignored with Chroot.
+	ReadOnlyHost bool
+	// PrivateTmp gives the job a tmpfs of its own on /tmp, of at most
+	// PrivateTmpSize bytes if that is positive; either way its pages count
+	// against the job's memory limit. It is discarded when the job ends.
+	// Needs root and RunShim; ignored with Chroot.
+	PrivateTmp     bool
+	PrivateTmpSize int64
+	// PIDNamespace runs the job in its own PID namespace, under a small
+	// init that forwards signals to it, reaps orphans and reports its exit
+	// status. The job sees only its own processes in /proc. Signals other
+	// than SIGKILL and SIGSTOP reach it through the init; SIGKILL ends the
+	// whole namespace. Needs root and RunShim; ignored with Chroot.
+	PIDNamespace bool
+	// RestrictGPUs limits /dev/nvidiaN access to GPUMinors (possibly none)
+	// with a cgroup device filter. Other devices are unaffected.
+	RestrictGPUs bool
+	GPUMinors    []uint32
+}
+
+// Job is a concrete job instance: the lifecycle (status, exit code, Done)
+// around a Backend that actually runs the process. We deliberately do NOT
+// expose channels for output; consumers should stream from OpenOutput.
+type Job struct {
+	id      string
+	log     *log.Logger
+	backend Backend
+
+	debug        *log.Logger
+	summaryLines int
+	capture      *ResultCapture
+
+	state  *stateMachine
+	final  atomic.Pointer[Stats]  // Exit.Usage, once the job has ended
+	core   atomic.Pointer[string] // Exit.Core, once the job has ended
+	result atomic.Pointer[Result] // from capture, once the job has ended
+}
+
+// New creates a new Job from opts. Nothing touches the filesystem or cgroups
+// until Start.
+func New(opts Options) (*Job, error) {
+	if opts.ID == "" {
+		return nil, errors.New("job id required")
+	}
+	if opts.Command == "" {
+		return nil, errors.New("Command required")
+	}
+	if opts.JobsDir == "" {
+		opts.JobsDir = DefaultJobsDir
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	if opts.DebugLogger == nil {
+		opts.DebugLogger = opts.Logger
+	}
+	if opts.Isolation.Credential == nil {
+		opts.Isolation.Credential = &syscall.Credential{Uid: NobodyID, Gid: NobodyID}
+	}
+	if opts.Backend == nil {
+		opts.Backend = NewExecBackend
+	}
+	if opts.Cgroups == nil {
+		opts.Cgroups = cgv2.V2
+	}
+
+	backend, err := opts.Backend(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		id:      opts.ID,
+		log:     opts.Logger,
+		backend: backend,
+		state:   newStateMachine(opts.ID, logTransitions(opts.Logger, opts.OnTransition)),
+
+		debug:        opts.DebugLogger,
+		summaryLines: opts.OutputSummaryLines,
+		capture:      opts.Result,
+	}
+
+	return job, nil
+}
+
+// ===== Public getters =====
+func (j *Job) Done() <-chan struct{} { return j.state.done }
+func (j *Job) ID() string            { return j.id }
+func (j *Job) Status() Status        { s, _ := j.state.current(); return s }
+func (j *Job) ExitCode() int32       { _, c := j.state.current(); return c }
+
+// State returns the status, exit code and transition times as one
+// consistent snapshot.
+func (j *Job) State() State { return j.state.snapshot() }
+
+// ===== Public methods =====
+
+// OpenOutput opens the persisted stdout (or stderr) of the job for reading
+// from the beginning. Encrypted output is decrypted transparently. The
+// returned reader reports io.EOF at the current end of the file; callers that
+// want to follow a running job should retry until Done() is closed.
+func (j *Job) OpenOutput(stderr bool) (io.ReadCloser, error) {
+	return j.backend.OutputReader(stderr)
+}
+
+// OutputPath returns the file holding the job's stdout (or stderr) when the
+// backend keeps output on this host.
+func (j *Job) OutputPath(stderr bool) (string, bool) {
+	lo, ok := j.backend.(LocalOutput)
+	if !ok {
+		return "", false
+	}
+	return lo.OutputPath(stderr), true
+}
+
+// OutputTruncated reports whether output has been cut at the job's
+// OutputLimit.
+func (j *Job) OutputTruncated() bool {
+	t, ok := j.backend.(OutputTruncater)
+	return ok && t.OutputTruncated()
+}
+
+// Processes lists the job's live processes. It fails with
+// errors.ErrUnsupported when the backend can't list them.
+func (j *Job) Processes() ([]Process, error) {
+	pl, ok := j.backend.(ProcessLister)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return pl.Processes()
+}
+
+// ExecIn runs spec with the job's confinement while the job is running.
+// It fails with errors.ErrUnsupported when the backend can't.
+func (j *Job) ExecIn(ctx context.Context, spec ExecSpec) (Exit, error) {
+	e, ok := j.backend.(Execer)
+	if !ok {
+		return Exit{}, errors.ErrUnsupported
+	}
+	if j.Status() != StatusRunning {
+		return Exit{}, fmt.Errorf("cannot exec in job %s: current status=%s", j.id, j.Status())
+	}
+	return e.ExecIn(ctx, spec)
+}
+
+// Result is what Options.Result kept of stdout, or nil if it wasn't set
+// or the job hasn't ended.
+func (j *Job) Result() *Result { return j.result.Load() }
+
+// OpenResultData opens what the job has written to ResultFD so far. It
+// fails with an error wrapping os.ErrNotExist for a job without one.
+func (j *Job) OpenResultData() (io.ReadCloser, error) {
+	r, ok := j.backend.(ResultDataReader)
+	if !ok {
+		return nil, fmt.Errorf("job %s has no result data: %w", j.id, os.ErrNotExist)
+	}
+	return r.ResultDataReader()
+}
+
+// ResultDataTruncated reports whether the job wrote more than
+// MaxResultData to ResultFD.
+func (j *Job) ResultDataTruncated() bool {
+	r, ok := j.backend.(ResultDataReader)
+	return ok && r.ResultDataTruncated()
+}
+
+// CoreCaptured reports whether the job crashed and its core was kept.
+func (j *Job) CoreCaptured() bool { return j.core.Load() != nil }
+
+// OpenCore opens the job's kept core. It fails with an error wrapping
+// os.ErrNotExist when there is none.
+func (j *Job) OpenCore() (*os.File, error) {
+	path := j.core.Load()
+	if path == nil {
+		return nil, fmt.Errorf("job %s has no core: %w", j.id, os.ErrNotExist)
+	}
+	return os.Open(*path)
+}
+
+// Describe reports the job's PID and cgroup when the backend knows them.
+func (j *Job) Describe() Description {
+	if d, ok := j.backend.(Describer); ok {
+		return d.Describe()
+	}
+	return Description{}
+}
+
+// StartTimings reports how long the steps of launching the job took, for
+// backends that time them.
+func (j *Job) StartTimings() StartTimings {
+	if t, ok := j.backend.(StartTimer); ok {
+		return t.StartTimings()
+	}
+	return StartTimings{}
+}
+
+// CompressOutput compresses the finished job's stored output, reporting
+// its size on disk before and after. It fails with errors.ErrUnsupported
+// when the backend can't.
+func (j *Job) CompressOutput() (before, after int64, err error) {
+	select {
+	case <-j.Done():
+	default:
+		return 0, 0, fmt.Errorf("cannot compress output of job %s: still %s", j.id, j.Status())
+	}
+	c, ok := j.backend.(OutputCompressor)
+	if !ok {
+		return 0, 0, errors.ErrUnsupported
+	}
+	return c.CompressOutput()
+}
+
+// Remove deletes whatever the backend kept for the finished job (its
+// output). The Job can't be streamed afterwards.
+func (j *Job) Remove() error {
+	select {
+	case <-j.Done():
+	default:
+		return fmt.Errorf("cannot remove job %s: still %s", j.id, j.Status())
+	}
+	if r, ok := j.backend.(Remover); ok {
+		return r.Remove()
+	}
+	return nil
+}
+
+// Stats reports the job's current resource usage. Once the job has ended
+// it reports the usage at exit, when the backend recorded it.
+func (j *Job) Stats() (Stats, error) {
+	if final := j.final.Load(); final != nil {
+		return *final, nil
+	}
+	return j.backend.Stats()
+}
+
+// Signal delivers sig to the job's process tree while it is running.
+func (j *Job) Signal(sig syscall.Signal) error {
+	if j.Status() != StatusRunning {
+		return fmt.Errorf("cannot signal job %s: current status=%s", j.id, j.Status())
+	}
+	return j.backend.Signal(sig)
+}
+
+// Start starts the job's process via its backend.
+func (j *Job) Start() error {
+	if err := j.state.transition(StatusUnknown, StatusStarted, 0, nil); err != nil {
+		return fmt.Errorf("cannot start job %s: current status=%s", j.id, j.Status())
+	}
+
+	if err := j.backend.Start(); err != nil {
+		code := int32(exitCodeFailedToStart)
+		if errors.Is(err, ErrSetup) {
+			code = exitCodeFailedCgroup
+		}
+		return j.failStart(code, err)
+	}
+	// Fails only if Stop arrived while the backend was launching. It left
+	// the kill to us, since the backend can't be stopped and started
+	// concurrently.
+	if j.state.transition(StatusStarted, StatusRunning, 0, nil) != nil {
+		if err := j.backend.Stop(); err != nil {
+			j.log.Printf("job %s: stop after launch: %v", j.id, err)
+		}
+	}
+
+	j.reapOnExit()
+	return nil
+}
+
+func (j *Job) Wait() {
+	<-j.Done()
+}
+
+// Stop kills the job's process tree and returns once the job is done. The
+// job reports STOPPING until the process has been reaped. Stop is
+// idempotent and safe to call concurrently with exit: if the job had
+// already finished, or an earlier Stop is in progress, nothing is signalled
+// and alreadyDone is true.
+func (j *Job) Stop() (alreadyDone bool, err error) {
+	return j.StopWithReason("")
+}
+
+// StopWithReason is Stop, recording reason as why the job ended instead of
+// "stopped by request".
+func (j *Job) StopWithReason(reason string) (alreadyDone bool, err error) {
+	from, first := j.state.requestStop(reason)
+	if !first {
+		<-j.Done()
+		return true, nil
+	}
+
+	// UNKNOWN went straight to STOPPED and Start will refuse; from STARTED,
+	// Start kills the process once the backend has launched it.
+	if from == StatusRunning {
+		err = j.backend.Stop()
+	}
+	<-j.Done()
+	return false, err
+}
+
+// ===== Private methods =====
+
+func logTransitions(logger *log.Logger, next func(Transition)) func(Transition) {
+	return func(t Transition) {
+		logger.Printf("job %s: status %s -> %s", t.JobID, t.From, t.To)
+		if next != nil {
+			next(t)
+		}
+	}
+}
+
+func leftoverNote(exit Exit) string {
+	switch {
+	case exit.Leftovers == 0:
+		return ""
+	case exit.LeftoversWaited:
+		return fmt.Sprintf("waited for %d process(es) left running after the main process exited", exit.Leftovers)
+	default:
+		return fmt.Sprintf("killed %d process(es) left running after the main process exited", exit.Leftovers)
+	}
+}
+
+func killedReason(exit Exit) string {
+	if exit.OOMKilled {
+		return "killed by the OOM killer: memory limit reached"
+	}
+	if exit.OutputLimitKilled {
+		return "killed: output limit reached"
+	}
+	if exit.Signal == 0 {
+		return "killed by a signal"
+	}
+	if exit.CoreDumped {
+		return "killed by signal " + unix.SignalName(exit.Signal) + " (core dumped)"
+	}
+	return "killed by signal " + unix.SignalName(exit.Signal)
+}
+
+func (j *Job) failStart(code int32, err error) error {
+	j.log.Printf("job %s: %v", j.id, err)
+	// The backend has already released what it set up; this closes Done.
+	if terr := j.state.failed(code, err); terr != nil {
+		j.log.Printf("%v", terr)
+	}
+	return err
+}
+
+// reapOnExit arranges for waitForExit to run. A backend that offers an
+// exit descriptor is watched by the shared reaper, so a running job holds
+// no goroutine; otherwise a goroutine blocks in Wait.
+func (j *Job) reapOnExit() {
+	if n, ok := j.backend.(ExitNotifier); ok {
+		fd, err := n.ExitFD()
+		if err == nil {
+			if err = exitReaper.watch(fd, j.waitForExit); err == nil {
+				return
+			}
+			unix.Close(fd)
+		}
+		j.log.Printf("job %s: waiting on a goroutine: %v", j.id, err)
+	}
+	go j.waitForExit()
+}
+
+// waitForExit reaps the process and records how it ended. Only Start
+// runs it, via reapOnExit, once the backend has launched the process.
+func (j *Job) waitForExit() {
+	exit, waitErr := j.backend.Wait()
+	if exit.Usage != nil {
+		j.final.Store(exit.Usage)
+	}
+	if exit.Core != "" {
+		j.core.Store(&exit.Core)
+	}
+
+	var code int32
+	var reason string
+	switch {
+	case waitErr != nil:
+		j.log.Printf("job %s exited with unexpected/unknown error: %v", j.id, waitErr)
+		code = exitCodeUnknown
+		reason = fmt.Sprintf("lost track of the process: %v", waitErr)
+	case exit.Signaled:
+		code = exitCodeKilledBySignal
+		reason = killedReason(exit)
+	case exit.Code != 0:
+		j.log.Printf("job %s exited with non-zero exit code: %d", j.id, exit.Code)
+		code = int32(exit.Code)
+		reason = fmt.Sprintf("exited with code %d", exit.Code)
+	default:
+		j.log.Printf("job %s exited cleanly (exit code %d)", j.id, exit.Code)
+	}
+	if note := leftoverNote(exit); note != "" {
+		j.log.Printf("job %s: %s", j.id, note)
+		reason = strings.TrimPrefix(reason+"; "+note, "; ")
+	}
+
+	if j.summaryLines > 0 {
+		j.logOutputSummary("stdout", false, j.summaryLines)
+		j.logOutputSummary("stderr", true, j.summaryLines)
+	}
+	if j.capture != nil {
+		j.captureResult()
+	}
+
+	if err := j.state.exited(code, reason); err != nil {
+		j.log.Printf("%v", err)
+	}
+}
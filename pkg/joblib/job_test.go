@@ -0,0 +1,236 @@
+package joblib
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeBackend runs no process. Its "process" exits when exit is called,
+// or when Stop kills it, whichever comes first.
+type fakeBackend struct {
+	launch  chan struct{} // Start returns once this is closed
+	exited  chan struct{}
+	once    sync.Once
+	result  Exit
+	stops   atomic.Int32 // Stop calls that found the process running
+	running atomic.Bool
+}
+
+func newFakeBackend() *fakeBackend {
+	launch := make(chan struct{})
+	close(launch)
+	return &fakeBackend{launch: launch, exited: make(chan struct{})}
+}
+
+func (b *fakeBackend) factory(Options) (Backend, error) { return b, nil }
+
+// exit ends the process with code, unless it has ended already.
+func (b *fakeBackend) exit(code int) {
+	b.once.Do(func() {
+		b.result = Exit{Code: code}
+		close(b.exited)
+	})
+}
+
+func (b *fakeBackend) Start() error {
+	<-b.launch
+	b.running.Store(true)
+	return nil
+}
+
+func (b *fakeBackend) Wait() (Exit, error) {
+	<-b.exited
+	return b.result, nil
+}
+
+func (b *fakeBackend) Stop() error {
+	if !b.running.Load() {
+		return errors.New("stop before launch")
+	}
+	b.once.Do(func() {
+		b.stops.Add(1)
+		b.result = Exit{Signaled: true, Signal: syscall.SIGKILL}
+		close(b.exited)
+	})
+	return nil
+}
+
+func (b *fakeBackend) Signal(syscall.Signal) error { return nil }
+func (b *fakeBackend) Stats() (Stats, error)       { return Stats{}, nil }
+func (b *fakeBackend) OutputReader(bool) (io.ReadCloser, error) {
+	return nil, errors.New("no output")
+}
+
+func newFakeJob(t *testing.T, b *fakeBackend) *Job {
+	t.Helper()
+	j, err := New(Options{ID: "job", Command: "/bin/true", Backend: b.factory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// waitDone fails t unless j is done within a second.
+func waitDone(t *testing.T, j *Job) {
+	t.Helper()
+	select {
+	case <-j.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("job still %s", j.Status())
+	}
+}
+
+// TestStopConcurrent checks that of many concurrent Stops on a running
+// job, one kills it and the rest wait for it and report alreadyDone.
+func TestStopConcurrent(t *testing.T) {
+	b := newFakeBackend()
+	j := newFakeJob(t, b)
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const stoppers = 8
+	var first atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < stoppers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			already, err := j.Stop()
+			if err != nil {
+				t.Errorf("Stop: %v", err)
+			}
+			if !already {
+				first.Add(1)
+			}
+			if j.Status() != StatusStopped {
+				t.Errorf("Stop returned with the job %s", j.Status())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := first.Load(); n != 1 {
+		t.Errorf("%d Stops reported stopping the job, want 1", n)
+	}
+	if n := b.stops.Load(); n != 1 {
+		t.Errorf("backend stopped %d times, want 1", n)
+	}
+}
+
+// TestStopRacesExit runs Stops against the process exiting on its own.
+// Whichever wins, every Stop returns once the job is done, the backend is
+// killed at most once, and the job ends EXITED or STOPPED.
+func TestStopRacesExit(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		b := newFakeBackend()
+		j := newFakeJob(t, b)
+		if err := j.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			b.exit(0)
+		}()
+		for k := 0; k < 2; k++ {
+			go func() {
+				defer wg.Done()
+				if _, err := j.StopWithReason("racing"); err != nil {
+					t.Errorf("StopWithReason: %v", err)
+				}
+				select {
+				case <-j.Done():
+				default:
+					t.Error("StopWithReason returned before the job was done")
+				}
+			}()
+		}
+		wg.Wait()
+		waitDone(t, j)
+
+		if n := b.stops.Load(); n > 1 {
+			t.Fatalf("backend stopped %d times", n)
+		}
+		st := j.State()
+		switch st.Status {
+		case StatusExited:
+			if b.stops.Load() != 0 {
+				t.Fatal("job EXITED although Stop killed it")
+			}
+		case StatusStopped:
+		default:
+			t.Fatalf("job ended %s", st.Status)
+		}
+	}
+}
+
+// TestStopAfterExit checks that stopping a finished job signals nothing.
+func TestStopAfterExit(t *testing.T) {
+	b := newFakeBackend()
+	j := newFakeJob(t, b)
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+	b.exit(3)
+	waitDone(t, j)
+
+	already, err := j.Stop()
+	if err != nil || !already {
+		t.Fatalf("Stop = %v, %v; want true, nil", already, err)
+	}
+	if n := b.stops.Load(); n != 0 {
+		t.Errorf("backend stopped %d times, want 0", n)
+	}
+	if st := j.State(); st.Status != StatusExited || st.ExitCode != 3 {
+		t.Errorf("job %s with code %d, want EXITED with 3", st.Status, st.ExitCode)
+	}
+}
+
+// TestStopDuringLaunch checks that a Stop arriving while the backend is
+// still launching is carried out by Start once it has.
+func TestStopDuringLaunch(t *testing.T) {
+	b := newFakeBackend()
+	launch := make(chan struct{})
+	b.launch = launch
+	j := newFakeJob(t, b)
+
+	started := make(chan error, 1)
+	go func() { started <- j.Start() }()
+	for j.Status() != StatusStarted {
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan bool, 1)
+	go func() {
+		already, err := j.Stop()
+		if err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+		stopped <- already
+	}()
+	for j.Status() != StatusStopping {
+		time.Sleep(time.Millisecond)
+	}
+	close(launch)
+
+	if err := <-started; err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if already := <-stopped; already {
+		t.Error("Stop reported the job already done")
+	}
+	if n := b.stops.Load(); n != 1 {
+		t.Errorf("backend stopped %d times, want 1", n)
+	}
+	if s := j.Status(); s != StatusStopped {
+		t.Errorf("job %s, want STOPPED", s)
+	}
+}
@@ -0,0 +1,98 @@
+package joblib
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// OutputLimit caps how much output a job keeps.
+type OutputLimit struct {
+	// MaxBytes is the cap on stdout and stderr combined. Zero means none.
+	MaxBytes int64
+	// Kill kills the job when it reaches the cap. Otherwise the job keeps
+	// running and the rest of its output is discarded.
+	Kill bool
+}
+
+// OutputTruncater is implemented by backends that enforce an OutputLimit.
+type OutputTruncater interface {
+	// OutputTruncated reports whether the job has reached its limit.
+	OutputTruncated() bool
+}
+
+// outputLimiter shares one OutputLimit between a job's stdout and stderr.
+type outputLimiter struct {
+	limit OutputLimit
+	kill  func() // called once, when the limit is reached with Kill set
+
+	mu        sync.Mutex
+	used      int64
+	truncated atomic.Bool
+}
+
+// take reserves up to n bytes of the limit and returns how many it got.
+func (l *outputLimiter) take(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n = int(min(int64(n), l.limit.MaxBytes-l.used))
+	l.used += int64(n)
+	return n
+}
+
+func (l *outputLimiter) reached() {
+	if l.truncated.CompareAndSwap(false, true) && l.limit.Kill && l.kill != nil {
+		l.kill()
+	}
+}
+
+// marker is written where a stream's output was cut, on a line of its own,
+// so readers can tell data is missing.
+func (l *outputLimiter) marker() string {
+	if l.limit.Kill {
+		return fmt.Sprintf("[jobworker: output limit of %d bytes reached; job killed]\n", l.limit.MaxBytes)
+	}
+	return fmt.Sprintf("[jobworker: output limit of %d bytes reached; the rest is discarded]\n", l.limit.MaxBytes)
+}
+
+// writer wraps one stream's destination.
+func (l *outputLimiter) writer(w io.Writer) io.Writer {
+	return &limitedWriter{l: l, w: w, last: '\n'}
+}
+
+// limitedWriter passes output through until the limit is reached, then
+// writes the marker once and swallows the rest, so the job never sees a
+// write error or blocks on a full pipe.
+type limitedWriter struct {
+	l      *outputLimiter
+	w      io.Writer
+	last   byte // last byte written, to start the marker on a new line
+	marked bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.marked {
+		return len(p), nil
+	}
+	n := w.l.take(len(p))
+	if n > 0 {
+		if _, err := w.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+		w.last = p[n-1]
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	w.marked = true
+	marker := w.l.marker()
+	if w.last != '\n' {
+		marker = "\n" + marker
+	}
+	if _, err := io.WriteString(w.w, marker); err != nil {
+		return 0, err
+	}
+	w.l.reached()
+	return len(p), nil
+}
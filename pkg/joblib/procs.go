@@ -0,0 +1,147 @@
+package joblib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It is
+// 100 on every Linux architecture Go supports.
+const clockTicks = 100
+
+// Process is one process of a job, as /proc describes it.
+type Process struct {
+	PID       int
+	PPID      int
+	Command   string   // executable name (comm), up to 15 bytes
+	Args      []string // command line; empty for kernel threads and zombies
+	State     string   // R, S, D, Z, T, ...
+	Threads   int
+	RSSBytes  uint64
+	CPUUsec   uint64 // user+system time since it started
+	StartedAt time.Time
+}
+
+// ProcessLister is implemented by backends that can list a running job's
+// processes.
+type ProcessLister interface {
+	Processes() ([]Process, error)
+}
+
+// readProcesses reads pids from /proc, skipping ones that exit meanwhile.
+func readProcesses(pids []int) ([]Process, error) {
+	boot, err := bootTime()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Process, 0, len(pids))
+	for _, pid := range pids {
+		p, err := readProcess(pid, boot)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func readProcess(pid int, boot time.Time) (Process, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return Process{}, err
+	}
+	p, err := parseStat(stat, boot)
+	if err != nil {
+		return Process{}, fmt.Errorf("pid %d: %w", pid, err)
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		p.Args = strings.Split(string(bytes.TrimSuffix(cmdline, []byte{0})), "\x00")
+	}
+	return p, nil
+}
+
+// parseStat reads /proc/<pid>/stat: "pid (comm) state ppid ...". comm may
+// itself contain spaces and parentheses, so fields are counted from the
+// last ')'.
+func parseStat(b []byte, boot time.Time) (Process, error) {
+	open, end := bytes.IndexByte(b, '('), bytes.LastIndexByte(b, ')')
+	if open < 0 || end < open {
+		return Process{}, fmt.Errorf("malformed stat %q", b)
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(b[:open])))
+	if err != nil {
+		return Process{}, fmt.Errorf("malformed stat %q", b)
+	}
+	// Fields from 3 (state) on; f[i] is field i+3 in proc(5).
+	f := strings.Fields(string(b[end+1:]))
+	if len(f) < 22 {
+		return Process{}, fmt.Errorf("malformed stat %q", b)
+	}
+	num := func(i int) uint64 { n, _ := strconv.ParseUint(f[i], 10, 64); return n }
+	return Process{
+		PID:       pid,
+		PPID:      int(num(1)),
+		Command:   string(b[open+1 : end]),
+		State:     f[0],
+		Threads:   int(num(17)),
+		RSSBytes:  num(21) * uint64(os.Getpagesize()),
+		CPUUsec:   (num(11) + num(12)) * (1e6 / clockTicks),
+		StartedAt: boot.Add(time.Duration(num(19)) * time.Second / clockTicks),
+	}, nil
+}
+
+// bootTime reads btime from /proc/stat.
+func bootTime() (time.Time, error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("malformed btime %q", v)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
+
+// processGroup lists the processes in process group pgid, for when the
+// cgroup can't say (fake or no-op cgroups).
+func processGroup(pgid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// pgrp is the 5th field, the 3rd after comm.
+		end := bytes.LastIndexByte(stat, ')')
+		if end < 0 {
+			continue
+		}
+		if f := strings.Fields(string(stat[end+1:])); len(f) > 2 && f[2] == strconv.Itoa(pgid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,100 @@
+package joblib
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExitNotifier is implemented by backends that can hand over a file
+// descriptor that becomes readable once the main process has exited, such
+// as a pidfd. Jobs on such backends wait in one shared epoll loop instead
+// of a goroutine each, and Wait is only called once it would not block on
+// the process. The caller owns and closes the descriptor.
+type ExitNotifier interface {
+	ExitFD() (int, error)
+}
+
+// reaper waits for many jobs' exits on one epoll descriptor, and runs each
+// job's onExit once its descriptor is readable.
+type reaper struct {
+	once sync.Once
+	epfd int
+
+	mu      sync.Mutex
+	err     error // set once the loop can't go on; watch then refuses
+	waiting map[int32]func()
+}
+
+var exitReaper reaper
+
+// watch runs onExit on its own goroutine once fd is readable, and closes
+// fd. On error nothing was registered and fd is still the caller's.
+func (r *reaper) watch(fd int, onExit func()) error {
+	r.once.Do(r.init)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	ev := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLONESHOT, Fd: int32(fd)}
+	if err := unix.EpollCtl(r.epfd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		return err
+	}
+	r.waiting[int32(fd)] = onExit
+	return nil
+}
+
+func (r *reaper) init() {
+	r.waiting = make(map[int32]func())
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.epfd = epfd
+	go r.run()
+}
+
+func (r *reaper) run() {
+	events := make([]unix.EpollEvent, 128)
+	for {
+		n, err := unix.EpollWait(r.epfd, events, -1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		for _, ev := range events[:n] {
+			r.mu.Lock()
+			onExit := r.waiting[ev.Fd]
+			delete(r.waiting, ev.Fd)
+			r.mu.Unlock()
+
+			unix.EpollCtl(r.epfd, unix.EPOLL_CTL_DEL, int(ev.Fd), nil)
+			unix.Close(int(ev.Fd))
+			if onExit != nil {
+				go onExit()
+			}
+		}
+	}
+}
+
+// fail hands every job still waiting to onExit as if it had exited, so its
+// backend's Wait blocks for it as it would without the reaper, and turns
+// later watches away.
+func (r *reaper) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+	for fd, onExit := range r.waiting {
+		unix.Close(int(fd))
+		go onExit()
+	}
+	r.waiting = nil
+	unix.Close(r.epfd)
+}
@@ -0,0 +1,143 @@
+package joblib
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+const (
+	// MaxResultBytes caps a job's result.
+	MaxResultBytes = 64 << 10
+	// MaxResultLines caps ResultCapture.LastLines.
+	MaxResultLines = 1000
+)
+
+// ResultCapture says what of a job's stdout is kept as its result once it
+// ends: the last LastLines lines, or, when Begin is set, the lines between
+// a line equal to Begin and the next line equal to End. The last such
+// block counts, and with no End after it, it runs to the end of the
+// output. Lines are compared without their "\n" or "\r\n".
+type ResultCapture struct {
+	LastLines int
+	Begin     string
+	End       string
+}
+
+// Result is what a ResultCapture kept. Truncated says it was cut to
+// MaxResultBytes: its end is kept for LastLines, its start for markers.
+type Result struct {
+	Text      []byte
+	Truncated bool
+}
+
+// captureResult keeps the job's result from its stdout. A result that
+// can't be read is logged and left unset.
+func (j *Job) captureResult() {
+	rc, err := j.OpenOutput(false)
+	if err != nil {
+		j.log.Printf("job %s: capture result: %v", j.id, err)
+		return
+	}
+	defer rc.Close()
+	res, err := readResult(rc, *j.capture)
+	if err != nil {
+		j.log.Printf("job %s: capture result: %v", j.id, err)
+		return
+	}
+	j.result.Store(&res)
+}
+
+// readResult reads the result c selects from r.
+func readResult(r io.Reader, c ResultCapture) (Result, error) {
+	if c.Begin != "" {
+		return markedResult(r, c.Begin, c.End)
+	}
+	return lastLines(r, c.LastLines)
+}
+
+// lastLines keeps the last n lines of r. Only its last MaxResultBytes can
+// be in the result, and the byte before them says whether they start on a
+// line, so a file is read from there; other readers are read through.
+func lastLines(r io.Reader, n int) (Result, error) {
+	const window = MaxResultBytes + 1
+	if s, ok := r.(io.Seeker); ok {
+		if end, err := s.Seek(0, io.SeekEnd); err == nil {
+			if _, err := s.Seek(max(end-window, 0), io.SeekStart); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+	tail := make([]byte, 0, 2*window)
+	for {
+		if len(tail) == cap(tail) {
+			tail = append(tail[:0], tail[len(tail)-window:]...)
+		}
+		k, err := r.Read(tail[len(tail):cap(tail)])
+		tail = tail[:len(tail)+k]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	body, whole := tail, true // whole: body starts on a line
+	if len(tail) >= window {
+		body = tail[len(tail)-MaxResultBytes:]
+		whole = tail[len(tail)-window] == '\n'
+	}
+	end := len(body)
+	if end > 0 && body[end-1] == '\n' {
+		end-- // the last line's own
+	}
+	for k := 0; k < n; k++ {
+		nl := bytes.LastIndexByte(body[:end], '\n')
+		if nl < 0 {
+			// Fewer than n lines here; the first is cut short unless whole.
+			return Result{Text: bytes.Clone(body), Truncated: !whole}, nil
+		}
+		end = nl
+	}
+	return Result{Text: bytes.Clone(body[end+1:])}, nil
+}
+
+// markedResult keeps the lines between begin and end markers in r.
+func markedResult(r io.Reader, begin, end string) (Result, error) {
+	br := bufio.NewReaderSize(r, MaxResultBytes) // longer than any marker
+	var (
+		res   Result
+		in    bool // inside a block
+		start = true
+	)
+	for {
+		frag, err := br.ReadSlice('\n')
+		marker := false
+		if start && err != bufio.ErrBufferFull { // a whole line
+			line := bytes.TrimSuffix(bytes.TrimSuffix(frag, []byte("\n")), []byte("\r"))
+			switch {
+			case string(line) == begin:
+				res, in, marker = Result{Text: res.Text[:0]}, true, true
+			case in && end != "" && string(line) == end:
+				in, marker = false, true
+			}
+		}
+		if in && !marker {
+			if room := MaxResultBytes - len(res.Text); len(frag) > room {
+				res.Text = append(res.Text, frag[:room]...)
+				res.Truncated = true
+			} else {
+				res.Text = append(res.Text, frag...)
+			}
+		}
+		start = err == nil
+		switch {
+		case err == nil, err == bufio.ErrBufferFull:
+		case err == io.EOF:
+			return res, nil
+		default:
+			return Result{}, err
+		}
+	}
+}
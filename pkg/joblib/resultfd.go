@@ -0,0 +1,125 @@
+package joblib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bucknercd/jobworker/internal/logcrypt"
+)
+
+const (
+	// ResultFD is the file descriptor a job started with Options.ResultFD
+	// writes its result data to.
+	ResultFD = 3
+
+	// MaxResultData caps the result data kept; the rest is read and
+	// dropped, so the job never blocks on it.
+	MaxResultData = 1 << 20
+
+	resultFilename = "result"
+
+	// resultDrainTimeout bounds how long Wait waits, once the job's
+	// processes are gone, for the last of its result data.
+	resultDrainTimeout = 5 * time.Second
+)
+
+// ResultDataReader is implemented by backends that support
+// Options.ResultFD.
+type ResultDataReader interface {
+	// ResultDataReader opens the result data written so far. It fails with
+	// an error wrapping os.ErrNotExist for a job without a ResultFD.
+	ResultDataReader() (io.ReadCloser, error)
+
+	// ResultDataTruncated reports whether the job wrote more than
+	// MaxResultData.
+	ResultDataTruncated() bool
+}
+
+// prepareResultFD creates the job's result file and the pipe the job
+// writes it through, and starts copying from the pipe. The copy ends once
+// every copy of the pipe's write end is closed: the job's when its last
+// process exits, b.resultW by Start or cleanup.
+func (b *execBackend) prepareResultFD() error {
+	f, err := os.OpenFile(b.resultPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open result file: %w", err)
+	}
+	var w io.Writer = f
+	if b.outputKey != nil {
+		if w, err = logcrypt.NewWriter(f, b.outputKey); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to set up result encryption: %w", err)
+		}
+	}
+	r, pw, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to create result pipe: %w", err)
+	}
+	b.resultW = pw
+	b.resultDone = make(chan struct{})
+	go b.copyResult(r, w, f)
+	return nil
+}
+
+// copyResult keeps the first MaxResultData bytes read from r in w, and
+// reads and drops the rest.
+func (b *execBackend) copyResult(r *os.File, w io.Writer, f *os.File) {
+	defer close(b.resultDone)
+	defer r.Close()
+	defer f.Close()
+	n, err := io.Copy(w, io.LimitReader(r, MaxResultData))
+	if err == nil && n == MaxResultData {
+		var dropped int64
+		dropped, err = io.Copy(io.Discard, r)
+		if dropped > 0 {
+			b.resultTruncated.Store(true)
+		}
+	}
+	if err != nil {
+		b.log.Printf("job %s: result data: %v", b.id, err)
+		io.Copy(io.Discard, r)
+	}
+}
+
+// waitResult waits for the copy of the result data to finish.
+func (b *execBackend) waitResult() {
+	if b.resultDone == nil {
+		return
+	}
+	select {
+	case <-b.resultDone:
+	case <-time.After(resultDrainTimeout):
+		b.log.Printf("job %s: result fd still open after %s; its result data may be incomplete", b.id, resultDrainTimeout)
+	}
+}
+
+// ResultDataReader implements ResultDataReader.
+func (b *execBackend) ResultDataReader() (io.ReadCloser, error) {
+	if b.resultPath == "" {
+		return nil, fmt.Errorf("job %s has no result fd: %w", b.id, os.ErrNotExist)
+	}
+	f, err := os.Open(b.resultPath)
+	if errors.Is(err, os.ErrNotExist) { // not started yet
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.outputKey == nil {
+		return f, nil
+	}
+	r, err := logcrypt.NewReader(f, b.outputKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &outputReader{Reader: r, f: f}, nil
+}
+
+// ResultDataTruncated implements ResultDataReader.
+func (b *execBackend) ResultDataTruncated() bool { return b.resultTruncated.Load() }
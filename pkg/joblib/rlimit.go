@@ -0,0 +1,47 @@
+package joblib
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rlimit is a per-process resource limit for the job's main process,
+// which its children inherit. Soft and hard limits are both set to Max,
+// so the job can't raise them again.
+type Rlimit struct {
+	Resource int    // unix.RLIMIT_*
+	Max      uint64 // unix.RLIM_INFINITY lifts the limit
+}
+
+// rlimitNames are the resources the manager sets, for messages.
+var rlimitNames = map[int]string{
+	unix.RLIMIT_NOFILE: "RLIMIT_NOFILE",
+	unix.RLIMIT_NPROC:  "RLIMIT_NPROC",
+	unix.RLIMIT_CORE:   "RLIMIT_CORE",
+	unix.RLIMIT_FSIZE:  "RLIMIT_FSIZE",
+}
+
+func (r Rlimit) String() string {
+	name, ok := rlimitNames[r.Resource]
+	if !ok {
+		name = fmt.Sprintf("rlimit %d", r.Resource)
+	}
+	if r.Max == unix.RLIM_INFINITY {
+		return name + "=unlimited"
+	}
+	return fmt.Sprintf("%s=%d", name, r.Max)
+}
+
+// setRlimits applies the job's rlimits to its main process. Go can't set
+// them between fork and exec, so this runs right after Start: the new
+// program may run briefly under the server's limits first.
+func (b *execBackend) setRlimits(pid int) error {
+	for _, r := range b.rlimits {
+		lim := &unix.Rlimit{Cur: r.Max, Max: r.Max}
+		if err := unix.Prlimit(pid, r.Resource, lim, nil); err != nil {
+			return fmt.Errorf("set %s: %w", r, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package joblib
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// shimArg0 marks a re-exec of the running binary as the mount
+	// namespace shim (see RunShim).
+	shimArg0 = "jobworker-shim"
+
+	// shimFailed is the exit code of a shim that couldn't set up the job;
+	// what went wrong is on the job's stderr.
+	shimFailed = 126
+
+	workspaceDirname = "work"
+
+	// privateDirname holds a job's /tmp on the host, root-only so other
+	// jobs running as the same user can't reach it.
+	privateDirname = "private"
+)
+
+// RunShim must be called first thing in main by programs whose jobs use
+// Isolation.ReadOnlyHost, Isolation.PrivateTmp, Isolation.PIDNamespace or
+// Options.SetUmask. In the shim process it sets the job up and runs it,
+// never returning; anywhere else it returns at once.
+//
+// Go can't run code between fork and exec, so such jobs start as a re-exec
+// of the running binary. For mounts it runs in a new mount namespace and,
+// still root there, arranges the job's mounts and drops to the job's
+// credentials itself; otherwise it starts as the job's user. Either way it
+// sets the umask and execs the job, or with a PID namespace stays as its
+// init (see runInit).
+func RunShim() {
+	if len(os.Args) == 0 || os.Args[0] != shimArg0 {
+		return
+	}
+	if err := shim(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "jobworker: %v\n", err)
+		os.Exit(shimFailed)
+	}
+}
+
+// shimConfig is what the server tells the shim, as flags.
+type shimConfig struct {
+	readOnly  bool   // make every mount read-only...
+	workspace string // ...except this one
+	tmp       string // bind this on /tmp, if set
+	umask     string // octal; empty leaves the server's
+
+	// init runs the job under runInit, as the PID namespace's init, with a
+	// /proc of the namespace.
+	init          bool
+	waitLeftovers bool
+	resultFD      bool // the init passes initResultFD on as ResultFD
+
+	uid, gid  int    // -1 when the shim already runs as the job's user
+	groups    string // comma-separated gids
+	serverPID int
+}
+
+func (c shimConfig) args(path string, argv []string) []string {
+	return append([]string{shimArg0,
+		"-read-only=" + strconv.FormatBool(c.readOnly),
+		"-workspace=" + c.workspace,
+		"-tmp=" + c.tmp,
+		"-umask=" + c.umask,
+		"-init=" + strconv.FormatBool(c.init),
+		"-wait-leftovers=" + strconv.FormatBool(c.waitLeftovers),
+		"-result-fd=" + strconv.FormatBool(c.resultFD),
+		"-uid=" + strconv.Itoa(c.uid),
+		"-gid=" + strconv.Itoa(c.gid),
+		"-groups=" + c.groups,
+		"-server-pid=" + strconv.Itoa(c.serverPID),
+		"--", path,
+	}, argv...)
+}
+
+func shim(args []string) error {
+	var c shimConfig
+	fs := flag.NewFlagSet(shimArg0, flag.ContinueOnError)
+	fs.BoolVar(&c.readOnly, "read-only", false, "")
+	fs.StringVar(&c.workspace, "workspace", "", "")
+	fs.StringVar(&c.tmp, "tmp", "", "")
+	fs.StringVar(&c.umask, "umask", "", "")
+	fs.BoolVar(&c.init, "init", false, "")
+	fs.BoolVar(&c.waitLeftovers, "wait-leftovers", false, "")
+	fs.BoolVar(&c.resultFD, "result-fd", false, "")
+	fs.IntVar(&c.uid, "uid", -1, "")
+	fs.IntVar(&c.gid, "gid", -1, "")
+	fs.StringVar(&c.groups, "groups", "", "")
+	fs.IntVar(&c.serverPID, "server-pid", 0, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+		return errors.New("shim: bad arguments")
+	}
+	path, argv := fs.Arg(0), fs.Args()[1:]
+	var groups []int
+	for _, s := range strings.Split(c.groups, ",") {
+		if s == "" {
+			continue
+		}
+		g, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("shim: bad group %q", s)
+		}
+		groups = append(groups, g)
+	}
+
+	if c.readOnly || c.tmp != "" || c.init {
+		if err := c.mount(); err != nil {
+			return err
+		}
+	}
+	if c.umask != "" {
+		mask, err := strconv.ParseUint(c.umask, 8, 32)
+		if err != nil {
+			return fmt.Errorf("shim: bad umask %q", c.umask)
+		}
+		unix.Umask(int(mask))
+	}
+	if c.uid >= 0 {
+		if err := c.dropCredentials(groups); err != nil {
+			return err
+		}
+	}
+	if c.init {
+		return runInit(c, path, argv)
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// mount arranges the job's view of the host, in the shim's own mount
+// namespace.
+func (c shimConfig) mount() error {
+	// Host mounts and unmounts still show up here; nothing done here leaks
+	// back.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("stop mounts propagating to the host: %w", err)
+	}
+	if c.readOnly {
+		if err := unix.MountSetattr(unix.AT_FDCWD, "/", unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+			return fmt.Errorf("make the host read-only: %w", err)
+		}
+		if err := bindWritable(c.workspace, c.workspace); err != nil {
+			return fmt.Errorf("workspace: %w", err)
+		}
+	}
+	if c.tmp != "" {
+		if err := bindWritable(c.tmp, "/tmp"); err != nil {
+			return fmt.Errorf("private /tmp: %w", err)
+		}
+	}
+	if c.init {
+		flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+		if c.readOnly {
+			flags |= unix.MS_RDONLY
+		}
+		if err := unix.Mount("proc", "/proc", "proc", flags, ""); err != nil {
+			return fmt.Errorf("mount the namespace's /proc: %w", err)
+		}
+	}
+	// The working directory was entered before the mounts; enter it again
+	// through them.
+	if wd, err := os.Getwd(); err == nil {
+		if err := os.Chdir(wd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropCredentials becomes the job's user, keeping the server's death
+// signal.
+func (c shimConfig) dropCredentials(groups []int) error {
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setresgid(c.gid, c.gid, c.gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setresuid(c.uid, c.uid, c.uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	// Changing credentials cleared the death signal the server asked for.
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(syscall.SIGKILL), 0, 0, 0); err != nil {
+		return fmt.Errorf("set death signal: %w", err)
+	}
+	// An init's parent is outside its namespace; runInit checks on the
+	// server through the start pipe instead.
+	if !c.init && os.Getppid() != c.serverPID {
+		return errors.New("server exited during setup")
+	}
+	return nil
+}
+
+// bindWritable binds src on dst and makes that mount writable, whatever
+// the mount it came from.
+func bindWritable(src, dst string) error {
+	if err := unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind %s on %s: %w", src, dst, err)
+	}
+	if err := unix.MountSetattr(unix.AT_FDCWD, dst, 0, &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("make %s writable: %w", dst, err)
+	}
+	return nil
+}
+
+// usesShim reports whether the job starts behind the shim. Chrooted jobs
+// can't: the shim is exec'd after the chroot.
+func (b *execBackend) usesShim() bool {
+	iso := b.isolation
+	return (iso.ReadOnlyHost || iso.PrivateTmp || iso.PIDNamespace || b.umask != nil) && iso.Chroot == ""
+}
+
+// setTitle puts the job's process title in front of cmd's argv[0].
+func (b *execBackend) setTitle(cmd *exec.Cmd) {
+	if b.title != "" {
+		cmd.Args[0] = b.title + " " + cmd.Args[0]
+	}
+}
+
+// workspace is the job's HOME, and a ReadOnlyHost job's one writable
+// directory.
+func (b *execBackend) workspace() string {
+	return filepath.Join(b.jobsDir, workspaceDirname)
+}
+
+// privateTmp is where a PrivateTmp job's tmpfs is mounted on the host.
+func (b *execBackend) privateTmp() string {
+	return filepath.Join(b.jobsDir, privateDirname, "tmp")
+}
+
+// prepareWorkspace creates the job's workspace, owned by its user.
+func (b *execBackend) prepareWorkspace() error {
+	ws := b.workspace()
+	if err := os.Mkdir(ws, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("failed to create workspace: %w", err)
+	}
+	cred := b.isolation.Credential
+	if err := os.Chown(ws, int(cred.Uid), int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to hand the workspace to the job's user: %w", err)
+	}
+	return nil
+}
+
+// prepareShim creates what the shim will mount for the job.
+func (b *execBackend) prepareShim() error {
+	if b.isolation.PrivateTmp {
+		tmp := b.privateTmp()
+		if err := os.MkdirAll(tmp, 0700); err != nil {
+			return fmt.Errorf("failed to create private /tmp: %w", err)
+		}
+		opts := "mode=1777"
+		if b.isolation.PrivateTmpSize > 0 {
+			opts += ",size=" + strconv.FormatInt(b.isolation.PrivateTmpSize, 10)
+		}
+		if err := unix.Mount("tmpfs", tmp, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, opts); err != nil {
+			return fmt.Errorf("failed to mount private /tmp: %w", err)
+		}
+	}
+	return nil
+}
+
+// releasePrivateTmp discards the job's /tmp once nothing in the job can
+// use it.
+func (b *execBackend) releasePrivateTmp() {
+	if !b.isolation.PrivateTmp {
+		return
+	}
+	tmp := b.privateTmp()
+	if err := unix.Unmount(tmp, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		b.log.Printf("job %s: unmount private /tmp: %v", b.id, err)
+		return
+	}
+	_ = os.RemoveAll(filepath.Dir(tmp))
+}
+
+// wrapShim turns cmd, once its SysProcAttr is set, into a shim run that
+// ends in cmd's program with cmd's credentials and the job's umask. For
+// mounts it runs in a new mount namespace, and asInit in a new PID
+// namespace too, as its init. With ReadOnlyHost it runs in the workspace
+// unless it has a Dir, and without a private /tmp, TMPDIR points there
+// too.
+func (b *execBackend) wrapShim(cmd *exec.Cmd, asInit bool) {
+	attr := cmd.SysProcAttr
+	c := shimConfig{
+		readOnly:      b.isolation.ReadOnlyHost,
+		init:          asInit,
+		waitLeftovers: b.leftovers == LeftoverWait,
+		resultFD:      asInit && b.resultPath != "",
+		uid:           -1,
+		gid:           -1,
+		serverPID:     os.Getpid(),
+	}
+	if c.readOnly {
+		c.workspace = b.workspace()
+	}
+	if b.isolation.PrivateTmp {
+		c.tmp = b.privateTmp()
+	}
+	if b.umask != nil {
+		c.umask = strconv.FormatUint(uint64(*b.umask), 8)
+	}
+	if c.readOnly || c.tmp != "" || c.init {
+		cred := attr.Credential
+		groups := make([]string, len(cred.Groups))
+		for i, g := range cred.Groups {
+			groups[i] = strconv.FormatUint(uint64(g), 10)
+		}
+		c.uid, c.gid, c.groups = int(cred.Uid), int(cred.Gid), strings.Join(groups, ",")
+		attr.Credential = nil // the shim drops them itself, after mounting
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+		if c.init {
+			attr.Cloneflags |= syscall.CLONE_NEWPID
+		}
+	}
+	cmd.Args = c.args(cmd.Path, cmd.Args)
+	cmd.Path = "/proc/self/exe"
+
+	if c.readOnly {
+		if c.tmp == "" {
+			cmd.Env = append(cmd.Env, "TMPDIR="+c.workspace)
+		}
+		if cmd.Dir == "" {
+			cmd.Dir = c.workspace
+		}
+	}
+}
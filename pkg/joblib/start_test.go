@@ -0,0 +1,112 @@
+package joblib
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bucknercd/jobworker/pkg/cgroups"
+)
+
+// newRecordedJob makes a job that runs command with the exec backend, as
+// the test's own user, with its cgroup calls going to rec.
+func newRecordedJob(t *testing.T, rec *cgroups.Recorder, command string, args ...string) *Job {
+	t.Helper()
+	j, err := New(Options{
+		ID:      "job1",
+		Command: command,
+		Args:    args,
+		JobsDir: t.TempDir(),
+		Limits:  []string{"memory.max=1048576", "pids.max=16"},
+		Cgroups: rec.Driver(),
+		Isolation: Isolation{Credential: &syscall.Credential{
+			Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), NoSetGroups: true,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestStartCgroupFailures(t *testing.T) {
+	errDenied := syscall.EACCES
+	for _, tc := range []struct {
+		name  string
+		rec   *cgroups.Recorder
+		err   string // a substring of Start's error
+		calls []string
+	}{
+		{
+			name:  "create",
+			rec:   &cgroups.Recorder{CreateErr: errors.New("cgroup v2 not available")},
+			err:   "failed to create cgroup: cgroup v2 not available",
+			calls: []string{"create job1 memory.max=1048576 pids.max=16", "delete job1"},
+		},
+		{
+			name: "limit write",
+			rec:  &cgroups.Recorder{LimitErrs: map[string]error{"pids.max": errDenied}},
+			err:  "failed to create cgroup: write pids.max: permission denied",
+			// Create's own rollback, then Start's cleanup.
+			calls: []string{"create job1 memory.max=1048576 pids.max=16", "delete job1", "delete job1"},
+		},
+		{
+			name:  "attach",
+			rec:   &cgroups.Recorder{AttachErr: errDenied},
+			err:   "failed to place job in its cgroup",
+			calls: []string{"create job1 memory.max=1048576 pids.max=16", "attach", "delete job1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			j := newRecordedJob(t, tc.rec, "/bin/sleep", "30")
+			err := j.Start()
+			if err == nil {
+				t.Fatal("Start succeeded")
+			}
+			if !errors.Is(err, ErrSetup) {
+				t.Errorf("Start error %q doesn't wrap ErrSetup", err)
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Start error %q, want one containing %q", err, tc.err)
+			}
+			waitDone(t, j)
+
+			st := j.State()
+			if st.Status != StatusFailed || st.ExitCode != exitCodeFailedCgroup {
+				t.Errorf("job %s with code %d, want FAILED with %d", st.Status, st.ExitCode, exitCodeFailedCgroup)
+			}
+			if calls := tc.rec.Calls(); !slices.Equal(calls, tc.calls) {
+				t.Errorf("cgroup calls %q, want %q", calls, tc.calls)
+			}
+			// A process started before the failure was killed and reaped.
+			if pid := j.backend.(Describer).Describe().PID; pid > 0 {
+				if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+					t.Errorf("job process %d left behind: kill 0: %v", pid, err)
+				}
+			}
+		})
+	}
+}
+
+// TestStartCgroupCalls checks a job's cgroup from Start to exit: created
+// with its limits, the process attached, and deleted once it has exited.
+func TestStartCgroupCalls(t *testing.T) {
+	rec := &cgroups.Recorder{}
+	j := newRecordedJob(t, rec, "/bin/true")
+	if err := j.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, j)
+
+	if st := j.State(); st.Status != StatusExited || st.ExitCode != 0 {
+		t.Errorf("job %s with code %d, want EXITED with 0", st.Status, st.ExitCode)
+	}
+	calls := slices.DeleteFunc(rec.Calls(), func(c string) bool { return c == "snapshot" || c == "procs" })
+	want := []string{"create job1 memory.max=1048576 pids.max=16", "attach", "delete job1"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("cgroup calls %q, want %q", calls, want)
+	}
+}
@@ -0,0 +1,203 @@
+package joblib
+
+import (
+	"cmp"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// allowedTransitions is the job lifecycle. Terminal statuses have no way out.
+//
+//	UNKNOWN -> STARTED -> RUNNING -> EXITED
+//	   |          |          |
+//	   |          +--------> STOPPING -> STOPPED
+//	   v          v          v
+//	STOPPED     FAILED     FAILED
+//
+// STOPPING may also end in FAILED when Stop arrives while the backend is
+// still launching and the launch then fails.
+var allowedTransitions = map[Status][]Status{
+	StatusUnknown:  {StatusStarted, StatusStopped},
+	StatusStarted:  {StatusRunning, StatusStopping, StatusFailed},
+	StatusRunning:  {StatusExited, StatusStopping, StatusFailed},
+	StatusStopping: {StatusStopped, StatusFailed},
+}
+
+// Terminal reports whether s is a final status.
+func (s Status) Terminal() bool {
+	return s == StatusExited || s == StatusStopped || s == StatusFailed
+}
+
+func canTransition(from, to Status) bool {
+	for _, s := range allowedTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition is one status change, as delivered to Options.OnTransition.
+type Transition struct {
+	JobID    string
+	From, To Status
+	At       time.Time
+	ExitCode int32  // final exit code when To is terminal
+	Reason   string // why the job ended, when To is terminal; see State.Reason
+	Err      error  // why, when To is FAILED
+}
+
+// State is a consistent snapshot of a job's lifecycle.
+type State struct {
+	Status   Status
+	ExitCode int32
+	// Reason says in words why the job ended the way it did, e.g.
+	// "killed by signal SIGKILL" or the launch error. Empty while the job
+	// is live and when it exited with status 0.
+	Reason string
+	// Entered holds when the job entered each status it has reached.
+	Entered map[Status]time.Time
+}
+
+// FinishedAt is when the job reached its terminal status, or zero.
+func (s State) FinishedAt() time.Time {
+	if !s.Status.Terminal() {
+		return time.Time{}
+	}
+	return s.Entered[s.Status]
+}
+
+// stateMachine guards a job's status and exit code with one mutex, so
+// readers never see a status paired with a stale exit code and every change
+// goes through the transition table.
+type stateMachine struct {
+	jobID string
+	hook  func(Transition)
+
+	// notifyMu serializes hook calls so they are delivered in transition
+	// order; it is held across the hook but mu is not, so the hook may read
+	// the job's state.
+	notifyMu sync.Mutex
+
+	mu       sync.Mutex
+	status   Status
+	exitCode int32
+	reason   string
+	stopWhy  string // reason to record once a stop completes
+	entered  map[Status]time.Time
+	done     chan struct{}
+}
+
+func newStateMachine(jobID string, hook func(Transition)) *stateMachine {
+	return &stateMachine{
+		jobID:    jobID,
+		hook:     hook,
+		status:   StatusUnknown,
+		exitCode: exitCodeUnknown,
+		entered:  map[Status]time.Time{StatusUnknown: time.Now()},
+		done:     make(chan struct{}),
+	}
+}
+
+// move picks the next status from the current one and applies it if the
+// table allows. Entering a terminal status records exitCode and closes
+// done; reason defaults to cause's message, or after a stop is the reason
+// given when entering STOPPING. It returns the status the job was in.
+func (sm *stateMachine) move(next func(cur Status) Status, exitCode int32, reason string, cause error) (Status, error) {
+	sm.notifyMu.Lock()
+	defer sm.notifyMu.Unlock()
+
+	sm.mu.Lock()
+	from := sm.status
+	to := next(from)
+	if !canTransition(from, to) {
+		sm.mu.Unlock()
+		return from, fmt.Errorf("job %s: cannot move %s -> %s", sm.jobID, from, to)
+	}
+	t := Transition{JobID: sm.jobID, From: from, To: to, At: time.Now(), ExitCode: sm.exitCode, Err: cause}
+	sm.status = to
+	sm.entered[to] = t.At
+	if to == StatusStopping {
+		sm.stopWhy = cmp.Or(reason, "stopped by request")
+	}
+	if to.Terminal() {
+		switch {
+		case from == StatusStopping && to == StatusStopped:
+			// Explains the ending better than the signal that carried it out.
+			reason = sm.stopWhy
+		case from == StatusUnknown && to == StatusStopped && reason == "":
+			reason = "stopped before it was started"
+		case reason == "" && cause != nil:
+			reason = cause.Error()
+		}
+		sm.exitCode, sm.reason = exitCode, reason
+		t.ExitCode, t.Reason = exitCode, reason
+		close(sm.done)
+	}
+	sm.mu.Unlock()
+
+	if sm.hook != nil {
+		sm.hook(t)
+	}
+	return from, nil
+}
+
+// transition moves from -> to, failing if the job isn't in from.
+func (sm *stateMachine) transition(from, to Status, exitCode int32, cause error) error {
+	_, err := sm.move(func(cur Status) Status {
+		if cur != from {
+			return cur
+		}
+		return to
+	}, exitCode, "", cause)
+	return err
+}
+
+// requestStop moves a live job to STOPPING, or straight to STOPPED if it
+// never started, recording why (empty for a plain stop request). It returns the status the job was in and
+// whether this call made the change; false means the job was already
+// stopping or finished.
+func (sm *stateMachine) requestStop(why string) (Status, bool) {
+	from, err := sm.move(func(cur Status) Status {
+		if cur == StatusUnknown {
+			return StatusStopped
+		}
+		return StatusStopping
+	}, exitCodeUnknown, why, nil)
+	return from, err == nil
+}
+
+// exited records how a reaped process ended: STOPPED if a stop was pending,
+// EXITED otherwise.
+func (sm *stateMachine) exited(exitCode int32, reason string) error {
+	_, err := sm.move(func(cur Status) Status {
+		if cur == StatusStopping {
+			return StatusStopped
+		}
+		return StatusExited
+	}, exitCode, reason, nil)
+	return err
+}
+
+// failed records a launch failure, whether or not a stop was pending.
+func (sm *stateMachine) failed(exitCode int32, cause error) error {
+	_, err := sm.move(func(Status) Status { return StatusFailed }, exitCode, "", cause)
+	return err
+}
+
+func (sm *stateMachine) snapshot() State {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	entered := make(map[Status]time.Time, len(sm.entered))
+	for s, t := range sm.entered {
+		entered[s] = t
+	}
+	return State{Status: sm.status, ExitCode: sm.exitCode, Reason: sm.reason, Entered: entered}
+}
+
+func (sm *stateMachine) current() (Status, int32) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.status, sm.exitCode
+}
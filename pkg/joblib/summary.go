@@ -0,0 +1,118 @@
+package joblib
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxSummaryLineBytes truncates each logged line so one huge line (binary
+// output, minified JSON) can't bloat the server log.
+const maxSummaryLineBytes = 256
+
+// outputSummary keeps the first and last n lines of a stream.
+type outputSummary struct {
+	head  []string
+	tail  []string // ring buffer once full
+	next  int      // next tail slot to overwrite
+	lines int
+}
+
+func summarizeOutput(r io.Reader, n int) (*outputSummary, error) {
+	s := &outputSummary{}
+	br := bufio.NewReader(r)
+	for {
+		line, err := readLineTruncated(br, maxSummaryLineBytes)
+		if len(line) > 0 || err == nil {
+			s.add(line, n)
+		}
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+}
+
+func (s *outputSummary) add(line string, n int) {
+	s.lines++
+	if len(s.head) < n {
+		s.head = append(s.head, line)
+		return
+	}
+	if len(s.tail) < n {
+		s.tail = append(s.tail, line)
+		return
+	}
+	s.tail[s.next] = line
+	s.next = (s.next + 1) % n
+}
+
+// lastLines returns the tail lines in order.
+func (s *outputSummary) lastLines() []string {
+	return append(append([]string(nil), s.tail[s.next:]...), s.tail[:s.next]...)
+}
+
+// omitted is how many lines fall between head and tail.
+func (s *outputSummary) omitted() int {
+	return s.lines - len(s.head) - len(s.tail)
+}
+
+// readLineTruncated reads one line without its newline, keeping at most max
+// bytes of it.
+func readLineTruncated(br *bufio.Reader, max int) (string, error) {
+	var buf bytes.Buffer
+	cut := false
+	for {
+		frag, err := br.ReadSlice('\n')
+		frag = bytes.TrimSuffix(frag, []byte("\n"))
+		if room := max - buf.Len(); room > 0 {
+			if len(frag) > room {
+				frag, cut = frag[:room], true
+			}
+			buf.Write(frag)
+		} else if len(frag) > 0 {
+			cut = true
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if cut {
+			buf.WriteString("...")
+		}
+		return buf.String(), err
+	}
+}
+
+// logOutputSummary logs the first and last n lines of the job's stdout or
+// stderr. It is a debugging aid; the stream and logs APIs are the real way
+// to read output.
+func (j *Job) logOutputSummary(label string, stderr bool, n int) {
+	rc, err := j.OpenOutput(stderr)
+	if err != nil {
+		j.log.Printf("job %s: failed to open %s: %v", j.id, label, err)
+		return
+	}
+	defer rc.Close()
+
+	s, err := summarizeOutput(rc, n)
+	if err != nil {
+		j.log.Printf("job %s: failed to read %s: %v", j.id, label, err)
+		return
+	}
+	if s.lines == 0 {
+		return
+	}
+
+	j.debug.Printf("job %s: %s: %d lines", j.id, label, s.lines)
+	for _, l := range s.head {
+		j.debug.Printf("job %s: %s| %s", j.id, label, l)
+	}
+	if k := s.omitted(); k > 0 {
+		j.debug.Printf("job %s: %s| ... %d lines omitted ...", j.id, label, k)
+	}
+	for _, l := range s.lastLines() {
+		j.debug.Printf("job %s: %s| %s", j.id, label, l)
+	}
+}
@@ -0,0 +1,157 @@
+package joblib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyDrainTimeout bounds how long Wait keeps copying a terminal's output
+// after the job has exited, in case something outside the job still holds
+// the terminal open.
+const ptyDrainTimeout = 2 * time.Second
+
+// TTYSize is a terminal's window size.
+type TTYSize struct {
+	Rows, Cols uint16
+}
+
+// Resizer is implemented by backends that can run a job on a terminal
+// (Options.TTY), to change its window size.
+type Resizer interface {
+	Resize(TTYSize) error
+}
+
+// ErrNoTTY is returned by Job.Resize for jobs that don't have a terminal,
+// or no longer do.
+var ErrNoTTY = errors.New("job has no terminal")
+
+// Resize changes the window size of the job's terminal; its processes get
+// SIGWINCH.
+func (j *Job) Resize(size TTYSize) error {
+	if r, ok := j.backend.(Resizer); ok {
+		return r.Resize(size)
+	}
+	return ErrNoTTY
+}
+
+// pty is the server's side of a job's terminal: the master, copied to out
+// (the job's stdout output) until the job's side is closed.
+type pty struct {
+	master *os.File
+	out    io.Writer
+	copied chan struct{}
+	closed atomic.Bool
+}
+
+// openPTY opens a terminal of the given size whose output goes to out,
+// for a job running as cred (nil: the server's user), and returns the
+// job's side. Output processing is left on, except that newlines aren't
+// turned into CRLF, so the captured output reads like a pipe's.
+func openPTY(size TTYSize, out io.Writer, cred *syscall.Credential) (*pty, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n int
+	err = control(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("unlock: %w", err)
+		}
+		var err error
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	p := &pty{master: master, out: out, copied: make(chan struct{})}
+	err = control(slave, func(fd int) error {
+		t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		t.Oflag &^= unix.ONLCR
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+			return err
+		}
+		if cred != nil {
+			_ = unix.Fchown(fd, int(cred.Uid), int(cred.Gid)) // best effort, like login
+		}
+		return nil
+	})
+	if err == nil {
+		err = p.resize(size)
+	}
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+	return p, slave, nil
+}
+
+// copy copies the job's terminal output to out until the job's side is
+// closed, or the master is, then closes copied.
+func (p *pty) copy() {
+	defer close(p.copied)
+	_, _ = io.Copy(p.out, p.master) // EIO once the job's side is closed
+}
+
+func (p *pty) resize(size TTYSize) error {
+	ws := &unix.Winsize{Row: size.Rows, Col: size.Cols}
+	if ws.Row == 0 {
+		ws.Row = 24
+	}
+	if ws.Col == 0 {
+		ws.Col = 80
+	}
+	err := control(p.master, func(fd int) error { return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws) })
+	if err != nil && p.closed.Load() {
+		return ErrNoTTY
+	}
+	return err
+}
+
+// close closes the master; the job's terminal is gone after this.
+func (p *pty) close() {
+	p.closed.Store(true)
+	p.master.Close()
+}
+
+// drain waits for the output copy to finish, for up to ptyDrainTimeout,
+// and closes the master.
+func (p *pty) drain() {
+	select {
+	case <-p.copied:
+	case <-time.After(ptyDrainTimeout):
+	}
+	p.close()
+	<-p.copied
+}
+
+// control runs fn on f's descriptor without putting f in blocking mode,
+// which would keep Close from interrupting a Read.
+func control(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
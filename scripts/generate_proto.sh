@@ -15,11 +15,13 @@ if [ ! -d proto/gen/jobpb ]; then
   mkdir -p proto/gen/jobpb
 fi
 
-# Generate Go code from .proto files
+# Generate Go code from .proto files. Each API version is a package under
+# proto/jobworker/ (jobworker.v1 -> proto/jobworker/v1/); its go_package
+# says where the Go code goes.
 protoc \
   --proto_path=proto \
-  --go_out=proto/gen/jobpb \
-  --go_opt=paths=source_relative \
-  --go-grpc_out=proto/gen/jobpb \
-  --go-grpc_opt=paths=source_relative \
-  proto/job.proto
+  --go_out=. \
+  --go_opt=module=github.com/bucknercd/jobworker \
+  --go-grpc_out=. \
+  --go-grpc_opt=module=github.com/bucknercd/jobworker \
+  proto/jobworker/v1/job.proto
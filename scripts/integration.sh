@@ -0,0 +1,136 @@
+#!/bin/bash
+
+# End-to-end check of the real server and jobctl without root: the server
+# runs against a temp-dir stand-in for cgroupfs (-fake-cgroups) and a temp
+# job root, and jobs run as the invoking user. Exercises start, status,
+# stream and stop over mTLS.
+#
+#   ./scripts/integration.sh            (or: make test.integration)
+#   KEEP=1 ./scripts/integration.sh     keep the temp dir for inspection
+
+set -euo pipefail
+
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+GO=${GO:-go}
+PORT=${PORT:-$((20000 + RANDOM % 20000))}
+ADDR=127.0.0.1:$PORT
+
+WORK=$(mktemp -d)
+SERVER_PID=
+
+cleanup() {
+    if [ -n "$SERVER_PID" ]; then
+        kill "$SERVER_PID" 2>/dev/null || true
+        wait "$SERVER_PID" 2>/dev/null || true
+    fi
+    if [ -n "${KEEP:-}" ]; then
+        echo ">>> kept $WORK"
+    else
+        rm -rf "$WORK"
+    fi
+}
+trap cleanup EXIT
+
+fail() {
+    echo "FAIL: $*" >&2
+    echo "---- server log ----" >&2
+    cat "$WORK/server.log" "$WORK/server.stderr" >&2 2>/dev/null || true
+    exit 1
+}
+
+echo ">>> building"
+(cd "$ROOT" && $GO build -o "$WORK/bin/jobworker-server" ./cmd/jobworker-server)
+(cd "$ROOT" && $GO build -o "$WORK/bin/jobctl" ./cmd/jobctl)
+
+echo ">>> generating certs"
+mkdir -p "$WORK/certs"
+cp "$ROOT/certs/Makefile" "$WORK/certs/"
+make -s -C "$WORK/certs" server >/dev/null 2>&1
+echo alice | make -s -C "$WORK/certs" user >/dev/null 2>&1
+
+# What the kernel would show on a cgroup v2 mount and in a fresh child.
+CG=$WORK/cgroup
+mkdir -p "$CG/jobs"
+for d in "$CG" "$CG/jobs"; do
+    echo "cpu cpuset memory io pids" > "$d/cgroup.controllers"
+    : > "$d/cgroup.subtree_control"
+done
+
+SERVER_FLAGS=(
+    -certs "$WORK/certs"
+    -jobs-dir "$WORK/jobs"
+    -cgroup-root "$CG"
+    -fake-cgroups
+    -run-as "$(id -u):$(id -g)"
+)
+
+echo ">>> preflight"
+"$WORK/bin/jobworker-server" "${SERVER_FLAGS[@]}" -check >"$WORK/check.out" || { cat "$WORK/check.out"; fail "preflight"; }
+grep -q '^WARN  cgroup v2' "$WORK/check.out" || fail "preflight didn't flag the fake cgroupfs"
+
+echo ">>> starting server on $ADDR"
+"$WORK/bin/jobworker-server" "${SERVER_FLAGS[@]}" \
+    -listen "$ADDR" \
+    -log "$WORK/server.log" \
+    >"$WORK/server.stderr" 2>&1 &
+SERVER_PID=$!
+
+jobctl() {
+    "$WORK/bin/jobctl" -addr "$ADDR" -certs "$WORK/certs" "$@"
+}
+
+for _ in $(seq 50); do
+    jobctl -cmd list >/dev/null 2>&1 && break
+    kill -0 "$SERVER_PID" 2>/dev/null || fail "server exited"
+    sleep 0.1
+done
+
+# wait_status ID STATUS: poll until the job reaches JOB_STATUS_<STATUS>
+# and print its status line.
+wait_status() {
+    local out
+    for _ in $(seq 50); do
+        out=$(jobctl -cmd status -id "$1")
+        case "$out" in *"status=JOB_STATUS_$2 "*) echo "$out"; return 0 ;; esac
+        sleep 0.1
+    done
+    echo "job $1 never reached $2: $out" >&2
+    return 1
+}
+
+# jobctl splits -args on whitespace, so anything needing quoting is a script.
+cat > "$WORK/hello.sh" <<'EOF'
+#!/bin/sh
+echo hello
+echo oops >&2
+EOF
+chmod +x "$WORK/hello.sh"
+
+echo ">>> start / stream / status"
+ID=$(jobctl -cmd start -exe "$WORK/hello.sh") || fail "start"
+wait_status "$ID" EXITED | grep -q 'exit_code=0' || fail "exit code"
+[ "$(jobctl -cmd stream -id "$ID")" = hello ] || fail "stdout"
+[ "$(jobctl -cmd stream -id "$ID" -target stderr)" = oops ] || fail "stderr"
+[ -f "$WORK/jobs/$ID/stdout.log" ] || fail "output not under -jobs-dir"
+
+echo ">>> non-zero exit"
+ID=$(jobctl -cmd start -exe false) || fail "start false"
+wait_status "$ID" EXITED | grep -q 'reason="exited with code 1"' || fail "exit reason"
+
+echo ">>> limits land in the job cgroup"
+ID=$(jobctl -cmd start -exe sleep -args 30 -mem 64M -cpu 500m -pids 32) || fail "start sleep"
+wait_status "$ID" RUNNING >/dev/null || fail "sleep not running"
+[ "$(cat "$CG/jobs/$ID/memory.max")" = 67108864 ] || fail "memory.max"
+[ "$(cat "$CG/jobs/$ID/cpu.max")" = "50000 100000" ] || fail "cpu.max"
+[ "$(cat "$CG/jobs/$ID/pids.max")" = 32 ] || fail "pids.max"
+
+echo ">>> stop"
+jobctl -cmd stop -id "$ID" | grep -q 'status=JOB_STATUS_STOPPED' || fail "stop"
+[ ! -d "$CG/jobs/$ID" ] || fail "cgroup not removed"
+
+echo ">>> rejected before start"
+if jobctl -cmd start -exe no-such-binary >/dev/null 2>&1; then
+    fail "unknown executable accepted"
+fi
+
+echo ">>> integration tests passed"